@@ -67,16 +67,21 @@ type IMonitor interface {
 	SegmentCacheInc()
 	SegmentCacheDec()
 
-	ConversationCacheSet(v int) // 最近会话缓存数量
-	TmpChannelCacheCountInc()   // 临时频道缓存数量递增
-	TmpChannelCacheCountDec()   // 临时频道缓存数量递减
-	ChannelCacheCountInc()      // 频道缓存数量递增
-	ChannelCacheCountDec()      // 频道缓存数量递减
+	ConversationCacheSet(v int)  // 最近会话缓存数量
+	ConversationPurgedAdd(v int) // 超过TTL被清理的最近会话数量
+	TmpChannelCacheCountInc()    // 临时频道缓存数量递增
+	TmpChannelCacheCountDec()    // 临时频道缓存数量递减
+	ChannelCacheCountInc()       // 频道缓存数量递增
+	ChannelCacheCountDec()       // 频道缓存数量递减
 
 	InFlightMessagesSet(v int) // 投递中的消息
 
 	OnlineUserInc() // 在线用户递增
 	OnlineUserDec() // 在线用户递减
+
+	DeliveryDevicesObserve(devices int, count int) // count条消息投递给了devices个在线设备
+
+	MessageFilterObserve(filter string, result string, v time.Duration) // 消息过滤器耗时记录
 }
 
 type monitorEmpty struct {
@@ -127,6 +132,8 @@ func (m *monitorEmpty) SegmentCacheDec() {}
 
 func (m *monitorEmpty) ConversationCacheSet(v int) {}
 
+func (m *monitorEmpty) ConversationPurgedAdd(v int) {}
+
 func (m *monitorEmpty) TmpChannelCacheCountInc() {}
 
 func (m *monitorEmpty) TmpChannelCacheCountDec() {}
@@ -143,4 +150,8 @@ func (m *monitorEmpty) RecvPacketInc(persist bool) {}
 func (m *monitorEmpty) OnlineUserInc() {}
 func (m *monitorEmpty) OnlineUserDec() {}
 
+func (m *monitorEmpty) DeliveryDevicesObserve(devices int, count int) {}
+
+func (m *monitorEmpty) MessageFilterObserve(filter string, result string, v time.Duration) {}
+
 func (m *monitorEmpty) SendSystemMsgInc() {}
@@ -24,6 +24,10 @@ type Prometheus struct {
 
 	onlineUserGauge prometheus.Gauge
 
+	deliveryDevicesHistogram prometheus.Histogram // 每条消息投递的在线设备数
+
+	messageFilterHistogram *prometheus.HistogramVec // 消息过滤器耗时（按过滤器和结果）
+
 	// ---------------- 上行 ----------------
 	upstreamCounter               prometheus.Counter
 	upstreamPackageTrafficCounter prometheus.Counter
@@ -42,7 +46,8 @@ type Prometheus struct {
 	topicCacheGauge   prometheus.Gauge // topic缓存数量
 	segmentCacheGauge prometheus.Gauge // segment缓存数量
 
-	conversationCacheCountGauge prometheus.Gauge // 最近会话缓存数量
+	conversationCacheCountGauge prometheus.Gauge   // 最近会话缓存数量
+	conversationPurgedCounter   prometheus.Counter // 超过TTL被清理的最近会话数量
 
 	stopChan chan struct{}
 
@@ -143,6 +148,24 @@ func NewPrometheus() IMonitor {
 	prometheus.MustRegister(inFlightMessagesGauge)
 	prometheus.MustRegister(onlineUserGauge)
 
+	deliveryDevicesHistogram := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "delivery_devices",
+		Help:      "每条消息投递的在线设备数（1，2，3+）",
+		Buckets:   []float64{1, 2},
+	})
+	prometheus.MustRegister(deliveryDevicesHistogram)
+
+	messageFilterHistogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "message_filter_histogram",
+		Help:      "消息过滤器耗时（result为pass，rewrite，reject，timeout，error）",
+		Buckets:   []float64{0.001, 0.002, 0.005, 0.01, 0.05, 0.1, 0.2, 0.5, 1, 2, 5},
+	}, []string{"filter", "result"})
+	prometheus.MustRegister(messageFilterHistogram)
+
 	// ---------------- 上行 ----------------
 	upstreamCounter := prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: namespace,
@@ -251,7 +274,15 @@ func NewPrometheus() IMonitor {
 	prometheus.MustRegister(slotCacheGauge)
 	prometheus.MustRegister(topicCacheGauge)
 	prometheus.MustRegister(segmentCacheGauge)
+	conversationPurgedCounter := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "conversation_purged",
+		Help:      "超过TTL被清理的最近会话数量",
+	})
+
 	prometheus.MustRegister(conversationCacheCountGauge)
+	prometheus.MustRegister(conversationPurgedCounter)
 
 	sample := 60
 
@@ -277,6 +308,8 @@ func NewPrometheus() IMonitor {
 		sendPacketCounter:         sendPacketCounter,
 		recvPacketCounter:         recvPacketCounter,
 		onlineUserGauge:           onlineUserGauge,
+		deliveryDevicesHistogram:  deliveryDevicesHistogram,
+		messageFilterHistogram:    messageFilterHistogram,
 		sendSystemMsgIncCounter:   sendSystemMsgIncCounter,
 		stopChan:                  make(chan struct{}),
 		connNumFifo:               wkutil.NewFIFO(sample),
@@ -290,6 +323,7 @@ func NewPrometheus() IMonitor {
 		topicCacheGauge:             topicCacheGauge,
 		segmentCacheGauge:           segmentCacheGauge,
 		conversationCacheCountGauge: conversationCacheCountGauge,
+		conversationPurgedCounter:   conversationPurgedCounter,
 		inFlightMessagesGauge:       inFlightMessagesGauge,
 	}
 }
@@ -449,6 +483,10 @@ func (p *Prometheus) ConversationCacheSet(v int) {
 	p.conversationCacheCountGauge.Set(float64(v))
 }
 
+func (p *Prometheus) ConversationPurgedAdd(v int) {
+	p.conversationPurgedCounter.Add(float64(v))
+}
+
 func (p *Prometheus) TmpChannelCacheCountInc() {
 	p.tmpChannelCacheCountGauge.Inc()
 }
@@ -484,6 +522,16 @@ func (p *Prometheus) OnlineUserDec() {
 	p.onlineUserGauge.Dec()
 }
 
+func (p *Prometheus) DeliveryDevicesObserve(devices int, count int) {
+	for i := 0; i < count; i++ {
+		p.deliveryDevicesHistogram.Observe(float64(devices))
+	}
+}
+
+func (p *Prometheus) MessageFilterObserve(filter string, result string, v time.Duration) {
+	p.messageFilterHistogram.With(prometheus.Labels{"filter": filter, "result": result}).Observe(float64(v) / (1000 * 1000 * 1000))
+}
+
 func (p *Prometheus) SendSystemMsgInc() {
 	p.sendSystemMsgIncCounter.Inc()
 }
@@ -97,6 +97,11 @@ func (ch *ChannelAPI) channelCreateOrUpdate(c *wkhttp.Context) {
 		ch.Error("创建频道失败！", zap.Error(err))
 		return
 	}
+	_, err = ch.s.conversationManager.DeleteConversationsByChannel(req.ChannelID, req.ChannelType)
+	if err != nil {
+		c.ResponseError(err)
+		return
+	}
 	err = ch.s.store.RemoveAllSubscriber(req.ChannelID, req.ChannelType)
 	if err != nil {
 		ch.Error("移除所有订阅者失败！", zap.Error(err))
@@ -135,6 +140,13 @@ func (ch *ChannelAPI) updateOrAddChannelInfo(c *wkhttp.Context) {
 	if channel != nil {
 		channel.ChannelInfo = channelInfo
 	}
+	if ch.s.opts.Conversation.ChannelInfo && (req.Name != "" || req.Avatar != "") {
+		err = ch.s.conversationManager.RefreshConversationChannelInfo(req.ChannelID, req.ChannelType, req.Name, req.Avatar)
+		if err != nil {
+			c.ResponseError(errors.New("刷新最近会话的频道信息失败！"))
+			return
+		}
+	}
 	c.ResponseOK()
 }
 
@@ -229,6 +241,9 @@ func (ch *ChannelAPI) addSubscriberWithReq(req subscriberAddReq, channel *Channe
 			return err
 		}
 		channel.AddSubscribers(newSubscribers)
+		if err = ch.s.conversationManager.OnUserJoinedChannel(newSubscribers, req.ChannelID, req.ChannelType); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -259,19 +274,13 @@ func (ch *ChannelAPI) removeSubscriber(c *wkhttp.Context) {
 	if req.TempSubscriber == 1 {
 		channel.RemoveTmpSubscribers(req.Subscribers)
 	} else {
-		err = ch.s.store.RemoveSubscribers(req.ChannelID, req.ChannelType, req.Subscribers)
+		channel.RemoveSubscribers(req.Subscribers) // 先从内存移除，之后的消息不再发给这些订阅者
+		err = ch.s.conversationManager.OnUserLeftChannel(req.Subscribers, req.ChannelID, req.ChannelType)
 		if err != nil {
 			ch.Error("移除订阅者失败！", zap.Error(err))
 			c.ResponseError(err)
 			return
 		}
-		channel.RemoveSubscribers(req.Subscribers)
-		err = ch.s.conversationManager.DeleteConversation(req.Subscribers, req.ChannelID, req.ChannelType)
-		if err != nil {
-			ch.Error("删除最近会话失败！", zap.Error(err))
-			c.ResponseError(err)
-			return
-		}
 	}
 
 	c.ResponseOK()
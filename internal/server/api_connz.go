@@ -151,6 +151,9 @@ type ConnInfo struct {
 	Device       string    `json:"device"`        // 设备
 	DeviceID     string    `json:"device_id"`     // 设备ID
 	Version      uint8     `json:"version"`       // 客户端协议版本
+
+	ProtoVersions []wknet.ProtoVersionChange `json:"proto_versions"` // 协议版本的协商记录（第一个为第一次协商的版本）
+	TCPInfo       *wknet.TCPInfo             `json:"tcp_info"`       // 最后一次采样的tcp链路质量（开启tcpInfoSampleInterval才有）
 }
 
 func newConnInfo(c wknet.Conn) *ConnInfo {
@@ -183,6 +186,9 @@ func newConnInfo(c wknet.Conn) *ConnInfo {
 		Device:       device(c),
 		DeviceID:     c.DeviceID(),
 		Version:      uint8(c.ProtoVersion()),
+
+		ProtoVersions: c.ProtoVersionHistory(),
+		TCPInfo:       connStats.LastTCPInfo.Load(),
 	}
 }
 
@@ -3,6 +3,7 @@ package server
 import (
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"sort"
 	"strconv"
@@ -11,7 +12,9 @@ import (
 	"github.com/WuKongIM/WuKongIM/pkg/wkhttp"
 	"github.com/WuKongIM/WuKongIM/pkg/wklog"
 	"github.com/WuKongIM/WuKongIM/pkg/wkstore"
+	"github.com/WuKongIM/WuKongIM/pkg/wkutil"
 	wkproto "github.com/WuKongIM/WuKongIMGoProto"
+	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 )
 
@@ -29,12 +32,36 @@ func NewConversationAPI(s *Server) *ConversationAPI {
 	}
 }
 
+// conversationsVersionHeader 同步最近会话时返回用户最近会话版本号的响应头（没有传conversations_version并且缓存里有还没保存的修改时不返回）
+const conversationsVersionHeader = "X-Conversations-Version"
+
+// conversationsReadMetaHeader 同步最近会话时请求了debug返回结果来源的响应头（json格式的ConversationReadMeta）
+const conversationsReadMetaHeader = "X-Conversations-Read-Meta"
+
+// conversationsTotalHeader 同步最近会话时返回满足条件的最近会话总数的响应头（limit截断前，客户端显示会话数量用）
+const conversationsTotalHeader = "X-Conversations-Total"
+
 // Route 路由
 func (s *ConversationAPI) Route(r *wkhttp.WKHttp) {
 	r.GET("/conversations", s.conversationsList)                    // 获取会话列表
+	r.GET("/conversations/page", s.conversationsPage)               // 分页获取会话列表
 	r.POST("/conversations/clearUnread", s.clearConversationUnread) // 清空会话未读数量
 	r.POST("/conversations/setUnread", s.setConversationUnread)     // 设置会话未读数量
+	r.POST("/conversations/readTo", s.setConversationsReadTo)       // 批量设置会话已读到的消息位置
+	r.POST("/conversations/setPinned", s.setConversationPinned)     // 置顶或取消置顶会话
+	r.POST("/conversations/setMute", s.setConversationMute)         // 设置会话免打扰
+	r.POST("/conversations/setExtra", s.setConversationExtra)       // 设置会话扩展数据
+	r.POST("/conversations/setArchived", s.setConversationArchived) // 归档或取消归档会话
+	r.GET("/conversations/archived", s.archivedConversations)       // 获取已归档的会话列表
+	r.POST("/conversations/incMention", s.incConversationMention)   // 增加（或减少）会话的提及数量
+	r.POST("/conversations/incUnread", s.incConversationUnread)     // 增加（或减少）会话未读数量
+	r.POST("/conversations/fixUnread", s.fixConversationUnread)     // 按已读位置重新计算用户所有会话的未读数量
 	r.POST("/conversations/delete", s.deleteConversation)           // 删除会话
+	r.POST("/conversations/ensure", s.ensureConversations)          // 给频道成员创建空的会话（已存在的不修改）
+	r.POST("/conversations/cas", s.conversationsCAS)                // 按版本号写入会话，版本号不一致时返回409和当前的会话
+	r.POST("/conversations/messageRecalled", s.messageRecalled)     // 频道消息撤回后修正会话的未读数量和最后一条消息
+	r.POST("/conversations/messageEdited", s.messageEdited)         // 频道消息编辑后更新最后一条消息是它的会话的版本号
+	r.GET("/conversations/changes", s.conversationChanges)          // 增量同步会话（版本号之后的修改和删除）
 	r.POST("/conversation/sync", s.syncUserConversation)            // 同步会话
 	r.POST("/conversation/syncMessages", s.syncRecentMessages)      // 同步会话最近消息
 }
@@ -47,36 +74,77 @@ func (s *ConversationAPI) conversationsList(c *wkhttp.Context) {
 		return
 	}
 	conversations := s.s.conversationManager.GetConversations(uid, 0, nil)
-	conversationResps := make([]conversationResp, 0)
-	if len(conversations) > 0 {
-		for _, conversation := range conversations {
-			fakeChannelID := conversation.ChannelID
-			if conversation.ChannelType == wkproto.ChannelTypePerson {
-				fakeChannelID = GetFakeChannelIDWith(uid, conversation.ChannelID)
-			}
-			// 获取到偏移位内的指定最大条数的最新消息
-			message, err := s.s.store.LoadMsg(fakeChannelID, conversation.ChannelType, conversation.LastMsgSeq)
-			if err != nil {
-				s.Error("Failed to query recent news", zap.Error(err))
-				c.ResponseError(err)
-				return
-			}
-			messageResp := &MessageResp{}
-			if message != nil {
-				messageResp.from(message.(*Message), s.s.store)
-			}
-			conversationResps = append(conversationResps, conversationResp{
-				ChannelID:   conversation.ChannelID,
-				ChannelType: conversation.ChannelType,
-				Unread:      conversation.UnreadCount,
-				Timestamp:   conversation.Timestamp,
-				LastMessage: messageResp,
-			})
-		}
+	conversationResps, err := s.toConversationResps(uid, conversations)
+	if err != nil {
+		s.Error("Failed to query recent news", zap.Error(err))
+		c.ResponseError(err)
+		return
 	}
 	c.JSON(http.StatusOK, conversationResps)
 }
 
+// 分页获取会话列表（按最后一条消息的时间从新到旧）
+func (s *ConversationAPI) conversationsPage(c *wkhttp.Context) {
+	uid := c.Query("uid")
+	if strings.TrimSpace(uid) == "" {
+		c.ResponseError(errors.New("uid cannot be empty"))
+		return
+	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit <= 0 {
+		limit = 100
+	}
+	conversations, cursor, meta, err := s.s.conversationManager.GetConversationsWithCursorMeta(uid, c.Query("cursor"), limit)
+	if err != nil {
+		c.ResponseError(err)
+		return
+	}
+	conversationResps, err := s.toConversationResps(uid, conversations)
+	if err != nil {
+		s.Error("Failed to query recent news", zap.Error(err))
+		c.ResponseError(err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"conversations": conversationResps,
+		"cursor":        cursor, // 下一页的游标，为空表示没有更多了
+		"has_more":      meta.HasMore,
+		"total":         meta.Total,
+	})
+}
+
+func (s *ConversationAPI) toConversationResps(uid string, conversations []*wkstore.Conversation) ([]conversationResp, error) {
+	conversationResps := make([]conversationResp, 0, len(conversations))
+	for _, conversation := range conversations {
+		fakeChannelID := conversation.ChannelID
+		if conversation.ChannelType == wkproto.ChannelTypePerson {
+			fakeChannelID = GetFakeChannelIDWith(uid, conversation.ChannelID)
+		}
+		// 获取到偏移位内的指定最大条数的最新消息
+		message, err := s.s.store.LoadMsg(fakeChannelID, conversation.ChannelType, conversation.LastMsgSeq)
+		if err != nil {
+			return nil, err
+		}
+		messageResp := &MessageResp{}
+		if message != nil {
+			messageResp.from(message.(*Message), s.s.store)
+		}
+		conversationResps = append(conversationResps, conversationResp{
+			ChannelID:    conversation.ChannelID,
+			ChannelType:  conversation.ChannelType,
+			Unread:       conversation.UnreadCount,
+			Timestamp:    conversation.Timestamp,
+			PinnedAt:     conversation.PinnedAt,
+			Mute:         conversation.Mute,
+			Extra:        conversation.Extra,
+			Archived:     conversation.Archived,
+			LastMessage:  messageResp,
+			MentionCount: conversation.MentionCount,
+		})
+	}
+	return conversationResps, nil
+}
+
 // 清楚会话未读数量
 func (s *ConversationAPI) clearConversationUnread(c *wkhttp.Context) {
 	var req clearConversationUnreadReq
@@ -107,6 +175,46 @@ func (s *ConversationAPI) clearConversationUnread(c *wkhttp.Context) {
 	c.ResponseOK()
 }
 
+// 批量设置会话已读到的消息位置（比如全部标记为已读），返回有修改的会话
+func (s *ConversationAPI) setConversationsReadTo(c *wkhttp.Context) {
+	var req struct {
+		UID   string `json:"uid"`
+		Items []struct {
+			ChannelID       string `json:"channel_id"`
+			ChannelType     uint8  `json:"channel_type"`
+			ReadToMsgSeq    uint32 `json:"read_to_msg_seq"`
+			CreateIfMissing bool   `json:"create_if_missing"` // 会话不存在时创建，不然已读位置会丢失
+			ResetMentions   bool   `json:"reset_mentions"`    // 提及数量清零（已读位置已经超过最后一条提及用户的消息）
+		} `json:"items"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	if req.UID == "" {
+		c.ResponseError(errors.New("UID cannot be empty"))
+		return
+	}
+	items := make([]wkstore.ConversationReadTo, 0, len(req.Items))
+	for _, item := range req.Items {
+		if item.ChannelID == "" || item.ChannelType == 0 {
+			c.ResponseError(errors.New("channel_id or channel_type cannot be empty"))
+			return
+		}
+		items = append(items, wkstore.ConversationReadTo{ChannelID: item.ChannelID, ChannelType: item.ChannelType, ReadToMsgSeq: item.ReadToMsgSeq, CreateIfMissing: item.CreateIfMissing, ResetMentions: item.ResetMentions})
+	}
+	changed, err := s.s.conversationManager.UpdateConversationsReadToMsgSeq(req.UID, items)
+	if err != nil {
+		c.ResponseError(err)
+		return
+	}
+	resps := make([]gin.H, 0, len(changed))
+	for _, key := range changed {
+		resps = append(resps, gin.H{"channel_id": key.ChannelID, "channel_type": key.ChannelType})
+	}
+	c.JSON(http.StatusOK, resps)
+}
+
 func (s *ConversationAPI) setConversationUnread(c *wkhttp.Context) {
 	var req struct {
 		UID         string `json:"uid"`
@@ -148,6 +256,329 @@ func (s *ConversationAPI) setConversationUnread(c *wkhttp.Context) {
 	c.ResponseOK()
 }
 
+// 置顶或取消置顶会话
+func (s *ConversationAPI) setConversationPinned(c *wkhttp.Context) {
+	var req struct {
+		UID         string `json:"uid"`
+		ChannelID   string `json:"channel_id"`
+		ChannelType uint8  `json:"channel_type"`
+		Pinned      bool   `json:"pinned"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	if req.UID == "" {
+		c.ResponseError(errors.New("UID cannot be empty"))
+		return
+	}
+	if req.ChannelID == "" || req.ChannelType == 0 {
+		c.ResponseError(errors.New("channel_id or channel_type cannot be empty"))
+		return
+	}
+	if _, err := s.s.conversationManager.SetConversationPinned(req.UID, req.ChannelID, req.ChannelType, req.Pinned); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	c.ResponseOK()
+}
+
+// 设置会话免打扰
+func (s *ConversationAPI) setConversationMute(c *wkhttp.Context) {
+	var req struct {
+		UID         string `json:"uid"`
+		ChannelID   string `json:"channel_id"`
+		ChannelType uint8  `json:"channel_type"`
+		Mute        uint8  `json:"mute"` // 1开启 0关闭
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	if req.UID == "" {
+		c.ResponseError(errors.New("UID cannot be empty"))
+		return
+	}
+	if req.ChannelID == "" || req.ChannelType == 0 {
+		c.ResponseError(errors.New("channel_id or channel_type cannot be empty"))
+		return
+	}
+	if _, err := s.s.conversationManager.SetConversationMute(req.UID, req.ChannelID, req.ChannelType, req.Mute); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	c.ResponseOK()
+}
+
+// 设置会话扩展数据（整体替换，传空清除）
+func (s *ConversationAPI) setConversationExtra(c *wkhttp.Context) {
+	var req struct {
+		UID         string            `json:"uid"`
+		ChannelID   string            `json:"channel_id"`
+		ChannelType uint8             `json:"channel_type"`
+		Extra       map[string]string `json:"extra"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	if req.UID == "" {
+		c.ResponseError(errors.New("UID cannot be empty"))
+		return
+	}
+	if req.ChannelID == "" || req.ChannelType == 0 {
+		c.ResponseError(errors.New("channel_id or channel_type cannot be empty"))
+		return
+	}
+	if _, err := s.s.conversationManager.SetConversationExtra(req.UID, req.ChannelID, req.ChannelType, req.Extra); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	c.ResponseOK()
+}
+
+// 归档或取消归档会话（不影响未读数）
+func (s *ConversationAPI) setConversationArchived(c *wkhttp.Context) {
+	var req struct {
+		UID         string `json:"uid"`
+		ChannelID   string `json:"channel_id"`
+		ChannelType uint8  `json:"channel_type"`
+		Archived    bool   `json:"archived"` // true归档 false取消归档
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	if req.UID == "" {
+		c.ResponseError(errors.New("UID cannot be empty"))
+		return
+	}
+	if req.ChannelID == "" || req.ChannelType == 0 {
+		c.ResponseError(errors.New("channel_id or channel_type cannot be empty"))
+		return
+	}
+	if _, err := s.s.conversationManager.SetConversationArchived(req.UID, req.ChannelID, req.ChannelType, req.Archived); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	c.ResponseOK()
+}
+
+// 增加会话的提及（@）数量，delta为负数时减少，比如群里@用户的消息发送后由业务服务调用
+func (s *ConversationAPI) incConversationMention(c *wkhttp.Context) {
+	var req struct {
+		UID         string `json:"uid"`
+		ChannelID   string `json:"channel_id"`
+		ChannelType uint8  `json:"channel_type"`
+		Delta       int    `json:"delta"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	if req.UID == "" {
+		c.ResponseError(errors.New("UID cannot be empty"))
+		return
+	}
+	if req.ChannelID == "" || req.ChannelType == 0 {
+		c.ResponseError(errors.New("channel_id or channel_type cannot be empty"))
+		return
+	}
+	conversation, err := s.s.conversationManager.IncConversationMentionCount(req.UID, req.ChannelID, req.ChannelType, req.Delta)
+	if err != nil {
+		c.ResponseError(err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"mention_count": conversation.MentionCount})
+}
+
+// 按版本号写入会话，有一条会话的版本号和expected_version不一致时都不写入，返回409和当前的会话（不存在时为null），调用方合并后用它的版本号重试
+func (s *ConversationAPI) conversationsCAS(c *wkhttp.Context) {
+	var req conversationCASReq
+	if err := c.BindJSON(&req); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	if err := req.Check(); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	conversations, err := s.s.conversationManager.AddOrUpdateConversationsCAS(req.UID, req.toConversationCAS())
+	if err != nil {
+		var conflict *wkstore.VersionConflictError
+		if !errors.As(err, &conflict) {
+			c.ResponseError(err)
+			return
+		}
+		var current *syncUserConversationResp
+		if conflict.Current != nil {
+			current = newSyncUserConversationResp(conflict.Current)
+		}
+		c.JSON(http.StatusConflict, gin.H{
+			"channel_id":       conflict.Key.ChannelID,
+			"channel_type":     conflict.Key.ChannelType,
+			"expected_version": conflict.Expected,
+			"current":          current,
+		})
+		return
+	}
+	resps := make([]*syncUserConversationResp, 0, len(conversations))
+	for _, conversation := range conversations {
+		resps = append(resps, newSyncUserConversationResp(conversation))
+	}
+	c.JSON(http.StatusOK, resps)
+}
+
+// 原子地增加（或减少）会话未读数量，并发调用不会互相覆盖，create_if_missing为true时会话不存在则新建
+func (s *ConversationAPI) incConversationUnread(c *wkhttp.Context) {
+	var req struct {
+		UID             string `json:"uid"`
+		ChannelID       string `json:"channel_id"`
+		ChannelType     uint8  `json:"channel_type"`
+		Delta           int    `json:"delta"`
+		CreateIfMissing bool   `json:"create_if_missing"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	if req.UID == "" {
+		c.ResponseError(errors.New("UID cannot be empty"))
+		return
+	}
+	if req.ChannelID == "" || req.ChannelType == 0 {
+		c.ResponseError(errors.New("channel_id or channel_type cannot be empty"))
+		return
+	}
+	conversation, err := s.s.conversationManager.IncConversationUnread(req.UID, req.ChannelID, req.ChannelType, req.Delta, req.CreateIfMissing)
+	if err != nil {
+		c.ResponseError(err)
+		return
+	}
+	if conversation == nil {
+		c.ResponseError(errors.New("conversation not found"))
+		return
+	}
+	conversation = s.s.conversationManager.GetConversation(req.UID, req.ChannelID, req.ChannelType) // 缓存里可能有还没保存的未读数
+	c.JSON(http.StatusOK, gin.H{"unread": conversation.UnreadCount})
+}
+
+// 按已读位置和频道最新的消息重新计算用户所有会话的未读数量，返回修正的会话（运维核对未读数的偏差）
+func (s *ConversationAPI) fixConversationUnread(c *wkhttp.Context) {
+	var req struct {
+		UID string `json:"uid"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	if req.UID == "" {
+		c.ResponseError(errors.New("UID cannot be empty"))
+		return
+	}
+	report, err := s.s.conversationManager.RecalculateConversationUnread(req.UID)
+	if err != nil {
+		c.ResponseError(err)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// 频道消息撤回后修正订阅者会话的未读数量和最后一条消息，由业务服务撤回消息后调用（同一条消息重复调用不会重复减少未读数）
+func (s *ConversationAPI) messageRecalled(c *wkhttp.Context) {
+	var req channelMessageReq
+	if err := c.BindJSON(&req); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	if err := req.Check(); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	if err := s.s.conversationManager.OnMessageRecalled(req.ChannelID, req.ChannelType, req.MessageSeq); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	c.ResponseOK()
+}
+
+// 频道消息编辑后更新最后一条消息是它的会话的版本号，客户端增量同步时重新获取最后一条消息，由业务服务编辑消息后调用
+func (s *ConversationAPI) messageEdited(c *wkhttp.Context) {
+	var req channelMessageReq
+	if err := c.BindJSON(&req); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	if err := req.Check(); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	if err := s.s.conversationManager.OnMessageEdited(req.ChannelID, req.ChannelType, req.MessageSeq); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	c.ResponseOK()
+}
+
+// 获取已归档的会话列表（按最后一条消息的时间从新到旧）
+func (s *ConversationAPI) archivedConversations(c *wkhttp.Context) {
+	uid := c.Query("uid")
+	if strings.TrimSpace(uid) == "" {
+		c.ResponseError(errors.New("uid cannot be empty"))
+		return
+	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	conversations, err := s.s.conversationManager.GetArchivedConversations(uid, limit)
+	if err != nil {
+		c.ResponseError(err)
+		return
+	}
+	conversationResps, err := s.toConversationResps(uid, conversations)
+	if err != nil {
+		s.Error("Failed to query recent news", zap.Error(err))
+		c.ResponseError(err)
+		return
+	}
+	c.JSON(http.StatusOK, conversationResps)
+}
+
+// conversationChanges 版本号大于version的会话和删除的会话，按版本号从小到大，客户端用返回的version继续同步
+func (s *ConversationAPI) conversationChanges(c *wkhttp.Context) {
+	uid := c.Query("uid")
+	if strings.TrimSpace(uid) == "" {
+		c.ResponseError(errors.New("uid cannot be empty"))
+		return
+	}
+	version, _ := strconv.ParseUint(c.Query("version"), 10, 64)
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	changes, err := s.s.conversationManager.GetConversationsUpdatedSince(uid, version, limit)
+	if err != nil {
+		c.ResponseError(err)
+		return
+	}
+	conversationResps, err := s.toConversationResps(uid, changes.Conversations)
+	if err != nil {
+		s.Error("Failed to query recent news", zap.Error(err))
+		c.ResponseError(err)
+		return
+	}
+	deleted := make([]*wkstore.ConversationTombstone, 0, len(changes.Deleted))
+	for _, tombstone := range changes.Deleted {
+		channelID := tombstone.ChannelID
+		if tombstone.ChannelType == wkproto.ChannelTypePerson {
+			channelID = GetFakeChannelIDWith(uid, channelID)
+		}
+		deleted = append(deleted, &wkstore.ConversationTombstone{ChannelID: channelID, ChannelType: tombstone.ChannelType, Version: tombstone.Version})
+	}
+	c.JSON(http.StatusOK, &conversationChangesResp{
+		Conversations: conversationResps,
+		Deleted:       deleted,
+		Version:       changes.Version,
+		More:          changes.More,
+		Reset:         changes.Reset,
+	})
+}
+
 func (s *ConversationAPI) deleteConversation(c *wkhttp.Context) {
 	var req deleteChannelReq
 	if err := c.BindJSON(&req); err != nil {
@@ -169,19 +600,111 @@ func (s *ConversationAPI) deleteConversation(c *wkhttp.Context) {
 	c.ResponseOK()
 }
 
+// 给频道成员创建空的会话，比如群创建后由业务服务调用，没有消息时也显示在成员的会话列表里，返回创建，跳过（已存在）和失败的会话
+func (s *ConversationAPI) ensureConversations(c *wkhttp.Context) {
+	var req ensureConversationsReq
+	if err := c.BindJSON(&req); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	if err := req.Check(); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	result, err := s.s.conversationManager.EnsureConversations(req.UIDs, req.ChannelID, req.ChannelType)
+	if err != nil && result == nil {
+		c.ResponseError(err)
+		return
+	}
+	resp := gin.H{
+		"written": len(result.Written),
+		"skipped": len(result.Skipped),
+		"failed":  conversationKeyUIDs(result.Failed),
+	}
+	if err != nil {
+		resp["msg"] = err.Error()
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func conversationKeyUIDs(keys []wkstore.ConversationKey) []string {
+	uids := make([]string, 0, len(keys))
+	for _, key := range keys {
+		uids = append(uids, key.UID)
+	}
+	return uids
+}
+
 func (s *ConversationAPI) syncUserConversation(c *wkhttp.Context) {
 	var req struct {
-		UID         string             `json:"uid"`
-		Version     int64              `json:"version"`       // 当前客户端的会话最大版本号(客户端最新会话的时间戳)
-		LastMsgSeqs string             `json:"last_msg_seqs"` // 客户端所有会话的最后一条消息序列号 格式： channelID:channelType:last_msg_seq|channelID:channelType:last_msg_seq
-		MsgCount    int64              `json:"msg_count"`     // 每个会话消息数量
-		Larges      []*wkproto.Channel `json:"larges"`        // 超大频道集合
+		UID           string             `json:"uid"`
+		Version       int64              `json:"version"`        // 当前客户端的会话最大版本号(客户端最新会话的时间戳)
+		VersionBefore int64              `json:"version_before"` // 只同步版本号小于此值的会话（客户端加载更早的会话时传当前最小的版本号）
+		Limit         int                `json:"limit"`          // 最多同步的会话数量 0表示不限制
+		LastMsgSeqs   string             `json:"last_msg_seqs"`  // 客户端所有会话的最后一条消息序列号 格式： channelID:channelType:last_msg_seq|channelID:channelType:last_msg_seq
+		MsgCount      int64              `json:"msg_count"`      // 每个会话消息数量
+		Larges        []*wkproto.Channel `json:"larges"`         // 超大频道集合
+		ExcludeMuted  bool               `json:"exclude_muted"`  // 不同步开启了免打扰的会话
+		Debug         bool               `json:"debug"`          // 响应头X-Conversations-Read-Meta返回结果的来源（是否来自缓存等）
+		FirstUnread   bool               `json:"first_unread"`   // 返回第一条未读消息的seq（需要额外查询消息，客户端跳转到第一条未读时才需要）
+		// IncludeArchived 同时同步已归档的会话（默认不同步）
+		IncludeArchived bool `json:"include_archived"`
+		// IncludeChannelTypes 只同步这些频道类型的会话，和exclude_channel_types只能设置一个
+		IncludeChannelTypes []int `json:"include_channel_types"`
+		ExcludeChannelTypes []int `json:"exclude_channel_types"` // 不同步这些频道类型的会话
+		// ConversationsVersion 客户端上次全量同步（没有version_before，limit，超大频道和过滤条件）时响应头X-Conversations-Version返回的最近会话版本号，同样全量同步时和服务端一致则返回304
+		ConversationsVersion uint64 `json:"conversations_version"`
 	}
 	if err := c.BindJSON(&req); err != nil {
 		s.Error("格式有误！", zap.Error(err))
 		c.ResponseError(err)
 		return
 	}
+	if len(req.IncludeChannelTypes) > 0 && len(req.ExcludeChannelTypes) > 0 {
+		c.ResponseError(errors.New("include_channel_types和exclude_channel_types不能同时设置！"))
+		return
+	}
+	includeChannelTypes, err := toChannelTypes(req.IncludeChannelTypes)
+	if err != nil {
+		c.ResponseError(err)
+		return
+	}
+	excludeChannelTypes, err := toChannelTypes(req.ExcludeChannelTypes)
+	if err != nil {
+		c.ResponseError(err)
+		return
+	}
+	query := ConversationQuery{
+		Version:             req.Version,
+		VersionBefore:       req.VersionBefore,
+		Limit:               req.Limit,
+		Larges:              req.Larges,
+		ExcludeMuted:        req.ExcludeMuted,
+		IncludeArchived:     req.IncludeArchived,
+		IncludeChannelTypes: includeChannelTypes,
+		ExcludeChannelTypes: excludeChannelTypes,
+	}
+	// 客户端传了版本号并且是全量同步时才需要先保存缓存里的修改再比较，其他时候有还没保存的修改就不返回版本号（不为了响应头写数据库）
+	fullSync := req.VersionBefore == 0 && req.Limit == 0 && len(req.Larges) == 0 && !req.ExcludeMuted && !req.IncludeArchived && !query.filterChannelTypes()
+	var (
+		conversationsVersion uint64
+		versionOK            bool
+	)
+	if req.ConversationsVersion > 0 && fullSync {
+		conversationsVersion, err = s.s.conversationManager.GetConversationVersion(req.UID)
+		versionOK = err == nil
+	} else {
+		conversationsVersion, versionOK, err = s.s.conversationManager.PeekConversationVersion(req.UID)
+	}
+	if err != nil {
+		s.Warn("获取最近会话版本号失败！", zap.Error(err), zap.String("uid", req.UID))
+	} else if versionOK {
+		c.Header(conversationsVersionHeader, strconv.FormatUint(conversationsVersion, 10))
+		if req.ConversationsVersion > 0 && req.ConversationsVersion == conversationsVersion && fullSync {
+			c.Status(http.StatusNotModified)
+			return
+		}
+	}
 	// msgCount := req.MsgCount
 	// if msgCount == 0 {
 	// 	msgCount = 100
@@ -201,7 +724,12 @@ func (s *ConversationAPI) syncUserConversation(c *wkhttp.Context) {
 		channelLastMsgMap[fmt.Sprintf("%s-%d", channelID, channelTypeI)] = uint32(lastMsgSeq)
 	}
 
-	conversations := s.s.conversationManager.GetConversations(req.UID, req.Version, req.Larges)
+	conversations, readMeta := s.s.conversationManager.GetConversationsWithMeta(req.UID, query)
+	c.Header(conversationsTotalHeader, strconv.Itoa(readMeta.Total))
+	if req.Debug {
+		c.Header(conversationsReadMetaHeader, wkutil.ToJson(readMeta))
+		s.Info("同步最近会话", zap.String("uid", req.UID), zap.Int("count", len(conversations)), zap.Bool("fromCache", readMeta.FromCache), zap.Int64("cacheAgeMs", readMeta.CacheAgeMs), zap.Int("scanKeys", readMeta.ScanKeys))
+	}
 	var newConversations = make([]*wkstore.Conversation, 0, len(conversations)+20)
 	if conversations != nil {
 		newConversations = append(newConversations, conversations...)
@@ -254,10 +782,26 @@ func (s *ConversationAPI) syncUserConversation(c *wkhttp.Context) {
 		}
 	}
 
+	var firstUnreads map[wkstore.ConversationKey]uint32
+	if req.FirstUnread {
+		keys := make([]wkstore.ConversationKey, 0, len(newConversations))
+		for _, conversation := range newConversations {
+			if conversation.UnreadCount > 0 {
+				keys = append(keys, wkstore.ConversationKey{UID: req.UID, ChannelID: conversation.ChannelID, ChannelType: conversation.ChannelType})
+			}
+		}
+		firstUnreads, err = s.s.conversationManager.GetConversationsFirstUnread(req.UID, keys)
+		if err != nil {
+			s.Warn("查询第一条未读消息失败！", zap.Error(err), zap.String("uid", req.UID))
+		}
+	}
 	resps := make([]*syncUserConversationResp, 0, len(newConversations))
 	if len(newConversations) > 0 {
 		for _, conversation := range newConversations {
 			syncUserConversationR := newSyncUserConversationResp(conversation)
+			if conversation.UnreadCount > 0 {
+				syncUserConversationR.FirstUnreadSeq = firstUnreads[wkstore.ConversationKey{UID: req.UID, ChannelID: conversation.ChannelID, ChannelType: conversation.ChannelType}]
+			}
 			resps = append(resps, syncUserConversationR)
 
 			msgSeq := channelLastMsgMap[fmt.Sprintf("%s-%d", conversation.ChannelID, conversation.ChannelType)]
@@ -349,3 +893,18 @@ func (s *ConversationAPI) getRecentMessages(uid string, msgCount int, channels [
 	}
 	return channelRecentMessages, nil
 }
+
+// toChannelTypes 请求里的频道类型转换为uint8（json里的[]uint8是base64字符串，所以请求用[]int）
+func toChannelTypes(values []int) ([]uint8, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	channelTypes := make([]uint8, 0, len(values))
+	for _, v := range values {
+		if v < 0 || v > math.MaxUint8 {
+			return nil, fmt.Errorf("频道类型[%d]不合法！", v)
+		}
+		channelTypes = append(channelTypes, uint8(v))
+	}
+	return channelTypes, nil
+}
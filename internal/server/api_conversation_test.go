@@ -0,0 +1,347 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/WuKongIM/WuKongIM/pkg/wkhttp"
+	"github.com/WuKongIM/WuKongIM/pkg/wkstore"
+	"github.com/WuKongIM/WuKongIM/pkg/wkutil"
+	wkproto "github.com/WuKongIM/WuKongIMGoProto"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+func newTestConversationAPI(t *testing.T) (*Server, *wkhttp.WKHttp) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	t.Cleanup(func() { s.store.Close() })
+	s.conversationManager.Start()
+	t.Cleanup(s.conversationManager.Stop)
+
+	r := wkhttp.New()
+	NewConversationAPI(s).Route(r)
+	return s, r
+}
+
+func postJSON(r *wkhttp.WKHttp, path string, body interface{}) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, path, strings.NewReader(wkutil.ToJSON(body)))
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func syncConversationsByAPI(t *testing.T, r *wkhttp.WKHttp, uid string, version int64) []*syncUserConversationResp {
+	w := postJSON(r, "/conversation/sync", map[string]interface{}{"uid": uid, "version": version})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resps []*syncUserConversationResp
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resps))
+	return resps
+}
+
+func TestConversationAPIMessageRecalledAndEdited(t *testing.T) {
+	s, r := newTestConversationAPI(t)
+	cm := s.conversationManager
+
+	assert.NoError(t, s.store.AddSubscribers("g1", wkproto.ChannelTypeGroup, []string{"u1", "u2"}))
+	for seq := uint32(1); seq <= 3; seq++ {
+		cm.calConversation(&Message{
+			RecvPacket: &wkproto.RecvPacket{
+				Framer:      wkproto.Framer{RedDot: true},
+				MessageID:   int64(seq),
+				MessageSeq:  seq,
+				ClientMsgNo: fmt.Sprintf("no%d", seq),
+				ChannelID:   "g1",
+				ChannelType: wkproto.ChannelTypeGroup,
+				FromUID:     "u2",
+				Timestamp:   int32(time.Now().Unix()),
+			},
+		}, "u1")
+	}
+	resps := syncConversationsByAPI(t, r, "u1", 0)
+	assert.Len(t, resps, 1)
+	assert.Equal(t, 3, resps[0].Unread)
+	version := resps[0].Version
+	time.Sleep(time.Millisecond * 2)
+
+	// 撤回未读的消息，业务服务重试同一条消息时未读数只减少一次
+	for i := 0; i < 3; i++ {
+		w := postJSON(r, "/conversations/messageRecalled", map[string]interface{}{"channel_id": "g1", "channel_type": wkproto.ChannelTypeGroup, "message_seq": 2})
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+	resps = syncConversationsByAPI(t, r, "u1", version)
+	assert.Len(t, resps, 1)
+	assert.Equal(t, 2, resps[0].Unread)
+	assert.Equal(t, "no3", resps[0].LastClientMsgNo)
+	cm.FlushConversations()
+	conversation, err := s.store.GetConversation("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, conversation.UnreadCount)
+
+	// 编辑最后一条消息后增量同步能拿到
+	version = resps[0].Version
+	assert.Empty(t, syncConversationsByAPI(t, r, "u1", version))
+	time.Sleep(time.Millisecond * 2)
+	w := postJSON(r, "/conversations/messageEdited", map[string]interface{}{"channel_id": "g1", "channel_type": wkproto.ChannelTypeGroup, "message_seq": 3})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	resps = syncConversationsByAPI(t, r, "u1", version)
+	assert.Len(t, resps, 1)
+	assert.Equal(t, 2, resps[0].Unread)
+
+	w = postJSON(r, "/conversations/messageRecalled", map[string]interface{}{"channel_id": "g1", "channel_type": wkproto.ChannelTypeGroup})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestConversationAPIEnsureConversations(t *testing.T) {
+	s, r := newTestConversationAPI(t)
+	cm := s.conversationManager
+
+	// u1缓存里有还没保存的会话，u2数据库里已有会话，只给u3创建
+	cm.AddOrUpdateConversation("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 1, Timestamp: time.Now().Unix()})
+	assert.NoError(t, s.store.AddOrUpdateConversations("u2", []*wkstore.Conversation{{UID: "u2", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 2}}))
+
+	w := postJSON(r, "/conversations/ensure", map[string]interface{}{"channel_id": "g1", "channel_type": wkproto.ChannelTypeGroup, "uids": []string{"u1", "u2", "u3"}})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		Written int      `json:"written"`
+		Skipped int      `json:"skipped"`
+		Failed  []string `json:"failed"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, 1, resp.Written)
+	assert.Equal(t, 2, resp.Skipped)
+	assert.Empty(t, resp.Failed)
+
+	for uid, unread := range map[string]int{"u1": 1, "u2": 2, "u3": 0} {
+		resps := syncConversationsByAPI(t, r, uid, 0)
+		assert.Len(t, resps, 1, uid)
+		assert.Equal(t, unread, resps[0].Unread, uid)
+	}
+
+	w = postJSON(r, "/conversations/ensure", map[string]interface{}{"channel_id": "u2", "channel_type": wkproto.ChannelTypePerson, "uids": []string{"u1"}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestConversationAPISyncVersionHeader(t *testing.T) {
+	s, r := newTestConversationAPI(t)
+	cm := s.conversationManager
+
+	assert.NoError(t, s.store.AddOrUpdateConversations("u1", []*wkstore.Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 3, LastMsgSeq: 3, Version: 1},
+	}))
+	w := postJSON(r, "/conversation/sync", map[string]interface{}{"uid": "u1"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "1", w.Header().Get(conversationsVersionHeader))
+
+	// 缓存里有还没保存的修改，客户端没有传版本号时不保存，也不返回版本号
+	assert.NoError(t, cm.SetConversationUnread("u1", "g1", wkproto.ChannelTypeGroup, 0, 3))
+	assert.Eventually(t, func() bool { return cm.needSave("u1") }, time.Second, time.Millisecond) // saveloop异步标记
+	w = postJSON(r, "/conversation/sync", map[string]interface{}{"uid": "u1"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get(conversationsVersionHeader))
+	assert.True(t, cm.needSave("u1"))
+
+	// 客户端传了版本号时先保存再比较
+	w = postJSON(r, "/conversation/sync", map[string]interface{}{"uid": "u1", "conversations_version": 1})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Header().Get(conversationsVersionHeader))
+	assert.False(t, cm.needSave("u1"))
+	w = postJSON(r, "/conversation/sync", map[string]interface{}{"uid": "u1", "conversations_version": 2})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+}
+
+func TestConversationAPIIncUnread(t *testing.T) {
+	s, r := newTestConversationAPI(t)
+	cm := s.conversationManager
+
+	// 缓存里有还没保存的未读数，返回在缓存的未读数上修改后的值
+	cm.AddOrUpdateConversation("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 2, Timestamp: time.Now().Unix()})
+	w := postJSON(r, "/conversations/incUnread", map[string]interface{}{"uid": "u1", "channel_id": "g1", "channel_type": wkproto.ChannelTypeGroup, "delta": 3, "create_if_missing": true})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `{"unread":5}`, w.Body.String())
+	w = postJSON(r, "/conversations/incUnread", map[string]interface{}{"uid": "u1", "channel_id": "g1", "channel_type": wkproto.ChannelTypeGroup, "delta": -10})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `{"unread":0}`, w.Body.String())
+
+	// 不存在的会话不新建时返回错误
+	w = postJSON(r, "/conversations/incUnread", map[string]interface{}{"uid": "u1", "channel_id": "g2", "channel_type": wkproto.ChannelTypeGroup, "delta": 1})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = postJSON(r, "/conversations/incUnread", map[string]interface{}{"uid": "u1", "channel_id": "g2", "channel_type": wkproto.ChannelTypeGroup, "delta": 1, "create_if_missing": true})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `{"unread":1}`, w.Body.String())
+
+	resps := syncConversationsByAPI(t, r, "u1", 0)
+	assert.Len(t, resps, 2)
+	w = postJSON(r, "/conversations/incUnread", map[string]interface{}{"channel_id": "g2", "channel_type": wkproto.ChannelTypeGroup, "delta": 1})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestConversationAPICASConcurrent(t *testing.T) {
+	s, r := newTestConversationAPI(t)
+
+	// 多个节点同时给同一个会话的未读数加1，冲突时用返回的当前会话重试，最后没有丢失的修改
+	const writers = 10
+	var (
+		wg        sync.WaitGroup
+		conflicts atomic.Int32
+	)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var unread int
+			var version int64
+			for {
+				w := postJSON(r, "/conversations/cas", map[string]interface{}{
+					"uid": "u1",
+					"conversations": []map[string]interface{}{
+						{"channel_id": "g1", "channel_type": wkproto.ChannelTypeGroup, "unread": unread + 1, "expected_version": version},
+					},
+				})
+				if w.Code == http.StatusOK {
+					var resps []*syncUserConversationResp
+					assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resps))
+					assert.Len(t, resps, 1)
+					return
+				}
+				if !assert.Equal(t, http.StatusConflict, w.Code, w.Body.String()) {
+					return
+				}
+				conflicts.Inc()
+				var conflict struct {
+					Current *syncUserConversationResp `json:"current"`
+				}
+				assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &conflict))
+				unread, version = conflict.Current.Unread, conflict.Current.Version
+			}
+		}()
+	}
+	wg.Wait()
+	assert.GreaterOrEqual(t, int(conflicts.Load()), writers-1) // 都期望会话还不存在，只有一个能直接写入
+
+	conversation, err := s.store.GetConversation("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.NoError(t, err)
+	assert.Equal(t, writers, conversation.UnreadCount)
+	resps := syncConversationsByAPI(t, r, "u1", 0)
+	assert.Len(t, resps, 1)
+	assert.Equal(t, writers, resps[0].Unread)
+	assert.Equal(t, conversation.Version, resps[0].Version)
+
+	// 会话不存在时当前会话为null
+	w := postJSON(r, "/conversations/cas", map[string]interface{}{
+		"uid":           "u1",
+		"conversations": []map[string]interface{}{{"channel_id": "g2", "channel_type": wkproto.ChannelTypeGroup, "unread": 1, "expected_version": 1}},
+	})
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), `"current":null`)
+
+	w = postJSON(r, "/conversations/cas", map[string]interface{}{"uid": "u1"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestSystemAPIMigrateConversationsChannel(t *testing.T) {
+	s, r := newTestConversationAPI(t)
+	NewSystemAPI(s).Route(r)
+	cm := s.conversationManager
+
+	assert.NoError(t, s.store.AddSubscribers("g1", wkproto.ChannelTypeGroup, []string{"u1", "u2"}))
+	assert.NoError(t, s.store.AddOrUpdateConversations("u2", []*wkstore.Conversation{{UID: "u2", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 1, LastMsgSeq: 1}}))
+	// u1缓存里有还没保存的会话，迁移前保存
+	cm.AddOrUpdateConversation("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 2, LastMsgSeq: 2, Timestamp: time.Now().Unix()})
+	assert.Eventually(t, func() bool { return cm.needSave("u1") }, time.Second, time.Millisecond) // saveloop异步标记
+	migrate := map[string]interface{}{"old_channel_id": "g1", "old_channel_type": wkproto.ChannelTypeGroup, "new_channel_id": "sg1", "new_channel_type": wkproto.ChannelTypeCommunity, "dry_run": true}
+
+	w := postJSON(r, "/system/conversation/migrate_channel", migrate)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `{"dry_run":true,"migrated":1}`, w.Body.String()) // DryRun不保存缓存，只有u2的会话在数据库里
+	assert.NotNil(t, cm.GetConversation("u1", "g1", wkproto.ChannelTypeGroup))
+
+	before := cm.ConversationInvalidateStats()
+	migrate["dry_run"] = false
+	w = postJSON(r, "/system/conversation/migrate_channel", migrate)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `{"dry_run":false,"migrated":2}`, w.Body.String())
+	// 迁移后通过失效队列清除迁移的用户的缓存
+	assert.Equal(t, int64(2), cm.ConversationInvalidateStats().Enqueued-before.Enqueued)
+	assert.Eventually(t, func() bool {
+		stats := cm.ConversationInvalidateStats()
+		return stats.Depth == 0 && stats.Processed-before.Processed == 2
+	}, time.Second, time.Millisecond*10)
+	for uid, unread := range map[string]int{"u1": 2, "u2": 1} {
+		resps := syncConversationsByAPI(t, r, uid, 0)
+		assert.Len(t, resps, 1, uid)
+		assert.Equal(t, "sg1", resps[0].ChannelID, uid)
+		assert.Equal(t, unread, resps[0].Unread, uid)
+	}
+
+	migrate["new_channel_id"], migrate["new_channel_type"] = "g1", wkproto.ChannelTypeGroup
+	w = postJSON(r, "/system/conversation/migrate_channel", migrate)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestSystemAPIDeleteUserAndChannelData(t *testing.T) {
+	s, r := newTestConversationAPI(t)
+	NewSystemAPI(s).Route(r)
+	cm := s.conversationManager
+
+	assert.NoError(t, s.store.AddSubscribers("g1", wkproto.ChannelTypeGroup, []string{"u1", "u2"}))
+	assert.NoError(t, s.store.AddSubscribers("g2", wkproto.ChannelTypeGroup, []string{"u1", "u2"}))
+	for _, uid := range []string{"u1", "u2"} {
+		for _, channelID := range []string{"g1", "g2"} {
+			assert.NoError(t, s.store.AddOrUpdateConversations(uid, []*wkstore.Conversation{{UID: uid, ChannelID: channelID, ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 1, LastMsgSeq: 1}}))
+		}
+		// 缓存里有还没保存的修改
+		cm.AddOrUpdateConversation(uid, &wkstore.Conversation{UID: uid, ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 2, LastMsgSeq: 2, Timestamp: time.Now().Unix()})
+	}
+
+	var report wkstore.CleanupReport
+	w := postJSON(r, "/system/user/delete_data", map[string]interface{}{"uid": "u1", "dry_run": true})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.True(t, report.DryRun)
+	assert.Len(t, syncConversationsByAPI(t, r, "u1", 0), 2)
+
+	// 删除用户后缓存里还没保存的会话也不会再写回去
+	w = postJSON(r, "/system/user/delete_data", map[string]interface{}{"uid": "u1"})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.True(t, report.Done)
+	assert.Nil(t, cm.getConversationFromCache("u1", "g1", wkproto.ChannelTypeGroup))
+	cm.FlushConversations()
+	assert.Empty(t, syncConversationsByAPI(t, r, "u1", 0))
+	subscribers, err := s.store.GetSubscribers("g1", wkproto.ChannelTypeGroup)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"u2"}, subscribers)
+
+	// 删除频道后通过失效队列清除订阅者的缓存
+	before := cm.ConversationInvalidateStats()
+	w = postJSON(r, "/system/channel/delete_data", map[string]interface{}{"channel_id": "g1", "channel_type": wkproto.ChannelTypeGroup})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.True(t, report.Done)
+	assert.Eventually(t, func() bool {
+		stats := cm.ConversationInvalidateStats()
+		return stats.Depth == 0 && stats.Processed-before.Processed == 1
+	}, time.Second, time.Millisecond*10)
+	cm.FlushConversations()
+	resps := syncConversationsByAPI(t, r, "u2", 0)
+	assert.Len(t, resps, 1)
+	assert.Equal(t, "g2", resps[0].ChannelID)
+	subscribers, err = s.store.GetSubscribers("g1", wkproto.ChannelTypeGroup)
+	assert.NoError(t, err)
+	assert.Empty(t, subscribers)
+
+	w = postJSON(r, "/system/channel/delete_data", map[string]interface{}{"channel_id": "g1"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
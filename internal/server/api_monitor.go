@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -38,13 +39,16 @@ func (m *MonitorAPI) Route(r *wkhttp.WKHttp) {
 	varz := NewVarzAPI(m.s)
 	connz := NewConnzAPI(m.s)
 
-	r.GET("/api/varz", varz.HandleVarz)          // 系统变量
-	r.GET("/api/connz", connz.HandleConnz)       // 系统客户端连接
-	r.GET("/api/metrics", m.s.monitor.Monitor)   // prometheus监控
-	r.GET("/api/chart/realtime", m.realtime)     // 首页实时数据
-	r.GET("/api/channels", m.channels)           // 频道
-	r.GET("/api/messages", m.messages)           // 消息
-	r.GET("/api/conversations", m.conversations) // 最近会话
+	r.GET("/api/varz", varz.HandleVarz)               // 系统变量
+	r.GET("/api/connz", connz.HandleConnz)            // 系统客户端连接
+	r.GET("/api/metrics", m.s.monitor.Monitor)        // prometheus监控
+	r.GET("/api/chart/realtime", m.realtime)          // 首页实时数据
+	r.GET("/api/channels", m.channels)                // 频道
+	r.GET("/api/messages", m.messages)                // 消息
+	r.GET("/api/conversations", m.conversations)      // 最近会话
+	r.GET("/api/delivery", m.delivery)                // 在线投递的设备扇出统计
+	r.GET("/api/memory", m.memory)                    // 存储层内存使用量
+	r.GET("/api/conversation/ops", m.conversationOps) // 按频道类型统计的最近会话操作次数
 	// r.GET("/chart/upstream_packet_count", m.upstreamPacketCount)
 
 	go m.startRealtimePublish() // 开启实时数据推送
@@ -53,6 +57,25 @@ func (m *MonitorAPI) Route(r *wkhttp.WKHttp) {
 
 }
 
+func (m *MonitorAPI) delivery(c *wkhttp.Context) {
+	c.JSON(http.StatusOK, m.s.deliveryManager.DeliveryStats())
+}
+
+func (m *MonitorAPI) memory(c *wkhttp.Context) {
+	usage := m.s.store.MemoryUsage()
+	c.JSON(http.StatusOK, gin.H{
+		"usage":    usage,
+		"budget":   m.s.opts.StoreMemoryBudget,
+		"pressure": m.s.store.MemoryPressure().String(),
+	})
+}
+
+func (m *MonitorAPI) conversationOps(c *wkhttp.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"ops": m.s.store.ConversationOpStats(),
+	})
+}
+
 func (m *MonitorAPI) realtime(c *wkhttp.Context) {
 	last := c.Query("last")
 	connNums := m.s.monitor.ConnNums()
@@ -372,13 +395,23 @@ func (m *MonitorAPI) conversations(c *wkhttp.Context) {
 		return
 	}
 
+	channelType, _ := strconv.ParseUint(c.Query("channel_type"), 10, 8) // 不传或0表示不按频道类型过滤
+
 	conversationResults := make([]*syncUserConversationResp, 0)
 	if m.s.opts.Conversation.On {
-		conversations := m.s.conversationManager.GetConversations(uid, 0, nil)
-		if len(conversations) > 0 {
-			for _, conversation := range conversations {
-				conversationResults = append(conversationResults, newSyncUserConversationResp(conversation))
-			}
+		conversations := conversationSlice{}
+		err := m.s.conversationManager.IterateConversations(uid, wkstore.ConversationIterOptions{Context: c.Request.Context(), ChannelType: uint8(channelType)}, func(conversation wkstore.Conversation) bool {
+			conversations = append(conversations, &conversation)
+			return true
+		})
+		if err != nil {
+			m.Error("Failed to iterate conversations", zap.String("uid", uid), zap.Error(err))
+			c.ResponseError(err)
+			return
+		}
+		sort.Sort(conversations)
+		for _, conversation := range conversations {
+			conversationResults = append(conversationResults, newSyncUserConversationResp(conversation))
 		}
 	}
 
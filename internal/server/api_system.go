@@ -1,11 +1,17 @@
 package server
 
 import (
+	"bytes"
 	"errors"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/WuKongIM/WuKongIM/pkg/wkhttp"
 	"github.com/WuKongIM/WuKongIM/pkg/wklog"
+	"github.com/WuKongIM/WuKongIM/pkg/wkstore"
+	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 )
 
@@ -24,9 +30,22 @@ func NewSystemAPI(s *Server) *SystemAPI {
 
 // Route Route
 func (s *SystemAPI) Route(r *wkhttp.WKHttp) {
-	r.POST("/system/ip/blacklist_add", s.ipBlacklistAdd)       // 添加ip黑名单
-	r.POST("/system/ip/blacklist_remove", s.ipBlacklistRemove) // 移除ip白名单
-	r.GET("/system/ip/blacklist", s.ipBlacklist)               // 获取ip黑名单列表
+	r.POST("/system/ip/blacklist_add", s.ipBlacklistAdd)                                    // 添加ip黑名单
+	r.POST("/system/ip/blacklist_remove", s.ipBlacklistRemove)                              // 移除ip白名单
+	r.GET("/system/ip/blacklist", s.ipBlacklist)                                            // 获取ip黑名单列表
+	r.GET("/system/debug", s.debugStatus)                                                   // 获取调试设置
+	r.POST("/system/debug", s.debugSet)                                                     // 修改调试设置（慢日志阈值，调试uid，调试连接）
+	r.GET("/system/conversation/stats", s.conversationStats)                                // 最近会话统计
+	r.POST("/system/conversation/search", s.conversationSearch)                             // 按条件搜索最近会话
+	r.POST("/system/conversation/snapshot", s.conversationSnapshot)                         // 保存用户最近会话快照
+	r.GET("/system/conversation/snapshots", s.conversationSnapshots)                        // 用户最近会话快照列表
+	r.POST("/system/conversation/restore", s.conversationRestore)                           // 用快照恢复用户最近会话
+	r.POST("/system/conversation/import_read_positions", s.conversationImportReadPositions) // 从其他系统导入已读位置（请求体为csv或ndjson）
+	r.GET("/system/conversation/export", s.conversationExport)                              // 导出用户最近会话（json lines）
+	r.POST("/system/conversation/import", s.conversationImport)                             // 导入导出的最近会话（请求体为json lines，overwrite=1覆盖已存在的）
+	r.POST("/system/conversation/migrate_channel", s.conversationMigrateChannel)            // 频道换了新的频道id后迁移最近会话和订阅关系（dry_run只返回会迁移的数量）
+	r.POST("/system/user/delete_data", s.userDeleteData)                                    // 删除用户的最近会话，订阅关系，快照等数据（dry_run只统计）
+	r.POST("/system/channel/delete_data", s.channelDeleteData)                              // 删除频道的本地用户最近会话，订阅关系等数据（dry_run只统计）
 }
 
 func (s *SystemAPI) ipBlacklistAdd(c *wkhttp.Context) {
@@ -86,3 +105,247 @@ func (s *SystemAPI) ipBlacklist(c *wkhttp.Context) {
 	}
 	c.JSON(http.StatusOK, ips)
 }
+
+func (s *SystemAPI) debugStatus(c *wkhttp.Context) {
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"store":  wkstore.GetDebugStatus(),
+		"engine": s.s.dispatch.engine.DebugStatus(),
+	})
+}
+
+func (s *SystemAPI) debugSet(c *wkhttp.Context) {
+	var req struct {
+		SlowLogThreshold *int64  `json:"slow_log_threshold"` // 慢日志阈值（毫秒），0表示关闭
+		DebugUID         *string `json:"debug_uid"`          // 调试uid，空表示关闭
+		DebugConnID      *int64  `json:"debug_conn_id"`      // 调试连接id，0表示关闭
+	}
+	if err := c.BindJSON(&req); err != nil {
+		s.Error("数据格式有误！", zap.Error(err))
+		c.ResponseError(err)
+		return
+	}
+	if req.SlowLogThreshold != nil {
+		wkstore.SetSlowLogThreshold(time.Duration(*req.SlowLogThreshold) * time.Millisecond)
+	}
+	if req.DebugUID != nil {
+		wkstore.SetDebugUID(*req.DebugUID)
+	}
+	if req.DebugConnID != nil {
+		s.s.dispatch.engine.SetDebugConn(*req.DebugConnID)
+	}
+	s.Info("修改调试设置", zap.Any("store", wkstore.GetDebugStatus()), zap.Any("engine", s.s.dispatch.engine.DebugStatus()))
+	c.ResponseOK()
+}
+
+func (s *SystemAPI) conversationStats(c *wkhttp.Context) {
+	sampleUsers, _ := strconv.Atoi(c.DefaultQuery("sample_users", "10000"))
+	report, err := s.s.store.ConversationStats(c.Request.Context(), sampleUsers)
+	if err != nil {
+		s.Error("最近会话统计失败！", zap.Error(err))
+		c.ResponseError(err)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+func (s *SystemAPI) conversationSearch(c *wkhttp.Context) {
+	var req wkstore.ConversationSearchReq
+	if err := c.BindJSON(&req); err != nil {
+		s.Error("数据格式有误！", zap.Error(err))
+		c.ResponseError(err)
+		return
+	}
+	result, err := s.s.conversationManager.SearchConversations(c.Request.Context(), req)
+	if err != nil {
+		s.Error("搜索最近会话失败！", zap.Error(err))
+		c.ResponseError(err)
+		return
+	}
+	resps := make([]*conversationSearchResp, 0, len(result.Conversations))
+	for _, conversation := range result.Conversations {
+		resps = append(resps, newConversationSearchResp(conversation))
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"total":         result.Total,
+		"conversations": resps,
+		"next_cursor":   result.NextCursor, // 下一页的游标，为空表示没有更多了
+		"has_more":      result.HasMore,
+	})
+}
+
+func (s *SystemAPI) conversationSnapshot(c *wkhttp.Context) {
+	var req struct {
+		UID string `json:"uid"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		s.Error("数据格式有误！", zap.Error(err))
+		c.ResponseError(err)
+		return
+	}
+	if strings.TrimSpace(req.UID) == "" {
+		c.ResponseError(errors.New("uid不能为空！"))
+		return
+	}
+	snapshotID, err := s.s.conversationManager.SnapshotUserConversations(req.UID)
+	if err != nil {
+		c.ResponseError(err)
+		return
+	}
+	c.JSON(http.StatusOK, map[string]string{"snapshot_id": snapshotID})
+}
+
+func (s *SystemAPI) conversationSnapshots(c *wkhttp.Context) {
+	uid := c.Query("uid")
+	if strings.TrimSpace(uid) == "" {
+		c.ResponseError(errors.New("uid不能为空！"))
+		return
+	}
+	snapshots, err := s.s.store.ListUserConversationSnapshots(uid)
+	if err != nil {
+		s.Error("获取最近会话快照失败！", zap.Error(err))
+		c.ResponseError(err)
+		return
+	}
+	c.JSON(http.StatusOK, snapshots)
+}
+
+func (s *SystemAPI) conversationRestore(c *wkhttp.Context) {
+	var req struct {
+		UID        string `json:"uid"`
+		SnapshotID string `json:"snapshot_id"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		s.Error("数据格式有误！", zap.Error(err))
+		c.ResponseError(err)
+		return
+	}
+	if strings.TrimSpace(req.UID) == "" || strings.TrimSpace(req.SnapshotID) == "" {
+		c.ResponseError(errors.New("uid和snapshot_id不能为空！"))
+		return
+	}
+	if err := s.s.conversationManager.RestoreUserConversations(req.UID, req.SnapshotID); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	c.ResponseOK()
+}
+
+func (s *SystemAPI) conversationImportReadPositions(c *wkhttp.Context) {
+	applied, skipped, err := s.s.conversationManager.ImportReadPositions(c.Request.Body)
+	if err != nil {
+		c.ResponseError(err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"applied": applied,
+		"skipped": skipped,
+	})
+}
+
+func (s *SystemAPI) conversationExport(c *wkhttp.Context) {
+	uid := c.Query("uid")
+	if strings.TrimSpace(uid) == "" {
+		c.ResponseError(errors.New("uid不能为空！"))
+		return
+	}
+	var buff bytes.Buffer
+	if _, err := s.s.conversationManager.ExportUserConversations(uid, &buff); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	c.Data(http.StatusOK, "application/x-ndjson", buff.Bytes())
+}
+
+func (s *SystemAPI) conversationImport(c *wkhttp.Context) {
+	overwrite := c.Query("overwrite") == "1" || c.Query("overwrite") == "true"
+	result, err := s.s.conversationManager.ImportConversations(c.Request.Body, overwrite)
+	if err != nil {
+		c.ResponseError(err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func (s *SystemAPI) conversationMigrateChannel(c *wkhttp.Context) {
+	var req struct {
+		OldChannelID   string `json:"old_channel_id"`
+		OldChannelType uint8  `json:"old_channel_type"`
+		NewChannelID   string `json:"new_channel_id"`
+		NewChannelType uint8  `json:"new_channel_type"`
+		DryRun         bool   `json:"dry_run"`
+		RateLimit      int    `json:"rate_limit"` // 每秒最多迁移的用户数量，0表示不限制
+	}
+	if err := c.BindJSON(&req); err != nil {
+		s.Error("数据格式有误！", zap.Error(err))
+		c.ResponseError(err)
+		return
+	}
+	if strings.TrimSpace(req.OldChannelID) == "" || req.OldChannelType == 0 || strings.TrimSpace(req.NewChannelID) == "" || req.NewChannelType == 0 {
+		c.ResponseError(errors.New("新旧频道的频道id和频道类型不能为空！"))
+		return
+	}
+	if req.OldChannelID == req.NewChannelID && req.OldChannelType == req.NewChannelType {
+		c.ResponseError(errors.New("新旧频道不能相同！"))
+		return
+	}
+	keys, err := s.s.conversationManager.MigrateConversationsChannel(req.OldChannelID, req.OldChannelType, req.NewChannelID, req.NewChannelType, wkstore.MaintenanceOptions{
+		DryRun:    req.DryRun,
+		RateLimit: req.RateLimit,
+	})
+	if err != nil {
+		c.ResponseError(err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"dry_run":  req.DryRun,
+		"migrated": len(keys),
+	})
+}
+
+func (s *SystemAPI) userDeleteData(c *wkhttp.Context) {
+	var req struct {
+		UID       string `json:"uid"`
+		DryRun    bool   `json:"dry_run"`
+		RateLimit int    `json:"rate_limit"` // 分批处理时每秒最多处理的数量，0表示不限制
+	}
+	if err := c.BindJSON(&req); err != nil {
+		s.Error("数据格式有误！", zap.Error(err))
+		c.ResponseError(err)
+		return
+	}
+	if strings.TrimSpace(req.UID) == "" {
+		c.ResponseError(errors.New("uid不能为空！"))
+		return
+	}
+	report, err := s.s.conversationManager.DeleteUserData(req.UID, wkstore.MaintenanceOptions{DryRun: req.DryRun, RateLimit: req.RateLimit})
+	s.responseCleanupReport(c, report, err)
+}
+
+func (s *SystemAPI) channelDeleteData(c *wkhttp.Context) {
+	var req struct {
+		ChannelID   string `json:"channel_id"`
+		ChannelType uint8  `json:"channel_type"`
+		DryRun      bool   `json:"dry_run"`
+		RateLimit   int    `json:"rate_limit"` // 分批处理时每秒最多处理的数量，0表示不限制
+	}
+	if err := c.BindJSON(&req); err != nil {
+		s.Error("数据格式有误！", zap.Error(err))
+		c.ResponseError(err)
+		return
+	}
+	if strings.TrimSpace(req.ChannelID) == "" || req.ChannelType == 0 {
+		c.ResponseError(errors.New("channel_id和channel_type不能为空！"))
+		return
+	}
+	report, err := s.s.conversationManager.DeleteChannelData(req.ChannelID, req.ChannelType, wkstore.MaintenanceOptions{DryRun: req.DryRun, RateLimit: req.RateLimit})
+	s.responseCleanupReport(c, report, err)
+}
+
+// responseCleanupReport 返回删除的结果，部分钩子执行失败时也返回已经执行的钩子（done为false，失败的钩子有error），可以重新调用继续删除
+func (s *SystemAPI) responseCleanupReport(c *wkhttp.Context, report *wkstore.CleanupReport, err error) {
+	if err != nil && report == nil {
+		c.ResponseError(err)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -87,6 +87,9 @@ func CreateVarz(s *Server) *Varz {
 		SlowClients: s.slowClients.Load(),
 		RetryQueue:  int64(retryQueueF),
 
+		ConversationInvalidate:  s.conversationManager.ConversationInvalidateStats(),
+		ConversationCacheVerify: s.conversationManager.ConversationCacheVerifyStats(),
+
 		TCPAddr:        opts.External.TCPAddr,
 		WSAddr:         opts.External.WSAddr,
 		WSSAddr:        opts.External.WSSAddr,
@@ -118,6 +121,9 @@ type Varz struct {
 	SlowClients int64 `json:"slow_clients"` // 慢客户端数量
 	RetryQueue  int64 `json:"retry_queue"`  // 重试队列数量
 
+	ConversationInvalidate  *ConversationInvalidateStats  `json:"conversation_invalidate"`   // 最近会话缓存失效队列统计
+	ConversationCacheVerify *ConversationCacheVerifyStats `json:"conversation_cache_verify"` // 最近会话缓存后台校验统计
+
 	TCPAddr     string `json:"tcp_addr"`     // tcp地址
 	WSAddr      string `json:"ws_addr"`      // ws地址
 	WSSAddr     string `json:"wss_addr"`     // wss地址
@@ -25,7 +25,12 @@ type connContext struct {
 	frameCacheLock sync.RWMutex
 	frameCaches    []wkproto.Frame
 	s              *Server
-	inflightCount  int // frame inflight count
+	inflightCount  int    // frame inflight count
+	inSeq          uint64 // 收到的frame的序号，连接内单调递增，在并行处理之前分配
+
+	sendLock    sync.Mutex
+	sendQueue   []sendBatch // 等待处理的SEND包，按seq排序
+	sendRunning bool        // 是否有协程在按顺序处理SEND包
 	wklog.Log
 
 	subscriberInfos    map[string]*wkstore.SubscribeInfo // 订阅的频道数据, key: channel, value: SubscriberInfo
@@ -47,20 +52,57 @@ func (c *connContext) putFrame(frame wkproto.Frame) {
 	defer c.frameCacheLock.Unlock()
 
 	c.inflightCount++
+	c.inSeq++
 	c.frameCaches = append(c.frameCaches, frame)
 	if c.s.opts.UserMsgQueueMaxSize > 0 && int(c.inflightCount) > c.s.opts.UserMsgQueueMaxSize {
 		c.disableRead()
 	}
 }
 
-func (c *connContext) popFrames() []wkproto.Frame {
+// popFrames 取出缓存的frame，firstSeq为第一个frame的序号
+func (c *connContext) popFrames() (frames []wkproto.Frame, firstSeq uint64) {
 	c.frameCacheLock.RLock()
 	defer c.frameCacheLock.RUnlock()
 	newFrames := c.frameCaches[:]
 	// copy(newFrames, c.frameCaches)
 	c.frameCaches = make([]wkproto.Frame, 0, 250)
-	return newFrames
+	return newFrames, c.inSeq - uint64(len(newFrames)) + 1
+
+}
+
+// sendBatch 同一个连接连续的SEND包，seq为第一个包的序号
+type sendBatch struct {
+	seq    uint64
+	frames []wkproto.Frame
+}
 
+// enqueueSend 按seq放入SEND包等待处理，返回true表示需要启动协程处理
+func (c *connContext) enqueueSend(batch sendBatch) bool {
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+	c.sendQueue = append(c.sendQueue, batch)
+	for i := len(c.sendQueue) - 1; i > 0 && c.sendQueue[i-1].seq > batch.seq; i-- {
+		c.sendQueue[i], c.sendQueue[i-1] = c.sendQueue[i-1], c.sendQueue[i]
+	}
+	if c.sendRunning {
+		return false
+	}
+	c.sendRunning = true
+	return true
+}
+
+// nextSend 取出seq最小的SEND包，没有了返回false（处理协程退出）
+func (c *connContext) nextSend() (sendBatch, bool) {
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+	if len(c.sendQueue) == 0 {
+		c.sendRunning = false
+		return sendBatch{}, false
+	}
+	batch := c.sendQueue[0]
+	c.sendQueue[0] = sendBatch{}
+	c.sendQueue = c.sendQueue[1:]
+	return batch, true
 }
 
 func (c *connContext) finishFrames(count int) {
@@ -139,6 +181,7 @@ func (c *connContext) init() {
 
 func (c *connContext) release() {
 	c.inflightCount = 0
+	c.inSeq = 0
 	c.Log = nil
 	c.isDisableRead = false
 	c.frameCaches = nil
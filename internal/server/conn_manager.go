@@ -31,6 +31,9 @@ func (c *ConnManager) AddConn(conn wknet.Conn) {
 	if connIDs == nil {
 		connIDs = make([]int64, 0, 10)
 	}
+	if len(connIDs) == 0 {
+		c.s.monitor.OnlineUserInc()
+	}
 	connIDs = append(connIDs, conn.ID())
 	c.userConnMap[conn.UID()] = connIDs
 	c.connMap[conn.ID()] = conn.Fd().Fd()
@@ -60,11 +63,26 @@ func (c *ConnManager) RemoveConnWithID(id int64) {
 			if connID == conn.ID() {
 				connIDs = append(connIDs[:index], connIDs[index+1:]...)
 				c.userConnMap[conn.UID()] = connIDs
+				if len(connIDs) == 0 {
+					c.s.monitor.OnlineUserDec()
+				}
 			}
 		}
 	}
 }
 
+// OnlineCount 在线用户数和在线连接数
+func (c *ConnManager) OnlineCount() (users int, conns int) {
+	c.RLock()
+	defer c.RUnlock()
+	for _, connIDs := range c.userConnMap {
+		if len(connIDs) > 0 {
+			users++
+		}
+	}
+	return users, len(c.connMap)
+}
+
 func (c *ConnManager) GetConnsWithUID(uid string) []wknet.Conn {
 	c.RLock()
 	defer c.RUnlock()
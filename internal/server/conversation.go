@@ -1,10 +1,13 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sort"
 	"sync"
 	"time"
+	"unsafe"
 
 	"github.com/WuKongIM/WuKongIM/pkg/wklog"
 	"github.com/WuKongIM/WuKongIM/pkg/wkstore"
@@ -21,7 +24,7 @@ type ConversationManager struct {
 	s *Server
 	wklog.Log
 	queue                          *Queue
-	userConversationMapBuckets     []map[string]*lru.Cache[string, *wkstore.Conversation]
+	userConversationMapBuckets     []map[string]*lru.Cache[string, *conversationCacheEntry]
 	userConversationMapBucketLocks []sync.RWMutex
 	bucketNum                      int
 	needSaveConversationMap        map[string]bool
@@ -30,8 +33,24 @@ type ConversationManager struct {
 	calcChan                       chan interface{}
 	needSaveChan                   chan string
 	crontab                        *cron.Cron
+	invalidator                    *conversationInvalidator  // 最近会话缓存失效队列
+	leftChannels                   sync.Map                  // 最近离开频道的用户，key为uid和频道，value为离开时间
+	now                            func() time.Time          // 记录缓存时间使用的时钟（测试时可以替换）
+	warmUpCancel                   context.CancelFunc        // 取消缓存预热，没有开启预热时为nil
+	warmUpDone                     chan struct{}             // 缓存预热结束后关闭
+	verifier                       conversationCacheVerifier // 后台校验缓存和数据库是否一致
+	offlineDigest                  *offlineDigest            // 用户离线后延迟生成未读摘要
 }
 
+// conversationCacheEntry 缓存的最近会话和写入缓存的时间
+type conversationCacheEntry struct {
+	conversation *wkstore.Conversation
+	cachedAt     time.Time
+}
+
+// leftChannelExpire 用户离开频道的记录保留时间，期间队列里还没处理的消息不再更新此用户在此频道的最近会话
+const leftChannelExpire = time.Minute
+
 // NewConversationManager NewConversationManager
 func NewConversationManager(s *Server) *ConversationManager {
 	cm := &ConversationManager{
@@ -43,9 +62,12 @@ func NewConversationManager(s *Server) *ConversationManager {
 		calcChan:                make(chan interface{}),
 		needSaveChan:            make(chan string),
 		queue:                   NewQueue(),
+		now:                     time.Now,
+		offlineDigest:           newOfflineDigest(),
 	}
-	cm.userConversationMapBuckets = make([]map[string]*lru.Cache[string, *wkstore.Conversation], cm.bucketNum)
+	cm.userConversationMapBuckets = make([]map[string]*lru.Cache[string, *conversationCacheEntry], cm.bucketNum)
 	cm.userConversationMapBucketLocks = make([]sync.RWMutex, cm.bucketNum)
+	cm.invalidator = newConversationInvalidator(s.opts.Conversation.InvalidateRate, s.opts.Conversation.InvalidateWindow, cm.isUserActive, cm.invalidateUserConversations)
 
 	s.Schedule(time.Minute, func() {
 		totalConversation := 0
@@ -60,6 +82,16 @@ func NewConversationManager(s *Server) *ConversationManager {
 		s.monitor.ConversationCacheSet(totalConversation)
 	})
 
+	s.Schedule(time.Minute, cm.clearLeftChannels)
+
+	if len(s.opts.Conversation.TTL) > 0 && s.opts.Conversation.CleanupInterval > 0 {
+		s.Schedule(s.opts.Conversation.CleanupInterval, cm.cleanupExpiredConversations)
+	}
+
+	if s.opts.Conversation.CacheVerifySampleRate > 0 && s.opts.Conversation.CacheVerifyInterval > 0 {
+		s.Schedule(s.opts.Conversation.CacheVerifyInterval, cm.verifyConversationCache)
+	}
+
 	cm.crontab = cron.New(cron.WithSeconds())
 
 	cm.crontab.AddFunc("0 0 2 * * ?", cm.clearExpireConversations) // 每条凌晨2点执行一次
@@ -72,7 +104,11 @@ func (cm *ConversationManager) Start() {
 	if cm.s.opts.Conversation.On {
 		go cm.saveloop()
 		go cm.calcLoop()
+		cm.invalidator.start()
 		cm.crontab.Start()
+		if cm.s.opts.Conversation.WarmUp && !cm.s.opts.Conversation.CacheDisabled {
+			cm.startWarmUp()
+		}
 	}
 
 }
@@ -80,6 +116,7 @@ func (cm *ConversationManager) Start() {
 // Stop Stop
 func (cm *ConversationManager) Stop() {
 	if cm.s.opts.Conversation.On {
+		cm.stopWarmUp()
 		fmt.Println("ConversationManager stop....1")
 		cm.FlushConversations()
 		fmt.Println("ConversationManager stop....2")
@@ -90,8 +127,10 @@ func (cm *ConversationManager) Stop() {
 
 		close(cm.stopChan)
 
+		cm.invalidator.stop()
 		cm.crontab.Stop()
 	}
+	cm.stopOfflineDigest()
 }
 
 // 清空过期最近会话
@@ -102,9 +141,9 @@ func (cm *ConversationManager) clearExpireConversations() {
 		for uid, cache := range userConversationMap {
 			keys := cache.Keys()
 			for _, key := range keys {
-				conversation, _ := cache.Get(key)
-				if conversation != nil {
-					if conversation.Timestamp+int64(cm.s.opts.Conversation.CacheExpire.Seconds()) < time.Now().Unix() {
+				entry, _ := cache.Get(key)
+				if entry != nil {
+					if entry.conversation.Timestamp+int64(cm.s.opts.Conversation.CacheExpire.Seconds()) < time.Now().Unix() {
 						cache.Remove(key)
 					}
 				}
@@ -201,22 +240,286 @@ func (cm *ConversationManager) SetConversationUnread(uid string, channelID strin
 		if messageSeq > 0 {
 			conversation.LastMsgSeq = messageSeq
 		}
-		cm.setConversationCache(uid, conversation)
-		cm.setNeedSave(uid)
+		cm.AddOrUpdateConversation(uid, conversation)
 	}
 	return nil
 }
 
-func (cm *ConversationManager) GetConversation(uid string, channelID string, channelType uint8) *wkstore.Conversation {
+// IncConversationUnread 原子地给最近会话的未读数加上delta（最小为0），createIfMissing为true时最近会话不存在则新建
+// 已缓存的最近会话同步修改未读数（缓存里可能有还没保存的未读数，所以在缓存的未读数上加delta）
+func (cm *ConversationManager) IncConversationUnread(uid string, channelID string, channelType uint8, delta int, createIfMissing bool) (*wkstore.Conversation, error) {
+	conversation, err := cm.s.store.IncConversationUnreadCount(uid, channelID, channelType, delta, createIfMissing)
+	if err != nil {
+		return nil, err
+	}
+	if conversation == nil {
+		return nil, nil
+	}
+	cm.updateConversationCache(uid, channelID, channelType, func(cached *wkstore.Conversation) *wkstore.Conversation {
+		newConversation := *cached
+		newConversation.UnreadCount += delta
+		if newConversation.UnreadCount < 0 {
+			newConversation.UnreadCount = 0
+		}
+		if newConversation.Version < conversation.Version {
+			newConversation.Version = conversation.Version
+		}
+		return &newConversation
+	})
+	return conversation, nil
+}
 
-	conversations := cm.getConversationsFromCache(uid)
-	if len(conversations) > 0 {
-		for _, conversation := range conversations {
-			if conversation.ChannelID == channelID && conversation.ChannelType == channelType {
-				return conversation
+// UpdateConversationsReadToMsgSeq 批量设置用户在多个频道已读到的消息位置（比如全部标记为已读），返回有修改的最近会话（只需要给这些最近会话发同步通知）
+// 修改前先保存并清除用户的最近会话缓存，修改期间重新缓存的最近会话（可能有新消息）按同样的规则修改，不会覆盖数据库里的已读位置
+// CreateIfMissing创建的最近会话同时加入缓存
+func (cm *ConversationManager) UpdateConversationsReadToMsgSeq(uid string, items []wkstore.ConversationReadTo) ([]wkstore.ConversationKey, error) {
+	cm.InvalidateUserConversations(uid)
+	changed, err := cm.s.store.UpdateConversationsReadToMsgSeq(uid, items)
+	if err != nil {
+		cm.Error("批量设置最近会话已读位置失败！", zap.Error(err), zap.String("uid", uid), zap.Int("count", len(items)))
+		return nil, err
+	}
+	for _, item := range items {
+		readTo, resetMentions := item.ReadToMsgSeq, item.ResetMentions
+		cm.updateConversationCache(uid, item.ChannelID, item.ChannelType, func(cached *wkstore.Conversation) *wkstore.Conversation {
+			newConversation := *cached
+			modify := newConversation.ReadTo(readTo)
+			if resetMentions && newConversation.MentionCount > 0 {
+				newConversation.MentionCount = 0
+				newConversation.Version = time.Now().UnixNano() / 1e6
+				modify = true
+			}
+			if !modify {
+				return cached
 			}
+			return &newConversation
+		})
+	}
+	cm.cacheCreatedReadTo(uid, items, changed)
+	return changed, nil
+}
+
+// cacheCreatedReadTo 把设置已读位置时创建的最近会话（缓存里还没有）加入缓存
+func (cm *ConversationManager) cacheCreatedReadTo(uid string, items []wkstore.ConversationReadTo, changed []wkstore.ConversationKey) {
+	creates := make(map[wkstore.ConversationKey]bool)
+	for _, item := range items {
+		if item.CreateIfMissing {
+			creates[wkstore.ConversationKey{UID: uid, ChannelID: item.ChannelID, ChannelType: item.ChannelType}] = true
+		}
+	}
+	if len(creates) == 0 {
+		return
+	}
+	for _, key := range changed {
+		if !creates[key] || cm.getConversationFromCache(uid, key.ChannelID, key.ChannelType) != nil {
+			continue
+		}
+		conversation, err := cm.s.store.GetConversation(uid, key.ChannelID, key.ChannelType)
+		if err != nil {
+			cm.Warn("查询创建的最近会话失败！", zap.Error(err), zap.String("uid", uid), zap.String("channelID", key.ChannelID), zap.Uint8("channelType", key.ChannelType))
+			continue
+		}
+		if conversation != nil {
+			cm.setConversationCache(uid, conversation)
+		}
+	}
+}
+
+// SetConversationPinned 置顶或取消置顶最近会话，已缓存的最近会话同步修改置顶时间（缓存的最近会话保存时不会覆盖数据库里的置顶状态）
+func (cm *ConversationManager) SetConversationPinned(uid string, channelID string, channelType uint8, pinned bool) (*wkstore.Conversation, error) {
+	conversation, err := cm.s.store.SetConversationPinned(uid, channelID, channelType, pinned)
+	if err != nil {
+		return nil, err
+	}
+	cm.mutateCachedConversation(uid, channelID, channelType, func(cached *wkstore.Conversation) {
+		cached.PinnedAt = conversation.PinnedAt
+	})
+	return conversation, nil
+}
+
+// SetConversationMute 设置最近会话的免打扰，已缓存的最近会话同步修改免打扰（缓存的最近会话保存时不会覆盖数据库里的免打扰）
+func (cm *ConversationManager) SetConversationMute(uid string, channelID string, channelType uint8, mute uint8) (*wkstore.Conversation, error) {
+	conversation, err := cm.s.store.SetConversationMute(uid, channelID, channelType, mute)
+	if err != nil {
+		return nil, err
+	}
+	cm.mutateCachedConversation(uid, channelID, channelType, func(cached *wkstore.Conversation) {
+		cached.Mute = conversation.Mute
+	})
+	return conversation, nil
+}
+
+// SetConversationExtra 替换最近会话的扩展数据，已缓存的最近会话同步修改扩展数据（缓存的最近会话保存时不会覆盖数据库里的扩展数据）
+func (cm *ConversationManager) SetConversationExtra(uid string, channelID string, channelType uint8, extra map[string]string) (*wkstore.Conversation, error) {
+	conversation, err := cm.s.store.SetConversationExtra(uid, channelID, channelType, extra)
+	if err != nil {
+		return nil, err
+	}
+	cm.mutateCachedConversation(uid, channelID, channelType, func(cached *wkstore.Conversation) {
+		cached.Extra = conversation.Extra
+	})
+	return conversation, nil
+}
+
+// SetConversationArchived 归档或取消归档最近会话，已缓存的最近会话同步修改归档状态（缓存的最近会话保存时不会覆盖数据库里的归档状态）
+// 取消归档后按原来的最后一条消息时间回到最近会话列表里
+func (cm *ConversationManager) SetConversationArchived(uid string, channelID string, channelType uint8, archived bool) (*wkstore.Conversation, error) {
+	conversation, err := cm.s.store.SetConversationArchived(uid, channelID, channelType, archived)
+	if err != nil {
+		return nil, err
+	}
+	cm.mutateCachedConversation(uid, channelID, channelType, func(cached *wkstore.Conversation) {
+		cached.Archived = conversation.Archived
+	})
+	return conversation, nil
+}
+
+// IncConversationMentionCount 增加（delta为负数时减少）最近会话的提及数量，已缓存的最近会话同步修改提及数量（缓存的最近会话保存时不会覆盖数据库里的提及数量）
+func (cm *ConversationManager) IncConversationMentionCount(uid string, channelID string, channelType uint8, delta int) (*wkstore.Conversation, error) {
+	conversation, err := cm.s.store.IncConversationMentionCount(uid, channelID, channelType, delta)
+	if err != nil {
+		return nil, err
+	}
+	cm.mutateCachedConversation(uid, channelID, channelType, func(cached *wkstore.Conversation) {
+		cached.MentionCount = conversation.MentionCount
+	})
+	return conversation, nil
+}
+
+// UpdateConversationLastMsg 更新最近会话的最后一条消息（只有messageSeq更大时修改），已缓存的最近会话同步修改（缓存保存时不会回退数据库里的最后一条消息）
+func (cm *ConversationManager) UpdateConversationLastMsg(uid string, channelID string, channelType uint8, messageSeq uint32, clientMsgNo string, timestamp int64) (bool, error) {
+	modify, err := cm.s.store.UpdateConversationLastMsg(uid, channelID, channelType, messageSeq, clientMsgNo, timestamp)
+	if err != nil {
+		return false, err
+	}
+	cm.updateConversationCache(uid, channelID, channelType, func(cached *wkstore.Conversation) *wkstore.Conversation {
+		if messageSeq <= cached.LastMsgSeq {
+			return cached
+		}
+		newConversation := *cached
+		newConversation.LastMsgSeq = messageSeq
+		newConversation.LastClientMsgNo = clientMsgNo
+		newConversation.LastMsgID = 0
+		newConversation.Timestamp = timestamp
+		newConversation.Version = time.Now().UnixNano() / 1e6
+		return &newConversation
+	})
+	return modify, nil
+}
+
+// mutateCachedConversation 修改已缓存的最近会话（数据库里已经修改过的字段同步到缓存），没有缓存时不修改
+// 缓存里的最近会话计算和保存的协程会无锁读取，mutate修改的是副本；修改后更新数据版本（比原来的大）并标记需要保存
+func (cm *ConversationManager) mutateCachedConversation(uid string, channelID string, channelType uint8, mutate func(cached *wkstore.Conversation)) {
+	updated := cm.updateConversationCache(uid, channelID, channelType, func(cached *wkstore.Conversation) *wkstore.Conversation {
+		newConversation := *cached
+		mutate(&newConversation)
+		newConversation.Version = time.Now().UnixNano() / 1e6
+		if newConversation.Version <= cached.Version {
+			newConversation.Version = cached.Version + 1
 		}
+		return &newConversation
+	})
+	if updated {
+		cm.setNeedSave(uid)
+	}
+}
+
+// GetArchivedConversations 用户已归档的最近会话（合并缓存里还没保存的修改），按最后一条消息的时间从新到旧，limit<=0表示不限制
+func (cm *ConversationManager) GetArchivedConversations(uid string, limit int) ([]*wkstore.Conversation, error) {
+	conversations, err := cm.getMergedConversations(uid)
+	if err != nil {
+		return nil, err
+	}
+	return wkstore.ArchivedConversations(conversations, limit), nil
+}
+
+// GetConversationVersion 用户最近会话的版本号（最近会话每次有变化加1），缓存里有还没保存的修改时先保存，保证版本号包含了这些修改
+func (cm *ConversationManager) GetConversationVersion(uid string) (uint64, error) {
+	if err := cm.flushIfNeedSave(uid); err != nil {
+		return 0, err
+	}
+	return cm.s.store.GetConversationVersion(uid)
+}
+
+// PeekConversationVersion 不保存缓存直接读取用户最近会话的版本号，缓存里有还没保存的修改时版本号还不包含这些修改，返回false
+// 同步最近会话每次都要返回版本号，客户端没有传版本号比较时用这个，避免每次同步都写一次数据库
+func (cm *ConversationManager) PeekConversationVersion(uid string) (uint64, bool, error) {
+	if cm.needSave(uid) {
+		return 0, false, nil
 	}
+	version, err := cm.s.store.GetConversationVersion(uid)
+	if err != nil {
+		return 0, false, err
+	}
+	return version, true, nil
+}
+
+// GetConversationsUpdatedSince 用户版本号大于sinceVersion的最近会话和删除记录，缓存里有还没保存的修改时先保存，保证版本号和存储的一致
+func (cm *ConversationManager) GetConversationsUpdatedSince(uid string, sinceVersion uint64, limit int) (*wkstore.ConversationChanges, error) {
+	if err := cm.flushIfNeedSave(uid); err != nil {
+		return nil, err
+	}
+	return cm.s.store.GetConversationsUpdatedSince(uid, sinceVersion, limit)
+}
+
+// flushIfNeedSave 缓存里有还没保存的修改时先保存，直接读存储的数据前调用
+func (cm *ConversationManager) flushIfNeedSave(uid string) error {
+	cm.applyPendingInvalidate(uid)
+	if cm.needSave(uid) {
+		cm.flushUserConversations(uid)
+		if cm.needSave(uid) {
+			return errors.New("failed to flush conversations")
+		}
+	}
+	return nil
+}
+
+// SearchConversations 按条件搜索最近会话（后台管理用），指定uid时先保存缓存里还没保存的修改，不指定uid时搜索的是已保存的最近会话
+func (cm *ConversationManager) SearchConversations(ctx context.Context, req wkstore.ConversationSearchReq) (*wkstore.ConversationSearchResult, error) {
+	if req.UID != "" {
+		if err := cm.flushIfNeedSave(req.UID); err != nil {
+			return nil, err
+		}
+	}
+	return cm.s.store.SearchConversations(ctx, req)
+}
+
+// IterateConversations 遍历用户符合条件的最近会话，先保存缓存里还没保存的修改，fn返回false时停止
+func (cm *ConversationManager) IterateConversations(uid string, opts wkstore.ConversationIterOptions, fn func(wkstore.Conversation) bool) error {
+	if err := cm.flushIfNeedSave(uid); err != nil {
+		return err
+	}
+	return cm.s.store.IterateConversations(uid, opts, fn)
+}
+
+// GetConversationFirstUnread 用户在频道里第一条未读并且还存在的消息seq（跳过已删除或过期的消息），没有未读返回false
+// 缓存里有还没保存的修改时先保存，保证和缓存里的未读数一致
+func (cm *ConversationManager) GetConversationFirstUnread(uid string, channelID string, channelType uint8) (uint32, bool, error) {
+	if err := cm.flushIfNeedSave(uid); err != nil {
+		return 0, false, err
+	}
+	return cm.s.store.GetConversationFirstUnread(uid, channelID, channelType)
+}
+
+// GetConversationsFirstUnread 批量获取用户在多个频道里第一条未读并且还存在的消息seq，只保存一次缓存并读取一次用户的最近会话，没有未读的不在结果里
+func (cm *ConversationManager) GetConversationsFirstUnread(uid string, keys []wkstore.ConversationKey) (map[wkstore.ConversationKey]uint32, error) {
+	if len(keys) == 0 {
+		return map[wkstore.ConversationKey]uint32{}, nil
+	}
+	if err := cm.flushIfNeedSave(uid); err != nil {
+		return nil, err
+	}
+	return cm.s.store.GetConversationsFirstUnread(uid, keys)
+}
+
+func (cm *ConversationManager) GetConversation(uid string, channelID string, channelType uint8) *wkstore.Conversation {
+	cm.applyPendingInvalidate(uid)
+
+	if conversation := cm.getConversationFromCache(uid, channelID, channelType); conversation != nil {
+		cm.invalidator.hits.Inc()
+		return conversation
+	}
+	cm.invalidator.misses.Inc()
 
 	conversation, err := cm.s.store.GetConversation(uid, channelID, channelType)
 	if err != nil {
@@ -244,6 +547,433 @@ func (cm *ConversationManager) DeleteConversation(uids []string, channelID strin
 	return nil
 }
 
+// EnsureConversations 给频道的成员创建空的最近会话（比如群创建后还没有消息时就显示在成员的会话列表里），已存在的（包括缓存里还没保存的）不修改
+// 批量检查和写入，写入失败的最近会话在result.Failed里，调用方只需要重试这些
+func (cm *ConversationManager) EnsureConversations(uids []string, channelID string, channelType uint8) (*wkstore.ConversationBatchResult, error) {
+	now := time.Now()
+	conversations := make([]*wkstore.Conversation, 0, len(uids))
+	var skipped []wkstore.ConversationKey
+	for _, uid := range uids {
+		if cm.getConversationFromCache(uid, channelID, channelType) != nil {
+			skipped = append(skipped, wkstore.ConversationKey{UID: uid, ChannelID: channelID, ChannelType: channelType})
+			continue
+		}
+		conversations = append(conversations, &wkstore.Conversation{
+			UID:         uid,
+			ChannelID:   channelID,
+			ChannelType: channelType,
+			Timestamp:   now.Unix(),
+			Version:     now.UnixNano() / 1e6,
+		})
+	}
+	result, err := cm.s.store.AddOrUpdateConversationsBatchIfNotExist(conversations)
+	if result != nil {
+		result.Skipped = append(skipped, result.Skipped...)
+	}
+	if err != nil {
+		cm.Error("创建最近会话失败！", zap.Error(err), zap.String("channelID", channelID), zap.Uint8("channelType", channelType), zap.Int("failed", len(result.Failed)))
+		return result, err
+	}
+	return result, nil
+}
+
+// OnMessagesExpired 频道消息过期(messageSeq<=uptoSeq)后修正最近会话，给清理过期消息的逻辑调用（当前没有消息过期任务）
+func (cm *ConversationManager) OnMessagesExpired(channelID string, channelType uint8, uptoSeq uint32) error {
+	keys, err := cm.s.store.OnMessagesExpired(channelID, channelType, uptoSeq)
+	if err != nil {
+		cm.Error("修正过期消息的最近会话失败！", zap.Error(err), zap.String("channelID", channelID), zap.Uint8("channelType", channelType), zap.Uint32("uptoSeq", uptoSeq))
+		return err
+	}
+	// 缓存里的最近会话可能有还没保存的修改，所以这里直接修正缓存，而不是删除缓存（复制后再修改，和RefreshConversationChannelInfo一样）
+	for _, key := range keys {
+		updated := cm.updateConversationCache(key.UID, key.ChannelID, key.ChannelType, func(cached *wkstore.Conversation) *wkstore.Conversation {
+			newConversation := *cached
+			if !newConversation.ClampExpired(uptoSeq) {
+				return cached
+			}
+			return &newConversation
+		})
+		if updated {
+			cm.setNeedSave(key.UID)
+		}
+	}
+	return nil
+}
+
+// OnMessageRecalled 频道消息撤回后修正本地用户的最近会话（未读数和最后一条消息），业务服务撤回消息后通过/conversations/messageRecalled调用
+func (cm *ConversationManager) OnMessageRecalled(channelID string, channelType uint8, messageSeq uint32) error {
+	keys, err := cm.s.store.OnMessageRecalled(channelID, channelType, messageSeq)
+	if err != nil {
+		cm.Error("修正撤回消息的最近会话失败！", zap.Error(err), zap.String("channelID", channelID), zap.Uint8("channelType", channelType), zap.Uint32("messageSeq", messageSeq))
+		return err
+	}
+	// 和OnMessagesExpired一样复制后修正缓存，缓存和数据库各自减少一次未读数，保存缓存时以缓存为准
+	// 同一条消息重复撤回时数据库返回空，缓存也不会再减少
+	for _, key := range keys {
+		updated := cm.updateConversationCache(key.UID, key.ChannelID, key.ChannelType, func(cached *wkstore.Conversation) *wkstore.Conversation {
+			newConversation := *cached
+			if !newConversation.Recall(messageSeq) {
+				return cached
+			}
+			return &newConversation
+		})
+		if updated {
+			cm.setNeedSave(key.UID)
+		}
+	}
+	return nil
+}
+
+// OnMessageEdited 频道消息编辑后更新最后一条消息是它的最近会话的数据版本，客户端增量同步时重新获取最后一条消息（业务服务通过/conversations/messageEdited调用）
+func (cm *ConversationManager) OnMessageEdited(channelID string, channelType uint8, messageSeq uint32) error {
+	keys, err := cm.s.store.OnMessageEdited(channelID, channelType, messageSeq)
+	if err != nil {
+		cm.Error("更新编辑消息的最近会话失败！", zap.Error(err), zap.String("channelID", channelID), zap.Uint8("channelType", channelType), zap.Uint32("messageSeq", messageSeq))
+		return err
+	}
+	for _, key := range keys {
+		updated := cm.updateConversationCache(key.UID, key.ChannelID, key.ChannelType, func(cached *wkstore.Conversation) *wkstore.Conversation {
+			newConversation := *cached
+			if !newConversation.Edit(messageSeq) {
+				return cached
+			}
+			return &newConversation
+		})
+		if updated {
+			cm.setNeedSave(key.UID)
+		}
+	}
+	return nil
+}
+
+// RefreshConversationChannelInfo 频道名称或头像修改后刷新最近会话里冗余的频道信息
+func (cm *ConversationManager) RefreshConversationChannelInfo(channelID string, channelType uint8, name string, avatar string) error {
+	keys, err := cm.s.store.RefreshConversationChannelInfo(channelID, channelType, name, avatar)
+	if err != nil {
+		cm.Error("刷新最近会话的频道信息失败！", zap.Error(err), zap.String("channelID", channelID), zap.Uint8("channelType", channelType))
+		return err
+	}
+	for _, key := range keys {
+		// 缓存里的最近会话计算和保存的协程会无锁读取，复制后再修改，修改后需要保存（缓存保存时会覆盖数据库里的频道信息）
+		updated := cm.updateConversationCache(key.UID, key.ChannelID, key.ChannelType, func(cached *wkstore.Conversation) *wkstore.Conversation {
+			newConversation := *cached
+			if !newConversation.RefreshChannelInfo(name, avatar) {
+				return cached
+			}
+			return &newConversation
+		})
+		if updated {
+			cm.setNeedSave(key.UID)
+		}
+	}
+	return nil
+}
+
+// DeleteUserData 删除用户的最近会话、订阅关系、快照等数据，删除前后都丢弃用户的最近会话缓存（不保存，保存会把删除的最近会话写回去），DryRun时不处理缓存
+func (cm *ConversationManager) DeleteUserData(uid string, opts wkstore.MaintenanceOptions) (*wkstore.CleanupReport, error) {
+	if !opts.DryRun {
+		cm.discardUserConversations(uid)
+	}
+	report, err := cm.s.store.DeleteUserData(uid, opts)
+	if !opts.DryRun { // 删除期间投递的消息又缓存的最近会话，部分删除失败时也丢弃（可以重新调用继续删除）
+		cm.discardUserConversations(uid)
+	}
+	if err != nil {
+		cm.Error("删除用户数据失败！", zap.Error(err), zap.String("uid", uid))
+		return report, err
+	}
+	return report, nil
+}
+
+// DeleteChannelData 删除频道的本地用户最近会话、订阅关系等数据，删除前清除订阅者缓存里此频道的最近会话，删除后通过失效队列清除这些用户的缓存，DryRun时不处理缓存
+func (cm *ConversationManager) DeleteChannelData(channelID string, channelType uint8, opts wkstore.MaintenanceOptions) (*wkstore.CleanupReport, error) {
+	var uids []string
+	if !opts.DryRun {
+		var err error
+		if uids, err = cm.s.store.GetSubscribers(channelID, channelType); err != nil { // 删除后订阅关系就没有了，先获取
+			cm.Error("获取频道的订阅者失败！", zap.Error(err), zap.String("channelID", channelID), zap.Uint8("channelType", channelType))
+			return nil, err
+		}
+		for _, uid := range uids {
+			cm.deleteConversationCache(uid, channelID, channelType)
+		}
+	}
+	report, err := cm.s.store.DeleteChannelData(channelID, channelType, opts)
+	if !opts.DryRun {
+		cm.InvalidateUserConversationsAsync(uids...)
+	}
+	if err != nil {
+		cm.Error("删除频道数据失败！", zap.Error(err), zap.String("channelID", channelID), zap.Uint8("channelType", channelType))
+		return report, err
+	}
+	return report, nil
+}
+
+// discardUserConversations 丢弃用户的最近会话缓存和需要保存的标记
+func (cm *ConversationManager) discardUserConversations(uid string) {
+	cm.dropUserConversationsCache(uid)
+	cm.mu.Lock()
+	delete(cm.needSaveConversationMap, uid)
+	cm.mu.Unlock()
+}
+
+// MigrateConversationsChannel 频道迁移到新的频道id后，把本地用户的最近会话迁移到新频道，返回迁移（DryRun时为会迁移）的最近会话
+// 迁移前先保存并清除这些用户新旧频道的缓存，迁移后通过失效队列再清除一次这些用户的缓存（迁移期间的修改先保存），DryRun时不处理缓存
+func (cm *ConversationManager) MigrateConversationsChannel(oldChannelID string, oldChannelType uint8, newChannelID string, newChannelType uint8, opts wkstore.MaintenanceOptions) ([]wkstore.ConversationKey, error) {
+	if !opts.DryRun {
+		uids, err := cm.s.store.GetSubscribers(oldChannelID, oldChannelType)
+		if err != nil {
+			cm.Error("获取旧频道的订阅者失败！", zap.Error(err), zap.String("channelID", oldChannelID), zap.Uint8("channelType", oldChannelType))
+			return nil, err
+		}
+		for _, uid := range uids {
+			cm.InvalidateConversation(uid, oldChannelID, oldChannelType)
+			cm.InvalidateConversation(uid, newChannelID, newChannelType)
+		}
+	}
+	keys, err := cm.s.store.MigrateConversationsChannel(oldChannelID, oldChannelType, newChannelID, newChannelType, opts)
+	if err != nil {
+		cm.Error("迁移最近会话的频道失败！", zap.Error(err), zap.String("oldChannelID", oldChannelID), zap.Uint8("oldChannelType", oldChannelType), zap.String("newChannelID", newChannelID), zap.Uint8("newChannelType", newChannelType))
+		return nil, err
+	}
+	if !opts.DryRun {
+		// 迁移前的保存是同步的（迁移需要读到最新的数据），迁移期间又被消息更新的缓存通过失效队列限速清除
+		uids := make([]string, 0, len(keys))
+		for _, key := range keys {
+			uids = append(uids, key.UID)
+		}
+		cm.InvalidateUserConversationsAsync(uids...)
+	}
+	return keys, nil
+}
+
+// cleanupExpiredConversations 清理超过TTL的最近会话，缓存里的也过期了才删除（缓存里有新的会话时会再保存）
+func (cm *ConversationManager) cleanupExpiredConversations() {
+	if !cm.s.opts.Conversation.On {
+		return
+	}
+	now := cm.now()
+	result, err := cm.s.store.RunConversationCleanup(now)
+	if err != nil {
+		cm.Error("清理过期的最近会话失败！", zap.Error(err))
+		return
+	}
+	// 过期的缓存项先直接删除（内存操作，等队列保存后再删除会把过期的会话保存回去），用户的缓存再通过失效队列限速清除，避免大批量清理时同步保存和重新加载
+	uids := make([]string, 0, len(result.Purged))
+	for _, key := range result.Purged {
+		conversation := cm.getConversationFromCache(key.UID, key.ChannelID, key.ChannelType)
+		if conversation == nil {
+			continue
+		}
+		if ttl := cm.s.opts.Conversation.TTL[key.ChannelType]; conversation.Timestamp < now.Add(-ttl).Unix() {
+			cm.deleteConversationCache(key.UID, key.ChannelID, key.ChannelType)
+			uids = append(uids, key.UID)
+		}
+	}
+	cm.InvalidateUserConversationsAsync(uids...)
+	cm.s.monitor.ConversationPurgedAdd(len(result.Purged))
+}
+
+// DeleteConversationsByChannel 删除所有本地用户在此频道的最近会话（比如群解散），返回删除了最近会话的用户数量
+// 先删除缓存（避免缓存里的修改再次保存），删除后通过失效队列限速清除这些用户的缓存（期间可能有新的消息更新了缓存，频道成员很多时不同步处理）
+func (cm *ConversationManager) DeleteConversationsByChannel(channelID string, channelType uint8) (int, error) {
+	uids, err := cm.s.store.GetSubscribers(channelID, channelType)
+	if err != nil {
+		cm.Error("获取频道的订阅者失败！", zap.Error(err), zap.String("channelID", channelID), zap.Uint8("channelType", channelType))
+		return 0, err
+	}
+	for _, uid := range uids {
+		cm.deleteConversationCache(uid, channelID, channelType)
+	}
+	count, err := cm.s.store.DeleteConversationsByChannel(channelID, channelType)
+	if err != nil {
+		cm.Error("删除频道的最近会话失败！", zap.Error(err), zap.String("channelID", channelID), zap.Uint8("channelType", channelType))
+		return 0, err
+	}
+	cm.InvalidateUserConversationsAsync(uids...)
+	return count, nil
+}
+
+// OnUserLeftChannel 用户离开频道，移除订阅关系并删除或冻结最近会话（Conversation.LeaveFreeze），之后的消息不再更新这些用户在此频道的最近会话
+func (cm *ConversationManager) OnUserLeftChannel(uids []string, channelID string, channelType uint8) error {
+	for _, uid := range uids {
+		cm.leftChannels.Store(cm.getLeftChannelKey(uid, channelID, channelType), time.Now())
+		cm.InvalidateConversation(uid, channelID, channelType) // 先保存缓存里的修改，冻结时保留最新的消息位置
+		err := cm.s.store.OnUserLeftChannel(uid, channelID, channelType)
+		if err != nil {
+			cm.Error("用户离开频道处理最近会话失败！", zap.Error(err), zap.String("uid", uid), zap.String("channelID", channelID), zap.Uint8("channelType", channelType))
+			return err
+		}
+		cm.deleteConversationCache(uid, channelID, channelType)
+	}
+	return nil
+}
+
+// OnUserJoinedChannel 用户重新加入频道，恢复冻结的最近会话
+func (cm *ConversationManager) OnUserJoinedChannel(uids []string, channelID string, channelType uint8) error {
+	for _, uid := range uids {
+		cm.leftChannels.Delete(cm.getLeftChannelKey(uid, channelID, channelType))
+		err := cm.s.store.OnUserJoinedChannel(uid, channelID, channelType)
+		if err != nil {
+			cm.Error("用户加入频道恢复最近会话失败！", zap.Error(err), zap.String("uid", uid), zap.String("channelID", channelID), zap.Uint8("channelType", channelType))
+			return err
+		}
+		// 缓存里的最近会话复制后修改，修改后需要保存（否则缓存淘汰或重启后恢复会丢失）
+		updated := cm.updateConversationCache(uid, channelID, channelType, func(cached *wkstore.Conversation) *wkstore.Conversation {
+			if !cached.Left {
+				return cached
+			}
+			newConversation := *cached
+			newConversation.Left = false
+			return &newConversation
+		})
+		if updated {
+			cm.setNeedSave(uid)
+		}
+	}
+	return nil
+}
+
+// isLeftChannel 用户是否刚离开频道
+func (cm *ConversationManager) isLeftChannel(uid string, channelID string, channelType uint8) bool {
+	key := cm.getLeftChannelKey(uid, channelID, channelType)
+	leftAt, ok := cm.leftChannels.Load(key)
+	if !ok {
+		return false
+	}
+	if time.Since(leftAt.(time.Time)) > leftChannelExpire {
+		cm.leftChannels.Delete(key)
+		return false
+	}
+	return true
+}
+
+func (cm *ConversationManager) clearLeftChannels() {
+	cm.leftChannels.Range(func(key, value any) bool {
+		if time.Since(value.(time.Time)) > leftChannelExpire {
+			cm.leftChannels.Delete(key)
+		}
+		return true
+	})
+}
+
+func (cm *ConversationManager) getLeftChannelKey(uid string, channelID string, channelType uint8) string {
+	return fmt.Sprintf("%s/%s", uid, cm.getChannelKey(channelID, channelType))
+}
+
+// SnapshotUserConversations 保存用户最近会话的快照（缓存里还没保存的修改会先保存），返回快照id
+func (cm *ConversationManager) SnapshotUserConversations(uid string) (string, error) {
+	cm.InvalidateUserConversations(uid)
+	snapshotID, err := cm.s.store.SnapshotUserConversations(uid)
+	if err != nil {
+		cm.Error("保存最近会话快照失败！", zap.Error(err), zap.String("uid", uid))
+		return "", err
+	}
+	return snapshotID, nil
+}
+
+// RestoreUserConversations 用快照恢复用户的最近会话，恢复后清除缓存（恢复期间缓存里的修改会被丢弃）
+func (cm *ConversationManager) RestoreUserConversations(uid string, snapshotID string) error {
+	cm.InvalidateUserConversations(uid)
+	err := cm.s.store.RestoreUserConversations(uid, snapshotID)
+	if err != nil {
+		cm.Error("恢复最近会话快照失败！", zap.Error(err), zap.String("uid", uid), zap.String("snapshotID", snapshotID))
+		return err
+	}
+	cm.dropUserConversationsCache(uid)
+	return nil
+}
+
+// InvalidateUserConversations 同步清除用户的最近会话缓存（还没保存的修改会先保存），下次读取时从数据库加载
+// 适用于需要马上读到最新数据的场景，大批量的失效请使用InvalidateUserConversationsAsync
+func (cm *ConversationManager) InvalidateUserConversations(uid string) {
+	cm.invalidator.take(uid)
+	cm.invalidator.direct.Inc()
+	cm.invalidateUserConversations(uid)
+}
+
+// InvalidateConversation 同步清除用户一个频道的最近会话缓存（还没保存的修改会先保存），用户其他频道的缓存不受影响
+// 缓存里每个频道是单独的一项，读取时和数据库里的合并后再排序，所以只清除一个频道不会让其他频道的顺序出错，不需要清除整个用户的缓存
+func (cm *ConversationManager) InvalidateConversation(uid string, channelID string, channelType uint8) {
+	cm.invalidator.channel.Inc()
+	if conversation := cm.getConversationFromCache(uid, channelID, channelType); conversation != nil && cm.needSave(uid) {
+		if err := cm.s.store.AddOrUpdateConversations(uid, []*wkstore.Conversation{conversation}); err != nil { // 保存失败，保留缓存，避免丢失修改
+			cm.Warn("Failed to invalidate conversation cache, flush fail", zap.String("uid", uid), zap.String("channelID", channelID), zap.Uint8("channelType", channelType), zap.Error(err))
+			return
+		}
+	}
+	cm.deleteConversationCache(uid, channelID, channelType)
+}
+
+// InvalidateUserConversationsAsync 通过失效队列清除用户的最近会话缓存（合并，限速，活跃用户优先），读取用户的最近会话时队列里还没处理的会先同步处理
+func (cm *ConversationManager) InvalidateUserConversationsAsync(uids ...string) {
+	if !cm.s.opts.Conversation.On {
+		return
+	}
+	cm.invalidator.add(uids...)
+}
+
+// ConversationInvalidateStats 最近会话缓存失效队列的统计
+func (cm *ConversationManager) ConversationInvalidateStats() *ConversationInvalidateStats {
+	return cm.invalidator.stats()
+}
+
+func (cm *ConversationManager) invalidateUserConversations(uid string) {
+	if cm.needSave(uid) {
+		cm.flushUserConversations(uid)
+		if cm.needSave(uid) { // 保存失败，保留缓存，避免丢失修改
+			cm.Warn("Failed to invalidate conversation cache, flush fail", zap.String("uid", uid))
+			return
+		}
+	}
+	cm.dropUserConversationsCache(uid)
+}
+
+// dropUserConversationsCache 直接删除用户的最近会话缓存（不保存还没保存的修改）
+func (cm *ConversationManager) dropUserConversationsCache(uid string) {
+	pos := cm.getLockIndex(uid)
+	cm.userConversationMapBucketLocks[pos].Lock()
+	delete(cm.userConversationMapBuckets[pos], uid)
+	cm.userConversationMapBucketLocks[pos].Unlock()
+}
+
+// conversationCacheEntrySize 最近会话缓存每一项的估算大小（字符串按平均长度估算，包括lru的节点）
+const conversationCacheEntrySize = int64(unsafe.Sizeof(wkstore.Conversation{})+unsafe.Sizeof(conversationCacheEntry{})) + 128
+
+// cacheBytes 最近会话缓存占用内存的估算
+func (cm *ConversationManager) cacheBytes() int64 {
+	count := 0
+	for i := range cm.userConversationMapBuckets {
+		cm.userConversationMapBucketLocks[i].Lock()
+		for _, cache := range cm.userConversationMapBuckets[i] {
+			count += cache.Len()
+		}
+		cm.userConversationMapBucketLocks[i].Unlock()
+	}
+	return int64(count) * conversationCacheEntrySize
+}
+
+// applyPendingInvalidate 用户在失效队列里还没处理则马上处理
+func (cm *ConversationManager) applyPendingInvalidate(uid string) {
+	if cm.invalidator.take(uid) {
+		cm.invalidator.direct.Inc()
+		cm.invalidateUserConversations(uid)
+	}
+}
+
+func (cm *ConversationManager) isUserActive(uid string) bool {
+	if cm.s.opts.IsUserActive != nil {
+		return cm.s.opts.IsUserActive(uid)
+	}
+	return cm.s.connManager != nil && len(cm.s.connManager.GetConnsWithUID(uid)) > 0
+}
+
+func (cm *ConversationManager) needSave(uid string) bool {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	return cm.needSaveConversationMap[uid]
+}
+
 func (cm *ConversationManager) getUserAllConversationMapFromStore(uid string) ([]*wkstore.Conversation, error) {
 	conversations, err := cm.s.store.GetConversations(uid)
 	if err != nil {
@@ -253,11 +983,26 @@ func (cm *ConversationManager) getUserAllConversationMapFromStore(uid string) ([
 	return conversations, nil
 }
 
-func (cm *ConversationManager) newLRUCache() *lru.Cache[string, *wkstore.Conversation] {
-	c, _ := lru.New[string, *wkstore.Conversation](cm.s.opts.Conversation.UserMaxCount)
+func (cm *ConversationManager) newLRUCache() *lru.Cache[string, *conversationCacheEntry] {
+	size := cm.s.opts.Conversation.CacheMaxEntries
+	if size <= 0 {
+		size = cm.s.opts.Conversation.UserMaxCount
+	}
+	c, _ := lru.New[string, *conversationCacheEntry](size)
 	return c
 }
 
+// cacheDisabled 是否关闭了最近会话缓存，关闭后不读写缓存
+func (cm *ConversationManager) cacheDisabled() bool {
+	return cm.s.opts.Conversation.CacheDisabled
+}
+
+// cacheEntryExpired 缓存写入超过CacheTTL，用户没有还没保存的修改时读取需要重新从数据库加载
+func (cm *ConversationManager) cacheEntryExpired(entry *conversationCacheEntry, now time.Time) bool {
+	ttl := cm.s.opts.Conversation.CacheTTL
+	return ttl > 0 && now.Sub(entry.cachedAt) > ttl
+}
+
 // FlushConversations 同步最近会话
 func (cm *ConversationManager) FlushConversations() {
 
@@ -283,7 +1028,7 @@ func (cm *ConversationManager) flushUserConversations(uid string) {
 	if len(conversations) == 0 {
 		return
 	}
-	err := cm.s.store.AddOrUpdateConversations(uid, conversations)
+	versions, err := cm.s.store.AddOrUpdateConversationsWithVersions(uid, conversations)
 	if err != nil {
 		cm.Warn("Failed to store conversation data", zap.Error(err))
 	} else {
@@ -291,6 +1036,18 @@ func (cm *ConversationManager) flushUserConversations(uid string) {
 		delete(cm.needSaveConversationMap, uid)
 		cm.mu.Unlock()
 
+		// 数据库修正了版本号（比如时钟回拨），缓存也要用修正后的版本号，否则同步时返回的版本号比数据库里的小
+		for key, version := range versions {
+			cm.updateConversationCache(uid, key.ChannelID, key.ChannelType, func(cached *wkstore.Conversation) *wkstore.Conversation {
+				if cached.Version >= version {
+					return cached
+				}
+				newConversation := *cached
+				newConversation.Version = version
+				return &newConversation
+			})
+		}
+
 		// 移除过期的最近会话缓存
 		for _, conversation := range conversations {
 			if conversation.Timestamp+int64(cm.s.opts.Conversation.CacheExpire.Seconds()) < time.Now().Unix() {
@@ -300,11 +1057,11 @@ func (cm *ConversationManager) flushUserConversations(uid string) {
 	}
 }
 
-func (cm *ConversationManager) getUserConversationCacheNoLock(uid string) *lru.Cache[string, *wkstore.Conversation] {
+func (cm *ConversationManager) getUserConversationCacheNoLock(uid string) *lru.Cache[string, *conversationCacheEntry] {
 	pos := int(wkutil.HashCrc32(uid) % uint32(cm.bucketNum))
 	userConversationMap := cm.userConversationMapBuckets[pos]
 	if userConversationMap == nil {
-		userConversationMap = make(map[string]*lru.Cache[string, *wkstore.Conversation])
+		userConversationMap = make(map[string]*lru.Cache[string, *conversationCacheEntry])
 		cm.userConversationMapBuckets[pos] = userConversationMap
 	}
 	cache := userConversationMap[uid]
@@ -316,25 +1073,60 @@ func (cm *ConversationManager) getUserConversationCacheNoLock(uid string) *lru.C
 }
 
 func (cm *ConversationManager) getConversationFromCache(uid string, channelID string, channelType uint8) *wkstore.Conversation {
+	if cm.cacheDisabled() {
+		return nil
+	}
 	pos := cm.getLockIndex(uid)
 	cm.userConversationMapBucketLocks[pos].Lock()
 	defer cm.userConversationMapBucketLocks[pos].Unlock()
 	cache := cm.getUserConversationCacheNoLock(uid)
 	channelKey := cm.getChannelKey(channelID, channelType)
-	conversation, _ := cache.Get(channelKey)
-	return conversation
+	entry, _ := cache.Get(channelKey)
+	if entry == nil {
+		return nil
+	}
+	if cm.cacheEntryExpired(entry, cm.now()) && !cm.needSave(uid) {
+		cache.Remove(channelKey)
+		return nil
+	}
+	return entry.conversation
 }
 
 func (cm *ConversationManager) setConversationCache(uid string, conversation *wkstore.Conversation) {
+	if cm.cacheDisabled() {
+		return
+	}
 	pos := cm.getLockIndex(uid)
 	cm.userConversationMapBucketLocks[pos].Lock()
 	defer cm.userConversationMapBucketLocks[pos].Unlock()
 	cache := cm.getUserConversationCacheNoLock(uid)
 	channelKey := cm.getChannelKey(conversation.ChannelID, conversation.ChannelType)
-	cache.Add(channelKey, conversation)
+	cache.Add(channelKey, &conversationCacheEntry{conversation: conversation, cachedAt: cm.now()})
+}
+
+// updateConversationCache 修改已缓存的最近会话，fn返回新的最近会话，没有缓存时不调用fn，返回是否修改了缓存（fn返回的不是原来的最近会话）
+func (cm *ConversationManager) updateConversationCache(uid string, channelID string, channelType uint8, fn func(cached *wkstore.Conversation) *wkstore.Conversation) bool {
+	if cm.cacheDisabled() {
+		return false
+	}
+	pos := cm.getLockIndex(uid)
+	cm.userConversationMapBucketLocks[pos].Lock()
+	defer cm.userConversationMapBucketLocks[pos].Unlock()
+	cache := cm.getUserConversationCacheNoLock(uid)
+	channelKey := cm.getChannelKey(channelID, channelType)
+	cached, ok := cache.Get(channelKey)
+	if !ok || cached == nil {
+		return false
+	}
+	conversation := fn(cached.conversation)
+	cache.Add(channelKey, &conversationCacheEntry{conversation: conversation, cachedAt: cm.now()})
+	return conversation != cached.conversation
 }
 
 func (cm *ConversationManager) deleteConversationCache(uid string, channelID string, channelType uint8) {
+	if cm.cacheDisabled() {
+		return
+	}
 	pos := cm.getLockIndex(uid)
 	cm.userConversationMapBucketLocks[pos].Lock()
 	defer cm.userConversationMapBucketLocks[pos].Unlock()
@@ -344,16 +1136,35 @@ func (cm *ConversationManager) deleteConversationCache(uid string, channelID str
 }
 
 func (cm *ConversationManager) getConversationsFromCache(uid string) []*wkstore.Conversation {
+	entries := cm.getConversationEntriesFromCache(uid)
+	conversations := make([]*wkstore.Conversation, 0, len(entries))
+	for _, entry := range entries {
+		conversations = append(conversations, entry.conversation)
+	}
+	return conversations
+}
+
+// getConversationEntriesFromCache 用户缓存的最近会话，用户没有还没保存的修改时超过CacheTTL的移除并且不返回
+func (cm *ConversationManager) getConversationEntriesFromCache(uid string) []*conversationCacheEntry {
+	if cm.cacheDisabled() {
+		return nil
+	}
 	pos := cm.getLockIndex(uid)
 	cm.userConversationMapBucketLocks[pos].Lock()
 	defer cm.userConversationMapBucketLocks[pos].Unlock()
 	cache := cm.getUserConversationCacheNoLock(uid)
-	conversations := make([]*wkstore.Conversation, 0, cache.Len())
+	entries := make([]*conversationCacheEntry, 0, cache.Len())
+	now := cm.now()
+	dirty := cm.needSave(uid)
 	for _, key := range cache.Keys() {
-		conversation, _ := cache.Get(key)
-		conversations = append(conversations, conversation)
+		entry, _ := cache.Get(key)
+		if !dirty && cm.cacheEntryExpired(entry, now) {
+			cache.Remove(key)
+			continue
+		}
+		entries = append(entries, entry)
 	}
-	return conversations
+	return entries
 }
 
 func (cm *ConversationManager) getLockIndex(uid string) int {
@@ -365,6 +1176,9 @@ func (cm *ConversationManager) calConversation(message *Message, subscriber stri
 	if message.ChannelType == wkproto.ChannelTypePerson && message.ChannelID == subscriber { // If it is a personal channel and the channel ID is equal to the subscriber, you need to swap fromUID and channelID
 		channelID = message.FromUID
 	}
+	if cm.isLeftChannel(subscriber, channelID, message.ChannelType) { // 已离开频道
+		return
+	}
 	conversation := cm.getConversationFromCache(subscriber, channelID, message.ChannelType)
 
 	if conversation == nil {
@@ -374,6 +1188,13 @@ func (cm *ConversationManager) calConversation(message *Message, subscriber stri
 			cm.Error("获取某个最接近会话失败！", zap.String("subscriber", subscriber), zap.String("channelID", channelID), zap.Uint8("channelType", message.ChannelType), zap.Error(err))
 		}
 	}
+	if conversation != nil && conversation.Left { // 冻结的最近会话不再更新
+		return
+	}
+	if conversation != nil && cm.cacheDisabled() { // 关闭了缓存时直接修改数据库里的最近会话，同一个最近会话并发投递消息时不会互相覆盖
+		cm.updateStoredConversation(message, subscriber, channelID)
+		return
+	}
 
 	var modify = false
 	if conversation == nil {
@@ -416,30 +1237,190 @@ func (cm *ConversationManager) calConversation(message *Message, subscriber stri
 
 }
 
+// updateStoredConversation 投递消息后修改数据库里已有的最近会话，需要红点时未读数原子地加1，最后一条消息只有messageSeq更大时才修改
+func (cm *ConversationManager) updateStoredConversation(message *Message, subscriber string, channelID string) {
+	if message.RedDot && message.FromUID != subscriber { //  message.FromUID != subscriber 自己发的消息不显示红点
+		if _, err := cm.IncConversationUnread(subscriber, channelID, message.ChannelType, 1, false); err != nil {
+			cm.Error("增加最近会话未读数失败！", zap.Error(err), zap.String("subscriber", subscriber), zap.String("channelID", channelID), zap.Uint8("channelType", message.ChannelType))
+		}
+	}
+	if _, err := cm.UpdateConversationLastMsg(subscriber, channelID, message.ChannelType, message.MessageSeq, message.ClientMsgNo, int64(message.Timestamp)); err != nil {
+		cm.Error("更新最近会话最后一条消息失败！", zap.Error(err), zap.String("subscriber", subscriber), zap.String("channelID", channelID), zap.Uint8("channelType", message.ChannelType))
+	}
+}
+
+// AddOrUpdateConversation 写入缓存，由saveloop批量保存，关闭了缓存时直接保存到数据库
 func (cm *ConversationManager) AddOrUpdateConversation(uid string, conversation *wkstore.Conversation) {
+	if cm.cacheDisabled() {
+		if err := cm.s.store.AddOrUpdateConversations(uid, []*wkstore.Conversation{conversation}); err != nil {
+			cm.Error("保存最近会话失败！", zap.Error(err), zap.String("uid", uid), zap.String("channelID", conversation.ChannelID), zap.Uint8("channelType", conversation.ChannelType))
+		}
+		return
+	}
 
 	cm.setConversationCache(uid, conversation)
 
 	cm.setNeedSave(uid)
 }
 
+// AddOrUpdateConversationsCAS 按版本号比较后写入最近会话（多个节点同步同一个用户时不会互相覆盖未读数），冲突时返回*wkstore.VersionConflictError，调用方合并后重试
+// 写入前先保存并清除用户的最近会话缓存（还没保存的修改也参与比较），写入后缓存写入的最近会话
+func (cm *ConversationManager) AddOrUpdateConversationsCAS(uid string, items []wkstore.ConversationCAS) ([]*wkstore.Conversation, error) {
+	cm.InvalidateUserConversations(uid)
+	conversations, err := cm.s.store.AddOrUpdateConversationsCAS(uid, items)
+	if err != nil {
+		if !errors.Is(err, wkstore.ErrVersionConflict) {
+			cm.Error("按版本号写入最近会话失败！", zap.Error(err), zap.String("uid", uid), zap.Int("count", len(items)))
+		}
+		return nil, err
+	}
+	for _, conversation := range conversations {
+		cm.setConversationCache(uid, conversation)
+	}
+	return conversations, nil
+}
+
+// ConversationQuery 查询用户最近会话的条件
+type ConversationQuery struct {
+	Version       int64              // 只返回版本号大于此值的最近会话（增量同步）
+	VersionBefore int64              // 只返回版本号小于此值的最近会话（向前翻页加载更早的最近会话）
+	Limit         int                // 最多返回的数量，0表示不限制
+	Larges        []*wkproto.Channel // 超大频道，不受Version限制（向前翻页时不特殊处理）
+	ExcludeMuted  bool               // 不返回开启了免打扰的最近会话
+	// IncludeArchived 同时返回已归档的最近会话（默认不返回，已归档的通过GetArchivedConversations查询）
+	IncludeArchived bool
+	// IncludeChannelTypes 只返回这些频道类型的最近会话，和ExcludeChannelTypes只能设置一个（都设置时只看IncludeChannelTypes）
+	IncludeChannelTypes []uint8
+	// ExcludeChannelTypes 不返回这些频道类型的最近会话
+	ExcludeChannelTypes []uint8
+}
+
+// filterChannelTypes 是否按频道类型过滤
+func (q ConversationQuery) filterChannelTypes() bool {
+	return len(q.IncludeChannelTypes) > 0 || len(q.ExcludeChannelTypes) > 0
+}
+
+// matchChannelType 频道类型是否满足IncludeChannelTypes/ExcludeChannelTypes
+func (q ConversationQuery) matchChannelType(channelType uint8) bool {
+	if len(q.IncludeChannelTypes) > 0 {
+		return containsChannelType(q.IncludeChannelTypes, channelType)
+	}
+	return !containsChannelType(q.ExcludeChannelTypes, channelType)
+}
+
+func containsChannelType(channelTypes []uint8, channelType uint8) bool {
+	for _, t := range channelTypes {
+		if t == channelType {
+			return true
+		}
+	}
+	return false
+}
+
 // GetConversations GetConversations
 func (cm *ConversationManager) GetConversations(uid string, version int64, larges []*wkproto.Channel) []*wkstore.Conversation {
+	return cm.GetConversationsWithOpts(uid, ConversationQuery{Version: version, Larges: larges})
+}
+
+// ConversationReadMeta 查询最近会话结果的来源（排查客户端拿到的最近会话不是最新的问题）
+type ConversationReadMeta struct {
+	FromCache  bool  `json:"from_cache"`   // 返回的最近会话是否有来自缓存（还没保存到数据库）的
+	CacheAgeMs int64 `json:"cache_age_ms"` // 返回的来自缓存的最近会话里最早写入缓存的距今多久（毫秒）
+	ScanKeys   int   `json:"scan_keys"`    // 查询时读取的最近会话数量（数据库和缓存）
+	Total      int   `json:"total"`        // 满足条件的最近会话数量（Limit截断前）
+}
+
+// GetConversationsWithTotal 同GetConversationsWithOpts，同时返回满足条件的最近会话总数（Limit截断前）
+func (cm *ConversationManager) GetConversationsWithTotal(uid string, query ConversationQuery) ([]*wkstore.Conversation, int) {
+	conversations, meta := cm.GetConversationsWithMeta(uid, query)
+	return conversations, meta.Total
+}
+
+// GetConversationsWithOpts 按条件查询用户的最近会话
+// 设置了Limit时：设置了VersionBefore（或没有设置Version）返回版本号最大的Limit个，只设置了Version返回版本号最小的Limit个，方便用返回的最小/最大版本号继续翻页
+// 注意：版本号是毫秒时间戳，翻页边界上版本号相同的最近会话可能会被跳过
+func (cm *ConversationManager) GetConversationsWithOpts(uid string, query ConversationQuery) []*wkstore.Conversation {
+	conversations, _ := cm.GetConversationsWithMeta(uid, query)
+	return conversations
+}
+
+// GetConversationsWithMeta 同GetConversationsWithOpts，同时返回结果的来源
+func (cm *ConversationManager) GetConversationsWithMeta(uid string, query ConversationQuery) ([]*wkstore.Conversation, ConversationReadMeta) {
+	var meta ConversationReadMeta
+	newConversations, cachedAt, err := cm.getMergedConversationsWithMeta(uid, &meta)
+	if err != nil {
+		cm.Warn("Failed to get the conversation from the database", zap.Error(err))
+		return nil, meta
+	}
+	conversationSlice := conversationSlice{}
+	for _, conversation := range newConversations {
+		if conversation != nil && cm.matchConversationQuery(conversation, query) {
+			conversationSlice = append(conversationSlice, conversation)
+		}
+	}
+	meta.Total = len(conversationSlice)
+	if query.Limit > 0 && len(conversationSlice) > query.Limit {
+		ascending := query.VersionBefore <= 0 && query.Version > 0
+		sort.Slice(conversationSlice, func(i, j int) bool {
+			if ascending {
+				return conversationSlice[i].Version < conversationSlice[j].Version
+			}
+			return conversationSlice[i].Version > conversationSlice[j].Version
+		})
+		conversationSlice = conversationSlice[:query.Limit]
+	}
+	sort.Sort(conversationSlice)
+
+	if len(cachedAt) > 0 {
+		now := cm.now()
+		for _, conversation := range conversationSlice {
+			t, ok := cachedAt[conversation]
+			if !ok {
+				continue
+			}
+			meta.FromCache = true
+			if age := now.Sub(t).Milliseconds(); age > meta.CacheAgeMs {
+				meta.CacheAgeMs = age
+			}
+		}
+	}
+	return conversationSlice, meta
+}
+
+// getMergedConversations 数据库里的最近会话合并缓存里还没保存的最近会话（缓存的优先）
+func (cm *ConversationManager) getMergedConversations(uid string) ([]*wkstore.Conversation, error) {
+	conversations, _, err := cm.getMergedConversationsWithMeta(uid, nil)
+	return conversations, err
+}
+
+// getMergedConversationsWithMeta 同getMergedConversations，同时返回来自缓存的最近会话写入缓存的时间，meta不为nil时记录读取的数量
+func (cm *ConversationManager) getMergedConversationsWithMeta(uid string, meta *ConversationReadMeta) ([]*wkstore.Conversation, map[*wkstore.Conversation]time.Time, error) {
+
+	cm.applyPendingInvalidate(uid)
 
 	newConversations := make([]*wkstore.Conversation, 0)
 
 	oldConversations, err := cm.getUserAllConversationMapFromStore(uid)
 	if err != nil {
-		cm.Warn("Failed to get the conversation from the database", zap.Error(err))
-		return nil
+		return nil, nil, err
 	}
 	if len(oldConversations) > 0 {
 		newConversations = append(newConversations, oldConversations...)
 	}
 
-	updateConversations := cm.getConversationsFromCache(uid)
-
-	for _, updateConversation := range updateConversations {
+	entries := cm.getConversationEntriesFromCache(uid)
+	if meta != nil {
+		meta.ScanKeys = len(oldConversations) + len(entries)
+	}
+	var cachedAt map[*wkstore.Conversation]time.Time
+	if meta != nil && len(entries) > 0 {
+		cachedAt = make(map[*wkstore.Conversation]time.Time, len(entries))
+	}
+	for _, entry := range entries {
+		updateConversation := entry.conversation
+		if cachedAt != nil {
+			cachedAt[updateConversation] = entry.cachedAt
+		}
 		existIndex := 0
 		var existConversation *wkstore.Conversation
 		for idx, conversation := range oldConversations {
@@ -455,16 +1436,27 @@ func (cm *ConversationManager) GetConversations(uid string, version int64, large
 			newConversations[existIndex] = existConversation
 		}
 	}
-	conversationSlice := conversationSlice{}
-	for _, conversation := range newConversations {
-		if conversation != nil {
-			if version <= 0 || conversation.Version > version || cm.channelInLarges(conversation.ChannelID, conversation.ChannelType, larges) {
-				conversationSlice = append(conversationSlice, conversation)
-			}
+	return newConversations, cachedAt, nil
+}
+
+func (cm *ConversationManager) matchConversationQuery(conversation *wkstore.Conversation, query ConversationQuery) bool {
+	if query.ExcludeMuted && conversation.Muted() {
+		return false
+	}
+	if conversation.Archived && !query.IncludeArchived {
+		return false
+	}
+	if !query.matchChannelType(conversation.ChannelType) {
+		return false
+	}
+	if query.VersionBefore > 0 {
+		if conversation.Version >= query.VersionBefore {
+			return false
 		}
+	} else if cm.channelInLarges(conversation.ChannelID, conversation.ChannelType, query.Larges) {
+		return true
 	}
-	sort.Sort(conversationSlice)
-	return conversationSlice
+	return query.Version <= 0 || conversation.Version > query.Version
 }
 
 func (cm *ConversationManager) channelInLarges(channelID string, channelType uint8, larges []*wkproto.Channel) bool {
@@ -480,6 +1472,9 @@ func (cm *ConversationManager) channelInLarges(channelID string, channelType uin
 }
 
 func (cm *ConversationManager) setNeedSave(uid string) {
+	if cm.cacheDisabled() { // 没有缓存，修改已经直接保存
+		return
+	}
 	cm.needSaveChan <- uid
 }
 
@@ -493,6 +1488,10 @@ func (s conversationSlice) Len() int { return len(s) }
 
 func (s conversationSlice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
 
+// Less 置顶的在前面（按置顶时间从新到旧），其他的按最后一条消息的时间从新到旧
 func (s conversationSlice) Less(i, j int) bool {
+	if s[i].PinnedAt != s[j].PinnedAt {
+		return s[i].PinnedAt > s[j].PinnedAt
+	}
 	return s[i].Timestamp > s[j].Timestamp
 }
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/WuKongIM/WuKongIM/pkg/wkstore"
+)
+
+// ErrInvalidConversationCursor 最近会话分页的游标格式不对
+var ErrInvalidConversationCursor = errors.New("invalid conversation cursor")
+
+// conversationCursor 上一页最后一条最近会话的排序位置
+type conversationCursor struct {
+	PinnedAt    int64  `json:"p,omitempty"`
+	Timestamp   int64  `json:"t"`
+	ChannelType uint8  `json:"ct"`
+	ChannelID   string `json:"c"`
+}
+
+func newConversationCursor(conversation *wkstore.Conversation) conversationCursor {
+	return conversationCursor{
+		PinnedAt:    conversation.PinnedAt,
+		Timestamp:   conversation.Timestamp,
+		ChannelType: conversation.ChannelType,
+		ChannelID:   conversation.ChannelID,
+	}
+}
+
+func (c conversationCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeConversationCursor(cursor string) (conversationCursor, error) {
+	var c conversationCursor
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return c, ErrInvalidConversationCursor
+	}
+	if err = json.Unmarshal(data, &c); err != nil || c.ChannelID == "" {
+		return c, ErrInvalidConversationCursor
+	}
+	return c, nil
+}
+
+// before 置顶的排在前面（按置顶时间从新到旧），然后按最后一条消息的时间从新到旧排序（没有消息的时间为0排在最后），时间相同的按频道排序
+func (c conversationCursor) before(o conversationCursor) bool {
+	if c.PinnedAt != o.PinnedAt {
+		return c.PinnedAt > o.PinnedAt
+	}
+	if c.Timestamp != o.Timestamp {
+		return c.Timestamp > o.Timestamp
+	}
+	if c.ChannelType != o.ChannelType {
+		return c.ChannelType < o.ChannelType
+	}
+	return c.ChannelID < o.ChannelID
+}
+
+// ConversationPageMeta 分页获取最近会话时的分页信息
+type ConversationPageMeta struct {
+	HasMore bool `json:"has_more"` // 后面还有最近会话（和返回的游标不为空一致）
+	Total   int  `json:"total"`    // 最近会话列表里的总数（不包括已归档的），翻页期间有新增或删除时会变化
+}
+
+// GetConversationsWithCursor 置顶的在前面，其他的按最后一条消息的时间从新到旧分页获取最近会话，cursor为上一页返回的游标（第一页传空），limit<=0表示返回剩下的所有
+// 返回的游标为空表示没有更多了；每页都是合并缓存后的结果，翻页期间有更新的最近会话会排到前面，不会在后面的页里重复返回
+func (cm *ConversationManager) GetConversationsWithCursor(uid string, cursor string, limit int) ([]*wkstore.Conversation, string, error) {
+	page, next, _, err := cm.GetConversationsWithCursorMeta(uid, cursor, limit)
+	return page, next, err
+}
+
+// GetConversationsWithCursorMeta 同GetConversationsWithCursor，同时返回分页信息
+// 分页信息和最近会话来自同一次合并缓存后的结果，有没有缓存返回的都一致；刚好剩下limit个时HasMore为false
+func (cm *ConversationManager) GetConversationsWithCursorMeta(uid string, cursor string, limit int) ([]*wkstore.Conversation, string, ConversationPageMeta, error) {
+	var (
+		after    conversationCursor
+		hasAfter bool
+		meta     ConversationPageMeta
+		err      error
+	)
+	if cursor != "" {
+		if after, err = decodeConversationCursor(cursor); err != nil {
+			return nil, "", meta, err
+		}
+		hasAfter = true
+	}
+	conversations, err := cm.getMergedConversations(uid)
+	if err != nil {
+		return nil, "", meta, err
+	}
+	page := make([]*wkstore.Conversation, 0, len(conversations))
+	for _, conversation := range conversations {
+		if conversation == nil || conversation.Archived { // 已归档的不在最近会话列表里
+			continue
+		}
+		meta.Total++
+		if hasAfter && !after.before(newConversationCursor(conversation)) {
+			continue
+		}
+		page = append(page, conversation)
+	}
+	sort.Slice(page, func(i, j int) bool {
+		return newConversationCursor(page[i]).before(newConversationCursor(page[j]))
+	})
+	if limit <= 0 || len(page) <= limit {
+		return page, "", meta, nil
+	}
+	meta.HasMore = true
+	page = page[:limit]
+	return page, newConversationCursor(page[len(page)-1]).encode(), meta, nil
+}
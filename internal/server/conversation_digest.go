@@ -0,0 +1,112 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/WuKongIM/WuKongIM/pkg/wkstore"
+	"go.uber.org/zap"
+)
+
+// OfflineDigestHandler 用户离线超过OfflineDigestDelay后调用，digest为有未读消息的最近会话摘要（没有未读时不调用）
+type OfflineDigestHandler func(uid string, digest []*wkstore.ConversationUnreadDigest)
+
+// RegisterOfflineDigestHandler 注册用户离线后的未读摘要回调（比如发webhook给邮件摘要服务），需要同时配置Conversation.OfflineDigestDelay
+func (s *Server) RegisterOfflineDigestHandler(h OfflineDigestHandler) {
+	s.conversationManager.offlineDigest.setHandler(h)
+}
+
+// GetConversationUnreadDigest 用户有未读消息的最近会话摘要（合并缓存里还没保存的修改），按最后一次会话的时间从新到旧，最多topN个
+func (cm *ConversationManager) GetConversationUnreadDigest(uid string, topN int) ([]*wkstore.ConversationUnreadDigest, error) {
+	conversations, err := cm.getMergedConversations(uid)
+	if err != nil {
+		return nil, err
+	}
+	return wkstore.UnreadDigest(conversations, topN), nil
+}
+
+// offlineDigest 用户所有设备离线后延迟生成未读摘要，延迟期间重新上线则取消
+type offlineDigest struct {
+	mu      sync.Mutex
+	handler OfflineDigestHandler
+	timers  map[string]*time.Timer // 等待生成摘要的用户
+}
+
+func newOfflineDigest() *offlineDigest {
+	return &offlineDigest{
+		timers: make(map[string]*time.Timer),
+	}
+}
+
+func (o *offlineDigest) setHandler(h OfflineDigestHandler) {
+	o.mu.Lock()
+	o.handler = h
+	o.mu.Unlock()
+}
+
+// userOffline 用户所有设备都离线了，OfflineDigestDelay后还没有上线时把未读摘要交给回调
+func (cm *ConversationManager) userOffline(uid string) {
+	delay := cm.s.opts.Conversation.OfflineDigestDelay
+	if delay <= 0 {
+		return
+	}
+	o := cm.offlineDigest
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.handler == nil {
+		return
+	}
+	if timer := o.timers[uid]; timer != nil {
+		timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		o.mu.Lock()
+		if o.timers[uid] != timer { // 已经取消或者重新计时了
+			o.mu.Unlock()
+			return
+		}
+		delete(o.timers, uid)
+		handler := o.handler
+		o.mu.Unlock()
+		cm.sendOfflineDigest(uid, handler)
+	})
+	o.timers[uid] = timer
+}
+
+// userOnline 用户上线了，取消等待中的未读摘要
+func (cm *ConversationManager) userOnline(uid string) {
+	o := cm.offlineDigest
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if timer := o.timers[uid]; timer != nil {
+		timer.Stop()
+		delete(o.timers, uid)
+	}
+}
+
+// stopOfflineDigest 取消所有等待中的未读摘要
+func (cm *ConversationManager) stopOfflineDigest() {
+	o := cm.offlineDigest
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for uid, timer := range o.timers {
+		timer.Stop()
+		delete(o.timers, uid)
+	}
+}
+
+func (cm *ConversationManager) sendOfflineDigest(uid string, handler OfflineDigestHandler) {
+	if handler == nil || cm.s.connManager.ExistConnsWithUID(uid) { // 上线和计时器触发同时发生
+		return
+	}
+	digest, err := cm.GetConversationUnreadDigest(uid, cm.s.opts.Conversation.OfflineDigestTopN)
+	if err != nil {
+		cm.Warn("failed to get conversation unread digest", zap.String("uid", uid), zap.Error(err))
+		return
+	}
+	if len(digest) == 0 {
+		return
+	}
+	handler(uid, digest)
+}
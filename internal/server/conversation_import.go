@@ -0,0 +1,57 @@
+package server
+
+import (
+	"io"
+	"time"
+
+	"github.com/WuKongIM/WuKongIM/pkg/wkstore"
+	"go.uber.org/zap"
+)
+
+// ImportReadPositions 从其他系统迁移时批量导入用户的已读位置（csv或ndjson），返回修改或创建了最近会话的记录数量和跳过的记录数量
+// 导入前先保存缓存里还没保存的修改（避免之后保存时覆盖导入的数据），导入后每个有修改的用户清除一次缓存
+func (cm *ConversationManager) ImportReadPositions(r io.Reader) (applied int, skipped int, err error) {
+	start := time.Now()
+	cm.FlushConversations()
+	result, err := cm.s.store.ImportReadPositions(r, wkstore.MaintenanceOptions{
+		Progress: func(event wkstore.ProgressEvent) {
+			cm.Info("importing read positions", zap.Int("records", event.Scanned), zap.Int("applied", event.Changed), zap.Bool("done", event.Done))
+		},
+	})
+	if err != nil {
+		cm.Error("导入已读位置失败！", zap.Error(err))
+		return 0, 0, err
+	}
+	for _, uid := range result.UIDs {
+		cm.InvalidateUserConversations(uid)
+	}
+	cm.Info("import read positions done", zap.Int("applied", result.Applied), zap.Int("unchanged", result.Unchanged), zap.Int("skipped", result.Skipped), zap.Int("users", len(result.UIDs)), zap.Duration("cost", time.Since(start)))
+	return result.Applied, result.Skipped, nil
+}
+
+// ExportUserConversations 导出用户的所有最近会话（json lines），导出前先保存缓存里还没保存的修改
+func (cm *ConversationManager) ExportUserConversations(uid string, w io.Writer) (int, error) {
+	cm.InvalidateUserConversations(uid)
+	count, err := cm.s.store.ExportConversations(uid, w)
+	if err != nil {
+		cm.Error("导出最近会话失败！", zap.Error(err), zap.String("uid", uid))
+		return count, err
+	}
+	return count, nil
+}
+
+// ImportConversations 导入其他节点导出的最近会话，已存在的overwrite为true时覆盖否则跳过，导入后每个有修改的用户清除一次缓存
+func (cm *ConversationManager) ImportConversations(r io.Reader, overwrite bool) (*wkstore.ConversationImportResult, error) {
+	start := time.Now()
+	cm.FlushConversations()
+	result, err := cm.s.store.ImportConversations(r, overwrite)
+	if err != nil {
+		cm.Error("导入最近会话失败！", zap.Error(err))
+		return nil, err
+	}
+	for _, uid := range result.UIDs {
+		cm.InvalidateUserConversations(uid)
+	}
+	cm.Info("import conversations done", zap.Bool("overwrite", overwrite), zap.Int("inserted", result.Inserted), zap.Int("updated", result.Updated), zap.Int("skipped", result.Skipped), zap.Int("users", len(result.UIDs)), zap.Duration("cost", time.Since(start)))
+	return result, nil
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// ConversationInvalidateStats 最近会话缓存失效队列的统计
+type ConversationInvalidateStats struct {
+	Depth        int   `json:"depth"`         // 队列里等待处理的用户数量
+	ActiveDepth  int   `json:"active_depth"`  // 等待处理的活跃用户数量
+	OfflineDepth int   `json:"offline_depth"` // 等待处理的离线用户数量
+	Enqueued     int64 `json:"enqueued"`      // 进入队列的失效请求数量
+	Deduped      int64 `json:"deduped"`       // 被合并的失效请求数量（用户已经在队列里）
+	Processed    int64 `json:"processed"`     // 队列处理的用户数量
+	Direct       int64 `json:"direct"`        // 同步失效的用户数量（包括读取时提前处理队列里的用户）
+	Channel      int64 `json:"channel"`       // 只失效一个频道的次数（InvalidateConversation，不影响用户其他频道的缓存）
+	CacheHits    int64 `json:"cache_hits"`    // 查询单个最近会话时缓存命中的次数，和CacheMisses一起衡量失效对缓存命中率的影响
+	CacheMisses  int64 `json:"cache_misses"`  // 查询单个最近会话时缓存没有命中（从数据库读取）的次数
+}
+
+// conversationInvalidator 最近会话缓存失效队列
+// 同一个用户在窗口内的多次失效合并为一次，按速率处理，有连接的用户优先处理，离线用户在没有活跃用户要处理时才处理
+type conversationInvalidator struct {
+	mu       sync.Mutex
+	active   []string                   // 活跃用户
+	offline  []string                   // 离线用户
+	pending  map[string]invalidateEntry // 队列里的用户
+	window   time.Duration              // 合并窗口，入队后过了窗口时间才处理
+	rate     int                        // 每秒最多处理的用户数量
+	isActive func(uid string) bool
+	process  func(uid string)
+
+	enqueued  atomic.Int64
+	deduped   atomic.Int64
+	processed atomic.Int64
+	direct    atomic.Int64
+	channel   atomic.Int64
+	hits      atomic.Int64
+	misses    atomic.Int64
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+type invalidateEntry struct {
+	at     time.Time // 入队时间
+	active bool
+}
+
+func newConversationInvalidator(rate int, window time.Duration, isActive func(uid string) bool, process func(uid string)) *conversationInvalidator {
+	if rate <= 0 {
+		rate = 1000
+	}
+	return &conversationInvalidator{
+		pending:  map[string]invalidateEntry{},
+		window:   window,
+		rate:     rate,
+		isActive: isActive,
+		process:  process,
+		stopChan: make(chan struct{}),
+	}
+}
+
+// add 用户加入队列，已经在队列里的合并
+func (ci *conversationInvalidator) add(uids ...string) {
+	now := time.Now()
+	for _, uid := range uids {
+		ci.enqueued.Inc()
+		active := ci.isActive != nil && ci.isActive(uid)
+		ci.mu.Lock()
+		if _, ok := ci.pending[uid]; ok {
+			ci.mu.Unlock()
+			ci.deduped.Inc()
+			continue
+		}
+		ci.pending[uid] = invalidateEntry{at: now, active: active}
+		if active {
+			ci.active = append(ci.active, uid)
+		} else {
+			ci.offline = append(ci.offline, uid)
+		}
+		ci.mu.Unlock()
+	}
+}
+
+// take 用户在队列里则从队列里移除并返回true，读取最近会话前调用，保证读到的是失效后的数据
+func (ci *conversationInvalidator) take(uid string) bool {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	if _, ok := ci.pending[uid]; !ok {
+		return false
+	}
+	delete(ci.pending, uid) // 队列里的uid在pop时发现不在pending里就跳过
+	return true
+}
+
+// pop 取出一个过了合并窗口的用户，活跃用户优先
+func (ci *conversationInvalidator) pop(now time.Time) (string, bool) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	if uid, ok := ci.popFromNoLock(&ci.active, now); ok {
+		return uid, true
+	}
+	return ci.popFromNoLock(&ci.offline, now)
+}
+
+func (ci *conversationInvalidator) popFromNoLock(queue *[]string, now time.Time) (string, bool) {
+	for len(*queue) > 0 {
+		uid := (*queue)[0]
+		entry, ok := ci.pending[uid]
+		if !ok { // 已经被take处理了
+			*queue = (*queue)[1:]
+			continue
+		}
+		if now.Sub(entry.at) < ci.window { // 队列按入队时间排序，第一个没到时间后面的也没到
+			return "", false
+		}
+		*queue = (*queue)[1:]
+		delete(ci.pending, uid)
+		return uid, true
+	}
+	*queue = nil // 释放底层数组
+	return "", false
+}
+
+func (ci *conversationInvalidator) start() {
+	go ci.loop()
+}
+
+func (ci *conversationInvalidator) stop() {
+	ci.stopOnce.Do(func() {
+		close(ci.stopChan)
+	})
+}
+
+func (ci *conversationInvalidator) loop() {
+	interval := time.Second / time.Duration(ci.rate)
+	batch := 1
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+		batch = ci.rate / 1000
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for i := 0; i < batch; i++ {
+				uid, ok := ci.pop(now)
+				if !ok {
+					break
+				}
+				ci.processed.Inc()
+				ci.process(uid)
+			}
+		case <-ci.stopChan:
+			return
+		}
+	}
+}
+
+func (ci *conversationInvalidator) stats() *ConversationInvalidateStats {
+	ci.mu.Lock()
+	stats := &ConversationInvalidateStats{
+		Depth: len(ci.pending),
+	}
+	for _, entry := range ci.pending {
+		if entry.active {
+			stats.ActiveDepth++
+		}
+	}
+	ci.mu.Unlock()
+	stats.OfflineDepth = stats.Depth - stats.ActiveDepth
+	stats.Enqueued = ci.enqueued.Load()
+	stats.Deduped = ci.deduped.Load()
+	stats.Processed = ci.processed.Load()
+	stats.Direct = ci.direct.Load()
+	stats.Channel = ci.channel.Load()
+	stats.CacheHits = ci.hits.Load()
+	stats.CacheMisses = ci.misses.Load()
+	return stats
+}
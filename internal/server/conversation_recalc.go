@@ -0,0 +1,42 @@
+package server
+
+import (
+	"time"
+
+	"github.com/WuKongIM/WuKongIM/pkg/wkstore"
+	wkproto "github.com/WuKongIM/WuKongIMGoProto"
+	"go.uber.org/zap"
+)
+
+// RecalculateConversationUnread 按已读位置和频道最新的消息重新计算用户所有最近会话的未读数（修复未读数和消息对不上的用户），返回修正的最近会话
+// 修改前先保存并清除用户的最近会话缓存，修改期间重新缓存的最近会话未读数没有变化时按同样的结果修正
+func (cm *ConversationManager) RecalculateConversationUnread(uid string) (*wkstore.ConversationUnreadReport, error) {
+	cm.InvalidateUserConversations(uid)
+	report, err := cm.s.store.RecalculateConversationUnread(uid, func(channelID string, channelType uint8) (uint32, error) {
+		fakeChannelID := channelID
+		if channelType == wkproto.ChannelTypePerson {
+			fakeChannelID = GetFakeChannelIDWith(uid, channelID)
+		}
+		return cm.s.store.GetLastMsgSeq(fakeChannelID, channelType)
+	})
+	if err != nil {
+		cm.Error("重新计算最近会话未读数失败！", zap.Error(err), zap.String("uid", uid))
+		return nil, err
+	}
+	for _, correction := range report.Corrected {
+		oldUnread, newUnread := correction.OldUnread, correction.NewUnread
+		cm.updateConversationCache(uid, correction.ChannelID, correction.ChannelType, func(cached *wkstore.Conversation) *wkstore.Conversation {
+			if cached.UnreadCount != oldUnread {
+				return cached
+			}
+			newConversation := *cached
+			newConversation.UnreadCount = newUnread
+			newConversation.Version = time.Now().UnixNano() / 1e6
+			return &newConversation
+		})
+	}
+	if len(report.Corrected) > 0 {
+		cm.Info("重新计算最近会话未读数", zap.String("uid", uid), zap.Int("scanned", report.Scanned), zap.Int("corrected", len(report.Corrected)), zap.Int("failed", len(report.Failed)))
+	}
+	return report, nil
+}
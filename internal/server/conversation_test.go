@@ -1,11 +1,19 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/WuKongIM/WuKongIM/pkg/wkstore"
 	wkproto "github.com/WuKongIM/WuKongIMGoProto"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 )
 
 func TestGetConversations(t *testing.T) {
@@ -54,3 +62,1603 @@ func TestGetConversations(t *testing.T) {
 	cm.s.store.Close()
 
 }
+
+func TestConversationInvalidatorDedupAndPriority(t *testing.T) {
+	active := map[string]bool{"a1": true, "a2": true}
+	ci := newConversationInvalidator(1000, time.Millisecond*50, func(uid string) bool { return active[uid] }, func(uid string) {})
+
+	ci.add("o1", "a1", "o1", "a2", "a1", "o2")
+	stats := ci.stats()
+	assert.Equal(t, 4, stats.Depth)
+	assert.Equal(t, 2, stats.ActiveDepth)
+	assert.Equal(t, 2, stats.OfflineDepth)
+	assert.Equal(t, int64(6), stats.Enqueued)
+	assert.Equal(t, int64(2), stats.Deduped)
+
+	// 合并窗口内不处理
+	_, ok := ci.pop(time.Now())
+	assert.False(t, ok)
+
+	// 读取时提前处理
+	assert.True(t, ci.take("a2"))
+	assert.False(t, ci.take("a2"))
+
+	now := time.Now().Add(time.Millisecond * 50)
+	uids := make([]string, 0)
+	for {
+		uid, ok := ci.pop(now)
+		if !ok {
+			break
+		}
+		uids = append(uids, uid)
+	}
+	assert.Equal(t, []string{"a1", "o1", "o2"}, uids)
+	assert.Equal(t, 0, ci.stats().Depth)
+}
+
+func TestConversationInvalidatorLoop(t *testing.T) {
+	processed := make(chan string, 10)
+	ci := newConversationInvalidator(100, time.Millisecond*10, nil, func(uid string) {
+		processed <- uid
+	})
+	ci.start()
+	defer ci.stop()
+
+	ci.add("u1", "u2", "u1")
+	for _, expect := range []string{"u1", "u2"} {
+		select {
+		case uid := <-processed:
+			assert.Equal(t, expect, uid)
+		case <-time.After(time.Second):
+			t.Fatal("invalidate timeout")
+		}
+	}
+	select {
+	case uid := <-processed:
+		t.Fatalf("unexpected invalidate %s", uid)
+	case <-time.After(time.Millisecond * 100):
+	}
+	assert.Equal(t, int64(2), ci.stats().Processed)
+}
+
+func TestConversationDeleteConversationsByChannel(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+	cm.Start()
+	defer cm.Stop()
+
+	assert.NoError(t, s.store.AddSubscribers("g1", wkproto.ChannelTypeGroup, []string{"u1", "u2"}))
+	for _, uid := range []string{"u1", "u2"} {
+		cm.calConversation(&Message{
+			RecvPacket: &wkproto.RecvPacket{
+				Framer:      wkproto.Framer{RedDot: true},
+				MessageID:   1,
+				MessageSeq:  1,
+				ChannelID:   "g1",
+				ChannelType: wkproto.ChannelTypeGroup,
+				FromUID:     "u3",
+				Timestamp:   int32(time.Now().Unix()),
+			},
+		}, uid)
+		cm.flushUserConversations(uid)
+	}
+
+	before := cm.ConversationInvalidateStats()
+	count, err := cm.DeleteConversationsByChannel("g1", wkproto.ChannelTypeGroup)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	// 删除后通过失效队列清除成员的缓存，队列会处理完
+	assert.Equal(t, int64(2), cm.ConversationInvalidateStats().Enqueued-before.Enqueued)
+	assert.Eventually(t, func() bool {
+		stats := cm.ConversationInvalidateStats()
+		return stats.Depth == 0 && stats.Processed-before.Processed == 2
+	}, time.Second, time.Millisecond*10)
+	for _, uid := range []string{"u1", "u2"} {
+		assert.Nil(t, cm.GetConversation(uid, "g1", wkproto.ChannelTypeGroup))
+		cm.flushUserConversations(uid) // 缓存里已经没有此频道，保存后不会恢复
+		exist, err := s.store.ExistConversation(uid, "g1", wkproto.ChannelTypeGroup)
+		assert.NoError(t, err)
+		assert.False(t, exist)
+	}
+}
+
+func TestConversationCleanupExpired(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	opts.Conversation.TTL = map[uint8]time.Duration{wkproto.ChannelTypeInfo: time.Hour}
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+
+	old := time.Now().Add(-time.Hour * 2).Unix()
+	for _, uid := range []string{"u1", "u2"} {
+		conversation := &wkstore.Conversation{UID: uid, ChannelID: "cmd", ChannelType: wkproto.ChannelTypeInfo, Timestamp: old, Version: 1}
+		assert.NoError(t, s.store.AddOrUpdateConversations(uid, []*wkstore.Conversation{conversation}))
+		cm.setConversationCache(uid, conversation)
+	}
+	// u2缓存里有新的会话还没保存
+	cm.setConversationCache("u2", &wkstore.Conversation{UID: "u2", ChannelID: "cmd", ChannelType: wkproto.ChannelTypeInfo, Timestamp: time.Now().Unix(), Version: 2})
+
+	cm.cleanupExpiredConversations()
+	assert.Nil(t, cm.getConversationFromCache("u1", "cmd", wkproto.ChannelTypeInfo))
+	assert.NotNil(t, cm.getConversationFromCache("u2", "cmd", wkproto.ChannelTypeInfo))
+	for _, uid := range []string{"u1", "u2"} {
+		exist, err := s.store.ExistConversation(uid, "cmd", wkproto.ChannelTypeInfo)
+		assert.NoError(t, err)
+		assert.False(t, exist)
+	}
+}
+
+func TestConversationOnUserLeftChannel(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	opts.Conversation.LeaveFreeze = true
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+	cm.Start()
+	defer cm.Stop()
+
+	newMessage := func(seq uint32) *Message {
+		return &Message{
+			RecvPacket: &wkproto.RecvPacket{
+				Framer:      wkproto.Framer{RedDot: true},
+				MessageID:   int64(seq),
+				MessageSeq:  seq,
+				ChannelID:   "g1",
+				ChannelType: wkproto.ChannelTypeGroup,
+				FromUID:     "u2",
+				Timestamp:   int32(time.Now().Unix()),
+			},
+		}
+	}
+	assert.NoError(t, s.store.AddSubscribers("g1", wkproto.ChannelTypeGroup, []string{"u1", "u2"}))
+	cm.calConversation(newMessage(1), "u1")
+
+	// 离开后冻结，未读数清空，队列里的消息不再更新
+	assert.NoError(t, cm.OnUserLeftChannel([]string{"u1"}, "g1", wkproto.ChannelTypeGroup))
+	cm.calConversation(newMessage(2), "u1")
+	conversation, err := s.store.GetConversation("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.NoError(t, err)
+	assert.True(t, conversation.Left)
+	assert.Equal(t, 0, conversation.UnreadCount)
+	assert.Equal(t, uint32(1), conversation.LastMsgSeq)
+	assert.Len(t, cm.GetConversations("u1", 0, nil), 1)
+
+	subscribers, err := s.store.GetSubscribers("g1", wkproto.ChannelTypeGroup)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"u2"}, subscribers)
+
+	// 离开记录过期后冻结的最近会话也不再更新
+	cm.leftChannels.Delete(cm.getLeftChannelKey("u1", "g1", wkproto.ChannelTypeGroup))
+	cm.calConversation(newMessage(3), "u1")
+	conversation, err = s.store.GetConversation("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.NoError(t, err)
+	assert.True(t, conversation.Left)
+	assert.Equal(t, uint32(1), conversation.LastMsgSeq)
+
+	// 重新加入后恢复
+	assert.NoError(t, cm.OnUserJoinedChannel([]string{"u1"}, "g1", wkproto.ChannelTypeGroup))
+	cm.calConversation(newMessage(4), "u1")
+	conversation = cm.getConversationFromCache("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.False(t, conversation.Left)
+	assert.Equal(t, 1, conversation.UnreadCount)
+	assert.Equal(t, uint32(4), conversation.LastMsgSeq)
+}
+
+// 缓存里是冻结的最近会话时，重新加入频道后复制修改并标记需要保存
+func TestConversationOnUserJoinedChannelCached(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	opts.Conversation.LeaveFreeze = true
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+	cm.Start()
+	defer cm.Stop()
+
+	assert.NoError(t, s.store.AddOrUpdateConversations("u1", []*wkstore.Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, LastMsgSeq: 1, Left: true, Version: 1},
+	}))
+	cached := &wkstore.Conversation{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, LastMsgSeq: 1, Left: true, Version: 1}
+	cm.setConversationCache("u1", cached)
+
+	assert.NoError(t, cm.OnUserJoinedChannel([]string{"u1"}, "g1", wkproto.ChannelTypeGroup))
+	assert.True(t, cached.Left)
+	assert.False(t, cm.getConversationFromCache("u1", "g1", wkproto.ChannelTypeGroup).Left)
+	assert.Eventually(t, func() bool { return cm.needSave("u1") }, time.Second, time.Millisecond*10)
+
+	cm.FlushConversations()
+	conversation, err := s.store.GetConversation("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.NoError(t, err)
+	assert.False(t, conversation.Left)
+}
+
+func TestConversationRefreshChannelInfo(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	opts.Conversation.ChannelInfo = true
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+	cm.Start()
+	defer cm.Stop()
+
+	assert.NoError(t, s.store.AddOrUpdateConversations("u1", []*wkstore.Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 1, Version: 1},
+	}))
+	assert.NoError(t, s.store.AddSubscribers("g1", wkproto.ChannelTypeGroup, []string{"u1"}))
+	cached := &wkstore.Conversation{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 2, Version: 1}
+	cm.setConversationCache("u1", cached)
+
+	// 缓存里的最近会话复制后修改，修改后需要保存
+	assert.NoError(t, cm.RefreshConversationChannelInfo("g1", wkproto.ChannelTypeGroup, "group1", "avatar1"))
+	assert.Empty(t, cached.ChannelName)
+	conversation := cm.getConversationFromCache("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.Equal(t, "group1", conversation.ChannelName)
+	assert.Equal(t, "avatar1", conversation.ChannelAvatar)
+	assert.Eventually(t, func() bool { return cm.needSave("u1") }, time.Second, time.Millisecond*10)
+
+	cm.FlushConversations()
+	conversation, err := s.store.GetConversation("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.NoError(t, err)
+	assert.Equal(t, "group1", conversation.ChannelName)
+	assert.Equal(t, 2, conversation.UnreadCount)
+}
+
+func TestIncConversationUnread(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+
+	// 缓存里有还没保存的未读数，在缓存的未读数上修改
+	assert.NoError(t, s.store.AddOrUpdateConversations("u1", []*wkstore.Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 1, Version: 1},
+	}))
+	cm.setConversationCache("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 5, Version: 1})
+	conversation, err := cm.IncConversationUnread("u1", "g1", wkproto.ChannelTypeGroup, 2, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, conversation.UnreadCount)
+	cached := cm.getConversationFromCache("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.Equal(t, 7, cached.UnreadCount)
+	assert.Equal(t, conversation.Version, cached.Version)
+
+	// 没有缓存的只修改数据库
+	conversation, err = cm.IncConversationUnread("u1", "g2", wkproto.ChannelTypeGroup, 1, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, conversation.UnreadCount)
+	assert.Nil(t, cm.getConversationFromCache("u1", "g2", wkproto.ChannelTypeGroup))
+	assert.Equal(t, 1, cm.GetConversation("u1", "g2", wkproto.ChannelTypeGroup).UnreadCount)
+}
+
+func TestUpdateConversationsReadToMsgSeqCreateIfMissing(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+	cm.Start()
+	defer cm.Stop()
+
+	changed, err := cm.UpdateConversationsReadToMsgSeq("u1", []wkstore.ConversationReadTo{
+		{ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, ReadToMsgSeq: 5, CreateIfMissing: true},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, changed, 1)
+
+	// 创建的最近会话加入了缓存
+	cached := cm.getConversationFromCache("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.NotNil(t, cached)
+	assert.Equal(t, uint32(5), cached.LastMsgSeq)
+	assert.Len(t, cm.GetConversations("u1", 0, nil), 1)
+}
+
+func TestUpdateConversationsReadToMsgSeq(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+	cm.Start()
+	defer cm.Stop()
+
+	assert.NoError(t, s.store.AddOrUpdateConversations("u1", []*wkstore.Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 1, LastMsgSeq: 1, Version: 1},
+		{UID: "u1", ChannelID: "g2", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 2, LastMsgSeq: 2, Version: 1},
+	}))
+	// 缓存里还没保存的新消息
+	cm.AddOrUpdateConversation("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 3, LastMsgSeq: 3, Version: 2})
+
+	changed, err := cm.UpdateConversationsReadToMsgSeq("u1", []wkstore.ConversationReadTo{
+		{ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, ReadToMsgSeq: 3},
+		{ChannelID: "g2", ChannelType: wkproto.ChannelTypeGroup, ReadToMsgSeq: 1},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, changed, 2)
+	assert.Equal(t, 0, cm.GetConversation("u1", "g1", wkproto.ChannelTypeGroup).UnreadCount)
+	assert.Equal(t, uint32(3), cm.GetConversation("u1", "g1", wkproto.ChannelTypeGroup).LastMsgSeq)
+	assert.Equal(t, 1, cm.GetConversation("u1", "g2", wkproto.ChannelTypeGroup).UnreadCount)
+}
+
+// 缓存里还没保存的修改（比如设置未读数）在获取版本号前保存，每次修改版本号只加1
+func TestGetConversationVersion(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+	cm.Start()
+	defer cm.Stop()
+
+	assert.NoError(t, s.store.AddOrUpdateConversations("u1", []*wkstore.Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 3, LastMsgSeq: 3, Version: 1},
+	}))
+	version, err := cm.GetConversationVersion("u1")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), version)
+
+	assert.NoError(t, cm.SetConversationUnread("u1", "g1", wkproto.ChannelTypeGroup, 0, 3))
+	version, err = cm.GetConversationVersion("u1")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), version)
+	version, err = cm.GetConversationVersion("u1")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), version)
+
+	_, err = cm.UpdateConversationsReadToMsgSeq("u1", []wkstore.ConversationReadTo{{ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, ReadToMsgSeq: 3}}) // 已经是已读
+	assert.NoError(t, err)
+	version, err = cm.GetConversationVersion("u1")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), version)
+}
+
+func TestGetConversationsWithOptsPaging(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+
+	const (
+		total    = 85
+		pageSize = 20
+		base     = int64(1700000000000)
+	)
+	conversations := make([]*wkstore.Conversation, 0, total)
+	for i := 0; i < total; i++ {
+		conversations = append(conversations, &wkstore.Conversation{
+			UID:         "u1",
+			ChannelID:   fmt.Sprintf("g%d", i),
+			ChannelType: wkproto.ChannelTypeGroup,
+			Timestamp:   base + int64(i),
+			Version:     base + int64(i),
+		})
+	}
+	assert.NoError(t, s.store.AddOrUpdateConversations("u1", conversations))
+
+	// 从最新的开始向前翻页
+	backward := make([]*wkstore.Conversation, 0, total)
+	query := ConversationQuery{Limit: pageSize}
+	for {
+		page := cm.GetConversationsWithOpts("u1", query)
+		if len(page) == 0 {
+			break
+		}
+		assert.LessOrEqual(t, len(page), pageSize)
+		backward = append(backward, page...)
+		query.VersionBefore = page[len(page)-1].Version
+	}
+	assert.Len(t, backward, total)
+	for i, conversation := range backward {
+		assert.Equal(t, base+int64(total-1-i), conversation.Version)
+	}
+
+	// 从最旧的开始向后翻页（增量同步）
+	forward := make([]*wkstore.Conversation, 0, total)
+	query = ConversationQuery{Version: base - 1, Limit: pageSize}
+	for {
+		page := cm.GetConversationsWithOpts("u1", query)
+		if len(page) == 0 {
+			break
+		}
+		assert.LessOrEqual(t, len(page), pageSize)
+		forward = append(page, forward...)
+		query.Version = page[0].Version
+	}
+	assert.Equal(t, backward, forward)
+
+	// 上下界一起使用
+	page := cm.GetConversationsWithOpts("u1", ConversationQuery{Version: base + 10, VersionBefore: base + 20})
+	assert.Len(t, page, 9)
+}
+
+func TestGetConversationsWithCursor(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+
+	const (
+		total    = 85
+		pageSize = 20
+		base     = int64(1700000000)
+	)
+	conversations := make([]*wkstore.Conversation, 0, total)
+	for i := 0; i < total; i++ {
+		timestamp := base + int64(i/2) // 时间相同的按频道排序
+		if i < 5 {
+			timestamp = 0 // 没有消息的排在最后
+		}
+		conversations = append(conversations, &wkstore.Conversation{
+			UID:         "u1",
+			ChannelID:   fmt.Sprintf("g%d", i),
+			ChannelType: wkproto.ChannelTypeGroup,
+			Timestamp:   timestamp,
+		})
+	}
+	assert.NoError(t, s.store.AddOrUpdateConversations("u1", conversations))
+
+	seen := make(map[string]bool)
+	pages := make([]*wkstore.Conversation, 0, total)
+	cursor := ""
+	for i := 0; ; i++ {
+		page, next, err := cm.GetConversationsWithCursor("u1", cursor, pageSize)
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, len(page), pageSize)
+		for _, conversation := range page {
+			assert.False(t, seen[conversation.ChannelID], conversation.ChannelID)
+			seen[conversation.ChannelID] = true
+		}
+		pages = append(pages, page...)
+		if next == "" {
+			break
+		}
+		cursor = next
+		// 翻页期间缓存里有新的最近会话，跳过而不是重复返回
+		cm.setConversationCache("u1", &wkstore.Conversation{
+			UID:         "u1",
+			ChannelID:   fmt.Sprintf("new%d", i),
+			ChannelType: wkproto.ChannelTypeGroup,
+			Timestamp:   base + 2*total + int64(i),
+		})
+		// 已经返回过的最近会话有更新
+		updated := *page[0]
+		updated.Timestamp = base + total + int64(i)
+		cm.setConversationCache("u1", &updated)
+	}
+	assert.Len(t, pages, total)
+	for i := 1; i < len(pages); i++ {
+		prev, cur := pages[i-1], pages[i]
+		assert.True(t, prev.Timestamp > cur.Timestamp || (prev.Timestamp == cur.Timestamp && prev.ChannelID < cur.ChannelID))
+	}
+	for _, conversation := range pages[total-5:] {
+		assert.Equal(t, int64(0), conversation.Timestamp)
+	}
+
+	// 合并了缓存，新的最近会话在第一页
+	page, _, err := cm.GetConversationsWithCursor("u1", "", pageSize)
+	assert.NoError(t, err)
+	assert.Equal(t, "new3", page[0].ChannelID)
+
+	_, _, err = cm.GetConversationsWithCursor("u1", "bad cursor", pageSize)
+	assert.ErrorIs(t, err, ErrInvalidConversationCursor)
+}
+
+func TestGetConversationsWithCursorMeta(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+
+	assert.NoError(t, s.store.AddOrUpdateConversations("u1", []*wkstore.Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 3},
+		{UID: "u1", ChannelID: "g2", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 2},
+		{UID: "u1", ChannelID: "g3", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 1},
+		{UID: "u1", ChannelID: "g4", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 4, Archived: true}, // 已归档的不计入总数
+	}))
+
+	// 刚好limit个时没有更多了
+	page, next, meta, err := cm.GetConversationsWithCursorMeta("u1", "", 3)
+	assert.NoError(t, err)
+	assert.Len(t, page, 3)
+	assert.Empty(t, next)
+	assert.Equal(t, ConversationPageMeta{HasMore: false, Total: 3}, meta)
+
+	page, next, meta, err = cm.GetConversationsWithCursorMeta("u1", "", 2)
+	assert.NoError(t, err)
+	assert.Len(t, page, 2)
+	assert.NotEmpty(t, next)
+	assert.Equal(t, ConversationPageMeta{HasMore: true, Total: 3}, meta)
+
+	// 最后一页刚好剩下limit个
+	page, next, meta, err = cm.GetConversationsWithCursorMeta("u1", next, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "g3", page[0].ChannelID)
+	assert.Empty(t, next)
+	assert.Equal(t, ConversationPageMeta{HasMore: false, Total: 3}, meta)
+
+	// 缓存里的最近会话合并后计算，已存储的频道不重复计数
+	cm.setConversationCache("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 5})
+	cm.setConversationCache("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g5", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 6})
+	page, next, meta, err = cm.GetConversationsWithCursorMeta("u1", "", 4)
+	assert.NoError(t, err)
+	assert.Len(t, page, 4)
+	assert.Empty(t, next)
+	assert.Equal(t, ConversationPageMeta{HasMore: false, Total: 4}, meta)
+	assert.Equal(t, "g5", page[0].ChannelID)
+}
+
+// 置顶的最近会话排在前面，缓存里的最近会话同步修改置顶时间，保存缓存时不会覆盖置顶状态
+func TestSetConversationPinned(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+	cm.Start()
+	defer cm.Stop()
+
+	assert.NoError(t, s.store.AddOrUpdateConversations("u1", []*wkstore.Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 1, Version: 1},
+		{UID: "u1", ChannelID: "g2", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 2, Version: 1},
+		{UID: "u1", ChannelID: "g3", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 3, Version: 1},
+	}))
+	cached := &wkstore.Conversation{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 4, Version: 2}
+	cm.setConversationCache("u1", cached)
+
+	conversation, err := cm.SetConversationPinned("u1", "g2", wkproto.ChannelTypeGroup, true)
+	assert.NoError(t, err)
+	assert.True(t, conversation.Pinned())
+	conversation, err = cm.SetConversationPinned("u1", "g1", wkproto.ChannelTypeGroup, true)
+	assert.NoError(t, err)
+	assert.True(t, cm.getConversationFromCache("u1", "g1", wkproto.ChannelTypeGroup).Pinned())
+	// 缓存里的最近会话复制后修改，数据版本变大并标记需要保存
+	assert.False(t, cached.Pinned())
+	assert.Greater(t, cm.getConversationFromCache("u1", "g1", wkproto.ChannelTypeGroup).Version, cached.Version)
+	assert.Eventually(t, func() bool { return cm.needSave("u1") }, time.Second, time.Millisecond*10)
+
+	conversations := cm.GetConversations("u1", 0, nil)
+	channelIDs := make([]string, 0, len(conversations))
+	for _, conversation := range conversations {
+		channelIDs = append(channelIDs, conversation.ChannelID)
+	}
+	assert.Equal(t, []string{"g1", "g2", "g3"}, channelIDs)
+
+	page, _, err := cm.GetConversationsWithCursor("u1", "", 2)
+	assert.NoError(t, err)
+	assert.Len(t, page, 2)
+	assert.Equal(t, "g1", page[0].ChannelID)
+	assert.Equal(t, "g2", page[1].ChannelID)
+
+	_, err = cm.SetConversationPinned("u1", "g4", wkproto.ChannelTypeGroup, true)
+	assert.ErrorIs(t, err, wkstore.ErrNotFound)
+}
+
+func TestSetConversationMute(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+	cm.Start()
+	defer cm.Stop()
+
+	assert.NoError(t, s.store.AddOrUpdateConversations("u1", []*wkstore.Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 1, Version: 1},
+		{UID: "u1", ChannelID: "g2", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 2, Version: 1},
+	}))
+	cm.setConversationCache("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 3, Version: 2})
+
+	conversation, err := cm.SetConversationMute("u1", "g1", wkproto.ChannelTypeGroup, 1)
+	assert.NoError(t, err)
+	assert.True(t, conversation.Muted())
+	assert.True(t, cm.getConversationFromCache("u1", "g1", wkproto.ChannelTypeGroup).Muted())
+
+	assert.Len(t, cm.GetConversationsWithOpts("u1", ConversationQuery{}), 2)
+	conversations := cm.GetConversationsWithOpts("u1", ConversationQuery{ExcludeMuted: true})
+	assert.Len(t, conversations, 1)
+	assert.Equal(t, "g2", conversations[0].ChannelID)
+
+	_, err = cm.SetConversationMute("u1", "g3", wkproto.ChannelTypeGroup, 1)
+	assert.ErrorIs(t, err, wkstore.ErrNotFound)
+}
+
+func TestSetConversationExtra(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+	cm.Start()
+	defer cm.Stop()
+
+	assert.NoError(t, s.store.AddOrUpdateConversations("u1", []*wkstore.Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 1, Version: 1},
+	}))
+	cm.setConversationCache("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 3, Version: 2})
+
+	conversation, err := cm.SetConversationExtra("u1", "g1", wkproto.ChannelTypeGroup, map[string]string{"draft": "hello"})
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", conversation.Extra["draft"])
+	cached := cm.getConversationFromCache("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.Equal(t, "hello", cached.Extra["draft"])
+	assert.Equal(t, int64(3), cached.Timestamp)
+	assert.GreaterOrEqual(t, cached.Version, conversation.Version)
+
+	// 保存缓存里的最近会话不会覆盖扩展数据
+	cm.FlushConversations()
+	extra, err := s.store.GetConversationExtra("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"draft": "hello"}, extra)
+
+	_, err = cm.SetConversationExtra("u1", "g3", wkproto.ChannelTypeGroup, nil)
+	assert.ErrorIs(t, err, wkstore.ErrNotFound)
+}
+
+// testMessageSeqLocator 频道内存在的消息seq
+type testMessageSeqLocator map[uint32]bool
+
+func (l testMessageSeqLocator) NextMessageSeq(channelID string, channelType uint8, startMessageSeq, endMessageSeq uint32) (uint32, bool, error) {
+	for seq := startMessageSeq; seq <= endMessageSeq; seq++ {
+		if l[seq] {
+			return seq, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+func TestGetConversationFirstUnread(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	s.store.(*wkstore.FileStore).SetMessageSeqLocator(testMessageSeqLocator{8: true, 9: true, 10: true})
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+
+	assert.NoError(t, s.store.AddOrUpdateConversations("u1", []*wkstore.Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 1, LastMsgSeq: 10, Version: 1},
+	}))
+	seq, exists, err := cm.GetConversationFirstUnread("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, uint32(10), seq)
+
+	// 缓存里还没保存的未读数先保存，6和7已经删除
+	cm.setConversationCache("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 5, LastMsgSeq: 10, Version: 2})
+	cm.mu.Lock()
+	cm.needSaveConversationMap["u1"] = true
+	cm.mu.Unlock()
+	seq, exists, err = cm.GetConversationFirstUnread("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, uint32(8), seq)
+	assert.False(t, cm.needSave("u1"))
+
+	// 批量获取，没有未读的不返回
+	cm.setConversationCache("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g2", ChannelType: wkproto.ChannelTypeGroup, LastMsgSeq: 10, Version: 3})
+	cm.mu.Lock()
+	cm.needSaveConversationMap["u1"] = true
+	cm.mu.Unlock()
+	firstUnreads, err := cm.GetConversationsFirstUnread("u1", []wkstore.ConversationKey{
+		{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup},
+		{UID: "u1", ChannelID: "g2", ChannelType: wkproto.ChannelTypeGroup},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[wkstore.ConversationKey]uint32{{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup}: 8}, firstUnreads)
+	assert.False(t, cm.needSave("u1"))
+}
+
+func TestGetConversationsWithMeta(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+	now := time.Unix(1700000000, 0)
+	cm.now = func() time.Time { return now }
+
+	assert.NoError(t, s.store.AddOrUpdateConversations("u1", []*wkstore.Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 1, Version: 1},
+		{UID: "u1", ChannelID: "g2", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 1, Version: 1},
+	}))
+	conversations, meta := cm.GetConversationsWithMeta("u1", ConversationQuery{})
+	assert.Len(t, conversations, 2)
+	assert.Equal(t, ConversationReadMeta{ScanKeys: 2, Total: 2}, meta)
+
+	cm.setConversationCache("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g2", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 2, Version: 2})
+	now = now.Add(time.Millisecond * 1500)
+	cm.setConversationCache("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g3", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 3, Version: 3})
+	now = now.Add(time.Millisecond * 500)
+
+	// 缓存时间取最早写入缓存的
+	conversations, meta = cm.GetConversationsWithMeta("u1", ConversationQuery{})
+	assert.Len(t, conversations, 3)
+	assert.Equal(t, ConversationReadMeta{FromCache: true, CacheAgeMs: 2000, ScanKeys: 4, Total: 3}, meta)
+
+	// 只返回g3
+	conversations, meta = cm.GetConversationsWithMeta("u1", ConversationQuery{Version: 2})
+	assert.Len(t, conversations, 1)
+	assert.Equal(t, ConversationReadMeta{FromCache: true, CacheAgeMs: 500, ScanKeys: 4, Total: 1}, meta)
+
+	// 没有返回缓存里的最近会话
+	conversations, meta = cm.GetConversationsWithMeta("u1", ConversationQuery{VersionBefore: 2})
+	assert.Len(t, conversations, 1)
+	assert.False(t, meta.FromCache)
+	assert.Equal(t, int64(0), meta.CacheAgeMs)
+
+	// 修改缓存后重新计时
+	cm.updateConversationCache("u1", "g2", wkproto.ChannelTypeGroup, func(cached *wkstore.Conversation) *wkstore.Conversation {
+		newConversation := *cached
+		newConversation.UnreadCount++
+		return &newConversation
+	})
+	now = now.Add(time.Millisecond * 100)
+	_, meta = cm.GetConversationsWithMeta("u1", ConversationQuery{})
+	assert.Equal(t, int64(600), meta.CacheAgeMs)
+
+	assert.Len(t, cm.GetConversationsWithOpts("u1", ConversationQuery{}), 3)
+}
+
+func TestConversationAddOrUpdateConversationsCAS(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+	cm.Start()
+	defer cm.Stop()
+
+	assert.NoError(t, s.store.AddOrUpdateConversations("u1", []*wkstore.Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 1, LastMsgSeq: 1, Version: 1},
+	}))
+	// 缓存里还没保存的修改也参与比较
+	cm.AddOrUpdateConversation("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 2, LastMsgSeq: 2, Version: 2})
+
+	_, err := cm.AddOrUpdateConversationsCAS("u1", []wkstore.ConversationCAS{
+		{Conversation: &wkstore.Conversation{ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 0, LastMsgSeq: 2}, ExpectedVersion: 1},
+	})
+	var conflict *wkstore.VersionConflictError
+	assert.ErrorAs(t, err, &conflict)
+	assert.Equal(t, int64(2), conflict.Current.Version)
+
+	written, err := cm.AddOrUpdateConversationsCAS("u1", []wkstore.ConversationCAS{
+		{Conversation: &wkstore.Conversation{ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 0, LastMsgSeq: 2}, ExpectedVersion: conflict.Current.Version},
+	})
+	assert.NoError(t, err)
+	// 写入的最近会话（包括版本号）在缓存里
+	cached := cm.getConversationFromCache("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.NotNil(t, cached)
+	assert.Equal(t, written[0].Version, cached.Version)
+	assert.Equal(t, 0, cm.GetConversation("u1", "g1", wkproto.ChannelTypeGroup).UnreadCount)
+}
+
+func TestConversationIterateConversations(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+	cm.Start()
+	defer cm.Stop()
+
+	assert.NoError(t, s.store.AddOrUpdateConversations("u1", []*wkstore.Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 1},
+		{UID: "u1", ChannelID: "u2", ChannelType: wkproto.ChannelTypePerson, UnreadCount: 1},
+	}))
+	// 缓存里还没保存的修改先保存再遍历
+	cm.AddOrUpdateConversation("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 3})
+
+	var conversations []wkstore.Conversation
+	err := cm.IterateConversations("u1", wkstore.ConversationIterOptions{ChannelType: wkproto.ChannelTypeGroup}, func(conversation wkstore.Conversation) bool {
+		conversations = append(conversations, conversation)
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Len(t, conversations, 1)
+	assert.Equal(t, "g1", conversations[0].ChannelID)
+	assert.Equal(t, 3, conversations[0].UnreadCount)
+	assert.False(t, cm.needSave("u1"))
+}
+
+func TestConversationInvalidateConversation(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+	cm.Start()
+	defer cm.Stop()
+
+	channelIDs := []string{"g1", "g2", "g3", "g4"}
+	fill := func() {
+		for _, channelID := range channelIDs {
+			cm.AddOrUpdateConversation("u1", &wkstore.Conversation{UID: "u1", ChannelID: channelID, ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 1})
+		}
+	}
+	// 读多写少：每次一个频道有变化后读取所有频道
+	syncRound := func(invalidate func(channelID string)) {
+		for _, changed := range channelIDs {
+			invalidate(changed)
+			for _, channelID := range channelIDs {
+				assert.NotNil(t, cm.GetConversation("u1", channelID, wkproto.ChannelTypeGroup))
+			}
+		}
+	}
+	hitRate := func(before *ConversationInvalidateStats) float64 {
+		after := cm.ConversationInvalidateStats()
+		hits := after.CacheHits - before.CacheHits
+		return float64(hits) / float64(hits+after.CacheMisses-before.CacheMisses)
+	}
+
+	fill()
+	before := cm.ConversationInvalidateStats()
+	syncRound(func(string) { cm.InvalidateUserConversations("u1") })
+	userHitRate := hitRate(before)
+
+	fill()
+	before = cm.ConversationInvalidateStats()
+	syncRound(func(channelID string) { cm.InvalidateConversation("u1", channelID, wkproto.ChannelTypeGroup) })
+	channelHitRate := hitRate(before)
+	assert.Equal(t, int64(len(channelIDs)), cm.ConversationInvalidateStats().Channel-before.Channel)
+
+	assert.Equal(t, 0.0, userHitRate)
+	assert.Equal(t, 0.375, channelHitRate) // 只有已经失效的频道从数据库读取（读取不会重新缓存），4轮分别命中3，2，1，0次
+	assert.Greater(t, channelHitRate, userHitRate)
+
+	// 还没保存的修改先保存，其他频道的缓存保留
+	cm.AddOrUpdateConversation("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 5})
+	cm.AddOrUpdateConversation("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g2", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 6})
+	cm.InvalidateConversation("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.Nil(t, cm.getConversationFromCache("u1", "g1", wkproto.ChannelTypeGroup))
+	assert.NotNil(t, cm.getConversationFromCache("u1", "g2", wkproto.ChannelTypeGroup))
+	conversation, err := s.store.GetConversation("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, conversation.UnreadCount)
+}
+
+func TestConversationOnMessagesExpired(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+	cm.Start()
+	defer cm.Stop()
+
+	assert.NoError(t, s.store.AddSubscribers("g1", wkproto.ChannelTypeGroup, []string{"u1"}))
+	cm.AddOrUpdateConversation("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 5, LastMsgSeq: 5, LastClientMsgNo: "no5", Timestamp: time.Now().Unix()})
+	cm.FlushConversations()
+	cached := cm.getConversationFromCache("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.NotNil(t, cached)
+
+	// 缓存里的最近会话复制后再修改，之前拿到的指针不变
+	assert.NoError(t, cm.OnMessagesExpired("g1", wkproto.ChannelTypeGroup, 3))
+	assert.Equal(t, 5, cached.UnreadCount)
+	conversation := cm.getConversationFromCache("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.NotSame(t, cached, conversation)
+	assert.Equal(t, 2, conversation.UnreadCount)
+	assert.Equal(t, "no5", conversation.LastClientMsgNo)
+
+	assert.NoError(t, cm.OnMessagesExpired("g1", wkproto.ChannelTypeGroup, 5))
+	cm.FlushConversations()
+	conversation, err := s.store.GetConversation("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, conversation.UnreadCount)
+	assert.Equal(t, "", conversation.LastClientMsgNo)
+}
+
+func TestConversationFlushCorrectsCachedVersion(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+	cm.Start()
+	defer cm.Stop()
+
+	// 数据库里的版本号比缓存里的大（比如时钟回拨），保存时数据库修正了版本号，缓存也要跟着修正
+	synced := time.Now().Add(time.Hour).UnixNano() / 1e6
+	assert.NoError(t, s.store.AddOrUpdateConversations("u1", []*wkstore.Conversation{{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, Version: synced}}))
+	cm.AddOrUpdateConversation("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 1, Version: time.Now().UnixNano() / 1e6, Timestamp: time.Now().Unix()})
+	cached := cm.getConversationFromCache("u1", "g1", wkproto.ChannelTypeGroup)
+	cm.FlushConversations()
+
+	conversation, err := s.store.GetConversation("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.NoError(t, err)
+	assert.Equal(t, synced+1, conversation.Version)
+	assert.Equal(t, 1, conversation.UnreadCount)
+	corrected := cm.getConversationFromCache("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.NotSame(t, cached, corrected)
+	assert.Equal(t, synced+1, corrected.Version)
+	assert.Less(t, cached.Version, synced)
+	assert.False(t, cm.needSave("u1"))
+
+	// 增量同步时拿到的版本号和数据库一致，再用这个版本号同步不会重复返回
+	conversations := cm.GetConversations("u1", synced, nil)
+	assert.Len(t, conversations, 1)
+	assert.Equal(t, synced+1, conversations[0].Version)
+	assert.Empty(t, cm.GetConversations("u1", synced+1, nil))
+}
+
+func TestConversationOnMessageRecalled(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+	cm.Start()
+	defer cm.Stop()
+
+	newMessage := func(seq uint32) *Message {
+		return &Message{
+			RecvPacket: &wkproto.RecvPacket{
+				Framer:      wkproto.Framer{RedDot: true},
+				MessageID:   int64(seq),
+				MessageSeq:  seq,
+				ClientMsgNo: fmt.Sprintf("no%d", seq),
+				ChannelID:   "g1",
+				ChannelType: wkproto.ChannelTypeGroup,
+				FromUID:     "u2",
+				Timestamp:   int32(time.Now().Unix()),
+			},
+		}
+	}
+	assert.NoError(t, s.store.AddSubscribers("g1", wkproto.ChannelTypeGroup, []string{"u1", "u2"}))
+	for seq := uint32(1); seq <= 3; seq++ {
+		cm.calConversation(newMessage(seq), "u1")
+	}
+	conversations := cm.GetConversations("u1", 0, nil)
+	assert.Len(t, conversations, 1)
+	assert.Equal(t, 3, conversations[0].UnreadCount)
+	version := conversations[0].Version
+	time.Sleep(time.Millisecond * 2)
+
+	// 撤回最后一条消息，缓存和数据库都修正，增量同步能拿到
+	assert.NoError(t, cm.OnMessageRecalled("g1", wkproto.ChannelTypeGroup, 3))
+	conversations = cm.GetConversations("u1", version, nil)
+	assert.Len(t, conversations, 1)
+	assert.Equal(t, 2, conversations[0].UnreadCount)
+	assert.Equal(t, uint32(3), conversations[0].LastMsgSeq)
+	assert.Equal(t, "", conversations[0].LastClientMsgNo)
+	assert.Equal(t, int64(0), conversations[0].LastMsgID)
+
+	cm.FlushConversations()
+	conversation, err := s.store.GetConversation("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, conversation.UnreadCount)
+	assert.Equal(t, "", conversation.LastClientMsgNo)
+
+	// 编辑最后一条消息后增量同步能拿到
+	cm.calConversation(newMessage(4), "u1")
+	version = cm.GetConversation("u1", "g1", wkproto.ChannelTypeGroup).Version
+	assert.Empty(t, cm.GetConversations("u1", version, nil))
+	time.Sleep(time.Millisecond * 2)
+	assert.NoError(t, cm.OnMessageEdited("g1", wkproto.ChannelTypeGroup, 4))
+	conversations = cm.GetConversations("u1", version, nil)
+	assert.Len(t, conversations, 1)
+	assert.Equal(t, 3, conversations[0].UnreadCount)
+}
+
+func TestConversationWarmUp(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	opts.Conversation.WarmUp = true
+	opts.Conversation.WarmUpUsers = 2
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+
+	now := time.Now().Unix()
+	timestamps := map[string]int64{
+		"u1": now - 10,
+		"u2": now - 5,
+		"u3": now,
+		"u4": now - int64((time.Hour * 48).Seconds()), // 超过CacheExpire
+	}
+	for uid, timestamp := range timestamps {
+		assert.NoError(t, s.store.AddOrUpdateConversations(uid, []*wkstore.Conversation{
+			{UID: uid, ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 1, Timestamp: timestamp},
+			{UID: uid, ChannelID: "g2", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 1, Timestamp: timestamp - int64((time.Hour * 48).Seconds())},
+		}))
+	}
+	// 已经缓存的不覆盖
+	cm.setConversationCache("u3", &wkstore.Conversation{UID: "u3", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 9, Timestamp: now})
+
+	cm.Start()
+	defer cm.Stop()
+	<-cm.warmUpDone
+
+	// 最近有会话的两个用户
+	for _, uid := range []string{"u2", "u3"} {
+		assert.NotNil(t, cm.getConversationFromCache(uid, "g1", wkproto.ChannelTypeGroup), uid)
+		assert.Nil(t, cm.getConversationFromCache(uid, "g2", wkproto.ChannelTypeGroup), uid) // 超过CacheExpire的会话不预热
+	}
+	assert.Equal(t, 9, cm.getConversationFromCache("u3", "g1", wkproto.ChannelTypeGroup).UnreadCount)
+	assert.Nil(t, cm.getConversationFromCache("u1", "g1", wkproto.ChannelTypeGroup))
+	assert.Nil(t, cm.getConversationFromCache("u4", "g1", wkproto.ChannelTypeGroup))
+
+	// 可以取消
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	users, _, err := cm.warmUpCache(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 0, users)
+}
+
+func TestConversationCacheTTL(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	opts.Conversation.CacheTTL = time.Minute
+	opts.Conversation.CacheMaxEntries = 2
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+	now := time.Unix(1700000000, 0)
+	cm.now = func() time.Time { return now }
+
+	for _, uid := range []string{"u1", "u2"} {
+		assert.NoError(t, s.store.AddOrUpdateConversations(uid, []*wkstore.Conversation{
+			{UID: uid, ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 1, Version: 1},
+		}))
+		cm.setConversationCache(uid, &wkstore.Conversation{UID: uid, ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 5, Version: 2})
+	}
+	// u2有还没保存的修改
+	cm.mu.Lock()
+	cm.needSaveConversationMap["u2"] = true
+	cm.mu.Unlock()
+
+	assert.Equal(t, 5, cm.GetConversation("u1", "g1", wkproto.ChannelTypeGroup).UnreadCount)
+	now = now.Add(time.Minute * 2)
+
+	// 过期后从数据库加载
+	conversations := cm.GetConversationsWithOpts("u1", ConversationQuery{})
+	assert.Len(t, conversations, 1)
+	assert.Equal(t, 1, conversations[0].UnreadCount)
+	assert.Nil(t, cm.getConversationFromCache("u1", "g1", wkproto.ChannelTypeGroup))
+	assert.Equal(t, 1, cm.GetConversation("u1", "g1", wkproto.ChannelTypeGroup).UnreadCount)
+
+	// 还没保存的不过期
+	assert.Equal(t, 5, cm.GetConversation("u2", "g1", wkproto.ChannelTypeGroup).UnreadCount)
+	conversations = cm.GetConversationsWithOpts("u2", ConversationQuery{})
+	assert.Len(t, conversations, 1)
+	assert.Equal(t, 5, conversations[0].UnreadCount)
+
+	// 每个用户最多缓存CacheMaxEntries个
+	for _, channelID := range []string{"g2", "g3", "g4"} {
+		cm.setConversationCache("u3", &wkstore.Conversation{UID: "u3", ChannelID: channelID, ChannelType: wkproto.ChannelTypeGroup})
+	}
+	assert.Len(t, cm.getConversationEntriesFromCache("u3"), 2)
+	assert.Nil(t, cm.getConversationFromCache("u3", "g2", wkproto.ChannelTypeGroup))
+}
+
+func TestConversationCacheDisabled(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	opts.Conversation.CacheDisabled = true
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+
+	// 直接保存到数据库
+	cm.AddOrUpdateConversation("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 1, Version: 1})
+	conversation, err := s.store.GetConversation("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, conversation.UnreadCount)
+
+	assert.NoError(t, cm.SetConversationUnread("u1", "g1", wkproto.ChannelTypeGroup, 3, 10))
+	conversation, err = s.store.GetConversation("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, conversation.UnreadCount)
+	assert.Equal(t, uint32(10), conversation.LastMsgSeq)
+	assert.False(t, cm.needSave("u1"))
+
+	conversations := cm.GetConversationsWithOpts("u1", ConversationQuery{})
+	assert.Len(t, conversations, 1)
+	assert.Equal(t, 3, cm.GetConversation("u1", "g1", wkproto.ChannelTypeGroup).UnreadCount)
+
+	// 没有创建任何缓存
+	for _, userConversationMap := range cm.userConversationMapBuckets {
+		assert.Empty(t, userConversationMap)
+	}
+}
+
+func TestConversationImportReadPositions(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+
+	// 缓存里有还没保存的修改
+	cm.setConversationCache("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, LastMsgSeq: 10, UnreadCount: 5, Version: 1})
+	cm.mu.Lock()
+	cm.needSaveConversationMap["u1"] = true
+	cm.mu.Unlock()
+
+	applied, skipped, err := cm.ImportReadPositions(strings.NewReader("u1,g1,2,8\nu2,g1,2,3\nbad"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, applied)
+	assert.Equal(t, 1, skipped)
+
+	assert.Nil(t, cm.getConversationFromCache("u1", "g1", wkproto.ChannelTypeGroup))
+	assert.Equal(t, 2, cm.GetConversation("u1", "g1", wkproto.ChannelTypeGroup).UnreadCount)
+	assert.Equal(t, uint32(3), cm.GetConversation("u2", "g1", wkproto.ChannelTypeGroup).LastMsgSeq)
+}
+
+func TestGetConversationsFilterChannelTypes(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+
+	assert.NoError(t, s.store.AddOrUpdateConversations("u1", []*wkstore.Conversation{
+		{UID: "u1", ChannelID: "u2", ChannelType: wkproto.ChannelTypePerson, Timestamp: 1, Version: 1},
+		{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 2, Version: 1},
+	}))
+	cm.setConversationCache("u1", &wkstore.Conversation{UID: "u1", ChannelID: "c1", ChannelType: wkproto.ChannelTypeCustomerService, Timestamp: 3, Version: 2})
+
+	channelIDs := func(query ConversationQuery) []string {
+		ids := make([]string, 0)
+		for _, conversation := range cm.GetConversationsWithOpts("u1", query) {
+			ids = append(ids, conversation.ChannelID)
+		}
+		return ids
+	}
+	assert.Equal(t, []string{"c1", "g1", "u2"}, channelIDs(ConversationQuery{}))
+	assert.Equal(t, []string{"g1", "u2"}, channelIDs(ConversationQuery{IncludeChannelTypes: []uint8{wkproto.ChannelTypePerson, wkproto.ChannelTypeGroup}}))
+	assert.Equal(t, []string{"c1", "u2"}, channelIDs(ConversationQuery{ExcludeChannelTypes: []uint8{wkproto.ChannelTypeGroup}}))
+	// 都设置时只看IncludeChannelTypes
+	assert.Equal(t, []string{"g1"}, channelIDs(ConversationQuery{IncludeChannelTypes: []uint8{wkproto.ChannelTypeGroup}, ExcludeChannelTypes: []uint8{wkproto.ChannelTypeGroup}}))
+	// 和其他条件一起
+	assert.Equal(t, []string{"c1"}, channelIDs(ConversationQuery{Version: 1, ExcludeChannelTypes: []uint8{wkproto.ChannelTypeGroup}}))
+}
+
+func TestGetConversationsWithTotal(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+
+	assert.NoError(t, s.store.AddOrUpdateConversations("u1", []*wkstore.Conversation{
+		{UID: "u1", ChannelID: "u2", ChannelType: wkproto.ChannelTypePerson, Timestamp: 1, Version: 1},
+		{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 2, Version: 2},
+		{UID: "u1", ChannelID: "g2", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 3, Version: 3},
+	}))
+	cm.setConversationCache("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g3", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 4, Version: 4})
+
+	// limit小于满足条件的数量
+	conversations, total := cm.GetConversationsWithTotal("u1", ConversationQuery{Limit: 2})
+	assert.Len(t, conversations, 2)
+	assert.Equal(t, 4, total)
+
+	// 按频道类型过滤掉的不算
+	conversations, total = cm.GetConversationsWithTotal("u1", ConversationQuery{Limit: 1, ExcludeChannelTypes: []uint8{wkproto.ChannelTypePerson}})
+	assert.Len(t, conversations, 1)
+	assert.Equal(t, "g3", conversations[0].ChannelID)
+	assert.Equal(t, 3, total)
+
+	conversations, total = cm.GetConversationsWithTotal("u1", ConversationQuery{Version: 2})
+	assert.Len(t, conversations, 2)
+	assert.Equal(t, 2, total)
+}
+
+func TestConversationExportImport(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+
+	// 缓存里还没保存的修改也导出
+	cm.setConversationCache("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, LastMsgSeq: 10, UnreadCount: 5, Version: 1})
+	cm.mu.Lock()
+	cm.needSaveConversationMap["u1"] = true
+	cm.mu.Unlock()
+	var buff bytes.Buffer
+	count, err := cm.ExportUserConversations("u1", &buff)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// 导入覆盖后缓存里是导入的
+	cm.setConversationCache("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, LastMsgSeq: 11, UnreadCount: 6, Version: 2})
+	cm.mu.Lock()
+	cm.needSaveConversationMap["u1"] = true
+	cm.mu.Unlock()
+	result, err := cm.ImportConversations(&buff, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.Updated)
+	assert.Equal(t, 5, cm.GetConversation("u1", "g1", wkproto.ChannelTypeGroup).UnreadCount)
+}
+
+func TestConversationCacheVerify(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	opts.Conversation.CacheVerifySampleRate = 10
+	opts.Conversation.CacheVerifyHeal = true
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+	now := time.Now()
+	cm.now = func() time.Time { return now }
+
+	assert.NoError(t, s.store.AddOrUpdateConversations("u1", []*wkstore.Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 1, LastMsgSeq: 5, UnreadCount: 1, Version: 1},
+		{UID: "u1", ChannelID: "g2", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 1, LastMsgSeq: 5, Version: 1},
+	}))
+	assert.NoError(t, s.store.AddOrUpdateConversations("u2", []*wkstore.Conversation{
+		{UID: "u2", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 1, Version: 1},
+	}))
+
+	// 版本号不同，Extra为nil和空map不算不一致
+	cm.setConversationCache("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g2", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 1, LastMsgSeq: 5, Version: 9, Extra: map[string]string{}})
+	// 故意改坏的缓存
+	cm.setConversationCache("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 1, LastMsgSeq: 6, UnreadCount: 3, Version: 1})
+	// 有还没保存的修改的用户不校验
+	cm.setConversationCache("u2", &wkstore.Conversation{UID: "u2", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 2, Version: 2})
+	cm.mu.Lock()
+	cm.needSaveConversationMap["u2"] = true
+	cm.mu.Unlock()
+
+	// 刚写入缓存的不校验
+	cm.verifyConversationCache()
+	assert.Equal(t, &ConversationCacheVerifyStats{Runs: 1, Users: 1}, cm.ConversationCacheVerifyStats())
+
+	now = now.Add(cacheVerifyGrace)
+	cm.verifyConversationCache()
+	assert.Equal(t, &ConversationCacheVerifyStats{Runs: 2, Users: 2, Entries: 2, Mismatches: 1, Healed: 1}, cm.ConversationCacheVerifyStats())
+	assert.Nil(t, cm.getConversationFromCache("u1", "g1", wkproto.ChannelTypeGroup))
+	assert.Equal(t, 1, cm.GetConversation("u1", "g1", wkproto.ChannelTypeGroup).UnreadCount)
+	assert.NotNil(t, cm.getConversationFromCache("u2", "g1", wkproto.ChannelTypeGroup))
+
+	assert.Equal(t, []string{"UnreadCount", "LastMsgSeq"}, diffConversationFields(
+		&wkstore.Conversation{ChannelID: "g1", LastMsgSeq: 6, UnreadCount: 3, Version: 2},
+		&wkstore.Conversation{ChannelID: "g1", LastMsgSeq: 5, UnreadCount: 1, Version: 1},
+	))
+}
+
+func TestSetConversationArchived(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+	cm.Start()
+	defer cm.Stop()
+
+	assert.NoError(t, s.store.AddOrUpdateConversations("u1", []*wkstore.Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 2, Timestamp: 1, Version: 1},
+		{UID: "u1", ChannelID: "g2", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 2, Version: 1},
+	}))
+	cm.setConversationCache("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 3, Timestamp: 3, Version: 2})
+
+	conversation, err := cm.SetConversationArchived("u1", "g1", wkproto.ChannelTypeGroup, true)
+	assert.NoError(t, err)
+	assert.True(t, conversation.Archived)
+	assert.True(t, cm.getConversationFromCache("u1", "g1", wkproto.ChannelTypeGroup).Archived)
+
+	// 默认不返回已归档的
+	conversations := cm.GetConversationsWithOpts("u1", ConversationQuery{})
+	assert.Len(t, conversations, 1)
+	assert.Equal(t, "g2", conversations[0].ChannelID)
+	assert.Len(t, cm.GetConversationsWithOpts("u1", ConversationQuery{IncludeArchived: true}), 2)
+	page, _, err := cm.GetConversationsWithCursor("u1", "", 10)
+	assert.NoError(t, err)
+	assert.Len(t, page, 1)
+
+	// 已归档的列表合并了缓存里的未读数
+	archived, err := cm.GetArchivedConversations("u1", 0)
+	assert.NoError(t, err)
+	assert.Len(t, archived, 1)
+	assert.Equal(t, 3, archived[0].UnreadCount)
+
+	// 取消归档后按最后一条消息的时间回到列表里
+	_, err = cm.SetConversationArchived("u1", "g1", wkproto.ChannelTypeGroup, false)
+	assert.NoError(t, err)
+	conversations = cm.GetConversationsWithOpts("u1", ConversationQuery{})
+	assert.Len(t, conversations, 2)
+	assert.Equal(t, "g1", conversations[0].ChannelID)
+	assert.Equal(t, 3, conversations[0].UnreadCount)
+
+	_, err = cm.SetConversationArchived("u1", "g3", wkproto.ChannelTypeGroup, true)
+	assert.ErrorIs(t, err, wkstore.ErrNotFound)
+}
+
+func TestIncConversationMentionCount(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+	cm.Start()
+	defer cm.Stop()
+
+	assert.NoError(t, s.store.AddOrUpdateConversations("u1", []*wkstore.Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 2, Timestamp: 1, LastMsgSeq: 2, Version: 1},
+	}))
+	cm.setConversationCache("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 3, Timestamp: 3, LastMsgSeq: 3, Version: 2})
+
+	conversation, err := cm.IncConversationMentionCount("u1", "g1", wkproto.ChannelTypeGroup, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), conversation.MentionCount)
+	cached := cm.getConversationFromCache("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.Equal(t, uint32(1), cached.MentionCount)
+	assert.Equal(t, 3, cached.UnreadCount)
+
+	// 保存缓存不会覆盖提及数量
+	cm.FlushConversations()
+	conversation, err = s.store.GetConversation("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), conversation.MentionCount)
+
+	// 已读时清零
+	_, err = cm.UpdateConversationsReadToMsgSeq("u1", []wkstore.ConversationReadTo{{ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, ReadToMsgSeq: 3, ResetMentions: true}})
+	assert.NoError(t, err)
+	conversations := cm.GetConversationsWithOpts("u1", ConversationQuery{})
+	assert.Len(t, conversations, 1)
+	assert.Equal(t, uint32(0), conversations[0].MentionCount)
+	assert.Equal(t, 0, conversations[0].UnreadCount)
+
+	_, err = cm.IncConversationMentionCount("u1", "g2", wkproto.ChannelTypeGroup, 1)
+	assert.ErrorIs(t, err, wkstore.ErrNotFound)
+}
+
+func TestUpdateConversationLastMsg(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+
+	assert.NoError(t, s.store.AddOrUpdateConversations("u1", []*wkstore.Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 1, Timestamp: 1, LastMsgSeq: 1, Version: 1},
+	}))
+	cm.setConversationCache("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 2, Timestamp: 2, LastMsgSeq: 2, Version: 2})
+
+	modify, err := cm.UpdateConversationLastMsg("u1", "g1", wkproto.ChannelTypeGroup, 3, "c3", 3)
+	assert.NoError(t, err)
+	assert.True(t, modify)
+	cached := cm.getConversationFromCache("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.Equal(t, uint32(3), cached.LastMsgSeq)
+	assert.Equal(t, "c3", cached.LastClientMsgNo)
+	assert.Equal(t, int64(3), cached.Timestamp)
+	assert.Equal(t, 2, cached.UnreadCount)
+
+	// 缓存里的不回退
+	_, err = cm.UpdateConversationLastMsg("u1", "g1", wkproto.ChannelTypeGroup, 2, "c2", 4)
+	assert.NoError(t, err)
+	assert.Equal(t, "c3", cm.getConversationFromCache("u1", "g1", wkproto.ChannelTypeGroup).LastClientMsgNo)
+}
+
+func TestConversationDeliverCacheDisabled(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	opts.Conversation.CacheDisabled = true
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+
+	deliver := func(seq uint32, fromUID string) {
+		cm.calConversation(&Message{
+			RecvPacket: &wkproto.RecvPacket{
+				Framer:      wkproto.Framer{RedDot: true},
+				MessageID:   int64(seq),
+				MessageSeq:  seq,
+				ClientMsgNo: fmt.Sprintf("no%d", seq),
+				ChannelID:   "g1",
+				ChannelType: wkproto.ChannelTypeGroup,
+				FromUID:     fromUID,
+				Timestamp:   int32(seq),
+			},
+		}, "u1")
+	}
+	deliver(1, "u2") // 新建
+	deliver(3, "u2")
+	deliver(2, "u2") // 乱序投递的旧消息只增加未读数，不回退最后一条消息
+	deliver(4, "u1") // 自己发的不增加未读数
+
+	conversation, err := s.store.GetConversation("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, conversation.UnreadCount)
+	assert.Equal(t, uint32(4), conversation.LastMsgSeq)
+	assert.Equal(t, "no4", conversation.LastClientMsgNo)
+	assert.Equal(t, int64(4), conversation.Timestamp)
+
+	// 并发投递时未读数不会互相覆盖
+	var wg sync.WaitGroup
+	for seq := uint32(5); seq < 25; seq++ {
+		wg.Add(1)
+		go func(seq uint32) {
+			defer wg.Done()
+			deliver(seq, "u2")
+		}(seq)
+	}
+	wg.Wait()
+	conversation, err = s.store.GetConversation("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.NoError(t, err)
+	assert.Equal(t, 23, conversation.UnreadCount)
+	assert.Equal(t, uint32(24), conversation.LastMsgSeq)
+}
+
+func TestConversationOfflineDigest(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	opts.Conversation.OfflineDigestDelay = time.Millisecond * 50
+	opts.Conversation.OfflineDigestTopN = 1
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+
+	assert.NoError(t, s.store.AddOrUpdateConversations("u1", []*wkstore.Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 1, Timestamp: 1, Version: 1},
+	}))
+	cm.setConversationCache("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g2", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 3, Timestamp: 2, Version: 2})
+
+	digests := make(chan []*wkstore.ConversationUnreadDigest, 10)
+	s.RegisterOfflineDigestHandler(func(uid string, digest []*wkstore.ConversationUnreadDigest) {
+		assert.Equal(t, "u1", uid)
+		digests <- digest
+	})
+
+	// 离线超过延迟后回调，包含缓存里还没保存的修改
+	cm.userOffline("u1")
+	select {
+	case digest := <-digests:
+		assert.Len(t, digest, 1)
+		assert.Equal(t, "g2", digest[0].ChannelID)
+		assert.Equal(t, 3, digest[0].UnreadCount)
+	case <-time.After(time.Second):
+		t.Fatal("offline digest not sent")
+	}
+
+	// 延迟期间重新上线则取消
+	cm.userOffline("u1")
+	cm.userOnline("u1")
+	// 没有未读的用户不回调
+	cm.userOffline("u2")
+	select {
+	case <-digests:
+		t.Fatal("offline digest should be canceled")
+	case <-time.After(time.Millisecond * 200):
+	}
+}
+
+func TestGetConversationsUpdatedSince(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+
+	assert.NoError(t, s.store.AddOrUpdateConversations("u1", []*wkstore.Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 1, Timestamp: 1, Version: 1},
+		{UID: "u1", ChannelID: "g2", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 1, Timestamp: 1, Version: 2},
+	}))
+	changes, err := cm.GetConversationsUpdatedSince("u1", 0, 0)
+	assert.NoError(t, err)
+	assert.Len(t, changes.Conversations, 2)
+	synced := changes.Version
+
+	// 缓存里还没保存的修改先保存
+	cm.setConversationCache("u1", &wkstore.Conversation{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 5, Timestamp: 2, Version: 3})
+	cm.mu.Lock()
+	cm.needSaveConversationMap["u1"] = true
+	cm.mu.Unlock()
+	assert.NoError(t, cm.DeleteConversation([]string{"u1"}, "g2", wkproto.ChannelTypeGroup))
+
+	changes, err = cm.GetConversationsUpdatedSince("u1", synced, 0)
+	assert.NoError(t, err)
+	assert.False(t, cm.needSave("u1"))
+	assert.Len(t, changes.Deleted, 1)
+	assert.Equal(t, "g2", changes.Deleted[0].ChannelID)
+	assert.Len(t, changes.Conversations, 1)
+	assert.Equal(t, 5, changes.Conversations[0].UnreadCount)
+	assert.Greater(t, changes.Conversations[0].Version, changes.Deleted[0].Version)
+}
+
+func TestRecalculateConversationUnread(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.DataDir = t.TempDir()
+	s := NewTestServer(opts)
+	assert.NoError(t, s.store.Open())
+	defer s.store.Close()
+	cm := s.conversationManager
+
+	// 频道里的消息已经不存在了
+	assert.NoError(t, s.store.AddOrUpdateConversations("u1", []*wkstore.Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: wkproto.ChannelTypeGroup, UnreadCount: 3, Timestamp: 1, LastMsgSeq: 3, Version: 1},
+		{UID: "u1", ChannelID: "g2", ChannelType: wkproto.ChannelTypeGroup, Timestamp: 1, LastMsgSeq: 3, Version: 1},
+	}))
+	report, err := cm.RecalculateConversationUnread("u1")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Scanned)
+	assert.Len(t, report.Corrected, 1)
+	assert.Equal(t, "g1", report.Corrected[0].ChannelID)
+	assert.Equal(t, 0, report.Corrected[0].NewUnread)
+	conversation, err := s.store.GetConversation("u1", "g1", wkproto.ChannelTypeGroup)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, conversation.UnreadCount)
+}
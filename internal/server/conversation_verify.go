@@ -0,0 +1,171 @@
+package server
+
+import (
+	"maps"
+	"reflect"
+	"time"
+
+	"github.com/WuKongIM/WuKongIM/pkg/wkstore"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// cacheVerifyGrace 写入缓存不到这么久的最近会话不校验（修改缓存和标记需要保存之间有间隔，刚修改的可能还没标记）
+const cacheVerifyGrace = time.Second
+
+// ConversationCacheVerifyStats 后台校验最近会话缓存的统计
+type ConversationCacheVerifyStats struct {
+	Runs       int64 `json:"runs"`       // 校验的次数
+	Users      int64 `json:"users"`      // 校验的用户数量
+	Entries    int64 `json:"entries"`    // 校验的缓存最近会话数量
+	Mismatches int64 `json:"mismatches"` // 和数据库不一致的缓存最近会话数量
+	Healed     int64 `json:"healed"`     // 因为不一致清除缓存的用户数量
+}
+
+// conversationCacheVerifier 后台校验最近会话缓存和数据库是否一致，发现修改缓存的bug（比如客户端看到旧的未读数）
+type conversationCacheVerifier struct {
+	runs       atomic.Int64
+	users      atomic.Int64
+	entries    atomic.Int64
+	mismatches atomic.Int64
+	healed     atomic.Int64
+	nextBucket int // 下次从哪个缓存桶开始抽样，只在校验的goroutine里使用
+}
+
+// ConversationCacheVerifyStats 后台校验最近会话缓存的统计
+func (cm *ConversationManager) ConversationCacheVerifyStats() *ConversationCacheVerifyStats {
+	return &ConversationCacheVerifyStats{
+		Runs:       cm.verifier.runs.Load(),
+		Users:      cm.verifier.users.Load(),
+		Entries:    cm.verifier.entries.Load(),
+		Mismatches: cm.verifier.mismatches.Load(),
+		Healed:     cm.verifier.healed.Load(),
+	}
+}
+
+// verifyConversationCache 抽样CacheVerifySampleRate个缓存的用户（每次从不同的缓存桶开始），和数据库里的最近会话逐个字段比较
+// 有还没保存的修改的用户不校验，不一致的记录日志和计数，开启CacheVerifyHeal时清除用户的缓存
+func (cm *ConversationManager) verifyConversationCache() {
+	sampleRate := cm.s.opts.Conversation.CacheVerifySampleRate
+	if sampleRate <= 0 || cm.cacheDisabled() {
+		return
+	}
+	cm.verifier.runs.Inc()
+	for _, uid := range cm.sampleCachedUIDs(sampleRate) {
+		if mismatched := cm.verifyUserConversationCache(uid); mismatched && cm.s.opts.Conversation.CacheVerifyHeal {
+			cm.invalidateUserConversations(uid)
+			cm.verifier.healed.Inc()
+		}
+	}
+}
+
+// sampleCachedUIDs 从缓存桶里抽样最多count个有缓存的用户
+func (cm *ConversationManager) sampleCachedUIDs(count int) []string {
+	uids := make([]string, 0, count)
+	start := cm.verifier.nextBucket
+	cm.verifier.nextBucket = (start + 1) % cm.bucketNum
+	for i := 0; i < cm.bucketNum && len(uids) < count; i++ {
+		pos := (start + i) % cm.bucketNum
+		cm.userConversationMapBucketLocks[pos].RLock()
+		for uid, cache := range cm.userConversationMapBuckets[pos] { // map的遍历顺序是随机的
+			if cache.Len() == 0 {
+				continue
+			}
+			uids = append(uids, uid)
+			if len(uids) >= count {
+				break
+			}
+		}
+		cm.userConversationMapBucketLocks[pos].RUnlock()
+	}
+	return uids
+}
+
+// verifyUserConversationCache 校验用户缓存的最近会话和数据库里的是否一致，返回是否有不一致的
+func (cm *ConversationManager) verifyUserConversationCache(uid string) bool {
+	if cm.needSave(uid) {
+		return false
+	}
+	entries := cm.peekConversationEntries(uid)
+	if len(entries) == 0 {
+		return false
+	}
+	conversations, err := cm.s.store.GetConversations(uid)
+	if err != nil {
+		cm.Warn("verify conversation cache: failed to get conversations", zap.String("uid", uid), zap.Error(err))
+		return false
+	}
+	if cm.needSave(uid) { // 读取期间有新的修改
+		return false
+	}
+	stored := make(map[string]*wkstore.Conversation, len(conversations))
+	for _, conversation := range conversations {
+		stored[cm.getChannelKey(conversation.ChannelID, conversation.ChannelType)] = conversation
+	}
+	cm.verifier.users.Inc()
+	now := cm.now()
+	mismatched := false
+	for _, entry := range entries {
+		if now.Sub(entry.cachedAt) < cacheVerifyGrace {
+			continue
+		}
+		cm.verifier.entries.Inc()
+		cached := entry.conversation
+		var fields []string
+		if conversation := stored[cm.getChannelKey(cached.ChannelID, cached.ChannelType)]; conversation == nil {
+			fields = []string{"missing"}
+		} else {
+			fields = diffConversationFields(cached, conversation)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		mismatched = true
+		cm.verifier.mismatches.Inc()
+		cm.Warn("conversation cache mismatch", zap.String("uid", uid), zap.String("channelID", cached.ChannelID), zap.Uint8("channelType", cached.ChannelType), zap.Strings("fields", fields), zap.Time("cachedAt", entry.cachedAt))
+	}
+	return mismatched
+}
+
+// peekConversationEntries 用户缓存的最近会话（不影响缓存的淘汰顺序，也不删除过期的）
+func (cm *ConversationManager) peekConversationEntries(uid string) []*conversationCacheEntry {
+	pos := cm.getLockIndex(uid)
+	cm.userConversationMapBucketLocks[pos].RLock()
+	defer cm.userConversationMapBucketLocks[pos].RUnlock()
+	cache := cm.userConversationMapBuckets[pos][uid]
+	if cache == nil {
+		return nil
+	}
+	entries := make([]*conversationCacheEntry, 0, cache.Len())
+	for _, key := range cache.Keys() {
+		if entry, ok := cache.Peek(key); ok && entry != nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// diffConversationFields 缓存和数据库里的最近会话不一样的字段
+// 不比较版本号（保存时会为了单调递增修正数据库里的版本号，缓存里的不会跟着修改），Extra为nil和空map视为相同
+// 按频道逐个比较，不受列表排序（相同时间的顺序）影响
+func diffConversationFields(cached, stored *wkstore.Conversation) []string {
+	var fields []string
+	a, b := reflect.ValueOf(*cached), reflect.ValueOf(*stored)
+	t := a.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Name
+		switch name {
+		case "Version":
+			continue
+		case "Extra":
+			if !maps.Equal(cached.Extra, stored.Extra) {
+				fields = append(fields, name)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/WuKongIM/WuKongIM/pkg/wkstore"
+	"go.uber.org/zap"
+)
+
+// startWarmUp 在后台预热最近会话缓存，Stop时取消
+func (cm *ConversationManager) startWarmUp() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cm.warmUpCancel = cancel
+	cm.warmUpDone = make(chan struct{})
+	go func() {
+		defer close(cm.warmUpDone)
+		start := time.Now()
+		users, rows, err := cm.warmUpCache(ctx)
+		if err != nil {
+			cm.Warn("conversation cache warm-up stopped", zap.Error(err), zap.Int("users", users), zap.Int("rows", rows), zap.Duration("cost", time.Since(start)))
+			return
+		}
+		cm.Info("conversation cache warm-up done", zap.Int("users", users), zap.Int("rows", rows), zap.Duration("cost", time.Since(start)))
+	}()
+}
+
+// stopWarmUp 取消预热并等待预热的goroutine退出
+func (cm *ConversationManager) stopWarmUp() {
+	if cm.warmUpCancel == nil {
+		return
+	}
+	cm.warmUpCancel()
+	<-cm.warmUpDone
+}
+
+// warmUpCache 遍历每个slot在CacheExpire内有会话的最近会话（每个slot最多遍历WarmUpRows/slot数量条），记录每个用户最新的会话时间
+// 然后按会话时间从新到旧加载最多WarmUpUsers个用户的最近会话到缓存，避免重启后大量客户端同时重连时都从数据库读取，返回预热的用户数量和遍历的最近会话数量
+func (cm *ConversationManager) warmUpCache(ctx context.Context) (int, int, error) {
+	opts := cm.s.opts.Conversation
+	if opts.WarmUpRows <= 0 || opts.WarmUpUsers <= 0 {
+		return 0, 0, nil
+	}
+	var updatedAfter int64
+	if opts.CacheExpire > 0 {
+		updatedAfter = cm.now().Add(-opts.CacheExpire).Unix()
+	}
+	iterOpts := wkstore.ConversationIterOptions{Context: ctx, UpdatedAfter: updatedAfter}
+	slotCount := cm.s.store.SlotCount()
+	slotRows := (opts.WarmUpRows + slotCount - 1) / slotCount
+	progressEvery := slotCount / 10
+	if progressEvery <= 0 {
+		progressEvery = 1
+	}
+
+	latest := make(map[string]int64)
+	rows := 0
+	for slot := 0; slot < slotCount; slot++ {
+		scanned := 0
+		err := cm.s.store.IterateAllConversations(uint32(slot), iterOpts, func(conversation wkstore.Conversation) bool {
+			scanned++
+			if conversation.Timestamp > latest[conversation.UID] {
+				latest[conversation.UID] = conversation.Timestamp
+			}
+			return scanned < slotRows
+		})
+		rows += scanned
+		if err != nil {
+			return 0, rows, err
+		}
+		if (slot+1)%progressEvery == 0 {
+			cm.Info("conversation cache warm-up scanning", zap.Int("slot", slot+1), zap.Int("slots", slotCount), zap.Int("rows", rows), zap.Int("users", len(latest)))
+		}
+	}
+
+	uids := make([]string, 0, len(latest))
+	for uid := range latest {
+		uids = append(uids, uid)
+	}
+	sort.Slice(uids, func(i, j int) bool {
+		if latest[uids[i]] != latest[uids[j]] {
+			return latest[uids[i]] > latest[uids[j]]
+		}
+		return uids[i] < uids[j]
+	})
+	if len(uids) > opts.WarmUpUsers {
+		uids = uids[:opts.WarmUpUsers]
+	}
+	progressEvery = len(uids) / 10
+	if progressEvery <= 0 {
+		progressEvery = 1
+	}
+	warmed := 0
+	for i, uid := range uids {
+		if err := ctx.Err(); err != nil {
+			return warmed, rows, err
+		}
+		conversations, err := cm.getUserAllConversationMapFromStore(uid)
+		if err != nil {
+			continue
+		}
+		cm.warmUserConversationsCache(uid, conversations, updatedAfter)
+		warmed++
+		if (i+1)%progressEvery == 0 {
+			cm.Info("conversation cache warm-up loading", zap.Int("users", warmed), zap.Int("total", len(uids)))
+		}
+	}
+	return warmed, rows, nil
+}
+
+// warmUserConversationsCache 把用户会话时间不早于updatedAfter的最近会话加入缓存，已经缓存的不覆盖（可能有还没保存的修改）
+func (cm *ConversationManager) warmUserConversationsCache(uid string, conversations []*wkstore.Conversation, updatedAfter int64) {
+	pos := cm.getLockIndex(uid)
+	cm.userConversationMapBucketLocks[pos].Lock()
+	defer cm.userConversationMapBucketLocks[pos].Unlock()
+	cache := cm.getUserConversationCacheNoLock(uid)
+	now := cm.now()
+	for _, conversation := range conversations {
+		if conversation.Timestamp < updatedAfter {
+			continue
+		}
+		cache.ContainsOrAdd(cm.getChannelKey(conversation.ChannelID, conversation.ChannelType), &conversationCacheEntry{conversation: conversation, cachedAt: now})
+	}
+}
@@ -16,6 +16,7 @@ import (
 type DeliveryManager struct {
 	s               *Server
 	deliveryMsgPool *ants.Pool
+	stats           deliveryStats // 在线投递的设备扇出统计
 	wklog.Log
 }
 
@@ -69,6 +70,8 @@ func (d *DeliveryManager) deliveryMessages(messages []*Message, large bool, sync
 				offlineSubscribers = append(offlineSubscribers, subscriber)
 			}
 		}
+		d.stats.observe(len(recvConns), len(messages))
+		d.s.monitor.DeliveryDevicesObserve(len(recvConns), len(messages))
 		startTime := time.Now()
 		d.Debug("消息投递", zap.String("subscriber", subscriber), zap.Any("recvConns", len(recvConns)))
 		for _, recvConn := range recvConns {
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"go.uber.org/atomic"
+)
+
+// deliveryStats 在线投递的设备扇出统计（按消息统计，每条消息投递给一个在线订阅者算一次）
+type deliveryStats struct {
+	deliveries       atomic.Int64 // 投递次数
+	devices          atomic.Int64 // 投递的设备总数
+	oneDevice        atomic.Int64 // 投递给1个设备的次数
+	twoDevices       atomic.Int64 // 投递给2个设备的次数
+	threePlusDevices atomic.Int64 // 投递给3个及以上设备的次数
+}
+
+// observe 记录count条消息投递给了devices个设备
+func (d *deliveryStats) observe(devices int, count int) {
+	if devices <= 0 || count <= 0 {
+		return
+	}
+	d.deliveries.Add(int64(count))
+	d.devices.Add(int64(devices * count))
+	switch devices {
+	case 1:
+		d.oneDevice.Add(int64(count))
+	case 2:
+		d.twoDevices.Add(int64(count))
+	default:
+		d.threePlusDevices.Add(int64(count))
+	}
+}
+
+// DeliveryStats 在线投递的设备扇出统计快照
+type DeliveryStats struct {
+	Deliveries        int64   `json:"deliveries"`           // 投递次数（每条消息投递给一个在线订阅者算一次）
+	Devices           int64   `json:"devices"`              // 投递的设备总数
+	OneDevice         int64   `json:"one_device"`           // 投递给1个设备的次数
+	TwoDevices        int64   `json:"two_devices"`          // 投递给2个设备的次数
+	ThreePlusDevices  int64   `json:"three_plus_devices"`   // 投递给3个及以上设备的次数
+	AvgDevices        float64 `json:"avg_devices"`          // 每次投递的平均设备数
+	OnlineUsers       int     `json:"online_users"`         // 在线用户数
+	OnlineConns       int     `json:"online_conns"`         // 在线连接数
+	AvgDevicesPerUser float64 `json:"avg_devices_per_user"` // 每个在线用户的平均连接数
+}
+
+func (d *deliveryStats) snapshot(onlineUsers, onlineConns int) DeliveryStats {
+	stats := DeliveryStats{
+		Deliveries:       d.deliveries.Load(),
+		Devices:          d.devices.Load(),
+		OneDevice:        d.oneDevice.Load(),
+		TwoDevices:       d.twoDevices.Load(),
+		ThreePlusDevices: d.threePlusDevices.Load(),
+		OnlineUsers:      onlineUsers,
+		OnlineConns:      onlineConns,
+	}
+	if stats.Deliveries > 0 {
+		stats.AvgDevices = float64(stats.Devices) / float64(stats.Deliveries)
+	}
+	if onlineUsers > 0 {
+		stats.AvgDevicesPerUser = float64(onlineConns) / float64(onlineUsers)
+	}
+	return stats
+}
+
+// DeliveryStats 获取在线投递的设备扇出统计
+func (d *DeliveryManager) DeliveryStats() DeliveryStats {
+	users, conns := d.s.connManager.OnlineCount()
+	return d.stats.snapshot(users, conns)
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliveryStats(t *testing.T) {
+	var stats deliveryStats
+	stats.observe(1, 3)
+	stats.observe(2, 1)
+	stats.observe(3, 1)
+	stats.observe(5, 1)
+	stats.observe(0, 10) // 没有在线设备不统计
+
+	snapshot := stats.snapshot(4, 6)
+	assert.Equal(t, int64(6), snapshot.Deliveries)
+	assert.Equal(t, int64(3+2+3+5), snapshot.Devices)
+	assert.Equal(t, int64(3), snapshot.OneDevice)
+	assert.Equal(t, int64(1), snapshot.TwoDevices)
+	assert.Equal(t, int64(2), snapshot.ThreePlusDevices)
+	assert.InDelta(t, 13.0/6, snapshot.AvgDevices, 0.0001)
+	assert.InDelta(t, 1.5, snapshot.AvgDevicesPerUser, 0.0001)
+
+	assert.Equal(t, DeliveryStats{}, (&deliveryStats{}).snapshot(0, 0))
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"strings"
 	"sync"
 	"time"
@@ -11,6 +12,9 @@ import (
 	"go.uber.org/zap"
 )
 
+// dispatchShutdownTimeout 停止时等待输出缓冲区数据发送完（ShutdownPhaseFlushConns阶段）的最长时间
+const dispatchShutdownTimeout = time.Second * 3
+
 type Dispatch struct {
 	engine *wknet.Engine
 
@@ -21,8 +25,10 @@ type Dispatch struct {
 }
 
 func NewDispatch(s *Server) *Dispatch {
-	return &Dispatch{
-		engine:    wknet.NewEngine(wknet.WithAddr(s.opts.Addr), wknet.WithWSAddr(s.opts.WSAddr), wknet.WithWSSAddr(s.opts.WSSAddr), wknet.WithWSTLSConfig(s.opts.WSTLSConfig)),
+	d := &Dispatch{
+		engine: wknet.NewEngine(wknet.WithAddr(s.opts.Addr), wknet.WithWSAddr(s.opts.WSAddr), wknet.WithWSSAddr(s.opts.WSSAddr), wknet.WithWSTLSConfig(s.opts.WSTLSConfig), wknet.WithTCPInfoSampleInterval(s.opts.TCPInfoSampleInterval), wknet.WithMaxFramesPerDecode(s.opts.MaxFramesPerDecode), wknet.WithShutdownPhaseTimeouts(map[wknet.ShutdownPhase]time.Duration{
+			wknet.ShutdownPhaseFlushConns: dispatchShutdownTimeout,
+		})),
 		s:         s,
 		processor: NewProcessor(s),
 		Log:       wklog.NewWKLog("Dispatch"),
@@ -32,6 +38,12 @@ func NewDispatch(s *Server) *Dispatch {
 			},
 		},
 	}
+	// reactor停止后不会再有消息经过过滤器
+	d.engine.RegisterShutdownHook("messageFilters", func(ctx context.Context) error {
+		d.processor.messageFilters.stop()
+		return nil
+	}, wknet.ShutdownPhaseStopReactors)
+	return d
 }
 
 // conn是否允许
@@ -89,7 +101,12 @@ func (d *Dispatch) dataIn(conn wknet.Conn) error {
 		d.processor.processAuth(conn, packet.(*wkproto.ConnectPacket))
 	} else { // authed
 		offset := 0
+		maxFrames := d.engine.MaxFramesPerDecode()
+		frameCount := 0
 		for len(data) > offset {
+			if maxFrames > 0 && frameCount >= maxFrames { // 剩下的包下一轮继续解码
+				break
+			}
 			frame, size, err := d.s.opts.Proto.DecodeFrame(data[offset:], uint8(conn.ProtoVersion()))
 			if err != nil { //
 				d.Warn("Failed to decode the message", zap.Error(err))
@@ -114,11 +131,15 @@ func (d *Dispatch) dataIn(conn wknet.Conn) error {
 			connCtx := conn.Context().(*connContext)
 			connCtx.putFrame(frame)
 			offset += size
+			frameCount++
 		}
 		// process frames
 		conn.Discard(offset)
 
 		d.processor.process(conn)
+		if maxFrames > 0 && frameCount >= maxFrames && offset < len(data) { // 还有完整的包没解码
+			return wknet.ErrDecodePending
+		}
 	}
 	return nil
 }
@@ -195,12 +216,9 @@ func (d *Dispatch) Start() error {
 	return err
 }
 
+// Stop 按阶段执行引擎注册的停止钩子（见Server.registerShutdownHooks），每个阶段有各自的超时时间
 func (d *Dispatch) Stop() error {
-	err := d.engine.Stop()
-	if err != nil {
-		return err
-	}
-	return err
+	return d.engine.Shutdown(context.Background())
 }
 
 func gnetUnpacket(buff []byte) ([]byte, error) {
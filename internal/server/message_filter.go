@@ -0,0 +1,302 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/WuKongIM/WuKongIM/pkg/wklog"
+	"github.com/WuKongIM/WuKongIM/pkg/wkutil"
+	wkproto "github.com/WuKongIM/WuKongIMGoProto"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// MessageFilterAction 消息过滤的结果
+type MessageFilterAction int
+
+const (
+	MessageFilterPass    MessageFilterAction = iota // 通过
+	MessageFilterRewrite                            // 改写消息内容，存储和投递的是改写后的内容
+	MessageFilterReject                             // 拒绝，消息不存储不投递
+)
+
+func (a MessageFilterAction) String() string {
+	switch a {
+	case MessageFilterPass:
+		return "pass"
+	case MessageFilterRewrite:
+		return "rewrite"
+	case MessageFilterReject:
+		return "reject"
+	}
+	return "unknown"
+}
+
+// MessageFilterResult 消息过滤器的处理结果
+type MessageFilterResult struct {
+	Action  MessageFilterAction
+	Payload []byte             // MessageFilterRewrite时改写后的消息内容
+	Reason  wkproto.ReasonCode // MessageFilterReject时sendack返回的原因码，为0时返回ReasonNotAllowSend
+}
+
+// PassMessage 消息通过过滤
+func PassMessage() MessageFilterResult {
+	return MessageFilterResult{Action: MessageFilterPass}
+}
+
+// RewriteMessage 改写消息内容
+func RewriteMessage(payload []byte) MessageFilterResult {
+	return MessageFilterResult{Action: MessageFilterRewrite, Payload: payload}
+}
+
+// RejectMessage 拒绝消息，sendack返回reason
+func RejectMessage(reason wkproto.ReasonCode) MessageFilterResult {
+	return MessageFilterResult{Action: MessageFilterReject, Reason: reason}
+}
+
+// MessageFilter 消息存储和投递前的内容过滤（比如关键词，第三方内容审核）
+// Filter在超时后ctx会被取消，返回错误或超时按Options.MessageFilter.FailOpen处理
+type MessageFilter interface {
+	Name() string
+	Filter(ctx context.Context, msg *Message) (MessageFilterResult, error)
+}
+
+// errMessageFilterStopped 消息过滤的协程已经停止
+var errMessageFilterStopped = errors.New("message filter stopped")
+
+// MessageFilterStats 消息过滤器的统计
+type MessageFilterStats struct {
+	Calls    int64         `json:"calls"`    // 调用次数
+	Rewrites int64         `json:"rewrites"` // 改写的消息数量
+	Rejects  int64         `json:"rejects"`  // 拒绝的消息数量（包括超时或出错后拒绝的）
+	Timeouts int64         `json:"timeouts"` // 超时次数
+	Errors   int64         `json:"errors"`   // 返回错误的次数
+	Latency  time.Duration `json:"latency"`  // 总耗时
+}
+
+type messageFilterEntry struct {
+	filter MessageFilter
+
+	calls    atomic.Int64
+	rewrites atomic.Int64
+	rejects  atomic.Int64
+	timeouts atomic.Int64
+	errors   atomic.Int64
+	latency  atomic.Int64
+}
+
+// messageFilterTask 同一个频道一批消息的过滤任务
+type messageFilterTask struct {
+	messages []*Message
+	results  []MessageFilterResult
+	done     chan struct{}
+}
+
+// messageFilterChain 按注册顺序执行消息过滤器，在固定数量的协程里执行，同一个频道的消息由同一个协程按顺序处理
+type messageFilterChain struct {
+	s       *Server
+	entries atomic.Pointer[[]*messageFilterEntry] // 写时复制
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+	workers   []chan *messageFilterTask
+	stopChan  chan struct{}
+	wg        sync.WaitGroup
+	wklog.Log
+}
+
+func newMessageFilterChain(s *Server) *messageFilterChain {
+	return &messageFilterChain{
+		s:        s,
+		stopChan: make(chan struct{}),
+		Log:      wklog.NewWKLog("MessageFilter"),
+	}
+}
+
+// register 追加过滤器，第一次注册时启动执行过滤的协程
+func (c *messageFilterChain) register(f MessageFilter) {
+	c.startOnce.Do(c.start)
+	var entries []*messageFilterEntry
+	if old := c.entries.Load(); old != nil {
+		entries = append(entries, *old...)
+	}
+	entries = append(entries, &messageFilterEntry{filter: f})
+	c.entries.Store(&entries)
+}
+
+func (c *messageFilterChain) empty() bool {
+	entries := c.entries.Load()
+	return entries == nil || len(*entries) == 0
+}
+
+func (c *messageFilterChain) start() {
+	workerCount := c.s.opts.MessageFilter.WorkerCount
+	if workerCount <= 0 {
+		workerCount = 1
+	}
+	c.workers = make([]chan *messageFilterTask, workerCount)
+	for i := range c.workers {
+		c.workers[i] = make(chan *messageFilterTask, c.s.opts.MessageFilter.QueueSize)
+		c.wg.Add(1)
+		go c.loop(c.workers[i])
+	}
+}
+
+func (c *messageFilterChain) stop() {
+	c.stopOnce.Do(func() {
+		close(c.stopChan)
+		c.wg.Wait()
+	})
+}
+
+func (c *messageFilterChain) loop(tasks chan *messageFilterTask) {
+	defer c.wg.Done()
+	for {
+		select {
+		case task := <-tasks:
+			for i, m := range task.messages {
+				task.results[i] = c.run(m)
+			}
+			close(task.done)
+		case <-c.stopChan:
+			return
+		}
+	}
+}
+
+// filter 过滤同一个频道的一批消息（channelKey相同的由同一个协程按提交顺序处理），返回每条消息的结果
+// 改写的消息已经替换了Payload，结果只会是MessageFilterPass或MessageFilterReject
+func (c *messageFilterChain) filter(channelKey string, messages []*Message) ([]MessageFilterResult, error) {
+	task := &messageFilterTask{
+		messages: messages,
+		results:  make([]MessageFilterResult, len(messages)),
+		done:     make(chan struct{}),
+	}
+	select {
+	case <-c.stopChan:
+		return nil, errMessageFilterStopped
+	default:
+	}
+	worker := c.workers[wkutil.HashCrc32(channelKey)%uint32(len(c.workers))]
+	select {
+	case worker <- task:
+	case <-c.stopChan:
+		return nil, errMessageFilterStopped
+	}
+	select {
+	case <-task.done:
+		return task.results, nil
+	case <-c.stopChan:
+		return nil, errMessageFilterStopped
+	}
+}
+
+// run 按顺序执行所有过滤器，某个过滤器拒绝后不再执行后面的过滤器
+func (c *messageFilterChain) run(m *Message) MessageFilterResult {
+	entries := c.entries.Load()
+	if entries == nil {
+		return PassMessage()
+	}
+	for _, entry := range *entries {
+		result := c.runOne(entry, m)
+		switch result.Action {
+		case MessageFilterRewrite:
+			m.Payload = result.Payload
+		case MessageFilterReject:
+			if result.Reason == 0 {
+				result.Reason = wkproto.ReasonNotAllowSend
+			}
+			return result
+		}
+	}
+	return PassMessage()
+}
+
+func (c *messageFilterChain) runOne(entry *messageFilterEntry, m *Message) MessageFilterResult {
+	type filterReturn struct {
+		result MessageFilterResult
+		err    error
+	}
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), c.s.opts.MessageFilter.Timeout)
+	defer cancel()
+	resultChan := make(chan filterReturn, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				resultChan <- filterReturn{err: errors.New("message filter panic")}
+			}
+		}()
+		result, err := entry.filter.Filter(ctx, m)
+		resultChan <- filterReturn{result: result, err: err}
+	}()
+
+	var (
+		result  MessageFilterResult
+		outcome string
+	)
+	select {
+	case ret := <-resultChan:
+		if ret.err != nil {
+			entry.errors.Inc()
+			c.Warn("message filter error", zap.String("filter", entry.filter.Name()), zap.Int64("messageID", m.MessageID), zap.Error(ret.err))
+			result, outcome = c.failResult(), "error"
+		} else {
+			result, outcome = ret.result, ret.result.Action.String()
+		}
+	case <-ctx.Done():
+		entry.timeouts.Inc()
+		c.Warn("message filter timeout", zap.String("filter", entry.filter.Name()), zap.Int64("messageID", m.MessageID), zap.Duration("timeout", c.s.opts.MessageFilter.Timeout))
+		result, outcome = c.failResult(), "timeout"
+	}
+	latency := time.Since(start)
+	entry.calls.Inc()
+	entry.latency.Add(int64(latency))
+	switch result.Action {
+	case MessageFilterRewrite:
+		entry.rewrites.Inc()
+	case MessageFilterReject:
+		entry.rejects.Inc()
+	}
+	c.s.monitor.MessageFilterObserve(entry.filter.Name(), outcome, latency)
+	return result
+}
+
+// failResult 过滤器超时或出错时的结果
+func (c *messageFilterChain) failResult() MessageFilterResult {
+	if c.s.opts.MessageFilter.FailOpen {
+		return PassMessage()
+	}
+	return RejectMessage(wkproto.ReasonSystemError)
+}
+
+func (c *messageFilterChain) stats() map[string]MessageFilterStats {
+	stats := make(map[string]MessageFilterStats)
+	entries := c.entries.Load()
+	if entries == nil {
+		return stats
+	}
+	for _, entry := range *entries {
+		stats[entry.filter.Name()] = MessageFilterStats{
+			Calls:    entry.calls.Load(),
+			Rewrites: entry.rewrites.Load(),
+			Rejects:  entry.rejects.Load(),
+			Timeouts: entry.timeouts.Load(),
+			Errors:   entry.errors.Load(),
+			Latency:  time.Duration(entry.latency.Load()),
+		}
+	}
+	return stats
+}
+
+// RegisterMessageFilter 注册消息过滤器，客户端发送的消息存储和投递前按注册顺序执行，需要在Start前注册
+func (s *Server) RegisterMessageFilter(f MessageFilter) {
+	s.dispatch.processor.messageFilters.register(f)
+}
+
+// MessageFilterStats 每个消息过滤器的统计，key为过滤器名称
+func (s *Server) MessageFilterStats() map[string]MessageFilterStats {
+	return s.dispatch.processor.messageFilters.stats()
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	wkproto "github.com/WuKongIM/WuKongIMGoProto"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+type testMessageFilter struct {
+	name string
+	fn   func(ctx context.Context, msg *Message) (MessageFilterResult, error)
+}
+
+func (f *testMessageFilter) Name() string { return f.name }
+
+func (f *testMessageFilter) Filter(ctx context.Context, msg *Message) (MessageFilterResult, error) {
+	return f.fn(ctx, msg)
+}
+
+func newTestFilterMessage(channelID string, payload string) *Message {
+	return &Message{
+		RecvPacket: &wkproto.RecvPacket{
+			ChannelID:   channelID,
+			ChannelType: wkproto.ChannelTypeGroup,
+			Payload:     []byte(payload),
+		},
+	}
+}
+
+func TestMessageFilterChain(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.MessageFilter.Timeout = time.Millisecond * 50
+	s := NewTestServer(opts)
+	chain := s.dispatch.processor.messageFilters
+	defer chain.stop()
+	assert.True(t, chain.empty())
+
+	s.RegisterMessageFilter(&testMessageFilter{name: "keyword", fn: func(ctx context.Context, msg *Message) (MessageFilterResult, error) {
+		if bytes.Contains(msg.Payload, []byte("bad")) {
+			return RewriteMessage(bytes.ReplaceAll(msg.Payload, []byte("bad"), []byte("***"))), nil
+		}
+		if bytes.Contains(msg.Payload, []byte("spam")) {
+			return RejectMessage(wkproto.ReasonBan), nil
+		}
+		return PassMessage(), nil
+	}})
+	s.RegisterMessageFilter(&testMessageFilter{name: "slow", fn: func(ctx context.Context, msg *Message) (MessageFilterResult, error) {
+		if bytes.Contains(msg.Payload, []byte("slow")) {
+			<-ctx.Done()
+			return PassMessage(), nil
+		}
+		if bytes.Contains(msg.Payload, []byte("***")) { // 看到的是前面的过滤器改写后的内容
+			return RejectMessage(0), nil
+		}
+		return PassMessage(), nil
+	}})
+	assert.False(t, chain.empty())
+
+	messages := []*Message{
+		newTestFilterMessage("g1", "hello"),
+		newTestFilterMessage("g1", "bad word"),
+		newTestFilterMessage("g1", "spam"),
+		newTestFilterMessage("g1", "slow"),
+	}
+	results, err := chain.filter("g1-2", messages)
+	assert.NoError(t, err)
+	assert.Equal(t, MessageFilterPass, results[0].Action)
+	assert.Equal(t, MessageFilterReject, results[1].Action)
+	assert.Equal(t, wkproto.ReasonNotAllowSend, results[1].Reason)
+	assert.Equal(t, []byte("*** word"), messages[1].Payload)
+	assert.Equal(t, RejectMessage(wkproto.ReasonBan), results[2])
+	// 超时默认拒绝
+	assert.Equal(t, RejectMessage(wkproto.ReasonSystemError), results[3])
+
+	stats := s.MessageFilterStats()
+	assert.Equal(t, int64(4), stats["keyword"].Calls)
+	assert.Equal(t, int64(1), stats["keyword"].Rewrites)
+	assert.Equal(t, int64(1), stats["keyword"].Rejects)
+	assert.Equal(t, int64(3), stats["slow"].Calls) // spam被拒绝后不再执行后面的过滤器
+	assert.Equal(t, int64(1), stats["slow"].Timeouts)
+	assert.Equal(t, int64(2), stats["slow"].Rejects)
+
+	// 超时放行
+	opts.MessageFilter.FailOpen = true
+	message := newTestFilterMessage("g1", "slow")
+	results, err = chain.filter("g1-2", []*Message{message})
+	assert.NoError(t, err)
+	assert.Equal(t, MessageFilterPass, results[0].Action)
+	assert.Equal(t, int64(2), s.MessageFilterStats()["slow"].Timeouts)
+}
+
+// 同一个频道的消息按提交顺序过滤
+func TestMessageFilterChainChannelOrder(t *testing.T) {
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.MessageFilter.WorkerCount = 4
+	s := NewTestServer(opts)
+	chain := s.dispatch.processor.messageFilters
+	defer chain.stop()
+
+	var (
+		mu    sync.Mutex
+		order = make(map[string][]string)
+	)
+	s.RegisterMessageFilter(&testMessageFilter{name: "order", fn: func(ctx context.Context, msg *Message) (MessageFilterResult, error) {
+		mu.Lock()
+		order[msg.ChannelID] = append(order[msg.ChannelID], string(msg.Payload))
+		mu.Unlock()
+		return PassMessage(), nil
+	}})
+
+	const (
+		channels = 8
+		count    = 50
+	)
+	var wg sync.WaitGroup
+	for c := 0; c < channels; c++ {
+		wg.Add(1)
+		go func(channelID string) {
+			defer wg.Done()
+			for i := 0; i < count; i++ {
+				_, err := chain.filter(channelID, []*Message{newTestFilterMessage(channelID, fmt.Sprintf("%d", i))})
+				assert.NoError(t, err)
+			}
+		}(fmt.Sprintf("g%d", c))
+	}
+	wg.Wait()
+	for c := 0; c < channels; c++ {
+		payloads := order[fmt.Sprintf("g%d", c)]
+		assert.Len(t, payloads, count)
+		for i, payload := range payloads {
+			assert.Equal(t, fmt.Sprintf("%d", i), payload)
+		}
+	}
+
+	// 停止后不再处理
+	chain.stop()
+	_, err := chain.filter("g1", []*Message{newTestFilterMessage("g1", "x")})
+	assert.ErrorIs(t, err, errMessageFilterStopped)
+}
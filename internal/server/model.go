@@ -229,11 +229,60 @@ func UnmarshalMessage(data []byte, m *Message) error {
 }
 
 type conversationResp struct {
-	ChannelID   string       `json:"channel_id"`   // 频道ID
-	ChannelType uint8        `json:"channel_type"` // 频道类型
-	Unread      int          `json:"unread"`       // 未读数
-	Timestamp   int64        `json:"timestamp"`
-	LastMessage *MessageResp `json:"last_message"` // 最后一条消息
+	ChannelID   string            `json:"channel_id"`   // 频道ID
+	ChannelType uint8             `json:"channel_type"` // 频道类型
+	Unread      int               `json:"unread"`       // 未读数
+	Timestamp   int64             `json:"timestamp"`
+	PinnedAt    int64             `json:"pinned_at,omitempty"` // 置顶时间（毫秒），没有置顶不返回
+	Mute        uint8             `json:"mute"`                // 免打扰 1开启 0关闭
+	Extra       map[string]string `json:"extra,omitempty"`     // 扩展数据，没有不返回
+	Archived    bool              `json:"archived,omitempty"`  // 已归档，没有归档不返回
+	LastMessage *MessageResp      `json:"last_message"`        // 最后一条消息
+	// MentionCount 提及（@）用户的未读消息数量，没有不返回
+	MentionCount uint32 `json:"mention_count,omitempty"`
+}
+
+// conversationSearchResp 后台搜索最近会话的结果
+type conversationSearchResp struct {
+	UID         string            `json:"uid"`
+	ChannelID   string            `json:"channel_id"`
+	ChannelType uint8             `json:"channel_type"`
+	Unread      int               `json:"unread"`
+	Timestamp   int64             `json:"timestamp"`
+	LastMsgSeq  uint32            `json:"last_msg_seq"`
+	Version     int64             `json:"version"`
+	PinnedAt    int64             `json:"pinned_at,omitempty"`
+	Mute        uint8             `json:"mute"`
+	Extra       map[string]string `json:"extra,omitempty"`
+	Archived    bool              `json:"archived,omitempty"`
+	// MentionCount 提及数量
+	MentionCount uint32 `json:"mention_count,omitempty"`
+}
+
+// conversationChangesResp 增量同步最近会话的结果
+type conversationChangesResp struct {
+	Conversations []conversationResp               `json:"conversations"`
+	Deleted       []*wkstore.ConversationTombstone `json:"deleted"` // 删除的最近会话
+	Version       uint64                           `json:"version"` // 下次同步传入的版本号
+	More          bool                             `json:"more"`    // 还有更多的变化，需要用version继续同步
+	Reset         bool                             `json:"reset"`   // 删除记录已经清理，客户端需要清空本地的最近会话
+}
+
+func newConversationSearchResp(conversation *wkstore.Conversation) *conversationSearchResp {
+	return &conversationSearchResp{
+		UID:          conversation.UID,
+		ChannelID:    conversation.ChannelID,
+		ChannelType:  conversation.ChannelType,
+		Unread:       conversation.UnreadCount,
+		Timestamp:    conversation.Timestamp,
+		LastMsgSeq:   conversation.LastMsgSeq,
+		Version:      conversation.Version,
+		PinnedAt:     conversation.PinnedAt,
+		Mute:         conversation.Mute,
+		Extra:        conversation.Extra,
+		Archived:     conversation.Archived,
+		MentionCount: conversation.MentionCount,
+	}
 }
 
 // MessageRespSlice MessageRespSlice
@@ -377,15 +426,23 @@ func (req deleteChannelReq) Check() error {
 }
 
 type syncUserConversationResp struct {
-	ChannelID       string         `json:"channel_id"`         // 频道ID
-	ChannelType     uint8          `json:"channel_type"`       // 频道类型
-	Unread          int            `json:"unread"`             // 未读消息
-	Timestamp       int64          `json:"timestamp"`          // 最后一次会话时间
-	LastMsgSeq      uint32         `json:"last_msg_seq"`       // 最后一条消息seq
-	LastClientMsgNo string         `json:"last_client_msg_no"` // 最后一次消息客户端编号
-	OffsetMsgSeq    int64          `json:"offset_msg_seq"`     // 偏移位的消息seq
-	Version         int64          `json:"version"`            // 数据版本
-	Recents         []*MessageResp `json:"recents"`            // 最近N条消息
+	ChannelID       string            `json:"channel_id"`                 // 频道ID
+	ChannelType     uint8             `json:"channel_type"`               // 频道类型
+	Unread          int               `json:"unread"`                     // 未读消息
+	Timestamp       int64             `json:"timestamp"`                  // 最后一次会话时间
+	LastMsgSeq      uint32            `json:"last_msg_seq"`               // 最后一条消息seq
+	LastClientMsgNo string            `json:"last_client_msg_no"`         // 最后一次消息客户端编号
+	OffsetMsgSeq    int64             `json:"offset_msg_seq"`             // 偏移位的消息seq
+	Version         int64             `json:"version"`                    // 数据版本
+	ChannelName     string            `json:"channel_name,omitempty"`     // 频道名称
+	ChannelAvatar   string            `json:"channel_avatar,omitempty"`   // 频道头像
+	PinnedAt        int64             `json:"pinned_at,omitempty"`        // 置顶时间（毫秒），没有置顶不返回
+	Mute            uint8             `json:"mute"`                       // 免打扰 1开启 0关闭
+	Extra           map[string]string `json:"extra,omitempty"`            // 扩展数据，没有不返回
+	Archived        bool              `json:"archived,omitempty"`         // 已归档（include_archived为true时才会同步），没有归档不返回
+	MentionCount    uint32            `json:"mention_count,omitempty"`    // 提及（@）用户的未读消息数量，没有不返回
+	FirstUnreadSeq  uint32            `json:"first_unread_seq,omitempty"` // 第一条未读并且还存在的消息seq，请求first_unread为true时返回，没有未读不返回
+	Recents         []*MessageResp    `json:"recents"`                    // 最近N条消息
 }
 
 func newSyncUserConversationResp(conversation *wkstore.Conversation) *syncUserConversationResp {
@@ -398,6 +455,13 @@ func newSyncUserConversationResp(conversation *wkstore.Conversation) *syncUserCo
 		LastMsgSeq:      conversation.LastMsgSeq,
 		LastClientMsgNo: conversation.LastClientMsgNo,
 		Version:         conversation.Version,
+		ChannelName:     conversation.ChannelName,
+		ChannelAvatar:   conversation.ChannelAvatar,
+		PinnedAt:        conversation.PinnedAt,
+		Mute:            conversation.Mute,
+		Extra:           conversation.Extra,
+		Archived:        conversation.Archived,
+		MentionCount:    conversation.MentionCount,
 	}
 }
 
@@ -441,6 +505,8 @@ type ChannelInfoReq struct {
 	Large       int    `json:"large"`        // 是否是超大群
 	Ban         int    `json:"ban"`          // 是否封禁频道（封禁后此频道所有人都将不能发消息，除了系统账号）
 	Disband     int    `json:"disband"`      // 是否解散频道
+	Name        string `json:"name"`         // 频道名称（开启conversation.channelInfo后冗余到最近会话）
+	Avatar      string `json:"avatar"`       // 频道头像（开启conversation.channelInfo后冗余到最近会话）
 }
 
 func (c ChannelInfoReq) ToChannelInfo() *wkstore.ChannelInfo {
@@ -576,6 +642,99 @@ func (r whitelistReq) Check() error {
 	return nil
 }
 
+// ensureConversationsReq 给频道成员创建空的会话的请求
+type ensureConversationsReq struct {
+	ChannelID   string   `json:"channel_id"`   // 频道ID
+	ChannelType uint8    `json:"channel_type"` // 频道类型
+	UIDs        []string `json:"uids"`         // 成员
+}
+
+func (r ensureConversationsReq) Check() error {
+	if r.ChannelID == "" {
+		return errors.New("channel_id不能为空！")
+	}
+	if r.ChannelType == 0 {
+		return errors.New("频道类型不能为0！")
+	}
+	if r.ChannelType == wkproto.ChannelTypePerson {
+		return errors.New("个人频道的会话由消息创建！")
+	}
+	if stringArrayIsEmpty(r.UIDs) {
+		return errors.New("uids不能为空！")
+	}
+	return nil
+}
+
+// channelMessageReq 频道内某条消息有变化（撤回，编辑）的请求
+type channelMessageReq struct {
+	ChannelID   string `json:"channel_id"`   // 频道ID
+	ChannelType uint8  `json:"channel_type"` // 频道类型
+	MessageSeq  uint32 `json:"message_seq"`  // 消息序列号
+}
+
+func (r channelMessageReq) Check() error {
+	if r.ChannelID == "" {
+		return errors.New("channel_id不能为空！")
+	}
+	if r.ChannelType == 0 {
+		return errors.New("频道类型不能为0！")
+	}
+	if r.MessageSeq == 0 {
+		return errors.New("message_seq不能为0！")
+	}
+	return nil
+}
+
+// conversationCASReq 按版本号写入会话的请求（多个节点同步同一个用户的会话时不会互相覆盖）
+type conversationCASReq struct {
+	UID           string                    `json:"uid"`           // 用户uid
+	Conversations []*conversationCASItemReq `json:"conversations"` // 要写入的会话
+}
+
+type conversationCASItemReq struct {
+	ChannelID       string `json:"channel_id"`         // 频道ID
+	ChannelType     uint8  `json:"channel_type"`       // 频道类型
+	Unread          int    `json:"unread"`             // 未读数
+	Timestamp       int64  `json:"timestamp"`          // 最后一次会话时间
+	LastMsgSeq      uint32 `json:"last_msg_seq"`       // 最后一条消息seq，0表示不修改
+	LastClientMsgNo string `json:"last_client_msg_no"` // 最后一条消息客户端编号
+	ExpectedVersion int64  `json:"expected_version"`   // 读取时会话的版本号，0表示期望会话还不存在
+}
+
+func (r conversationCASReq) Check() error {
+	if strings.TrimSpace(r.UID) == "" {
+		return errors.New("用户uid不能为空！")
+	}
+	if len(r.Conversations) == 0 {
+		return errors.New("conversations不能为空！")
+	}
+	for _, conversation := range r.Conversations {
+		if conversation == nil || conversation.ChannelID == "" || conversation.ChannelType == 0 {
+			return errors.New("channel_id或channel_type不能为空！")
+		}
+	}
+	return nil
+}
+
+func (r conversationCASReq) toConversationCAS() []wkstore.ConversationCAS {
+	items := make([]wkstore.ConversationCAS, 0, len(r.Conversations))
+	for _, conversation := range r.Conversations {
+		items = append(items, wkstore.ConversationCAS{
+			Conversation: &wkstore.Conversation{
+				UID:             r.UID,
+				ChannelID:       conversation.ChannelID,
+				ChannelType:     conversation.ChannelType,
+				UnreadCount:     conversation.Unread,
+				Timestamp:       conversation.Timestamp,
+				LastMsgSeq:      conversation.LastMsgSeq,
+				LastClientMsgNo: conversation.LastClientMsgNo,
+			},
+			ExpectedVersion: conversation.ExpectedVersion,
+		})
+	}
+	return items
+}
+
 type syncReq struct {
 	UID        string `json:"uid"`         // 用户uid
 	MessageSeq uint32 `json:"message_seq"` // 客户端最大消息序列号
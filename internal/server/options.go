@@ -101,7 +101,38 @@ type Options struct {
 		SyncInterval time.Duration // 最近会话同步间隔
 		SyncOnce     int           //  当多少最近会话数量发送变化就保存一次
 		UserMaxCount int           // 每个用户最大最近会话数量 默认为500
+		ChannelInfo  bool          // 最近会话是否冗余存储频道名称和头像（通过/channel/info更新）
+
+		InvalidateRate   int           // 最近会话缓存失效队列每秒最多处理的用户数量 默认为1000
+		InvalidateWindow time.Duration // 最近会话缓存失效的合并窗口，窗口内同一个用户的多次失效只处理一次 默认为100毫秒
+
+		Compress          bool // 是否压缩存储较大的最近会话数据 默认为false
+		CompressThreshold int  // 用户的最近会话数据超过此大小（字节）才压缩 默认为1024
+
+		LeaveFreeze bool // 用户离开频道后是否冻结最近会话（清空未读数，不再更新，重新加入后恢复），为false时删除最近会话 默认为false
+
+		TTL             map[uint8]time.Duration // 每种频道类型（key）的最近会话超过多久没有会话被清理，没有配置的频道类型不清理 默认为空
+		CleanupInterval time.Duration           // 清理过期最近会话的间隔 默认为10分钟
+		CleanupBudget   time.Duration           // 每次清理最多执行的时间，没清理完的下次继续 默认为1秒
+
+		WarmUp      bool // 启动后是否在后台预热最近会话缓存（加载最近有会话的用户） 默认为false
+		WarmUpRows  int  // 预热时最多遍历的最近会话数量（平均分到每个slot） 默认为100000
+		WarmUpUsers int  // 最多预热的用户数量，按用户最新的会话时间选取 默认为10000
+
+		CacheMaxEntries int           // 每个用户最多缓存的最近会话数量，超过后淘汰最久没有使用的 默认为0表示和UserMaxCount一样
+		CacheTTL        time.Duration // 已保存的最近会话缓存写入超过多久后读取时重新从数据库加载（避免漏了失效时一直返回旧数据） 默认为30分钟，0表示不过期
+		CacheDisabled   bool          // 是否关闭最近会话缓存，关闭后读取直接查数据库，修改直接保存到数据库 默认为false
+
+		CacheVerifySampleRate int           // 每次后台校验抽样的缓存用户数量（和数据库里的逐个字段比较），0表示不校验 默认为0
+		CacheVerifyInterval   time.Duration // 后台校验缓存的间隔 默认为1分钟
+		CacheVerifyHeal       bool          // 校验发现缓存和数据库不一致时是否清除用户的缓存 默认为false（只记录日志和计数）
+
+		OfflineDigestDelay time.Duration // 用户所有设备离线超过多久后把未读摘要交给RegisterOfflineDigestHandler注册的回调（期间重新上线则取消），0表示不开启 默认为0
+		OfflineDigestTopN  int           // 未读摘要最多包含的最近会话数量 默认为10
 	}
+	// IsUserActive 用户是否活跃，最近会话缓存失效队列优先处理活跃的用户，为nil时有连接的用户为活跃用户
+	IsUserActive func(uid string) bool
+
 	ManagerToken   string // 管理者的token
 	ManagerUID     string // 管理者的uid
 	ManagerTokenOn bool   // 管理者的token是否开启
@@ -117,15 +148,33 @@ type Options struct {
 	TimingWheelTick time.Duration // The time-round training interval must be 1ms or more
 	TimingWheelSize int64         // Time wheel size
 
+	TCPInfoSampleInterval time.Duration // 每隔多久采样一次连接的tcp链路质量（rtt，重传等，只支持linux），连接列表接口会返回最后一次的采样，0表示不采样
+	MaxFramesPerDecode    int           // 每个连接每次收到数据最多解码的包数量，剩下的下一轮继续解码（避免一次发送大量包的客户端让其他连接等待），0表示不限制
+
 	UserMsgQueueMaxSize int // 用户消息队列最大大小，超过此大小此用户将被限速，0为不限制
 
+	StoreMemoryBudget int64 // 存储层缓存（包括最近会话缓存）的内存预算（字节），超过水位时打印日志并停止写入非必要的缓存，0为不检查
+
+	StoreStartupCheck                 string  // 启动时检查最近会话数据的方式 off：不检查 sample：抽样检查 full：全部检查 默认为off
+	StoreStartupCheckFailOnCorruption bool    // 检查到的损坏用户比例超过StoreStartupCheckMaxCorruptRatio时拒绝启动 默认为false只打印日志
+	StoreStartupCheckMaxCorruptRatio  float64 // 允许的损坏用户比例 默认为0
+
 	TokenAuthOn bool // 是否开启token验证 不配置将根据mode属性判断 debug模式下默认为false release模式为true
 
+	MinProtoVersion int // 允许连接的最低协议版本，低于此版本的连接认证失败，0表示不限制
+
 	EventPoolSize int // 事件协程池大小,此池主要处理im的一些通知事件 比如webhook，上下线等等 默认为1024
 
 	WhitelistOffOfPerson bool // 是否关闭个人白名单验证
 	DeliveryMsgPoolSize  int  // 投递消息协程池大小，此池的协程主要用来将消息投递给在线用户 默认大小为 10240
 
+	MessageFilter struct { // 消息过滤器（Server.RegisterMessageFilter）配置
+		Timeout     time.Duration // 每个过滤器的超时时间 默认为1秒
+		FailOpen    bool          // 过滤器超时或出错时是否放行消息，为false时拒绝 默认为false
+		WorkerCount int           // 执行过滤器的协程数量，同一个频道的消息由同一个协程按顺序执行 默认为64
+		QueueSize   int           // 每个协程等待执行的任务队列大小，队列满了发送消息会等待 默认为1024
+	}
+
 	MessageRetry struct {
 		Interval     time.Duration // 消息重试间隔，如果消息发送后在此间隔内没有收到ack，将会在此间隔后重新发送
 		MaxCount     int           // 消息最大重试次数
@@ -206,15 +255,70 @@ func NewOptions() *Options {
 			SyncInterval time.Duration
 			SyncOnce     int
 			UserMaxCount int
+			ChannelInfo  bool
+
+			InvalidateRate   int
+			InvalidateWindow time.Duration
+
+			Compress          bool
+			CompressThreshold int
+
+			LeaveFreeze bool
+
+			TTL             map[uint8]time.Duration
+			CleanupInterval time.Duration
+			CleanupBudget   time.Duration
+
+			WarmUp      bool
+			WarmUpRows  int
+			WarmUpUsers int
+
+			CacheMaxEntries int
+			CacheTTL        time.Duration
+			CacheDisabled   bool
+
+			CacheVerifySampleRate int
+			CacheVerifyInterval   time.Duration
+			CacheVerifyHeal       bool
+
+			OfflineDigestDelay time.Duration
+			OfflineDigestTopN  int
 		}{
 			On:           true,
 			CacheExpire:  time.Hour * 24 * 1, // 1天过期
 			UserMaxCount: 1000,
 			SyncInterval: time.Minute * 5,
 			SyncOnce:     100,
+
+			InvalidateRate:   1000,
+			InvalidateWindow: time.Millisecond * 100,
+
+			CompressThreshold: 1024,
+
+			CleanupInterval: time.Minute * 10,
+			CleanupBudget:   time.Second,
+
+			WarmUpRows:  100000,
+			WarmUpUsers: 10000,
+
+			CacheTTL: time.Minute * 30,
+
+			CacheVerifyInterval: time.Minute,
+
+			OfflineDigestTopN: 10,
 		},
 		DeliveryMsgPoolSize: 10240,
 		EventPoolSize:       1024,
+		MessageFilter: struct {
+			Timeout     time.Duration
+			FailOpen    bool
+			WorkerCount int
+			QueueSize   int
+		}{
+			Timeout:     time.Second,
+			WorkerCount: 64,
+			QueueSize:   1024,
+		},
 		MessageRetry: struct {
 			Interval     time.Duration
 			MaxCount     int
@@ -309,14 +413,22 @@ func (o *Options) ConfigureWithViper(vp *viper.Viper) {
 	o.Channel.SubscriberCompressOfCount = o.getInt("channel.subscriberCompressOfCount", o.Channel.SubscriberCompressOfCount)
 
 	o.ConnIdleTime = o.getDuration("connIdleTime", o.ConnIdleTime)
+	o.TCPInfoSampleInterval = o.getDuration("tcpInfoSampleInterval", o.TCPInfoSampleInterval)
+	o.MaxFramesPerDecode = o.getInt("maxFramesPerDecode", o.MaxFramesPerDecode)
 
 	o.TimingWheelTick = o.getDuration("timingWheelTick", o.TimingWheelTick)
 	o.TimingWheelSize = o.getInt64("timingWheelSize", o.TimingWheelSize)
 
 	o.UserMsgQueueMaxSize = o.getInt("userMsgQueueMaxSize", o.UserMsgQueueMaxSize)
+	o.StoreMemoryBudget = o.getInt64("storeMemoryBudget", o.StoreMemoryBudget)
+	o.StoreStartupCheck = o.getString("storeStartupCheck.mode", o.StoreStartupCheck)
+	o.StoreStartupCheckFailOnCorruption = o.getBool("storeStartupCheck.failOnCorruption", o.StoreStartupCheckFailOnCorruption)
+	o.StoreStartupCheckMaxCorruptRatio = o.getFloat64("storeStartupCheck.maxCorruptRatio", o.StoreStartupCheckMaxCorruptRatio)
 
 	o.TokenAuthOn = o.getBool("tokenAuthOn", o.TokenAuthOn)
 
+	o.MinProtoVersion = o.getInt("minProtoVersion", o.MinProtoVersion)
+
 	o.UnitTest = o.vp.GetBool("unitTest")
 
 	o.Webhook.GRPCAddr = o.getString("webhook.grpcAddr", o.Webhook.GRPCAddr)
@@ -341,11 +453,36 @@ func (o *Options) ConfigureWithViper(vp *viper.Viper) {
 	o.MessageRetry.ScanInterval = o.getDuration("messageRetry.scanInterval", o.MessageRetry.ScanInterval)
 	o.MessageRetry.MaxCount = o.getInt("messageRetry.maxCount", o.MessageRetry.MaxCount)
 
+	o.MessageFilter.Timeout = o.getDuration("messageFilter.timeout", o.MessageFilter.Timeout)
+	o.MessageFilter.FailOpen = o.getBool("messageFilter.failOpen", o.MessageFilter.FailOpen)
+	o.MessageFilter.WorkerCount = o.getInt("messageFilter.workerCount", o.MessageFilter.WorkerCount)
+	o.MessageFilter.QueueSize = o.getInt("messageFilter.queueSize", o.MessageFilter.QueueSize)
+
 	o.Conversation.On = o.getBool("conversation.on", o.Conversation.On)
 	o.Conversation.CacheExpire = o.getDuration("conversation.cacheExpire", o.Conversation.CacheExpire)
 	o.Conversation.SyncInterval = o.getDuration("conversation.syncInterval", o.Conversation.SyncInterval)
 	o.Conversation.SyncOnce = o.getInt("conversation.syncOnce", o.Conversation.SyncOnce)
 	o.Conversation.UserMaxCount = o.getInt("conversation.userMaxCount", o.Conversation.UserMaxCount)
+	o.Conversation.ChannelInfo = o.getBool("conversation.channelInfo", o.Conversation.ChannelInfo)
+	o.Conversation.InvalidateRate = o.getInt("conversation.invalidateRate", o.Conversation.InvalidateRate)
+	o.Conversation.InvalidateWindow = o.getDuration("conversation.invalidateWindow", o.Conversation.InvalidateWindow)
+	o.Conversation.Compress = o.getBool("conversation.compress", o.Conversation.Compress)
+	o.Conversation.CompressThreshold = o.getInt("conversation.compressThreshold", o.Conversation.CompressThreshold)
+	o.Conversation.LeaveFreeze = o.getBool("conversation.leaveFreeze", o.Conversation.LeaveFreeze)
+	o.Conversation.TTL = o.getChannelTypeDurations("conversation.ttl", o.Conversation.TTL)
+	o.Conversation.CleanupInterval = o.getDuration("conversation.cleanupInterval", o.Conversation.CleanupInterval)
+	o.Conversation.CleanupBudget = o.getDuration("conversation.cleanupBudget", o.Conversation.CleanupBudget)
+	o.Conversation.WarmUp = o.getBool("conversation.warmUp", o.Conversation.WarmUp)
+	o.Conversation.WarmUpRows = o.getInt("conversation.warmUpRows", o.Conversation.WarmUpRows)
+	o.Conversation.WarmUpUsers = o.getInt("conversation.warmUpUsers", o.Conversation.WarmUpUsers)
+	o.Conversation.CacheMaxEntries = o.getInt("conversation.cacheMaxEntries", o.Conversation.CacheMaxEntries)
+	o.Conversation.CacheTTL = o.getDuration("conversation.cacheTTL", o.Conversation.CacheTTL)
+	o.Conversation.CacheDisabled = o.getBool("conversation.cacheDisabled", o.Conversation.CacheDisabled)
+	o.Conversation.CacheVerifySampleRate = o.getInt("conversation.cacheVerifySampleRate", o.Conversation.CacheVerifySampleRate)
+	o.Conversation.CacheVerifyInterval = o.getDuration("conversation.cacheVerifyInterval", o.Conversation.CacheVerifyInterval)
+	o.Conversation.CacheVerifyHeal = o.getBool("conversation.cacheVerifyHeal", o.Conversation.CacheVerifyHeal)
+	o.Conversation.OfflineDigestDelay = o.getDuration("conversation.offlineDigestDelay", o.Conversation.OfflineDigestDelay)
+	o.Conversation.OfflineDigestTopN = o.getInt("conversation.offlineDigestTopN", o.Conversation.OfflineDigestTopN)
 
 	o.SlotNum = o.getInt("slotNum", o.SlotNum)
 
@@ -492,6 +629,14 @@ func (o *Options) getInt64(key string, defaultValue int64) int64 {
 	return v
 }
 
+func (o *Options) getFloat64(key string, defaultValue float64) float64 {
+	v := o.vp.GetFloat64(key)
+	if v == 0 {
+		return defaultValue
+	}
+	return v
+}
+
 func (o *Options) getDuration(key string, defaultValue time.Duration) time.Duration {
 	v := o.vp.GetDuration(key)
 	if v == 0 {
@@ -500,6 +645,27 @@ func (o *Options) getDuration(key string, defaultValue time.Duration) time.Durat
 	return v
 }
 
+// getChannelTypeDurations 频道类型到时长的配置（比如 conversation.ttl: {1: 720h}），格式不对的项忽略
+func (o *Options) getChannelTypeDurations(key string, defaultValue map[uint8]time.Duration) map[uint8]time.Duration {
+	v := o.vp.GetStringMapString(key)
+	if len(v) == 0 {
+		return defaultValue
+	}
+	durations := make(map[uint8]time.Duration, len(v))
+	for channelTypeStr, durationStr := range v {
+		channelType, err := strconv.ParseUint(channelTypeStr, 10, 8)
+		if err != nil {
+			continue
+		}
+		duration, err := time.ParseDuration(durationStr)
+		if err != nil {
+			continue
+		}
+		durations[uint8(channelType)] = duration
+	}
+	return durations
+}
+
 // WebhookOn WebhookOn
 func (o *Options) WebhookOn() bool {
 	return strings.TrimSpace(o.Webhook.HTTPAddr) != "" || o.WebhookGRPCOn()
@@ -18,6 +18,9 @@ import (
 	"go.uber.org/zap"
 )
 
+// SendOrderPerConn 同一个连接发送的消息按发送顺序处理和存储（存储的messageSeq顺序和发送顺序一致），不同连接之间不保证顺序
+const SendOrderPerConn = true
+
 type Processor struct {
 	s               *Server
 	connContextPool sync.Pool
@@ -26,6 +29,8 @@ type Processor struct {
 	messageIDGen *snowflake.Node // 消息ID生成器
 
 	framePool *FramePool // 对象池
+
+	messageFilters *messageFilterChain // 消息存储前的内容过滤
 }
 
 func NewProcessor(s *Server) *Processor {
@@ -35,11 +40,12 @@ func NewProcessor(s *Server) *Processor {
 		panic(err)
 	}
 	return &Processor{
-		s:             s,
-		messageIDGen:  messageIDGen,
-		Log:           wklog.NewWKLog("Processor"),
-		frameWorkPool: NewFrameWorkPool(),
-		framePool:     NewFramePool(),
+		s:              s,
+		messageIDGen:   messageIDGen,
+		Log:            wklog.NewWKLog("Processor"),
+		frameWorkPool:  NewFrameWorkPool(),
+		framePool:      NewFramePool(),
+		messageFilters: newMessageFilterChain(s),
 		connContextPool: sync.Pool{
 			New: func() any {
 				cc := newConnContext(s)
@@ -102,6 +108,12 @@ func (p *Processor) processAuth(conn wknet.Conn, connectPacket *wkproto.ConnectP
 		p.responseConnackAuthFail(conn)
 		return
 	}
+	// -------------------- proto version --------------------
+	if p.s.opts.MinProtoVersion > 0 && int(connectPacket.Version) < p.s.opts.MinProtoVersion {
+		p.Warn("proto version too low", zap.String("uid", uid), zap.Uint8("version", connectPacket.Version), zap.Int("minProtoVersion", p.s.opts.MinProtoVersion), zap.String("deviceID", connectPacket.DeviceID))
+		p.responseConnack(conn, 0, reasonProtoVersionTooLow)
+		return
+	}
 	// -------------------- token verify --------------------
 	if connectPacket.UID == p.s.opts.ManagerUID {
 		if p.s.opts.ManagerTokenOn && connectPacket.Token != p.s.opts.ManagerToken {
@@ -240,6 +252,7 @@ func (p *Processor) processAuth(conn wknet.Conn, connectPacket *wkproto.ConnectP
 	// 在线webhook
 	onlineCount, totalOnlineCount := p.s.connManager.GetConnCountWith(uid, connectPacket.DeviceFlag)
 	p.s.webhook.Online(uid, connectPacket.DeviceFlag, conn.ID(), onlineCount, totalOnlineCount)
+	p.s.conversationManager.userOnline(uid) // 取消等待中的离线未读摘要
 
 }
 
@@ -396,6 +409,10 @@ func (p *Processor) prcocessChannelMessages(conn wknet.Conn, channelID string, c
 			large:          channel.Large,
 		})
 	}
+	//########## message filter ##########
+	if !p.messageFilters.empty() {
+		messages, sendackPackets = p.filterChannelMessages(fakeChannelID, channelType, messages, sendackPackets)
+	}
 	if len(messages) == 0 {
 		return sendackPackets, nil
 	}
@@ -430,6 +447,27 @@ func (p *Processor) prcocessChannelMessages(conn wknet.Conn, channelID string, c
 	return sendackPackets, nil
 }
 
+// filterChannelMessages 执行消息过滤器，返回通过的消息（改写的消息已替换内容），被拒绝的消息追加sendack
+func (p *Processor) filterChannelMessages(channelID string, channelType uint8, messages []*Message, sendackPackets []wkproto.Frame) ([]*Message, []wkproto.Frame) {
+	results, err := p.messageFilters.filter(fmt.Sprintf("%s-%d", channelID, channelType), messages)
+	if err != nil {
+		p.Warn("filter channel messages err", zap.Error(err), zap.String("channelID", channelID), zap.Uint8("channelType", channelType))
+		for _, m := range messages {
+			sendackPackets = append(sendackPackets, p.getSendackPacket(m, wkproto.ReasonSystemError))
+		}
+		return nil, sendackPackets
+	}
+	passed := make([]*Message, 0, len(messages))
+	for i, m := range messages {
+		if results[i].Action == MessageFilterReject {
+			sendackPackets = append(sendackPackets, p.getSendackPacket(m, results[i].Reason))
+			continue
+		}
+		passed = append(passed, m)
+	}
+	return passed, sendackPackets
+}
+
 // if has permission for sender
 func (p *Processor) hasPermission(channel *Channel, fromUID string) (bool, wkproto.ReasonCode) {
 	if channel.ChannelType == wkproto.ChannelTypeCustomerService { // customer service channel
@@ -681,6 +719,9 @@ func (p *Processor) processClose(conn wknet.Conn) {
 
 		onlineCount, totalOnlineCount := p.s.connManager.GetConnCountWith(conn.UID(), wkproto.DeviceFlag(conn.DeviceFlag())) // 指定的uid和设备下没有新的客户端才算真真的下线（TODO: 有时候离线要比在线晚触发导致不正确）
 		p.s.webhook.Offline(conn.UID(), wkproto.DeviceFlag(conn.DeviceFlag()), conn.ID(), onlineCount, totalOnlineCount)     // 触发离线webhook
+		if totalOnlineCount == 0 {
+			p.s.conversationManager.userOffline(conn.UID()) // 所有设备都离线了，延迟生成未读摘要
+		}
 	}
 }
 
@@ -690,6 +731,9 @@ func (p *Processor) response(conn wknet.Conn, frames ...wkproto.Frame) {
 	p.s.dispatch.dataOut(conn, frames...)
 }
 
+// reasonProtoVersionTooLow 协议版本低于MinProtoVersion（协议里没有单独的原因码，使用不支持的header）
+const reasonProtoVersionTooLow = wkproto.ReasonNotSupportHeader
+
 func (p *Processor) responseConnackAuthFail(c wknet.Conn) {
 	p.responseConnack(c, 0, wkproto.ReasonAuthFail)
 }
@@ -729,16 +773,24 @@ func (p *Processor) genMessageID() int64 {
 
 func (p *Processor) process(conn wknet.Conn) {
 	connCtx := conn.Context().(*connContext)
-	frames := connCtx.popFrames()
-	p.processFrames(conn, frames)
+	frames, firstSeq := connCtx.popFrames()
+	p.processFrames(conn, frames, firstSeq)
 
 }
 
 // 处理相同的frame
-func (p *Processor) processFrames(conn wknet.Conn, frames []wkproto.Frame) {
+func (p *Processor) processFrames(conn wknet.Conn, frames []wkproto.Frame, firstSeq uint64) {
 
 	p.sameFrames(frames, func(s, e int, frs []wkproto.Frame) {
-
+		if frs[0].GetFrameType() == wkproto.SEND { // 同一个连接的SEND包按序号依次处理，保证消息的存储顺序和发送顺序一致
+			connCtx := conn.Context().(*connContext)
+			if connCtx.enqueueSend(sendBatch{seq: firstSeq + uint64(s), frames: frs}) {
+				p.frameWorkPool.SubmitMust(func() {
+					p.processSendQueue(conn, connCtx)
+				})
+			}
+			return
+		}
 		p.frameWorkPool.Submit(func() { // 开启协程处理相同的frame
 			p.processSameFrame(conn, frs[0].GetFrameType(), frs, s, e)
 		})
@@ -746,6 +798,17 @@ func (p *Processor) processFrames(conn wknet.Conn, frames []wkproto.Frame) {
 
 }
 
+// processSendQueue 按序号依次处理连接的SEND包，直到队列为空
+func (p *Processor) processSendQueue(conn wknet.Conn, connCtx *connContext) {
+	for {
+		batch, ok := connCtx.nextSend()
+		if !ok {
+			return
+		}
+		p.processSameFrame(conn, wkproto.SEND, batch.frames, 0, len(batch.frames))
+	}
+}
+
 // 将frames按照frameType分组，然后处理
 func (p *Processor) sameFrames(frames []wkproto.Frame, callback func(s, e int, fs []wkproto.Frame)) {
 	for i := 0; i < len(frames); {
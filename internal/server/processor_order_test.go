@@ -0,0 +1,62 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/WuKongIM/WuKongIM/pkg/client"
+	wkproto "github.com/WuKongIM/WuKongIMGoProto"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// 同一个连接发送的消息，存储的messageSeq顺序和发送顺序一致
+func TestSendOrderPerConn(t *testing.T) {
+	assert.True(t, SendOrderPerConn)
+
+	opts := NewTestOptions(zap.ErrorLevel)
+	opts.ConfigureWithViper(viper.New())
+	opts.Mode = TestMode
+	opts.DataDir = t.TempDir()
+	opts.Addr = "tcp://127.0.0.1:0"
+	opts.WSAddr = "ws://127.0.0.1:0"
+	opts.HTTPAddr = "127.0.0.1:0"
+	opts.Monitor.On = false
+	opts.Demo.On = false
+	s := NewTestServer(opts)
+	assert.NoError(t, s.Start())
+	defer s.Stop()
+
+	cli := client.New(fmt.Sprintf("tcp://%s", s.dispatch.engine.TCPRealListenAddr().String()), client.WithUID("u1"), client.WithAutoReconn(false))
+	assert.NoError(t, cli.Connect())
+	defer cli.Close()
+
+	const count = 10000
+	acked := make(chan struct{}, count)
+	cli.SetOnSendack(func(sendackPacket *wkproto.SendackPacket) {
+		acked <- struct{}{}
+	})
+	channel := client.NewChannel("u2", wkproto.ChannelTypePerson)
+	for i := 0; i < count; i++ {
+		assert.NoError(t, cli.SendMessage(channel, []byte(fmt.Sprintf("%d", i))))
+	}
+	for i := 0; i < count; i++ {
+		select {
+		case <-acked:
+		case <-time.After(time.Second * 30):
+			t.Fatalf("wait sendack timeout, acked: %d", i)
+		}
+	}
+
+	messages, err := s.store.LoadNextRangeMsgs(GetFakeChannelIDWith("u1", "u2"), wkproto.ChannelTypePerson, 0, 0, count)
+	assert.NoError(t, err)
+	assert.Len(t, messages, count)
+	for i, message := range messages {
+		assert.Equal(t, fmt.Sprintf("%d", i), string(message.(*Message).Payload))
+		if t.Failed() {
+			t.Fatalf("message %d out of order, seq: %d", i, message.GetSeq())
+		}
+	}
+}
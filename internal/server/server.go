@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -14,6 +15,7 @@ import (
 	"github.com/RussellLuo/timingwheel"
 	"github.com/WuKongIM/WuKongIM/internal/monitor"
 	"github.com/WuKongIM/WuKongIM/pkg/wklog"
+	"github.com/WuKongIM/WuKongIM/pkg/wknet"
 	"github.com/WuKongIM/WuKongIM/pkg/wkstore"
 	"github.com/WuKongIM/WuKongIM/pkg/wkutil"
 	"github.com/WuKongIM/WuKongIM/version"
@@ -75,6 +77,26 @@ func New(opts *Options) *Server {
 
 	storeCfg := wkstore.NewStoreConfig()
 	storeCfg.DataDir = s.opts.DataDir
+	storeCfg.ConversationChannelInfo = s.opts.Conversation.ChannelInfo
+	storeCfg.ConversationCompress = s.opts.Conversation.Compress
+	storeCfg.ConversationCompressThreshold = s.opts.Conversation.CompressThreshold
+	if s.opts.Conversation.LeaveFreeze {
+		storeCfg.ConversationLeavePolicy = wkstore.ConversationLeaveFreeze
+	}
+	storeCfg.ConversationTTL = s.opts.Conversation.TTL
+	storeCfg.ConversationCleanupBudget = s.opts.Conversation.CleanupBudget
+	storeCfg.MemoryBudget = s.opts.StoreMemoryBudget
+	if s.opts.StoreStartupCheck != "" {
+		storeCfg.StartupCheck = wkstore.StartupCheckMode(s.opts.StoreStartupCheck)
+	}
+	storeCfg.StartupCheckFailOnCorruption = s.opts.StoreStartupCheckFailOnCorruption
+	storeCfg.StartupCheckMaxCorruptRatio = s.opts.StoreStartupCheckMaxCorruptRatio
+	storeCfg.ExternalMemoryUsage = func() int64 {
+		if s.conversationManager == nil {
+			return 0
+		}
+		return s.conversationManager.cacheBytes()
+	}
 	storeCfg.DecodeMessageFnc = func(msg []byte) (wkstore.Message, error) {
 		m := &Message{}
 		err := m.Decode(msg)
@@ -105,6 +127,8 @@ func New(opts *Options) *Server {
 
 	monitor.SetMonitorOn(s.opts.Monitor.On) // 监控开关
 
+	s.registerShutdownHooks()
+
 	return s
 }
 
@@ -135,6 +159,7 @@ func (s *Server) Start() error {
 	s.Info(fmt.Sprintf("  Git:  %s", fmt.Sprintf("%s-%s", version.CommitDate, version.Commit)))
 	s.Info(fmt.Sprintf("  Go build:  %s", runtime.Version()))
 	s.Info(fmt.Sprintf("  DataDir:  %s", s.opts.DataDir))
+	s.Info(fmt.Sprintf("  Send order per conn:  %v", SendOrderPerConn))
 
 	s.Info(fmt.Sprintf("Listening  for TCP client on %s", s.opts.Addr))
 	s.Info(fmt.Sprintf("Listening  for WS client on %s", s.opts.WSAddr))
@@ -194,28 +219,55 @@ func (s *Server) Stop() error {
 
 	s.timingWheel.Stop()
 
-	s.retryQueue.Stop()
-	_ = s.dispatch.Stop()
-	s.apiServer.Stop()
-	s.conversationManager.Stop()
-	s.webhook.Stop()
-
-	if s.opts.Monitor.On {
-		_ = s.monitorServer.Stop()
-		s.monitor.Stop()
-	}
-	if s.opts.Demo.On {
-		s.demoServer.Stop()
+	// 各组件按registerShutdownHooks注册的阶段依次停止
+	err := s.dispatch.Stop()
+	if err != nil {
+		s.Warn("some components failed to stop", zap.Error(err))
 	}
-	fmt.Println("Server is Stoping...7")
-	s.store.Close()
-	fmt.Println("Server is Stoping...8")
 	close(s.stopChan)
-	fmt.Println("Server is Stoping...9")
 
 	return nil
 }
 
+// registerShutdownHooks 把各组件的停止注册到引擎的停止阶段，避免停止的顺序不对导致存储关闭后还有写入、reactor停止后还有回调
+// 先停止接受新连接和api请求，发送完连接输出缓冲区的数据后停止reactor和会写存储的后台处理，最后关闭存储
+func (s *Server) registerShutdownHooks() {
+	engine := s.dispatch.engine
+	engine.RegisterShutdownHook("apiServer", func(ctx context.Context) error {
+		s.apiServer.Stop()
+		return nil
+	}, wknet.ShutdownPhaseDrainHandlers)
+	engine.RegisterShutdownHook("monitorServer", func(ctx context.Context) error {
+		if !s.opts.Monitor.On {
+			return nil
+		}
+		err := s.monitorServer.Stop()
+		s.monitor.Stop()
+		return err
+	}, wknet.ShutdownPhaseDrainHandlers)
+	engine.RegisterShutdownHook("demoServer", func(ctx context.Context) error {
+		if s.opts.Demo.On {
+			s.demoServer.Stop()
+		}
+		return nil
+	}, wknet.ShutdownPhaseDrainHandlers)
+	engine.RegisterShutdownHook("retryQueue", func(ctx context.Context) error {
+		s.retryQueue.Stop()
+		return nil
+	}, wknet.ShutdownPhaseDrainHandlers)
+	engine.RegisterShutdownHook("conversationManager", func(ctx context.Context) error {
+		s.conversationManager.Stop()
+		return nil
+	}, wknet.ShutdownPhaseStopReactors)
+	engine.RegisterShutdownHook("webhook", func(ctx context.Context) error {
+		s.webhook.Stop()
+		return nil
+	}, wknet.ShutdownPhaseStopReactors)
+	engine.RegisterShutdownHook("store", func(ctx context.Context) error {
+		return s.store.Close()
+	}, wknet.ShutdownPhaseCloseStore)
+}
+
 // Schedule 延迟任务
 func (s *Server) Schedule(interval time.Duration, f func()) *timingwheel.Timer {
 	return s.timingWheel.ScheduleFunc(&everyScheduler{
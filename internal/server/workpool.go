@@ -20,3 +20,10 @@ func NewFrameWorkPool() *FrameWorkPool {
 func (f *FrameWorkPool) Submit(task func()) {
 	_ = f.pool.Submit(task)
 }
+
+// SubmitMust 提交任务，协程池满了则开启新的协程执行，任务不会被丢弃
+func (f *FrameWorkPool) SubmitMust(task func()) {
+	if err := f.pool.Submit(task); err != nil {
+		go task()
+	}
+}
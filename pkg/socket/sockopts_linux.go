@@ -0,0 +1,21 @@
+//go:build linux
+// +build linux
+
+package socket
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// SetDeferAccept enables TCP_DEFER_ACCEPT option on listening socket,
+// the connection is only accepted after data arrives or secs elapsed.
+func SetDeferAccept(fd, secs int) error {
+	return os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_DEFER_ACCEPT, secs))
+}
+
+// SetFastOpen enables TCP_FASTOPEN option on listening socket with the given pending SYN queue length.
+func SetFastOpen(fd, qlen int) error {
+	return os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_FASTOPEN, qlen))
+}
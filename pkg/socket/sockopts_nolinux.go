@@ -0,0 +1,14 @@
+//go:build freebsd || dragonfly || darwin
+// +build freebsd dragonfly darwin
+
+package socket
+
+// SetDeferAccept is a no-op on this platform.
+func SetDeferAccept(_, _ int) error {
+	return nil
+}
+
+// SetFastOpen is a no-op on this platform.
+func SetFastOpen(_, _ int) error {
+	return nil
+}
@@ -4,6 +4,7 @@
 package wknet
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -14,6 +15,7 @@ import (
 	"github.com/WuKongIM/WuKongIM/pkg/socket"
 	"github.com/WuKongIM/WuKongIM/pkg/wklog"
 	"github.com/WuKongIM/WuKongIM/pkg/wknet/netpoll"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 	"golang.org/x/sys/unix"
 )
@@ -25,10 +27,12 @@ type Acceptor struct {
 	listenWSPoller    *netpoll.Poller
 	listenWSSPoller   *netpoll.Poller
 	listen            *listener
-	listenWS          *listener // websocket
-	listenWSS         *listener // websocket
-	tcpRealListenAddr net.Addr  // tcp real listen addr
-	wsRealListenAddr  net.Addr  // websocket real listen addr
+	listenWS          *listener    // websocket
+	listenWSS         *listener    // websocket
+	sniffer           *connSniffer // tcp端口开启tls时判断新连接是否是tls
+	tcpRealListenAddr net.Addr     // tcp real listen addr
+	wsRealListenAddr  net.Addr     // websocket real listen addr
+	listenStopped     atomic.Bool  // 监听端口是否已关闭
 
 	wklog.Log
 }
@@ -46,6 +50,9 @@ func NewAcceptor(eg *Engine) *Acceptor {
 		listenWSSPoller: netpoll.NewPoller(0, "listenWSSPoller"),
 		Log:             wklog.NewWKLog("Acceptor"),
 	}
+	if eg.tcpTLSEnabled() {
+		a.sniffer = newConnSniffer(a)
+	}
 
 	return a
 }
@@ -60,6 +67,9 @@ func (a *Acceptor) start() error {
 	for _, reactorSub := range a.reactorSubs {
 		reactorSub.Start()
 	}
+	if a.sniffer != nil {
+		a.sniffer.start()
+	}
 
 	var wg = &sync.WaitGroup{}
 
@@ -95,6 +105,24 @@ func (a *Acceptor) start() error {
 }
 
 func (a *Acceptor) Stop() error {
+	a.stopListen()
+
+	// -----------------reactor sub-----------------
+	for _, reactorSub := range a.reactorSubs {
+		err := reactorSub.Stop()
+		if err != nil {
+			a.Warn("reactorSub.Stop() failed", zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// stopListen 关闭监听端口，不再接受新连接，已经建立的连接不受影响，可以重复调用
+func (a *Acceptor) stopListen() {
+	if !a.listenStopped.CompareAndSwap(false, true) {
+		return
+	}
 
 	// -----------------listen-----------------
 	err := a.listenPoller.Close()
@@ -106,6 +134,7 @@ func (a *Acceptor) Stop() error {
 		if err != nil {
 			a.Warn("listen.Close() failed", zap.Error(err))
 		}
+		a.eg.emitListenerEvent(EventListenerStopped, ListenerTCP, a.listen.realAddr)
 	}
 
 	// -----------------ws-----------------
@@ -115,6 +144,7 @@ func (a *Acceptor) Stop() error {
 		if err != nil {
 			a.Warn("listenWS.Close() failed", zap.Error(err))
 		}
+		a.eg.emitListenerEvent(EventListenerStopped, ListenerWS, a.listenWS.realAddr)
 	}
 	err = a.listenWSPoller.Close()
 	if err != nil {
@@ -131,17 +161,15 @@ func (a *Acceptor) Stop() error {
 		if err != nil {
 			a.Warn("listenWSS.Close() failed", zap.Error(err))
 		}
+		a.eg.emitListenerEvent(EventListenerStopped, ListenerWSS, a.listenWSS.realAddr)
 	}
 
-	// -----------------reactor sub-----------------
-	for _, reactorSub := range a.reactorSubs {
-		err = reactorSub.Stop()
+	if a.sniffer != nil {
+		err = a.sniffer.stop()
 		if err != nil {
-			a.Warn("reactorSub.Stop() failed", zap.Error(err))
+			a.Warn("sniffer.stop() failed", zap.Error(err))
 		}
 	}
-
-	return nil
 }
 
 func (a *Acceptor) initTCPListener(wg *sync.WaitGroup) error {
@@ -155,10 +183,11 @@ func (a *Acceptor) initTCPListener(wg *sync.WaitGroup) error {
 	if err := a.listenPoller.AddRead(a.listen.fd); err != nil {
 		return fmt.Errorf("add listener fd to poller failed %s", err)
 	}
+	a.eg.emitListenerEvent(EventListenerStarted, ListenerTCP, a.listen.realAddr)
 	wg.Done()
 
 	err = a.listenPoller.Polling(func(fd int, ev netpoll.PollEvent) error {
-		return a.acceptConn(fd, false, false)
+		return a.acceptConn(fd, connKindTCP)
 	})
 	return err
 
@@ -175,9 +204,10 @@ func (a *Acceptor) initWSListener(wg *sync.WaitGroup) error {
 	if err := a.listenWSPoller.AddRead(a.listenWS.fd); err != nil {
 		return fmt.Errorf("add ws listener fd to poller failed %s", err)
 	}
+	a.eg.emitListenerEvent(EventListenerStarted, ListenerWS, a.listenWS.realAddr)
 	wg.Done()
 	return a.listenWSPoller.Polling(func(fd int, ev netpoll.PollEvent) error {
-		return a.acceptConn(fd, true, false)
+		return a.acceptConn(fd, connKindWS)
 	})
 }
 
@@ -192,17 +222,14 @@ func (a *Acceptor) initWSSListener(wg *sync.WaitGroup) error {
 	if err := a.listenWSSPoller.AddRead(a.listenWSS.fd); err != nil {
 		return fmt.Errorf("add ws listener fd to poller failed %s", err)
 	}
+	a.eg.emitListenerEvent(EventListenerStarted, ListenerWSS, a.listenWSS.realAddr)
 	wg.Done()
 	return a.listenWSSPoller.Polling(func(fd int, ev netpoll.PollEvent) error {
-		return a.acceptConn(fd, false, true)
+		return a.acceptConn(fd, connKindWSS)
 	})
 }
 
-func (a *Acceptor) acceptConn(listenFd int, ws bool, wss bool) error {
-	var (
-		conn Conn
-		err  error
-	)
+func (a *Acceptor) acceptConn(listenFd int, kind connKind) error {
 	connFd, sa, err := unix.Accept(listenFd)
 	if err != nil {
 		if err == unix.EAGAIN {
@@ -215,37 +242,86 @@ func (a *Acceptor) acceptConn(listenFd int, ws bool, wss bool) error {
 		return err
 	}
 	remoteAddr := socket.SockaddrToTCPOrUnixAddr(sa)
+	if !a.eg.acceptAllowed(kind, remoteAddr) { // 网段限制，还没创建连接，直接关闭fd
+		_ = unix.Close(connFd)
+		return nil
+	}
 	if a.eg.options.TCPKeepAlive > 0 && a.listen.customNetwork == "tcp" {
 		err = socket.SetKeepAlivePeriod(connFd, int(a.eg.options.TCPKeepAlive.Seconds()))
 		a.Error("SetKeepAlivePeriod() failed", zap.Error(err))
 	}
+	if kind == connKindTCP && a.sniffer != nil { // 等收到第一个包判断是否是tls后再创建连接
+		a.sniffer.add(connFd, remoteAddr)
+		return nil
+	}
+	return a.newConn(connFd, remoteAddr, kind)
+}
+
+// newConn 创建连接并添加到sub reactor
+func (a *Acceptor) newConn(connFd int, remoteAddr net.Addr, kind connKind) error {
+	_, err := a.registerConn(connFd, nil, remoteAddr, kind)
+	if errors.Is(err, errAddToReactorSub) { // 已经打印了日志，不影响继续accept
+		return nil
+	}
+	return err
+}
+
+// errAddToReactorSub 连接添加到sub reactor失败
+var errAddToReactorSub = errors.New("add conn to sub reactor failed")
+
+// registerConn 创建连接，调用OnConnect后添加到sub reactor，localAddr为nil时使用监听的地址
+func (a *Acceptor) registerConn(connFd int, localAddr net.Addr, remoteAddr net.Addr, kind connKind) (Conn, error) {
+	var conn Conn
 	subReactor := a.reactorSubByConnFd(connFd)
-	if wss {
-		if conn, err = a.eg.eventHandler.OnNewWSSConn(a.eg.GenClientID(), newNetFd(connFd), a.wssRealAddr(), remoteAddr, a.eg, subReactor); err != nil {
-			return err
-		}
-	} else if ws {
-		if conn, err = a.eg.eventHandler.OnNewWSConn(a.eg.GenClientID(), newNetFd(connFd), a.wsRealAddr(), remoteAddr, a.eg, subReactor); err != nil {
-			return err
+	fd := newNetFd(connFd)
+	fd.injector = a.eg.options.FaultInjector
+	err := a.eg.callHandler("OnNewConn", nil, func() error {
+		var err error
+		switch kind {
+		case connKindWSS:
+			conn, err = a.eg.eventHandler.OnNewWSSConn(a.eg.GenClientID(), fd, orAddr(localAddr, a.wssRealAddr), remoteAddr, a.eg, subReactor)
+		case connKindWS:
+			conn, err = a.eg.eventHandler.OnNewWSConn(a.eg.GenClientID(), fd, orAddr(localAddr, a.wsRealAddr), remoteAddr, a.eg, subReactor)
+		case connKindTLS:
+			conn, err = a.eg.eventHandler.OnNewTLSConn(a.eg.GenClientID(), fd, orAddr(localAddr, a.tcpRealAddr), remoteAddr, a.eg, subReactor)
+		default:
+			conn, err = a.eg.eventHandler.OnNewConn(a.eg.GenClientID(), fd, orAddr(localAddr, a.tcpRealAddr), remoteAddr, a.eg, subReactor)
 		}
-	} else {
-
-		if conn, err = a.eg.eventHandler.OnNewConn(a.eg.GenClientID(), newNetFd(connFd), a.tcpRealAddr(), remoteAddr, a.eg, subReactor); err != nil {
-			return err
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, ErrHandlerPanic) { // 连接还没创建，直接关闭fd
+			_ = unix.Close(connFd)
 		}
+		return nil, err
+	}
+	// call on connect
+	// 先调用OnConnect再添加到sub reactor，开启TCP_DEFER_ACCEPT或TCP_FASTOPEN后连接建立时可能已经有数据，添加后读事件会立马触发
+	connectErr := a.eg.callHandler("OnConnect", conn, func() error {
+		return a.eg.eventHandler.OnConnect(conn)
+	})
+	if connectErr != nil {
+		a.Warn("OnConnect() failed", zap.Error(connectErr))
 	}
+	a.eg.emitConnEvent(EventConnOpened, conn.ID(), conn.LocalAddr(), conn.RemoteAddr(), nil) // 添加到sub reactor前发送，保证在关闭事件之前
 	// add conn to sub reactor
 	err = subReactor.AddConn(conn)
 	if err != nil {
 		a.Warn("subReactor.AddConn() failed", zap.Error(err))
+		return conn, fmt.Errorf("%w: %w", errAddToReactorSub, err)
 	}
-	// call on connect
-	err = a.eg.eventHandler.OnConnect(conn)
-	if err != nil {
-		a.Warn("OnConnect() failed", zap.Error(err))
+	if errors.Is(connectErr, ErrHandlerPanic) {
+		_ = subReactor.CloseConn(conn, connectErr)
 	}
+	return conn, nil
+}
 
-	return nil
+// orAddr addr为nil时使用def返回的地址
+func orAddr(addr net.Addr, def func() net.Addr) net.Addr {
+	if addr != nil {
+		return addr
+	}
+	return def()
 }
 
 func (a *Acceptor) reactorSubByConnFd(connfd int) *ReactorSub {
@@ -1,11 +1,13 @@
 package wknet
 
 import (
+	"errors"
 	"net"
 	"strings"
 	"sync"
 
 	"github.com/WuKongIM/WuKongIM/pkg/wklog"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 )
 
@@ -16,6 +18,8 @@ type Acceptor struct {
 	listen    *listener
 	listenWS  *listener // websocket
 	listenWSS *listener // websocket
+
+	listenStopped atomic.Bool // 监听端口是否已关闭
 }
 
 func NewAcceptor(eg *Engine) *Acceptor {
@@ -36,22 +40,33 @@ func (a *Acceptor) Start() error {
 }
 
 func (a *Acceptor) Stop() error {
+	a.stopListen()
+	for _, reactorSub := range a.reactorSubs {
+		reactorSub.Stop()
+	}
+	return nil
+}
+
+// stopListen 关闭监听端口，不再接受新连接，已经建立的连接不受影响，可以重复调用
+func (a *Acceptor) stopListen() {
+	if !a.listenStopped.CompareAndSwap(false, true) {
+		return
+	}
 	err := a.listen.Close()
 	if err != nil {
 		a.Warn("listen.Close() failed", zap.Error(err))
 	}
+	a.eg.emitListenerEvent(EventListenerStopped, ListenerTCP, a.listen.realAddr)
 	err = a.listenWS.Close()
 	if err != nil {
 		a.Warn("listenWS.Close() failed", zap.Error(err))
 	}
+	a.eg.emitListenerEvent(EventListenerStopped, ListenerWS, a.listenWS.realAddr)
 	err = a.listenWSS.Close()
 	if err != nil {
 		a.Warn("listenWSS.Close() failed", zap.Error(err))
 	}
-	for _, reactorSub := range a.reactorSubs {
-		reactorSub.Stop()
-	}
-	return nil
+	a.eg.emitListenerEvent(EventListenerStopped, ListenerWSS, a.listenWSS.realAddr)
 }
 
 func (a *Acceptor) tcpRealAddr() net.Addr {
@@ -114,6 +129,7 @@ func (a *Acceptor) initTCPListener(wg *sync.WaitGroup) error {
 	if err != nil {
 		return err
 	}
+	a.eg.emitListenerEvent(EventListenerStarted, ListenerTCP, a.listen.realAddr)
 	wg.Done()
 	a.listen.Polling(func(fd NetFd) error {
 		return a.acceptConn(fd, false, false)
@@ -128,6 +144,7 @@ func (a *Acceptor) initWSListener(wg *sync.WaitGroup) error {
 	if err != nil {
 		return err
 	}
+	a.eg.emitListenerEvent(EventListenerStarted, ListenerWS, a.listenWS.realAddr)
 	wg.Done()
 	a.listenWS.Polling(func(fd NetFd) error {
 		return a.acceptConn(fd, true, false)
@@ -142,6 +159,7 @@ func (a *Acceptor) initWSSListener(wg *sync.WaitGroup) error {
 	if err != nil {
 		return err
 	}
+	a.eg.emitListenerEvent(EventListenerStarted, ListenerWSS, a.listenWSS.realAddr)
 	wg.Done()
 	a.listenWSS.Polling(func(fd NetFd) error {
 		return a.acceptConn(fd, false, true)
@@ -157,25 +175,47 @@ func (a *Acceptor) acceptConn(connNetFd NetFd, ws bool, wss bool) error {
 	connFd := connNetFd.fd
 
 	remoteAddr := connNetFd.conn.RemoteAddr()
-
-	subReactor := a.reactorSubByConnFd(connFd)
+	kind := connKindTCP
 	if wss {
-		if conn, err = a.eg.eventHandler.OnNewWSSConn(a.eg.GenClientID(), connNetFd, a.wssRealAddr(), remoteAddr, a.eg, subReactor); err != nil {
-			return err
-		}
+		kind = connKindWSS
 	} else if ws {
-		if conn, err = a.eg.eventHandler.OnNewWSConn(a.eg.GenClientID(), connNetFd, a.wsRealAddr(), remoteAddr, a.eg, subReactor); err != nil {
-			return err
+		kind = connKindWS
+	}
+	if !a.eg.acceptAllowed(kind, remoteAddr) { // 网段限制，还没创建连接，直接关闭
+		_ = connNetFd.Close()
+		return nil
+	}
+
+	subReactor := a.reactorSubByConnFd(connFd)
+	err = a.eg.callHandler("OnNewConn", nil, func() error {
+		var err error
+		if wss {
+			conn, err = a.eg.eventHandler.OnNewWSSConn(a.eg.GenClientID(), connNetFd, a.wssRealAddr(), remoteAddr, a.eg, subReactor)
+		} else if ws {
+			conn, err = a.eg.eventHandler.OnNewWSConn(a.eg.GenClientID(), connNetFd, a.wsRealAddr(), remoteAddr, a.eg, subReactor)
+		} else if a.eg.tcpTLSEnabled() && a.eg.options.TLSMode == TLSModeOpportunistic { // windows下不支持嗅探，按tls连接处理
+			conn, err = a.eg.eventHandler.OnNewTLSConn(a.eg.GenClientID(), connNetFd, a.tcpRealAddr(), remoteAddr, a.eg, subReactor)
+		} else {
+			conn, err = a.eg.eventHandler.OnNewConn(a.eg.GenClientID(), connNetFd, a.tcpRealAddr(), remoteAddr, a.eg, subReactor)
 		}
-	} else {
-		if conn, err = a.eg.eventHandler.OnNewConn(a.eg.GenClientID(), connNetFd, a.tcpRealAddr(), remoteAddr, a.eg, subReactor); err != nil {
-			return err
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, ErrHandlerPanic) { // 连接还没创建，直接关闭
+			_ = connNetFd.Close()
 		}
+		return err
 	}
+	a.eg.emitConnEvent(EventConnOpened, conn.ID(), conn.LocalAddr(), conn.RemoteAddr(), nil)
 	// add conn to sub reactor
 	subReactor.AddConn(conn)
 	// call on connect
-	a.eg.eventHandler.OnConnect(conn)
+	err = a.eg.callHandler("OnConnect", conn, func() error {
+		return a.eg.eventHandler.OnConnect(conn)
+	})
+	if errors.Is(err, ErrHandlerPanic) {
+		_ = subReactor.CloseConn(conn, err)
+	}
 	return nil
 }
 
@@ -0,0 +1,74 @@
+package wknet
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CPUAffinity sub reactor绑定cpu的配置，只支持linux，其他平台忽略
+type CPUAffinity struct {
+	Auto bool  // 自动把sub reactor平均分配到进程可用的cpu上
+	CPUs []int // 第i个sub reactor绑定到CPUs[i%len(CPUs)]
+}
+
+// ParseCPUAffinity 解析cpu绑定配置，"auto"表示自动分配，"0,2,4"表示依次绑定到指定的cpu，空字符串表示不绑定
+func ParseCPUAffinity(v string) (*CPUAffinity, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return nil, nil
+	}
+	if v == "auto" {
+		return &CPUAffinity{Auto: true}, nil
+	}
+	parts := strings.Split(v, ",")
+	cpus := make([]int, 0, len(parts))
+	for _, part := range parts {
+		cpu, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || cpu < 0 {
+			return nil, fmt.Errorf("invalid cpu affinity: %s", v)
+		}
+		cpus = append(cpus, cpu)
+	}
+	return &CPUAffinity{CPUs: cpus}, nil
+}
+
+// assignReactorCPUs 计算每个sub reactor要绑定的cpu，-1表示不绑定
+func assignReactorCPUs(affinity *CPUAffinity, subNum int, available []int) []int {
+	cpus := make([]int, subNum)
+	for i := range cpus {
+		cpus[i] = -1
+	}
+	if affinity == nil || len(available) == 0 {
+		return cpus
+	}
+	candidates := affinity.CPUs
+	if affinity.Auto {
+		candidates = available
+	}
+	if len(candidates) == 0 {
+		return cpus
+	}
+	for i := range cpus {
+		cpus[i] = candidates[i%len(candidates)]
+	}
+	return cpus
+}
+
+// reactorCPU 第idx个sub reactor要绑定的cpu，-1表示不绑定
+func (e *Engine) reactorCPU(idx int) int {
+	if idx < 0 || idx >= len(e.reactorCPUs) {
+		return -1
+	}
+	return e.reactorCPUs[idx]
+}
+
+// ReactorCPUs 每个sub reactor实际绑定的cpu，-1表示没有绑定
+func (e *Engine) ReactorCPUs() []int {
+	subs := e.reactorMain.acceptor.reactorSubs
+	cpus := make([]int, 0, len(subs))
+	for _, sub := range subs {
+		cpus = append(cpus, sub.BoundCPU())
+	}
+	return cpus
+}
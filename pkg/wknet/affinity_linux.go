@@ -0,0 +1,45 @@
+//go:build linux
+// +build linux
+
+package wknet
+
+import (
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// availableCPUs 进程可用的cpu
+func availableCPUs() []int {
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		return nil
+	}
+	cpus := make([]int, 0, set.Count())
+	for cpu := 0; len(cpus) < set.Count(); cpu++ {
+		if set.IsSet(cpu) {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus
+}
+
+// lockOSThreadToCPU 把当前goroutine锁定到线程并绑定到指定的cpu，返回的unlock恢复线程原来的cpu并解锁
+func lockOSThreadToCPU(cpu int) (unlock func(), err error) {
+	runtime.LockOSThread()
+	var old unix.CPUSet
+	if err = unix.SchedGetaffinity(0, &old); err != nil {
+		runtime.UnlockOSThread()
+		return nil, err
+	}
+	var set unix.CPUSet
+	set.Set(cpu)
+	if err = unix.SchedSetaffinity(0, &set); err != nil {
+		runtime.UnlockOSThread()
+		return nil, err
+	}
+	return func() {
+		_ = unix.SchedSetaffinity(0, &old) // 线程还给调度器前恢复，避免别的goroutine也被绑定
+		runtime.UnlockOSThread()
+	}, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package wknet
+
+import "errors"
+
+func availableCPUs() []int {
+	return nil
+}
+
+func lockOSThreadToCPU(cpu int) (unlock func(), err error) {
+	return nil, errors.New("cpu affinity is only supported on linux")
+}
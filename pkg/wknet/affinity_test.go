@@ -0,0 +1,130 @@
+package wknet
+
+import (
+	"flag"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -run none -bench BenchmarkEngineEcho -wknet.affinity=auto 对比绑定cpu前后的吞吐
+var benchAffinity = flag.String("wknet.affinity", "", "sub reactor cpu affinity for benchmarks: auto or 0,1,2")
+
+func TestParseCPUAffinity(t *testing.T) {
+	affinity, err := ParseCPUAffinity("")
+	assert.NoError(t, err)
+	assert.Nil(t, affinity)
+
+	affinity, err = ParseCPUAffinity("auto")
+	assert.NoError(t, err)
+	assert.True(t, affinity.Auto)
+
+	affinity, err = ParseCPUAffinity("0, 2,4")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 2, 4}, affinity.CPUs)
+
+	_, err = ParseCPUAffinity("0,a")
+	assert.Error(t, err)
+	_, err = ParseCPUAffinity("-1")
+	assert.Error(t, err)
+}
+
+func TestAssignReactorCPUs(t *testing.T) {
+	available := []int{0, 1, 2, 3}
+	assert.Equal(t, []int{-1, -1}, assignReactorCPUs(nil, 2, available))
+	assert.Equal(t, []int{0, 1, 2, 3, 0, 1}, assignReactorCPUs(&CPUAffinity{Auto: true}, 6, available))
+	assert.Equal(t, []int{3, 1, 3}, assignReactorCPUs(&CPUAffinity{CPUs: []int{3, 1}}, 3, available))
+	// 不支持的平台
+	assert.Equal(t, []int{-1, -1}, assignReactorCPUs(&CPUAffinity{Auto: true}, 2, nil))
+}
+
+func TestEngineReactorCPUAffinity(t *testing.T) {
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"), WithSubReactorNum(2), WithReactorCPUAffinity(&CPUAffinity{Auto: true}))
+	assert.NoError(t, e.Start())
+
+	expected := assignReactorCPUs(&CPUAffinity{Auto: true}, 2, availableCPUs())
+	if runtime.GOOS != "linux" {
+		expected = []int{-1, -1}
+	}
+	assert.Eventually(t, func() bool {
+		cpus := e.Stats().ReactorCPUs
+		return len(cpus) == 2 && cpus[0] == expected[0] && cpus[1] == expected[1]
+	}, time.Second, time.Millisecond*10)
+
+	assert.NoError(t, e.Stop())
+	assert.Eventually(t, func() bool {
+		cpus := e.ReactorCPUs()
+		return cpus[0] == -1 && cpus[1] == -1
+	}, time.Second, time.Millisecond*10)
+}
+
+func BenchmarkEngineEcho(b *testing.B) {
+	affinity, err := ParseCPUAffinity(*benchAffinity)
+	if err != nil {
+		b.Fatal(err)
+	}
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"), WithReactorCPUAffinity(affinity))
+	e.OnData(func(conn Conn) error {
+		buff, err := conn.Peek(-1)
+		if err != nil {
+			return err
+		}
+		_, _ = conn.Discard(len(buff))
+		_, err = conn.WriteToOutboundBuffer(buff)
+		if err != nil {
+			return err
+		}
+		return conn.WakeWrite()
+	})
+	if err := e.Start(); err != nil {
+		b.Fatal(err)
+	}
+	defer e.Stop()
+
+	const (
+		connNum = 64
+		msgSize = 512
+	)
+	conns := make([]net.Conn, 0, connNum)
+	for i := 0; i < connNum; i++ {
+		conn, err := net.Dial("tcp", e.TCPRealListenAddr().String())
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	b.Logf("reactor cpus: %v", e.Stats().ReactorCPUs)
+
+	msg := make([]byte, msgSize)
+	b.SetBytes(msgSize)
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		n := b.N / connNum
+		if i < b.N%connNum {
+			n++
+		}
+		wg.Add(1)
+		go func(conn net.Conn, n int) {
+			defer wg.Done()
+			resp := make([]byte, msgSize)
+			for j := 0; j < n; j++ {
+				if _, err := conn.Write(msg); err != nil {
+					b.Error(err)
+					return
+				}
+				if _, err := io.ReadFull(conn, resp); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}(conn, n)
+	}
+	wg.Wait()
+}
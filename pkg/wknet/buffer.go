@@ -1,16 +1,23 @@
 package wknet
 
+import "io"
+
 type Buffer interface {
 	// IsEmpty returns true if the buffer is empty.
 	IsEmpty() bool
 	// Write writes the data to the buffer.
 	Write(data []byte) (int, error)
+	// WriteV writes the multiple data segments to the buffer.
+	WriteV(bufs [][]byte) (int, error)
 	// Read reads the data from the buffer.
 	Read(data []byte) (int, error)
 	// BoundBufferSize returns the bound buffer size.
 	BoundBufferSize() int
 	// Peek returns the data from the buffer without removing it.
 	Peek(n int) (head []byte, tail []byte)
+	// PeekV returns the next n bytes as the ring's natural segments without copying and removing it,
+	// it returns all bytes when n <= 0.
+	PeekV(n int) ([][]byte, error)
 	PeekBytes(p []byte) int
 	// Discard discards the data from the buffer.
 	Discard(n int) (int, error)
@@ -43,6 +50,19 @@ func (d *DefualtBuffer) IsEmpty() bool {
 func (d *DefualtBuffer) Write(data []byte) (int, error) {
 	return d.ringBuffer.Write(data)
 }
+
+func (d *DefualtBuffer) WriteV(bufs [][]byte) (int, error) {
+	var total int
+	for _, buf := range bufs {
+		n, err := d.ringBuffer.Write(buf)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
 func (d *DefualtBuffer) Read(data []byte) (int, error) {
 	return d.ringBuffer.Read(data)
 }
@@ -54,19 +74,27 @@ func (d *DefualtBuffer) Peek(n int) (head []byte, tail []byte) {
 	return d.ringBuffer.Peek(n)
 }
 
-func (d *DefualtBuffer) PeekBytes(p []byte) int {
-	head, tail := d.ringBuffer.Peek(-1)
-	if len(head) > 0 && len(tail) > 0 {
-		return copy(p, append(head, tail...))
+func (d *DefualtBuffer) PeekV(n int) ([][]byte, error) {
+	if n > d.ringBuffer.Buffered() {
+		return nil, io.ErrShortBuffer
 	}
-
-	if len(head) > 0 {
-		return copy(p, head)
+	head, tail := d.ringBuffer.Peek(n)
+	if len(head) == 0 {
+		return nil, nil
+	}
+	if len(tail) == 0 {
+		return [][]byte{head}, nil
 	}
-	if len(tail) > 0 {
-		return copy(p, tail)
+	return [][]byte{head, tail}, nil
+}
+
+func (d *DefualtBuffer) PeekBytes(p []byte) int {
+	bufs, _ := d.PeekV(-1)
+	var n int
+	for _, buf := range bufs {
+		n += copy(p[n:], buf)
 	}
-	return 0
+	return n
 }
 
 func (d *DefualtBuffer) Discard(n int) (int, error) {
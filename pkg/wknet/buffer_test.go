@@ -0,0 +1,114 @@
+package wknet
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBufferPeekV(t *testing.T) {
+	buff := NewDefaultBuffer()
+	defer buff.Release()
+
+	bufs, err := buff.PeekV(-1)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(bufs))
+
+	n, err := buff.WriteV([][]byte{[]byte("hello"), nil, []byte(" world")})
+	assert.NoError(t, err)
+	assert.Equal(t, 11, n)
+
+	bufs, err = buff.PeekV(5)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), bytes.Join(bufs, nil))
+
+	_, err = buff.PeekV(12)
+	assert.Error(t, err)
+
+	p := make([]byte, 11)
+	assert.Equal(t, 11, buff.PeekBytes(p))
+	assert.Equal(t, []byte("hello world"), p)
+}
+
+// FuzzBufferVectored 交替执行V和非V操作，验证读出的数据流和写入的数据流一致
+func FuzzBufferVectored(f *testing.F) {
+	f.Add([]byte{0, 10, 1, 20, 2, 5, 3, 7, 4, 3})
+	f.Add([]byte{1, 255, 2, 200, 0, 255, 3, 0, 4, 100, 1, 128})
+	f.Fuzz(func(t *testing.T, script []byte) {
+		var (
+			buff     = NewDefaultBuffer()
+			expected []byte // 还在buffer里的数据
+			seq      byte
+		)
+		defer buff.Release()
+
+		nextData := func(n int) []byte {
+			data := make([]byte, n)
+			for i := range data {
+				data[i] = seq
+				seq++
+			}
+			return data
+		}
+		for i := 0; i+1 < len(script); i += 2 {
+			size := int(script[i+1])
+			switch script[i] % 5 {
+			case 0: // Write
+				data := nextData(size)
+				n, err := buff.Write(data)
+				if err != nil || n != len(data) {
+					t.Fatalf("write n:%d err:%v", n, err)
+				}
+				expected = append(expected, data...)
+			case 1: // WriteV
+				data := nextData(size)
+				split := size / 3
+				n, err := buff.WriteV([][]byte{data[:split], data[split : split*2], data[split*2:]})
+				if err != nil || n != len(data) {
+					t.Fatalf("writev n:%d err:%v", n, err)
+				}
+				expected = append(expected, data...)
+			case 2: // Read
+				p := make([]byte, size)
+				n, _ := buff.Read(p)
+				if n > len(expected) || !bytes.Equal(p[:n], expected[:n]) {
+					t.Fatalf("read mismatch")
+				}
+				expected = expected[n:]
+			case 3: // PeekV + Discard
+				if size > len(expected) {
+					size = len(expected)
+				}
+				if size == 0 {
+					continue
+				}
+				bufs, err := buff.PeekV(size)
+				if err != nil {
+					t.Fatalf("peekv err:%v", err)
+				}
+				if !bytes.Equal(bytes.Join(bufs, nil), expected[:size]) {
+					t.Fatalf("peekv mismatch")
+				}
+				n, _ := buff.Discard(size)
+				expected = expected[n:]
+			case 4: // Peek和PeekV结果一致
+				bufs, err := buff.PeekV(-1)
+				if err != nil {
+					t.Fatalf("peekv err:%v", err)
+				}
+				head, tail := buff.Peek(-1)
+				if !bytes.Equal(bytes.Join(bufs, nil), append(append([]byte{}, head...), tail...)) {
+					t.Fatalf("peek and peekv mismatch")
+				}
+			}
+			if buff.BoundBufferSize() != len(expected) {
+				t.Fatalf("size mismatch buffered:%d expected:%d", buff.BoundBufferSize(), len(expected))
+			}
+		}
+		bufs, _ := buff.PeekV(-1)
+		if !bytes.Equal(bytes.Join(bufs, nil), expected) {
+			t.Fatalf("final stream mismatch")
+		}
+	})
+}
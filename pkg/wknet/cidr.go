@@ -0,0 +1,242 @@
+package wknet
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// Listener 监听端口
+type Listener string
+
+const (
+	ListenerTCP Listener = "tcp" // tcp端口（包括tcp端口上的tls连接）
+	ListenerWS  Listener = "ws"  // websocket端口
+	ListenerWSS Listener = "wss" // websocket tls端口
+)
+
+var listeners = []Listener{ListenerTCP, ListenerWS, ListenerWSS}
+
+func (k connKind) listener() Listener {
+	switch k {
+	case connKindWS:
+		return ListenerWS
+	case connKindWSS:
+		return ListenerWSS
+	}
+	return ListenerTCP
+}
+
+// cidrTrie 按位存储的网段前缀树，ipv4统一转换为ipv4-mapped ipv6
+type cidrTrie struct {
+	root cidrNode
+}
+
+type cidrNode struct {
+	children [2]*cidrNode
+	end      bool // 从根到这里是一个网段
+}
+
+// newCIDRTrie 解析网段（也可以是单个ip），cidrs为空返回nil
+func newCIDRTrie(cidrs []string) (*cidrTrie, error) {
+	if len(cidrs) == 0 {
+		return nil, nil
+	}
+	t := &cidrTrie{}
+	for _, cidr := range cidrs {
+		prefix, err := parseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		t.insert(prefix)
+	}
+	return t, nil
+}
+
+func parseCIDR(cidr string) (netip.Prefix, error) {
+	cidr = strings.TrimSpace(cidr)
+	if !strings.Contains(cidr, "/") {
+		addr, err := netip.ParseAddr(cidr)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid cidr %q: %w", cidr, err)
+		}
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid cidr %q: %w", cidr, err)
+	}
+	return prefix, nil
+}
+
+func (t *cidrTrie) insert(prefix netip.Prefix) {
+	bits := prefix.Bits()
+	if prefix.Addr().Is4() {
+		bits += 96
+	}
+	addr := prefix.Addr().As16()
+	node := &t.root
+	for i := 0; i < bits; i++ {
+		if node.end { // 已经有更大的网段了
+			return
+		}
+		b := addrBit(addr, i)
+		if node.children[b] == nil {
+			node.children[b] = &cidrNode{}
+		}
+		node = node.children[b]
+	}
+	node.end = true
+	node.children = [2]*cidrNode{} // 被这个网段包含的小网段不需要了
+}
+
+func (t *cidrTrie) contains(addr netip.Addr) bool {
+	a := addr.As16()
+	node := &t.root
+	for i := 0; i < 128; i++ {
+		if node.end {
+			return true
+		}
+		node = node.children[addrBit(a, i)]
+		if node == nil {
+			return false
+		}
+	}
+	return node.end
+}
+
+func addrBit(addr [16]byte, i int) int {
+	return int(addr[i/8]>>(7-uint(i%8))) & 1
+}
+
+// cidrFilter 一个监听端口的网段过滤，deny优先
+type cidrFilter struct {
+	allow *cidrTrie // nil表示允许所有
+	deny  *cidrTrie
+}
+
+func newCIDRFilter(allow []string, deny []string) (*cidrFilter, error) {
+	allowTrie, err := newCIDRTrie(allow)
+	if err != nil {
+		return nil, err
+	}
+	denyTrie, err := newCIDRTrie(deny)
+	if err != nil {
+		return nil, err
+	}
+	if allowTrie == nil && denyTrie == nil {
+		return nil, nil
+	}
+	return &cidrFilter{allow: allowTrie, deny: denyTrie}, nil
+}
+
+func (f *cidrFilter) allowed(addr netip.Addr) bool {
+	if f.deny != nil && f.deny.contains(addr) {
+		return false
+	}
+	if f.allow != nil {
+		return f.allow.contains(addr)
+	}
+	return true
+}
+
+// cidrFilters 所有监听端口的网段过滤
+type cidrFilters struct {
+	mu      sync.RWMutex
+	filters map[Listener]*cidrFilter
+	denied  map[Listener]*atomic.Int64 // 被拒绝的连接数量，初始化后只读
+}
+
+func newCIDRFilters() *cidrFilters {
+	f := &cidrFilters{
+		filters: make(map[Listener]*cidrFilter),
+		denied:  make(map[Listener]*atomic.Int64, len(listeners)),
+	}
+	for _, l := range listeners {
+		f.denied[l] = atomic.NewInt64(0)
+	}
+	return f
+}
+
+// init 启动时解析配置，已经通过SetListenerCIDRs设置过的监听端口以设置的为准
+func (f *cidrFilters) init(opts *Options) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, l := range listeners {
+		if _, ok := f.filters[l]; ok {
+			continue
+		}
+		filter, err := newCIDRFilter(opts.AllowCIDRs[l], opts.DenyCIDRs[l])
+		if err != nil {
+			return fmt.Errorf("listener %s: %w", l, err)
+		}
+		f.filters[l] = filter
+	}
+	return nil
+}
+
+func (f *cidrFilters) set(l Listener, filter *cidrFilter) {
+	f.mu.Lock()
+	f.filters[l] = filter
+	f.mu.Unlock()
+}
+
+func (f *cidrFilters) allowed(l Listener, addr netip.Addr) bool {
+	f.mu.RLock()
+	filter := f.filters[l]
+	f.mu.RUnlock()
+	if filter == nil || filter.allowed(addr) {
+		return true
+	}
+	f.denied[l].Inc()
+	return false
+}
+
+func (f *cidrFilters) deniedCounts() map[Listener]int64 {
+	counts := make(map[Listener]int64, len(f.denied))
+	for l, count := range f.denied {
+		counts[l] = count.Load()
+	}
+	return counts
+}
+
+// SetListenerCIDRs 运行时修改监听端口允许和拒绝的网段（deny优先），allow为空表示允许所有，只对之后接收的连接生效
+func (e *Engine) SetListenerCIDRs(l Listener, allow []string, deny []string) error {
+	if _, ok := e.cidrFilters.denied[l]; !ok {
+		return fmt.Errorf("unknown listener %q", l)
+	}
+	filter, err := newCIDRFilter(allow, deny)
+	if err != nil {
+		return err
+	}
+	e.cidrFilters.set(l, filter)
+	e.Info("set listener cidrs", zap.String("listener", string(l)), zap.Strings("allow", allow), zap.Strings("deny", deny))
+	return nil
+}
+
+// DeniedAccepts 每个监听端口因为网段限制被拒绝的连接数量
+func (e *Engine) DeniedAccepts() map[Listener]int64 {
+	return e.cidrFilters.deniedCounts()
+}
+
+// acceptAllowed 接收连接后创建连接对象前判断远程地址是否允许连接
+func (e *Engine) acceptAllowed(kind connKind, remoteAddr net.Addr) bool {
+	tcpAddr, ok := remoteAddr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	addr, ok := netip.AddrFromSlice(tcpAddr.IP)
+	if !ok {
+		return true
+	}
+	if e.cidrFilters.allowed(kind.listener(), addr) {
+		return true
+	}
+	e.Debug("accept denied by cidr", zap.String("listener", string(kind.listener())), zap.String("remoteAddr", remoteAddr.String()))
+	return false
+}
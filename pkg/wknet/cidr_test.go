@@ -0,0 +1,137 @@
+package wknet
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCIDRFilter(t *testing.T) {
+	filter, err := newCIDRFilter(
+		[]string{"10.0.0.0/8", "10.1.0.0/16", "192.168.1.0/24", "2001:db8::/32", "172.16.0.1"},
+		[]string{"10.1.2.0/24", "::ffff:192.168.1.128/121", "2001:db8:1::/48"},
+	)
+	assert.NoError(t, err)
+	tests := []struct {
+		addr    string
+		allowed bool
+	}{
+		{"10.2.3.4", true},
+		{"10.1.3.4", true},
+		{"10.1.2.3", false}, // deny优先
+		{"::ffff:10.1.2.3", false},
+		{"::ffff:10.2.3.4", true},
+		{"192.168.1.1", true},
+		{"192.168.1.200", false},
+		{"192.168.2.1", false},
+		{"172.16.0.1", true},
+		{"172.16.0.2", false},
+		{"2001:db8::1", true},
+		{"2001:db8:1::1", false},
+		{"2001:db9::1", false},
+		{"127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.allowed, filter.allowed(netip.MustParseAddr(tt.addr)), tt.addr)
+	}
+
+	// 只有deny
+	filter, err = newCIDRFilter(nil, []string{"0.0.0.0/0"})
+	assert.NoError(t, err)
+	assert.False(t, filter.allowed(netip.MustParseAddr("8.8.8.8")))
+	assert.False(t, filter.allowed(netip.MustParseAddr("::ffff:8.8.8.8")))
+	assert.True(t, filter.allowed(netip.MustParseAddr("2001:db8::1")))
+
+	filter, err = newCIDRFilter(nil, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, filter)
+
+	_, err = newCIDRFilter([]string{"10.0.0.0/33"}, nil)
+	assert.Error(t, err)
+	_, err = newCIDRFilter(nil, []string{"abc"})
+	assert.Error(t, err)
+}
+
+func TestEngineCIDRs(t *testing.T) {
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"), WithAllowCIDRs(ListenerTCP, "10.0.0.0/8"))
+	var (
+		connectLock sync.Mutex
+		connected   int
+	)
+	e.OnConnect(func(conn Conn) error {
+		connectLock.Lock()
+		connected++
+		connectLock.Unlock()
+		return nil
+	})
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	// 被拒绝的连接会被直接关闭
+	denied := func() bool {
+		cli, err := net.Dial("tcp", e.TCPRealListenAddr().String())
+		if !assert.NoError(t, err) {
+			return false
+		}
+		defer cli.Close()
+		_ = cli.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+		_, err = cli.Read(make([]byte, 1))
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return false
+		}
+		return true
+	}
+	assert.True(t, denied())
+	assert.Equal(t, int64(1), e.DeniedAccepts()[ListenerTCP])
+	assert.Equal(t, int64(1), e.Stats().DeniedAccepts[ListenerTCP])
+
+	assert.NoError(t, e.SetListenerCIDRs(ListenerTCP, []string{"127.0.0.0/8"}, nil))
+	assert.False(t, denied())
+	assert.Error(t, e.SetListenerCIDRs(ListenerTCP, []string{"bad"}, nil))
+	assert.Error(t, e.SetListenerCIDRs(Listener("unknown"), nil, nil))
+
+	// 修改的同时接收连接
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if i%2 == 0 {
+				_ = e.SetListenerCIDRs(ListenerTCP, nil, []string{"127.0.0.1"})
+			} else {
+				_ = e.SetListenerCIDRs(ListenerTCP, nil, nil)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				cli, err := net.Dial("tcp", e.TCPRealListenAddr().String())
+				if err == nil {
+					cli.Close()
+				}
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond * 200)
+	close(stop)
+	wg.Wait()
+
+	assert.NoError(t, e.SetListenerCIDRs(ListenerTCP, []string{"127.0.0.1"}, []string{"127.0.0.0/8"}))
+	before := e.DeniedAccepts()[ListenerTCP]
+	assert.True(t, denied())
+	assert.Equal(t, before+1, e.DeniedAccepts()[ListenerTCP])
+}
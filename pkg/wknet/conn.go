@@ -1,11 +1,15 @@
 package wknet
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -26,6 +30,10 @@ type ConnStats struct {
 	OutMsgs  *atomic.Int64
 	InBytes  *atomic.Int64
 	OutBytes *atomic.Int64
+
+	LastTCPInfo atomic.Pointer[TCPInfo] // 最后一次采样的tcp链路质量（Options.TCPInfoSampleInterval）
+	// TLSState tls连接握手协商的版本和加密套件，握手完成前为nil
+	TLSState atomic.Pointer[ConnTLSState]
 }
 
 func NewConnStats() *ConnStats {
@@ -38,6 +46,30 @@ func NewConnStats() *ConnStats {
 	}
 }
 
+// maxProtoVersionHistory 每个连接最多保留的协议版本协商记录
+const maxProtoVersionHistory = 8
+
+// ProtoVersionChange 连接的协议版本协商记录
+type ProtoVersionChange struct {
+	Version int       `json:"version"`
+	At      time.Time `json:"at"`
+}
+
+func formatProtoVersionHistory(history []ProtoVersionChange) string {
+	var b strings.Builder
+	b.WriteString("[")
+	for i, change := range history {
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		b.WriteString(strconv.Itoa(change.Version))
+		b.WriteString("@")
+		b.WriteString(change.At.Format("15:04:05"))
+	}
+	b.WriteString("]")
+	return b.String()
+}
+
 type Conn interface {
 	// ID returns the connection id.
 	ID() int64
@@ -100,6 +132,12 @@ type Conn interface {
 	ProtoVersion() int
 	// SetProtoVersion sets message proto version
 	SetProtoVersion(version int)
+	// WriteStream writes the header and then the data of r to the outbound buffer chunk by chunk with flow control.
+	WriteStream(r io.Reader, frameHeader []byte, chunkSize int) error
+	// Go runs fn on a tracked goroutine, ctx is canceled when the connection is closed.
+	Go(fn func(ctx context.Context)) error
+	// ProtoVersionHistory returns the negotiated proto version history, the first one is the initial negotiated version.
+	ProtoVersionHistory() []ProtoVersionChange
 	// LastActivity returns the last activity time.
 	LastActivity() time.Time
 	// Uptime returns the connection uptime.
@@ -117,6 +155,16 @@ type Conn interface {
 
 	// ConnStats returns the connection stats.
 	ConnStats() *ConnStats
+	// TCPInfo returns the tcp link quality of the connection, only supported on linux.
+	TCPInfo() (*TCPInfo, error)
+	// CloseRead stops reading from the connection (buffered inbound data is discarded and OnData is no longer called), the write side keeps working until Close.
+	CloseRead() error
+	// IsReadClosed returns true if CloseRead has been called.
+	IsReadClosed() bool
+	// SetLifetimeExempt exempts the connection from Options.MaxConnLifetime, e.g. critical internal links.
+	SetLifetimeExempt(exempt bool)
+	// IsLifetimeExempt returns true if the connection is exempt from Options.MaxConnLifetime.
+	IsLifetimeExempt() bool
 }
 
 type IWSConn interface {
@@ -145,12 +193,44 @@ type DefaultConn struct {
 	valueMap       map[string]interface{}
 
 	uptime       time.Time
-	lastActivity time.Time
+	lastActivity atomic.Time // 每次读都会更新，不加锁
 	maxIdle      time.Duration
 	idleTimer    *timingwheel.Timer
 
 	connStats *ConnStats
 
+	netConn         *netConn    // 通过NetConnAdapter适配的net.Conn
+	netConnAttached atomic.Bool // 是否已适配为net.Conn，适配后数据不再回调OnData
+
+	handlerPanicCount atomic.Int32 // 事件回调panic的次数
+
+	readClosed  atomic.Bool // 调用了CloseRead，不再回调OnData
+	readPollOff atomic.Bool // 不再监听可读事件（tls连接还需要继续处理tls记录，不会设置）
+
+	decodePending atomic.Bool // OnData返回了ErrDecodePending，等待下一轮事件循环继续解码
+
+	protoVersionHistory atomic.Pointer[[]ProtoVersionChange] // 协议版本的协商记录（写时复制）
+
+	streamMu     sync.Mutex    // WriteStream依次写入
+	streamSignal chan struct{} // 输出缓冲区的数据发送出去了或连接关闭，唤醒WriteStream
+	streaming    atomic.Bool   // 是否有WriteStream在写入
+
+	goroutines *connGoroutines // 通过Go启动的goroutine
+
+	writeTrace atomic.Pointer[writeTrace] // 调试连接的写入跟踪，为nil表示不跟踪
+
+	deliveryLatency *connDeliveryLatency // 投递延迟的采样，没有开启DeliveryLatencySampleRate时为nil
+
+	lifetimeDeadline   atomic.Int64 // 超过最长存活时间的时间（unix nano，已加上抖动），0表示不限制
+	lifetimeNotifiedAt atomic.Int64 // 超过最长存活时间后回调OnLifetimeExceeded的时间（unix nano），0表示还没通知
+	lifetimeExempt     atomic.Bool  // 不受最长存活时间限制
+
+	// 以下由Engine.deviceStats.mu保护
+	deviceClass    uint16 // 计数的设备类型（deviceClassKey）
+	deviceCounted  bool   // 是否已经计入设备类型的统计
+	rolledInBytes  int64  // 已经汇总到设备类型统计的流入字节
+	rolledOutBytes int64  // 已经汇总到设备类型统计的流出字节
+
 	wklog.Log
 }
 
@@ -170,13 +250,35 @@ func GetDefaultConn(id int64, connFd NetFd, localAddr, remoteAddr net.Addr, eg *
 	defaultConn.reactorSub = reactorSub
 	defaultConn.valueMap = map[string]interface{}{}
 	defaultConn.context = nil
-	defaultConn.lastActivity = time.Now()
+	defaultConn.lastActivity.Store(time.Now())
 	defaultConn.uptime = time.Now()
 	defaultConn.Log = wklog.NewWKLog(fmt.Sprintf("Conn[[reactor-%d]%d]", reactorSub.idx, id))
 	defaultConn.connStats = NewConnStats()
+	defaultConn.netConn = nil
+	defaultConn.netConnAttached.Store(false)
+	defaultConn.handlerPanicCount.Store(0)
+	defaultConn.readClosed.Store(false)
+	defaultConn.readPollOff.Store(false)
+	defaultConn.decodePending.Store(false)
+	defaultConn.protoVersion = 0
+	defaultConn.protoVersionHistory.Store(nil)
+	defaultConn.streamSignal = nil
+	defaultConn.streaming.Store(false)
+	defaultConn.goroutines = nil
+	defaultConn.lifetimeDeadline.Store(eg.connLifetimeDeadline(defaultConn.uptime))
+	defaultConn.lifetimeNotifiedAt.Store(0)
+	defaultConn.lifetimeExempt.Store(false)
 
 	defaultConn.inboundBuffer = eg.eventHandler.OnNewInboundConn(defaultConn, eg)
-	defaultConn.outboundBuffer = eg.eventHandler.OnNewOutboundConn(defaultConn, eg)
+	defaultConn.outboundBuffer = newReactorOutboundBuffer(eg.eventHandler.OnNewOutboundConn(defaultConn, eg), reactorSub)
+	defaultConn.writeTrace.Store(nil)
+	defaultConn.deliveryLatency = nil
+	if eg.deliveryLatency != nil {
+		defaultConn.deliveryLatency = &connDeliveryLatency{}
+	}
+	if eg.isDebugConn(id) {
+		defaultConn.writeTrace.Store(newWriteTrace(0))
+	}
 
 	return defaultConn
 }
@@ -197,15 +299,23 @@ func CreateConn(id int64, connFd NetFd, localAddr, remoteAddr net.Addr, eg *Engi
 	// }
 
 	defaultConn := GetDefaultConn(id, connFd, localAddr, remoteAddr, eg, reactorSub)
-	if eg.options.TCPTLSConfig != nil {
-		tc := newTLSConn(defaultConn)
-		tlsCn := tls.Server(tc, eg.options.TCPTLSConfig)
-		tc.tlsconn = tlsCn
-		return tc, nil
+	if eg.tcpTLSEnabled() && eg.options.TLSMode == TLSModeRequired { // TLSModeOpportunistic下由acceptor判断是否是tls连接
+		return newTLSServerConn(defaultConn), nil
 	}
 	return defaultConn, nil
 }
 
+// CreateTLSConn 创建tcp端口的tls连接
+func CreateTLSConn(id int64, connFd NetFd, localAddr, remoteAddr net.Addr, eg *Engine, reactorSub *ReactorSub) (Conn, error) {
+	return newTLSServerConn(GetDefaultConn(id, connFd, localAddr, remoteAddr, eg, reactorSub)), nil
+}
+
+func newTLSServerConn(d *DefaultConn) *TLSConn {
+	tc := newTLSConn(d, ListenerTCP)
+	tc.tlsconn = tls.Server(tc, d.eg.tlsConfig(ListenerTCP))
+	return tc
+}
+
 func (d *DefaultConn) ID() int64 {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
@@ -224,18 +334,51 @@ func (d *DefaultConn) ReadToInboundBuffer() (int, error) {
 	if err != nil || n == 0 {
 		return 0, err
 	}
+	if d.netConnAttached.Load() {
+		return d.readToInboundBufferForNetConn(readBuffer[:n])
+	}
+	// 没有适配为net.Conn时输入缓冲区只在reactor的goroutine里读写，不需要加锁
 	if d.overflowForInbound(n) {
-		return 0, fmt.Errorf("inbound buffer overflow, fd: %d buffSize:%d n: %d currentSize: %d maxSize: %d", d.fd, d.inboundBuffer.BoundBufferSize(), n, d.inboundBuffer.BoundBufferSize()+n, d.eg.options.MaxReadBufferSize)
+		return 0, d.inboundOverflowError(n)
 	}
 	d.KeepLastActivity()
 	_, err = d.inboundBuffer.Write(readBuffer[:n])
+	d.debugRead(n, d.inboundBuffer.BoundBufferSize(), err)
 	return n, err
 }
 
-func (d *DefaultConn) KeepLastActivity() {
+// readToInboundBufferForNetConn netConn会在别的goroutine读取输入缓冲区，写入时需要加锁
+func (d *DefaultConn) readToInboundBufferForNetConn(data []byte) (int, error) {
 	d.mu.Lock()
-	defer d.mu.Unlock()
-	d.lastActivity = time.Now()
+	if d.overflowForInbound(len(data)) {
+		err := d.inboundOverflowError(len(data))
+		d.mu.Unlock()
+		return 0, err
+	}
+	d.KeepLastActivity()
+	_, err := d.inboundBuffer.Write(data)
+	inboundSize := d.inboundBuffer.BoundBufferSize()
+	nc := d.netConn
+	d.mu.Unlock()
+	if nc != nil {
+		nc.notifyRead()
+	}
+	d.debugRead(len(data), inboundSize, err)
+	return len(data), err
+}
+
+func (d *DefaultConn) inboundOverflowError(n int) error {
+	return fmt.Errorf("inbound buffer overflow, fd: %d buffSize:%d n: %d currentSize: %d maxSize: %d", d.fd, d.inboundBuffer.BoundBufferSize(), n, d.inboundBuffer.BoundBufferSize()+n, d.eg.options.MaxReadBufferSize)
+}
+
+func (d *DefaultConn) debugRead(n int, inboundSize int, err error) {
+	if d.eg.debugConnID.Load() != 0 && d.eg.isDebugConn(d.ID()) {
+		d.Info("debug conn read", zap.Int64("id", d.ID()), zap.Int("n", n), zap.Int("inboundSize", inboundSize), zap.Error(err))
+	}
+}
+
+func (d *DefaultConn) KeepLastActivity() {
+	d.lastActivity.Store(time.Now())
 }
 
 func (d *DefaultConn) Read(buf []byte) (int, error) {
@@ -273,7 +416,7 @@ func (d *DefaultConn) WriteToOutboundBuffer(b []byte) (int, error) {
 	}
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	return d.outboundBuffer.Write(b)
+	return d.writeOutbound(b)
 
 }
 
@@ -309,6 +452,11 @@ func (d *DefaultConn) closeNeedLock(closeErr error) error {
 		return nil
 	}
 	d.closed.Store(true)
+	d.decodePending.Store(false)
+
+	if d.eg.isDebugConn(d.id) {
+		d.Info("debug conn close", zap.Int64("id", d.id), zap.String("uid", d.uid), zap.String("deviceID", d.deviceID), zap.Error(closeErr))
+	}
 
 	if closeErr != nil && !errors.Is(closeErr, syscall.ECONNRESET) { // ECONNRESET表示fd已经关闭，不需要再次关闭
 		err := d.reactorSub.DeleteFd(d) // 先删除fd
@@ -317,11 +465,28 @@ func (d *DefaultConn) closeNeedLock(closeErr error) error {
 		}
 	}
 
-	_ = d.fd.Close()             // 后关闭fd
-	d.eg.RemoveConn(d)           // remove from the engine
-	d.reactorSub.ConnDec()       // decrease the connection count
-	d.mu.Unlock()                // 这里先解锁，避免OnClose中调用conn的方法导致死锁
-	d.eg.eventHandler.OnClose(d) // call the close handler
+	if d.netConn != nil { // 把还没读取的数据交给netConn，然后唤醒阻塞的读写
+		var pending []byte
+		if size := d.inboundBuffer.BoundBufferSize(); size > 0 {
+			pending = make([]byte, size)
+			_, _ = d.inboundBuffer.Read(pending)
+		}
+		d.netConn.notifyClosed(pending)
+	}
+	d.notifyStream()
+	d.closeGoroutines()
+	d.reactorSub.dirty.remove(d)
+
+	_ = d.fd.Close()       // 后关闭fd
+	d.eg.RemoveConn(d)     // remove from the engine
+	d.reactorSub.ConnDec() // decrease the connection count
+	d.mu.Unlock()          // 这里先解锁，避免OnClose中调用conn的方法导致死锁
+	// call the close handler
+	_ = d.eg.callHandler("OnClose", d, func() error {
+		d.eg.eventHandler.OnClose(d)
+		return nil
+	})
+	d.eg.emitConnEvent(EventConnClosed, d.id, d.localAddr, d.remoteAddr, closeErr)
 	d.mu.Lock()
 
 	d.release()
@@ -384,6 +549,9 @@ func (d *DefaultConn) release() {
 		d.Debug("outboundBuffer release error", zap.Error(err), zap.String("uid", d.uid), zap.String("deviceID", d.deviceID))
 	}
 
+	if d.netConnAttached.Load() || d.streaming.Load() || d.hasLiveGoroutines() { // netConn、WriteStream或Go启动的goroutine还持有此连接，不能放回池里复用
+		return
+	}
 	d.eg.defaultConnPool.Put(d)
 
 }
@@ -398,10 +566,14 @@ func (d *DefaultConn) Peek(n int) ([]byte, error) {
 	if d.inboundBuffer.IsEmpty() {
 		return nil, nil
 	}
-	head, tail := d.inboundBuffer.Peek(n)
+	bufs, err := d.inboundBuffer.PeekV(n)
+	if err != nil {
+		return nil, err
+	}
 	d.reactorSub.cache.Reset()
-	d.reactorSub.cache.Write(head)
-	d.reactorSub.cache.Write(tail)
+	for _, buf := range bufs {
+		d.reactorSub.cache.Write(buf)
+	}
 
 	data := d.reactorSub.cache.Bytes()
 	resultData := make([]byte, len(data)) // TODO: 这里考虑用sync.Pool
@@ -437,6 +609,9 @@ func (d *DefaultConn) IsAuthed() bool {
 func (d *DefaultConn) SetAuthed(authed bool) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
+	if authed && !d.authed {
+		d.eg.emitConnEvent(EventConnAuthed, d.id, d.localAddr, d.remoteAddr, nil)
+	}
 	d.authed = authed
 }
 
@@ -448,7 +623,26 @@ func (d *DefaultConn) ProtoVersion() int {
 func (d *DefaultConn) SetProtoVersion(version int) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
+	history := d.ProtoVersionHistory()
+	if len(history) > 0 && version < d.protoVersion {
+		d.Warn("proto version downgrade", zap.Int64("id", d.id), zap.String("uid", d.uid), zap.Int("from", d.protoVersion), zap.Int("to", version))
+	}
 	d.protoVersion = version
+	// 保留第一次协商的版本和最近的变化
+	if len(history) >= maxProtoVersionHistory {
+		history = append(history[:1], history[len(history)-maxProtoVersionHistory+2:]...)
+	}
+	history = append(history, ProtoVersionChange{Version: version, At: time.Now()})
+	d.protoVersionHistory.Store(&history)
+}
+
+// ProtoVersionHistory 协议版本的协商记录（第一个为第一次协商的版本），String()里会调用，所以不加锁
+func (d *DefaultConn) ProtoVersionHistory() []ProtoVersionChange {
+	history := d.protoVersionHistory.Load()
+	if history == nil {
+		return nil
+	}
+	return append(make([]ProtoVersionChange, 0, len(*history)+1), *history...)
 }
 
 func (d *DefaultConn) UID() string {
@@ -472,6 +666,9 @@ func (d *DefaultConn) SetDeviceFlag(deviceFlag uint8) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 	d.deviceFlag = deviceFlag
+	if d.eg != nil {
+		d.eg.deviceStats.reclassify(d)
+	}
 }
 
 func (d *DefaultConn) DeviceLevel() uint8 {
@@ -484,6 +681,9 @@ func (d *DefaultConn) SetDeviceLevel(deviceLevel uint8) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 	d.deviceLevel = deviceLevel
+	if d.eg != nil {
+		d.eg.deviceStats.reclassify(d)
+	}
 }
 
 func (d *DefaultConn) DeviceID() string {
@@ -517,9 +717,7 @@ func (d *DefaultConn) OutboundBuffer() OutboundBuffer {
 }
 
 func (d *DefaultConn) LastActivity() time.Time {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
-	return d.lastActivity
+	return d.lastActivity.Load()
 }
 
 func (d *DefaultConn) Uptime() time.Time {
@@ -546,10 +744,10 @@ func (d *DefaultConn) SetMaxIdle(maxIdle time.Duration) {
 		d.idleTimer = d.eg.Schedule(maxIdle/2, func() {
 			d.mu.Lock()
 			defer d.mu.Unlock()
-			if d.lastActivity.Add(maxIdle).After(time.Now()) {
+			if d.lastActivity.Load().Add(maxIdle).After(time.Now()) {
 				return
 			}
-			d.Debug("max idle time exceeded, close the connection", zap.Duration("maxIdle", maxIdle), zap.Duration("lastActivity", time.Since(d.lastActivity)), zap.String("conn", d.String()))
+			d.Debug("max idle time exceeded, close the connection", zap.Duration("maxIdle", maxIdle), zap.Duration("lastActivity", time.Since(d.lastActivity.Load())), zap.String("conn", d.String()))
 			if d.idleTimer != nil {
 				d.idleTimer.Stop()
 			}
@@ -565,26 +763,78 @@ func (d *DefaultConn) ConnStats() *ConnStats {
 	return d.connStats
 }
 
+// CloseRead 关闭读，不再监听可读事件，丢弃已经收到还没处理的数据，写不受影响（比如发送最后的通知后再Close）
+func (d *DefaultConn) CloseRead() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed.Load() {
+		return net.ErrClosed
+	}
+	if d.readClosed.Swap(true) {
+		return nil
+	}
+	_, _ = d.inboundBuffer.Discard(d.inboundBuffer.BoundBufferSize())
+	d.decodePending.Store(false)
+	d.readPollOff.Store(true)
+	return d.reactorSub.DisableRead(d, !d.outboundBuffer.IsEmpty())
+}
+
+func (d *DefaultConn) IsReadClosed() bool {
+	return d.readClosed.Load()
+}
+
+// discardInbound 丢弃输入缓冲区的数据
+func (d *DefaultConn) discardInbound() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, _ = d.inboundBuffer.Discard(d.inboundBuffer.BoundBufferSize())
+}
+
 func (d *DefaultConn) flush() error {
+	_, err := d.flushN(-1)
+	return err
+}
+
+// flushN 把输出缓冲区里最多max字节的数据写入fd，max<=0表示全部，返回写入的大小
+func (d *DefaultConn) flushN(max int) (int, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
 	if d.closed.Load() {
-		return net.ErrClosed
+		return 0, net.ErrClosed
 	}
 
 	if d.outboundBuffer.IsEmpty() {
 		_ = d.removeWriteIfExist()
-		return nil
+		return 0, nil
+	}
+	if max >= d.outboundBuffer.BoundBufferSize() {
+		max = -1
 	}
 	var (
 		n   int
 		err error
 	)
 
-	head, tail := d.outboundBuffer.Peek(-1)
-	n, err = d.writeDirect(head, tail)
-	_, _ = d.outboundBuffer.Discard(n)
+	if t := d.writeTrace.Load(); t != nil {
+		n, err = d.flushTraced(t, max)
+	} else {
+		bufs, _ := d.outboundBuffer.PeekV(max)
+		n, err = d.writeDirectV(bufs)
+		_, _ = d.outboundBuffer.Discard(n)
+	}
+	if n > 0 {
+		if d.deliveryLatency != nil {
+			d.deliveryLatency.flush(d, n)
+		}
+		if d.netConn != nil {
+			d.netConn.notifyWrite()
+		}
+		d.notifyStream()
+	}
+	if d.eg.isDebugConn(d.id) {
+		d.Info("debug conn flush", zap.Int64("id", d.id), zap.String("uid", d.uid), zap.Int("n", n), zap.Int("outboundSize", d.outboundBuffer.BoundBufferSize()), zap.Error(err))
+	}
 	switch err {
 	case nil:
 	case syscall.EAGAIN:
@@ -596,7 +846,7 @@ func (d *DefaultConn) flush() error {
 		d.mu.Lock()
 		if err != nil {
 			d.Error("failed to close conn", zap.Error(err), zap.String("uid", d.uid), zap.String("deviceID", d.deviceID))
-			return err
+			return n, err
 		}
 	}
 	// All data have been drained, it's no need to monitor the writable events,
@@ -604,8 +854,7 @@ func (d *DefaultConn) flush() error {
 	if d.outboundBuffer.IsEmpty() {
 		_ = d.removeWriteIfExist()
 	}
-	return nil
-
+	return n, nil
 }
 
 func (d *DefaultConn) WriteDirect(head, tail []byte) (int, error) {
@@ -618,20 +867,26 @@ func (d *DefaultConn) writeDirect(head, tail []byte) (int, error) {
 	if d.closed.Load() {
 		return -1, net.ErrClosed
 	}
-	var (
-		n   int
-		err error
-	)
-	if len(head) > 0 && len(tail) > 0 {
-		n, err = d.fd.Write(append(head, tail...))
-	} else {
-		if len(head) > 0 {
-			n, err = d.fd.Write(head)
-		} else if len(tail) > 0 {
-			n, err = d.fd.Write(tail)
+	if len(tail) == 0 {
+		if len(head) == 0 {
+			return 0, nil
 		}
+		return d.fd.Write(head)
 	}
-	return n, err
+	if len(head) == 0 {
+		return d.fd.Write(tail)
+	}
+	return d.fd.Writev([][]byte{head, tail})
+}
+
+func (d *DefaultConn) writeDirectV(bufs [][]byte) (int, error) {
+	if d.closed.Load() {
+		return -1, net.ErrClosed
+	}
+	if len(bufs) == 1 {
+		return d.fd.Write(bufs[0])
+	}
+	return d.fd.Writev(bufs)
 }
 
 func (d *DefaultConn) write(b []byte) (int, error) {
@@ -645,8 +900,7 @@ func (d *DefaultConn) write(b []byte) (int, error) {
 	if d.overflowForOutbound(len(b)) { // overflow check
 		return 0, syscall.EINVAL
 	}
-	var err error
-	n, err = d.outboundBuffer.Write(b)
+	n, err := d.writeOutbound(b)
 	if err != nil {
 		return 0, err
 	}
@@ -683,22 +937,40 @@ func (d *DefaultConn) overflowForInbound(n int) bool {
 	return maxReadBufferSize > 0 && (d.inboundBuffer.BoundBufferSize()+n > maxReadBufferSize)
 }
 
+// underlyingConn 返回连接底层的DefaultConn，自定义的连接返回nil
+func underlyingConn(conn Conn) *DefaultConn {
+	switch c := conn.(type) {
+	case *DefaultConn:
+		return c
+	case *WSConn:
+		return c.DefaultConn
+	case *TLSConn:
+		return c.d
+	case *WSSConn:
+		return c.d
+	}
+	return nil
+}
+
 func (d *DefaultConn) String() string {
 
-	return fmt.Sprintf("Conn[%d] uid=%s fd=%d deviceFlag=%s deviceLevel=%s deviceID=%s", d.id, d.uid, d.fd, wkproto.DeviceFlag(d.deviceFlag), wkproto.DeviceLevel(d.deviceLevel), d.deviceID)
+	return fmt.Sprintf("Conn[%d] uid=%s fd=%d deviceFlag=%s deviceLevel=%s deviceID=%s protoVersions=%s", d.id, d.uid, d.fd, wkproto.DeviceFlag(d.deviceFlag), wkproto.DeviceLevel(d.deviceLevel), d.deviceID, formatProtoVersionHistory(d.ProtoVersionHistory()))
 }
 
 type TLSConn struct {
 	d                *DefaultConn
 	tlsconn          *tls.Conn
 	tmpInboundBuffer InboundBuffer // inboundBuffer InboundBuffer
+	listener         Listener      // 所在的监听端口（ListenerTCP或ListenerWSS）
+	handshakeDone    bool          // 已经记录过握手的结果，只在连接的reactor里使用
 }
 
-func newTLSConn(d *DefaultConn) *TLSConn {
+func newTLSConn(d *DefaultConn, listener Listener) *TLSConn {
 
 	return &TLSConn{
 		d:                d,
 		tmpInboundBuffer: d.eg.eventHandler.OnNewInboundConn(d, d.eg),
+		listener:         listener,
 	}
 }
 
@@ -716,6 +988,7 @@ func (t *TLSConn) ReadToInboundBuffer() (int, error) {
 
 	for {
 		tlsN, err := t.tlsconn.Read(readBuffer) // 这里其实是把tmpInboundBuffer的数据解密后放到readBuffer内了
+		t.afterTLSRead(err)
 		if err != nil {
 			if err == tls.ErrDataNotEnough {
 				return n, nil
@@ -875,6 +1148,10 @@ func (t *TLSConn) SetProtoVersion(version int) {
 	t.d.SetProtoVersion(version)
 }
 
+func (t *TLSConn) ProtoVersionHistory() []ProtoVersionChange {
+	return t.d.ProtoVersionHistory()
+}
+
 func (t *TLSConn) ReactorSub() *ReactorSub {
 	return t.d.ReactorSub()
 }
@@ -896,7 +1173,7 @@ func (t *TLSConn) Uptime() time.Time {
 }
 
 func (t *TLSConn) WriteToOutboundBuffer(b []byte) (int, error) {
-	return t.d.outboundBuffer.Write(b)
+	return t.d.writeOutbound(b)
 }
 
 func (t *TLSConn) SetMaxIdle(maxIdle time.Duration) {
@@ -907,6 +1184,31 @@ func (t *TLSConn) ConnStats() *ConnStats {
 	return t.d.connStats
 }
 
+func (t *TLSConn) TCPInfo() (*TCPInfo, error) {
+	return t.d.TCPInfo()
+}
+
+// CloseRead tls连接关闭读后继续读取和处理tls记录（握手等），只丢弃解密后的应用数据，不再回调OnData
+func (t *TLSConn) CloseRead() error {
+	if t.d.closed.Load() {
+		return net.ErrClosed
+	}
+	t.d.readClosed.Store(true) // 已经收到的应用数据在reactor下次读取时丢弃
+	return nil
+}
+
+func (t *TLSConn) IsReadClosed() bool {
+	return t.d.readClosed.Load()
+}
+
+func (t *TLSConn) SetLifetimeExempt(exempt bool) {
+	t.d.SetLifetimeExempt(exempt)
+}
+
+func (t *TLSConn) IsLifetimeExempt() bool {
+	return t.d.IsLifetimeExempt()
+}
+
 func (t *TLSConn) String() string {
 	return t.d.String()
 }
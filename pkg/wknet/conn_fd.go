@@ -0,0 +1,29 @@
+//go:build linux || freebsd || dragonfly || darwin
+// +build linux freebsd dragonfly darwin
+
+package wknet
+
+import (
+	"os"
+
+	"github.com/WuKongIM/WuKongIM/pkg/socket"
+	"golang.org/x/sys/unix"
+)
+
+// AddConnFd 把已经建立好的socket（比如syscall.Socketpair的一端）作为连接交给引擎管理，需要在Start后调用
+// 和accept的连接一样调用OnNewConn和OnConnect，添加到sub reactor，统计和关闭的处理也相同
+// 成功后fd归引擎所有，连接关闭时关闭fd；失败时fd可能已经被关闭，调用方不要再使用
+func (e *Engine) AddConnFd(fd int) (Conn, error) {
+	if err := os.NewSyscallError("fcntl nonblock", unix.SetNonblock(fd, true)); err != nil {
+		return nil, err
+	}
+	localSa, err := unix.Getsockname(fd)
+	if err != nil {
+		return nil, os.NewSyscallError("getsockname", err)
+	}
+	remoteSa, err := unix.Getpeername(fd)
+	if err != nil {
+		return nil, os.NewSyscallError("getpeername", err)
+	}
+	return e.reactorMain.acceptor.registerConn(fd, socket.SockaddrToTCPOrUnixAddr(localSa), socket.SockaddrToTCPOrUnixAddr(remoteSa), connKindTCP)
+}
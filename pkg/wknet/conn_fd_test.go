@@ -0,0 +1,105 @@
+//go:build linux || freebsd || dragonfly || darwin
+// +build linux freebsd dragonfly darwin
+
+package wknet
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestEngineAddConnFd(t *testing.T) {
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"))
+	connected := make(chan Conn, 1)
+	closed := make(chan Conn, 1)
+	e.OnConnect(func(conn Conn) error {
+		connected <- conn
+		return nil
+	})
+	e.OnData(func(conn Conn) error {
+		buff, err := conn.Peek(-1)
+		if err != nil {
+			return err
+		}
+		_, _ = conn.Discard(len(buff))
+		_, err = conn.WriteToOutboundBuffer(buff)
+		if err != nil {
+			return err
+		}
+		return conn.WakeWrite()
+	})
+	e.OnClose(func(conn Conn) {
+		closed <- conn
+	})
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	assert.NoError(t, err)
+	conn, err := e.AddConnFd(fds[0])
+	assert.NoError(t, err)
+	assert.Equal(t, conn, <-connected)
+	assert.Equal(t, 1, e.ConnCount())
+	assert.Equal(t, conn, e.GetConn(fds[0]))
+
+	// 另一端作为客户端收发数据，FileConn会复制fd
+	f := os.NewFile(uintptr(fds[1]), "socketpair")
+	cli, err := net.FileConn(f)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	defer cli.Close()
+	_, err = cli.Write([]byte("hello"))
+	assert.NoError(t, err)
+	_ = cli.SetReadDeadline(time.Now().Add(time.Second * 2))
+	resp := make([]byte, 5)
+	_, err = io.ReadFull(cli, resp)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(resp))
+
+	// 客户端关闭后和accept的连接一样关闭
+	assert.NoError(t, cli.Close())
+	select {
+	case c := <-closed:
+		assert.Equal(t, conn, c)
+	case <-time.After(time.Second * 2):
+		t.Fatal("conn not closed")
+	}
+	assert.Equal(t, 0, e.ConnCount())
+}
+
+func TestEngineUnixListener(t *testing.T) {
+	path := t.TempDir() + "/wknet.sock"
+	e := NewEngine(WithAddr("unix://" + path))
+	e.OnData(func(conn Conn) error {
+		buff, err := conn.Peek(-1)
+		if err != nil {
+			return err
+		}
+		_, _ = conn.Discard(len(buff))
+		_, err = conn.WriteToOutboundBuffer(buff)
+		if err != nil {
+			return err
+		}
+		return conn.WakeWrite()
+	})
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+	assert.Equal(t, path, e.TCPRealListenAddr().String())
+
+	cli, err := net.Dial("unix", path)
+	assert.NoError(t, err)
+	defer cli.Close()
+	_, err = cli.Write([]byte("hello"))
+	assert.NoError(t, err)
+	_ = cli.SetReadDeadline(time.Now().Add(time.Second * 2))
+	resp := make([]byte, 5)
+	_, err = io.ReadFull(cli, resp)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(resp))
+}
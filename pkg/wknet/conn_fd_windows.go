@@ -0,0 +1,8 @@
+package wknet
+
+import perrors "github.com/WuKongIM/WuKongIM/pkg/errors"
+
+// AddConnFd windows不支持
+func (e *Engine) AddConnFd(fd int) (Conn, error) {
+	return nil, perrors.ErrUnsupportedPlatform
+}
@@ -6,10 +6,12 @@ import (
 	"crypto/tls"
 	"fmt"
 	"io"
+	"net"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/WuKongIM/WuKongIM/pkg/wklog"
 	stls "github.com/WuKongIM/crypto/tls"
 
 	"github.com/stretchr/testify/assert"
@@ -49,6 +51,30 @@ func TestConn(t *testing.T) {
 	time.Sleep(time.Second * 1)
 }
 
+func TestConnProtoVersionHistory(t *testing.T) {
+	conn := &DefaultConn{id: 1, uid: "u1", Log: wklog.NewWKLog("test")}
+	assert.Equal(t, 0, len(conn.ProtoVersionHistory()))
+
+	conn.SetProtoVersion(4)
+	conn.SetProtoVersion(3) // 降级
+	history := conn.ProtoVersionHistory()
+	assert.Equal(t, 2, len(history))
+	assert.Equal(t, 4, history[0].Version)
+	assert.Equal(t, 3, history[1].Version)
+	assert.Equal(t, 3, conn.ProtoVersion())
+	assert.Contains(t, conn.String(), "protoVersions=[4@")
+
+	// 超过上限后保留第一次协商的版本和最近的变化
+	for i := 0; i < maxProtoVersionHistory*2; i++ {
+		conn.SetProtoVersion(10 + i)
+	}
+	history = conn.ProtoVersionHistory()
+	assert.Equal(t, maxProtoVersionHistory, len(history))
+	assert.Equal(t, 4, history[0].Version)
+	assert.Equal(t, 10+maxProtoVersionHistory*2-1, history[len(history)-1].Version)
+	assert.Equal(t, 10+maxProtoVersionHistory*2-maxProtoVersionHistory+1, history[1].Version)
+}
+
 func TestTlsConn(t *testing.T) {
 	cert, err := stls.X509KeyPair(rsaCertPEM, rsaKeyPEM)
 	if err != nil {
@@ -241,3 +267,72 @@ Mr+u5TRncZBIzAZtButlh1AHnpN/qO3P0c0Rbdep3XBc/82JWO8qdb5QvAkxga3X
 BpA7MNLxiqss+rCbwf3NbWxEMiDQ2zRwVoafVFys7tjmv6t2Xck=
 -----END RSA PRIVATE KEY-----
 `)
+
+func testConnCloseRead(t *testing.T, e *Engine, dial func() (net.Conn, error)) {
+	connected := make(chan Conn, 1)
+	received := make(chan string, 10)
+	e.OnConnect(func(conn Conn) error {
+		connected <- conn
+		return nil
+	})
+	e.OnData(func(conn Conn) error {
+		data, _ := conn.Peek(-1)
+		if len(data) == 0 { // tls握手
+			return nil
+		}
+		_, _ = conn.Discard(len(data))
+		received <- string(data)
+		return nil
+	})
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	cli, err := dial()
+	assert.NoError(t, err)
+	defer cli.Close()
+	_, err = cli.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", <-received)
+	conn := <-connected
+
+	assert.False(t, conn.IsReadClosed())
+	assert.NoError(t, conn.CloseRead())
+	assert.True(t, conn.IsReadClosed())
+	assert.NoError(t, conn.CloseRead())
+
+	// 关闭读后收到的数据不再回调OnData，写不受影响
+	_, err = cli.Write([]byte("ignored"))
+	assert.NoError(t, err)
+	_, err = conn.Write([]byte("bye"))
+	assert.NoError(t, err)
+	buf := make([]byte, 3)
+	assert.NoError(t, cli.SetReadDeadline(time.Now().Add(time.Second*5)))
+	_, err = io.ReadFull(cli, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "bye", string(buf))
+	select {
+	case data := <-received:
+		t.Fatalf("unexpected OnData after CloseRead: %s", data)
+	case <-time.After(time.Millisecond * 100):
+	}
+	assert.Equal(t, 0, conn.InboundBuffer().BoundBufferSize())
+
+	assert.NoError(t, conn.Close())
+	assert.ErrorIs(t, conn.CloseRead(), net.ErrClosed)
+}
+
+func TestConnCloseRead(t *testing.T) {
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"))
+	testConnCloseRead(t, e, func() (net.Conn, error) {
+		return net.Dial("tcp", e.TCPRealListenAddr().String())
+	})
+}
+
+func TestTLSConnCloseRead(t *testing.T) {
+	cert, err := stls.X509KeyPair(rsaCertPEM, rsaKeyPEM)
+	assert.NoError(t, err)
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"), WithTCPTLSConfig(&stls.Config{Certificates: []stls.Certificate{cert}}))
+	testConnCloseRead(t, e, func() (net.Conn, error) {
+		return tls.Dial("tcp", e.TCPRealListenAddr().String(), &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	})
+}
@@ -0,0 +1,37 @@
+package wknet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEngineSetDebugConn(t *testing.T) {
+	e := NewEngine(WithDebugExpire(time.Millisecond * 50))
+
+	// 设置后生效，只对指定的连接
+	e.SetDebugConn(10)
+	assert.True(t, e.isDebugConn(10))
+	assert.False(t, e.isDebugConn(11))
+	status := e.DebugStatus()
+	assert.Equal(t, int64(10), status.DebugConnID)
+	assert.Equal(t, time.Millisecond*50, status.DebugExpire)
+	assert.Greater(t, status.DebugConnExpireAt, time.Now().UnixNano())
+
+	// 过期后自动关闭
+	assert.Eventually(t, func() bool { return !e.isDebugConn(10) }, time.Second, time.Millisecond*10)
+	assert.Equal(t, EngineDebugStatus{DebugExpire: time.Millisecond * 50}, e.DebugStatus())
+
+	// 切换到其他连接，原来的连接不再调试
+	e.SetDebugConn(10)
+	e.SetDebugConn(11)
+	assert.False(t, e.isDebugConn(10))
+	assert.True(t, e.isDebugConn(11))
+
+	// id为0表示关闭
+	e.SetDebugConn(0)
+	assert.False(t, e.isDebugConn(11))
+	assert.False(t, e.isDebugConn(0))
+	assert.Equal(t, EngineDebugStatus{DebugExpire: time.Millisecond * 50}, e.DebugStatus())
+}
@@ -0,0 +1,22 @@
+package wknet
+
+import "errors"
+
+// ErrDecodePending OnData解码了MaxFramesPerDecode个帧后输入缓冲区里还有完整的帧时返回（不会关闭连接）
+// 连接被标记为等待解码，下一轮事件循环再次回调OnData继续解码，不需要等客户端发送新的数据
+var ErrDecodePending = errors.New("decode pending")
+
+// MaxFramesPerDecode 每次回调OnData最多解码的帧数量，0表示不限制
+func (e *Engine) MaxFramesPerDecode() int {
+	return e.options.MaxFramesPerDecode
+}
+
+// DecodeRevisits 因为OnData返回ErrDecodePending在下一轮事件循环再次回调OnData的次数
+func (e *Engine) DecodeRevisits() int64 {
+	return e.decodeRevisits.Load()
+}
+
+// IsDecodePending 连接是否在等待下一轮事件循环继续解码
+func (d *DefaultConn) IsDecodePending() bool {
+	return d.decodePending.Load()
+}
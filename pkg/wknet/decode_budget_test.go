@@ -0,0 +1,130 @@
+package wknet
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEngineMaxFramesPerDecode(t *testing.T) {
+	const (
+		frameSize = 4
+		maxFrames = 10
+		burst     = 1000
+	)
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"), WithSubReactorNum(1), WithMaxFramesPerDecode(maxFrames))
+	var (
+		mu        sync.Mutex
+		seqs      []uint32
+		maxDecode int
+		burstDone bool
+	)
+	other := make(chan bool, 1) // 另一个连接的帧是否在突发的帧解码完之前收到
+	e.OnData(func(conn Conn) error {
+		data, _ := conn.Peek(-1)
+		if len(data) > 0 && data[0] == 0xff { // 另一个连接
+			_, _ = conn.Discard(len(data))
+			mu.Lock()
+			other <- !burstDone
+			mu.Unlock()
+			return nil
+		}
+		count := 0
+		mu.Lock()
+		for len(data) >= frameSize && count < e.MaxFramesPerDecode() {
+			seqs = append(seqs, binary.BigEndian.Uint32(data))
+			data = data[frameSize:]
+			count++
+		}
+		if count > maxDecode {
+			maxDecode = count
+		}
+		burstDone = len(seqs) == burst
+		mu.Unlock()
+		_, _ = conn.Discard(count * frameSize)
+		time.Sleep(time.Millisecond) // 每次解码都有耗时，不限制时其他连接要等所有帧解码完
+		if len(data) >= frameSize {
+			return ErrDecodePending
+		}
+		return nil
+	})
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	cli, err := net.Dial("tcp", e.TCPRealListenAddr().String())
+	assert.NoError(t, err)
+	defer cli.Close()
+	otherCli, err := net.Dial("tcp", e.TCPRealListenAddr().String())
+	assert.NoError(t, err)
+	defer otherCli.Close()
+	time.Sleep(time.Millisecond * 50)
+
+	data := make([]byte, 0, burst*frameSize)
+	for i := 0; i < burst; i++ {
+		data = binary.BigEndian.AppendUint32(data, uint32(i))
+	}
+	_, err = cli.Write(data)
+	assert.NoError(t, err)
+	time.Sleep(time.Millisecond * 10)
+	_, err = otherCli.Write([]byte{0xff})
+	assert.NoError(t, err)
+
+	// 突发的帧分多轮解码，另一个连接不需要等它们都解码完
+	select {
+	case beforeBurstDone := <-other:
+		assert.True(t, beforeBurstDone)
+	case <-time.After(time.Second * 5):
+		t.Fatal("other conn not served")
+	}
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(seqs) == burst
+	}, time.Second*10, time.Millisecond*10)
+	mu.Lock()
+	defer mu.Unlock()
+	for i, seq := range seqs {
+		if !assert.Equal(t, uint32(i), seq) {
+			break
+		}
+	}
+	assert.LessOrEqual(t, maxDecode, maxFrames)
+	assert.Greater(t, e.DecodeRevisits(), int64(0))
+	assert.Equal(t, e.DecodeRevisits(), e.Stats().DecodeRevisits)
+}
+
+func TestDecodePendingClearedOnClose(t *testing.T) {
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"), WithMaxFramesPerDecode(1))
+	accepted := make(chan Conn, 1)
+	e.OnConnect(func(conn Conn) error {
+		accepted <- conn
+		return nil
+	})
+	calls := make(chan struct{}, 10)
+	e.OnData(func(conn Conn) error {
+		calls <- struct{}{}
+		_ = conn.Close() // 关闭后不再继续解码
+		return ErrDecodePending
+	})
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	cli, err := net.Dial("tcp", e.TCPRealListenAddr().String())
+	assert.NoError(t, err)
+	defer cli.Close()
+	conn := <-accepted
+	_, err = cli.Write([]byte{1, 2, 3})
+	assert.NoError(t, err)
+	<-calls
+
+	time.Sleep(time.Millisecond * 50)
+	assert.Len(t, calls, 0)
+	assert.True(t, conn.IsClosed())
+	assert.False(t, underlyingConn(conn).IsDecodePending())
+	assert.Equal(t, int64(0), e.DecodeRevisits())
+}
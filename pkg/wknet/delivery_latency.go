@@ -0,0 +1,233 @@
+package wknet
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// deliveryLatencyBuckets 投递延迟直方图每个桶的上限（包含），超过最大上限的记在最后一个桶
+var deliveryLatencyBuckets = []time.Duration{
+	time.Microsecond * 100,
+	time.Microsecond * 250,
+	time.Microsecond * 500,
+	time.Millisecond,
+	time.Microsecond * 2500,
+	time.Millisecond * 5,
+	time.Millisecond * 10,
+	time.Millisecond * 25,
+	time.Millisecond * 50,
+	time.Millisecond * 100,
+	time.Millisecond * 250,
+	time.Millisecond * 500,
+	time.Second,
+	time.Millisecond * 2500,
+	time.Second * 5,
+	time.Second * 10,
+}
+
+// maxDeliveryLatencyMarks 每个连接最多等待写入fd的采样数量，超过后不再采样（输出缓冲区堆积时避免无限增长）
+const maxDeliveryLatencyMarks = 1024
+
+// DeliveryLatencyBucket 投递延迟直方图的一个桶
+type DeliveryLatencyBucket struct {
+	UpperBound time.Duration `json:"upper_bound"` // 桶的上限（包含），0表示超过最大上限
+	Count      int64         `json:"count"`
+}
+
+// DeliveryLatencyHistogram 投递延迟（写入输出缓冲区到完全写入fd的时间）的直方图
+type DeliveryLatencyHistogram struct {
+	Count   int64                   `json:"count"` // 采样数量
+	Sum     time.Duration           `json:"sum"`   // 采样延迟的总和
+	Buckets []DeliveryLatencyBucket `json:"buckets"`
+}
+
+// Quantile 第q（0到1）分位的延迟，返回所在桶的上限（超过最大上限时返回最大上限），没有采样返回0
+func (h DeliveryLatencyHistogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	target := int64(q * float64(h.Count))
+	if target < 1 {
+		target = 1
+	}
+	var count int64
+	for _, bucket := range h.Buckets {
+		count += bucket.Count
+		if count >= target {
+			if bucket.UpperBound == 0 {
+				break
+			}
+			return bucket.UpperBound
+		}
+	}
+	return deliveryLatencyBuckets[len(deliveryLatencyBuckets)-1]
+}
+
+// DeliveryLatencyStats 投递延迟的统计，见Options.DeliveryLatencySampleRate
+type DeliveryLatencyStats struct {
+	SampleRate   float64                            `json:"sample_rate"`
+	All          DeliveryLatencyHistogram           `json:"all"`
+	ByDeviceFlag map[uint8]DeliveryLatencyHistogram `json:"by_device_flag"` // 按写入fd时连接的设备标记
+}
+
+type latencyHistogram struct {
+	counts []atomic.Int64 // 和deliveryLatencyBuckets对应，多一个超过最大上限的桶
+	count  atomic.Int64
+	sum    atomic.Int64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{
+		counts: make([]atomic.Int64, len(deliveryLatencyBuckets)+1),
+	}
+}
+
+func (h *latencyHistogram) observe(latency time.Duration) {
+	idx := sort.Search(len(deliveryLatencyBuckets), func(i int) bool {
+		return deliveryLatencyBuckets[i] >= latency
+	})
+	h.counts[idx].Inc()
+	h.count.Inc()
+	h.sum.Add(int64(latency))
+}
+
+func (h *latencyHistogram) snapshot() DeliveryLatencyHistogram {
+	histogram := DeliveryLatencyHistogram{
+		Count:   h.count.Load(),
+		Sum:     time.Duration(h.sum.Load()),
+		Buckets: make([]DeliveryLatencyBucket, len(h.counts)),
+	}
+	for i := range h.counts {
+		if i < len(deliveryLatencyBuckets) {
+			histogram.Buckets[i].UpperBound = deliveryLatencyBuckets[i]
+		}
+		histogram.Buckets[i].Count = h.counts[i].Load()
+	}
+	return histogram
+}
+
+// deliveryLatencyStats 引擎的投递延迟直方图，DeliveryLatencySampleRate<=0时为nil
+type deliveryLatencyStats struct {
+	sampleRate   float64
+	all          *latencyHistogram
+	mu           sync.RWMutex
+	byDeviceFlag map[uint8]*latencyHistogram
+}
+
+func newDeliveryLatencyStats(sampleRate float64) *deliveryLatencyStats {
+	if sampleRate <= 0 {
+		return nil
+	}
+	return &deliveryLatencyStats{
+		sampleRate:   sampleRate,
+		all:          newLatencyHistogram(),
+		byDeviceFlag: make(map[uint8]*latencyHistogram),
+	}
+}
+
+func (s *deliveryLatencyStats) sample() bool {
+	return s.sampleRate >= 1 || rand.Float64() < s.sampleRate
+}
+
+func (s *deliveryLatencyStats) observe(deviceFlag uint8, latency time.Duration) {
+	s.all.observe(latency)
+	s.mu.RLock()
+	h := s.byDeviceFlag[deviceFlag]
+	s.mu.RUnlock()
+	if h == nil {
+		s.mu.Lock()
+		if h = s.byDeviceFlag[deviceFlag]; h == nil {
+			h = newLatencyHistogram()
+			s.byDeviceFlag[deviceFlag] = h
+		}
+		s.mu.Unlock()
+	}
+	h.observe(latency)
+}
+
+func (s *deliveryLatencyStats) stats() *DeliveryLatencyStats {
+	stats := &DeliveryLatencyStats{
+		SampleRate: s.sampleRate,
+		All:        s.all.snapshot(),
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stats.ByDeviceFlag = make(map[uint8]DeliveryLatencyHistogram, len(s.byDeviceFlag))
+	for deviceFlag, h := range s.byDeviceFlag {
+		stats.ByDeviceFlag[deviceFlag] = h.snapshot()
+	}
+	return stats
+}
+
+// DeliveryLatencyStats 投递延迟（数据写入输出缓冲区到完全写入fd）的直方图，没有开启DeliveryLatencySampleRate时返回nil
+func (e *Engine) DeliveryLatencyStats() *DeliveryLatencyStats {
+	if e.deliveryLatency == nil {
+		return nil
+	}
+	return e.deliveryLatency.stats()
+}
+
+type deliveryLatencyMark struct {
+	end        uint64    // 这次写入的数据在流里的结束偏移
+	enqueuedAt time.Time // 写入输出缓冲区的时间（带单调时钟读数，不受系统时间调整影响）
+}
+
+// connDeliveryLatency 连接等待写入fd的采样，按写入输出缓冲区和写入fd的字节偏移匹配
+// 偏移只做原子加，只有采样的写入才加锁，没有采样时写入路径不会变慢
+type connDeliveryLatency struct {
+	enqueued atomic.Uint64 // 写入输出缓冲区的字节数
+	flushed  atomic.Uint64 // 写入fd的字节数
+	mu       sync.Mutex
+	marks    []deliveryLatencyMark // 按结束偏移从小到大
+}
+
+// enqueue 写入了n个字节到输出缓冲区，按采样率记录写入的时间
+func (l *connDeliveryLatency) enqueue(stats *deliveryLatencyStats, n int) {
+	end := l.enqueued.Add(uint64(n))
+	if !stats.sample() {
+		return
+	}
+	l.mu.Lock()
+	if len(l.marks) < maxDeliveryLatencyMarks {
+		l.marks = append(l.marks, deliveryLatencyMark{end: end, enqueuedAt: time.Now()})
+	}
+	l.mu.Unlock()
+}
+
+// flush 输出缓冲区的n个字节写入了fd，完全写入fd的采样记入直方图，需要持有d.mu
+func (l *connDeliveryLatency) flush(d *DefaultConn, n int) {
+	flushed := l.flushed.Add(uint64(n))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.marks) == 0 || l.marks[0].end > flushed {
+		return
+	}
+	now := time.Now()
+	done := 0
+	for done < len(l.marks) && l.marks[done].end <= flushed {
+		d.eg.deliveryLatency.observe(d.deviceFlag, now.Sub(l.marks[done].enqueuedAt))
+		done++
+	}
+	l.marks = append(l.marks[:0], l.marks[done:]...)
+}
+
+// writeOutbound 写入输出缓冲区（调试连接同时跟踪写入的帧，开启投递延迟统计时采样写入的时间）
+func (d *DefaultConn) writeOutbound(b []byte) (int, error) {
+	var (
+		n   int
+		err error
+	)
+	if t := d.writeTrace.Load(); t != nil {
+		n, err = d.traceWrite(t, b, d.outboundBuffer.Write)
+	} else {
+		n, err = d.outboundBuffer.Write(b)
+	}
+	if l := d.deliveryLatency; l != nil && n > 0 {
+		l.enqueue(d.eg.deliveryLatency, n)
+	}
+	return n, err
+}
@@ -0,0 +1,80 @@
+package wknet
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliveryLatencyHistogram(t *testing.T) {
+	stats := newDeliveryLatencyStats(1)
+	stats.observe(0, time.Microsecond*50)
+	stats.observe(0, time.Millisecond*3)
+	stats.observe(1, time.Millisecond*40)
+	stats.observe(1, time.Minute)
+
+	all := stats.stats().All
+	assert.Equal(t, int64(4), all.Count)
+	assert.Equal(t, time.Microsecond*50+time.Millisecond*43+time.Minute, all.Sum)
+	assert.Equal(t, time.Microsecond*100, all.Quantile(0.25))
+	assert.Equal(t, time.Millisecond*5, all.Quantile(0.5))
+	assert.Equal(t, time.Millisecond*50, all.Quantile(0.75))
+	assert.Equal(t, time.Second*10, all.Quantile(1)) // 超过最大上限
+	assert.Equal(t, time.Duration(0), DeliveryLatencyHistogram{}.Quantile(0.5))
+
+	byDeviceFlag := stats.stats().ByDeviceFlag
+	assert.Len(t, byDeviceFlag, 2)
+	assert.Equal(t, int64(2), byDeviceFlag[1].Count)
+	assert.Equal(t, int64(1), byDeviceFlag[1].Buckets[len(deliveryLatencyBuckets)].Count)
+}
+
+// 写入fd变慢时直方图反映注入的延迟，一次写入分多次才写完时按最后一次写入fd的时间计算
+func TestDeliveryLatencySlowFd(t *testing.T) {
+	deliver := func(injector FaultInjector) *DeliveryLatencyStats {
+		opts := []Option{WithAddr("tcp://127.0.0.1:0"), WithDeliveryLatencySampleRate(1)}
+		if injector != nil {
+			opts = append(opts, WithFaultInjector(injector))
+		}
+		e := NewEngine(opts...)
+		accepted := make(chan Conn, 1)
+		e.OnConnect(func(conn Conn) error {
+			accepted <- conn
+			return nil
+		})
+		assert.NoError(t, e.Start())
+		defer e.Stop()
+		cli, err := net.Dial("tcp", e.TCPRealListenAddr().String())
+		assert.NoError(t, err)
+		defer cli.Close()
+		conn := <-accepted
+
+		conn.SetDeviceFlag(2)
+		data := make([]byte, 10000)
+		_, err = conn.WriteToOutboundBuffer(data)
+		assert.NoError(t, err)
+		assert.NoError(t, conn.WakeWrite())
+		_ = cli.SetReadDeadline(time.Now().Add(time.Second * 10))
+		_, err = io.ReadFull(cli, make([]byte, len(data)))
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool { return e.DeliveryLatencyStats().All.Count == 1 }, time.Second, time.Millisecond*10)
+		stats := e.Stats().DeliveryLatency
+		assert.Equal(t, int64(1), stats.ByDeviceFlag[2].Count)
+		return stats
+	}
+
+	// 每次最多写入1000字节，每次写入前延迟10ms，10000字节要写10次
+	slow := deliver(&FaultScenario{Latency: time.Millisecond * 10, MaxWriteSize: 1000})
+	assert.GreaterOrEqual(t, slow.All.Sum, time.Millisecond*100)
+	assert.GreaterOrEqual(t, slow.All.Quantile(0.5), time.Millisecond*100)
+
+	fast := deliver(nil)
+	assert.Less(t, fast.All.Sum, slow.All.Sum)
+
+	// 没有开启时不统计
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"))
+	assert.Nil(t, e.DeliveryLatencyStats())
+	assert.Nil(t, e.Stats().DeliveryLatency)
+}
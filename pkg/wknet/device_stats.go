@@ -0,0 +1,141 @@
+package wknet
+
+import (
+	"sort"
+	"sync"
+)
+
+// DeviceClassStats 一类设备（设备标记和设备等级）的连接统计
+type DeviceClassStats struct {
+	DeviceFlag  uint8 `json:"device_flag"`
+	DeviceLevel uint8 `json:"device_level"`
+	ConnCount   int64 `json:"conn_count"` // 在线连接数量
+	InBytes     int64 `json:"in_bytes"`   // 已汇总的流入字节（包括已关闭的连接，在线连接每DeviceStatsInterval汇总一次）
+	OutBytes    int64 `json:"out_bytes"`  // 已汇总的流出字节
+}
+
+// deviceClassKey 设备类型的key，高8位为设备标记，低8位为设备等级
+func deviceClassKey(deviceFlag uint8, deviceLevel uint8) uint16 {
+	return uint16(deviceFlag)<<8 | uint16(deviceLevel)
+}
+
+// deviceStats 按设备类型汇总的连接数量和流量，连接上的deviceClass、deviceCounted、rolledInBytes和rolledOutBytes也由mu保护
+// 连接切换设备类型时先把之前的流量汇总到原来的设备类型再移动连接数量，关闭时汇总剩下的流量后减少连接数量，所以不会重复计算
+type deviceStats struct {
+	mu      sync.Mutex
+	classes map[uint16]*DeviceClassStats
+}
+
+func newDeviceStats() *deviceStats {
+	return &deviceStats{
+		classes: make(map[uint16]*DeviceClassStats),
+	}
+}
+
+func (s *deviceStats) classNoLock(key uint16) *DeviceClassStats {
+	class := s.classes[key]
+	if class == nil {
+		class = &DeviceClassStats{DeviceFlag: uint8(key >> 8), DeviceLevel: uint8(key)}
+		s.classes[key] = class
+	}
+	return class
+}
+
+// rollupNoLock 把连接还没汇总的流量加到连接当前的设备类型上
+func (s *deviceStats) rollupNoLock(d *DefaultConn) {
+	if !d.deviceCounted || d.connStats == nil {
+		return
+	}
+	inBytes, outBytes := d.connStats.InBytes.Load(), d.connStats.OutBytes.Load()
+	if inBytes == d.rolledInBytes && outBytes == d.rolledOutBytes {
+		return
+	}
+	class := s.classNoLock(d.deviceClass)
+	class.InBytes += inBytes - d.rolledInBytes
+	class.OutBytes += outBytes - d.rolledOutBytes
+	d.rolledInBytes, d.rolledOutBytes = inBytes, outBytes
+}
+
+// add 连接加入引擎，调用时需要持有d.mu
+func (s *deviceStats) add(d *DefaultConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d.deviceCounted {
+		return
+	}
+	d.deviceCounted = true
+	d.deviceClass = deviceClassKey(d.deviceFlag, d.deviceLevel)
+	d.rolledInBytes, d.rolledOutBytes = 0, 0
+	if d.connStats != nil {
+		d.rolledInBytes, d.rolledOutBytes = d.connStats.InBytes.Load(), d.connStats.OutBytes.Load()
+	}
+	s.classNoLock(d.deviceClass).ConnCount++
+}
+
+// remove 连接从引擎移除，汇总剩下的流量，调用时需要持有d.mu
+func (s *deviceStats) remove(d *DefaultConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !d.deviceCounted {
+		return
+	}
+	s.rollupNoLock(d)
+	s.classNoLock(d.deviceClass).ConnCount--
+	d.deviceCounted = false
+}
+
+// reclassify 连接的设备标记或设备等级修改后移动到新的设备类型，调用时需要持有d.mu
+func (s *deviceStats) reclassify(d *DefaultConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !d.deviceCounted { // 还没加入引擎或已经移除，加入时按当时的设备类型计数
+		return
+	}
+	key := deviceClassKey(d.deviceFlag, d.deviceLevel)
+	if key == d.deviceClass {
+		return
+	}
+	s.rollupNoLock(d)
+	s.classNoLock(d.deviceClass).ConnCount--
+	s.classNoLock(key).ConnCount++
+	d.deviceClass = key
+}
+
+// rollup 汇总连接还没汇总的流量
+func (s *deviceStats) rollup(d *DefaultConn) {
+	s.mu.Lock()
+	s.rollupNoLock(d)
+	s.mu.Unlock()
+}
+
+// snapshot 按设备标记和设备等级排序的统计，不包括没有连接也没有流量的设备类型
+func (s *deviceStats) snapshot() []DeviceClassStats {
+	s.mu.Lock()
+	stats := make([]DeviceClassStats, 0, len(s.classes))
+	for _, class := range s.classes {
+		if class.ConnCount == 0 && class.InBytes == 0 && class.OutBytes == 0 {
+			continue
+		}
+		stats = append(stats, *class)
+	}
+	s.mu.Unlock()
+	sort.Slice(stats, func(i, j int) bool {
+		return deviceClassKey(stats[i].DeviceFlag, stats[i].DeviceLevel) < deviceClassKey(stats[j].DeviceFlag, stats[j].DeviceLevel)
+	})
+	return stats
+}
+
+// rollupDeviceStats 把所有在线连接还没汇总的流量汇总到设备类型的统计（每DeviceStatsInterval执行一次）
+func (e *Engine) rollupDeviceStats() {
+	for _, conn := range e.GetAllConn() {
+		if d := underlyingConn(conn); d != nil {
+			e.deviceStats.rollup(d)
+		}
+	}
+}
+
+// DeviceClassStats 按设备类型（设备标记和设备等级）统计的在线连接数量和流量，读取时不遍历连接
+// 在线连接的流量每DeviceStatsInterval汇总一次，所以会比ConnStats里的稍微滞后
+func (e *Engine) DeviceClassStats() []DeviceClassStats {
+	return e.deviceStats.snapshot()
+}
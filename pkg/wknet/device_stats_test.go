@@ -0,0 +1,124 @@
+package wknet
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEngineDeviceClassStats(t *testing.T) {
+	const clients = 8
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"), WithDeviceStatsInterval(0))
+	accepted := make(chan Conn, clients)
+	e.OnConnect(func(conn Conn) error {
+		accepted <- conn
+		return nil
+	})
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	clis := make([]net.Conn, 0, clients)
+	conns := make([]Conn, 0, clients)
+	for i := 0; i < clients; i++ {
+		cli, err := net.Dial("tcp", e.TCPRealListenAddr().String())
+		assert.NoError(t, err)
+		defer cli.Close()
+		clis = append(clis, cli)
+		conns = append(conns, <-accepted)
+	}
+	assert.Eventually(t, func() bool { return e.ConnCount() == clients }, time.Second, time.Millisecond*10)
+
+	// 还没认证的连接都在设备标记0
+	assert.Equal(t, []DeviceClassStats{{ConnCount: clients}}, e.DeviceClassStats())
+
+	classOf := func(flag, level uint8) DeviceClassStats {
+		for _, stats := range e.DeviceClassStats() {
+			if stats.DeviceFlag == flag && stats.DeviceLevel == level {
+				return stats
+			}
+		}
+		return DeviceClassStats{DeviceFlag: flag, DeviceLevel: level}
+	}
+
+	// 切换设备类型之前的流量算原来的设备类型
+	conns[0].ConnStats().InBytes.Add(100)
+	conns[0].SetDeviceFlag(1)
+	conns[0].ConnStats().InBytes.Add(10)
+	conns[0].ConnStats().OutBytes.Add(20)
+	e.rollupDeviceStats()
+	e.rollupDeviceStats() // 重复汇总不重复计算
+	assert.Equal(t, DeviceClassStats{ConnCount: clients - 1, InBytes: 100}, classOf(0, 0))
+	assert.Equal(t, DeviceClassStats{DeviceFlag: 1, ConnCount: 1, InBytes: 10, OutBytes: 20}, classOf(1, 0))
+
+	// 并发切换设备类型、增加流量和汇总
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(i int, conn Conn) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				conn.SetDeviceFlag(uint8((i + j) % 3))
+				conn.SetDeviceLevel(uint8(j % 2))
+				conn.ConnStats().InBytes.Add(1)
+				conn.ConnStats().OutBytes.Add(2)
+			}
+		}(i, conn)
+	}
+	stop := make(chan struct{})
+	rollupDone := make(chan struct{})
+	go func() {
+		defer close(rollupDone)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				e.rollupDeviceStats()
+			}
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	<-rollupDone
+	e.rollupDeviceStats()
+
+	sumStats := func() DeviceClassStats {
+		var sum DeviceClassStats
+		for _, stats := range e.DeviceClassStats() {
+			sum.ConnCount += stats.ConnCount
+			sum.InBytes += stats.InBytes
+			sum.OutBytes += stats.OutBytes
+		}
+		return sum
+	}
+	assert.Equal(t, DeviceClassStats{ConnCount: clients, InBytes: 110 + clients*200, OutBytes: 20 + clients*400}, sumStats())
+	for _, stats := range e.DeviceClassStats() {
+		count := int64(0)
+		for _, conn := range conns {
+			if conn.DeviceFlag() == stats.DeviceFlag && conn.DeviceLevel() == stats.DeviceLevel {
+				count++
+			}
+		}
+		assert.Equal(t, count, stats.ConnCount, "flag=%d level=%d", stats.DeviceFlag, stats.DeviceLevel)
+	}
+
+	// 关闭连接后减少连接数量，还没汇总的流量在关闭时汇总
+	conns[1].SetDeviceFlag(2)
+	conns[1].SetDeviceLevel(1)
+	before := classOf(2, 1)
+	conns[1].ConnStats().OutBytes.Add(1000)
+	assert.NoError(t, conns[1].Close())
+	after := classOf(2, 1)
+	assert.Equal(t, before.ConnCount-1, after.ConnCount)
+	assert.Equal(t, before.OutBytes+1000, after.OutBytes)
+	conns[1].SetDeviceFlag(1) // 关闭后修改不影响统计
+	assert.Equal(t, after, classOf(2, 1))
+
+	_ = clis[2].Close()
+	assert.Eventually(t, func() bool { return e.ConnCount() == clients-2 }, time.Second, time.Millisecond*10)
+	assert.Equal(t, int64(clients-2), sumStats().ConnCount)
+	assert.Equal(t, e.DeviceClassStats(), e.Stats().DeviceClasses)
+}
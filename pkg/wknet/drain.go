@@ -0,0 +1,100 @@
+package wknet
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrDrained 连接在维护时被DrainWhere主动关闭
+var ErrDrained = errors.New("connection drained")
+
+// DrainOptions 排空连接的设置
+type DrainOptions struct {
+	// Context 取消后停止排空（已关闭的连接不会恢复），为nil表示不能取消
+	Context context.Context
+	// Rate 每秒最多关闭的连接数量，避免客户端同时重连到其他节点，<=0表示不限制
+	Rate int
+	// ReconnectAdvice 关闭前发给客户端的数据（比如建议重连到其他节点的帧），为nil或返回空时直接关闭
+	ReconnectAdvice func(conn Conn) []byte
+	// Progress 每处理完一个连接后回调
+	Progress func(progress DrainProgress)
+}
+
+// DrainProgress 排空连接的进度
+type DrainProgress struct {
+	Total   int `json:"total"`   // 开始时匹配的连接数量
+	Closed  int `json:"closed"`  // 已关闭的连接数量
+	Skipped int `json:"skipped"` // 排空前已经关闭被跳过的连接数量
+}
+
+// DrainWhere 按速率关闭filter匹配的连接（比如维护前只断开web端的连接），其他连接不受影响
+// 匹配的是调用时在线的连接，之后新建立的连接不会关闭；已经关闭的连接跳过，所以可以重复调用
+// opts.Context取消后返回ctx.Err()，已关闭的连接不会恢复
+func (e *Engine) DrainWhere(filter func(Conn) bool, opts DrainOptions) error {
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	// 连接对象关闭后会放回池里复用，记录匹配时的连接id，id变了说明原来的连接已经关闭
+	type drainTarget struct {
+		conn Conn
+		id   int64
+	}
+	targets := make([]drainTarget, 0)
+	for _, conn := range e.GetAllConn() {
+		if filter(conn) {
+			targets = append(targets, drainTarget{conn: conn, id: conn.ID()})
+		}
+	}
+	progress := DrainProgress{Total: len(targets)}
+	e.Info("drain conns", zap.Int("total", progress.Total), zap.Int("rate", opts.Rate))
+
+	var ticker *time.Ticker
+	if opts.Rate > 0 {
+		if interval := time.Second / time.Duration(opts.Rate); interval > 0 {
+			ticker = time.NewTicker(interval)
+			defer ticker.Stop()
+		}
+	}
+	alive := func(target drainTarget) bool {
+		return !target.conn.IsClosed() && target.conn.ID() == target.id
+	}
+	for _, target := range targets {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if ticker != nil && progress.Closed > 0 && alive(target) {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if alive(target) { // 等待期间可能已经关闭
+			e.drainConn(target.conn, opts.ReconnectAdvice)
+			progress.Closed++
+		} else {
+			progress.Skipped++
+		}
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+	}
+	e.Info("drain conns done", zap.Int("closed", progress.Closed), zap.Int("skipped", progress.Skipped))
+	return nil
+}
+
+// drainConn 发送重连建议后关闭连接，发送失败也关闭
+func (e *Engine) drainConn(conn Conn, reconnectAdvice func(conn Conn) []byte) {
+	if reconnectAdvice != nil {
+		if data := reconnectAdvice(conn); len(data) > 0 {
+			if _, err := conn.WriteToOutboundBuffer(data); err == nil {
+				_ = conn.Flush()
+			}
+		}
+	}
+	_ = conn.CloseWithErr(ErrDrained)
+}
@@ -0,0 +1,139 @@
+package wknet
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEngineDrainWhere(t *testing.T) {
+	const clients = 10
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"))
+	accepted := make(chan Conn, clients)
+	e.OnConnect(func(conn Conn) error {
+		accepted <- conn
+		return nil
+	})
+	e.OnData(func(conn Conn) error {
+		buff, err := conn.Peek(-1)
+		if err != nil {
+			return err
+		}
+		_, _ = conn.Discard(len(buff))
+		_, err = conn.WriteToOutboundBuffer(buff)
+		if err != nil {
+			return err
+		}
+		return conn.WakeWrite()
+	})
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	clientConns := make([]net.Conn, 0, clients)
+	for i := 0; i < clients; i++ {
+		cli, err := net.Dial("tcp", e.TCPRealListenAddr().String())
+		assert.NoError(t, err)
+		defer cli.Close()
+		conn := <-accepted
+		if i%2 == 0 {
+			conn.SetValue("label", "web")
+		} else {
+			conn.SetValue("label", "app")
+		}
+		clientConns = append(clientConns, cli)
+	}
+	isWeb := func(conn Conn) bool { return conn.Value("label") == "web" }
+
+	// 排空期间app的连接正常收发数据
+	stopEcho := make(chan struct{})
+	echoDone := make(chan struct{})
+	go func() {
+		defer close(echoDone)
+		buff := make([]byte, 4)
+		for {
+			select {
+			case <-stopEcho:
+				return
+			default:
+			}
+			for i := 1; i < clients; i += 2 {
+				cli := clientConns[i]
+				_, err := cli.Write([]byte("ping"))
+				assert.NoError(t, err)
+				_ = cli.SetReadDeadline(time.Now().Add(time.Second * 2))
+				_, err = io.ReadFull(cli, buff)
+				assert.NoError(t, err)
+				assert.Equal(t, "ping", string(buff))
+			}
+		}
+	}()
+
+	var progresses []DrainProgress
+	err := e.DrainWhere(isWeb, DrainOptions{
+		Rate: 50,
+		ReconnectAdvice: func(conn Conn) []byte {
+			return []byte("reconnect")
+		},
+		Progress: func(progress DrainProgress) {
+			progresses = append(progresses, progress)
+		},
+	})
+	assert.NoError(t, err)
+	close(stopEcho)
+	<-echoDone
+
+	assert.Len(t, progresses, clients/2)
+	assert.Equal(t, DrainProgress{Total: clients / 2, Closed: clients / 2}, progresses[len(progresses)-1])
+	assert.Equal(t, clients/2, e.ConnCount())
+	for i := 0; i < clients; i += 2 { // 关闭前收到了重连建议
+		_ = clientConns[i].SetReadDeadline(time.Now().Add(time.Second * 2))
+		data, err := io.ReadAll(clientConns[i])
+		assert.NoError(t, err)
+		assert.Equal(t, "reconnect", string(data))
+	}
+
+	// 重复排空没有可以关闭的连接
+	progresses = nil
+	assert.NoError(t, e.DrainWhere(isWeb, DrainOptions{Progress: func(progress DrainProgress) {
+		progresses = append(progresses, progress)
+	}}))
+	assert.Len(t, progresses, 0)
+	assert.Equal(t, clients/2, e.ConnCount())
+}
+
+func TestEngineDrainWhereCancel(t *testing.T) {
+	const clients = 6
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"))
+	accepted := make(chan Conn, clients)
+	e.OnConnect(func(conn Conn) error {
+		accepted <- conn
+		return nil
+	})
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	for i := 0; i < clients; i++ {
+		cli, err := net.Dial("tcp", e.TCPRealListenAddr().String())
+		assert.NoError(t, err)
+		defer cli.Close()
+		<-accepted
+	}
+
+	// 每秒只关闭一个，第一个关闭后取消
+	ctx, cancel := context.WithCancel(context.Background())
+	err := e.DrainWhere(func(conn Conn) bool { return true }, DrainOptions{
+		Context: ctx,
+		Rate:    1,
+		Progress: func(progress DrainProgress) {
+			if progress.Closed == 1 {
+				cancel()
+			}
+		},
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, clients-1, e.ConnCount())
+}
@@ -6,8 +6,11 @@ import (
 	"time"
 
 	"github.com/RussellLuo/timingwheel"
+	"github.com/WuKongIM/WuKongIM/pkg/wklog"
+	"github.com/WuKongIM/crypto/tls"
 	"github.com/sasha-s/go-deadlock"
 	"go.uber.org/atomic"
+	"go.uber.org/zap"
 )
 
 type Engine struct {
@@ -19,6 +22,76 @@ type Engine struct {
 	timingWheel     *timingwheel.TimingWheel // Time wheel delay task
 	defaultConnPool *sync.Pool               // 默认连接对象池
 	clientIDGen     atomic.Int64             // 客户端ID生成器
+
+	debugConnID       atomic.Int64 // 调试的连接ID，0表示不调试
+	debugConnExpireAt atomic.Int64 // 调试连接的过期时间（unix nano）
+
+	panicCount atomic.Int64 // 事件回调panic的次数
+
+	tlsRejectedCount atomic.Int64 // TLSModeRequired下因为不是tls被关闭的连接数量
+
+	writeChecksumMismatches atomic.Int64 // 调试连接写入fd的数据和写入输出缓冲区时不一致的帧数量
+
+	goroutines *goroutineRegistry // 连接通过Go启动的goroutine
+
+	cidrFilters *cidrFilters  // 监听端口的网段限制
+	reactorCPUs []int         // 每个sub reactor要绑定的cpu
+	events      *engineEvents // 连接生命周期事件，为nil表示不发送
+	optionsErr  error         // 配置检查的错误，不为nil时Start直接返回
+
+	lifetimeNotified atomic.Int64 // 超过最长存活时间被通知的连接数量
+	lifetimeClosed   atomic.Int64 // 超过最长存活时间被关闭的连接数量
+
+	decodeRevisits atomic.Int64 // OnData返回ErrDecodePending后再次回调的次数
+
+	deviceStats *deviceStats // 按设备类型汇总的连接数量和流量
+
+	deliveryLatency *deliveryLatencyStats // 投递延迟的直方图，没有开启DeliveryLatencySampleRate时为nil
+
+	tcpTLSConfig *tls.Config    // 应用了TLSPolicies[ListenerTCP]的TCPTLSConfig
+	wssTLSConfig *tls.Config    // 应用了TLSPolicies[ListenerWSS]的WSTLSConfig
+	tlsUsage     *tlsUsageStats // tls握手协商的版本和加密套件统计
+
+	shutdownLock    sync.Mutex
+	shutdownHooks   []shutdownHook        // Shutdown时按阶段执行的钩子
+	shutdownResults []ShutdownPhaseResult // Shutdown每个阶段的执行结果
+	shutdownStarted atomic.Bool           // 是否已经调用过Shutdown
+
+	wklog.Log
+}
+
+// EngineDebugStatus 引擎的调试设置
+type EngineDebugStatus struct {
+	DebugConnID       int64         `json:"debug_conn_id"`
+	DebugConnExpireAt int64         `json:"debug_conn_expire_at"` // 过期时间（unix nano）
+	DebugExpire       time.Duration `json:"debug_expire"`
+}
+
+// EngineStats 引擎的统计
+type EngineStats struct {
+	ConnCount         int                `json:"conn_count"`         // 在线连接数量
+	PanicCount        int64              `json:"panic_count"`        // 事件回调panic的次数
+	TLSRejectedCount  int64              `json:"tls_rejected_count"` // TLSModeRequired下因为不是tls被关闭的连接数量
+	TrackedGoroutines int64              `json:"tracked_goroutines"` // 通过Conn.Go启动还存活的goroutine总数
+	ConnGoroutines    map[int64]int      `json:"conn_goroutines"`    // 每个连接（包括已关闭的）还存活的goroutine数量，key为连接id
+	DeniedAccepts     map[Listener]int64 `json:"denied_accepts"`     // 每个监听端口因为网段限制被拒绝的连接数量
+	ReactorCPUs       []int              `json:"reactor_cpus"`       // 每个sub reactor实际绑定的cpu，-1表示没有绑定
+	DroppedEvents     int64              `json:"dropped_events"`     // 缓冲区满了被丢弃的生命周期事件数量
+	WriteMismatches   int64              `json:"write_mismatches"`   // 调试连接写入fd的数据和写入输出缓冲区时不一致的帧数量
+	// ReactorOutboundBytes 每个sub reactor所有连接输出缓冲区里还没发送的数据总大小
+	ReactorOutboundBytes []int64 `json:"reactor_outbound_bytes"`
+	// SlowConsumerEvictions 因为超过MaxReactorOutboundBytes被关闭的连接数量
+	SlowConsumerEvictions int64 `json:"slow_consumer_evictions"`
+	// ConnLifetime 超过最长存活时间（MaxConnLifetime）被通知和关闭的连接数量
+	ConnLifetime ConnLifetimeStats `json:"conn_lifetime"`
+	// FlushFairness 轮流发送输出缓冲区时超过MaxFlushBytesPerTick的统计
+	FlushFairness FlushFairnessStats `json:"flush_fairness"`
+	// DecodeRevisits 超过MaxFramesPerDecode在下一轮事件循环继续解码的次数
+	DecodeRevisits int64 `json:"decode_revisits"`
+	// DeviceClasses 按设备类型（设备标记和设备等级）统计的在线连接数量和流量
+	DeviceClasses []DeviceClassStats `json:"device_classes"`
+	// DeliveryLatency 投递延迟的直方图，没有开启DeliveryLatencySampleRate时为nil
+	DeliveryLatency *DeliveryLatencyStats `json:"delivery_latency,omitempty"`
 }
 
 func NewEngine(opts ...Option) *Engine {
@@ -41,13 +114,44 @@ func NewEngine(opts ...Option) *Engine {
 				return &DefaultConn{}
 			},
 		},
+		goroutines:  newGoroutineRegistry(),
+		cidrFilters: newCIDRFilters(),
+		reactorCPUs: assignReactorCPUs(options.ReactorCPUAffinity, options.SubReactorNum, availableCPUs()),
+		events:      newEngineEvents(options.EventBufferSize),
+		deviceStats: newDeviceStats(),
+		tlsUsage:    newTLSUsageStats(),
+		Log:         wklog.NewWKLog("Engine"),
+	}
+	eg.tcpTLSConfig = applyTLSPolicy(options.TCPTLSConfig, options.TLSPolicies[ListenerTCP])
+	eg.wssTLSConfig = applyTLSPolicy(options.WSTLSConfig, options.TLSPolicies[ListenerWSS])
+	eg.deliveryLatency = newDeliveryLatencyStats(options.DeliveryLatencySampleRate)
+	if eg.optionsErr = options.Validate(); eg.optionsErr != nil {
+		eg.Error("invalid options", zap.Error(eg.optionsErr))
 	}
 	eg.reactorMain = NewReactorMain(eg)
+	eg.registerEngineShutdownHooks()
 	return eg
 }
 
+// Start 启动引擎，配置有问题（见Options.Validate）时不启动直接返回错误
 func (e *Engine) Start() error {
+	if e.optionsErr != nil {
+		return e.optionsErr
+	}
+	e.Info("engine options", e.options.logFields()...)
+	if err := e.cidrFilters.init(e.options); err != nil {
+		return err
+	}
 	e.timingWheel.Start()
+	if e.options.TCPInfoSampleInterval > 0 {
+		e.Schedule(e.options.TCPInfoSampleInterval, e.sampleTCPInfo)
+	}
+	if e.options.DeviceStatsInterval > 0 {
+		e.Schedule(e.options.DeviceStatsInterval, e.rollupDeviceStats)
+	}
+	if e.options.MaxConnLifetime > 0 {
+		e.Schedule(connLifetimeTick(e.options.MaxConnLifetime), e.checkConnLifetime)
+	}
 	return e.reactorMain.Start()
 }
 
@@ -60,16 +164,45 @@ func (e *Engine) Stop() error {
 	return nil
 }
 
+// Stats 引擎的统计
+func (e *Engine) Stats() EngineStats {
+	return EngineStats{
+		ConnCount:         e.ConnCount(),
+		PanicCount:        e.PanicCount(),
+		TLSRejectedCount:  e.TLSRejectedCount(),
+		TrackedGoroutines: e.goroutines.total.Load(),
+		ConnGoroutines:    e.goroutines.counts(),
+		DeniedAccepts:     e.DeniedAccepts(),
+		ReactorCPUs:       e.ReactorCPUs(),
+		DroppedEvents:     e.DroppedEvents(),
+		WriteMismatches:   e.WriteMismatches(),
+
+		ReactorOutboundBytes:  e.ReactorOutboundBytes(),
+		SlowConsumerEvictions: e.SlowConsumerEvictions(),
+		ConnLifetime:          e.ConnLifetimeStats(),
+		FlushFairness:         e.FlushFairness(),
+		DecodeRevisits:        e.DecodeRevisits(),
+		DeviceClasses:         e.DeviceClassStats(),
+		DeliveryLatency:       e.DeliveryLatencyStats(),
+	}
+}
+
 func (e *Engine) AddConn(conn Conn) {
 	e.connsUnixLock.Lock()
 	e.connMatrix.addConn(conn)
 	e.connsUnixLock.Unlock()
+	if d := underlyingConn(conn); d != nil {
+		e.deviceStats.add(d)
+	}
 }
 
 func (e *Engine) RemoveConn(conn Conn) {
 	e.connsUnixLock.Lock()
 	e.connMatrix.delConn(conn)
 	e.connsUnixLock.Unlock()
+	if d := underlyingConn(conn); d != nil {
+		e.deviceStats.remove(d)
+	}
 }
 
 func (e *Engine) GetConn(fd int) Conn {
@@ -144,6 +277,46 @@ func (e *Engine) GenClientID() int64 {
 	return e.clientIDGen.Inc()
 }
 
+// SetDebugConn 只对指定的连接打印详细日志，在DebugExpire后自动失效，id为0表示关闭
+func (e *Engine) SetDebugConn(id int64) {
+	if id == 0 {
+		e.debugConnID.Store(0)
+		e.debugConnExpireAt.Store(0)
+		return
+	}
+	e.debugConnExpireAt.Store(time.Now().Add(e.options.DebugExpire).UnixNano())
+	e.debugConnID.Store(id)
+	for _, conn := range e.GetAllConn() {
+		if conn.ID() != id {
+			continue
+		}
+		if d := underlyingConn(conn); d != nil {
+			d.startWriteTrace()
+		}
+	}
+}
+
+// DebugStatus 获取当前的调试设置（已过期的设置不返回）
+func (e *Engine) DebugStatus() EngineDebugStatus {
+	status := EngineDebugStatus{
+		DebugExpire: e.options.DebugExpire,
+	}
+	id := e.debugConnID.Load()
+	if e.isDebugConn(id) {
+		status.DebugConnID = id
+		status.DebugConnExpireAt = e.debugConnExpireAt.Load()
+	}
+	return status
+}
+
+func (e *Engine) isDebugConn(id int64) bool {
+	debugID := e.debugConnID.Load()
+	if debugID == 0 || debugID != id {
+		return false
+	}
+	return time.Now().UnixNano() <= e.debugConnExpireAt.Load()
+}
+
 type everyScheduler struct {
 	Interval time.Duration
 }
@@ -0,0 +1,107 @@
+//go:build linux
+// +build linux
+
+package wknet
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestEngineDeferAcceptAndFastOpen(t *testing.T) {
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"), WithTCPDeferAccept(time.Second), WithTCPFastOpen(16))
+	e.OnData(func(conn Conn) error {
+		buff, err := conn.Peek(-1)
+		if err != nil {
+			return err
+		}
+		_, _ = conn.Discard(len(buff))
+		_, err = conn.WriteToOutboundBuffer(buff)
+		if err != nil {
+			return err
+		}
+		return conn.WakeWrite()
+	})
+	err := e.Start()
+	assert.NoError(t, err)
+	defer e.Stop()
+
+	addr := e.TCPRealListenAddr().(*net.TCPAddr)
+	data := []byte("hello")
+
+	fd, err := tcpFastOpenDial(addr, data)
+	if err != nil { // 内核不支持TFO时使用普通连接
+		t.Logf("tcp fast open not available, fallback: %v", err)
+		conn, err := net.Dial("tcp", addr.String())
+		assert.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write(data)
+		assert.NoError(t, err)
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+		resp := make([]byte, len(data))
+		_, err = conn.Read(resp)
+		assert.NoError(t, err)
+		assert.Equal(t, data, resp)
+		return
+	}
+	defer unix.Close(fd)
+	tv := unix.NsecToTimeval(int64(time.Second * 2))
+	err = unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv)
+	assert.NoError(t, err)
+	resp := make([]byte, len(data))
+	n, err := unix.Read(fd, resp)
+	assert.NoError(t, err)
+	assert.Equal(t, data, resp[:n])
+}
+
+// tcpFastOpenDial 在SYN里携带数据建立连接
+func tcpFastOpenDial(addr *net.TCPAddr, data []byte) (int, error) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, unix.IPPROTO_TCP)
+	if err != nil {
+		return 0, err
+	}
+	sa := &unix.SockaddrInet4{Port: addr.Port}
+	copy(sa.Addr[:], addr.IP.To4())
+	if err = unix.Sendto(fd, data, unix.MSG_FASTOPEN, sa); err != nil {
+		unix.Close(fd)
+		return 0, err
+	}
+	return fd, nil
+}
+
+func TestEngineUnixAbstractListener(t *testing.T) {
+	name := fmt.Sprintf("wknet-test-%d-%d", os.Getpid(), time.Now().UnixNano())
+	e := NewEngine(WithAddr("unix-abstract://" + name))
+	e.OnData(func(conn Conn) error {
+		buff, err := conn.Peek(-1)
+		if err != nil {
+			return err
+		}
+		_, _ = conn.Discard(len(buff))
+		_, err = conn.WriteToOutboundBuffer(buff)
+		if err != nil {
+			return err
+		}
+		return conn.WakeWrite()
+	})
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	cli, err := net.Dial("unix", "@"+name)
+	assert.NoError(t, err)
+	defer cli.Close()
+	_, err = cli.Write([]byte("hello"))
+	assert.NoError(t, err)
+	_ = cli.SetReadDeadline(time.Now().Add(time.Second * 2))
+	resp := make([]byte, 5)
+	_, err = io.ReadFull(cli, resp)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(resp))
+}
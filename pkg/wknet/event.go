@@ -21,10 +21,14 @@ type EventHandler struct {
 	// OnNewWSConn is called when a new websocket connection is established.
 	OnNewWSConn  OnNewConn
 	OnNewWSSConn OnNewConn
+	// OnNewTLSConn is called when a new tls connection is established on the tcp port (TCPTLSConfig is set).
+	OnNewTLSConn OnNewConn
 	// OnNewInboundConn is called when need create a new inbound buffer.
 	OnNewInboundConn OnNewInboundConn
 	// OnNewOutboundConn is called when need create a new outbound buffer.
 	OnNewOutboundConn OnNewOutboundConn
+	// OnLifetimeExceeded is called when a connection is older than Options.MaxConnLifetime, nil means close it directly.
+	OnLifetimeExceeded OnLifetimeExceeded
 }
 
 func NewEventHandler() *EventHandler {
@@ -41,6 +45,9 @@ func NewEventHandler() *EventHandler {
 		OnNewWSSConn: func(id int64, connFd NetFd, localAddr, remoteAddr net.Addr, eg *Engine, reactorSub *ReactorSub) (Conn, error) {
 			return CreateWSSConn(id, connFd, localAddr, remoteAddr, eg, reactorSub)
 		},
+		OnNewTLSConn: func(id int64, connFd NetFd, localAddr, remoteAddr net.Addr, eg *Engine, reactorSub *ReactorSub) (Conn, error) {
+			return CreateTLSConn(id, connFd, localAddr, remoteAddr, eg, reactorSub)
+		},
 		OnNewInboundConn:  func(conn Conn, eg *Engine) InboundBuffer { return NewDefaultBuffer() },
 		OnNewOutboundConn: func(conn Conn, eg *Engine) OutboundBuffer { return NewDefaultBuffer() },
 	}
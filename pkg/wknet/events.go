@@ -0,0 +1,111 @@
+package wknet
+
+import (
+	"net"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// EngineEventType 引擎事件类型
+type EngineEventType uint8
+
+const (
+	EventConnOpened      EngineEventType = iota + 1 // 连接建立
+	EventConnAuthed                                 // 连接认证通过（调用了SetAuthed(true)）
+	EventConnClosed                                 // 连接关闭
+	EventListenerStarted                            // 开始监听
+	EventListenerStopped                            // 停止监听
+)
+
+func (t EngineEventType) String() string {
+	switch t {
+	case EventConnOpened:
+		return "ConnOpened"
+	case EventConnAuthed:
+		return "ConnAuthed"
+	case EventConnClosed:
+		return "ConnClosed"
+	case EventListenerStarted:
+		return "ListenerStarted"
+	case EventListenerStopped:
+		return "ListenerStopped"
+	}
+	return "Unknown"
+}
+
+// EngineEvent 引擎事件，值类型，发送事件不需要分配内存
+type EngineEvent struct {
+	Type       EngineEventType
+	At         time.Time
+	ConnID     int64    // 连接事件的连接id
+	LocalAddr  net.Addr // 连接事件为连接的本地地址，监听事件为监听地址
+	RemoteAddr net.Addr // 连接事件为客户端地址
+	Listener   Listener // 监听事件的监听端口
+	Reason     error    // EventConnClosed的关闭原因，主动关闭为nil
+}
+
+type engineEvents struct {
+	ch      chan EngineEvent
+	dropped atomic.Int64 // 缓冲区满了被丢弃的事件数量
+}
+
+func newEngineEvents(size int) *engineEvents {
+	if size <= 0 {
+		return nil
+	}
+	return &engineEvents{ch: make(chan EngineEvent, size)}
+}
+
+// Events 连接生命周期事件，需要配置Options.EventBufferSize，没有配置返回nil
+// 缓冲区满了事件会被丢弃（见DroppedEvents），不会阻塞reactor，和OnConnect，OnClose等回调可以同时使用
+func (e *Engine) Events() <-chan EngineEvent {
+	if e.events == nil {
+		return nil
+	}
+	return e.events.ch
+}
+
+// DroppedEvents 缓冲区满了被丢弃的事件数量
+func (e *Engine) DroppedEvents() int64 {
+	if e.events == nil {
+		return 0
+	}
+	return e.events.dropped.Load()
+}
+
+func (e *Engine) emitEvent(event EngineEvent) {
+	if e.events == nil {
+		return
+	}
+	event.At = time.Now()
+	select {
+	case e.events.ch <- event:
+	default:
+		e.events.dropped.Inc()
+	}
+}
+
+func (e *Engine) emitConnEvent(typ EngineEventType, id int64, localAddr, remoteAddr net.Addr, reason error) {
+	if e.events == nil {
+		return
+	}
+	e.emitEvent(EngineEvent{
+		Type:       typ,
+		ConnID:     id,
+		LocalAddr:  localAddr,
+		RemoteAddr: remoteAddr,
+		Reason:     reason,
+	})
+}
+
+func (e *Engine) emitListenerEvent(typ EngineEventType, l Listener, addr net.Addr) {
+	if e.events == nil {
+		return
+	}
+	e.emitEvent(EngineEvent{
+		Type:      typ,
+		Listener:  l,
+		LocalAddr: addr,
+	})
+}
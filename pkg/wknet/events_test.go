@@ -0,0 +1,101 @@
+package wknet
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEngineEvents(t *testing.T) {
+	const cycles = 10000
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"), WithEventBufferSize(4096))
+	e.OnConnect(func(conn Conn) error {
+		conn.SetAuthed(true)
+		return nil
+	})
+
+	var (
+		mu     sync.Mutex
+		counts = map[EngineEventType]int{}
+		opened = map[int64]bool{}
+		closed = make(chan struct{})
+	)
+	consumed := make(chan struct{})
+	go func() {
+		defer close(consumed)
+		for event := range e.Events() {
+			mu.Lock()
+			counts[event.Type]++
+			switch event.Type {
+			case EventConnOpened:
+				assert.False(t, opened[event.ConnID])
+				opened[event.ConnID] = true
+			case EventConnClosed:
+				assert.True(t, opened[event.ConnID]) // 关闭事件在建立事件之后
+				if counts[EventConnClosed] == cycles {
+					close(closed)
+				}
+			case EventListenerStopped:
+				mu.Unlock()
+				return
+			}
+			assert.False(t, event.At.IsZero())
+			mu.Unlock()
+		}
+	}()
+
+	assert.NoError(t, e.Start())
+	addr := e.TCPRealListenAddr().String()
+	for i := 0; i < cycles; i++ {
+		cli, err := net.Dial("tcp", addr)
+		if !assert.NoError(t, err) {
+			break
+		}
+		_ = cli.Close()
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second * 30):
+		t.Fatal("wait closed events timeout")
+	}
+	assert.NoError(t, e.Stop())
+	<-consumed
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, int64(0), e.DroppedEvents())
+	assert.Equal(t, 1, counts[EventListenerStarted])
+	assert.Equal(t, 1, counts[EventListenerStopped])
+	assert.Equal(t, cycles, counts[EventConnOpened])
+	assert.Equal(t, cycles, counts[EventConnAuthed])
+	assert.Equal(t, cycles, counts[EventConnClosed])
+}
+
+func TestEngineEventsDropped(t *testing.T) {
+	e := NewEngine(WithEventBufferSize(2))
+	reason := errors.New("closed")
+	for i := 0; i < 5; i++ {
+		e.emitConnEvent(EventConnClosed, int64(i), nil, nil, reason)
+	}
+	assert.Equal(t, int64(3), e.DroppedEvents())
+	assert.Equal(t, int64(3), e.Stats().DroppedEvents)
+	event := <-e.Events()
+	assert.Equal(t, EventConnClosed, event.Type)
+	assert.Equal(t, int64(0), event.ConnID)
+	assert.Equal(t, reason, event.Reason)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		e.emitConnEvent(EventConnOpened, 1, nil, nil, nil)
+	})
+	assert.Equal(t, float64(0), allocs)
+
+	// 没有配置不发送事件
+	e = NewEngine()
+	assert.Nil(t, e.Events())
+	e.emitConnEvent(EventConnOpened, 1, nil, nil, nil)
+	assert.Equal(t, int64(0), e.DroppedEvents())
+}
@@ -0,0 +1,70 @@
+package wknet
+
+// fastPingPrefixSize 识别心跳包时最多peek的数据大小
+const fastPingPrefixSize = 16
+
+// FastPing 心跳快速处理，读取数据后先识别输入缓冲区开头的心跳包，心跳包直接回复Response，不再回调OnData
+type FastPing struct {
+	// Detect 判断prefix开头是否是心跳包，是则返回心跳包的长度，prefix最多fastPingPrefixSize个字节
+	Detect func(prefix []byte) (consumed int, ok bool)
+	// Response 回复的心跳包
+	Response []byte
+}
+
+// handleFastPing 处理输入缓冲区开头的心跳包，心跳包后面的数据留给OnData处理
+// 返回true表示处理了心跳包并且输入缓冲区没有其他数据了，不需要回调OnData
+func (e *Engine) handleFastPing(c Conn) (bool, error) {
+	fastPing := e.options.FastPing
+	if fastPing == nil || fastPing.Detect == nil {
+		return false, nil
+	}
+	inbound := c.InboundBuffer()
+	handled := false
+	for {
+		size := inbound.BoundBufferSize()
+		if size == 0 {
+			break
+		}
+		if size > fastPingPrefixSize {
+			size = fastPingPrefixSize
+		}
+		prefix, err := c.Peek(size)
+		if err != nil {
+			return false, err
+		}
+		consumed, ok := fastPing.Detect(prefix)
+		if !ok || consumed <= 0 || consumed > len(prefix) {
+			break
+		}
+		if _, err = c.Discard(consumed); err != nil {
+			return false, err
+		}
+		if err = writeFastPingResponse(c, fastPing.Response); err != nil {
+			return false, err
+		}
+		handled = true
+	}
+	if !handled {
+		return false, nil
+	}
+	if d := underlyingConn(c); d != nil {
+		d.KeepLastActivity()
+	}
+	return inbound.IsEmpty(), nil
+}
+
+func writeFastPingResponse(c Conn, response []byte) error {
+	if len(response) == 0 {
+		return nil
+	}
+	var err error
+	if wsConn, ok := c.(IWSConn); ok { // websocket连接
+		err = wsConn.WriteServerBinary(response)
+	} else {
+		_, err = c.WriteToOutboundBuffer(response)
+	}
+	if err != nil {
+		return err
+	}
+	return c.WakeWrite()
+}
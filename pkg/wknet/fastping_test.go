@@ -0,0 +1,67 @@
+package wknet
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFastPing(t *testing.T) {
+	var (
+		ping = byte(0x90)
+		pong = byte(0xa0)
+	)
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"), WithFastPing(&FastPing{
+		Detect: func(prefix []byte) (int, bool) {
+			return 1, len(prefix) > 0 && prefix[0] == ping
+		},
+		Response: []byte{pong},
+	}))
+	received := make(chan []byte, 10)
+	e.OnData(func(conn Conn) error {
+		data, _ := conn.Peek(-1)
+		_, _ = conn.Discard(len(data))
+		received <- data
+		return nil
+	})
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	cli, err := net.Dial("tcp", e.TCPRealListenAddr().String())
+	assert.NoError(t, err)
+	defer cli.Close()
+
+	readPong := func(n int) {
+		buf := make([]byte, n)
+		_ = cli.SetReadDeadline(time.Now().Add(time.Second * 5))
+		_, err := io.ReadFull(cli, buf)
+		assert.NoError(t, err)
+		for _, b := range buf {
+			assert.Equal(t, pong, b)
+		}
+	}
+
+	// 只有心跳包，不回调OnData
+	_, err = cli.Write([]byte{ping, ping})
+	assert.NoError(t, err)
+	readPong(2)
+	select {
+	case data := <-received:
+		t.Fatalf("unexpected OnData: %v", data)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// 心跳包后面还有数据，只消费心跳包
+	_, err = cli.Write([]byte{ping, 0x01, ping})
+	assert.NoError(t, err)
+	readPong(1)
+	select {
+	case data := <-received:
+		assert.Equal(t, []byte{0x01, ping}, data)
+	case <-time.After(time.Second * 5):
+		t.Fatal("OnData not called")
+	}
+}
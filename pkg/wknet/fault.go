@@ -0,0 +1,138 @@
+package wknet
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// FaultInjector 连接读写fd前的故障注入（用于集成测试模拟网络状况），通过Options.FaultInjector配置，为nil时读写路径只多一次nil判断
+// 钩子在sub reactor的goroutine里调用，sleep会阻塞同一个sub reactor上的所有连接
+type FaultInjector interface {
+	// BeforeRead 读取fd前调用，返回错误则不读取直接返回此错误
+	BeforeRead(fd int) error
+	// BeforeWrite 写入fd前调用（writev的多段数据合并为b），返回本次最多写入的字节数（小于len(b)时强制短写），返回错误则不写入直接返回此错误
+	BeforeWrite(fd int, b []byte) (int, error)
+}
+
+func injectRead(injector FaultInjector, fd int) error {
+	return injector.BeforeRead(fd)
+}
+
+// injectWrite 返回本次实际要写入的数据
+func injectWrite(injector FaultInjector, fd int, b []byte) ([]byte, error) {
+	max, err := injector.BeforeWrite(fd, b)
+	if err != nil {
+		return nil, err
+	}
+	if max < 0 {
+		max = 0
+	}
+	if max < len(b) {
+		b = b[:max]
+	}
+	return b, nil
+}
+
+func joinBuffers(bufs [][]byte) []byte {
+	return bytes.Join(bufs, nil)
+}
+
+// FaultScenario 内置的故障注入场景（可以组合配置），创建后不要修改字段
+type FaultScenario struct {
+	Latency      time.Duration // 每次读写前的延迟
+	MaxWriteSize int           // 每次最多写入的字节数（强制短写），0表示不限制
+	EAGAINRate   float64       // 写入返回EAGAIN的概率（读取不注入EAGAIN，边缘触发的poller会丢失读事件）
+	ResetRate    float64       // 读写返回ECONNRESET的概率
+
+	mu   sync.Mutex
+	rand *rand.Rand
+
+	shortWrites atomic.Int64
+	eagains     atomic.Int64
+	resets      atomic.Int64
+}
+
+// SlowNetworkScenario 慢网络，每次读写前延迟latency
+func SlowNetworkScenario(latency time.Duration) *FaultScenario {
+	return &FaultScenario{Latency: latency}
+}
+
+// FlakyScenario 不稳定的网络，写入按eagainRate概率返回EAGAIN，读写按resetRate概率返回ECONNRESET，seed相同时注入的顺序相同
+func FlakyScenario(eagainRate, resetRate float64, seed int64) *FaultScenario {
+	return &FaultScenario{
+		EAGAINRate: eagainRate,
+		ResetRate:  resetRate,
+		rand:       rand.New(rand.NewSource(seed)),
+	}
+}
+
+// ShortWritesScenario 每次最多写入maxWriteSize个字节（模拟发送缓冲区满时的短写）
+func ShortWritesScenario(maxWriteSize int) *FaultScenario {
+	return &FaultScenario{MaxWriteSize: maxWriteSize}
+}
+
+func (f *FaultScenario) BeforeRead(fd int) error {
+	if f.Latency > 0 {
+		time.Sleep(f.Latency)
+	}
+	if f.hit(f.ResetRate) {
+		f.resets.Inc()
+		return syscall.ECONNRESET
+	}
+	return nil
+}
+
+func (f *FaultScenario) BeforeWrite(fd int, b []byte) (int, error) {
+	if f.Latency > 0 {
+		time.Sleep(f.Latency)
+	}
+	if f.hit(f.ResetRate) {
+		f.resets.Inc()
+		return 0, syscall.ECONNRESET
+	}
+	if f.hit(f.EAGAINRate) {
+		f.eagains.Inc()
+		return 0, syscall.EAGAIN
+	}
+	if f.MaxWriteSize > 0 && len(b) > f.MaxWriteSize {
+		f.shortWrites.Inc()
+		return f.MaxWriteSize, nil
+	}
+	return len(b), nil
+}
+
+func (f *FaultScenario) hit(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	if rate >= 1 {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rand == nil {
+		f.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return f.rand.Float64() < rate
+}
+
+// FaultStats 已注入的故障次数
+type FaultStats struct {
+	ShortWrites int64 `json:"short_writes"`
+	EAGAINs     int64 `json:"eagains"`
+	Resets      int64 `json:"resets"`
+}
+
+// Stats 已注入的故障次数
+func (f *FaultScenario) Stats() FaultStats {
+	return FaultStats{
+		ShortWrites: f.shortWrites.Load(),
+		EAGAINs:     f.eagains.Load(),
+		Resets:      f.resets.Load(),
+	}
+}
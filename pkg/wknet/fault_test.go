@@ -0,0 +1,122 @@
+package wknet
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/atomic"
+)
+
+func startFaultEngine(t *testing.T, injector FaultInjector) (*Engine, net.Conn, Conn) {
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"), WithFaultInjector(injector))
+	accepted := make(chan Conn, 1)
+	e.OnConnect(func(conn Conn) error {
+		accepted <- conn
+		return nil
+	})
+	assert.NoError(t, e.Start())
+	t.Cleanup(func() { _ = e.Stop() })
+
+	cli, err := net.Dial("tcp", e.TCPRealListenAddr().String())
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = cli.Close() })
+	return e, cli, <-accepted
+}
+
+// 每次只能写入一部分时，输出缓冲区按实际写入的字节数丢弃，数据完整有序
+func TestFaultShortWritesFlush(t *testing.T) {
+	scenario := ShortWritesScenario(1000)
+	e, cli, conn := startFaultEngine(t, scenario)
+
+	data := make([]byte, 256*1024)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	for i := 0; i < len(data); i += 10000 {
+		end := i + 10000
+		if end > len(data) {
+			end = len(data)
+		}
+		_, err := conn.WriteToOutboundBuffer(data[i:end])
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, conn.WakeWrite())
+
+	received := make([]byte, len(data))
+	_ = cli.SetReadDeadline(time.Now().Add(time.Second * 10))
+	_, err := io.ReadFull(cli, received)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, received))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	pending, err := e.FlushAll(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, pending)
+	assert.Greater(t, scenario.Stats().ShortWrites, int64(len(data)/1000-1))
+}
+
+type stallInjector struct {
+	stalled atomic.Bool
+}
+
+func (s *stallInjector) BeforeRead(fd int) error {
+	return nil
+}
+
+func (s *stallInjector) BeforeWrite(fd int, b []byte) (int, error) {
+	if s.stalled.Load() {
+		time.Sleep(time.Millisecond)
+		return 0, syscall.EAGAIN
+	}
+	return len(b), nil
+}
+
+// 写入一直返回EAGAIN时FlushAll超时返回没发送完的连接，恢复后数据继续发送
+func TestFaultWriteStall(t *testing.T) {
+	injector := &stallInjector{}
+	injector.stalled.Store(true)
+	e, cli, conn := startFaultEngine(t, injector)
+
+	data := []byte("stalled frame")
+	_, err := conn.WriteToOutboundBuffer(data)
+	assert.NoError(t, err)
+	assert.NoError(t, conn.WakeWrite())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	pending, err := e.FlushAll(ctx)
+	cancel()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 1, pending)
+	assert.False(t, conn.IsClosed())
+
+	injector.stalled.Store(false)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second*5)
+	pending, err = e.FlushAll(ctx)
+	cancel()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, pending)
+
+	received := make([]byte, len(data))
+	_ = cli.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = io.ReadFull(cli, received)
+	assert.NoError(t, err)
+	assert.Equal(t, data, received)
+}
+
+// 读取返回ECONNRESET时关闭连接
+func TestFaultFlakyReset(t *testing.T) {
+	scenario := FlakyScenario(0, 1, 1)
+	_, cli, conn := startFaultEngine(t, scenario)
+
+	_, err := cli.Write([]byte("ping"))
+	assert.NoError(t, err)
+	assert.Eventually(t, conn.IsClosed, time.Second*5, time.Millisecond*10)
+	assert.Equal(t, int64(1), scenario.Stats().Resets)
+}
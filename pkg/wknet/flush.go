@@ -0,0 +1,238 @@
+package wknet
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// flushAllInterval FlushAll检查输出缓冲区是否发送完的间隔
+const flushAllInterval = time.Millisecond * 5
+
+// dirtyConns 输出缓冲区有数据等待发送的连接（添加了写事件的连接）
+type dirtyConns struct {
+	mu    sync.Mutex
+	conns map[Conn]struct{}
+}
+
+func (d *dirtyConns) add(c Conn) {
+	d.mu.Lock()
+	if d.conns == nil {
+		d.conns = make(map[Conn]struct{})
+	}
+	d.conns[c] = struct{}{}
+	d.mu.Unlock()
+}
+
+func (d *dirtyConns) remove(c Conn) {
+	d.mu.Lock()
+	delete(d.conns, c)
+	d.mu.Unlock()
+}
+
+func (d *dirtyConns) snapshot() []Conn {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	conns := make([]Conn, 0, len(d.conns))
+	for c := range d.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// pendingCount 还有数据没有发送完的连接数量
+func (d *dirtyConns) pendingCount() int {
+	count := 0
+	for _, c := range d.snapshot() {
+		if pendingOutbound(c) > 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// pendingOutbound 连接输出缓冲区里还没发送的数据大小
+func pendingOutbound(c Conn) int {
+	d := underlyingConn(c)
+	if d == nil {
+		return 0
+	}
+	n, closed := d.outboundBuffered()
+	if closed {
+		return 0
+	}
+	return n
+}
+
+// FlushFairnessStats 发送输出缓冲区时的公平性统计（MaxFlushBytesPerConnPerTick、MaxFlushBytesPerTick）
+type FlushFairnessStats struct {
+	BudgetHitTicks    int64 `json:"budget_hit_ticks"`    // 超过MaxFlushBytesPerTick还有连接没发送完的次数
+	MaxCarryoverBytes int64 `json:"max_carryover_bytes"` // 超过MaxFlushBytesPerTick时留到下次发送的单个连接的最大数据量
+}
+
+// flushFairness 轮流发送每个连接的输出缓冲区，避免输出缓冲区很大的连接占满一次发送，其他连接要等很久
+type flushFairness struct {
+	mu             sync.Mutex
+	carry          []Conn // 上次超过预算没发送完的连接，下次优先发送
+	budgetHitTicks atomic.Int64
+	maxCarryover   atomic.Int64
+}
+
+// tick 一次发送：轮流给每个连接发送最多perConn字节，直到都发送完、发送不了（EAGAIN）或者一共超过perTick字节，0表示不限制
+// 超过perTick时没发送完的连接留到下次优先发送；write发送连接最多max字节（max<=0表示全部），返回发送的大小和剩下的大小，pending返回连接还没发送的大小
+// 返回还有数据没发送完的连接数量
+func (f *flushFairness) tick(conns []Conn, perConn, perTick int, write func(c Conn, max int) (int, int), pending func(c Conn) int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	active := f.order(conns)
+	f.carry = nil
+	remaining := make(map[Conn]int, len(active))
+	written := 0
+	for len(active) > 0 {
+		next := active[:0]
+		for i, c := range active {
+			if perTick > 0 && written >= perTick { // 预算用完了，这一轮还没发送的排在前面
+				f.carry = make([]Conn, 0, len(active)-i+len(next))
+				f.carry = append(f.carry, active[i:]...)
+				f.carry = append(f.carry, next...)
+				break
+			}
+			max := perConn
+			if perTick > 0 && (max <= 0 || perTick-written < max) {
+				max = perTick - written
+			}
+			n, left := write(c, max)
+			remaining[c] = left
+			if n > 0 {
+				written += n
+			}
+			if n <= 0 || left <= 0 { // 发送完了或者发送不了，发送不了的等可写事件
+				continue
+			}
+			next = append(next, c)
+		}
+		if f.carry != nil {
+			break
+		}
+		active = next
+	}
+
+	if len(f.carry) > 0 {
+		f.budgetHitTicks.Inc()
+		for _, c := range f.carry {
+			left, ok := remaining[c]
+			if !ok {
+				left = pending(c)
+			}
+			if int64(left) > f.maxCarryover.Load() {
+				f.maxCarryover.Store(int64(left))
+			}
+		}
+	}
+	count := 0
+	for _, c := range conns {
+		left, ok := remaining[c]
+		if !ok {
+			left = pending(c)
+		}
+		if left > 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// order 上次没发送完的连接排在前面，不在conns里的（已经发送完或者关闭了）去掉
+func (f *flushFairness) order(conns []Conn) []Conn {
+	ordered := make([]Conn, 0, len(conns))
+	if len(f.carry) == 0 {
+		return append(ordered, conns...)
+	}
+	exist := make(map[Conn]bool, len(conns))
+	for _, c := range conns {
+		exist[c] = true
+	}
+	for _, c := range f.carry {
+		if exist[c] {
+			ordered = append(ordered, c)
+			exist[c] = false
+		}
+	}
+	for _, c := range conns {
+		if exist[c] {
+			ordered = append(ordered, c)
+		}
+	}
+	return ordered
+}
+
+func (f *flushFairness) stats() FlushFairnessStats {
+	return FlushFairnessStats{
+		BudgetHitTicks:    f.budgetHitTicks.Load(),
+		MaxCarryoverBytes: f.maxCarryover.Load(),
+	}
+}
+
+// flushConn 发送连接输出缓冲区里最多max字节的数据，返回发送的大小和剩下的大小
+func flushConn(c Conn, max int) (int, int) {
+	d := underlyingConn(c)
+	if d == nil {
+		_ = c.Flush()
+		return 0, 0
+	}
+	n, _ := d.flushN(max)
+	return n, pendingOutbound(c)
+}
+
+// FlushFairness 所有sub reactor发送输出缓冲区时的公平性统计
+func (e *Engine) FlushFairness() FlushFairnessStats {
+	var stats FlushFairnessStats
+	for _, sub := range e.reactorMain.acceptor.reactorSubs {
+		s := sub.fairness.stats()
+		stats.BudgetHitTicks += s.BudgetHitTicks
+		if s.MaxCarryoverBytes > stats.MaxCarryoverBytes {
+			stats.MaxCarryoverBytes = s.MaxCarryoverBytes
+		}
+	}
+	return stats
+}
+
+// FlushAll 让每个sub reactor发送它的连接输出缓冲区里的数据，等到所有连接的输出缓冲区都为空或者ctx结束
+// 返回还有数据没有发送完的连接数量，ctx结束时同时返回ctx的错误
+func (e *Engine) FlushAll(ctx context.Context) (int, error) {
+	subs := e.reactorMain.acceptor.reactorSubs
+	for {
+		done := make(chan int, len(subs))
+		for _, sub := range subs {
+			sub.flushPending(done)
+		}
+		pending := 0
+		for range subs {
+			select {
+			case n := <-done:
+				pending += n
+			case <-ctx.Done():
+				return e.pendingConnCount(), ctx.Err()
+			}
+		}
+		if pending == 0 {
+			return 0, nil
+		}
+		select {
+		case <-ctx.Done():
+			return e.pendingConnCount(), ctx.Err()
+		case <-time.After(flushAllInterval):
+		}
+	}
+}
+
+func (e *Engine) pendingConnCount() int {
+	count := 0
+	for _, sub := range e.reactorMain.acceptor.reactorSubs {
+		count += sub.dirty.pendingCount()
+	}
+	return count
+}
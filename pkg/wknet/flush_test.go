@@ -0,0 +1,203 @@
+package wknet
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEngineFlushAll(t *testing.T) {
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"))
+	accepted := make(chan Conn, 1)
+	e.OnConnect(func(conn Conn) error {
+		accepted <- conn
+		return nil
+	})
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	cli, err := net.Dial("tcp", e.TCPRealListenAddr().String())
+	assert.NoError(t, err)
+	defer cli.Close()
+	conn := <-accepted
+
+	// 没有待发送的数据
+	pending, err := e.FlushAll(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, pending)
+
+	// 客户端不读取，数据发送不完
+	data := make([]byte, 1024*1024*16)
+	_, err = conn.Write(data)
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	pending, err = e.FlushAll(ctx)
+	cancel()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 1, pending)
+
+	received := make(chan int64, 1)
+	go func() {
+		n, _ := io.CopyN(io.Discard, cli, int64(len(data)))
+		received <- n
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second*10)
+	pending, err = e.FlushAll(ctx)
+	cancel()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, pending)
+	assert.Equal(t, int64(len(data)), <-received)
+}
+
+func TestEngineShutdown(t *testing.T) {
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"))
+	accepted := make(chan Conn, 1)
+	e.OnConnect(func(conn Conn) error {
+		accepted <- conn
+		return nil
+	})
+	assert.NoError(t, e.Start())
+
+	cli, err := net.Dial("tcp", e.TCPRealListenAddr().String())
+	assert.NoError(t, err)
+	defer cli.Close()
+	conn := <-accepted
+
+	data := make([]byte, 1024*1024*4)
+	_, err = conn.Write(data)
+	assert.NoError(t, err)
+	received := make(chan int64, 1)
+	go func() {
+		n, _ := io.CopyN(io.Discard, cli, int64(len(data)))
+		received <- n
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	assert.NoError(t, e.Shutdown(ctx))
+	assert.Equal(t, int64(len(data)), <-received)
+}
+
+func TestFlushFairness(t *testing.T) {
+	const (
+		perConn = 1024 * 16
+		perTick = 1024 * 64
+	)
+	big := &DefaultConn{id: 1}
+	queued := map[Conn]int{big: 1024 * 1024 * 10}
+	conns := []Conn{big} // 输出缓冲区很大的连接排在最前面
+	for i := 0; i < 100; i++ {
+		c := &DefaultConn{id: int64(i + 2)}
+		queued[c] = 1024
+		conns = append(conns, c)
+	}
+	write := func(c Conn, max int) (int, int) {
+		n := queued[c]
+		if max > 0 && max < n {
+			n = max
+		}
+		queued[c] -= n
+		return n, queued[c]
+	}
+	pending := func(c Conn) int {
+		return queued[c]
+	}
+	dirty := func() []Conn {
+		var pending []Conn
+		for _, c := range conns {
+			if queued[c] > 0 {
+				pending = append(pending, c)
+			}
+		}
+		return pending
+	}
+
+	// 小的连接在两次内发送完
+	var f flushFairness
+	assert.Equal(t, 53, f.tick(dirty(), perConn, perTick, write, pending))
+	assert.Equal(t, 1, f.tick(dirty(), perConn, perTick, write, pending))
+	assert.Equal(t, []Conn{big}, dirty())
+
+	// 大的连接每次最多发送perTick，剩下的下次继续
+	ticks := 2
+	for len(dirty()) > 0 {
+		f.tick(dirty(), perConn, perTick, write, pending)
+		ticks++
+	}
+	assert.Equal(t, (1024*1024*10+1024*100+perTick-1)/perTick, ticks) // 每次都用完了预算
+	stats := f.stats()
+	assert.Equal(t, int64(ticks-1), stats.BudgetHitTicks)
+	assert.Equal(t, int64(1024*1024*10-perConn), stats.MaxCarryoverBytes)
+}
+
+func TestFlushFairnessUnlimited(t *testing.T) {
+	queued := map[Conn]int{}
+	var conns []Conn
+	for i := 0; i < 10; i++ {
+		c := &DefaultConn{id: int64(i + 1)}
+		queued[c] = 1024 * (i + 1)
+		conns = append(conns, c)
+	}
+	writes := 0
+	write := func(c Conn, max int) (int, int) {
+		writes++
+		n := queued[c]
+		if max > 0 && max < n {
+			n = max
+		}
+		queued[c] -= n
+		return n, queued[c]
+	}
+	pending := func(c Conn) int {
+		return queued[c]
+	}
+
+	// 不限制时一次发送完，每个连接只发送一次
+	var f flushFairness
+	assert.Equal(t, 0, f.tick(conns, 0, 0, write, pending))
+	assert.Equal(t, 10, writes)
+	assert.Equal(t, FlushFairnessStats{}, f.stats())
+
+	// 只限制每个连接时轮流发送到全部发送完
+	for i, c := range conns {
+		queued[c] = 1024 * (i + 1)
+	}
+	assert.Equal(t, 0, f.tick(conns, 1024, 0, write, pending))
+	assert.Equal(t, FlushFairnessStats{}, f.stats())
+}
+
+func TestEngineMaxFlushBytesPerConnPerTick(t *testing.T) {
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"), WithMaxFlushBytesPerConnPerTick(1024), WithMaxFlushBytesPerTick(1024*4))
+	accepted := make(chan Conn, 1)
+	e.OnConnect(func(conn Conn) error {
+		accepted <- conn
+		return nil
+	})
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	cli, err := net.Dial("tcp", e.TCPRealListenAddr().String())
+	assert.NoError(t, err)
+	defer cli.Close()
+	conn := <-accepted
+
+	// 每次最多发送1024字节，数据完整的发送完
+	data := make([]byte, 1024*1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	_, err = conn.Write(data)
+	assert.NoError(t, err)
+	pending, err := e.FlushAll(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, pending)
+
+	received := make([]byte, len(data))
+	_ = cli.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = io.ReadFull(cli, received)
+	assert.NoError(t, err)
+	assert.Equal(t, data, received)
+}
@@ -0,0 +1,205 @@
+package wknet
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// connGoroutines 一个连接通过Conn.Go启动的goroutine，连接关闭后ctx被取消
+type connGoroutines struct {
+	connID int64
+	uid    string
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	seq      uint64
+	live     map[uint64]string // goroutine序号 -> 调用Conn.Go的位置
+	closed   bool
+	closedAt time.Time
+}
+
+// goroutineRegistry 记录所有连接还存活的goroutine，连接关闭并且goroutine都结束后移除
+type goroutineRegistry struct {
+	mu    sync.Mutex
+	conns map[*connGoroutines]struct{}
+	total atomic.Int64
+}
+
+func newGoroutineRegistry() *goroutineRegistry {
+	return &goroutineRegistry{
+		conns: make(map[*connGoroutines]struct{}),
+	}
+}
+
+func (r *goroutineRegistry) register(connID int64, uid string) *connGoroutines {
+	ctx, cancel := context.WithCancel(context.Background())
+	g := &connGoroutines{
+		connID: connID,
+		uid:    uid,
+		ctx:    ctx,
+		cancel: cancel,
+		live:   make(map[uint64]string),
+	}
+	r.mu.Lock()
+	r.conns[g] = struct{}{}
+	r.mu.Unlock()
+	return g
+}
+
+func (r *goroutineRegistry) add(g *connGoroutines, caller string) uint64 {
+	g.mu.Lock()
+	g.seq++
+	id := g.seq
+	g.live[id] = caller
+	g.mu.Unlock()
+	r.total.Inc()
+	return id
+}
+
+func (r *goroutineRegistry) done(g *connGoroutines, id uint64) {
+	g.mu.Lock()
+	delete(g.live, id)
+	finished := g.closed && len(g.live) == 0
+	g.mu.Unlock()
+	r.total.Dec()
+	if finished {
+		r.remove(g)
+	}
+}
+
+// close 连接关闭，取消ctx，返回还存活的goroutine数量
+func (r *goroutineRegistry) close(g *connGoroutines) int {
+	g.cancel()
+	g.mu.Lock()
+	g.closed = true
+	g.closedAt = time.Now()
+	live := len(g.live)
+	g.mu.Unlock()
+	if live == 0 {
+		r.remove(g)
+	}
+	return live
+}
+
+func (r *goroutineRegistry) remove(g *connGoroutines) {
+	r.mu.Lock()
+	delete(r.conns, g)
+	r.mu.Unlock()
+}
+
+// counts 每个连接还存活的goroutine数量
+func (r *goroutineRegistry) counts() map[int64]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	counts := make(map[int64]int, len(r.conns))
+	for g := range r.conns {
+		if n := g.count(); n > 0 {
+			counts[g.connID] += n
+		}
+	}
+	return counts
+}
+
+func (g *connGoroutines) count() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.live)
+}
+
+// callers 还存活的goroutine的创建位置（按序号排序）
+func (g *connGoroutines) callers() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ids := make([]uint64, 0, len(g.live))
+	for id := range g.live {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	callers := make([]string, 0, len(ids))
+	for _, id := range ids {
+		callers = append(callers, g.live[id])
+	}
+	return callers
+}
+
+// checkLeak 连接关闭GoroutineLeakTimeout后还有存活的goroutine则打印创建位置
+func (e *Engine) checkGoroutineLeak(g *connGoroutines) {
+	callers := g.callers()
+	if len(callers) == 0 {
+		return
+	}
+	e.Warn("conn goroutines leak", zap.Int64("connID", g.connID), zap.String("uid", g.uid), zap.Duration("closedFor", time.Since(g.closedAt)), zap.Int("count", len(callers)), zap.Strings("callers", callers))
+}
+
+// Go 在受跟踪的goroutine里执行fn，连接关闭后ctx被取消，fn应该尽快返回
+// 连接关闭GoroutineLeakTimeout后fn还没返回会打印调用Go的位置，用于排查泄漏
+func (d *DefaultConn) Go(fn func(ctx context.Context)) error {
+	return d.goTracked(fn, goCaller())
+}
+
+func (d *DefaultConn) goTracked(fn func(ctx context.Context), caller string) error {
+	d.mu.Lock()
+	if d.closed.Load() {
+		d.mu.Unlock()
+		return net.ErrClosed
+	}
+	registry := d.eg.goroutines
+	if d.goroutines == nil {
+		d.goroutines = registry.register(d.id, d.uid)
+	}
+	g := d.goroutines
+	id := registry.add(g, caller)
+	d.mu.Unlock()
+
+	go func() {
+		defer registry.done(g, id)
+		defer func() {
+			if v := recover(); v != nil {
+				_ = d.eg.onHandlerPanic("Go", nil, nil, v, debug.Stack())
+			}
+		}()
+		fn(g.ctx)
+	}()
+	return nil
+}
+
+// closeGoroutines 连接关闭时取消goroutine的ctx，调用此方法需要加锁
+func (d *DefaultConn) closeGoroutines() {
+	g := d.goroutines
+	if g == nil {
+		return
+	}
+	if d.eg.goroutines.close(g) > 0 && d.eg.options.GoroutineLeakTimeout > 0 {
+		d.eg.timingWheel.AfterFunc(d.eg.options.GoroutineLeakTimeout, func() {
+			d.eg.checkGoroutineLeak(g)
+		})
+	}
+}
+
+// hasLiveGoroutines 是否还有通过Go启动的goroutine没结束
+func (d *DefaultConn) hasLiveGoroutines() bool {
+	return d.goroutines != nil && d.goroutines.count() > 0
+}
+
+func (t *TLSConn) Go(fn func(ctx context.Context)) error {
+	return t.d.goTracked(fn, goCaller())
+}
+
+// goCaller 调用Conn.Go的位置
+func goCaller() string {
+	_, file, line, ok := runtime.Caller(2)
+	if !ok {
+		return "unknown"
+	}
+	return fmt.Sprintf("%s:%d", file, line)
+}
@@ -0,0 +1,96 @@
+package wknet
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnGo(t *testing.T) {
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"), WithGoroutineLeakTimeout(time.Millisecond*50))
+	accepted := make(chan Conn, 1)
+	e.OnConnect(func(conn Conn) error {
+		accepted <- conn
+		return nil
+	})
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	cli, err := net.Dial("tcp", e.TCPRealListenAddr().String())
+	assert.NoError(t, err)
+	defer cli.Close()
+	conn := <-accepted
+	connID := conn.ID()
+
+	canceled := make(chan struct{})
+	err = conn.Go(func(ctx context.Context) {
+		<-ctx.Done()
+		close(canceled)
+	})
+	assert.NoError(t, err)
+	leak := make(chan struct{})
+	err = conn.Go(func(ctx context.Context) {
+		<-leak // 不关心ctx，模拟泄漏
+	})
+	assert.NoError(t, err)
+
+	stats := e.Stats()
+	assert.Equal(t, int64(2), stats.TrackedGoroutines)
+	assert.Equal(t, map[int64]int{connID: 2}, stats.ConnGoroutines)
+
+	assert.NoError(t, conn.Close())
+	select {
+	case <-canceled:
+	case <-time.After(time.Second * 5):
+		t.Fatal("ctx not canceled after conn close")
+	}
+	assert.ErrorIs(t, conn.Go(func(ctx context.Context) {}), net.ErrClosed)
+
+	// 关闭后还存活的goroutine
+	assert.Eventually(t, func() bool {
+		return e.Stats().TrackedGoroutines == 1
+	}, time.Second*5, time.Millisecond*10)
+	assert.Equal(t, map[int64]int{connID: 1}, e.Stats().ConnGoroutines)
+	var callers []string
+	e.goroutines.mu.Lock()
+	for g := range e.goroutines.conns {
+		callers = g.callers()
+	}
+	e.goroutines.mu.Unlock()
+	assert.Len(t, callers, 1)
+	assert.True(t, strings.Contains(callers[0], "goroutine_test.go"), callers[0])
+
+	close(leak)
+	assert.Eventually(t, func() bool {
+		return e.Stats().TrackedGoroutines == 0
+	}, time.Second*5, time.Millisecond*10)
+	assert.Empty(t, e.Stats().ConnGoroutines)
+	assert.Empty(t, e.goroutines.conns)
+}
+
+func TestConnGoPanic(t *testing.T) {
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"))
+	accepted := make(chan Conn, 1)
+	e.OnConnect(func(conn Conn) error {
+		accepted <- conn
+		return nil
+	})
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	cli, err := net.Dial("tcp", e.TCPRealListenAddr().String())
+	assert.NoError(t, err)
+	defer cli.Close()
+	conn := <-accepted
+
+	assert.NoError(t, conn.Go(func(ctx context.Context) {
+		panic("test")
+	}))
+	assert.Eventually(t, func() bool {
+		return e.PanicCount() == 1 && e.Stats().TrackedGoroutines == 0
+	}, time.Second*5, time.Millisecond*10)
+}
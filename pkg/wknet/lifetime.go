@@ -0,0 +1,108 @@
+package wknet
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrLifetimeExceeded 连接超过最长存活时间（Options.MaxConnLifetime），通知后在宽限期内客户端没有断开被关闭
+var ErrLifetimeExceeded = errors.New("connection lifetime exceeded")
+
+// OnLifetimeExceeded 连接超过最长存活时间时回调（比如发送建议重连到其他节点的帧），Options.ConnLifetimeGrace后客户端还没断开则关闭连接
+type OnLifetimeExceeded func(conn Conn)
+
+// ConnLifetimeStats 连接最长存活时间的统计
+type ConnLifetimeStats struct {
+	Notified int64 `json:"notified"` // 超过最长存活时间被通知的连接数量
+	Closed   int64 `json:"closed"`   // 通知后在宽限期内没有断开被关闭的连接数量
+}
+
+// OnLifetimeExceeded 设置连接超过最长存活时间的回调，没有设置时超过后直接关闭连接
+func (e *Engine) OnLifetimeExceeded(onLifetimeExceeded OnLifetimeExceeded) {
+	e.eventHandler.OnLifetimeExceeded = onLifetimeExceeded
+}
+
+// ConnLifetimeStats 连接最长存活时间的统计
+func (e *Engine) ConnLifetimeStats() ConnLifetimeStats {
+	return ConnLifetimeStats{
+		Notified: e.lifetimeNotified.Load(),
+		Closed:   e.lifetimeClosed.Load(),
+	}
+}
+
+// connLifetimeDeadline 连接的过期时间（unix nano），在MaxConnLifetime上按MaxConnLifetimeJitter随机增减，避免同时建立的连接同时断开，0表示不限制
+func (e *Engine) connLifetimeDeadline(uptime time.Time) int64 {
+	lifetime := e.options.MaxConnLifetime
+	if lifetime <= 0 {
+		return 0
+	}
+	if jitter := e.options.MaxConnLifetimeJitter; jitter > 0 {
+		lifetime += time.Duration((rand.Float64()*2 - 1) * float64(lifetime) * float64(jitter) / 100)
+	}
+	return uptime.Add(lifetime).UnixNano()
+}
+
+// connLifetimeTick 检查连接存活时间的间隔，最长存活时间的1/10，在[10ms,1s]之间
+func connLifetimeTick(lifetime time.Duration) time.Duration {
+	tick := lifetime / 10
+	if tick < time.Millisecond*10 {
+		return time.Millisecond * 10
+	}
+	if tick > time.Second {
+		return time.Second
+	}
+	return tick
+}
+
+// checkConnLifetime 通知超过最长存活时间的连接，通知后超过宽限期的关闭，每次最多处理ConnLifetimeBatch个，剩下的下次处理
+func (e *Engine) checkConnLifetime() {
+	now := time.Now()
+	budget := e.options.ConnLifetimeBatch
+	for _, conn := range e.GetAllConn() {
+		if budget <= 0 {
+			return
+		}
+		d := underlyingConn(conn)
+		if d == nil || d.closed.Load() || d.lifetimeExempt.Load() {
+			continue
+		}
+		deadline := d.lifetimeDeadline.Load()
+		if deadline == 0 || now.UnixNano() < deadline {
+			continue
+		}
+		handler := e.eventHandler.OnLifetimeExceeded
+		notifiedAt := d.lifetimeNotifiedAt.Load()
+		if notifiedAt == 0 && handler != nil {
+			d.lifetimeNotifiedAt.Store(now.UnixNano())
+			e.lifetimeNotified.Inc()
+			budget--
+			err := e.callHandler("OnLifetimeExceeded", conn, func() error {
+				handler(conn)
+				return nil
+			})
+			if err != nil {
+				_ = conn.CloseWithErr(err)
+			}
+			continue
+		}
+		if notifiedAt != 0 && now.Sub(time.Unix(0, notifiedAt)) < e.options.ConnLifetimeGrace {
+			continue
+		}
+		budget--
+		e.lifetimeClosed.Inc()
+		e.Debug("connection lifetime exceeded, close the connection", zap.Time("uptime", conn.Uptime()), zap.String("conn", d.String()))
+		_ = conn.CloseWithErr(ErrLifetimeExceeded)
+	}
+}
+
+// SetLifetimeExempt 设置连接不受最长存活时间（Options.MaxConnLifetime）限制，比如重要的内部连接
+func (d *DefaultConn) SetLifetimeExempt(exempt bool) {
+	d.lifetimeExempt.Store(exempt)
+}
+
+func (d *DefaultConn) IsLifetimeExempt() bool {
+	return d.lifetimeExempt.Load()
+}
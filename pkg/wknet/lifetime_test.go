@@ -0,0 +1,138 @@
+package wknet
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEngineMaxConnLifetime(t *testing.T) {
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"), WithMaxConnLifetime(time.Millisecond*200, 0), WithConnLifetimeGrace(time.Millisecond*200))
+	accepted := make(chan Conn, 2)
+	e.OnConnect(func(conn Conn) error {
+		accepted <- conn
+		return nil
+	})
+	notified := make(chan int64, 2)
+	e.OnLifetimeExceeded(func(conn Conn) {
+		notified <- conn.ID()
+		_, _ = conn.WriteToOutboundBuffer([]byte("reconnect"))
+		_ = conn.WakeWrite()
+	})
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	cli, err := net.Dial("tcp", e.TCPRealListenAddr().String())
+	assert.NoError(t, err)
+	defer cli.Close()
+	conn := <-accepted
+	exemptCli, err := net.Dial("tcp", e.TCPRealListenAddr().String())
+	assert.NoError(t, err)
+	defer exemptCli.Close()
+	exemptConn := <-accepted
+	exemptConn.SetLifetimeExempt(true)
+
+	// 先收到重连建议，客户端没有断开，宽限期后被关闭
+	select {
+	case id := <-notified:
+		assert.Equal(t, conn.ID(), id)
+	case <-time.After(time.Second * 2):
+		t.Fatal("lifetime exceeded not notified")
+	}
+	_ = cli.SetReadDeadline(time.Now().Add(time.Second * 2))
+	data, err := io.ReadAll(cli)
+	assert.NoError(t, err)
+	assert.Equal(t, "reconnect", string(data))
+	assert.Equal(t, ConnLifetimeStats{Notified: 1, Closed: 1}, e.ConnLifetimeStats())
+
+	// 豁免的连接不受影响
+	time.Sleep(time.Millisecond * 300)
+	assert.Len(t, notified, 0)
+	assert.False(t, exemptConn.IsClosed())
+	assert.Equal(t, 1, e.ConnCount())
+}
+
+func TestEngineMaxConnLifetimeJitter(t *testing.T) {
+	const (
+		clients  = 20
+		lifetime = time.Millisecond * 400
+	)
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"), WithMaxConnLifetime(lifetime, 50))
+	accepted := make(chan Conn, clients)
+	e.OnConnect(func(conn Conn) error {
+		accepted <- conn
+		return nil
+	})
+	var (
+		mu       sync.Mutex
+		closedAt []time.Time
+	)
+	e.OnClose(func(conn Conn) {
+		mu.Lock()
+		closedAt = append(closedAt, time.Now())
+		mu.Unlock()
+	})
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	for i := 0; i < clients; i++ {
+		cli, err := net.Dial("tcp", e.TCPRealListenAddr().String())
+		assert.NoError(t, err)
+		defer cli.Close()
+		conn := <-accepted
+		// 过期时间在[lifetime/2, lifetime*3/2]之间
+		age := time.Duration(underlyingConn(conn).lifetimeDeadline.Load() - conn.Uptime().UnixNano())
+		assert.GreaterOrEqual(t, age, lifetime/2)
+		assert.LessOrEqual(t, age, lifetime*3/2)
+	}
+
+	assert.Eventually(t, func() bool {
+		return e.ConnCount() == 0
+	}, time.Second*3, time.Millisecond*10)
+	assert.Equal(t, ConnLifetimeStats{Closed: clients}, e.ConnLifetimeStats())
+
+	// 随机增减后连接分散在不同的时间关闭
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, closedAt, clients)
+	first, last := closedAt[0], closedAt[0]
+	for _, at := range closedAt {
+		if at.Before(first) {
+			first = at
+		}
+		if at.After(last) {
+			last = at
+		}
+	}
+	assert.Greater(t, last.Sub(first), lifetime/4)
+}
+
+func TestEngineConnLifetimeBatch(t *testing.T) {
+	const clients = 6
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"), WithMaxConnLifetime(time.Hour, 0), WithConnLifetimeBatch(2))
+	accepted := make(chan Conn, clients)
+	e.OnConnect(func(conn Conn) error {
+		accepted <- conn
+		return nil
+	})
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	for i := 0; i < clients; i++ {
+		cli, err := net.Dial("tcp", e.TCPRealListenAddr().String())
+		assert.NoError(t, err)
+		defer cli.Close()
+		conn := <-accepted
+		underlyingConn(conn).lifetimeDeadline.Store(time.Now().UnixNano())
+	}
+
+	// 每次最多关闭ConnLifetimeBatch个
+	e.checkConnLifetime()
+	assert.Equal(t, int64(2), e.ConnLifetimeStats().Closed)
+	e.checkConnLifetime()
+	assert.Equal(t, int64(4), e.ConnLifetimeStats().Closed)
+}
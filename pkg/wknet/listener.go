@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"runtime"
 	"strings"
 	"syscall"
 
@@ -19,7 +20,7 @@ type listener struct {
 	customAddr    string
 	customNetwork string
 	realAddr      net.Addr
-	addr          string // 监听地址 格式为 tcp://xxx.xxx.xxx.xxx:xxxx
+	addr          string // 监听地址 格式为 tcp://xxx.xxx.xxx.xxx:xxxx，unix://path 或 unix-abstract://name（仅linux）
 	opts          *Options
 }
 
@@ -41,6 +42,9 @@ func (l *listener) init() error {
 	if strings.HasPrefix(network, "tcp") || strings.HasPrefix(network, "ws") {
 		return l.initTCPListener(network, addr)
 	}
+	if network == "unix" || network == "unix-abstract" {
+		return l.initUnixListener(network, addr)
+	}
 	return fmt.Errorf("unsupported network: %s", network)
 }
 
@@ -59,6 +63,18 @@ func (l *listener) initTCPListener(network, addr string) error {
 		sockOpt := socket.Option{SetSockOpt: socket.SetSendBuffer, Opt: opts.SocketSendBuffer}
 		sockOpts = append(sockOpts, sockOpt)
 	}
+	if opts.TCPDeferAccept > 0 {
+		secs := int(opts.TCPDeferAccept.Seconds())
+		if secs < 1 {
+			secs = 1
+		}
+		sockOpt := socket.Option{SetSockOpt: socket.SetDeferAccept, Opt: secs}
+		sockOpts = append(sockOpts, sockOpt)
+	}
+	if opts.TCPFastOpen > 0 {
+		sockOpt := socket.Option{SetSockOpt: socket.SetFastOpen, Opt: opts.TCPFastOpen}
+		sockOpts = append(sockOpts, sockOpt)
+	}
 	var (
 		err error
 	)
@@ -91,6 +107,23 @@ func (l *listener) initTCPListener(network, addr string) error {
 	return err
 }
 
+// initUnixListener 监听unix socket，unix-abstract为linux的抽象命名空间，不会在文件系统创建文件
+func (l *listener) initUnixListener(network, addr string) error {
+	if network == "unix-abstract" {
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("unsupported network: %s on %s", network, runtime.GOOS)
+		}
+		addr = "@" + addr
+	}
+	var err error
+	l.fd, _, err = socket.UnixSocket("unix", addr, true)
+	if err != nil {
+		return err
+	}
+	l.realAddr = &net.UnixAddr{Name: addr, Net: "unix"}
+	return nil
+}
+
 // addr format: tcp://xx.xxx.xx.xx:xxxx split
 func (l *listener) parseAddr(addr string) (network, address string, err error) {
 	if addr == "" {
@@ -115,6 +115,7 @@ func (l *listener) Polling(callback func(fd NetFd) error) {
 			continue
 		}
 		nfd := newNetFd(conn)
+		nfd.injector = l.opts.FaultInjector
 		err = callback(nfd)
 		if err != nil {
 			l.Error("polling error: %v", zap.Error(err))
@@ -4,11 +4,13 @@
 package wknet
 
 import (
+	wkio "github.com/WuKongIM/WuKongIM/pkg/wknet/io"
 	"golang.org/x/sys/unix"
 )
 
 type NetFd struct {
-	fd int
+	fd       int
+	injector FaultInjector // 故障注入（Options.FaultInjector），为nil表示不注入
 }
 
 func newNetFd(fd int) NetFd {
@@ -19,13 +21,32 @@ func newNetFd(fd int) NetFd {
 }
 
 func (n NetFd) Read(b []byte) (int, error) {
+	if n.injector != nil {
+		if err := injectRead(n.injector, n.fd); err != nil {
+			return 0, err
+		}
+	}
 	return unix.Read(n.fd, b)
 }
 
 func (n NetFd) Write(b []byte) (int, error) {
+	if n.injector != nil {
+		var err error
+		if b, err = injectWrite(n.injector, n.fd, b); err != nil {
+			return 0, err
+		}
+	}
 	return unix.Write(n.fd, b)
 }
 
+// Writev writes the multiple data segments with a single system call.
+func (n NetFd) Writev(bufs [][]byte) (int, error) {
+	if n.injector != nil {
+		return n.Write(joinBuffers(bufs))
+	}
+	return wkio.Writev(n.fd, bufs)
+}
+
 func (n NetFd) Close() error {
 	return unix.Close(n.fd)
 }
@@ -9,8 +9,9 @@ import (
 )
 
 type NetFd struct {
-	conn net.Conn
-	fd   int
+	conn     net.Conn
+	fd       int
+	injector FaultInjector // 故障注入（Options.FaultInjector），为nil表示不注入
 }
 
 func newNetFd(conn net.Conn) NetFd {
@@ -28,6 +29,11 @@ func (n NetFd) Read(b []byte) (int, error) {
 	if n.conn == nil {
 		return 0, errors.New("conn is nil")
 	}
+	if n.injector != nil {
+		if err := injectRead(n.injector, n.fd); err != nil {
+			return 0, err
+		}
+	}
 	return n.conn.Read(b)
 }
 
@@ -35,9 +41,28 @@ func (n NetFd) Write(b []byte) (int, error) {
 	if n.conn == nil {
 		return 0, errors.New("conn is nil")
 	}
+	if n.injector != nil {
+		var err error
+		if b, err = injectWrite(n.injector, n.fd, b); err != nil {
+			return 0, err
+		}
+	}
 	return n.conn.Write(b)
 }
 
+// Writev writes the multiple data segments.
+func (n NetFd) Writev(bufs [][]byte) (int, error) {
+	if n.conn == nil {
+		return 0, errors.New("conn is nil")
+	}
+	if n.injector != nil {
+		return n.Write(joinBuffers(bufs))
+	}
+	buffers := net.Buffers(bufs)
+	written, err := buffers.WriteTo(n.conn)
+	return int(written), err
+}
+
 func (n NetFd) Close() error {
 	if n.conn == nil {
 		return errors.New("conn is nil")
@@ -0,0 +1,321 @@
+package wknet
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// netConnCloseFlushTimeout 关闭时等待输出缓冲区数据发送完的最长时间
+const netConnCloseFlushTimeout = time.Second * 5
+
+// NetConnAdapter 把engine接收的连接适配为阻塞的net.Conn，方便在上面使用标准库（yamux，smux，grpc等）
+// 适配后连接的数据不再回调OnData，只能通过返回的net.Conn读取，只支持tcp连接（*DefaultConn）
+// 适配前reactor不加锁读写输入缓冲区，需要在对端发送数据之前适配（比如在OnConnect里或者由服务端先发数据的协议）
+func NetConnAdapter(c Conn) net.Conn {
+	d, ok := c.(*DefaultConn)
+	if !ok {
+		panic("NetConnAdapter only supports tcp conn")
+	}
+	nc := &netConn{
+		d:           d,
+		readSignal:  make(chan struct{}, 1),
+		writeSignal: make(chan struct{}, 1),
+		closeChan:   make(chan struct{}),
+	}
+	nc.readDeadline.init()
+	nc.writeDeadline.init()
+	d.attachNetConn(nc)
+	return nc
+}
+
+type netConn struct {
+	d           *DefaultConn
+	readSignal  chan struct{} // 输入缓冲区有新数据
+	writeSignal chan struct{} // 输出缓冲区有数据发送出去了
+	closeChan   chan struct{} // 连接关闭
+	closeOnce   sync.Once
+
+	readMu  sync.Mutex
+	writeMu sync.Mutex
+
+	mu          sync.Mutex
+	closed      bool   // 连接已关闭
+	localClosed bool   // 调用了Close
+	pending     []byte // 连接关闭时输入缓冲区里还没读取的数据
+
+	readDeadline  netConnDeadline
+	writeDeadline netConnDeadline
+}
+
+func (n *netConn) Read(b []byte) (int, error) {
+	n.readMu.Lock()
+	defer n.readMu.Unlock()
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for {
+		if n.readDeadline.exceeded() {
+			return 0, os.ErrDeadlineExceeded
+		}
+		num, closed := n.d.readInboundForNetConn(b)
+		if num > 0 {
+			return num, nil
+		}
+		if closed {
+			return n.readPending(b)
+		}
+		if err := n.wait(n.readSignal, &n.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (n *netConn) readPending(b []byte) (int, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.localClosed {
+		return 0, net.ErrClosed
+	}
+	if len(n.pending) == 0 {
+		return 0, io.EOF
+	}
+	num := copy(b, n.pending)
+	n.pending = n.pending[num:]
+	return num, nil
+}
+
+func (n *netConn) Write(b []byte) (int, error) {
+	n.writeMu.Lock()
+	defer n.writeMu.Unlock()
+	var total int
+	for total < len(b) {
+		if n.writeDeadline.exceeded() {
+			return total, os.ErrDeadlineExceeded
+		}
+		num, err := n.d.writeOutboundForNetConn(b[total:])
+		if err != nil {
+			return total, err
+		}
+		total += num
+		if total == len(b) {
+			break
+		}
+		if num == 0 { // 输出缓冲区满了，等待数据发送出去
+			if err = n.wait(n.writeSignal, &n.writeDeadline); err != nil {
+				return total, err
+			}
+		}
+	}
+	return total, nil
+}
+
+// wait 等待信号，连接关闭或deadline被修改时也会返回
+func (n *netConn) wait(signal chan struct{}, deadline *netConnDeadline) error {
+	t, changed := deadline.get()
+	var timeout <-chan time.Time
+	if !t.IsZero() {
+		d := time.Until(t)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-signal:
+	case <-changed:
+	case <-n.closeChan:
+		if n.isLocalClosed() {
+			return net.ErrClosed
+		}
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+func (n *netConn) Close() error {
+	err := net.ErrClosed
+	n.closeOnce.Do(func() {
+		n.flushBeforeClose()
+		n.mu.Lock()
+		n.localClosed = true
+		n.mu.Unlock()
+		err = n.d.Close()
+		n.notifyClosed(nil) // 连接可能已经被关闭了，这里确保唤醒等待的读写
+	})
+	return err
+}
+
+// flushBeforeClose 关闭前等待输出缓冲区的数据发送完
+func (n *netConn) flushBeforeClose() {
+	timeout := time.NewTimer(netConnCloseFlushTimeout)
+	defer timeout.Stop()
+	for {
+		buffered, closed := n.d.outboundBuffered()
+		if closed || buffered == 0 {
+			return
+		}
+		select {
+		case <-n.writeSignal:
+		case <-n.closeChan:
+			return
+		case <-timeout.C:
+			return
+		}
+	}
+}
+
+func (n *netConn) LocalAddr() net.Addr {
+	return n.d.LocalAddr()
+}
+
+func (n *netConn) RemoteAddr() net.Addr {
+	return n.d.RemoteAddr()
+}
+
+func (n *netConn) SetDeadline(t time.Time) error {
+	n.readDeadline.set(t)
+	n.writeDeadline.set(t)
+	return nil
+}
+
+func (n *netConn) SetReadDeadline(t time.Time) error {
+	n.readDeadline.set(t)
+	return nil
+}
+
+func (n *netConn) SetWriteDeadline(t time.Time) error {
+	n.writeDeadline.set(t)
+	return nil
+}
+
+func (n *netConn) isLocalClosed() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.localClosed
+}
+
+func (n *netConn) notifyRead() {
+	select {
+	case n.readSignal <- struct{}{}:
+	default:
+	}
+}
+
+func (n *netConn) notifyWrite() {
+	select {
+	case n.writeSignal <- struct{}{}:
+	default:
+	}
+}
+
+// notifyClosed 连接关闭，pending为输入缓冲区里还没读取的数据
+func (n *netConn) notifyClosed(pending []byte) {
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		n.pending = pending
+		close(n.closeChan)
+	}
+	n.mu.Unlock()
+}
+
+type netConnDeadline struct {
+	mu      sync.Mutex
+	t       time.Time
+	changed chan struct{} // deadline修改后关闭，唤醒等待者
+}
+
+func (d *netConnDeadline) init() {
+	d.changed = make(chan struct{})
+}
+
+func (d *netConnDeadline) set(t time.Time) {
+	d.mu.Lock()
+	d.t = t
+	close(d.changed)
+	d.changed = make(chan struct{})
+	d.mu.Unlock()
+}
+
+func (d *netConnDeadline) get() (time.Time, chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.t, d.changed
+}
+
+func (d *netConnDeadline) exceeded() bool {
+	t, _ := d.get()
+	return !t.IsZero() && !time.Now().Before(t)
+}
+
+// isNetConn 连接是否已经适配为net.Conn
+func isNetConn(c Conn) bool {
+	d, ok := c.(*DefaultConn)
+	return ok && d.netConnAttached.Load()
+}
+
+func (d *DefaultConn) attachNetConn(nc *netConn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.netConn = nc
+	d.netConnAttached.Store(true)
+	if d.closed.Load() {
+		nc.notifyClosed(nil)
+	}
+	if !d.inboundBuffer.IsEmpty() { // 适配前已经收到的数据
+		nc.notifyRead()
+	}
+}
+
+// readInboundForNetConn 从输入缓冲区读取数据，连接关闭后返回closed为true
+func (d *DefaultConn) readInboundForNetConn(b []byte) (n int, closed bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed.Load() {
+		return 0, true
+	}
+	if d.inboundBuffer.IsEmpty() {
+		return 0, false
+	}
+	n, _ = d.inboundBuffer.Read(b)
+	return n, false
+}
+
+// writeOutboundForNetConn 在输出缓冲区不超过MaxWriteBufferSize的情况下尽量写入数据
+func (d *DefaultConn) writeOutboundForNetConn(b []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	if maxSize := d.eg.options.MaxWriteBufferSize; maxSize > 0 {
+		room := maxSize - d.outboundBuffer.BoundBufferSize()
+		if room <= 0 {
+			return 0, nil
+		}
+		if room < len(b) {
+			b = b[:room]
+		}
+	}
+	n, err := d.writeOutbound(b)
+	if err != nil {
+		return n, err
+	}
+	return n, d.addWriteIfNotExist()
+}
+
+// outboundBuffered 输出缓冲区的数据大小，连接关闭后返回closed为true
+func (d *DefaultConn) outboundBuffered() (int, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed.Load() {
+		return 0, true
+	}
+	return d.outboundBuffer.BoundBufferSize(), false
+}
@@ -0,0 +1,34 @@
+package wknet
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/nettest"
+)
+
+func TestNetConnAdapter(t *testing.T) {
+	nettest.TestConn(t, func() (c1, c2 net.Conn, stop func(), err error) {
+		e := NewEngine(WithAddr("tcp://127.0.0.1:0"))
+		accepted := make(chan Conn, 1)
+		e.OnConnect(func(conn Conn) error {
+			accepted <- conn
+			return nil
+		})
+		if err = e.Start(); err != nil {
+			return nil, nil, nil, err
+		}
+		c2, err = net.Dial("tcp", e.TCPRealListenAddr().String())
+		if err != nil {
+			_ = e.Stop()
+			return nil, nil, nil, err
+		}
+		c1 = NetConnAdapter(<-accepted)
+		stop = func() {
+			_ = c1.Close()
+			_ = c2.Close()
+			_ = e.Stop()
+		}
+		return c1, c2, stop, nil
+	})
+}
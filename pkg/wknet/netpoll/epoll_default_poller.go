@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"sync"
 
 	"github.com/WuKongIM/WuKongIM/pkg/wklog"
 	"go.uber.org/atomic"
@@ -24,6 +25,8 @@ type Poller struct {
 	efd      int
 	shutdown atomic.Bool
 	name     string
+	tasks    taskQueue
+	closeMu  sync.RWMutex // 保证Close和Trigger写efd时efd还没有被Polling关闭
 }
 
 func NewPoller(index int, name string) *Poller {
@@ -75,6 +78,10 @@ func (p *Poller) Polling(callback func(fd int, event PollEvent) error) error {
 		for i := 0; i < n; i++ {
 			evt := el.events[i]
 			fd := evt.Fd
+			if int(fd) == p.efd { // Trigger唤醒
+				p.runTasks()
+				continue
+			}
 			pollEvent = PollEventUnknown
 			triggerRead = evt.Events&readEvents != 0
 			triggerWrite = evt.Events&unix.EPOLLOUT != 0
@@ -108,6 +115,7 @@ func (p *Poller) Polling(callback func(fd int, event PollEvent) error) error {
 			el.shrink()
 		}
 	}
+	_ = p.close()
 	return nil
 }
 
@@ -141,6 +149,16 @@ func (p *Poller) DeleteWrite(fd int) error {
 		unix.EpollCtl(p.fd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Fd: int32(fd), Events: readEvents}))
 }
 
+// DisableRead 不再监听可读事件，writing为true时只监听可写事件（连接关闭等错误事件总是会通知）
+func (p *Poller) DisableRead(fd int, writing bool) error {
+	var events uint32
+	if writing {
+		events = writeEvents
+	}
+	return os.NewSyscallError("epoll_ctl mod",
+		unix.EpollCtl(p.fd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Fd: int32(fd), Events: events}))
+}
+
 func (p *Poller) DeleteReadAndWrite(fd int) error {
 	return os.NewSyscallError("epoll_ctl delete",
 		unix.EpollCtl(p.fd, unix.EPOLL_CTL_DEL, fd, &unix.EpollEvent{Fd: int32(fd), Events: readWriteEvents}))
@@ -151,8 +169,49 @@ func (p *Poller) Delete(fd int) error {
 	return err
 }
 
+// Trigger 在poller的goroutine里执行task
+func (p *Poller) Trigger(task func()) error {
+	if p.shutdown.Load() {
+		return ErrPollerClosed
+	}
+	p.closeMu.RLock()
+	defer p.closeMu.RUnlock()
+	if p.shutdown.Load() { // 拿到锁之前Close或者close已经执行，efd可能已经关闭（fd号可能已经被复用）
+		return ErrPollerClosed
+	}
+	p.tasks.push(task)
+	var b = [8]byte{0, 0, 0, 0, 0, 0, 0, 1}
+	if _, err := unix.Write(p.efd, b[:]); err != nil && err != unix.EAGAIN {
+		return os.NewSyscallError("write", err)
+	}
+	return nil
+}
+
+func (p *Poller) runTasks() {
+	var b [8]byte
+	_, _ = unix.Read(p.efd, b[:])
+	p.tasks.run()
+}
+
 // Close closes the poller.
 func (p *Poller) Close() error {
-	p.shutdown.Store(true)
-	return os.NewSyscallError("close", unix.Close(p.efd))
+	p.closeMu.Lock()
+	defer p.closeMu.Unlock()
+	if p.shutdown.Swap(true) {
+		return nil
+	}
+	var b = [8]byte{0, 0, 0, 0, 0, 0, 0, 1}
+	if _, err := unix.Write(p.efd, b[:]); err != nil && err != unix.EAGAIN { // 唤醒Polling，退出后再关闭fd，这里直接关闭efd会丢掉唤醒事件
+		return os.NewSyscallError("write", err)
+	}
+	return nil
+}
+
+// close closes the poller.
+func (p *Poller) close() error {
+	p.closeMu.Lock()
+	defer p.closeMu.Unlock()
+	p.shutdown.Store(true) // Polling出错返回时shutdown还是false，之后的Trigger不能再写efd
+	_ = unix.Close(p.efd)
+	return os.NewSyscallError("close", unix.Close(p.fd))
 }
@@ -9,9 +9,11 @@
 package netpoll
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"runtime"
+	"sync"
 	"syscall"
 
 	"github.com/WuKongIM/WuKongIM/pkg/wklog"
@@ -25,6 +27,8 @@ type Poller struct {
 	wklog.Log
 	shutdown atomic.Bool
 	name     string
+	tasks    taskQueue
+	closeMu  sync.RWMutex // 保证Close和Trigger触发时fd还没有被Polling关闭
 }
 
 // NewPoller instantiates a poller.
@@ -102,8 +106,8 @@ func (p *Poller) Polling(callback func(fd int, event PollEvent) error) error {
 					}
 				}
 
-			} else {
-				p.Debug("trigger......")
+			} else { // Trigger唤醒
+				p.tasks.run()
 			}
 
 		}
@@ -150,6 +154,20 @@ func (p *Poller) DeleteWrite(fd int) error {
 	return os.NewSyscallError("kevent delete", err)
 }
 
+// DisableRead 不再监听可读事件，writing为true时只监听可写事件
+func (p *Poller) DisableRead(fd int, writing bool) error {
+	if err := p.DeleteRead(fd); err != nil && !errors.Is(err, unix.ENOENT) {
+		return err
+	}
+	if writing {
+		return p.AddWrite(fd)
+	}
+	if err := p.DeleteWrite(fd); err != nil && !errors.Is(err, unix.ENOENT) {
+		return err
+	}
+	return nil
+}
+
 func (p *Poller) DeleteReadAndWrite(fd int) error {
 
 	_, err := unix.Kevent(p.fd, []unix.Kevent_t{
@@ -165,16 +183,38 @@ func (p *Poller) Delete(fd int) error {
 
 func (p *Poller) Close() error {
 	p.Debug("close")
-	p.shutdown.Store(true)
+	p.closeMu.Lock()
+	defer p.closeMu.Unlock()
+	if p.shutdown.Swap(true) {
+		return nil
+	}
 	p.trigger()
 	return nil
 }
 
 // close closes the poller.
 func (p *Poller) close() error {
+	p.closeMu.Lock()
+	defer p.closeMu.Unlock()
+	p.shutdown.Store(true)
 	return os.NewSyscallError("close", unix.Close(p.fd))
 }
 
+// Trigger 在poller的goroutine里执行task
+func (p *Poller) Trigger(task func()) error {
+	if p.shutdown.Load() {
+		return ErrPollerClosed
+	}
+	p.closeMu.RLock()
+	defer p.closeMu.RUnlock()
+	if p.shutdown.Load() { // 拿到锁之前Close或者close已经执行，fd可能已经关闭
+		return ErrPollerClosed
+	}
+	p.tasks.push(task)
+	p.trigger()
+	return nil
+}
+
 func (p *Poller) trigger() {
 	_, _ = unix.Kevent(p.fd, []unix.Kevent_t{{Ident: 0, Filter: unix.EVFILT_USER, Fflags: unix.NOTE_TRIGGER}}, nil, nil)
 }
@@ -0,0 +1,32 @@
+package netpoll
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrPollerClosed poller已经关闭
+var ErrPollerClosed = errors.New("poller closed")
+
+// taskQueue 需要在poller的goroutine里执行的任务
+type taskQueue struct {
+	mu    sync.Mutex
+	tasks []func()
+}
+
+func (q *taskQueue) push(task func()) {
+	q.mu.Lock()
+	q.tasks = append(q.tasks, task)
+	q.mu.Unlock()
+}
+
+// run 执行所有的任务，执行期间新加入的任务下次执行
+func (q *taskQueue) run() {
+	q.mu.Lock()
+	tasks := q.tasks
+	q.tasks = nil
+	q.mu.Unlock()
+	for _, task := range tasks {
+		task()
+	}
+}
@@ -26,24 +26,101 @@ type Options struct {
 	ReadBufferSize int
 	// MaxWriteBufferSize is the write maximum size of the buffer for each connection
 	MaxWriteBufferSize int
+	// MaxReactorOutboundBytes 每个sub reactor所有连接输出缓冲区的总大小上限，超过后从输出缓冲区最大的连接开始关闭（ErrSlowConsumer），0表示不限制
+	MaxReactorOutboundBytes int64
+	// MaxFlushBytesPerConnPerTick 每个连接每次最多发送的数据大小，没发送完的轮流发送，避免输出缓冲区很大的连接让其他连接等待，0表示不限制
+	MaxFlushBytesPerConnPerTick int
+	// MaxFlushBytesPerTick 每个sub reactor一次发送（FlushAll）最多发送的数据大小，没发送完的连接下次优先发送，0表示不限制
+	MaxFlushBytesPerTick int
 	// MaxReadBufferSize is the read maximum size of the buffer for each connection
 	MaxReadBufferSize int
+	// MaxFramesPerDecode 每次回调OnData最多解码的帧数量（由OnData通过Engine.MaxFramesPerDecode获取），还有完整的帧时OnData返回ErrDecodePending，下一轮事件循环继续解码，避免一次发送大量帧的连接让其他连接等待，0表示不限制
+	MaxFramesPerDecode int
 	// SocketRecvBuffer sets the maximum socket receive buffer in bytes.
 	SocketRecvBuffer int
 	// SocketSendBuffer sets the maximum socket send buffer in bytes.
 	SocketSendBuffer int
 	// TCPKeepAlive sets up a duration for (SO_KEEPALIVE) socket option.
 	TCPKeepAlive time.Duration
+	// TCPDeferAccept sets up a duration for (TCP_DEFER_ACCEPT) socket option on listening socket, only supported on linux.
+	TCPDeferAccept time.Duration
+	// TCPFastOpen sets the pending SYN queue length for (TCP_FASTOPEN) socket option on listening socket, only supported on linux.
+	TCPFastOpen int
+	// DebugExpire 调试连接设置的有效时长，过期后自动关闭调试日志
+	DebugExpire time.Duration
+	// PanicHandler 事件回调panic后的自定义处理（比如上报到sentry）
+	PanicHandler PanicHandler
+	// MaxConnPanics 同一个连接的事件回调panic达到此次数后不再回调此连接的事件，0表示不限制
+	MaxConnPanics int
+	// StreamLowWatermark WriteStream时输出缓冲区的数据低于此大小才写入下一个分片
+	StreamLowWatermark int
+	// TLSMode 配置了TCPTLSConfig时tcp端口的tls模式
+	TLSMode TLSMode
+	// TLSSniffTimeout 新连接等待第一个包判断是否是tls的最长时间，超时后TLSModeOpportunistic按明文连接处理，TLSModeRequired关闭连接
+	TLSSniffTimeout time.Duration
+	// TLSPolicies 每个tls监听端口（ListenerTCP和ListenerWSS）的最低版本和加密套件策略，没有配置表示不限制（只统计，见Engine.TLSUsageReport）
+	TLSPolicies map[Listener]*TLSPolicy
+	// GoroutineLeakTimeout 连接关闭后通过Conn.Go启动的goroutine超过此时间还没结束则打印创建位置，0表示不检查
+	GoroutineLeakTimeout time.Duration
+	// FastPing 心跳快速处理，为nil表示不开启
+	FastPing *FastPing
+	// AllowCIDRs 每个监听端口允许连接的网段（也可以是单个ip），没有配置表示允许所有
+	AllowCIDRs map[Listener][]string
+	// DenyCIDRs 每个监听端口拒绝连接的网段，优先于AllowCIDRs
+	DenyCIDRs map[Listener][]string
+	// ReactorCPUAffinity sub reactor绑定cpu（只支持linux），为nil表示不绑定
+	ReactorCPUAffinity *CPUAffinity
+	// TCPInfoSampleInterval 每隔多久采样一次所有连接的tcp链路质量（记录到ConnStats.LastTCPInfo），0表示不采样
+	TCPInfoSampleInterval time.Duration
+	// DeviceStatsInterval 每隔多久把所有连接ConnStats的流入流出字节汇总到设备类型（设备标记和设备等级）的统计，0表示只在连接切换设备类型和关闭时汇总
+	DeviceStatsInterval time.Duration
+	// WSUpgradeValidator 校验websocket升级请求（比如Origin），返回错误则响应403并关闭连接，为nil表示不校验
+	WSUpgradeValidator WSUpgradeValidator
+	// WSLabelHeaders websocket升级请求里需要保存到连接上的请求头（比如租户id，客户端版本），通过conn.Value(WSHeaderValueKey(name))获取
+	WSLabelHeaders []string
+	// MaxWSHandshakeBytes websocket升级请求（请求行和请求头）的最大字节数，超过后响应431并关闭连接，0表示不限制
+	MaxWSHandshakeBytes int
+	// WSHandshakeTimeout 连接建立后多久没有完成websocket握手则关闭连接（比如只发了部分请求头的慢客户端），0表示不限制
+	WSHandshakeTimeout time.Duration
+	// EventBufferSize Engine.Events()连接生命周期事件的缓冲区大小，缓冲区满了事件会被丢弃，0表示不发送事件
+	EventBufferSize int
+	// FaultInjector 连接读写fd前的故障注入（用于集成测试模拟网络延迟、短写和错误），为nil表示不注入
+	FaultInjector FaultInjector
+	// MaxConnLifetime 连接的最长存活时间，超过后回调OnLifetimeExceeded（让客户端重连到其他节点，使各节点的连接重新均衡），0表示不限制
+	MaxConnLifetime time.Duration
+	// MaxConnLifetimeJitter 每个连接的最长存活时间随机增减的百分比（[0,100)），避免同时建立的连接同时断开
+	MaxConnLifetimeJitter int
+	// ConnLifetimeGrace 回调OnLifetimeExceeded后等待客户端主动断开的时间，超过后关闭连接（ErrLifetimeExceeded）
+	ConnLifetimeGrace time.Duration
+	// ConnLifetimeBatch 每次检查最多通知或关闭的连接数量，剩下的下次检查时处理
+	ConnLifetimeBatch int
+	// ShutdownPhaseTimeout Shutdown每个阶段（ShutdownPhase）最长的执行时间，超过后跳过这个阶段还没执行完的钩子进入下一个阶段，0表示不限制（只受Shutdown的ctx限制）
+	ShutdownPhaseTimeout time.Duration
+	// ShutdownPhaseTimeouts 单独设置某些阶段最长的执行时间，没有设置的阶段使用ShutdownPhaseTimeout
+	ShutdownPhaseTimeouts map[ShutdownPhase]time.Duration
+	// DeliveryLatencySampleRate 投递延迟（数据写入输出缓冲区到完全写入fd）的采样率（(0,1]，1表示每次写入都采样），0表示不统计，见Engine.DeliveryLatencyStats
+	DeliveryLatencySampleRate float64
 }
 
 func NewOptions() *Options {
 	return &Options{
-		Addr:               "tcp://127.0.0.1:5100",
-		MaxOpenFiles:       GetMaxOpenFiles(),
-		SubReactorNum:      runtime.NumCPU(),
-		ReadBufferSize:     1024 * 32,
-		MaxWriteBufferSize: 1024 * 1024 * 50,
-		MaxReadBufferSize:  1024 * 1024 * 50,
+		Addr:                 "tcp://127.0.0.1:5100",
+		MaxOpenFiles:         GetMaxOpenFiles(),
+		SubReactorNum:        runtime.NumCPU(),
+		ReadBufferSize:       1024 * 32,
+		MaxWriteBufferSize:   1024 * 1024 * 50,
+		MaxReadBufferSize:    1024 * 1024 * 50,
+		DebugExpire:          time.Minute * 10,
+		MaxConnPanics:        3,
+		StreamLowWatermark:   1024 * 64,
+		TLSSniffTimeout:      time.Second * 5,
+		GoroutineLeakTimeout: time.Second * 10,
+		ConnLifetimeGrace:    time.Second * 30,
+		ConnLifetimeBatch:    100,
+		ShutdownPhaseTimeout: time.Second * 10,
+		MaxWSHandshakeBytes:  1024 * 8,
+		WSHandshakeTimeout:   time.Second * 10,
+		DeviceStatsInterval:  time.Second * 5,
 	}
 }
 
@@ -114,3 +191,234 @@ func WithTCPKeepAlive(v time.Duration) Option {
 		opts.TCPKeepAlive = v
 	}
 }
+
+// WithTCPDeferAccept set TCP_DEFER_ACCEPT duration, only supported on linux
+func WithTCPDeferAccept(v time.Duration) Option {
+	return func(opts *Options) {
+		opts.TCPDeferAccept = v
+	}
+}
+
+// WithTCPFastOpen set TCP_FASTOPEN queue length, only supported on linux
+func WithTCPFastOpen(v int) Option {
+	return func(opts *Options) {
+		opts.TCPFastOpen = v
+	}
+}
+
+// WithDebugExpire 设置调试连接设置的有效时长
+func WithDebugExpire(v time.Duration) Option {
+	return func(opts *Options) {
+		opts.DebugExpire = v
+	}
+}
+
+// WithPanicHandler 设置事件回调panic后的自定义处理
+func WithPanicHandler(v PanicHandler) Option {
+	return func(opts *Options) {
+		opts.PanicHandler = v
+	}
+}
+
+// WithMaxConnPanics 设置同一个连接的事件回调最多panic的次数
+func WithMaxConnPanics(v int) Option {
+	return func(opts *Options) {
+		opts.MaxConnPanics = v
+	}
+}
+
+// WithMaxReactorOutboundBytes 设置每个sub reactor所有连接输出缓冲区的总大小上限
+func WithMaxReactorOutboundBytes(v int64) Option {
+	return func(opts *Options) {
+		opts.MaxReactorOutboundBytes = v
+	}
+}
+
+// WithMaxFlushBytesPerConnPerTick 设置每个连接每次最多发送的数据大小
+func WithMaxFlushBytesPerConnPerTick(v int) Option {
+	return func(opts *Options) {
+		opts.MaxFlushBytesPerConnPerTick = v
+	}
+}
+
+// WithMaxFlushBytesPerTick 设置每个sub reactor一次发送最多发送的数据大小
+func WithMaxFlushBytesPerTick(v int) Option {
+	return func(opts *Options) {
+		opts.MaxFlushBytesPerTick = v
+	}
+}
+
+// WithMaxFramesPerDecode 设置每次回调OnData最多解码的帧数量
+func WithMaxFramesPerDecode(v int) Option {
+	return func(opts *Options) {
+		opts.MaxFramesPerDecode = v
+	}
+}
+
+// WithStreamLowWatermark 设置WriteStream的输出缓冲区低水位
+func WithStreamLowWatermark(v int) Option {
+	return func(opts *Options) {
+		opts.StreamLowWatermark = v
+	}
+}
+
+// WithTLSMode 设置tcp端口的tls模式
+func WithTLSMode(v TLSMode) Option {
+	return func(opts *Options) {
+		opts.TLSMode = v
+	}
+}
+
+// WithTLSSniffTimeout 设置新连接判断是否是tls的超时时间
+func WithTLSSniffTimeout(v time.Duration) Option {
+	return func(opts *Options) {
+		opts.TLSSniffTimeout = v
+	}
+}
+
+// WithTLSPolicy 设置tls监听端口的最低版本和加密套件策略
+func WithTLSPolicy(l Listener, policy *TLSPolicy) Option {
+	return func(opts *Options) {
+		if opts.TLSPolicies == nil {
+			opts.TLSPolicies = make(map[Listener]*TLSPolicy)
+		}
+		opts.TLSPolicies[l] = policy
+	}
+}
+
+// WithGoroutineLeakTimeout 设置连接关闭后检查goroutine泄漏的时间
+func WithGoroutineLeakTimeout(v time.Duration) Option {
+	return func(opts *Options) {
+		opts.GoroutineLeakTimeout = v
+	}
+}
+
+// WithAllowCIDRs 设置监听端口允许连接的网段
+func WithAllowCIDRs(l Listener, cidrs ...string) Option {
+	return func(opts *Options) {
+		if opts.AllowCIDRs == nil {
+			opts.AllowCIDRs = make(map[Listener][]string)
+		}
+		opts.AllowCIDRs[l] = cidrs
+	}
+}
+
+// WithDenyCIDRs 设置监听端口拒绝连接的网段
+func WithDenyCIDRs(l Listener, cidrs ...string) Option {
+	return func(opts *Options) {
+		if opts.DenyCIDRs == nil {
+			opts.DenyCIDRs = make(map[Listener][]string)
+		}
+		opts.DenyCIDRs[l] = cidrs
+	}
+}
+
+// WithReactorCPUAffinity 设置sub reactor绑定cpu
+func WithReactorCPUAffinity(v *CPUAffinity) Option {
+	return func(opts *Options) {
+		opts.ReactorCPUAffinity = v
+	}
+}
+
+// WithTCPInfoSampleInterval 设置tcp链路质量的采样间隔
+func WithTCPInfoSampleInterval(v time.Duration) Option {
+	return func(opts *Options) {
+		opts.TCPInfoSampleInterval = v
+	}
+}
+
+// WithFastPing 设置心跳快速处理
+func WithWSUpgradeValidator(v WSUpgradeValidator) Option {
+	return func(opts *Options) {
+		opts.WSUpgradeValidator = v
+	}
+}
+
+func WithWSLabelHeaders(headers ...string) Option {
+	return func(opts *Options) {
+		opts.WSLabelHeaders = headers
+	}
+}
+
+// WithMaxWSHandshakeBytes 设置websocket升级请求的最大字节数
+func WithMaxWSHandshakeBytes(v int) Option {
+	return func(opts *Options) {
+		opts.MaxWSHandshakeBytes = v
+	}
+}
+
+// WithDeviceStatsInterval 设置按设备类型汇总连接流量的间隔
+func WithDeviceStatsInterval(v time.Duration) Option {
+	return func(opts *Options) {
+		opts.DeviceStatsInterval = v
+	}
+}
+
+// WithWSHandshakeTimeout 设置websocket握手的超时时间
+func WithWSHandshakeTimeout(v time.Duration) Option {
+	return func(opts *Options) {
+		opts.WSHandshakeTimeout = v
+	}
+}
+
+func WithEventBufferSize(v int) Option {
+	return func(opts *Options) {
+		opts.EventBufferSize = v
+	}
+}
+
+// WithFaultInjector 设置连接读写的故障注入（测试用）
+func WithFaultInjector(v FaultInjector) Option {
+	return func(opts *Options) {
+		opts.FaultInjector = v
+	}
+}
+
+// WithMaxConnLifetime 设置连接的最长存活时间和随机增减的百分比
+func WithMaxConnLifetime(lifetime time.Duration, jitterPercent int) Option {
+	return func(opts *Options) {
+		opts.MaxConnLifetime = lifetime
+		opts.MaxConnLifetimeJitter = jitterPercent
+	}
+}
+
+// WithConnLifetimeGrace 设置通知后等待客户端主动断开的时间
+func WithConnLifetimeGrace(v time.Duration) Option {
+	return func(opts *Options) {
+		opts.ConnLifetimeGrace = v
+	}
+}
+
+// WithConnLifetimeBatch 设置每次检查最多通知或关闭的连接数量
+func WithConnLifetimeBatch(v int) Option {
+	return func(opts *Options) {
+		opts.ConnLifetimeBatch = v
+	}
+}
+
+// WithShutdownPhaseTimeout 设置Shutdown每个阶段最长的执行时间
+func WithShutdownPhaseTimeout(v time.Duration) Option {
+	return func(opts *Options) {
+		opts.ShutdownPhaseTimeout = v
+	}
+}
+
+// WithShutdownPhaseTimeouts 单独设置Shutdown某些阶段最长的执行时间
+func WithShutdownPhaseTimeouts(v map[ShutdownPhase]time.Duration) Option {
+	return func(opts *Options) {
+		opts.ShutdownPhaseTimeouts = v
+	}
+}
+
+func WithFastPing(v *FastPing) Option {
+	return func(opts *Options) {
+		opts.FastPing = v
+	}
+}
+
+// WithDeliveryLatencySampleRate 设置投递延迟的采样率
+func WithDeliveryLatencySampleRate(v float64) Option {
+	return func(opts *Options) {
+		opts.DeliveryLatencySampleRate = v
+	}
+}
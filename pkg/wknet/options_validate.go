@@ -0,0 +1,244 @@
+package wknet
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Validate 检查配置的取值范围、互相冲突的设置和当前平台是否支持，一次返回所有问题（errors.Join）
+func (o *Options) Validate() error {
+	var errs []error
+	addErr := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	// -----------------监听地址-----------------
+	tcpNetwork, err := validateListenAddr(o.Addr, "tcp", "tcp4", "tcp6", "unix", "unix-abstract")
+	if err != nil {
+		addErr("Addr: %w", err)
+	}
+	if tcpNetwork == "unix-abstract" && runtime.GOOS != "linux" {
+		addErr("Addr: unix-abstract is only supported on linux")
+	}
+	if strings.TrimSpace(o.WsAddr) != "" {
+		if _, err = validateListenAddr(o.WsAddr, "ws"); err != nil {
+			addErr("WsAddr: %w", err)
+		}
+	}
+	if strings.TrimSpace(o.WssAddr) != "" {
+		if _, err = validateListenAddr(o.WssAddr, "wss"); err != nil {
+			addErr("WssAddr: %w", err)
+		}
+		if o.WSTLSConfig == nil {
+			addErr("WssAddr: requires WSTLSConfig")
+		}
+	}
+
+	// -----------------取值范围-----------------
+	if o.SubReactorNum <= 0 {
+		addErr("SubReactorNum must be > 0, got %d", o.SubReactorNum)
+	}
+	if o.ReadBufferSize <= 0 {
+		addErr("ReadBufferSize must be > 0, got %d", o.ReadBufferSize)
+	}
+	if o.MaxReadBufferSize < o.ReadBufferSize {
+		addErr("MaxReadBufferSize(%d) must be >= ReadBufferSize(%d)", o.MaxReadBufferSize, o.ReadBufferSize)
+	}
+	if o.MaxWriteBufferSize <= 0 {
+		addErr("MaxWriteBufferSize must be > 0, got %d", o.MaxWriteBufferSize)
+	}
+	if o.StreamLowWatermark < 0 || (o.MaxWriteBufferSize > 0 && o.StreamLowWatermark >= o.MaxWriteBufferSize) {
+		addErr("StreamLowWatermark(%d) must be in [0, MaxWriteBufferSize(%d))", o.StreamLowWatermark, o.MaxWriteBufferSize)
+	}
+	nonNegative := []struct {
+		name  string
+		value int64
+	}{
+		{"MaxReactorOutboundBytes", o.MaxReactorOutboundBytes},
+		{"MaxFlushBytesPerConnPerTick", int64(o.MaxFlushBytesPerConnPerTick)},
+		{"MaxFlushBytesPerTick", int64(o.MaxFlushBytesPerTick)},
+		{"MaxFramesPerDecode", int64(o.MaxFramesPerDecode)},
+		{"SocketRecvBuffer", int64(o.SocketRecvBuffer)},
+		{"SocketSendBuffer", int64(o.SocketSendBuffer)},
+		{"TCPKeepAlive", int64(o.TCPKeepAlive)},
+		{"TCPDeferAccept", int64(o.TCPDeferAccept)},
+		{"TCPFastOpen", int64(o.TCPFastOpen)},
+		{"DebugExpire", int64(o.DebugExpire)},
+		{"MaxConnPanics", int64(o.MaxConnPanics)},
+		{"TLSSniffTimeout", int64(o.TLSSniffTimeout)},
+		{"GoroutineLeakTimeout", int64(o.GoroutineLeakTimeout)},
+		{"TCPInfoSampleInterval", int64(o.TCPInfoSampleInterval)},
+		{"DeviceStatsInterval", int64(o.DeviceStatsInterval)},
+		{"EventBufferSize", int64(o.EventBufferSize)},
+		{"MaxWSHandshakeBytes", int64(o.MaxWSHandshakeBytes)},
+		{"WSHandshakeTimeout", int64(o.WSHandshakeTimeout)},
+		{"MaxConnLifetime", int64(o.MaxConnLifetime)},
+		{"ConnLifetimeGrace", int64(o.ConnLifetimeGrace)},
+		{"ShutdownPhaseTimeout", int64(o.ShutdownPhaseTimeout)},
+	}
+	for _, v := range nonNegative {
+		if v.value < 0 {
+			addErr("%s must be >= 0, got %d", v.name, v.value)
+		}
+	}
+	for phase, timeout := range o.ShutdownPhaseTimeouts {
+		if phase < 0 || phase >= shutdownPhaseCount {
+			addErr("ShutdownPhaseTimeouts has invalid phase %d", int(phase))
+		} else if timeout < 0 {
+			addErr("ShutdownPhaseTimeouts[%s] must be >= 0, got %d", phase, timeout)
+		}
+	}
+
+	// -----------------平台和互相冲突的设置-----------------
+	if runtime.GOOS != "linux" {
+		if o.TCPDeferAccept > 0 {
+			addErr("TCPDeferAccept is only supported on linux")
+		}
+		if o.TCPFastOpen > 0 {
+			addErr("TCPFastOpen is only supported on linux")
+		}
+	}
+	if strings.HasPrefix(tcpNetwork, "unix") { // unix socket不支持tcp的socket选项
+		if o.TCPKeepAlive > 0 || o.TCPDeferAccept > 0 || o.TCPFastOpen > 0 {
+			addErr("TCPKeepAlive/TCPDeferAccept/TCPFastOpen can not be used with %s address", tcpNetwork)
+		}
+	}
+	switch o.TLSMode {
+	case TLSModeRequired, TLSModeOff:
+	case TLSModeOpportunistic:
+		if o.TCPTLSConfig == nil {
+			addErr("TLSMode %s requires TCPTLSConfig", o.TLSMode)
+		}
+	default:
+		addErr("unknown TLSMode %d", o.TLSMode)
+	}
+	if o.TCPTLSConfig != nil && o.TLSMode != TLSModeOff && o.TLSSniffTimeout <= 0 { // 需要等第一个包判断是否是tls
+		addErr("TLSSniffTimeout must be > 0 when tcp tls is enabled")
+	}
+	for l, policy := range o.TLSPolicies {
+		if l != ListenerTCP && l != ListenerWSS {
+			addErr("TLSPolicies: listener %q does not use tls", l)
+			continue
+		}
+		if policy == nil {
+			continue
+		}
+		for _, err := range policy.validate() {
+			addErr("TLSPolicies[%s]: %w", l, err)
+		}
+	}
+	if o.FastPing != nil && o.FastPing.Detect == nil {
+		addErr("FastPing.Detect is required")
+	}
+	if o.ReactorCPUAffinity != nil {
+		if o.ReactorCPUAffinity.Auto && len(o.ReactorCPUAffinity.CPUs) > 0 {
+			addErr("ReactorCPUAffinity: Auto and CPUs are mutually exclusive")
+		}
+		for _, cpu := range o.ReactorCPUAffinity.CPUs {
+			if cpu < 0 {
+				addErr("ReactorCPUAffinity: invalid cpu %d", cpu)
+			}
+		}
+	}
+	if o.DeliveryLatencySampleRate < 0 || o.DeliveryLatencySampleRate > 1 {
+		addErr("DeliveryLatencySampleRate must be in [0, 1], got %v", o.DeliveryLatencySampleRate)
+	}
+	if o.MaxConnLifetime > 0 {
+		if o.MaxConnLifetimeJitter < 0 || o.MaxConnLifetimeJitter >= 100 {
+			addErr("MaxConnLifetimeJitter must be in [0, 100), got %d", o.MaxConnLifetimeJitter)
+		}
+		if o.ConnLifetimeBatch <= 0 {
+			addErr("ConnLifetimeBatch must be > 0 when MaxConnLifetime is set, got %d", o.ConnLifetimeBatch)
+		}
+	}
+	hasWS := strings.TrimSpace(o.WsAddr) != "" || strings.TrimSpace(o.WssAddr) != ""
+	if !hasWS && (o.WSUpgradeValidator != nil || len(o.WSLabelHeaders) > 0) {
+		addErr("WSUpgradeValidator/WSLabelHeaders require WsAddr or WssAddr")
+	}
+	for _, cidrs := range []map[Listener][]string{o.AllowCIDRs, o.DenyCIDRs} {
+		for l, list := range cidrs {
+			if l != ListenerTCP && l != ListenerWS && l != ListenerWSS {
+				addErr("unknown listener %q in cidrs", l)
+			}
+			for _, cidr := range list {
+				if _, err = parseCIDR(cidr); err != nil {
+					addErr("%s: %w", l, err)
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateListenAddr 检查监听地址的格式（network://address），返回network
+func validateListenAddr(addr string, networks ...string) (string, error) {
+	network, address, ok := strings.Cut(addr, "://")
+	if !ok || network == "" || address == "" {
+		return "", fmt.Errorf("invalid address %q, format: network://address", addr)
+	}
+	for _, n := range networks {
+		if network == n {
+			return network, nil
+		}
+	}
+	return network, fmt.Errorf("unsupported network %q, supported: %s", network, strings.Join(networks, ","))
+}
+
+// logFields 生效的配置，tls证书等敏感信息只打印是否设置
+func (o *Options) logFields() []zap.Field {
+	setOrNot := func(set bool) string {
+		if set {
+			return "<set>"
+		}
+		return "<unset>"
+	}
+	return []zap.Field{
+		zap.String("addr", o.Addr),
+		zap.String("wsAddr", o.WsAddr),
+		zap.String("wssAddr", o.WssAddr),
+		zap.String("tcpTLSConfig", setOrNot(o.TCPTLSConfig != nil)),
+		zap.String("wsTLSConfig", setOrNot(o.WSTLSConfig != nil)),
+		zap.Stringer("tlsMode", o.TLSMode),
+		zap.Duration("tlsSniffTimeout", o.TLSSniffTimeout),
+		zap.Any("tlsPolicies", o.TLSPolicies),
+		zap.Int("subReactorNum", o.SubReactorNum),
+		zap.Int("readBufferSize", o.ReadBufferSize),
+		zap.Int("maxReadBufferSize", o.MaxReadBufferSize),
+		zap.Int("maxWriteBufferSize", o.MaxWriteBufferSize),
+		zap.Int64("maxReactorOutboundBytes", o.MaxReactorOutboundBytes),
+		zap.Int("maxFlushBytesPerConnPerTick", o.MaxFlushBytesPerConnPerTick),
+		zap.Int("maxFlushBytesPerTick", o.MaxFlushBytesPerTick),
+		zap.Int("maxFramesPerDecode", o.MaxFramesPerDecode),
+		zap.Int("streamLowWatermark", o.StreamLowWatermark),
+		zap.Int("socketRecvBuffer", o.SocketRecvBuffer),
+		zap.Int("socketSendBuffer", o.SocketSendBuffer),
+		zap.Duration("tcpKeepAlive", o.TCPKeepAlive),
+		zap.Duration("tcpDeferAccept", o.TCPDeferAccept),
+		zap.Int("tcpFastOpen", o.TCPFastOpen),
+		zap.Int("maxConnPanics", o.MaxConnPanics),
+		zap.Duration("goroutineLeakTimeout", o.GoroutineLeakTimeout),
+		zap.Bool("fastPing", o.FastPing != nil),
+		zap.Any("allowCIDRs", o.AllowCIDRs),
+		zap.Any("denyCIDRs", o.DenyCIDRs),
+		zap.Any("reactorCPUAffinity", o.ReactorCPUAffinity),
+		zap.Duration("tcpInfoSampleInterval", o.TCPInfoSampleInterval),
+		zap.Duration("deviceStatsInterval", o.DeviceStatsInterval),
+		zap.String("wsUpgradeValidator", setOrNot(o.WSUpgradeValidator != nil)),
+		zap.Strings("wsLabelHeaders", o.WSLabelHeaders),
+		zap.Int("maxWSHandshakeBytes", o.MaxWSHandshakeBytes),
+		zap.Duration("wsHandshakeTimeout", o.WSHandshakeTimeout),
+		zap.Int("eventBufferSize", o.EventBufferSize),
+		zap.Bool("faultInjector", o.FaultInjector != nil),
+		zap.Duration("maxConnLifetime", o.MaxConnLifetime),
+		zap.Int("maxConnLifetimeJitter", o.MaxConnLifetimeJitter),
+		zap.Duration("connLifetimeGrace", o.ConnLifetimeGrace),
+		zap.Int("connLifetimeBatch", o.ConnLifetimeBatch),
+		zap.Duration("shutdownPhaseTimeout", o.ShutdownPhaseTimeout),
+		zap.Any("shutdownPhaseTimeouts", o.ShutdownPhaseTimeouts),
+		zap.Float64("deliveryLatencySampleRate", o.DeliveryLatencySampleRate),
+	}
+}
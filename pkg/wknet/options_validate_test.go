@@ -0,0 +1,87 @@
+package wknet
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/WuKongIM/crypto/tls"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []Option
+		errors []string // 错误里要包含的内容，为空表示没有错误
+	}{
+		{name: "default"},
+		{name: "unix", opts: []Option{WithAddr("unix:///tmp/wknet.sock")}},
+		{name: "invalid addr", opts: []Option{WithAddr("127.0.0.1:5100")}, errors: []string{"Addr: invalid address"}},
+		{name: "unsupported network", opts: []Option{WithAddr("udp://127.0.0.1:5100")}, errors: []string{`unsupported network "udp"`}},
+		{name: "ws network", opts: []Option{WithWSAddr("tcp://127.0.0.1:5200")}, errors: []string{"WsAddr"}},
+		{name: "wss without tls config", opts: []Option{WithWSSAddr("wss://127.0.0.1:5210")}, errors: []string{"WssAddr: requires WSTLSConfig"}},
+		{name: "ranges", opts: []Option{WithSubReactorNum(0), WithMaxConnPanics(-1), WithEventBufferSize(-1)}, errors: []string{
+			"SubReactorNum must be > 0", "MaxConnPanics must be >= 0", "EventBufferSize must be >= 0",
+		}},
+		{name: "read buffer", opts: []Option{func(opts *Options) { opts.MaxReadBufferSize = opts.ReadBufferSize - 1 }}, errors: []string{"MaxReadBufferSize"}},
+		{name: "stream watermark", opts: []Option{WithStreamLowWatermark(1024 * 1024 * 50)}, errors: []string{"StreamLowWatermark"}},
+		{name: "tcp options with unix", opts: []Option{WithAddr("unix:///tmp/wknet.sock"), WithTCPKeepAlive(time.Second)}, errors: []string{"can not be used with unix address"}},
+		{name: "opportunistic without tls config", opts: []Option{WithTLSMode(TLSModeOpportunistic)}, errors: []string{"TLSMode opportunistic requires TCPTLSConfig"}},
+		{name: "unknown tls mode", opts: []Option{WithTLSMode(TLSMode(9))}, errors: []string{"unknown TLSMode 9"}},
+		{name: "tls without sniff timeout", opts: []Option{WithTCPTLSConfig(&tls.Config{}), WithTLSSniffTimeout(0)}, errors: []string{"TLSSniffTimeout must be > 0"}},
+		{name: "tls off without sniff timeout", opts: []Option{WithTCPTLSConfig(&tls.Config{}), WithTLSMode(TLSModeOff), WithTLSSniffTimeout(0)}},
+		{name: "fast ping without detect", opts: []Option{WithFastPing(&FastPing{Response: []byte{1}})}, errors: []string{"FastPing.Detect"}},
+		{name: "cpu affinity", opts: []Option{WithReactorCPUAffinity(&CPUAffinity{Auto: true, CPUs: []int{-1}})}, errors: []string{
+			"mutually exclusive", "invalid cpu -1",
+		}},
+		{name: "ws options without ws", opts: []Option{WithWSLabelHeaders("X-Tenant-ID")}, errors: []string{"require WsAddr or WssAddr"}},
+		{name: "conn lifetime", opts: []Option{WithMaxConnLifetime(time.Hour, 100), WithConnLifetimeBatch(0)}, errors: []string{
+			"MaxConnLifetimeJitter must be in [0, 100)", "ConnLifetimeBatch must be > 0",
+		}},
+		{name: "cidrs", opts: []Option{WithAllowCIDRs(ListenerTCP, "10.0.0.0/8", "bad"), WithDenyCIDRs(Listener("udp"), "1.1.1.1")}, errors: []string{
+			`invalid cidr "bad"`, `unknown listener "udp"`,
+		}},
+		{name: "tls policies", opts: []Option{WithTLSPolicy(ListenerWS, &TLSPolicy{}), WithTLSPolicy(ListenerTCP, &TLSPolicy{MinVersion: 0x0305, CipherSuites: []uint16{0x1234}})}, errors: []string{
+			`listener "ws" does not use tls`, "unknown MinVersion 0x0305", "unknown cipher suite 0x1234",
+		}},
+		{name: "delivery latency sample rate", opts: []Option{WithDeliveryLatencySampleRate(1.5)}, errors: []string{"DeliveryLatencySampleRate must be in [0, 1], got 1.5"}},
+	}
+	if runtime.GOOS != "linux" {
+		tests = append(tests, struct {
+			name   string
+			opts   []Option
+			errors []string
+		}{name: "linux only", opts: []Option{WithTCPFastOpen(16), WithAddr("unix-abstract://wknet")}, errors: []string{"TCPFastOpen is only supported on linux", "unix-abstract is only supported on linux"}})
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := NewOptions()
+			for _, opt := range tt.opts {
+				opt(opts)
+			}
+			err := opts.Validate()
+			if len(tt.errors) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			assert.Error(t, err)
+			if err == nil {
+				return
+			}
+			// 一次返回所有问题
+			assert.Len(t, strings.Split(err.Error(), "\n"), len(tt.errors), err.Error())
+			for _, e := range tt.errors {
+				assert.Contains(t, err.Error(), e)
+			}
+		})
+	}
+}
+
+func TestEngineStartInvalidOptions(t *testing.T) {
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"), WithSubReactorNum(0))
+	err := e.Start()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "SubReactorNum")
+}
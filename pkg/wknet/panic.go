@@ -0,0 +1,86 @@
+package wknet
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// ErrHandlerPanic 事件回调发生了panic，连接会以此原因关闭
+var ErrHandlerPanic = errors.New("handler panic")
+
+// PanicHandler 事件回调panic后的自定义处理（比如上报到sentry），conn可能为nil（连接还没创建）
+type PanicHandler func(conn Conn, event string, v interface{}, stack []byte)
+
+// handlerPanicCounter 连接上事件回调panic的次数
+type handlerPanicCounter interface {
+	handlerPanics() *atomic.Int32
+}
+
+// PanicCount 事件回调发生panic的总次数
+func (e *Engine) PanicCount() int64 {
+	return e.panicCount.Load()
+}
+
+// callHandler 调用用户的事件回调，回调panic时recover，不影响reactor继续服务其他连接
+// panic后返回包装了ErrHandlerPanic的错误，同一个连接panic次数达到MaxConnPanics后不再回调此连接的事件
+func (e *Engine) callHandler(event string, conn Conn, fn func() error) (err error) {
+	counter := connPanicCounter(conn)
+	if counter != nil && e.options.MaxConnPanics > 0 && int(counter.Load()) >= e.options.MaxConnPanics {
+		return nil
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			err = e.onHandlerPanic(event, conn, counter, v, debug.Stack())
+		}
+	}()
+	return fn()
+}
+
+func (e *Engine) onHandlerPanic(event string, conn Conn, counter *atomic.Int32, v interface{}, stack []byte) error {
+	e.panicCount.Inc()
+	var (
+		connPanics int32
+		connStr    string
+	)
+	if counter != nil {
+		connPanics = counter.Inc()
+	}
+	if s, ok := conn.(fmt.Stringer); ok {
+		connStr = s.String()
+	}
+	e.Error("event handler panic", zap.String("event", event), zap.String("conn", connStr), zap.Int32("connPanics", connPanics), zap.Any("panic", v), zap.ByteString("stack", stack))
+
+	if e.options.PanicHandler != nil {
+		func() {
+			defer func() {
+				if v := recover(); v != nil {
+					e.Error("panic handler panic", zap.Any("panic", v))
+				}
+			}()
+			e.options.PanicHandler(conn, event, v, stack)
+		}()
+	}
+	return fmt.Errorf("%w: %s: %v", ErrHandlerPanic, event, v)
+}
+
+func connPanicCounter(conn Conn) *atomic.Int32 {
+	if conn == nil {
+		return nil
+	}
+	if c, ok := conn.(handlerPanicCounter); ok {
+		return c.handlerPanics()
+	}
+	return nil
+}
+
+func (d *DefaultConn) handlerPanics() *atomic.Int32 {
+	return &d.handlerPanicCount
+}
+
+func (t *TLSConn) handlerPanics() *atomic.Int32 {
+	return t.d.handlerPanics()
+}
@@ -0,0 +1,98 @@
+package wknet
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/atomic"
+)
+
+func TestEngineHandlerPanic(t *testing.T) {
+	var handlerCount atomic.Int32
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"), WithPanicHandler(func(conn Conn, event string, v interface{}, stack []byte) {
+		handlerCount.Inc()
+	}))
+	e.OnData(func(conn Conn) error {
+		buff, err := conn.Peek(-1)
+		if err != nil {
+			return err
+		}
+		_, _ = conn.Discard(len(buff))
+		if string(buff) == "panic" {
+			panic("test panic")
+		}
+		_, err = conn.WriteToOutboundBuffer(buff)
+		if err != nil {
+			return err
+		}
+		return conn.WakeWrite()
+	})
+	e.OnClose(func(conn Conn) {
+		panic("test close panic")
+	})
+	err := e.Start()
+	assert.NoError(t, err)
+	defer e.Stop()
+
+	addr := e.TCPRealListenAddr().String()
+	bad, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer bad.Close()
+	good, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer good.Close()
+
+	// panic的连接被关闭（OnData和OnClose都panic了）
+	_, err = bad.Write([]byte("panic"))
+	assert.NoError(t, err)
+	_ = bad.SetReadDeadline(time.Now().Add(time.Second * 2))
+	_, err = bad.Read(make([]byte, 10))
+	assert.True(t, errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || isConnReset(err), "err: %v", err)
+
+	// 其他连接正常服务
+	_, err = good.Write([]byte("hello"))
+	assert.NoError(t, err)
+	_ = good.SetReadDeadline(time.Now().Add(time.Second * 2))
+	resp := make([]byte, 5)
+	_, err = io.ReadFull(good, resp)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(resp))
+
+	assert.Eventually(t, func() bool {
+		return e.PanicCount() == 2 && handlerCount.Load() == 2
+	}, time.Second*2, time.Millisecond*10)
+}
+
+func TestEngineHandlerPanicBreaker(t *testing.T) {
+	e := NewEngine(WithMaxConnPanics(2))
+	conn := &DefaultConn{}
+	var calls int
+	for i := 0; i < 4; i++ {
+		err := e.callHandler("OnData", conn, func() error {
+			calls++
+			panic("test panic")
+		})
+		if i < 2 {
+			assert.True(t, errors.Is(err, ErrHandlerPanic))
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+	assert.Equal(t, 2, calls) // 达到次数后不再回调
+	assert.Equal(t, int64(2), e.PanicCount())
+
+	// 没有连接的回调不受影响
+	err := e.callHandler("OnNewConn", nil, func() error {
+		panic("test panic")
+	})
+	assert.True(t, errors.Is(err, ErrHandlerPanic))
+}
+
+func isConnReset(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
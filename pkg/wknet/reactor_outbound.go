@@ -0,0 +1,133 @@
+package wknet
+
+import (
+	"errors"
+	"sort"
+
+	"go.uber.org/zap"
+)
+
+// ErrSlowConsumer sub reactor的输出缓冲区总大小超过MaxReactorOutboundBytes，输出缓冲区最大的连接被关闭
+var ErrSlowConsumer = errors.New("slow consumer")
+
+// reactorOutboundBuffer 统计sub reactor所有连接输出缓冲区的总大小（写入时增加，发送或丢弃时减少）
+type reactorOutboundBuffer struct {
+	OutboundBuffer
+	sub *ReactorSub
+}
+
+func newReactorOutboundBuffer(buffer OutboundBuffer, sub *ReactorSub) OutboundBuffer {
+	if sub == nil {
+		return buffer
+	}
+	return &reactorOutboundBuffer{OutboundBuffer: buffer, sub: sub}
+}
+
+func (b *reactorOutboundBuffer) Write(data []byte) (int, error) {
+	n, err := b.OutboundBuffer.Write(data)
+	b.sub.addOutbound(n)
+	return n, err
+}
+
+func (b *reactorOutboundBuffer) WriteV(bufs [][]byte) (int, error) {
+	n, err := b.OutboundBuffer.WriteV(bufs)
+	b.sub.addOutbound(n)
+	return n, err
+}
+
+func (b *reactorOutboundBuffer) Read(data []byte) (int, error) {
+	n, err := b.OutboundBuffer.Read(data)
+	b.sub.addOutbound(-n)
+	return n, err
+}
+
+func (b *reactorOutboundBuffer) Discard(n int) (int, error) {
+	n, err := b.OutboundBuffer.Discard(n)
+	b.sub.addOutbound(-n)
+	return n, err
+}
+
+func (b *reactorOutboundBuffer) Release() error {
+	n := b.OutboundBuffer.BoundBufferSize()
+	err := b.OutboundBuffer.Release()
+	b.sub.addOutbound(-n)
+	return err
+}
+
+// OutboundBytes sub reactor所有连接输出缓冲区里还没发送的数据总大小
+func (r *ReactorSub) OutboundBytes() int64 {
+	return r.outboundBytes.Load()
+}
+
+// SlowConsumerEvictions 因为超过MaxReactorOutboundBytes被关闭的连接数量
+func (r *ReactorSub) SlowConsumerEvictions() int64 {
+	return r.slowConsumerEvictions.Load()
+}
+
+func (r *ReactorSub) addOutbound(n int) {
+	if n == 0 {
+		return
+	}
+	r.outboundBytes.Add(int64(n))
+	if n > 0 && r.overOutboundLimit() && r.outboundLimitScheduled.CompareAndSwap(false, true) {
+		r.scheduleOutboundLimit()
+	}
+}
+
+func (r *ReactorSub) overOutboundLimit() bool {
+	limit := r.eg.options.MaxReactorOutboundBytes
+	return limit > 0 && r.outboundBytes.Load() > limit
+}
+
+// enforceOutboundLimit 输出缓冲区总大小超过MaxReactorOutboundBytes时，从输出缓冲区最大的连接开始关闭，直到不超过限制
+// 只在sub reactor的goroutine里调用（发送数据时或者写入超限后触发）
+func (r *ReactorSub) enforceOutboundLimit() {
+	r.outboundLimitScheduled.Store(false)
+	if !r.overOutboundLimit() {
+		return
+	}
+	type pendingConn struct {
+		conn Conn
+		size int
+	}
+	conns := r.dirty.snapshot()
+	pendings := make([]pendingConn, 0, len(conns))
+	for _, c := range conns {
+		if size := pendingOutbound(c); size > 0 {
+			pendings = append(pendings, pendingConn{conn: c, size: size})
+		}
+	}
+	sort.Slice(pendings, func(i, j int) bool {
+		return pendings[i].size > pendings[j].size
+	})
+	for _, p := range pendings {
+		if !r.overOutboundLimit() {
+			return
+		}
+		if p.conn.IsClosed() {
+			continue
+		}
+		r.Warn("reactor outbound bytes exceed the limit, close the slow consumer", zap.Int64("id", p.conn.ID()), zap.String("uid", p.conn.UID()), zap.Int("pending", p.size), zap.Int64("outboundBytes", r.outboundBytes.Load()))
+		r.slowConsumerEvictions.Inc()
+		_ = r.CloseConn(p.conn, ErrSlowConsumer)
+	}
+}
+
+// ReactorOutboundBytes 每个sub reactor所有连接输出缓冲区里还没发送的数据总大小
+func (e *Engine) ReactorOutboundBytes() []int64 {
+	subs := e.reactorMain.acceptor.reactorSubs
+	bytes := make([]int64, 0, len(subs))
+	for _, sub := range subs {
+		bytes = append(bytes, sub.OutboundBytes())
+	}
+	return bytes
+}
+
+// SlowConsumerEvictions 因为超过MaxReactorOutboundBytes被关闭的连接总数
+func (e *Engine) SlowConsumerEvictions() int64 {
+	var count int64
+	for _, sub := range e.reactorMain.acceptor.reactorSubs {
+		count += sub.SlowConsumerEvictions()
+	}
+	return count
+}
@@ -0,0 +1,73 @@
+package wknet
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReactorOutboundLimit(t *testing.T) {
+	const (
+		clients = 20
+		limit   = 1024 * 1024 * 4
+	)
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"), WithSubReactorNum(1), WithSocketSendBuffer(1024*16), WithMaxReactorOutboundBytes(limit))
+	accepted := make(chan Conn, clients)
+	e.OnConnect(func(conn Conn) error {
+		accepted <- conn
+		return nil
+	})
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	conns := make([]Conn, 0, clients)
+	for i := 0; i < clients; i++ {
+		cli, err := net.Dial("tcp", e.TCPRealListenAddr().String())
+		assert.NoError(t, err)
+		assert.NoError(t, cli.(*net.TCPConn).SetReadBuffer(1024*16))
+		defer cli.Close() // 客户端都不读取
+		conns = append(conns, <-accepted)
+	}
+
+	// 每个连接写入的数据不超过MaxWriteBufferSize，但是总大小超过了MaxReactorOutboundBytes
+	sub := e.reactorMain.acceptor.reactorSubs[0]
+	for i, conn := range conns { // 奇数连接写入的少，总大小不超过限制
+		if i%2 == 1 {
+			_, _ = conn.Write(make([]byte, 1024*128))
+		}
+	}
+	for i, conn := range conns {
+		if i%2 == 0 {
+			_, _ = conn.Write(make([]byte, 1024*512))
+		}
+	}
+	assert.Eventually(t, func() bool {
+		return sub.OutboundBytes() <= limit
+	}, time.Second*5, time.Millisecond*10)
+	assert.Greater(t, e.Stats().SlowConsumerEvictions, int64(0))
+	assert.Equal(t, []int64{sub.OutboundBytes()}, e.ReactorOutboundBytes())
+
+	// 先关闭输出缓冲区最大的连接，写入少的连接保留
+	closed, evens := 0, 0
+	for i, conn := range conns {
+		if conn.IsClosed() {
+			closed++
+			if i%2 == 0 {
+				evens++
+			}
+		}
+	}
+	assert.Equal(t, int64(closed), e.SlowConsumerEvictions())
+	assert.Equal(t, closed, evens)
+	assert.Less(t, closed, clients)
+
+	// 关闭的连接不再占用
+	for _, conn := range conns {
+		if !conn.IsClosed() {
+			_ = conn.Close()
+		}
+	}
+	assert.Equal(t, int64(0), sub.OutboundBytes())
+}
@@ -6,6 +6,7 @@ package wknet
 import (
 	"bytes"
 	"fmt"
+	"net"
 	"os"
 
 	"github.com/WuKongIM/WuKongIM/pkg/wklog"
@@ -26,23 +27,41 @@ type ReactorSub struct {
 	cache      bytes.Buffer // temporary buffer for scattered bytes
 
 	stopped atomic.Bool
+
+	dirty    dirtyConns    // 输出缓冲区有数据等待发送的连接
+	fairness flushFairness // 轮流发送输出缓冲区有数据的连接
+
+	cpu atomic.Int32 // 绑定的cpu，-1表示没有绑定
+
+	outboundBytes          atomic.Int64 // 所有连接输出缓冲区里还没发送的数据总大小
+	outboundLimitScheduled atomic.Bool  // 已经触发了enforceOutboundLimit还没执行
+	slowConsumerEvictions  atomic.Int64 // 因为超过MaxReactorOutboundBytes被关闭的连接数量
 }
 
 // NewReactorSub instantiates a sub reactor.
 func NewReactorSub(eg *Engine, index int) *ReactorSub {
 	poller := netpoll.NewPoller(index, "connPoller")
 
-	return &ReactorSub{
+	r := &ReactorSub{
 		eg:         eg,
 		poller:     poller,
 		idx:        index,
 		Log:        wklog.NewWKLog(fmt.Sprintf("ReactorSub-%d", index)),
 		ReadBuffer: make([]byte, eg.options.ReadBufferSize),
 	}
+	r.cpu.Store(-1)
+	return r
 }
 
 // AddConn adds a connection to the sub reactor.
 func (r *ReactorSub) AddConn(conn Conn) error {
+	if d := underlyingConn(conn); d != nil { // OnConnect后连接可能已经在别的goroutine被关闭了（例如NetConnAdapter），添加期间不允许关闭
+		d.mu.Lock()
+		defer d.mu.Unlock()
+	}
+	if conn.IsClosed() {
+		return net.ErrClosed
+	}
 	r.eg.AddConn(conn)
 	r.connCount.Inc()
 	return r.poller.AddRead(conn.Fd().fd)
@@ -61,6 +80,10 @@ func (r *ReactorSub) Stop() error {
 }
 
 func (r *ReactorSub) AddWrite(conn Conn) error {
+	r.dirty.add(conn)
+	if d := underlyingConn(conn); d != nil && d.readPollOff.Load() {
+		return r.poller.DisableRead(conn.Fd().fd, true)
+	}
 	return r.poller.AddWrite(conn.Fd().fd)
 }
 
@@ -69,9 +92,18 @@ func (r *ReactorSub) AddRead(conn Conn) error {
 }
 
 func (r *ReactorSub) RemoveWrite(conn Conn) error {
+	r.dirty.remove(conn)
+	if d := underlyingConn(conn); d != nil && d.readPollOff.Load() {
+		return r.poller.DisableRead(conn.Fd().fd, false)
+	}
 	return r.poller.DeleteWrite(conn.Fd().fd)
 }
 
+// DisableRead 不再监听连接的可读事件，writing为true时继续监听可写事件
+func (r *ReactorSub) DisableRead(conn Conn, writing bool) error {
+	return r.poller.DisableRead(conn.Fd().fd, writing)
+}
+
 func (r *ReactorSub) RemoveRead(conn Conn) error {
 	return r.poller.DeleteRead(conn.Fd().fd)
 }
@@ -91,7 +123,24 @@ func (r *ReactorSub) ConnDec() {
 	r.connCount.Dec()
 }
 
+// BoundCPU 绑定的cpu，-1表示没有绑定
+func (r *ReactorSub) BoundCPU() int {
+	return int(r.cpu.Load())
+}
+
 func (r *ReactorSub) run() {
+	if cpu := r.eg.reactorCPU(r.idx); cpu >= 0 {
+		unlock, err := lockOSThreadToCPU(cpu)
+		if err != nil {
+			r.Warn("绑定cpu失败！", zap.Int("cpu", cpu), zap.Error(err))
+		} else {
+			r.cpu.Store(int32(cpu))
+			defer func() {
+				r.cpu.Store(-1)
+				unlock()
+			}()
+		}
+	}
 	err := r.poller.Polling(func(fd int, event netpoll.PollEvent) (err error) {
 		conn := r.eg.GetConn(fd)
 		if conn == nil {
@@ -134,27 +183,118 @@ func (r *ReactorSub) read(c Conn) error {
 	if n == 0 {
 		return r.CloseConn(c, os.NewSyscallError("read", unix.ECONNRESET))
 	}
-	if err = r.eg.eventHandler.OnData(c); err != nil {
-		if err == unix.EAGAIN {
-			return nil
+	if c.IsReadClosed() { // 已关闭读，丢弃数据
+		if d := underlyingConn(c); d != nil {
+			d.discardInbound()
 		}
+		return nil
+	}
+	if isNetConn(c) { // 数据由netConn读取
+		return nil
+	}
+	if handled, err := r.eg.handleFastPing(c); err != nil || handled {
+		if err != nil {
+			if err1 := r.CloseConn(c, err); err1 != nil {
+				r.Warn("failed to close conn", zap.Error(err1))
+			}
+		}
+		return nil
+	}
+	r.onData(c) // 等待解码的连接有新数据时也只解码MaxFramesPerDecode个帧，继续从输入缓冲区头部解码，帧的顺序不变
+	return nil
+}
+
+// onData 回调OnData，返回ErrDecodePending时标记连接等待解码，下一轮事件循环再次回调
+func (r *ReactorSub) onData(c Conn) {
+	err := r.eg.callHandler("OnData", c, func() error {
+		return r.eg.eventHandler.OnData(c)
+	})
+	switch err {
+	case nil, unix.EAGAIN:
+	case ErrDecodePending:
+		r.markDecodePending(c)
+	default:
 		if err1 := r.CloseConn(c, err); err1 != nil {
 			r.Warn("failed to close conn", zap.Error(err1))
 		}
 		r.Warn("failed to call OnData", zap.Error(err))
-		return nil
 	}
-	return nil
+}
+
+// markDecodePending 标记连接等待解码，已经在等待的不重复添加
+func (r *ReactorSub) markDecodePending(c Conn) {
+	d := underlyingConn(c)
+	if d == nil || !d.decodePending.CompareAndSwap(false, true) {
+		return
+	}
+	if err := r.poller.Trigger(func() { r.decodePending(c) }); err != nil { // reactor已经停止
+		d.decodePending.Store(false)
+	}
+}
+
+// decodePending 继续解码等待解码的连接（关闭或关闭读后标记已被清除）
+func (r *ReactorSub) decodePending(c Conn) {
+	d := underlyingConn(c)
+	if d == nil || !d.decodePending.CompareAndSwap(true, false) {
+		return
+	}
+	if c.IsClosed() || c.IsReadClosed() || isNetConn(c) {
+		return
+	}
+	r.eg.decodeRevisits.Inc()
+	r.onData(c)
 }
 
 func (r *ReactorSub) write(c Conn) error {
-	err := c.Flush()
+	var err error
+	if d := underlyingConn(c); d != nil { // 每次可写事件最多发送MaxFlushBytesPerConnPerTick，没发送完的等下次可写事件
+		_, err = d.flushN(r.eg.options.MaxFlushBytesPerConnPerTick)
+	} else {
+		err = c.Flush()
+	}
 	switch err {
 	case nil:
 	case unix.EAGAIN:
-		return nil
 	default:
 		return r.CloseConn(c, os.NewSyscallError("write", err))
 	}
+	if r.overOutboundLimit() {
+		r.enforceOutboundLimit()
+	}
 	return nil
 }
+
+// scheduleOutboundLimit 在reactor的goroutine里执行enforceOutboundLimit
+func (r *ReactorSub) scheduleOutboundLimit() {
+	if err := r.poller.Trigger(r.enforceOutboundLimit); err != nil { // reactor已经停止
+		r.outboundLimitScheduled.Store(false)
+	}
+}
+
+// flushPending 在reactor的goroutine里发送输出缓冲区有数据的连接，完成后把还有数据没发送完的连接数量写入done
+func (r *ReactorSub) flushPending(done chan<- int) {
+	err := r.poller.Trigger(func() {
+		done <- r.flushDirty()
+	})
+	if err != nil { // reactor已经停止
+		done <- r.dirty.pendingCount()
+	}
+}
+
+// flushDirty 发送输出缓冲区有数据的连接，按MaxFlushBytesPerConnPerTick轮流发送，一次最多发送MaxFlushBytesPerTick
+func (r *ReactorSub) flushDirty() int {
+	conns := r.dirty.snapshot()
+	opened := conns[:0]
+	for _, c := range conns {
+		if c.IsClosed() {
+			r.dirty.remove(c)
+			continue
+		}
+		opened = append(opened, c)
+	}
+	pending := r.fairness.tick(opened, r.eg.options.MaxFlushBytesPerConnPerTick, r.eg.options.MaxFlushBytesPerTick, flushConn, pendingOutbound)
+	if r.overOutboundLimit() {
+		r.enforceOutboundLimit()
+	}
+	return pending
+}
@@ -18,6 +18,13 @@ type ReactorSub struct {
 	wklog.Log
 	cache     bytes.Buffer // temporary buffer for scattered bytes
 	connCount atomic.Int32
+
+	dirty    dirtyConns    // 输出缓冲区有数据等待发送的连接
+	fairness flushFairness // 轮流发送输出缓冲区有数据的连接
+
+	outboundBytes          atomic.Int64 // 所有连接输出缓冲区里还没发送的数据总大小
+	outboundLimitScheduled atomic.Bool  // 已经触发了enforceOutboundLimit还没执行
+	slowConsumerEvictions  atomic.Int64 // 因为超过MaxReactorOutboundBytes被关闭的连接数量
 }
 
 // NewReactorSub instantiates a sub reactor.
@@ -45,6 +52,16 @@ func (r *ReactorSub) DeleteFd(conn Conn) error {
 	return nil
 }
 
+// scheduleOutboundLimit windows没有reactor的goroutine，在新的goroutine里执行（写入时持有连接的锁，不能直接关闭连接）
+func (r *ReactorSub) scheduleOutboundLimit() {
+	go r.enforceOutboundLimit()
+}
+
+// BoundCPU windows不支持绑定cpu
+func (r *ReactorSub) BoundCPU() int {
+	return -1
+}
+
 func (r *ReactorSub) ConnInc() {
 	r.connCount.Inc()
 }
@@ -67,6 +84,7 @@ func (r *ReactorSub) CloseConn(c Conn, er error) (rerr error) {
 }
 
 func (r *ReactorSub) AddWrite(conn Conn) error {
+	r.dirty.add(conn)
 	go conn.Flush()
 	return nil
 }
@@ -80,6 +98,12 @@ func (r *ReactorSub) RemoveRead(conn Conn) error {
 }
 
 func (r *ReactorSub) RemoveWrite(conn Conn) error {
+	r.dirty.remove(conn)
+	return nil
+}
+
+// DisableRead windows下继续读取，读取到的数据在readLoop丢弃
+func (r *ReactorSub) DisableRead(conn Conn, writing bool) error {
 	return nil
 }
 
@@ -100,7 +124,35 @@ func (r *ReactorSub) readLoop(conn Conn) {
 			r.CloseConn(conn, os.NewSyscallError("read", syscall.ECONNRESET))
 			return
 		}
-		if err = r.eg.eventHandler.OnData(conn); err != nil {
+		if conn.IsReadClosed() { // 已关闭读，丢弃数据
+			if d := underlyingConn(conn); d != nil {
+				d.discardInbound()
+			}
+			continue
+		}
+		if isNetConn(conn) { // 数据由netConn读取
+			continue
+		}
+		if handled, err := r.eg.handleFastPing(conn); err != nil || handled {
+			if err != nil {
+				r.CloseConn(conn, err)
+				return
+			}
+			continue
+		}
+		err = r.eg.callHandler("OnData", conn, func() error {
+			return r.eg.eventHandler.OnData(conn)
+		})
+		for err == ErrDecodePending && !conn.IsClosed() && !conn.IsReadClosed() { // 每个连接一个goroutine，直接继续解码
+			r.eg.decodeRevisits.Inc()
+			err = r.eg.callHandler("OnData", conn, func() error {
+				return r.eg.eventHandler.OnData(conn)
+			})
+		}
+		if err == ErrDecodePending {
+			continue
+		}
+		if err != nil {
 			if err == syscall.EAGAIN {
 				continue
 			}
@@ -113,3 +165,17 @@ func (r *ReactorSub) readLoop(conn Conn) {
 	}
 
 }
+
+// flushPending 发送输出缓冲区有数据的连接，完成后把还有数据没发送完的连接数量写入done
+func (r *ReactorSub) flushPending(done chan<- int) {
+	conns := r.dirty.snapshot()
+	opened := conns[:0]
+	for _, c := range conns {
+		if c.IsClosed() {
+			r.dirty.remove(c)
+			continue
+		}
+		opened = append(opened, c)
+	}
+	done <- r.fairness.tick(opened, r.eg.options.MaxFlushBytesPerConnPerTick, r.eg.options.MaxFlushBytesPerTick, flushConn, pendingOutbound)
+}
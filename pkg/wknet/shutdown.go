@@ -0,0 +1,189 @@
+package wknet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrShutdownTimeout Shutdown的阶段超时（或者Shutdown的ctx结束）时，还在执行和被跳过的钩子返回的错误
+var ErrShutdownTimeout = errors.New("shutdown phase timeout")
+
+// ShutdownPhase Shutdown的阶段，按从小到大的顺序依次执行每个阶段注册的钩子
+type ShutdownPhase int
+
+const (
+	ShutdownPhaseStopAccept    ShutdownPhase = iota // 关闭监听端口，不再接受新连接（引擎内置）
+	ShutdownPhaseDrainHandlers                      // 停止接收新的业务请求，等待正在处理的请求处理完（比如api服务、重试队列）
+	ShutdownPhaseFlushConns                         // 发送连接输出缓冲区里的数据（引擎内置）
+	ShutdownPhaseStopReactors                       // 停止reactor（引擎内置，之后不会再回调OnData等事件）和业务的后台处理
+	ShutdownPhaseCloseStore                         // 关闭存储，前面的阶段已经停止了所有会写存储的组件
+	shutdownPhaseCount
+)
+
+var shutdownPhaseNames = [shutdownPhaseCount]string{"stop_accept", "drain_handlers", "flush_conns", "stop_reactors", "close_store"}
+
+func (p ShutdownPhase) String() string {
+	if p < 0 || p >= shutdownPhaseCount {
+		return fmt.Sprintf("phase(%d)", int(p))
+	}
+	return shutdownPhaseNames[p]
+}
+
+// ShutdownHook Shutdown时执行的钩子，ctx在阶段超时或者Shutdown的ctx结束时取消
+type ShutdownHook func(ctx context.Context) error
+
+type shutdownHook struct {
+	name  string
+	phase ShutdownPhase
+	fn    ShutdownHook
+}
+
+// ShutdownHookResult 钩子的执行结果
+type ShutdownHookResult struct {
+	Name     string
+	Duration time.Duration
+	Err      error // 超时或被跳过时为ErrShutdownTimeout
+}
+
+// ShutdownPhaseResult 阶段的执行结果
+type ShutdownPhaseResult struct {
+	Phase    ShutdownPhase
+	Duration time.Duration
+	Hooks    []ShutdownHookResult
+}
+
+// RegisterShutdownHook 注册Shutdown时在phase阶段执行的钩子，同一个阶段的钩子按注册顺序依次执行（引擎内置的钩子创建引擎时注册，排在最前面）
+func (e *Engine) RegisterShutdownHook(name string, fn ShutdownHook, phase ShutdownPhase) {
+	if phase < 0 || phase >= shutdownPhaseCount {
+		e.Error("invalid shutdown phase", zap.String("hook", name), zap.Int("phase", int(phase)))
+		return
+	}
+	e.shutdownLock.Lock()
+	e.shutdownHooks = append(e.shutdownHooks, shutdownHook{name: name, phase: phase, fn: fn})
+	e.shutdownLock.Unlock()
+}
+
+// registerEngineShutdownHooks 注册引擎内置的钩子
+func (e *Engine) registerEngineShutdownHooks() {
+	e.RegisterShutdownHook("engine.stopAccept", func(ctx context.Context) error {
+		e.reactorMain.acceptor.stopListen()
+		return nil
+	}, ShutdownPhaseStopAccept)
+	e.RegisterShutdownHook("engine.flushConns", func(ctx context.Context) error {
+		pending, err := e.FlushAll(ctx)
+		if err != nil {
+			e.Warn("some conns still have pending data on shutdown", zap.Int("pending", pending), zap.Error(err))
+		}
+		return err
+	}, ShutdownPhaseFlushConns)
+	e.RegisterShutdownHook("engine.stopReactors", func(ctx context.Context) error {
+		return e.Stop()
+	}, ShutdownPhaseStopReactors)
+}
+
+// Shutdown 按阶段（ShutdownPhase）依次执行注册的钩子，停止引擎和注册了钩子的业务组件，只有第一次调用会执行
+// 每个阶段最多执行ShutdownPhaseTimeout（ShutdownPhaseTimeouts可以单独设置），超时后不再等待还在执行的钩子，这个阶段剩下的钩子跳过，继续下一个阶段
+// ctx结束后剩下的钩子都跳过；执行完后打印每个阶段的耗时和错误，返回所有钩子的错误
+func (e *Engine) Shutdown(ctx context.Context) error {
+	if !e.shutdownStarted.CompareAndSwap(false, true) {
+		e.Warn("engine already shutdown")
+		return nil
+	}
+	e.shutdownLock.Lock()
+	hooks := append([]shutdownHook(nil), e.shutdownHooks...)
+	e.shutdownLock.Unlock()
+
+	results := make([]ShutdownPhaseResult, 0, shutdownPhaseCount)
+	errs := make([]error, 0)
+	for phase := ShutdownPhase(0); phase < shutdownPhaseCount; phase++ {
+		result := e.runShutdownPhase(ctx, phase, hooks)
+		for _, hook := range result.Hooks {
+			if hook.Err != nil {
+				errs = append(errs, fmt.Errorf("%s/%s: %w", phase, hook.Name, hook.Err))
+			}
+		}
+		results = append(results, result)
+	}
+	e.shutdownLock.Lock()
+	e.shutdownResults = results
+	e.shutdownLock.Unlock()
+	e.logShutdownResults(results, len(errs))
+	return errors.Join(errs...)
+}
+
+// ShutdownResults Shutdown每个阶段的执行结果，还没有Shutdown时为nil
+func (e *Engine) ShutdownResults() []ShutdownPhaseResult {
+	e.shutdownLock.Lock()
+	defer e.shutdownLock.Unlock()
+	return e.shutdownResults
+}
+
+func (e *Engine) shutdownPhaseTimeout(phase ShutdownPhase) time.Duration {
+	if timeout, ok := e.options.ShutdownPhaseTimeouts[phase]; ok {
+		return timeout
+	}
+	return e.options.ShutdownPhaseTimeout
+}
+
+func (e *Engine) runShutdownPhase(ctx context.Context, phase ShutdownPhase, hooks []shutdownHook) ShutdownPhaseResult {
+	start := time.Now()
+	result := ShutdownPhaseResult{Phase: phase}
+	if timeout := e.shutdownPhaseTimeout(phase); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	for _, hook := range hooks {
+		if hook.phase != phase {
+			continue
+		}
+		hookStart := time.Now()
+		err := e.runShutdownHook(ctx, hook)
+		result.Hooks = append(result.Hooks, ShutdownHookResult{Name: hook.name, Duration: time.Since(hookStart), Err: err})
+	}
+	result.Duration = time.Since(start)
+	return result
+}
+
+// runShutdownHook 执行钩子直到返回或者ctx结束，ctx结束时钩子还在执行的不再等待（钩子的goroutine会继续执行完）
+func (e *Engine) runShutdownHook(ctx context.Context, hook shutdownHook) error {
+	if ctx.Err() != nil {
+		return ErrShutdownTimeout
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- e.callHandler("shutdown:"+hook.name, nil, func() error {
+			return hook.fn(ctx)
+		})
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ErrShutdownTimeout
+	}
+}
+
+func (e *Engine) logShutdownResults(results []ShutdownPhaseResult, errCount int) {
+	fields := make([]zap.Field, 0, len(results)+1)
+	hookErrs := make([]string, 0, errCount)
+	for _, result := range results {
+		fields = append(fields, zap.Duration(result.Phase.String(), result.Duration))
+		for _, hook := range result.Hooks {
+			if hook.Err != nil {
+				hookErrs = append(hookErrs, fmt.Sprintf("%s/%s(%s): %v", result.Phase, hook.Name, hook.Duration, hook.Err))
+			}
+		}
+	}
+	if len(hookErrs) > 0 {
+		fields = append(fields, zap.String("errors", strings.Join(hookErrs, "; ")))
+		e.Warn("engine shutdown with errors", fields...)
+		return
+	}
+	e.Info("engine shutdown", fields...)
+}
@@ -0,0 +1,118 @@
+package wknet
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEngineShutdownPhases(t *testing.T) {
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"), WithShutdownPhaseTimeouts(map[ShutdownPhase]time.Duration{
+		ShutdownPhaseDrainHandlers: time.Millisecond * 100,
+	}))
+	assert.NoError(t, e.Start())
+	addr := e.TCPRealListenAddr().String()
+
+	var (
+		mu    sync.Mutex
+		order []string
+	)
+	record := func(name string) {
+		mu.Lock()
+		order = append(order, name)
+		mu.Unlock()
+	}
+	hook := func(name string) ShutdownHook {
+		return func(ctx context.Context) error {
+			record(name)
+			return nil
+		}
+	}
+	// 注册的顺序和阶段的顺序不一样
+	e.RegisterShutdownHook("store", hook("store"), ShutdownPhaseCloseStore)
+	e.RegisterShutdownHook("conversation", hook("conversation"), ShutdownPhaseStopReactors)
+	e.RegisterShutdownHook("api", func(ctx context.Context) error {
+		record("api")
+		if _, err := net.DialTimeout("tcp", addr, time.Second); err == nil { // 监听端口已经关闭
+			return errors.New("still accepting")
+		}
+		return nil
+	}, ShutdownPhaseDrainHandlers)
+	slowDone := make(chan struct{})
+	e.RegisterShutdownHook("slow", func(ctx context.Context) error {
+		record("slow")
+		defer close(slowDone)
+		time.Sleep(time.Millisecond * 500) // 不理会ctx
+		return nil
+	}, ShutdownPhaseDrainHandlers)
+	e.RegisterShutdownHook("skipped", hook("skipped"), ShutdownPhaseDrainHandlers)
+	e.RegisterShutdownHook("webhook", hook("webhook"), ShutdownPhaseStopReactors)
+
+	start := time.Now()
+	err := e.Shutdown(context.Background())
+	elapsed := time.Since(start)
+	assert.ErrorIs(t, err, ErrShutdownTimeout)
+	assert.Less(t, elapsed, time.Millisecond*400) // 不等待超时的钩子
+
+	mu.Lock()
+	assert.Equal(t, []string{"api", "slow", "conversation", "webhook", "store"}, order)
+	mu.Unlock()
+
+	results := e.ShutdownResults()
+	assert.Len(t, results, int(shutdownPhaseCount))
+	for i, result := range results {
+		assert.Equal(t, ShutdownPhase(i), result.Phase)
+	}
+	names := func(phase ShutdownPhase) []string {
+		hookNames := make([]string, 0)
+		for _, hook := range results[phase].Hooks {
+			hookNames = append(hookNames, hook.Name)
+		}
+		return hookNames
+	}
+	assert.Equal(t, []string{"engine.stopAccept"}, names(ShutdownPhaseStopAccept))
+	assert.Equal(t, []string{"api", "slow", "skipped"}, names(ShutdownPhaseDrainHandlers))
+	assert.Equal(t, []string{"engine.flushConns"}, names(ShutdownPhaseFlushConns))
+	assert.Equal(t, []string{"engine.stopReactors", "conversation", "webhook"}, names(ShutdownPhaseStopReactors))
+	assert.Equal(t, []string{"store"}, names(ShutdownPhaseCloseStore))
+
+	drain := results[ShutdownPhaseDrainHandlers]
+	assert.NoError(t, drain.Hooks[0].Err)
+	assert.ErrorIs(t, drain.Hooks[1].Err, ErrShutdownTimeout)
+	assert.ErrorIs(t, drain.Hooks[2].Err, ErrShutdownTimeout)
+	assert.GreaterOrEqual(t, drain.Duration, time.Millisecond*100)
+	for _, phase := range []ShutdownPhase{ShutdownPhaseStopAccept, ShutdownPhaseFlushConns, ShutdownPhaseStopReactors, ShutdownPhaseCloseStore} {
+		for _, hook := range results[phase].Hooks {
+			assert.NoError(t, hook.Err, hook.Name)
+		}
+	}
+
+	// 只执行一次
+	<-slowDone
+	assert.NoError(t, e.Shutdown(context.Background()))
+	mu.Lock()
+	assert.Len(t, order, 5)
+	mu.Unlock()
+}
+
+func TestEngineShutdownContextDone(t *testing.T) {
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"))
+	assert.NoError(t, e.Start())
+	called := false
+	e.RegisterShutdownHook("store", func(ctx context.Context) error {
+		called = true
+		return nil
+	}, ShutdownPhaseCloseStore)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := e.Shutdown(ctx)
+	assert.ErrorIs(t, err, ErrShutdownTimeout)
+	assert.False(t, called)
+	_ = e.Stop()
+}
@@ -0,0 +1,77 @@
+package wknet
+
+// TLSMode tcp端口的tls模式（TCPTLSConfig不为空时有效）
+type TLSMode int
+
+const (
+	// TLSModeRequired 只接受tls连接，非tls的连接会被关闭（默认）
+	TLSModeRequired TLSMode = iota
+	// TLSModeOpportunistic 同一个端口同时接受tls和明文连接，根据连接的第一个包判断，用于迁移期间（windows下按TLSModeRequired处理）
+	TLSModeOpportunistic
+	// TLSModeOff 不使用tls
+	TLSModeOff
+)
+
+func (m TLSMode) String() string {
+	switch m {
+	case TLSModeRequired:
+		return "required"
+	case TLSModeOpportunistic:
+		return "opportunistic"
+	case TLSModeOff:
+		return "off"
+	}
+	return "unknown"
+}
+
+// connKind 监听端口接收的连接类型
+type connKind int
+
+const (
+	connKindTCP connKind = iota
+	connKindTLS          // tcp端口上嗅探出来的tls连接
+	connKindWS
+	connKindWSS
+)
+
+// sniffResult 协议嗅探的结果
+type sniffResult int
+
+const (
+	sniffNeedMore sniffResult = iota // 数据不够，需要等待更多数据
+	sniffMatch                       // 是此协议
+	sniffNoMatch                     // 不是此协议
+)
+
+// sniffer 根据连接最开始收到的数据判断协议，prefix可能只有部分数据
+type sniffer func(prefix []byte) sniffResult
+
+// sniffTLSMaxLen sniffTLS最多需要的数据长度
+const sniffTLSMaxLen = 2
+
+// sniffTLS tls的ClientHello以 0x16（handshake记录）0x03（主版本号）开头
+func sniffTLS(prefix []byte) sniffResult {
+	if len(prefix) == 0 {
+		return sniffNeedMore
+	}
+	if prefix[0] != 0x16 {
+		return sniffNoMatch
+	}
+	if len(prefix) < 2 {
+		return sniffNeedMore
+	}
+	if prefix[1] != 0x03 {
+		return sniffNoMatch
+	}
+	return sniffMatch
+}
+
+// tcpTLSEnabled tcp端口是否需要使用tls
+func (e *Engine) tcpTLSEnabled() bool {
+	return e.options.TCPTLSConfig != nil && e.options.TLSMode != TLSModeOff
+}
+
+// TLSRejectedCount TLSModeRequired下因为不是tls连接被关闭的连接数量
+func (e *Engine) TLSRejectedCount() int64 {
+	return e.tlsRejectedCount.Load()
+}
@@ -0,0 +1,25 @@
+package wknet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSniffTLS(t *testing.T) {
+	tests := []struct {
+		prefix []byte
+		result sniffResult
+	}{
+		{nil, sniffNeedMore},
+		{[]byte{0x16}, sniffNeedMore},
+		{[]byte{0x16, 0x03}, sniffMatch},
+		{[]byte{0x16, 0x03, 0x01}, sniffMatch},
+		{[]byte{0x16, 0x01}, sniffNoMatch},
+		{[]byte{0x10, 0x03}, sniffNoMatch},
+		{[]byte("GET / HTTP/1.1"), sniffNoMatch},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.result, sniffTLS(tt.prefix), "%v", tt.prefix)
+	}
+}
@@ -0,0 +1,159 @@
+//go:build linux || freebsd || dragonfly || darwin
+// +build linux freebsd dragonfly darwin
+
+package wknet
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/RussellLuo/timingwheel"
+	"github.com/WuKongIM/WuKongIM/pkg/wklog"
+	"github.com/WuKongIM/WuKongIM/pkg/wknet/netpoll"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// sniffRetryInterval 数据不够判断协议时，过一段时间再检查（poller是水平触发，不能一直等可读事件）
+const sniffRetryInterval = time.Millisecond * 10
+
+// connSniffer 新连接先在这里等待第一个包，判断是否是tls后再创建连接
+type connSniffer struct {
+	a       *Acceptor
+	poller  *netpoll.Poller
+	timeout time.Duration
+	sniff   sniffer
+	buf     []byte // 只在poller的goroutine里使用
+
+	mu      sync.Mutex
+	pending map[int]*sniffingConn
+
+	wklog.Log
+}
+
+type sniffingConn struct {
+	fd         int
+	remoteAddr net.Addr
+	timer      *timingwheel.Timer // 嗅探超时
+}
+
+func newConnSniffer(a *Acceptor) *connSniffer {
+	return &connSniffer{
+		a:       a,
+		poller:  netpoll.NewPoller(0, "sniffPoller"),
+		timeout: a.eg.options.TLSSniffTimeout,
+		sniff:   sniffTLS,
+		buf:     make([]byte, sniffTLSMaxLen),
+		pending: map[int]*sniffingConn{},
+		Log:     wklog.NewWKLog("ConnSniffer"),
+	}
+}
+
+func (s *connSniffer) start() {
+	go func() {
+		err := s.poller.Polling(func(fd int, ev netpoll.PollEvent) error {
+			s.check(fd, ev == netpoll.PollEventClose)
+			return nil
+		})
+		if err != nil {
+			s.Warn("sniff poller stopped", zap.Error(err))
+		}
+	}()
+}
+
+func (s *connSniffer) stop() error {
+	return s.poller.Close()
+}
+
+// add 新连接等待嗅探
+func (s *connSniffer) add(fd int, remoteAddr net.Addr) {
+	sc := &sniffingConn{fd: fd, remoteAddr: remoteAddr}
+	s.mu.Lock()
+	s.pending[fd] = sc
+	if s.timeout > 0 {
+		sc.timer = s.a.eg.timingWheel.AfterFunc(s.timeout, func() {
+			s.finish(fd, sc, sniffNeedMore)
+		})
+	}
+	s.mu.Unlock()
+	if err := s.poller.AddRead(fd); err != nil {
+		s.Warn("add sniffing conn to poller failed", zap.Error(err))
+		if s.take(fd, sc) != nil {
+			_ = unix.Close(fd)
+		}
+	}
+}
+
+// check 在不读取数据的情况下查看连接最开始的数据
+func (s *connSniffer) check(fd int, hup bool) {
+	n, _, err := unix.Recvfrom(fd, s.buf, unix.MSG_PEEK)
+	if err == unix.EAGAIN || err == unix.EINTR {
+		return
+	}
+	if err != nil || n == 0 { // 连接已关闭
+		if s.take(fd, nil) != nil {
+			_ = unix.Close(fd)
+		}
+		return
+	}
+	result := s.sniff(s.buf[:n])
+	if result != sniffNeedMore {
+		s.finish(fd, nil, result)
+		return
+	}
+	if hup { // 对方关闭了写，不会再有数据
+		s.finish(fd, nil, sniffNoMatch)
+		return
+	}
+	// 数据不够，先移除可读事件，过一会再检查
+	s.mu.Lock()
+	sc := s.pending[fd]
+	s.mu.Unlock()
+	_ = s.poller.Delete(fd)
+	s.a.eg.timingWheel.AfterFunc(sniffRetryInterval, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if sc != nil && s.pending[fd] == sc {
+			_ = s.poller.AddRead(fd)
+		}
+	})
+}
+
+// take 取出等待嗅探的连接，已经被处理（超时或已判断）的返回nil
+// expect不为nil时只有还是同一个连接才取出（fd关闭后可能被新连接复用）
+func (s *connSniffer) take(fd int, expect *sniffingConn) *sniffingConn {
+	s.mu.Lock()
+	sc := s.pending[fd]
+	if sc == nil || (expect != nil && sc != expect) {
+		s.mu.Unlock()
+		return nil
+	}
+	delete(s.pending, fd)
+	s.mu.Unlock()
+	if sc.timer != nil {
+		sc.timer.Stop()
+	}
+	_ = s.poller.Delete(fd)
+	return sc
+}
+
+// finish 嗅探结束后创建连接，sniffNeedMore表示超时
+func (s *connSniffer) finish(fd int, expect *sniffingConn, result sniffResult) {
+	sc := s.take(fd, expect)
+	if sc == nil {
+		return
+	}
+	opts := s.a.eg.options
+	if result == sniffMatch {
+		_ = s.a.newConn(fd, sc.remoteAddr, connKindTLS)
+		return
+	}
+	if opts.TLSMode == TLSModeOpportunistic {
+		_ = s.a.newConn(fd, sc.remoteAddr, connKindTCP)
+		return
+	}
+	s.a.eg.tlsRejectedCount.Inc()
+	s.Debug("close non tls conn", zap.String("remoteAddr", sc.remoteAddr.String()), zap.Bool("timeout", result == sniffNeedMore))
+	_ = unix.Close(fd)
+}
@@ -0,0 +1,141 @@
+//go:build linux || freebsd || dragonfly || darwin
+// +build linux freebsd dragonfly darwin
+
+package wknet
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	stls "github.com/WuKongIM/crypto/tls"
+	"github.com/stretchr/testify/assert"
+)
+
+func newSniffTestEngine(t *testing.T, opts ...Option) (*Engine, chan Conn) {
+	cert, err := stls.X509KeyPair(rsaCertPEM, rsaKeyPEM)
+	assert.NoError(t, err)
+	opts = append([]Option{WithAddr("tcp://127.0.0.1:0"), WithTCPTLSConfig(&stls.Config{Certificates: []stls.Certificate{cert}})}, opts...)
+	e := NewEngine(opts...)
+	connected := make(chan Conn, 10)
+	e.OnConnect(func(conn Conn) error {
+		connected <- conn
+		return nil
+	})
+	e.OnData(func(conn Conn) error { // echo
+		data, _ := conn.Peek(-1)
+		if len(data) == 0 {
+			return nil
+		}
+		_, _ = conn.Discard(len(data))
+		_, err := conn.Write(data)
+		return err
+	})
+	assert.NoError(t, e.Start())
+	t.Cleanup(func() {
+		_ = e.Stop()
+	})
+	return e, connected
+}
+
+func assertEcho(t *testing.T, conn net.Conn) {
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+	_, err := conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+// splitConn 第一次写入时先只写1个字节，模拟ClientHello分多次到达
+type splitConn struct {
+	net.Conn
+	split bool
+}
+
+func (s *splitConn) Write(b []byte) (int, error) {
+	if s.split || len(b) < 2 {
+		return s.Conn.Write(b)
+	}
+	s.split = true
+	n, err := s.Conn.Write(b[:1])
+	if err != nil {
+		return n, err
+	}
+	time.Sleep(time.Millisecond * 50)
+	m, err := s.Conn.Write(b[1:])
+	return n + m, err
+}
+
+func TestTLSModeOpportunistic(t *testing.T) {
+	e, connected := newSniffTestEngine(t, WithTLSMode(TLSModeOpportunistic))
+	addr := e.TCPRealListenAddr().String()
+
+	plain, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer plain.Close()
+	assertEcho(t, plain)
+	_, ok := (<-connected).(*DefaultConn)
+	assert.True(t, ok)
+
+	tlsCli, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	assert.NoError(t, err)
+	defer tlsCli.Close()
+	assertEcho(t, tlsCli)
+	_, ok = (<-connected).(*TLSConn)
+	assert.True(t, ok)
+
+	// ClientHello的第一个字节单独到达
+	raw, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	splitCli := tls.Client(&splitConn{Conn: raw}, &tls.Config{InsecureSkipVerify: true})
+	defer splitCli.Close()
+	assertEcho(t, splitCli)
+	_, ok = (<-connected).(*TLSConn)
+	assert.True(t, ok)
+
+	assert.Equal(t, int64(0), e.TLSRejectedCount())
+}
+
+// 超时还没收到数据的按明文连接处理（服务端先发送数据的协议）
+func TestTLSModeOpportunisticSniffTimeout(t *testing.T) {
+	e, connected := newSniffTestEngine(t, WithTLSMode(TLSModeOpportunistic), WithTLSSniffTimeout(time.Millisecond*100))
+	cli, err := net.Dial("tcp", e.TCPRealListenAddr().String())
+	assert.NoError(t, err)
+	defer cli.Close()
+
+	select {
+	case conn := <-connected:
+		_, ok := conn.(*DefaultConn)
+		assert.True(t, ok)
+	case <-time.After(time.Second * 5):
+		t.Fatal("sniff timeout not triggered")
+	}
+	assertEcho(t, cli)
+}
+
+func TestTLSModeRequired(t *testing.T) {
+	e, connected := newSniffTestEngine(t)
+	addr := e.TCPRealListenAddr().String()
+
+	plain, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer plain.Close()
+	_ = plain.SetDeadline(time.Now().Add(time.Second * 5))
+	_, err = plain.Write([]byte("hello"))
+	assert.NoError(t, err)
+	_, err = plain.Read(make([]byte, 1))
+	assert.Error(t, err) // 非tls连接被关闭
+	assert.Equal(t, int64(1), e.TLSRejectedCount())
+
+	tlsCli, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	assert.NoError(t, err)
+	defer tlsCli.Close()
+	assertEcho(t, tlsCli)
+	_, ok := (<-connected).(*TLSConn)
+	assert.True(t, ok)
+	assert.Equal(t, 0, len(connected))
+}
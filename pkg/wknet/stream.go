@@ -0,0 +1,144 @@
+package wknet
+
+import (
+	"errors"
+	"io"
+	"net"
+
+	"github.com/gobwas/ws/wsutil"
+)
+
+// DefaultStreamChunkSize WriteStream默认的分片大小
+const DefaultStreamChunkSize = 1024 * 32
+
+// ErrStreamChunkTooLarge 低水位加上分片大小超过了MaxWriteBufferSize
+var ErrStreamChunkTooLarge = errors.New("stream chunk too large")
+
+// WriteStream 先写入frameHeader，然后从r分片读取数据写入输出缓冲区，输出缓冲区的数据低于StreamLowWatermark时才写入下一片，
+// 所以不管数据多大内存占用都不会超过 低水位+分片大小，连接关闭后停止并返回net.ErrClosed
+// 注意：流写入期间其他地方写入此连接的数据会插入到分片之间；会阻塞等待数据发送，不能在engine的事件回调里调用
+func (d *DefaultConn) WriteStream(r io.Reader, frameHeader []byte, chunkSize int) error {
+	return d.writeStream(r, frameHeader, chunkSize, func(b []byte) error {
+		_, err := d.write(b)
+		return err
+	})
+}
+
+// WriteStream 每个分片封装为一个websocket二进制帧
+func (w *WSConn) WriteStream(r io.Reader, frameHeader []byte, chunkSize int) error {
+	return w.writeStream(r, frameHeader, chunkSize, func(b []byte) error {
+		if err := w.writeServerBinary(b); err != nil {
+			return err
+		}
+		return w.addWriteIfNotExist()
+	})
+}
+
+// WriteStream 每个分片加密为tls记录
+func (t *TLSConn) WriteStream(r io.Reader, frameHeader []byte, chunkSize int) error {
+	return t.d.writeStream(r, frameHeader, chunkSize, func(b []byte) error {
+		if _, err := t.tlsconn.Write(b); err != nil {
+			return err
+		}
+		return t.d.addWriteIfNotExist()
+	})
+}
+
+// WriteStream 每个分片封装为一个websocket二进制帧后加密
+func (w *WSSConn) WriteStream(r io.Reader, frameHeader []byte, chunkSize int) error {
+	return w.d.writeStream(r, frameHeader, chunkSize, func(b []byte) error {
+		if err := wsutil.WriteServerBinary(w.TLSConn, b); err != nil {
+			return err
+		}
+		return w.d.addWriteIfNotExist()
+	})
+}
+
+// writeStream writeChunk在持有d.mu的情况下调用
+func (d *DefaultConn) writeStream(r io.Reader, frameHeader []byte, chunkSize int, writeChunk func(b []byte) error) error {
+	if chunkSize <= 0 {
+		chunkSize = DefaultStreamChunkSize
+	}
+	lowWatermark := d.eg.options.StreamLowWatermark
+	if maxSize := d.eg.options.MaxWriteBufferSize; maxSize > 0 && lowWatermark+chunkSize+len(frameHeader) > maxSize {
+		return ErrStreamChunkTooLarge
+	}
+
+	d.streamMu.Lock() // 同一个连接的流依次写入，避免分片交错
+	defer d.streamMu.Unlock()
+	if err := d.startStream(); err != nil {
+		return err
+	}
+	defer d.streaming.Store(false)
+
+	if len(frameHeader) > 0 {
+		if err := d.writeStreamChunk(frameHeader, writeChunk); err != nil {
+			return err
+		}
+	}
+	buf := make([]byte, chunkSize)
+	for {
+		if err := d.waitStreamWritable(lowWatermark); err != nil {
+			return err
+		}
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if werr := d.writeStreamChunk(buf[:n], writeChunk); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (d *DefaultConn) startStream() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed.Load() {
+		return net.ErrClosed
+	}
+	if d.streamSignal == nil {
+		d.streamSignal = make(chan struct{}, 1)
+	}
+	d.streaming.Store(true)
+	return nil
+}
+
+func (d *DefaultConn) writeStreamChunk(b []byte, writeChunk func(b []byte) error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed.Load() {
+		return net.ErrClosed
+	}
+	return writeChunk(b)
+}
+
+// waitStreamWritable 等待输出缓冲区的数据低于低水位（由flush发送数据后唤醒）
+func (d *DefaultConn) waitStreamWritable(lowWatermark int) error {
+	for {
+		buffered, closed := d.outboundBuffered()
+		if closed {
+			return net.ErrClosed
+		}
+		if buffered < lowWatermark || buffered == 0 {
+			return nil
+		}
+		<-d.streamSignal
+	}
+}
+
+// notifyStream 唤醒等待输出缓冲区的流，调用时需要持有d.mu
+func (d *DefaultConn) notifyStream() {
+	if d.streamSignal == nil {
+		return
+	}
+	select {
+	case d.streamSignal <- struct{}{}:
+	default:
+	}
+}
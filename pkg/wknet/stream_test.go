@@ -0,0 +1,150 @@
+package wknet
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// watermarkReader 记录每次读取时输出缓冲区的最大数据量，用来检查都低于低水位
+type watermarkReader struct {
+	r           io.Reader
+	d           *DefaultConn
+	maxBuffered int
+}
+
+func (w *watermarkReader) Read(p []byte) (int, error) {
+	buffered, _ := w.d.outboundBuffered()
+	if buffered > w.maxBuffered {
+		w.maxBuffered = buffered
+	}
+	return w.r.Read(p)
+}
+
+func TestWriteStream(t *testing.T) {
+	lowWatermark := 1024 * 64
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"), WithStreamLowWatermark(lowWatermark))
+	accepted := make(chan Conn, 1)
+	e.OnConnect(func(conn Conn) error {
+		accepted <- conn
+		return nil
+	})
+	err := e.Start()
+	assert.NoError(t, err)
+	defer e.Stop()
+
+	cli, err := net.Dial("tcp", e.TCPRealListenAddr().String())
+	assert.NoError(t, err)
+	defer cli.Close()
+	conn := <-accepted
+
+	size := int64(1024 * 1024 * 50)
+	header := []byte("header")
+	expect := sha256.New()
+	_, _ = io.Copy(expect, io.LimitReader(rand.New(rand.NewSource(1)), size))
+
+	reader := &watermarkReader{
+		r: io.LimitReader(rand.New(rand.NewSource(1)), size),
+		d: conn.(*DefaultConn),
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- conn.WriteStream(reader, header, 0)
+	}()
+
+	head := make([]byte, len(header))
+	_, err = io.ReadFull(cli, head)
+	assert.NoError(t, err)
+	assert.Equal(t, header, head)
+	actual := sha256.New()
+	n, err := io.CopyN(actual, cli, size)
+	assert.NoError(t, err)
+	assert.Equal(t, size, n)
+	assert.Equal(t, expect.Sum(nil), actual.Sum(nil))
+
+	assert.NoError(t, <-errChan)
+	assert.Less(t, reader.maxBuffered, lowWatermark)
+}
+
+// 连接关闭后停止写入
+func TestWriteStreamClose(t *testing.T) {
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"), WithStreamLowWatermark(1024*64))
+	accepted := make(chan Conn, 1)
+	e.OnConnect(func(conn Conn) error {
+		accepted <- conn
+		return nil
+	})
+	err := e.Start()
+	assert.NoError(t, err)
+	defer e.Stop()
+
+	cli, err := net.Dial("tcp", e.TCPRealListenAddr().String())
+	assert.NoError(t, err)
+	defer cli.Close()
+	conn := <-accepted
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- conn.WriteStream(rand.New(rand.NewSource(1)), nil, 0) // 客户端不读取，输出缓冲区满了后阻塞
+	}()
+	time.Sleep(time.Millisecond * 200)
+	_ = conn.Close()
+	select {
+	case err = <-errChan:
+		assert.ErrorIs(t, err, net.ErrClosed)
+	case <-time.After(time.Second * 5):
+		t.Fatal("write stream not stopped")
+	}
+}
+
+// websocket连接每个分片是一个二进制帧
+func TestWriteStreamWebsocket(t *testing.T) {
+	e := NewEngine(WithWSAddr("ws://127.0.0.1:0"))
+	data := make([]byte, 1024*100)
+	rand.New(rand.NewSource(1)).Read(data)
+	errChan := make(chan error, 1)
+	e.OnData(func(conn Conn) error {
+		buff, _ := conn.Peek(-1)
+		if len(buff) == 0 {
+			return nil
+		}
+		_, _ = conn.Discard(len(buff))
+		go func() { // 不能在事件回调里等待发送
+			errChan <- conn.WriteStream(bytes.NewReader(data), []byte("header"), 1024*32)
+		}()
+		return nil
+	})
+	err := e.Start()
+	assert.NoError(t, err)
+	defer e.Stop()
+
+	u := url.URL{Scheme: "ws", Host: e.WSRealListenAddr().String(), Path: "/"}
+	cli, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	assert.NoError(t, err)
+	defer cli.Close()
+	err = cli.WriteMessage(websocket.BinaryMessage, []byte("start"))
+	assert.NoError(t, err)
+
+	_, msg, err := cli.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "header", string(msg))
+	received := make([]byte, 0, len(data))
+	chunks := 0
+	for len(received) < len(data) {
+		_, msg, err = cli.ReadMessage()
+		assert.NoError(t, err)
+		received = append(received, msg...)
+		chunks++
+	}
+	assert.Equal(t, data, received)
+	assert.Equal(t, 4, chunks)
+	assert.NoError(t, <-errChan)
+}
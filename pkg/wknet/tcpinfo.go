@@ -0,0 +1,44 @@
+package wknet
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// ErrTCPInfoNotSupported 当前平台或连接类型（例如unix socket）不支持获取TCP_INFO
+var ErrTCPInfoNotSupported = errors.New("tcp info is not supported")
+
+// TCPInfo 连接的tcp链路质量（内核TCP_INFO）
+type TCPInfo struct {
+	RTT          time.Duration `json:"rtt"`           // 平滑后的往返时间
+	RTTVar       time.Duration `json:"rtt_var"`       // 往返时间的波动
+	Retransmits  uint32        `json:"retransmits"`   // 当前未确认数据的连续重传次数
+	TotalRetrans uint32        `json:"total_retrans"` // 连接建立以来的重传总次数
+	DeliveryRate uint64        `json:"delivery_rate"` // 最近的发送速率（字节/秒）
+	SampledAt    time.Time     `json:"sampled_at"`    // 采样时间
+}
+
+// TCPInfo 获取连接的tcp链路质量
+func (d *DefaultConn) TCPInfo() (*TCPInfo, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed.Load() {
+		return nil, net.ErrClosed
+	}
+	return d.fd.tcpInfo()
+}
+
+// sampleTCPInfo 采样所有连接的tcp链路质量，记录到ConnStats.LastTCPInfo
+func (e *Engine) sampleTCPInfo() {
+	for _, conn := range e.GetAllConn() {
+		if conn.IsClosed() {
+			continue
+		}
+		info, err := conn.TCPInfo()
+		if err != nil {
+			continue
+		}
+		conn.ConnStats().LastTCPInfo.Store(info)
+	}
+}
@@ -0,0 +1,28 @@
+//go:build linux
+// +build linux
+
+package wknet
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func (n NetFd) tcpInfo() (*TCPInfo, error) {
+	info, err := unix.GetsockoptTCPInfo(n.fd, unix.IPPROTO_TCP, unix.TCP_INFO)
+	if err != nil {
+		if err == unix.EOPNOTSUPP || err == unix.ENOPROTOOPT { // 不是tcp连接
+			return nil, ErrTCPInfoNotSupported
+		}
+		return nil, err
+	}
+	return &TCPInfo{
+		RTT:          time.Duration(info.Rtt) * time.Microsecond,
+		RTTVar:       time.Duration(info.Rttvar) * time.Microsecond,
+		Retransmits:  uint32(info.Retransmits),
+		TotalRetrans: info.Total_retrans,
+		DeliveryRate: info.Delivery_rate,
+		SampledAt:    time.Now(),
+	}, nil
+}
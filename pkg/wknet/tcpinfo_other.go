@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package wknet
+
+func (n NetFd) tcpInfo() (*TCPInfo, error) {
+	return nil, ErrTCPInfoNotSupported
+}
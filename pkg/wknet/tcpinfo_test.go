@@ -0,0 +1,43 @@
+package wknet
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnTCPInfo(t *testing.T) {
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"), WithTCPInfoSampleInterval(time.Millisecond*20))
+	accepted := make(chan Conn, 1)
+	e.OnConnect(func(conn Conn) error {
+		accepted <- conn
+		return nil
+	})
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	cli, err := net.Dial("tcp", e.TCPRealListenAddr().String())
+	assert.NoError(t, err)
+	defer cli.Close()
+	conn := <-accepted
+
+	info, err := conn.TCPInfo()
+	if runtime.GOOS != "linux" {
+		assert.ErrorIs(t, err, ErrTCPInfoNotSupported)
+		return
+	}
+	assert.NoError(t, err)
+	assert.False(t, info.SampledAt.IsZero())
+
+	// 定时采样
+	assert.Eventually(t, func() bool {
+		return conn.ConnStats().LastTCPInfo.Load() != nil
+	}, time.Second, time.Millisecond*10)
+
+	assert.NoError(t, conn.Close())
+	_, err = conn.TCPInfo()
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
@@ -0,0 +1,234 @@
+package wknet
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/WuKongIM/crypto/tls"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// TLSPolicy 监听端口（ListenerTCP或ListenerWSS）的tls版本和加密套件策略
+type TLSPolicy struct {
+	// MinVersion 允许的最低tls版本（比如tls.VersionTLS12），0表示不限制
+	MinVersion uint16
+	// CipherSuites 允许的加密套件，为空表示不限制，只对tls1.2及以下生效（tls1.3的加密套件不能配置）
+	CipherSuites []uint16
+	// ReportOnly 只统计不拦截：允许所有版本和加密套件，不满足策略的连接记为违规，用来评估开启拦截后影响的客户端
+	ReportOnly bool
+}
+
+// allows 协商的版本和加密套件是否满足策略
+func (p *TLSPolicy) allows(version uint16, cipherSuite uint16) bool {
+	if p == nil {
+		return true
+	}
+	if p.MinVersion > 0 && version < p.MinVersion {
+		return false
+	}
+	if len(p.CipherSuites) == 0 || version >= tls.VersionTLS13 {
+		return true
+	}
+	for _, id := range p.CipherSuites {
+		if id == cipherSuite {
+			return true
+		}
+	}
+	return false
+}
+
+// validate 检查版本和加密套件是否是已知的，返回所有问题
+func (p *TLSPolicy) validate() []error {
+	var errs []error
+	switch p.MinVersion {
+	case 0, tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13:
+	default:
+		errs = append(errs, fmt.Errorf("unknown MinVersion 0x%04x", p.MinVersion))
+	}
+	for _, id := range p.CipherSuites {
+		if !knownCipherSuite(id) {
+			errs = append(errs, fmt.Errorf("unknown cipher suite 0x%04x", id))
+		}
+	}
+	return errs
+}
+
+func knownCipherSuite(id uint16) bool {
+	for _, suites := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, suite := range suites {
+			if suite.ID == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyTLSPolicy 按策略拦截时返回设置了最低版本和加密套件的配置副本（不修改原来的配置），不拦截时返回原来的配置
+func applyTLSPolicy(config *tls.Config, policy *TLSPolicy) *tls.Config {
+	if config == nil || policy == nil || policy.ReportOnly {
+		return config
+	}
+	config = config.Clone()
+	if policy.MinVersion > config.MinVersion {
+		config.MinVersion = policy.MinVersion
+	}
+	if len(policy.CipherSuites) > 0 {
+		config.CipherSuites = append([]uint16(nil), policy.CipherSuites...)
+	}
+	return config
+}
+
+// tlsVersionName tls版本的名称
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionSSL30:
+		return "SSLv3"
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// ConnTLSState 连接握手协商的tls版本和加密套件
+type ConnTLSState struct {
+	Version         uint16 `json:"version"`
+	CipherSuite     uint16 `json:"cipher_suite"`
+	PolicyViolation bool   `json:"policy_violation"` // 不满足监听端口的TLSPolicy（只有ReportOnly时才会有这样的连接）
+}
+
+// TLSUsage 一种tls版本和加密套件的握手统计
+type TLSUsage struct {
+	Listener         Listener `json:"listener"`
+	Version          string   `json:"version"`
+	CipherSuite      string   `json:"cipher_suite"`
+	Handshakes       int64    `json:"handshakes"`        // 握手成功的连接数量
+	PolicyViolations int64    `json:"policy_violations"` // 其中不满足TLSPolicy的数量（开启拦截后会被拒绝）
+}
+
+// TLSUsageReport 进程启动以来tls握手的统计
+type TLSUsageReport struct {
+	Usages            []TLSUsage         `json:"usages"`             // 按监听端口、版本和加密套件排序
+	HandshakeFailures map[Listener]int64 `json:"handshake_failures"` // 每个监听端口握手失败的连接数量（包括被TLSPolicy拒绝的）
+}
+
+type tlsUsageKey struct {
+	listener    Listener
+	version     uint16
+	cipherSuite uint16
+}
+
+// tlsUsageStats 按监听端口、版本和加密套件统计的握手数量，只在握手完成时修改一次
+type tlsUsageStats struct {
+	mu       sync.Mutex
+	usages   map[tlsUsageKey]*TLSUsage
+	failures map[Listener]*atomic.Int64 // 初始化后只读
+}
+
+func newTLSUsageStats() *tlsUsageStats {
+	s := &tlsUsageStats{
+		usages:   make(map[tlsUsageKey]*TLSUsage),
+		failures: make(map[Listener]*atomic.Int64, len(listeners)),
+	}
+	for _, l := range listeners {
+		s.failures[l] = atomic.NewInt64(0)
+	}
+	return s
+}
+
+func (s *tlsUsageStats) add(l Listener, state *ConnTLSState) {
+	key := tlsUsageKey{listener: l, version: state.Version, cipherSuite: state.CipherSuite}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usage := s.usages[key]
+	if usage == nil {
+		usage = &TLSUsage{Listener: l, Version: tlsVersionName(state.Version), CipherSuite: tls.CipherSuiteName(state.CipherSuite)}
+		s.usages[key] = usage
+	}
+	usage.Handshakes++
+	if state.PolicyViolation {
+		usage.PolicyViolations++
+	}
+}
+
+func (s *tlsUsageStats) report() *TLSUsageReport {
+	s.mu.Lock()
+	keys := make([]tlsUsageKey, 0, len(s.usages))
+	for key := range s.usages {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].listener != keys[j].listener {
+			return keys[i].listener < keys[j].listener
+		}
+		if keys[i].version != keys[j].version {
+			return keys[i].version < keys[j].version
+		}
+		return keys[i].cipherSuite < keys[j].cipherSuite
+	})
+	report := &TLSUsageReport{
+		Usages:            make([]TLSUsage, 0, len(keys)),
+		HandshakeFailures: make(map[Listener]int64, len(s.failures)),
+	}
+	for _, key := range keys {
+		report.Usages = append(report.Usages, *s.usages[key])
+	}
+	s.mu.Unlock()
+	for l, count := range s.failures {
+		if n := count.Load(); n > 0 {
+			report.HandshakeFailures[l] = n
+		}
+	}
+	return report
+}
+
+// tlsConfig 监听端口应用了TLSPolicy后的tls配置
+func (e *Engine) tlsConfig(l Listener) *tls.Config {
+	if l == ListenerWSS {
+		return e.wssTLSConfig
+	}
+	return e.tcpTLSConfig
+}
+
+// TLSUsageReport 进程启动以来每个监听端口协商的tls版本和加密套件的连接数量，以及不满足TLSPolicy的数量和握手失败的数量
+func (e *Engine) TLSUsageReport() *TLSUsageReport {
+	return e.tlsUsage.report()
+}
+
+// afterTLSRead 每次解密tls记录后调用（只在连接的reactor里调用），握手完成时记录协商的版本和加密套件，握手失败时计数
+func (t *TLSConn) afterTLSRead(err error) {
+	if t.handshakeDone {
+		return
+	}
+	eg := t.d.eg
+	cs := t.tlsconn.ConnectionState()
+	if !cs.HandshakeComplete {
+		if err != nil && err != tls.ErrDataNotEnough {
+			t.handshakeDone = true
+			eg.tlsUsage.failures[t.listener].Inc()
+			eg.Debug("tls handshake failed", zap.String("listener", string(t.listener)), zap.String("conn", t.d.String()), zap.Error(err))
+		}
+		return
+	}
+	t.handshakeDone = true
+	state := &ConnTLSState{
+		Version:         cs.Version,
+		CipherSuite:     cs.CipherSuite,
+		PolicyViolation: !eg.options.TLSPolicies[t.listener].allows(cs.Version, cs.CipherSuite),
+	}
+	if t.d.connStats != nil {
+		t.d.connStats.TLSState.Store(state)
+	}
+	eg.tlsUsage.add(t.listener, state)
+	if state.PolicyViolation {
+		eg.Debug("tls policy violation", zap.String("listener", string(t.listener)), zap.String("version", tlsVersionName(cs.Version)), zap.String("cipherSuite", tls.CipherSuiteName(cs.CipherSuite)), zap.String("conn", t.d.String()))
+	}
+}
@@ -0,0 +1,109 @@
+package wknet
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	stls "github.com/WuKongIM/crypto/tls"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTLSPolicyTestEngine 收到数据时把连接协商的tls版本和加密套件发送到返回的chan（连接关闭后会被复用，不能在关闭后读取）
+func newTLSPolicyTestEngine(t *testing.T, policy *TLSPolicy) (*Engine, chan *ConnTLSState) {
+	cert, err := stls.X509KeyPair(rsaCertPEM, rsaKeyPEM)
+	assert.NoError(t, err)
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"), WithTCPTLSConfig(&stls.Config{Certificates: []stls.Certificate{cert}}), WithTLSPolicy(ListenerTCP, policy))
+	received := make(chan *ConnTLSState, 10)
+	e.OnData(func(conn Conn) error {
+		data, _ := conn.Peek(-1)
+		if len(data) > 0 {
+			_, _ = conn.Discard(len(data))
+			received <- conn.ConnStats().TLSState.Load()
+		}
+		return nil
+	})
+	assert.NoError(t, e.Start())
+	t.Cleanup(func() { _ = e.Stop() })
+	return e, received
+}
+
+// dialTLS 握手后发送数据，握手成功时返回服务端记录的连接协商的版本和加密套件
+func dialTLS(t *testing.T, e *Engine, received chan *ConnTLSState, config *tls.Config) (*ConnTLSState, error) {
+	config.InsecureSkipVerify = true
+	cli, err := tls.Dial("tcp", e.TCPRealListenAddr().String(), config)
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+	_, err = cli.Write([]byte("hello"))
+	assert.NoError(t, err)
+	select {
+	case state := <-received:
+		return state, nil
+	case <-time.After(time.Second * 3):
+		t.Fatal("server did not receive data")
+	}
+	return nil, nil
+}
+
+func TestTLSPolicyEnforce(t *testing.T) {
+	e, received := newTLSPolicyTestEngine(t, &TLSPolicy{
+		MinVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+	})
+
+	// 低于最低版本
+	_, err := dialTLS(t, e, received, &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11})
+	assert.Error(t, err)
+	// 不允许的加密套件
+	_, err = dialTLS(t, e, received, &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}})
+	assert.Error(t, err)
+
+	state, err := dialTLS(t, e, received, &tls.Config{MaxVersion: tls.VersionTLS12})
+	assert.NoError(t, err)
+	assert.Equal(t, &ConnTLSState{Version: tls.VersionTLS12, CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, state)
+	// tls1.3的加密套件不受限制
+	state, err = dialTLS(t, e, received, &tls.Config{MinVersion: tls.VersionTLS13})
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), state.Version)
+
+	assert.Eventually(t, func() bool { return e.TLSUsageReport().HandshakeFailures[ListenerTCP] == 2 }, time.Second, time.Millisecond*10)
+	report := e.TLSUsageReport()
+	assert.Len(t, report.Usages, 2)
+	assert.Equal(t, TLSUsage{Listener: ListenerTCP, Version: "TLS1.2", CipherSuite: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", Handshakes: 1}, report.Usages[0])
+	assert.Equal(t, "TLS1.3", report.Usages[1].Version)
+	assert.Equal(t, int64(0), report.Usages[1].PolicyViolations)
+}
+
+func TestTLSPolicyReportOnly(t *testing.T) {
+	e, received := newTLSPolicyTestEngine(t, &TLSPolicy{
+		MinVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		ReportOnly:   true,
+	})
+
+	// 不满足策略的照样允许连接，记为违规
+	state, err := dialTLS(t, e, received, &tls.Config{MinVersion: tls.VersionTLS11, MaxVersion: tls.VersionTLS11})
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS11), state.Version)
+	assert.True(t, state.PolicyViolation)
+
+	state, err = dialTLS(t, e, received, &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}})
+	assert.NoError(t, err)
+	assert.Equal(t, &ConnTLSState{Version: tls.VersionTLS12, CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, PolicyViolation: true}, state)
+
+	for i := 0; i < 2; i++ {
+		state, err = dialTLS(t, e, received, &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}})
+		assert.NoError(t, err)
+		assert.False(t, state.PolicyViolation)
+	}
+
+	report := e.TLSUsageReport()
+	assert.Empty(t, report.HandshakeFailures)
+	assert.Len(t, report.Usages, 3)
+	assert.Equal(t, "TLS1.1", report.Usages[0].Version)
+	assert.Equal(t, int64(1), report.Usages[0].PolicyViolations)
+	assert.Equal(t, TLSUsage{Listener: ListenerTCP, Version: "TLS1.2", CipherSuite: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", Handshakes: 2}, report.Usages[1])
+	assert.Equal(t, TLSUsage{Listener: ListenerTCP, Version: "TLS1.2", CipherSuite: "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", Handshakes: 1, PolicyViolations: 1}, report.Usages[2])
+}
@@ -6,7 +6,9 @@ import (
 	"io"
 	"net"
 
+	"github.com/RussellLuo/timingwheel"
 	"github.com/WuKongIM/crypto/tls"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 
 	"github.com/gobwas/ws"
@@ -20,16 +22,17 @@ func CreateWSConn(id int64, connFd NetFd, localAddr, remoteAddr net.Addr, eg *En
 
 func CreateWSSConn(id int64, connFd NetFd, localAddr, remoteAddr net.Addr, eg *Engine, reactorSub *ReactorSub) (Conn, error) {
 	defaultConn := GetDefaultConn(id, connFd, localAddr, remoteAddr, eg, reactorSub)
-	tc := newTLSConn(defaultConn)
-	tlsCn := tls.Server(tc, eg.options.WSTLSConfig)
+	tc := newTLSConn(defaultConn, ListenerWSS)
+	tlsCn := tls.Server(tc, eg.tlsConfig(ListenerWSS))
 	tc.tlsconn = tlsCn
 	return NewWSSConn(tc), nil
 }
 
 type WSConn struct {
 	*DefaultConn
-	upgraded         bool
-	tmpInboundBuffer InboundBuffer // inboundBuffer InboundBuffer
+	upgraded         atomic.Bool
+	tmpInboundBuffer InboundBuffer      // inboundBuffer InboundBuffer
+	handshakeTimer   *timingwheel.Timer // 握手超时
 }
 
 func NewWSConn(d *DefaultConn) *WSConn {
@@ -37,6 +40,7 @@ func NewWSConn(d *DefaultConn) *WSConn {
 		DefaultConn:      d,
 		tmpInboundBuffer: d.eg.eventHandler.OnNewInboundConn(d, d.eg),
 	}
+	w.handshakeTimer = d.eg.startWSHandshakeTimer(d, &w.upgraded)
 	return w
 }
 
@@ -60,13 +64,25 @@ func (w *WSConn) ReadToInboundBuffer() (int, error) {
 func (w *WSConn) WriteServerBinary(data []byte) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	return w.writeServerBinary(data)
+}
+
+func (w *WSConn) writeServerBinary(data []byte) error {
+	if t := w.writeTrace.Load(); t != nil { // 整个websocket帧记为一帧
+		var frame bytes.Buffer
+		if err := wsutil.WriteServerBinary(&frame, data); err != nil {
+			return err
+		}
+		_, err := w.traceWrite(t, frame.Bytes(), w.outboundBuffer.Write)
+		return err
+	}
 	return wsutil.WriteServerBinary(w.outboundBuffer, data)
 }
 
 // 解包ws的数据
 func (w *WSConn) unpacketWSData() error {
 
-	if !w.upgraded {
+	if !w.upgraded.Load() {
 		err := w.upgrade()
 		if err != nil {
 			return err
@@ -145,9 +161,20 @@ func (w *WSConn) upgrade() error {
 	if err != nil {
 		return err
 	}
-	tmpReader := bytes.NewReader(buff)
+	handshakeLen, err := w.eg.wsHandshakeLen(buff)
+	if err != nil {
+		w.DiscardFromTemp(len(buff))
+		if _, werr := w.Write(wsHandshakeTooLargeResponse); werr == nil {
+			_ = w.DefaultConn.flush()
+		}
+		return err
+	}
+	if handshakeLen == 0 { // 升级请求还没收完，等后面的数据
+		return nil
+	}
+	tmpReader := bytes.NewReader(buff[:handshakeLen])
 	tmpWriter := bytes.NewBuffer(nil)
-	_, err = ws.Upgrade(&readWrite{
+	err = w.eg.wsUpgrade(w, &readWrite{
 		Reader: tmpReader,
 		Writer: tmpWriter,
 	})
@@ -156,6 +183,12 @@ func (w *WSConn) upgrade() error {
 			return nil
 		}
 		w.DiscardFromTemp(len(buff)) // 发送错误，丢弃数据
+		// 返回后连接会被关闭，先把握手失败的响应发送出去
+		if tmpWriter.Len() > 0 {
+			if _, werr := w.Write(tmpWriter.Bytes()); werr == nil {
+				_ = w.DefaultConn.flush()
+			}
+		}
 		return err
 	}
 	_, err = w.Write(tmpWriter.Bytes())
@@ -163,8 +196,11 @@ func (w *WSConn) upgrade() error {
 		return err
 	}
 
-	w.DiscardFromTemp(len(buff) - tmpReader.Len())
-	w.upgraded = true
+	w.DiscardFromTemp(handshakeLen - tmpReader.Len())
+	w.upgraded.Store(true)
+	if w.handshakeTimer != nil {
+		w.handshakeTimer.Stop()
+	}
 	return nil
 }
 
@@ -178,10 +214,14 @@ func (w *WSConn) PeekFromTemp(n int) ([]byte, error) {
 	if w.tmpInboundBuffer.IsEmpty() {
 		return nil, nil
 	}
-	head, tail := w.tmpInboundBuffer.Peek(n)
+	bufs, err := w.tmpInboundBuffer.PeekV(n)
+	if err != nil {
+		return nil, err
+	}
 	w.reactorSub.cache.Reset()
-	w.reactorSub.cache.Write(head)
-	w.reactorSub.cache.Write(tail)
+	for _, buf := range bufs {
+		w.reactorSub.cache.Write(buf)
+	}
 
 	data := w.reactorSub.cache.Bytes()
 	return data, nil
@@ -192,6 +232,9 @@ func (w *WSConn) DiscardFromTemp(n int) {
 }
 
 func (w *WSConn) Close() error {
+	if w.handshakeTimer != nil {
+		w.handshakeTimer.Stop()
+	}
 	w.tmpInboundBuffer.Release()
 	return w.DefaultConn.Close()
 }
@@ -203,16 +246,19 @@ type readWrite struct {
 
 type WSSConn struct {
 	*TLSConn
-	upgraded bool
+	upgraded atomic.Bool
 
-	wsTmpInboundBuffer InboundBuffer // inboundBuffer InboundBuffer
+	wsTmpInboundBuffer InboundBuffer      // inboundBuffer InboundBuffer
+	handshakeTimer     *timingwheel.Timer // 握手超时
 }
 
 func NewWSSConn(tlsConn *TLSConn) *WSSConn {
-	return &WSSConn{
+	w := &WSSConn{
 		TLSConn:            tlsConn,
 		wsTmpInboundBuffer: tlsConn.d.eg.eventHandler.OnNewInboundConn(tlsConn.d, tlsConn.d.eg), // tls解码后的数据
 	}
+	w.handshakeTimer = tlsConn.d.eg.startWSHandshakeTimer(tlsConn.d, &w.upgraded)
+	return w
 }
 
 func (w *WSSConn) ReadToInboundBuffer() (int, error) {
@@ -229,6 +275,7 @@ func (w *WSSConn) ReadToInboundBuffer() (int, error) {
 
 	for {
 		tlsN, err := w.tlsconn.Read(readBuffer)
+		w.afterTLSRead(err)
 		if err != nil {
 			if err == tls.ErrDataNotEnough {
 				return n, nil
@@ -260,10 +307,14 @@ func (w *WSSConn) peekFromWSTemp(n int) ([]byte, error) {
 	if w.wsTmpInboundBuffer.IsEmpty() {
 		return nil, nil
 	}
-	head, tail := w.wsTmpInboundBuffer.Peek(n)
+	bufs, err := w.wsTmpInboundBuffer.PeekV(n)
+	if err != nil {
+		return nil, err
+	}
 	w.d.reactorSub.cache.Reset()
-	w.d.reactorSub.cache.Write(head)
-	w.d.reactorSub.cache.Write(tail)
+	for _, buf := range bufs {
+		w.d.reactorSub.cache.Write(buf)
+	}
 
 	data := w.d.reactorSub.cache.Bytes()
 	return data, nil
@@ -281,10 +332,21 @@ func (w *WSSConn) upgrade() error {
 	if len(buff) == 0 {
 		return nil
 	}
+	handshakeLen, err := w.d.eg.wsHandshakeLen(buff)
+	if err != nil {
+		w.discardFromWSTemp(len(buff))
+		if _, werr := w.TLSConn.Write(wsHandshakeTooLargeResponse); werr == nil {
+			_ = w.d.flush()
+		}
+		return err
+	}
+	if handshakeLen == 0 { // 升级请求还没收完，等后面的数据
+		return nil
+	}
 
-	tmpReader := bytes.NewReader(buff)
+	tmpReader := bytes.NewReader(buff[:handshakeLen])
 	tmpWriter := bytes.NewBuffer(nil)
-	_, err = ws.Upgrade(&readWrite{
+	err = w.d.eg.wsUpgrade(w, &readWrite{
 		Reader: tmpReader,
 		Writer: tmpWriter,
 	})
@@ -293,6 +355,12 @@ func (w *WSSConn) upgrade() error {
 			return nil
 		}
 		w.discardFromWSTemp(len(buff)) // 发送错误，丢弃数据
+		// 返回后连接会被关闭，先把握手失败的响应发送出去
+		if tmpWriter.Len() > 0 {
+			if _, werr := w.TLSConn.Write(tmpWriter.Bytes()); werr == nil {
+				_ = w.d.flush()
+			}
+		}
 		return err
 	}
 	_, err = w.TLSConn.Write(tmpWriter.Bytes())
@@ -300,16 +368,19 @@ func (w *WSSConn) upgrade() error {
 		return err
 	}
 
-	w.discardFromWSTemp(len(buff) - tmpReader.Len())
+	w.discardFromWSTemp(handshakeLen - tmpReader.Len())
 
-	w.upgraded = true
+	w.upgraded.Store(true)
+	if w.handshakeTimer != nil {
+		w.handshakeTimer.Stop()
+	}
 
 	return nil
 }
 
 // 解包ws的数据
 func (w *WSSConn) unpacketWSData() error {
-	if !w.upgraded {
+	if !w.upgraded.Load() {
 		err := w.upgrade()
 		if err != nil {
 			return err
@@ -340,7 +411,10 @@ func (w *WSSConn) unpacketWSData() error {
 }
 
 func (w *WSSConn) Close() error {
-	w.upgraded = false
+	if w.handshakeTimer != nil {
+		w.handshakeTimer.Stop()
+	}
+	w.upgraded.Store(false)
 	w.wsTmpInboundBuffer.Release()
 	return w.TLSConn.Close()
 }
@@ -5,14 +5,18 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"io"
 	"net"
+	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	stls "github.com/WuKongIM/crypto/tls"
+	"github.com/gobwas/ws/wsutil"
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 )
@@ -280,3 +284,208 @@ func testWSSConnSend(msgNum int, addr string, t *testing.T, wg *sync.WaitGroup,
 		assert.NoError(t, err)
 	}
 }
+
+func TestWSUpgradeValidator(t *testing.T) {
+	var (
+		reqMu   sync.Mutex
+		lastReq UpgradeRequest
+	)
+	validator := func(req UpgradeRequest) error {
+		reqMu.Lock()
+		lastReq = req
+		reqMu.Unlock()
+		if req.Origin != "https://im.example.com" {
+			return errors.New("origin not allowed")
+		}
+		return nil
+	}
+	e := NewEngine(WithWSAddr("ws://0.0.0.0:0"), WithWSUpgradeValidator(validator), WithWSLabelHeaders("X-Tenant-ID", "x-client-version"))
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	connChan := make(chan Conn, 1)
+	e.OnData(func(conn Conn) error {
+		data, err := conn.Peek(-1)
+		assert.NoError(t, err)
+		if string(data) == "hello" {
+			connChan <- conn
+		}
+		return nil
+	})
+	u := url.URL{Scheme: "ws", Host: e.WSRealListenAddr().String(), Path: "/ws", RawQuery: "token=1"}
+
+	// 不允许的origin
+	_, resp, err := websocket.DefaultDialer.Dial(u.String(), http.Header{"Origin": []string{"https://evil.example.com"}})
+	assert.ErrorIs(t, err, websocket.ErrBadHandshake)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+
+	// 允许的origin，请求头保存到连接上
+	header := http.Header{}
+	header.Set("Origin", "https://im.example.com")
+	header.Set("X-Tenant-ID", "tenant1")
+	header.Set("X-Client-Version", "1.2.3")
+	header.Set("X-Other", "other")
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), header)
+	assert.NoError(t, err)
+	defer c.Close()
+
+	reqMu.Lock()
+	assert.Equal(t, http.MethodGet, lastReq.Method)
+	assert.Equal(t, "/ws", lastReq.Path)
+	assert.Equal(t, "token=1", lastReq.RawQuery)
+	assert.Equal(t, u.Host, lastReq.Host)
+	assert.Equal(t, "tenant1", lastReq.Header.Get("X-Tenant-ID"))
+	reqMu.Unlock()
+
+	assert.NoError(t, c.WriteMessage(websocket.BinaryMessage, []byte("hello")))
+	select {
+	case conn := <-connChan:
+		assert.Equal(t, "tenant1", conn.Value(WSHeaderValueKey("x-tenant-id")))
+		assert.Equal(t, "1.2.3", conn.Value(WSHeaderValueKey("X-Client-Version")))
+		assert.Nil(t, conn.Value(WSHeaderValueKey("X-Other")))
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+func TestWSSUpgradeValidator(t *testing.T) {
+	cert, err := stls.X509KeyPair(rsaCertPEM, rsaKeyPEM)
+	assert.NoError(t, err)
+	tlsConfig := &stls.Config{
+		Certificates: []stls.Certificate{cert},
+	}
+	e := NewEngine(WithWSSAddr("wss://0.0.0.0:0"), WithWSTLSConfig(tlsConfig), WithWSUpgradeValidator(func(req UpgradeRequest) error {
+		if req.Origin != "https://im.example.com" {
+			return errors.New("origin not allowed")
+		}
+		return nil
+	}))
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	dialer := &websocket.Dialer{
+		NetDialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return tls.Dial(network, addr, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS13})
+		},
+	}
+	u := url.URL{Scheme: "wss", Host: e.WSSRealListenAddr().String(), Path: "/"}
+	_, resp, err := dialer.Dial(u.String(), http.Header{"Origin": []string{"https://evil.example.com"}})
+	assert.ErrorIs(t, err, websocket.ErrBadHandshake)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+
+	c, _, err := dialer.Dial(u.String(), http.Header{"Origin": []string{"https://im.example.com"}})
+	assert.NoError(t, err)
+	c.Close()
+}
+
+// wsHandshakeRequest 最小的websocket升级请求
+func wsHandshakeRequest(host string, extraHeader string) string {
+	return "GET /ws HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		extraHeader +
+		"\r\n"
+}
+
+func TestWSUpgradeOneBytePerRead(t *testing.T) {
+	e := NewEngine(WithWSAddr("ws://127.0.0.1:0"))
+	dataChan := make(chan string, 1)
+	e.OnData(func(conn Conn) error {
+		data, err := conn.Peek(-1)
+		assert.NoError(t, err)
+		if len(data) > 0 {
+			conn.Discard(len(data))
+			dataChan <- string(data)
+		}
+		return nil
+	})
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	addr := e.WSRealListenAddr().String()
+	c, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer c.Close()
+	// 升级请求每次只发送一个字节，服务端分多次读到
+	req := wsHandshakeRequest(addr, "")
+	for i := 0; i < len(req); i++ {
+		_, err = c.Write([]byte{req[i]})
+		assert.NoError(t, err)
+		time.Sleep(time.Millisecond)
+	}
+	assert.NoError(t, c.SetReadDeadline(time.Now().Add(time.Second*5)))
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	assert.NoError(t, wsutil.WriteClientBinary(c, []byte("hello")))
+	select {
+	case data := <-dataChan:
+		assert.Equal(t, "hello", data)
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+func TestWSUpgradeTooLarge(t *testing.T) {
+	e := NewEngine(WithWSAddr("ws://127.0.0.1:0"), WithMaxWSHandshakeBytes(1024))
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	addr := e.WSRealListenAddr().String()
+	c, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte(wsHandshakeRequest(addr, "X-Large: "+strings.Repeat("a", 2048)+"\r\n")))
+	assert.NoError(t, err)
+
+	assert.NoError(t, c.SetReadDeadline(time.Now().Add(time.Second*5)))
+	reader := bufio.NewReader(c)
+	resp, err := http.ReadResponse(reader, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, resp.StatusCode)
+	_, err = reader.ReadByte() // 响应后关闭连接
+	assert.Error(t, err)
+
+	// 没有超过限制的可以升级
+	c2, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer c2.Close()
+	_, err = c2.Write([]byte(wsHandshakeRequest(addr, "X-Small: "+strings.Repeat("a", 512)+"\r\n")))
+	assert.NoError(t, err)
+	assert.NoError(t, c2.SetReadDeadline(time.Now().Add(time.Second*5)))
+	resp, err = http.ReadResponse(bufio.NewReader(c2), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+}
+
+func TestWSUpgradeTimeout(t *testing.T) {
+	e := NewEngine(WithWSAddr("ws://127.0.0.1:0"), WithWSHandshakeTimeout(time.Millisecond*200))
+	assert.NoError(t, e.Start())
+	defer e.Stop()
+
+	addr := e.WSRealListenAddr().String()
+	c, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer c.Close()
+	req := wsHandshakeRequest(addr, "")
+	_, err = c.Write([]byte(req[:len(req)/2])) // 只发送一半的升级请求
+	assert.NoError(t, err)
+
+	start := time.Now()
+	assert.NoError(t, c.SetReadDeadline(time.Now().Add(time.Second*5)))
+	_, err = c.Read(make([]byte, 1))
+	assert.Error(t, err)
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		assert.False(t, netErr.Timeout()) // 被服务端关闭，不是读超时
+	}
+	assert.Less(t, time.Since(start), time.Second*2)
+}
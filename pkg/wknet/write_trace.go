@@ -0,0 +1,160 @@
+package wknet
+
+import (
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+	"go.uber.org/zap"
+)
+
+// writeTrace 调试连接的写入跟踪（用来定位数据是在wknet之前还是之后损坏的）
+// 每次写入输出缓冲区的数据记为一帧并计算xxhash，数据写入fd时按帧再计算一次，两者不一致说明数据在输出缓冲区里被破坏了
+// 只有调试连接才有，没有调试时写入路径只多一次原子读取
+type writeTrace struct {
+	mu        sync.Mutex
+	frames    []*writeTraceFrame // 还没完全写入fd的帧
+	nextIndex uint64             // 下一帧的序号
+	buffered  uint64             // 写入输出缓冲区的数据在流里的偏移（从开始跟踪算起，包括开始跟踪前已经在缓冲区里的数据）
+	flushed   uint64             // 写入fd的数据在流里的偏移
+
+	outboundRolling *xxhash.Digest // 写入输出缓冲区的所有帧的滚动hash
+	writtenRolling  *xxhash.Digest // 写入fd的所有帧的滚动hash
+}
+
+type writeTraceFrame struct {
+	index           uint64
+	start           uint64 // 在流里的偏移
+	size            int
+	outboundSum     uint64 // 写入输出缓冲区时的hash
+	outboundRolling uint64 // 写入输出缓冲区时到此帧为止的滚动hash
+	written         *xxhash.Digest
+	writtenSize     int
+}
+
+func newWriteTrace(buffered int) *writeTrace {
+	return &writeTrace{
+		buffered:        uint64(buffered),
+		outboundRolling: xxhash.New(),
+		writtenRolling:  xxhash.New(),
+	}
+}
+
+// startWriteTrace 连接成为调试连接，开始跟踪之后写入的帧
+func (d *DefaultConn) startWriteTrace() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed.Load() || d.writeTrace.Load() != nil {
+		return
+	}
+	d.writeTrace.Store(newWriteTrace(d.outboundBuffer.BoundBufferSize()))
+}
+
+// traceWrite 通过write写入输出缓冲区，写入的数据记为一帧（调试过期后只记录偏移）
+func (d *DefaultConn) traceWrite(t *writeTrace, b []byte, write func([]byte) (int, error)) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n, err := write(b)
+	if n <= 0 {
+		return n, err
+	}
+	frame := b[:n]
+	if d.eg.isDebugConn(d.id) {
+		_, _ = t.outboundRolling.Write(frame)
+		t.frames = append(t.frames, &writeTraceFrame{
+			index:           t.nextIndex,
+			start:           t.buffered,
+			size:            n,
+			outboundSum:     xxhash.Sum64(frame),
+			outboundRolling: t.outboundRolling.Sum64(),
+			written:         xxhash.New(),
+		})
+		t.nextIndex++
+	}
+	t.buffered += uint64(n)
+	return n, err
+}
+
+// flushTraced 和flush一样把输出缓冲区的数据写入fd，同时计算写入fd的每一帧的hash，需要持有d.mu
+func (d *DefaultConn) flushTraced(t *writeTrace, max int) (int, error) {
+	t.mu.Lock()
+	bufs, _ := d.outboundBuffer.PeekV(max)
+	n, err := d.writeDirectV(bufs)
+	if n > 0 {
+		remaining := n
+		for _, buf := range bufs {
+			if remaining <= 0 {
+				break
+			}
+			if len(buf) > remaining {
+				buf = buf[:remaining]
+			}
+			t.written(d, buf)
+			remaining -= len(buf)
+		}
+		_, _ = d.outboundBuffer.Discard(n)
+	}
+	done := len(t.frames) == 0
+	t.mu.Unlock()
+	if done && !d.eg.isDebugConn(d.id) { // 调试已关闭或过期，跟踪的帧都写完了
+		d.writeTrace.CompareAndSwap(t, nil)
+	}
+	return n, err
+}
+
+// written 写入fd的数据，按帧计算hash，帧写完后比较是否和写入输出缓冲区时一致
+func (t *writeTrace) written(d *DefaultConn, b []byte) {
+	for len(b) > 0 && len(t.frames) > 0 {
+		frame := t.frames[0]
+		if t.flushed < frame.start { // 不属于跟踪的帧（开始跟踪前或调试过期后写入的数据）
+			skip := frame.start - t.flushed
+			if skip > uint64(len(b)) {
+				skip = uint64(len(b))
+			}
+			b = b[skip:]
+			t.flushed += skip
+			continue
+		}
+		take := frame.size - frame.writtenSize
+		if take > len(b) {
+			take = len(b)
+		}
+		_, _ = frame.written.Write(b[:take])
+		_, _ = t.writtenRolling.Write(b[:take])
+		frame.writtenSize += take
+		t.flushed += uint64(take)
+		b = b[take:]
+		if frame.writtenSize < frame.size {
+			return
+		}
+		t.frames[0] = nil
+		t.frames = t.frames[1:]
+		t.frameDone(d, frame)
+	}
+	t.flushed += uint64(len(b))
+}
+
+func (t *writeTrace) frameDone(d *DefaultConn, frame *writeTraceFrame) {
+	writtenSum := frame.written.Sum64()
+	writtenRolling := t.writtenRolling.Sum64()
+	fields := []zap.Field{
+		zap.Int64("id", d.id),
+		zap.String("uid", d.uid),
+		zap.Uint64("frame", frame.index),
+		zap.Int("size", frame.size),
+		zap.Uint64("outboundSum", frame.outboundSum),
+		zap.Uint64("writtenSum", writtenSum),
+		zap.Uint64("outboundRolling", frame.outboundRolling),
+		zap.Uint64("writtenRolling", writtenRolling),
+	}
+	if writtenSum != frame.outboundSum {
+		d.eg.writeChecksumMismatches.Inc()
+		d.Warn("debug conn frame checksum mismatch", fields...)
+		return
+	}
+	d.Info("debug conn frame", fields...)
+}
+
+// WriteMismatches 调试连接写入fd的数据和写入输出缓冲区时不一致的帧数量
+func (e *Engine) WriteMismatches() int64 {
+	return e.writeChecksumMismatches.Load()
+}
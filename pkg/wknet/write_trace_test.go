@@ -0,0 +1,80 @@
+package wknet
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 人为破坏输出缓冲区里的数据，写入fd时能检测到不一致的帧
+func TestWriteTraceChecksumMismatch(t *testing.T) {
+	e := NewEngine(WithAddr("tcp://127.0.0.1:0"))
+	accepted := make(chan Conn, 1)
+	e.OnConnect(func(conn Conn) error {
+		accepted <- conn
+		return nil
+	})
+	err := e.Start()
+	assert.NoError(t, err)
+	defer e.Stop()
+
+	cli, err := net.Dial("tcp", e.TCPRealListenAddr().String())
+	assert.NoError(t, err)
+	defer cli.Close()
+	conn := <-accepted
+	d := conn.(*DefaultConn)
+
+	// 没有调试时不跟踪
+	assert.Nil(t, d.writeTrace.Load())
+	e.SetDebugConn(conn.ID())
+	assert.NotNil(t, d.writeTrace.Load())
+
+	frames := [][]byte{[]byte("frame-0"), []byte("frame-1"), []byte("frame-2")}
+	for _, frame := range frames {
+		_, err = conn.WriteToOutboundBuffer(frame)
+		assert.NoError(t, err)
+	}
+	// 破坏第二帧的一个字节
+	bufs, err := conn.OutboundBuffer().PeekV(-1)
+	assert.NoError(t, err)
+	offset := len(frames[0]) + 2
+	for _, buf := range bufs {
+		if offset < len(buf) {
+			buf[offset] = 'X'
+			break
+		}
+		offset -= len(buf)
+	}
+	assert.NoError(t, conn.WakeWrite())
+
+	var total int
+	for _, frame := range frames {
+		total += len(frame)
+	}
+	received := make([]byte, total)
+	_ = cli.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = io.ReadFull(cli, received)
+	assert.NoError(t, err)
+	assert.Equal(t, "frame-0frXme-1frame-2", string(received))
+
+	assert.Eventually(t, func() bool {
+		return e.WriteMismatches() == 1
+	}, time.Second*5, time.Millisecond*10)
+	assert.Equal(t, int64(1), e.Stats().WriteMismatches)
+
+	// 关闭调试后，跟踪的帧写完就不再跟踪
+	e.SetDebugConn(0)
+	_, err = conn.WriteToOutboundBuffer([]byte("frame-3"))
+	assert.NoError(t, err)
+	assert.NoError(t, conn.WakeWrite())
+	received = make([]byte, len("frame-3"))
+	_, err = io.ReadFull(cli, received)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return d.writeTrace.Load() == nil
+	}, time.Second*5, time.Millisecond*10)
+	assert.Equal(t, int64(1), e.WriteMismatches())
+}
@@ -0,0 +1,131 @@
+package wknet
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/RussellLuo/timingwheel"
+	"github.com/gobwas/ws"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrWSHandshakeTooLarge websocket升级请求超过Options.MaxWSHandshakeBytes，已响应431
+	ErrWSHandshakeTooLarge = errors.New("websocket handshake too large")
+	// ErrWSHandshakeTimeout 连接建立后Options.WSHandshakeTimeout内没有完成websocket握手
+	ErrWSHandshakeTimeout = errors.New("websocket handshake timeout")
+)
+
+// wsHandshakeTooLargeResponse 升级请求过大时的响应
+var wsHandshakeTooLargeResponse = []byte("HTTP/1.1 431 Request Header Fields Too Large\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+
+var wsHandshakeTerminator = []byte("\r\n\r\n")
+
+// UpgradeRequest websocket升级（握手）请求
+type UpgradeRequest struct {
+	Method   string
+	Path     string
+	RawQuery string
+	Host     string
+	Origin   string
+	Header   http.Header // 除websocket协议相关以外的请求头
+}
+
+// WSUpgradeValidator 完成websocket握手前校验升级请求，返回错误则响应403并关闭连接
+type WSUpgradeValidator func(req UpgradeRequest) error
+
+// WSHeaderValueKey 升级请求头在连接上的key，通过conn.Value(WSHeaderValueKey(name))获取Options.WSLabelHeaders配置的请求头
+func WSHeaderValueKey(name string) string {
+	return "ws.header." + textproto.CanonicalMIMEHeaderKey(name)
+}
+
+// wsHandshakeLen 返回buff里完整的升级请求（到空行为止）的长度，还没收到空行时返回0（可能分多次读到）
+// 升级请求超过MaxWSHandshakeBytes时返回ErrWSHandshakeTooLarge
+func (e *Engine) wsHandshakeLen(buff []byte) (int, error) {
+	maxBytes := e.options.MaxWSHandshakeBytes
+	search := buff
+	if maxBytes > 0 && len(search) > maxBytes {
+		search = search[:maxBytes]
+	}
+	if idx := bytes.Index(search, wsHandshakeTerminator); idx >= 0 {
+		return idx + len(wsHandshakeTerminator), nil
+	}
+	if maxBytes > 0 && len(buff) >= maxBytes {
+		return 0, ErrWSHandshakeTooLarge
+	}
+	return 0, nil
+}
+
+// startWSHandshakeTimer WSHandshakeTimeout后连接还没有完成websocket握手则关闭连接，没有设置超时返回nil
+// 连接关闭后DefaultConn会被复用，所以按连接id判断是不是还是同一个连接
+func (e *Engine) startWSHandshakeTimer(d *DefaultConn, upgraded *atomic.Bool) *timingwheel.Timer {
+	timeout := e.options.WSHandshakeTimeout
+	if timeout <= 0 {
+		return nil
+	}
+	id := d.id
+	return e.timingWheel.AfterFunc(timeout, func() {
+		if upgraded.Load() {
+			return
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.id != id || d.closed.Load() {
+			return
+		}
+		d.Debug("websocket handshake timeout, close the connection", zap.Duration("timeout", timeout), zap.String("conn", d.String()))
+		_ = d.closeNeedLock(ErrWSHandshakeTimeout)
+	})
+}
+
+// wsUpgrade 在rw上完成websocket握手，握手失败时响应已经写入rw
+func (e *Engine) wsUpgrade(conn Conn, rw io.ReadWriter) error {
+	validator := e.options.WSUpgradeValidator
+	labelHeaders := e.options.WSLabelHeaders
+	if validator == nil && len(labelHeaders) == 0 {
+		_, err := ws.Upgrader{ReadBufferSize: e.options.MaxWSHandshakeBytes}.Upgrade(rw)
+		return err
+	}
+	req := UpgradeRequest{
+		Method: http.MethodGet, // 不是GET请求的握手会被拒绝
+		Header: http.Header{},
+	}
+	upgrader := ws.Upgrader{
+		ReadBufferSize: e.options.MaxWSHandshakeBytes,
+		OnRequest: func(uri []byte) error {
+			req.Path, req.RawQuery, _ = strings.Cut(string(uri), "?")
+			return nil
+		},
+		OnHost: func(host []byte) error {
+			req.Host = string(host)
+			return nil
+		},
+		OnHeader: func(key, value []byte) error {
+			req.Header.Add(string(key), string(value))
+			return nil
+		},
+		OnBeforeUpgrade: func() (ws.HandshakeHeader, error) {
+			req.Origin = req.Header.Get("Origin")
+			if validator != nil {
+				if err := validator(req); err != nil {
+					return nil, ws.RejectConnectionError(ws.RejectionStatus(http.StatusForbidden), ws.RejectionReason(err.Error()))
+				}
+			}
+			return ws.HandshakeHeaderString(""), nil
+		},
+	}
+	if _, err := upgrader.Upgrade(rw); err != nil {
+		return err
+	}
+	for _, name := range labelHeaders {
+		if value := req.Header.Get(name); value != "" {
+			conn.SetValue(WSHeaderValueKey(name), value)
+		}
+	}
+	return nil
+}
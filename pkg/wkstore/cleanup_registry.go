@@ -0,0 +1,269 @@
+package wkstore
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	wkproto "github.com/WuKongIM/WuKongIMGoProto"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// CleanupScope 删除用户或频道的数据时传给清理钩子的参数
+type CleanupScope struct {
+	UID         string             // DeleteUserData时为删除的用户
+	ChannelID   string             // DeleteChannelData时为删除的频道
+	ChannelType uint8              // DeleteChannelData时为删除的频道类型
+	Opts        MaintenanceOptions // DryRun时只统计不写入，需要分批处理的钩子按RateLimit限速并回调Progress
+}
+
+// CleanupHook 删除用户或频道时清理一类引用了它的数据，返回清理（DryRun时为会清理）的数量
+// 数据多的钩子应该分批，每批一个写事务；返回错误后不再调用后面的钩子，已经提交的不会回滚，可以重新调用继续清理
+type CleanupHook func(scope CleanupScope) (int, error)
+
+// CleanupStep 一个清理钩子的执行结果
+type CleanupStep struct {
+	Name    string        `json:"name"`            // 钩子名称
+	Removed int           `json:"removed"`         // 清理（DryRun时为会清理）的数量
+	Elapsed time.Duration `json:"elapsed"`         // 耗时
+	Err     string        `json:"error,omitempty"` // 钩子返回的错误
+}
+
+// CleanupReport 删除用户或频道数据的结果，出错时只有已经执行的钩子
+type CleanupReport struct {
+	DryRun bool           `json:"dry_run"`
+	Steps  []*CleanupStep `json:"steps"` // 按注册顺序执行的钩子
+	Done   bool           `json:"done"`  // 所有钩子是否都执行成功
+}
+
+type namedCleanupHook struct {
+	name string
+	hook CleanupHook
+}
+
+// cleanupRegistry 删除用户或频道时需要清理的数据，各模块注册自己的钩子，不需要在删除的地方逐个处理
+type cleanupRegistry struct {
+	mu      sync.RWMutex
+	user    []namedCleanupHook
+	channel []namedCleanupHook
+}
+
+func (r *cleanupRegistry) hooks(channel bool) []namedCleanupHook {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if channel {
+		return append([]namedCleanupHook(nil), r.channel...)
+	}
+	return append([]namedCleanupHook(nil), r.user...)
+}
+
+// RegisterUserCleanup 注册删除用户（DeleteUserData）时的清理钩子，按注册顺序执行
+func (f *FileStore) RegisterUserCleanup(name string, hook CleanupHook) {
+	f.cleanups.mu.Lock()
+	defer f.cleanups.mu.Unlock()
+	f.cleanups.user = append(f.cleanups.user, namedCleanupHook{name: name, hook: hook})
+}
+
+// RegisterChannelCleanup 注册删除频道（DeleteChannelData）时的清理钩子，按注册顺序执行
+func (f *FileStore) RegisterChannelCleanup(name string, hook CleanupHook) {
+	f.cleanups.mu.Lock()
+	defer f.cleanups.mu.Unlock()
+	f.cleanups.channel = append(f.cleanups.channel, namedCleanupHook{name: name, hook: hook})
+}
+
+// DeleteUserData 依次调用删除用户的清理钩子，删除引用了此用户的数据，出错时返回已经执行的钩子的结果和错误
+func (f *FileStore) DeleteUserData(uid string, opts MaintenanceOptions) (*CleanupReport, error) {
+	defer f.trace("DeleteUserData", uid, time.Now(), zap.Bool("dryRun", opts.DryRun))
+	if uid == "" {
+		return nil, wrapError("DeleteUserData", ErrInvalidConversation, uid, "", 0)
+	}
+	report, err := f.runCleanups(f.cleanups.hooks(false), CleanupScope{UID: uid, Opts: opts})
+	return report, wrapError("DeleteUserData", err, uid, "", 0)
+}
+
+// DeleteChannelData 依次调用删除频道的清理钩子，删除引用了此频道的数据，出错时返回已经执行的钩子的结果和错误
+func (f *FileStore) DeleteChannelData(channelID string, channelType uint8, opts MaintenanceOptions) (*CleanupReport, error) {
+	defer f.trace("DeleteChannelData", "", time.Now(), zap.String("channelID", channelID), zap.Uint8("channelType", channelType), zap.Bool("dryRun", opts.DryRun))
+	if channelID == "" {
+		return nil, wrapError("DeleteChannelData", ErrInvalidChannel, "", channelID, channelType)
+	}
+	report, err := f.runCleanups(f.cleanups.hooks(true), CleanupScope{ChannelID: channelID, ChannelType: channelType, Opts: opts})
+	return report, wrapError("DeleteChannelData", err, "", channelID, channelType)
+}
+
+func (f *FileStore) runCleanups(hooks []namedCleanupHook, scope CleanupScope) (*CleanupReport, error) {
+	report := &CleanupReport{DryRun: scope.Opts.DryRun, Steps: make([]*CleanupStep, 0, len(hooks))}
+	for _, h := range hooks {
+		start := time.Now()
+		removed, err := h.hook(scope)
+		step := &CleanupStep{Name: h.name, Removed: removed, Elapsed: time.Since(start)}
+		report.Steps = append(report.Steps, step)
+		if err != nil {
+			step.Err = err.Error()
+			return report, fmt.Errorf("cleanup %s: %w", h.name, err)
+		}
+	}
+	report.Done = true
+	return report, nil
+}
+
+// registerConversationCleanups 最近会话模块的清理：删除用户时删除最近会话、订阅关系、快照和隔离区，删除频道时删除本地用户的最近会话和订阅关系
+func (f *FileStore) registerConversationCleanups() {
+	f.RegisterUserCleanup("conversation_relations", f.cleanupUserSubscriptions)
+	f.RegisterUserCleanup("conversations", f.cleanupUserConversations)
+	f.RegisterUserCleanup("conversation_snapshots", f.cleanupUserConversationSnapshots)
+	f.RegisterUserCleanup("conversation_quarantine", f.cleanupUserConversationQuarantine)
+
+	f.RegisterChannelCleanup("conversations", func(scope CleanupScope) (int, error) {
+		return f.deleteConversationsByChannel(scope.ChannelID, scope.ChannelType, scope.Opts)
+	})
+	f.RegisterChannelCleanup("subscribers", f.cleanupChannelSubscribers)
+}
+
+// cleanupUserSubscriptions 从用户有最近会话的频道的订阅者里移除用户（个人频道没有订阅关系）
+func (f *FileStore) cleanupUserSubscriptions(scope CleanupScope) (int, error) {
+	conversations, err := f.getConversations(scope.UID)
+	if err != nil {
+		return 0, err
+	}
+	channels := make([]*Conversation, 0, len(conversations))
+	for _, conversation := range conversations {
+		if conversation.ChannelType != wkproto.ChannelTypePerson {
+			channels = append(channels, conversation)
+		}
+	}
+	if scope.Opts.DryRun || len(channels) == 0 {
+		return len(channels), nil
+	}
+	err = f.update(func(t *bolt.Tx) error {
+		for _, conversation := range channels {
+			if err := f.removeSubscribersInTx(t, conversation.ChannelID, conversation.ChannelType, []string{scope.UID}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(channels), nil
+}
+
+// cleanupUserConversations 删除用户的最近会话、最近会话的版本号和删除记录
+func (f *FileStore) cleanupUserConversations(scope CleanupScope) (int, error) {
+	key := f.getConversationKey(scope.UID)
+	f.lock.Lock(key)
+	defer f.lock.Unlock(key)
+	count := 0
+	tx := f.update
+	if scope.Opts.DryRun {
+		tx = f.view
+	}
+	err := tx(func(t *bolt.Tx) error {
+		bucket, err := f.getSlotBucketWithKey(scope.UID, t)
+		if err != nil {
+			return err
+		}
+		value := bucket.Get([]byte(key))
+		if len(value) > 0 {
+			conversations, err := decodeConversations(value, true)
+			if err != nil {
+				return err
+			}
+			count = len(conversations)
+		}
+		if scope.Opts.DryRun {
+			return nil
+		}
+		if err = bucket.Delete([]byte(key)); err != nil {
+			return err
+		}
+		if err = bucket.Delete(f.getConversationsVersionKey(scope.UID)); err != nil {
+			return err
+		}
+		return bucket.Delete(f.getConversationTombstoneKey(scope.UID))
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// cleanupUserConversationSnapshots 删除用户的最近会话快照
+func (f *FileStore) cleanupUserConversationSnapshots(scope CleanupScope) (int, error) {
+	count := 0
+	tx := f.update
+	if scope.Opts.DryRun {
+		tx = f.view
+	}
+	err := tx(func(t *bolt.Tx) error {
+		bucket, err := f.getSlotBucketWithKey(scope.UID, t)
+		if err != nil {
+			return err
+		}
+		ids := f.conversationSnapshotIDs(scope.UID, bucket)
+		count = len(ids)
+		if scope.Opts.DryRun {
+			return nil
+		}
+		for _, id := range ids {
+			if err = bucket.Delete(f.getConversationSnapshotKey(scope.UID, id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// cleanupUserConversationQuarantine 删除用户被隔离的频道类型为0的最近会话
+func (f *FileStore) cleanupUserConversationQuarantine(scope CleanupScope) (int, error) {
+	count := 0
+	tx := f.update
+	if scope.Opts.DryRun {
+		tx = f.view
+	}
+	err := tx(func(t *bolt.Tx) error {
+		bucket, err := f.getSlotBucketWithKey(scope.UID, t)
+		if err != nil {
+			return err
+		}
+		key := f.getConversationQuarantineKey(scope.UID)
+		value := bucket.Get(key)
+		if len(value) == 0 {
+			return nil
+		}
+		conversations, err := decodeConversations(value, true)
+		if err != nil {
+			return err
+		}
+		count = len(conversations)
+		if scope.Opts.DryRun {
+			return nil
+		}
+		return bucket.Delete(key)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// cleanupChannelSubscribers 删除频道剩下的订阅关系（没有最近会话的订阅者）
+func (f *FileStore) cleanupChannelSubscribers(scope CleanupScope) (int, error) {
+	subscribers, err := f.GetSubscribers(scope.ChannelID, scope.ChannelType)
+	if err != nil {
+		return 0, err
+	}
+	if scope.Opts.DryRun || len(subscribers) == 0 {
+		return len(subscribers), nil
+	}
+	if err = f.RemoveAllSubscriber(scope.ChannelID, scope.ChannelType); err != nil {
+		return 0, err
+	}
+	return len(subscribers), nil
+}
@@ -0,0 +1,127 @@
+package wkstore
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeleteUserData(t *testing.T) {
+	store := newTestFileStore(t)
+
+	err := store.AddSubscribers("g1", 2, []string{"u1", "u2"})
+	assert.NoError(t, err)
+	err = store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, Version: 1},
+		{UID: "u1", ChannelID: "u2", ChannelType: 1, Version: 1},
+	})
+	assert.NoError(t, err)
+	_, err = store.SnapshotUserConversations("u1")
+	assert.NoError(t, err)
+
+	// DryRun只统计
+	report, err := store.DeleteUserData("u1", MaintenanceOptions{DryRun: true})
+	assert.NoError(t, err)
+	assert.True(t, report.Done)
+	assert.Equal(t, []int{1, 2, 1, 0}, cleanupRemoved(report))
+	conversations, err := store.GetConversations("u1")
+	assert.NoError(t, err)
+	assert.Len(t, conversations, 2)
+
+	report, err = store.DeleteUserData("u1", MaintenanceOptions{})
+	assert.NoError(t, err)
+	assert.True(t, report.Done)
+	assert.Equal(t, []string{"conversation_relations", "conversations", "conversation_snapshots", "conversation_quarantine"}, cleanupNames(report))
+	assert.Equal(t, []int{1, 2, 1, 0}, cleanupRemoved(report))
+
+	conversations, err = store.GetConversations("u1")
+	assert.NoError(t, err)
+	assert.Empty(t, conversations)
+	snapshots, err := store.ListUserConversationSnapshots("u1")
+	assert.NoError(t, err)
+	assert.Empty(t, snapshots)
+	subscribers, err := store.GetSubscribers("g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"u2"}, subscribers)
+}
+
+func TestDeleteChannelData(t *testing.T) {
+	store := newTestFileStore(t)
+	store.cfg.ScanBatchSize = 1
+
+	err := store.AddSubscribers("g1", 2, []string{"u1", "u2", "u3"})
+	assert.NoError(t, err)
+	for _, uid := range []string{"u1", "u2"} {
+		err = store.AddOrUpdateConversations(uid, []*Conversation{{UID: uid, ChannelID: "g1", ChannelType: 2, Version: 1}})
+		assert.NoError(t, err)
+	}
+
+	var progresses []ProgressEvent
+	report, err := store.DeleteChannelData("g1", 2, MaintenanceOptions{Progress: func(event ProgressEvent) {
+		progresses = append(progresses, event)
+	}})
+	assert.NoError(t, err)
+	assert.True(t, report.Done)
+	assert.Equal(t, []string{"conversations", "subscribers"}, cleanupNames(report))
+	assert.Equal(t, []int{2, 0}, cleanupRemoved(report)) // 订阅关系和最近会话一起删除了
+	assert.Len(t, progresses, 4)                         // 每个用户一批，最后一次为完成
+	assert.True(t, progresses[len(progresses)-1].Done)
+
+	for _, uid := range []string{"u1", "u2"} {
+		exist, err := store.ExistConversation(uid, "g1", 2)
+		assert.NoError(t, err)
+		assert.False(t, exist)
+	}
+	subscribers, err := store.GetSubscribers("g1", 2)
+	assert.NoError(t, err)
+	assert.Empty(t, subscribers)
+}
+
+func TestDeleteUserDataHookFail(t *testing.T) {
+	store := newTestFileStore(t)
+	errHook := errors.New("hook fail")
+	var calls []string
+	store.cleanups = cleanupRegistry{}
+	store.RegisterUserCleanup("first", func(scope CleanupScope) (int, error) {
+		calls = append(calls, "first")
+		return 3, nil
+	})
+	store.RegisterUserCleanup("fail", func(scope CleanupScope) (int, error) {
+		calls = append(calls, "fail")
+		return 1, errHook
+	})
+	store.RegisterUserCleanup("last", func(scope CleanupScope) (int, error) {
+		calls = append(calls, "last")
+		return 0, nil
+	})
+
+	// 出错后不再执行后面的钩子，返回已经执行的进度
+	report, err := store.DeleteUserData("u1", MaintenanceOptions{})
+	assert.ErrorIs(t, err, errHook)
+	assert.Equal(t, []string{"first", "fail"}, calls)
+	assert.False(t, report.Done)
+	assert.Equal(t, []string{"first", "fail"}, cleanupNames(report))
+	assert.Equal(t, []int{3, 1}, cleanupRemoved(report))
+	assert.Empty(t, report.Steps[0].Err)
+	assert.Equal(t, "hook fail", report.Steps[1].Err)
+
+	_, err = store.DeleteUserData("", MaintenanceOptions{})
+	assert.ErrorIs(t, err, ErrInvalidConversation)
+}
+
+func cleanupNames(report *CleanupReport) []string {
+	names := make([]string, 0, len(report.Steps))
+	for _, step := range report.Steps {
+		names = append(names, step.Name)
+	}
+	return names
+}
+
+func cleanupRemoved(report *CleanupReport) []int {
+	removed := make([]int, 0, len(report.Steps))
+	for _, step := range report.Steps {
+		removed = append(removed, step.Removed)
+	}
+	return removed
+}
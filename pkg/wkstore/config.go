@@ -1,5 +1,7 @@
 package wkstore
 
+import "time"
+
 type StoreConfig struct {
 	SlotNum                    int //
 	DataDir                    string
@@ -8,15 +10,74 @@ type StoreConfig struct {
 	SegmentMaxBytes            int64 // each segment max size of bytes default 2G
 	DecodeMessageFnc           func(msg []byte) (Message, error)
 	StreamCacheSize            int // stream cache size
+
+	ScanBatchSize    int           // 扫描数据时每个读事务处理的key数量
+	ScanBatchBackoff time.Duration // 扫描数据时每批之间的间隔，避免扫描占用太多资源
+
+	ConversationStatsThresholds []int // 最近会话统计时关注的会话数量阈值，超过阈值的用户会被统计出来
+	ConversationStatsMaxUIDs    int   // 每个阈值最多返回的uid数量
+
+	ConversationChannelInfo          bool // 最近会话是否冗余存储频道名称和头像，开启后客户端同步最近会话时不需要再查询频道信息
+	ConversationChannelInfoCacheSize int  // 频道名称和头像的缓存数量，写最近会话时用缓存里的值刷新
+
+	MaxConversationsPerUser             int                     // 每个用户最多的最近会话数量，0表示不限制
+	ConversationQuotaPolicy             ConversationQuotaPolicy // 最近会话数量达到上限后的处理策略
+	ConversationQuotaExemptChannelTypes []uint8                 // 不受数量限制的频道类型（比如系统频道）
+
+	ConversationCompress          bool // 是否压缩存储较大的最近会话数据（snappy）
+	ConversationCompressThreshold int  // 用户的最近会话数据超过此大小才压缩
+
+	ConversationSnapshotMaxCount int // 每个用户最多保存的最近会话快照数量，超过后删除最旧的，0表示不限制
+
+	ConversationTombstoneMaxCount int // 每个用户最多保留的删除最近会话的记录（增量同步用），超过后删除最旧的，客户端版本号更旧时需要全量同步，0表示不限制
+
+	ConversationLeavePolicy ConversationLeavePolicy // 用户离开频道后最近会话的处理策略
+
+	ConversationTTL           map[uint8]time.Duration // 每种频道类型的最近会话超过多久没有会话（按最后一次会话时间）被RunConversationCleanup删除，没有配置的频道类型不删除
+	ConversationCleanupBatch  int                     // 清理过期最近会话时每个写事务最多删除的数量（按用户，一个用户的不会拆开）
+	ConversationCleanupBudget time.Duration           // 每次清理过期最近会话最多执行的时间，超过后下次继续，0表示不限制
+
+	Clock func() time.Time // 生成最近会话版本号等使用的时钟，为nil使用time.Now
+
+	StartupCheck                 StartupCheckMode // 打开数据库时检查最近会话数据的方式（非正常退出后确认数据没有损坏再提供服务），为空表示不检查
+	StartupCheckSampleKeys       int              // 抽样检查最多检查的用户数量，0表示不限制
+	StartupCheckBudget           time.Duration    // 抽样检查最多执行的时间，超过后提前结束，0表示不限制
+	StartupCheckFailOnCorruption bool             // 损坏的用户比例超过StartupCheckMaxCorruptRatio时Open返回ErrStartupCheckFailed
+	StartupCheckMaxCorruptRatio  float64          // 允许的损坏用户比例（损坏的用户数量/检查的用户数量），默认为0表示有损坏就拒绝
+
+	MemoryBudget        int64                                              // 存储层缓存的内存预算（字节），超过水位时调用OnMemoryPressure，0表示不检查
+	MemoryWarningRatio  float64                                            // 内存使用量达到预算的此比例为MemoryPressureWarning
+	MemoryCriticalRatio float64                                            // 内存使用量达到预算的此比例为MemoryPressureCritical，不再写入缓存
+	MemoryCheckInterval time.Duration                                      // 检查内存使用量的间隔
+	OnMemoryPressure    func(level MemoryPressureLevel, usage MemoryUsage) // 内存压力等级变化的回调
+	ExternalMemoryUsage func() int64                                       // 调用方为存储层缓存的数据大小（比如最近会话缓存），计入内存使用量
 }
 
 func NewStoreConfig() *StoreConfig {
 	return &StoreConfig{
-		SlotNum:                    256,
-		DataDir:                    "./data",
-		MaxSegmentCacheNum:         2000,
-		EachMessagegMaxSizeOfBytes: 1024 * 1024 * 2, // 2M
-		SegmentMaxBytes:            1024 * 1024 * 1024 * 2,
-		StreamCacheSize:            40,
+		SlotNum:                     256,
+		DataDir:                     "./data",
+		MaxSegmentCacheNum:          2000,
+		EachMessagegMaxSizeOfBytes:  1024 * 1024 * 2, // 2M
+		SegmentMaxBytes:             1024 * 1024 * 1024 * 2,
+		StreamCacheSize:             40,
+		ScanBatchSize:               1000,
+		ScanBatchBackoff:            time.Millisecond * 5,
+		ConversationStatsThresholds: []int{5000},
+		ConversationStatsMaxUIDs:    100,
+
+		ConversationChannelInfoCacheSize: 10000,
+		ConversationCompressThreshold:    1024,
+		ConversationSnapshotMaxCount:     10,
+		ConversationTombstoneMaxCount:    1000,
+		ConversationCleanupBatch:         500,
+		ConversationCleanupBudget:        time.Second,
+
+		StartupCheckSampleKeys: 10000,
+		StartupCheckBudget:     time.Second * 5,
+
+		MemoryWarningRatio:  0.8,
+		MemoryCriticalRatio: 0.95,
+		MemoryCheckInterval: time.Second,
 	}
 }
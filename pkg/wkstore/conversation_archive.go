@@ -0,0 +1,83 @@
+package wkstore
+
+import (
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// SetConversationArchived 归档或取消归档用户的最近会话，只修改是否已归档和版本号（未读数和最后一条消息等不变），返回修改后的最近会话，最近会话不存在返回ErrNotFound
+func (f *FileStore) SetConversationArchived(uid string, channelID string, channelType uint8, archived bool) (*Conversation, error) {
+	defer f.trace("SetConversationArchived", uid, time.Now(), zap.String("channelID", channelID), zap.Uint8("channelType", channelType), zap.Bool("archived", archived))
+	conversation, err := f.setConversationArchived(uid, channelID, channelType, archived)
+	return conversation, wrapError("SetConversationArchived", err, uid, channelID, channelType)
+}
+
+func (f *FileStore) setConversationArchived(uid string, channelID string, channelType uint8, archived bool) (*Conversation, error) {
+	if uid == "" || !validConversationChannel(channelID, channelType) {
+		return nil, ErrInvalidConversation
+	}
+	key := f.getConversationKey(uid)
+	f.lock.Lock(key)
+	defer f.lock.Unlock(key)
+
+	var conversation *Conversation
+	err := f.update(func(t *bolt.Tx) error {
+		return f.updateConversationInTx(t, uid, channelID, channelType, func(conversations []*Conversation, idx int) []*Conversation {
+			conversation = conversations[idx]
+			if conversation.Archived == archived {
+				return nil
+			}
+			conversation.Archived = archived
+			conversation.Version = f.newConversationVersion()
+			return conversations
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if conversation == nil {
+		return nil, ErrNotFound
+	}
+	newConversation := *conversation
+	return &newConversation, nil
+}
+
+// GetArchivedConversations 用户已归档的最近会话，按最后一条消息的时间从新到旧，limit<=0表示不限制
+// 用户的最近会话存储在一起，读取后过滤即可，不需要单独的索引
+func (f *FileStore) GetArchivedConversations(uid string, limit int) ([]*Conversation, error) {
+	defer f.trace("GetArchivedConversations", uid, time.Now(), zap.Int("limit", limit))
+	conversations, err := f.getConversations(uid)
+	if err != nil {
+		return nil, wrapError("GetArchivedConversations", err, uid, "", 0)
+	}
+	return ArchivedConversations(conversations, limit), nil
+}
+
+// ArchivedConversations 从最近会话里取出已归档的，按最后一条消息的时间从新到旧，limit<=0表示不限制
+func ArchivedConversations(conversations []*Conversation, limit int) []*Conversation {
+	archived := make([]*Conversation, 0)
+	for _, conversation := range conversations {
+		if conversation != nil && conversation.Archived {
+			archived = append(archived, conversation)
+		}
+	}
+	sort.SliceStable(archived, func(i, j int) bool {
+		return archived[i].Timestamp > archived[j].Timestamp
+	})
+	if limit > 0 && len(archived) > limit {
+		archived = archived[:limit]
+	}
+	return archived
+}
+
+// carryArchived 是否已归档只能通过SetConversationArchived修改，更新已有的最近会话时保留原来的归档状态（缓存里的最近会话可能是设置前读取的）
+func carryArchived(merged *Conversation, stored *Conversation) bool {
+	if merged.Archived == stored.Archived {
+		return false
+	}
+	merged.Archived = stored.Archived
+	return true
+}
@@ -0,0 +1,129 @@
+package wkstore
+
+import (
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// ConversationCAS 按版本号比较后写入的最近会话
+type ConversationCAS struct {
+	Conversation    *Conversation
+	ExpectedVersion int64 // 读取时最近会话的版本号（Conversation.Version），0表示期望最近会话还不存在
+}
+
+// VersionConflictError 按版本号写入时最近会话已经被修改，Current为当前存储的最近会话（nil表示不存在），调用方合并后可以用它的版本号重试
+type VersionConflictError struct {
+	Key      ConversationKey
+	Expected int64
+	Current  *Conversation
+}
+
+func (e *VersionConflictError) Error() string {
+	var current int64
+	if e.Current != nil {
+		current = e.Current.Version
+	}
+	return fmt.Sprintf("%s: conversation %s/%d expected version %d, current %d", ErrVersionConflict, e.Key.ChannelID, e.Key.ChannelType, e.Expected, current)
+}
+
+func (e *VersionConflictError) Unwrap() error {
+	return ErrVersionConflict
+}
+
+// AddOrUpdateConversationsCAS 和AddOrUpdateConversations一样添加或更新最近会话，但是每条最近会话当前的版本号必须和ExpectedVersion一致
+// 比较和写入在同一个事务里，有一条不一致时都不写入，返回*VersionConflictError（errors.Is(err, ErrVersionConflict)）
+// 写入的最近会话的版本号由存储生成（比已存储的都大），返回写入后的最近会话，不会修改传入的最近会话
+func (f *FileStore) AddOrUpdateConversationsCAS(uid string, items []ConversationCAS) ([]*Conversation, error) {
+	defer f.trace("AddOrUpdateConversationsCAS", uid, time.Now(), zap.Int("count", len(items)))
+	conversations, err := f.addOrUpdateConversationsCAS(uid, items)
+	return conversations, wrapError("AddOrUpdateConversationsCAS", err, uid, "", 0)
+}
+
+func (f *FileStore) addOrUpdateConversationsCAS(uid string, items []ConversationCAS) ([]*Conversation, error) {
+	if uid == "" {
+		return nil, ErrInvalidConversation
+	}
+	if len(items) == 0 {
+		return nil, nil
+	}
+	expected := make(map[ConversationKey]int64, len(items))
+	updates := make([]*Conversation, 0, len(items))
+	for _, item := range items {
+		if item.Conversation == nil || !validConversationChannel(item.Conversation.ChannelID, item.Conversation.ChannelType) {
+			return nil, ErrInvalidConversation
+		}
+		channelKey := ConversationKey{ChannelID: item.Conversation.ChannelID, ChannelType: item.Conversation.ChannelType}
+		if _, ok := expected[channelKey]; ok { // 同一个最近会话只能有一个期望的版本号
+			return nil, ErrInvalidConversation
+		}
+		expected[channelKey] = item.ExpectedVersion
+		update := *item.Conversation
+		update.UID = uid
+		updates = append(updates, &update)
+	}
+	if f.cfg.ConversationChannelInfo { // 在写事务外查询频道信息
+		f.fillChannelInfo(updates)
+	}
+	key := f.getConversationKey(uid)
+	f.lock.Lock(key)
+	defer f.lock.Unlock(key)
+
+	written := make([]*Conversation, 0, len(updates))
+	var created []*Conversation
+	err := f.update(func(t *bolt.Tx) error {
+		bucket, err := f.getSlotBucketWithKey(uid, t)
+		if err != nil {
+			return err
+		}
+		oldConversations := make([]*Conversation, 0)
+		if value := bucket.Get([]byte(key)); len(value) > 0 {
+			if oldConversations, err = decodeConversations(value, false); err != nil {
+				return err
+			}
+		}
+		current := make(map[ConversationKey]*Conversation, len(oldConversations))
+		for _, conversation := range oldConversations {
+			current[ConversationKey{ChannelID: conversation.ChannelID, ChannelType: conversation.ChannelType}] = conversation
+		}
+		for _, update := range updates {
+			channelKey := ConversationKey{ChannelID: update.ChannelID, ChannelType: update.ChannelType}
+			conversation := current[channelKey]
+			var version int64
+			if conversation != nil {
+				version = conversation.Version
+			}
+			if version != expected[channelKey] {
+				if conversation != nil {
+					copied := *conversation
+					conversation = &copied
+				}
+				return &VersionConflictError{Key: ConversationKey{UID: uid, ChannelID: update.ChannelID, ChannelType: update.ChannelType}, Expected: expected[channelKey], Current: conversation}
+			}
+		}
+		version := f.newConversationVersion()
+		for _, update := range updates {
+			update.Version = version
+		}
+		newConversations := f.mergeNewConversations(oldConversations, updates)
+		created = append(created[:0], newConversations[len(oldConversations):]...)
+		if newConversations, err = f.applyConversationQuota(uid, newConversations, len(oldConversations), updates); err != nil {
+			return err
+		}
+		written = written[:0]
+		for _, conversation := range newConversations {
+			if _, ok := expected[ConversationKey{ChannelID: conversation.ChannelID, ChannelType: conversation.ChannelType}]; ok {
+				copied := *conversation
+				written = append(written, &copied)
+			}
+		}
+		return f.putUserConversationsInTx(bucket, uid, f.encodeConversations(newConversations))
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.conversationOps.addWrites(updates, created)
+	return written, nil
+}
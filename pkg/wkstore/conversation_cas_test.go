@@ -0,0 +1,63 @@
+package wkstore
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddOrUpdateConversationsCAS(t *testing.T) {
+	store := newTestFileStore(t)
+
+	// 期望不存在
+	written, err := store.AddOrUpdateConversationsCAS("u1", []ConversationCAS{
+		{Conversation: &Conversation{ChannelID: "g1", ChannelType: 2, UnreadCount: 1, LastMsgSeq: 1}},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, written, 1)
+	assert.Equal(t, "u1", written[0].UID)
+	assert.Greater(t, written[0].Version, int64(0))
+	v1 := written[0].Version
+
+	// 另一个节点用旧的版本号写入被拒绝，返回当前的最近会话
+	_, err = store.AddOrUpdateConversationsCAS("u1", []ConversationCAS{
+		{Conversation: &Conversation{ChannelID: "g1", ChannelType: 2, UnreadCount: 5, LastMsgSeq: 5}},
+	})
+	assert.ErrorIs(t, err, ErrVersionConflict)
+	var conflict *VersionConflictError
+	assert.True(t, errors.As(err, &conflict))
+	assert.Equal(t, int64(0), conflict.Expected)
+	assert.Equal(t, v1, conflict.Current.Version)
+	assert.Equal(t, 1, conflict.Current.UnreadCount)
+
+	// 合并后用当前的版本号重试
+	update := &Conversation{ChannelID: "g1", ChannelType: 2, UnreadCount: 6, LastMsgSeq: 6}
+	written, err = store.AddOrUpdateConversationsCAS("u1", []ConversationCAS{{Conversation: update, ExpectedVersion: conflict.Current.Version}})
+	assert.NoError(t, err)
+	assert.Greater(t, written[0].Version, v1) // 每次写入版本号都变大
+	assert.Equal(t, int64(0), update.Version) // 不修改传入的最近会话
+	conversation, err := store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, conversation.UnreadCount)
+	assert.Equal(t, written[0].Version, conversation.Version)
+
+	// 有一条冲突时都不写入
+	_, err = store.AddOrUpdateConversationsCAS("u1", []ConversationCAS{
+		{Conversation: &Conversation{ChannelID: "g2", ChannelType: 2, UnreadCount: 1}},
+		{Conversation: &Conversation{ChannelID: "g1", ChannelType: 2, UnreadCount: 9}, ExpectedVersion: v1},
+	})
+	assert.ErrorIs(t, err, ErrVersionConflict)
+	exist, err := store.ExistConversation("u1", "g2", 2)
+	assert.NoError(t, err)
+	assert.False(t, exist)
+
+	// 重复的最近会话和保留的频道类型不合法
+	_, err = store.AddOrUpdateConversationsCAS("u1", []ConversationCAS{
+		{Conversation: &Conversation{ChannelID: "g2", ChannelType: 2}},
+		{Conversation: &Conversation{ChannelID: "g2", ChannelType: 2}},
+	})
+	assert.ErrorIs(t, err, ErrInvalidConversation)
+	_, err = store.AddOrUpdateConversationsCAS("u1", []ConversationCAS{{Conversation: &Conversation{ChannelID: "g2"}}})
+	assert.ErrorIs(t, err, ErrInvalidConversation)
+}
@@ -0,0 +1,73 @@
+package wkstore
+
+import "fmt"
+
+// channelDisplayInfo 频道的展示信息
+type channelDisplayInfo struct {
+	name   string
+	avatar string
+}
+
+// RefreshConversationChannelInfo 频道名称或头像修改后，更新缓存并刷新本地用户（频道订阅者）的最近会话，返回涉及的最近会话
+// 个人频道没有订阅者，只更新缓存，用户的最近会话在下次写入时刷新
+// 没有开启ConversationChannelInfo时不做任何处理
+func (f *FileStore) RefreshConversationChannelInfo(channelID string, channelType uint8, name string, avatar string) ([]ConversationKey, error) {
+	keys, err := f.refreshConversationChannelInfo(channelID, channelType, name, avatar)
+	return keys, wrapError("RefreshConversationChannelInfo", err, "", channelID, channelType)
+}
+
+func (f *FileStore) refreshConversationChannelInfo(channelID string, channelType uint8, name string, avatar string) ([]ConversationKey, error) {
+	if !f.cfg.ConversationChannelInfo {
+		return nil, nil
+	}
+	if channelID == "" {
+		return nil, ErrInvalidConversation
+	}
+	if f.MemoryPressure() == MemoryPressureCritical { // 内存紧张时不缓存，删除旧的缓存（不能再用旧的值刷新最近会话）
+		f.channelInfoCache.Remove(channelInfoCacheKey(channelID, channelType))
+	} else {
+		f.channelInfoCache.Add(channelInfoCacheKey(channelID, channelType), channelDisplayInfo{name: name, avatar: avatar})
+	}
+
+	keys, _, err := f.forEachChannelConversation(channelID, channelType, "RefreshConversationChannelInfo", MaintenanceOptions{}, func(uid string, conversations []*Conversation, idx int) ([]*Conversation, bool, error) {
+		return conversations, conversations[idx].RefreshChannelInfo(name, avatar), nil
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// fillChannelInfo 写最近会话时，缓存里有不一样的频道名称或头像则使用缓存里的（缓存是最后一次刷新的值）
+// 会替换为副本修改，不修改调用方传入的最近会话
+func (f *FileStore) fillChannelInfo(conversations []*Conversation) {
+	for i, conversation := range conversations {
+		info, ok := f.channelInfoCache.Get(channelInfoCacheKey(conversation.ChannelID, conversation.ChannelType))
+		if !ok {
+			continue
+		}
+		if conversation.ChannelName == info.name && conversation.ChannelAvatar == info.avatar {
+			continue
+		}
+		newConversation := *conversation
+		newConversation.RefreshChannelInfo(info.name, info.avatar)
+		conversations[i] = &newConversation
+	}
+}
+
+// carryChannelInfo 更新的最近会话没有带频道名称和头像时保留原来的（调用方一般不关心频道信息）
+func carryChannelInfo(merged *Conversation, stored *Conversation) bool {
+	if merged.ChannelName != "" || merged.ChannelAvatar != "" {
+		return false
+	}
+	if stored.ChannelName == "" && stored.ChannelAvatar == "" {
+		return false
+	}
+	merged.ChannelName = stored.ChannelName
+	merged.ChannelAvatar = stored.ChannelAvatar
+	return true
+}
+
+func channelInfoCacheKey(channelID string, channelType uint8) string {
+	return fmt.Sprintf("%s-%d", channelID, channelType)
+}
@@ -0,0 +1,171 @@
+package wkstore
+
+import (
+	"context"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// ConversationCleanupResult 一次清理过期最近会话的结果
+type ConversationCleanupResult struct {
+	ScannedUsers int               // 扫描的用户数量
+	Purged       []ConversationKey // 删除的最近会话（调用方用来清除缓存）
+	Done         bool              // 是否扫描完了所有用户，为false表示超过了时间预算，下次从停下的位置继续
+}
+
+// conversationCleanupCursor 清理过期最近会话停下的位置，下次从这个用户开始
+type conversationCleanupCursor struct {
+	slot uint32
+	key  []byte
+}
+
+// ConversationsPurged 超过ConversationTTL被清理的最近会话数量（进程启动后）
+func (f *FileStore) ConversationsPurged() int64 {
+	return f.conversationsPurged.Load()
+}
+
+// conversationExpired 最近会话是否超过了频道类型配置的ConversationTTL（按最后一次会话时间）
+func (f *FileStore) conversationExpired(conversation *Conversation, now time.Time) bool {
+	ttl := f.cfg.ConversationTTL[conversation.ChannelType]
+	if ttl <= 0 {
+		return false
+	}
+	return conversation.Timestamp < now.Add(-ttl).Unix()
+}
+
+// RunConversationCleanup 删除最后一次会话时间超过ConversationTTL的最近会话，每ConversationCleanupBatch个在一个写事务里删除
+// 每次最多执行ConversationCleanupBudget，超过后记住停下的位置，下次调用继续，所以不会长时间占用写事务；同时只能有一次清理
+// 只删除最近会话，不修改频道的订阅关系
+func (f *FileStore) RunConversationCleanup(now time.Time) (*ConversationCleanupResult, error) {
+	defer f.trace("RunConversationCleanup", "", time.Now())
+	result, err := f.runConversationCleanup(now)
+	return result, wrapError("RunConversationCleanup", err, "", "", 0)
+}
+
+func (f *FileStore) runConversationCleanup(now time.Time) (*ConversationCleanupResult, error) {
+	result := &ConversationCleanupResult{}
+	if len(f.cfg.ConversationTTL) == 0 {
+		result.Done = true
+		return result, nil
+	}
+	f.conversationCleanupLock.Lock()
+	defer f.conversationCleanupLock.Unlock()
+
+	batchSize := f.cfg.ConversationCleanupBatch
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+	start := time.Now()
+	overBudget := func() bool {
+		return f.cfg.ConversationCleanupBudget > 0 && time.Since(start) >= f.cfg.ConversationCleanupBudget
+	}
+	prefix := []byte(f.conversationPrefix)
+	cursor := f.conversationCleanupCursor
+	for {
+		var (
+			uids     []string // 有过期最近会话的用户
+			expired  int
+			stopped  bool
+			stopSlot uint32
+			stopKey  []byte
+		)
+		err := f.scanFrom(context.Background(), prefix, cursor.slot, cursor.key, func(slot uint32, key, value []byte) error {
+			if expired >= batchSize || (result.ScannedUsers > 0 && overBudget()) { // 从这个用户继续（每次至少处理一个用户）
+				stopped = true
+				stopSlot = slot
+				stopKey = append(make([]byte, 0, len(key)), key...)
+				return errStopScan
+			}
+			result.ScannedUsers++
+			conversations, err := decodeConversations(value, false)
+			if err != nil {
+				f.Warn("decode conversations fail", zap.Error(err), zap.ByteString("key", key))
+				return nil
+			}
+			count := 0
+			for _, conversation := range conversations {
+				if f.conversationExpired(conversation, now) {
+					count++
+				}
+			}
+			if count > 0 {
+				uids = append(uids, string(key[len(prefix):]))
+				expired += count
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(uids) > 0 {
+			purged, err := f.purgeExpiredConversations(uids, now)
+			if err != nil {
+				return nil, err
+			}
+			result.Purged = append(result.Purged, purged...)
+		}
+		if !stopped { // 扫描完了，下次从头开始
+			f.conversationCleanupCursor = conversationCleanupCursor{}
+			result.Done = true
+			break
+		}
+		cursor = conversationCleanupCursor{slot: stopSlot, key: stopKey}
+		f.conversationCleanupCursor = cursor
+		if overBudget() {
+			break
+		}
+	}
+	if len(result.Purged) > 0 {
+		f.Info("purge expired conversations", zap.Int("scannedUsers", result.ScannedUsers), zap.Int("purged", len(result.Purged)), zap.Bool("done", result.Done))
+	}
+	return result, nil
+}
+
+// purgeExpiredConversations 在一个写事务里删除这些用户过期的最近会话（扫描后可能有更新，重新判断）
+func (f *FileStore) purgeExpiredConversations(uids []string, now time.Time) ([]ConversationKey, error) {
+	var purged []ConversationKey
+	err := f.update(func(t *bolt.Tx) error {
+		purged = make([]ConversationKey, 0, len(uids))
+		for _, uid := range uids {
+			bucket, err := f.getSlotBucketWithKey(uid, t)
+			if err != nil {
+				return err
+			}
+			value := bucket.Get([]byte(f.getConversationKey(uid)))
+			if len(value) == 0 {
+				continue
+			}
+			conversations, err := decodeConversations(value, false)
+			if err != nil {
+				return err
+			}
+			kept := make([]*Conversation, 0, len(conversations))
+			for _, conversation := range conversations {
+				if f.conversationExpired(conversation, now) {
+					purged = append(purged, ConversationKey{UID: uid, ChannelID: conversation.ChannelID, ChannelType: conversation.ChannelType})
+					continue
+				}
+				kept = append(kept, conversation)
+			}
+			if len(kept) == len(conversations) {
+				continue
+			}
+			var newValue []byte
+			if len(kept) > 0 {
+				newValue = f.encodeConversations(kept)
+			}
+			if err = f.putUserConversationsInTx(bucket, uid, newValue); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.conversationsPurged.Add(int64(len(purged)))
+	f.conversationOps.addKeys(ConversationOpDelete, purged)
+	return purged, nil
+}
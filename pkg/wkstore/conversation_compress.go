@@ -0,0 +1,151 @@
+package wkstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/golang/snappy"
+	bolt "go.etcd.io/bbolt"
+)
+
+// conversationCodecSnappy snappy压缩的最近会话数据的前缀
+// 没有压缩的数据第一个字节是版本号（很小）或旧的json格式（'['或'n'），不会和前缀冲突
+const conversationCodecSnappy byte = 0xf1
+
+// encodeConversations 编码用户的最近会话用于存储，开启ConversationCompress后超过ConversationCompressThreshold的数据会被压缩
+func (f *FileStore) encodeConversations(conversations []*Conversation) []byte {
+	return f.compressConversations(ConversationSet(conversations).Encode())
+}
+
+// compressConversations 按配置压缩编码后的最近会话，压缩后没有变小则不压缩
+func (f *FileStore) compressConversations(data []byte) []byte {
+	if !f.cfg.ConversationCompress || len(data) <= f.cfg.ConversationCompressThreshold {
+		return data
+	}
+	compressed := make([]byte, 1+snappy.MaxEncodedLen(len(data)))
+	compressed[0] = conversationCodecSnappy
+	n := len(snappy.Encode(compressed[1:], data))
+	if n+1 >= len(data) {
+		return data
+	}
+	return compressed[:n+1]
+}
+
+// decompressConversations 解压存储的最近会话，没有压缩的直接返回
+func decompressConversations(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != conversationCodecSnappy {
+		return data, nil
+	}
+	decoded, err := snappy.Decode(nil, data[1:])
+	if err != nil {
+		return nil, fmt.Errorf("decompress conversations: %w", err)
+	}
+	return decoded, nil
+}
+
+// RecompressConversations 按当前的压缩配置重写已存储的最近会话（开启压缩后压缩旧数据，关闭压缩后解压），返回重写的用户数量
+// 可选的后台任务，不调用也不影响读取，扫描分批进行，可通过ctx取消，opts.DryRun为true时只返回需要重写的用户数量
+func (f *FileStore) RecompressConversations(ctx context.Context, opts MaintenanceOptions) (int, error) {
+	count, err := f.recompressConversations(ctx, opts)
+	return count, wrapError("RecompressConversations", err, "", "", 0)
+}
+
+func (f *FileStore) recompressConversations(ctx context.Context, opts MaintenanceOptions) (int, error) {
+	prefix := []byte(f.conversationPrefix)
+	keys := make([][]byte, 0)
+	err := f.scan(ctx, prefix, func(key, value []byte) error {
+		compressed := len(value) > 0 && value[0] == conversationCodecSnappy
+		if compressed != f.shouldCompress(value) {
+			keys = append(keys, append(make([]byte, 0, len(key)), key...))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	m := newMaintenance("RecompressConversations", opts, len(keys))
+	if opts.DryRun {
+		m.event.Scanned, m.event.Changed = len(keys), len(keys)
+		m.done()
+		return len(keys), nil
+	}
+	batchSize := m.batchSize(f.cfg)
+	count := 0
+	for start := 0; start < len(keys); start += batchSize {
+		if err = ctx.Err(); err != nil {
+			return count, err
+		}
+		end := start + batchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		n, err := f.recompressConversationKeys(keys[start:end])
+		count += n
+		if err != nil {
+			return count, err
+		}
+		if err = m.advance(ctx, end-start, n); err != nil {
+			return count, err
+		}
+	}
+	m.done()
+	return count, nil
+}
+
+// shouldCompress 按当前的配置存储的数据是否应该是压缩的
+func (f *FileStore) shouldCompress(value []byte) bool {
+	data, err := decompressConversations(value)
+	if err != nil {
+		return false
+	}
+	result := f.compressConversations(data)
+	return len(result) > 0 && result[0] == conversationCodecSnappy
+}
+
+func (f *FileStore) recompressConversationKeys(keys [][]byte) (int, error) {
+	slotKeys := make(map[uint32][][]byte)
+	for _, key := range keys {
+		slot := f.slotNum(string(key[len(f.conversationPrefix):]))
+		slotKeys[slot] = append(slotKeys[slot], key)
+	}
+	count := 0
+	for slot, items := range slotKeys {
+		var n int
+		err := f.update(func(t *bolt.Tx) error {
+			n = 0
+			bucket, err := f.getSlotBucket(slot, t)
+			if err != nil {
+				return err
+			}
+			for _, key := range items {
+				value := bucket.Get(key)
+				if len(value) == 0 {
+					continue
+				}
+				data, err := decompressConversations(value)
+				if err != nil {
+					if errors.Is(err, snappy.ErrCorrupt) {
+						continue
+					}
+					return err
+				}
+				newValue := f.compressConversations(data)
+				if bytes.Equal(newValue, value) {
+					continue
+				}
+				if err = bucket.Put(key, newValue); err != nil {
+					return err
+				}
+				n++
+			}
+			return nil
+		})
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
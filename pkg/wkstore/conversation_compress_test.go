@@ -0,0 +1,149 @@
+package wkstore
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func newCompressTestConversations(uid string, count int) []*Conversation {
+	conversations := make([]*Conversation, 0, count)
+	for i := 0; i < count; i++ {
+		conversations = append(conversations, &Conversation{
+			UID:             uid,
+			ChannelID:       fmt.Sprintf("group%d", i),
+			ChannelType:     2,
+			UnreadCount:     i,
+			Timestamp:       1700000000 + int64(i),
+			LastMsgSeq:      uint32(i),
+			LastClientMsgNo: fmt.Sprintf("client-msg-no-%d", i),
+			LastMsgID:       int64(i),
+			Version:         int64(i),
+			ChannelName:     fmt.Sprintf("群聊名称%d", i),
+			ChannelAvatar:   fmt.Sprintf("https://example.com/avatar/group%d.png", i),
+		})
+	}
+	return conversations
+}
+
+func getStoredConversations(t *testing.T, store *FileStore, uid string) []byte {
+	var value []byte
+	err := store.view(func(tx *bolt.Tx) error {
+		bucket, err := store.getSlotBucketWithKey(uid, tx)
+		if err != nil {
+			return err
+		}
+		value = append(value, bucket.Get([]byte(store.getConversationKey(uid)))...)
+		return nil
+	})
+	assert.NoError(t, err)
+	return value
+}
+
+func TestConversationCompress(t *testing.T) {
+	store := newTestFileStore(t)
+	store.cfg.ConversationCompress = true
+	store.cfg.ConversationCompressThreshold = 256
+
+	large := newCompressTestConversations("u1", 50)
+	small := newCompressTestConversations("u2", 1)
+	assert.NoError(t, store.AddOrUpdateConversations("u1", large))
+	assert.NoError(t, store.AddOrUpdateConversations("u2", small))
+
+	value := getStoredConversations(t, store, "u1")
+	assert.Equal(t, conversationCodecSnappy, value[0])
+	assert.Less(t, len(value), len(ConversationSet(large).Encode()))
+	assert.NotEqual(t, conversationCodecSnappy, getStoredConversations(t, store, "u2")[0]) // 没有超过阈值
+
+	conversations, err := store.GetConversations("u1")
+	assert.NoError(t, err)
+	assert.Equal(t, large, conversations)
+	conversations, err = store.GetConversations("u2")
+	assert.NoError(t, err)
+	assert.Equal(t, small, conversations)
+	exist, err := store.ExistConversation("u1", "group49", 2)
+	assert.NoError(t, err)
+	assert.True(t, exist)
+}
+
+// 压缩和没有压缩的数据混在一起，开启或关闭压缩都能正常读取
+func TestConversationCompressMixed(t *testing.T) {
+	store := newTestFileStore(t)
+	store.cfg.ConversationCompressThreshold = 256
+
+	old := newCompressTestConversations("u1", 50)
+	assert.NoError(t, store.AddOrUpdateConversations("u1", old))
+	assert.NotEqual(t, conversationCodecSnappy, getStoredConversations(t, store, "u1")[0])
+
+	store.cfg.ConversationCompress = true
+	compressed := newCompressTestConversations("u2", 50)
+	assert.NoError(t, store.AddOrUpdateConversations("u2", compressed))
+	assert.Equal(t, conversationCodecSnappy, getStoredConversations(t, store, "u2")[0])
+
+	conversations, err := store.GetConversations("u1")
+	assert.NoError(t, err)
+	assert.Equal(t, old, conversations)
+
+	store.cfg.ConversationCompress = false
+	conversations, err = store.GetConversations("u2")
+	assert.NoError(t, err)
+	assert.Equal(t, compressed, conversations)
+
+	// 修改后按当前配置重新存储
+	assert.NoError(t, store.AddOrUpdateConversations("u2", []*Conversation{{UID: "u2", ChannelID: "group0", ChannelType: 2, Version: 100}}))
+	assert.NotEqual(t, conversationCodecSnappy, getStoredConversations(t, store, "u2")[0])
+	conversations, err = store.GetConversations("u2")
+	assert.NoError(t, err)
+	assert.Len(t, conversations, 50)
+	assert.Equal(t, int64(100), conversations[0].Version)
+}
+
+func TestRecompressConversations(t *testing.T) {
+	store := newTestFileStore(t)
+	store.cfg.ConversationCompressThreshold = 256
+	store.cfg.ScanBatchBackoff = 0
+	for i := 0; i < 5; i++ {
+		uid := fmt.Sprintf("u%d", i)
+		assert.NoError(t, store.AddOrUpdateConversations(uid, newCompressTestConversations(uid, 50)))
+	}
+	assert.NoError(t, store.AddOrUpdateConversations("small", newCompressTestConversations("small", 1)))
+
+	store.cfg.ConversationCompress = true
+	count, err := store.RecompressConversations(context.Background(), MaintenanceOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, count)
+	for i := 0; i < 5; i++ {
+		uid := fmt.Sprintf("u%d", i)
+		assert.Equal(t, conversationCodecSnappy, getStoredConversations(t, store, uid)[0])
+		conversations, err := store.GetConversations(uid)
+		assert.NoError(t, err)
+		assert.Equal(t, newCompressTestConversations(uid, 50), conversations)
+	}
+	count, err = store.RecompressConversations(context.Background(), MaintenanceOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	store.cfg.ConversationCompress = false
+	count, err = store.RecompressConversations(context.Background(), MaintenanceOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, count)
+	assert.NotEqual(t, conversationCodecSnappy, getStoredConversations(t, store, "u0")[0])
+}
+
+func BenchmarkConversationCompress(b *testing.B) {
+	store := &FileStore{cfg: NewStoreConfig()}
+	store.cfg.ConversationCompress = true
+	conversations := newCompressTestConversations("u1", 1000)
+	raw := ConversationSet(conversations).Encode()
+	var compressed []byte
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		compressed = store.encodeConversations(conversations)
+	}
+	b.ReportMetric(float64(len(raw)), "raw-bytes")
+	b.ReportMetric(float64(len(compressed)), "compressed-bytes")
+	b.ReportMetric(float64(len(compressed))/float64(len(raw)), "ratio")
+}
@@ -0,0 +1,64 @@
+package wkstore
+
+import (
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ConversationUnreadDigest 有未读消息的最近会话摘要（比如用户离线后发邮件提醒）
+type ConversationUnreadDigest struct {
+	ChannelID       string `json:"channel_id"`
+	ChannelType     uint8  `json:"channel_type"`
+	UnreadCount     int    `json:"unread_count"`
+	MentionCount    uint32 `json:"mention_count,omitempty"`
+	Mute            uint8  `json:"mute,omitempty"`
+	LastMsgSeq      uint32 `json:"last_msg_seq"`       // 最后一条消息（预览）的messageSeq
+	LastClientMsgNo string `json:"last_client_msg_no"` // 最后一条消息的客户端编号
+	Timestamp       int64  `json:"timestamp"`          // 最后一次会话的时间
+	Version         int64  `json:"version"`            // 最近会话最后修改的版本号（毫秒）
+}
+
+// GetConversationUnreadDigest 用户有未读消息的最近会话摘要，按最后一次会话的时间从新到旧，最多topN个（topN<=0表示不限制）
+// 用户的最近会话存储在一起，一次读取后过滤，已离开和已归档的不返回
+func (f *FileStore) GetConversationUnreadDigest(uid string, topN int) ([]*ConversationUnreadDigest, error) {
+	defer f.trace("GetConversationUnreadDigest", uid, time.Now(), zap.Int("topN", topN))
+	conversations, err := f.getConversations(uid)
+	if err != nil {
+		return nil, wrapError("GetConversationUnreadDigest", err, uid, "", 0)
+	}
+	return UnreadDigest(conversations, topN), nil
+}
+
+// UnreadDigest 从最近会话里取出有未读消息的摘要，规则见GetConversationUnreadDigest
+func UnreadDigest(conversations []*Conversation, topN int) []*ConversationUnreadDigest {
+	unread := make([]*Conversation, 0)
+	for _, conversation := range conversations {
+		if conversation == nil || conversation.UnreadCount <= 0 || conversation.Left || conversation.Archived {
+			continue
+		}
+		unread = append(unread, conversation)
+	}
+	sort.SliceStable(unread, func(i, j int) bool {
+		return unread[i].Timestamp > unread[j].Timestamp
+	})
+	if topN > 0 && len(unread) > topN {
+		unread = unread[:topN]
+	}
+	digests := make([]*ConversationUnreadDigest, 0, len(unread))
+	for _, conversation := range unread {
+		digests = append(digests, &ConversationUnreadDigest{
+			ChannelID:       conversation.ChannelID,
+			ChannelType:     conversation.ChannelType,
+			UnreadCount:     conversation.UnreadCount,
+			MentionCount:    conversation.MentionCount,
+			Mute:            conversation.Mute,
+			LastMsgSeq:      conversation.LastMsgSeq,
+			LastClientMsgNo: conversation.LastClientMsgNo,
+			Timestamp:       conversation.Timestamp,
+			Version:         conversation.Version,
+		})
+	}
+	return digests
+}
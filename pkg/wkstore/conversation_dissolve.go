@@ -0,0 +1,45 @@
+package wkstore
+
+import (
+	"time"
+
+	wkproto "github.com/WuKongIM/WuKongIMGoProto"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// DeleteConversationsByChannel 删除本地用户（频道订阅者）在此频道的最近会话（比如群解散），返回删除了最近会话的用户数量
+// 按用户分批，每批的最近会话和订阅关系在同一个事务里删除；已经没有此频道最近会话的用户跳过，但订阅关系照样移除，所以可以重复调用
+func (f *FileStore) DeleteConversationsByChannel(channelID string, channelType uint8) (int, error) {
+	defer f.trace("DeleteConversationsByChannel", "", time.Now(), zap.String("channelID", channelID), zap.Uint8("channelType", channelType))
+	count, err := f.deleteConversationsByChannel(channelID, channelType, MaintenanceOptions{})
+	return count, wrapError("DeleteConversationsByChannel", err, "", channelID, channelType)
+}
+
+// opts.DryRun时只返回会删除最近会话的用户数量
+func (f *FileStore) deleteConversationsByChannel(channelID string, channelType uint8, opts MaintenanceOptions) (int, error) {
+	if channelID == "" {
+		return 0, ErrInvalidChannel
+	}
+	remove := func(uid string, conversations []*Conversation, idx int) ([]*Conversation, bool, error) {
+		return append(conversations[:idx], conversations[idx+1:]...), true, nil
+	}
+	var removeSubscribers channelConversationChunkFn
+	if channelType != wkproto.ChannelTypePerson { // 个人频道没有订阅关系
+		removeSubscribers = func(t *bolt.Tx, keys []ConversationKey, changed []ConversationKey) error {
+			uids := make([]string, 0, len(keys))
+			for _, key := range keys {
+				uids = append(uids, key.UID)
+			}
+			return f.removeSubscribersInTx(t, channelID, channelType, uids)
+		}
+	}
+	_, changed, err := f.forEachChannelConversation(channelID, channelType, "DeleteConversationsByChannel", opts, remove, removeSubscribers)
+	if err != nil {
+		return 0, err
+	}
+	if !opts.DryRun {
+		f.conversationOps.add(ConversationOpDelete, channelType, int64(len(changed)))
+	}
+	return len(changed), nil
+}
@@ -0,0 +1,233 @@
+package wkstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// conversationImportMaxLineSize 导入最近会话时一行最大的长度（Extra可能比较大）
+const conversationImportMaxLineSize = 1024 * 1024
+
+// ConversationImportResult 导入最近会话的结果
+type ConversationImportResult struct {
+	Inserted int      `json:"inserted"` // 新增的最近会话数量
+	Updated  int      `json:"updated"`  // 覆盖已有的最近会话数量
+	Skipped  int      `json:"skipped"`  // 格式错误、已存在（不覆盖或没有变化）或超过数量上限跳过的数量
+	UIDs     []string `json:"-"`        // 有修改的用户
+}
+
+// ExportConversations 把用户的所有最近会话按json lines（每行一个完整的Conversation）写入w，用于排查问题和迁移到其他节点
+func (f *FileStore) ExportConversations(uid string, w io.Writer) (int, error) {
+	defer f.trace("ExportConversations", uid, time.Now())
+	conversations, err := f.getConversations(uid)
+	if err != nil {
+		return 0, wrapError("ExportConversations", err, uid, "", 0)
+	}
+	encoder := json.NewEncoder(w)
+	for i, conversation := range conversations {
+		if err = encoder.Encode(conversation); err != nil {
+			return i, wrapError("ExportConversations", err, uid, "", 0)
+		}
+	}
+	return len(conversations), nil
+}
+
+// ImportConversations 导入ExportConversations导出的最近会话（可以包含多个用户），每ScanBatchSize条按slot分组后在一个写事务里提交
+// 已存在的最近会话overwrite为true时覆盖，否则跳过；保留导入的版本号，不大于已存储的最大版本号时按keepConversationVersionsMonotonic修正
+func (f *FileStore) ImportConversations(r io.Reader, overwrite bool) (*ConversationImportResult, error) {
+	defer f.trace("ImportConversations", "", time.Now(), zap.Bool("overwrite", overwrite))
+	result, err := f.importConversations(r, overwrite)
+	return result, wrapError("ImportConversations", err, "", "", 0)
+}
+
+func (f *FileStore) importConversations(r io.Reader, overwrite bool) (*ConversationImportResult, error) {
+	m := newMaintenance("ImportConversations", MaintenanceOptions{}, -1)
+	batchSize := m.batchSize(f.cfg)
+	result := &ConversationImportResult{}
+	uids := make(map[string]struct{})
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), conversationImportMaxLineSize)
+
+	batch := make([]*Conversation, 0, batchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		changed, err := f.importConversationsBatch(batch, overwrite, result)
+		if err != nil {
+			return err
+		}
+		for _, uid := range changed {
+			uids[uid] = struct{}{}
+		}
+		scanned := len(batch)
+		batch = batch[:0]
+		return m.advance(context.Background(), scanned, len(changed))
+	}
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		conversation := &Conversation{}
+		if err := json.Unmarshal(line, conversation); err != nil || conversation.UID == "" || !validConversationChannel(conversation.ChannelID, conversation.ChannelType) {
+			result.Skipped++
+			f.Debug("skip malformed conversation", zap.Int("line", lineNo), zap.Error(err))
+			continue
+		}
+		batch = append(batch, conversation)
+		if len(batch) >= batchSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	m.done()
+	result.UIDs = make([]string, 0, len(uids))
+	for uid := range uids {
+		result.UIDs = append(result.UIDs, uid)
+	}
+	sort.Strings(result.UIDs)
+	return result, nil
+}
+
+// importConversationsBatch 在一个事务里导入一批最近会话（按slot和用户分组，同一个最近会话以后面的为准），返回有修改的用户
+func (f *FileStore) importConversationsBatch(batch []*Conversation, overwrite bool, result *ConversationImportResult) ([]string, error) {
+	userConversations := make(map[string]map[ConversationKey]*Conversation)
+	for _, conversation := range batch {
+		conversations := userConversations[conversation.UID]
+		if conversations == nil {
+			conversations = make(map[ConversationKey]*Conversation)
+			userConversations[conversation.UID] = conversations
+		}
+		key := ConversationKey{ChannelID: conversation.ChannelID, ChannelType: conversation.ChannelType}
+		if _, ok := conversations[key]; ok {
+			result.Skipped++ // 同一批里重复的记录
+		}
+		conversations[key] = conversation
+	}
+	uids := make([]string, 0, len(userConversations))
+	for uid := range userConversations {
+		uids = append(uids, uid)
+	}
+	sort.Slice(uids, func(i, j int) bool { // 同一个slot的用户放在一起写
+		si, sj := f.slotNum(uids[i]), f.slotNum(uids[j])
+		if si != sj {
+			return si < sj
+		}
+		return uids[i] < uids[j]
+	})
+
+	var (
+		changed                    []string
+		inserted, updated, skipped int
+		created, modified          []*Conversation
+	)
+	err := f.update(func(t *bolt.Tx) error {
+		changed, inserted, updated, skipped = changed[:0], 0, 0, 0
+		created, modified = created[:0], modified[:0]
+		for _, uid := range uids {
+			userCreated, userUpdated, userSkipped, err := f.importUserConversationsInTx(t, uid, userConversations[uid], overwrite)
+			if err != nil {
+				return err
+			}
+			if len(userCreated) > 0 || len(userUpdated) > 0 {
+				changed = append(changed, uid)
+			}
+			inserted += len(userCreated)
+			updated += len(userUpdated)
+			skipped += userSkipped
+			created = append(created, userCreated...)
+			modified = append(modified, userUpdated...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.Inserted += inserted
+	result.Updated += updated
+	result.Skipped += skipped
+	f.conversationOps.addWrites(append(modified, created...), created)
+	return changed, nil
+}
+
+// importUserConversationsInTx 导入用户的最近会话，返回新增的、覆盖的最近会话和跳过的数量，超过最近会话数量上限时不新增（记为跳过）
+func (f *FileStore) importUserConversationsInTx(t *bolt.Tx, uid string, imports map[ConversationKey]*Conversation, overwrite bool) ([]*Conversation, []*Conversation, int, error) {
+	bucket, err := f.getSlotBucketWithKey(uid, t)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	conversations := make([]*Conversation, 0)
+	if value := bucket.Get([]byte(f.getConversationKey(uid))); len(value) > 0 {
+		if conversations, err = decodeConversations(value, false); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+	old := snapshotConversations(conversations)
+	oldLen := len(conversations)
+	var (
+		created, updated []*Conversation
+		skipped          int
+	)
+	exist := make(map[ConversationKey]bool, len(conversations))
+	for i, conversation := range conversations {
+		key := ConversationKey{ChannelID: conversation.ChannelID, ChannelType: conversation.ChannelType}
+		exist[key] = true
+		imported, ok := imports[key]
+		if !ok {
+			continue
+		}
+		if !overwrite || equalExceptVersion(conversation, imported) {
+			skipped++
+			continue
+		}
+		conversations[i] = imported
+		updated = append(updated, imported)
+	}
+	for key, imported := range imports {
+		if exist[key] {
+			continue
+		}
+		conversations = append(conversations, imported)
+		created = append(created, imported)
+	}
+	if len(created) > 0 {
+		quota, err := f.applyConversationQuota(uid, conversations, oldLen, append(updated, created...))
+		if err != nil {
+			if !errors.Is(err, ErrOverQuota) {
+				return nil, nil, 0, err
+			}
+			conversations = conversations[:oldLen] // 超过上限不新增，覆盖的照样覆盖
+			skipped += len(created)
+			created = nil
+		} else {
+			conversations = quota
+		}
+	}
+	if len(created) == 0 && len(updated) == 0 {
+		return nil, nil, skipped, nil
+	}
+	f.keepConversationVersionsMonotonic(old, conversations)
+	if err = f.putUserConversationsInTx(bucket, uid, f.encodeConversations(conversations)); err != nil {
+		return nil, nil, 0, err
+	}
+	return created, updated, skipped, nil
+}
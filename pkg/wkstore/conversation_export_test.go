@@ -0,0 +1,69 @@
+package wkstore
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportImportConversations(t *testing.T) {
+	src := newTestFileStore(t)
+	err := src.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "u2", ChannelType: 1, UnreadCount: 2, Timestamp: 10, LastMsgSeq: 5, LastClientMsgNo: "c5", LastMsgID: 105, Version: 100},
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, Timestamp: 20, LastMsgSeq: 8, Version: 200},
+	})
+	assert.NoError(t, err)
+	_, err = src.SetConversationExtra("u1", "g1", 2, map[string]string{"draft": "hi"})
+	assert.NoError(t, err)
+	_, err = src.SetConversationPinned("u1", "g1", 2, true)
+	assert.NoError(t, err)
+	expected, err := src.GetConversations("u1")
+	assert.NoError(t, err)
+
+	var buff bytes.Buffer
+	count, err := src.ExportConversations("u1", &buff)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, 2, strings.Count(buff.String(), "\n"))
+	exported := buff.String()
+
+	// 导入到其他节点
+	dst := newTestFileStore(t)
+	dst.cfg.ScanBatchSize = 1
+	result, err := dst.ImportConversations(strings.NewReader(exported+"not json\n"+`{"UID":"u3","ChannelID":"","ChannelType":2}`+"\n"), false)
+	assert.NoError(t, err)
+	assert.Equal(t, &ConversationImportResult{Inserted: 2, Skipped: 2, UIDs: []string{"u1"}}, result)
+	conversations, err := dst.GetConversations("u1")
+	assert.NoError(t, err)
+	assert.Equal(t, expected, conversations)
+
+	// 重复导入，不覆盖时跳过
+	result, err = dst.ImportConversations(strings.NewReader(exported), false)
+	assert.NoError(t, err)
+	assert.Equal(t, &ConversationImportResult{Skipped: 2, UIDs: []string{}}, result)
+
+	// 覆盖已有的，没有变化的跳过，版本号不回退
+	_, err = dst.IncConversationUnreadCount("u1", "u2", 1, 3, false)
+	assert.NoError(t, err)
+	changed, err := dst.GetConversation("u1", "u2", 1)
+	assert.NoError(t, err)
+	result, err = dst.ImportConversations(strings.NewReader(exported+`{"UID":"u4","ChannelID":"g1","ChannelType":2,"LastMsgSeq":3}`+"\n"), true)
+	assert.NoError(t, err)
+	assert.Equal(t, &ConversationImportResult{Inserted: 1, Updated: 1, Skipped: 1, UIDs: []string{"u1", "u4"}}, result)
+	conversation, err := dst.GetConversation("u1", "u2", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, conversation.UnreadCount)
+	assert.Greater(t, conversation.Version, changed.Version)
+	conversation, err = dst.GetConversation("u4", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(3), conversation.LastMsgSeq)
+
+	// 没有最近会话的用户
+	buff.Reset()
+	count, err = dst.ExportConversations("u9", &buff)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+	assert.Empty(t, buff.String())
+}
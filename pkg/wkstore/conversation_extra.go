@@ -0,0 +1,77 @@
+package wkstore
+
+import (
+	"maps"
+	"math"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// GetConversationExtra 获取用户最近会话的扩展数据，返回的是副本可以修改，最近会话不存在返回ErrNotFound
+func (f *FileStore) GetConversationExtra(uid string, channelID string, channelType uint8) (map[string]string, error) {
+	conversation, err := f.getConversation(uid, channelID, channelType)
+	if err == nil && conversation == nil {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return nil, wrapError("GetConversationExtra", err, uid, channelID, channelType)
+	}
+	return maps.Clone(conversation.Extra), nil
+}
+
+// SetConversationExtra 替换用户最近会话的扩展数据（nil或空map表示清空），只修改扩展数据和版本号，返回修改后的最近会话，最近会话不存在返回ErrNotFound
+func (f *FileStore) SetConversationExtra(uid string, channelID string, channelType uint8, extra map[string]string) (*Conversation, error) {
+	defer f.trace("SetConversationExtra", uid, time.Now(), zap.String("channelID", channelID), zap.Uint8("channelType", channelType), zap.Int("extraLen", len(extra)))
+	conversation, err := f.setConversationExtra(uid, channelID, channelType, extra)
+	return conversation, wrapError("SetConversationExtra", err, uid, channelID, channelType)
+}
+
+func (f *FileStore) setConversationExtra(uid string, channelID string, channelType uint8, extra map[string]string) (*Conversation, error) {
+	if uid == "" || !validConversationChannel(channelID, channelType) {
+		return nil, ErrInvalidConversation
+	}
+	if len(encodeConversationExtra(extra)) > math.MaxUint16 { // 按字符串编码，长度只有两个字节
+		return nil, ErrConversationExtraTooLarge
+	}
+	// 复制一份，调用方后续修改传入的map不影响存储和缓存
+	if len(extra) == 0 {
+		extra = nil
+	} else {
+		extra = maps.Clone(extra)
+	}
+	key := f.getConversationKey(uid)
+	f.lock.Lock(key)
+	defer f.lock.Unlock(key)
+
+	var conversation *Conversation
+	err := f.update(func(t *bolt.Tx) error {
+		return f.updateConversationInTx(t, uid, channelID, channelType, func(conversations []*Conversation, idx int) []*Conversation {
+			conversation = conversations[idx]
+			if maps.Equal(conversation.Extra, extra) {
+				return nil
+			}
+			conversation.Extra = extra
+			conversation.Version = f.newConversationVersion()
+			return conversations
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if conversation == nil {
+		return nil, ErrNotFound
+	}
+	newConversation := *conversation
+	return &newConversation, nil
+}
+
+// carryExtra 扩展数据只能通过SetConversationExtra修改，更新已有的最近会话时保留原来的扩展数据（缓存里的最近会话可能是设置前读取的）
+func carryExtra(merged *Conversation, stored *Conversation) bool {
+	if maps.Equal(merged.Extra, stored.Extra) {
+		return false
+	}
+	merged.Extra = stored.Extra
+	return true
+}
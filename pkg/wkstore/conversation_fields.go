@@ -0,0 +1,287 @@
+package wkstore
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	wkproto "github.com/WuKongIM/WuKongIMGoProto"
+)
+
+// conversationField 最近会话编码的字段
+// 字段按id从小到大依次编码，新字段只能追加到最后（id和version都不能比前面的小），这样旧版本的节点可以按长度跳过不认识的尾部字段
+type conversationField struct {
+	id      int                                       // 字段编号，决定编码顺序，不能重复
+	name    string                                    // 字段名称
+	version uint8                                     // 从哪个版本开始有此字段
+	key     bool                                      // 是否是uid和频道信息字段（只解码频道信息时使用），必须在其他字段前面
+	append  func(dst []byte, cn *Conversation) []byte // 编码后追加到dst，返回追加后的slice
+	decode  func(dec *wkproto.Decoder, cn *Conversation) error
+
+	merge conversationMerge                                     // 更新已存储的最近会话时的合并方式，每个字段都必须声明
+	carry func(merged *Conversation, stored *Conversation) bool // 把已存储的值带到合并后的最近会话上，返回是否有修改（merge为conversationMergeCarry时使用）
+}
+
+// conversationMerge 更新已存储的最近会话时字段的合并方式（见mergeConversationFields）
+type conversationMerge uint8
+
+const (
+	conversationMergeUnset conversationMerge = iota // 没有声明，validateConversationFields会报错，避免新字段合并时被漏掉
+	// conversationMergeUpdate 使用更新的最近会话的值
+	conversationMergeUpdate
+	// conversationMergeCarry 由carry决定是否保留已存储的值
+	conversationMergeCarry
+	// conversationMergeGroup 和前面的字段一起由前面字段的carry合并（比如最后一条消息的几个字段）
+	conversationMergeGroup
+)
+
+// withMerge 设置字段的合并方式
+func (f conversationField) withMerge(merge conversationMerge, carry func(merged *Conversation, stored *Conversation) bool) conversationField {
+	f.merge = merge
+	f.carry = carry
+	return f
+}
+
+// mergeConversationFields 按conversationFields的合并方式把已存储的最近会话的字段带到更新的最近会话上，没有需要保留的字段时返回updateConversation本身
+func mergeConversationFields(updateConversation *Conversation, storedConversation *Conversation) *Conversation {
+	merged := *updateConversation
+	changed := false
+	for _, field := range conversationFields {
+		if field.merge == conversationMergeCarry && field.carry(&merged, storedConversation) {
+			changed = true
+		}
+	}
+	if !changed {
+		return updateConversation
+	}
+	return &merged
+}
+
+// conversationFields 当前版本的最近会话字段
+var conversationFields = []conversationField{
+	conversationStringField(1, "uid", conversationVersionV1, true, func(cn *Conversation) *string { return &cn.UID }).withMerge(conversationMergeUpdate, nil),
+	conversationStringField(2, "channel_id", conversationVersionV1, true, func(cn *Conversation) *string { return &cn.ChannelID }).withMerge(conversationMergeUpdate, nil),
+	{
+		id: 3, name: "channel_type", version: conversationVersionV1, key: true, merge: conversationMergeUpdate,
+		append: func(dst []byte, cn *Conversation) []byte { return append(dst, cn.ChannelType) },
+		decode: func(dec *wkproto.Decoder, cn *Conversation) (err error) {
+			cn.ChannelType, err = dec.Uint8()
+			return
+		},
+	},
+	{
+		id: 4, name: "unread_count", version: conversationVersionV1, merge: conversationMergeUpdate,
+		append: func(dst []byte, cn *Conversation) []byte {
+			return binary.BigEndian.AppendUint32(dst, uint32(cn.UnreadCount))
+		},
+		decode: func(dec *wkproto.Decoder, cn *Conversation) error {
+			unreadCount, err := dec.Uint32()
+			cn.UnreadCount = int(unreadCount)
+			return err
+		},
+	},
+	conversationInt64Field(5, "timestamp", conversationVersionV1, func(cn *Conversation) *int64 { return &cn.Timestamp }).withMerge(conversationMergeUpdate, nil),
+	{
+		id: 6, name: "last_msg_seq", version: conversationVersionV1, merge: conversationMergeCarry, carry: carryLastMsg,
+		append: func(dst []byte, cn *Conversation) []byte { return binary.BigEndian.AppendUint32(dst, cn.LastMsgSeq) },
+		decode: func(dec *wkproto.Decoder, cn *Conversation) (err error) {
+			cn.LastMsgSeq, err = dec.Uint32()
+			return
+		},
+	},
+	conversationStringField(7, "last_client_msg_no", conversationVersionV1, false, func(cn *Conversation) *string { return &cn.LastClientMsgNo }).withMerge(conversationMergeGroup, nil),
+	conversationInt64Field(8, "last_msg_id", conversationVersionV1, func(cn *Conversation) *int64 { return &cn.LastMsgID }).withMerge(conversationMergeGroup, nil),
+	conversationInt64Field(9, "version", conversationVersionV1, func(cn *Conversation) *int64 { return &cn.Version }).withMerge(conversationMergeUpdate, nil),
+	conversationStringField(10, "channel_name", conversationVersionV3, false, func(cn *Conversation) *string { return &cn.ChannelName }).withMerge(conversationMergeCarry, carryChannelInfo),
+	conversationStringField(11, "channel_avatar", conversationVersionV3, false, func(cn *Conversation) *string { return &cn.ChannelAvatar }).withMerge(conversationMergeGroup, nil),
+	{
+		id: 12, name: "left", version: conversationVersionV4, merge: conversationMergeUpdate,
+		append: func(dst []byte, cn *Conversation) []byte {
+			var left uint8
+			if cn.Left {
+				left = 1
+			}
+			return append(dst, left)
+		},
+		decode: func(dec *wkproto.Decoder, cn *Conversation) error {
+			left, err := dec.Uint8()
+			cn.Left = left == 1
+			return err
+		},
+	},
+	conversationInt64Field(13, "pinned_at", conversationVersionV5, func(cn *Conversation) *int64 { return &cn.PinnedAt }).withMerge(conversationMergeCarry, carryPinnedAt),
+	{
+		id: 14, name: "mute", version: conversationVersionV6, merge: conversationMergeCarry, carry: carryMute,
+		append: func(dst []byte, cn *Conversation) []byte { return append(dst, cn.Mute) },
+		decode: func(dec *wkproto.Decoder, cn *Conversation) (err error) {
+			cn.Mute, err = dec.Uint8()
+			return
+		},
+	},
+	{
+		id: 15, name: "extra", version: conversationVersionV7, merge: conversationMergeCarry, carry: carryExtra,
+		append: appendConversationExtra,
+		decode: func(dec *wkproto.Decoder, cn *Conversation) error {
+			extra, err := dec.String()
+			if err != nil {
+				return err
+			}
+			cn.Extra, err = decodeConversationExtra(extra)
+			return err
+		},
+	},
+	{
+		id: 16, name: "archived", version: conversationVersionV8, merge: conversationMergeCarry, carry: carryArchived,
+		append: func(dst []byte, cn *Conversation) []byte {
+			var archived uint8
+			if cn.Archived {
+				archived = 1
+			}
+			return append(dst, archived)
+		},
+		decode: func(dec *wkproto.Decoder, cn *Conversation) error {
+			archived, err := dec.Uint8()
+			cn.Archived = archived == 1
+			return err
+		},
+	},
+	{
+		id: 17, name: "mention_count", version: conversationVersion, merge: conversationMergeCarry, carry: carryMentionCount,
+		append: func(dst []byte, cn *Conversation) []byte {
+			return binary.BigEndian.AppendUint32(dst, cn.MentionCount)
+		},
+		decode: func(dec *wkproto.Decoder, cn *Conversation) (err error) {
+			cn.MentionCount, err = dec.Uint32()
+			return
+		},
+	},
+}
+
+func init() {
+	if err := validateConversationFields(conversationFields, conversationVersion); err != nil {
+		panic(err)
+	}
+}
+
+// validateConversationFields 检查字段的编码顺序，字段顺序错了会导致新旧版本的数据互相解析错乱
+func validateConversationFields(fields []conversationField, maxVersion uint8) error {
+	for i, field := range fields {
+		if field.append == nil || field.decode == nil {
+			return fmt.Errorf("conversation field %d(%s) codec is nil", field.id, field.name)
+		}
+		switch field.merge {
+		case conversationMergeUpdate, conversationMergeGroup:
+			if field.carry != nil {
+				return fmt.Errorf("conversation field %d(%s) carry must be nil", field.id, field.name)
+			}
+			if field.merge == conversationMergeGroup && i == 0 {
+				return fmt.Errorf("conversation field %d(%s) has no previous field to merge with", field.id, field.name)
+			}
+		case conversationMergeCarry:
+			if field.carry == nil {
+				return fmt.Errorf("conversation field %d(%s) carry is nil", field.id, field.name)
+			}
+		default:
+			return fmt.Errorf("conversation field %d(%s) merge is not set", field.id, field.name)
+		}
+		if field.version > maxVersion {
+			return fmt.Errorf("conversation field %d(%s) version %d is greater than %d", field.id, field.name, field.version, maxVersion)
+		}
+		if i == 0 {
+			continue
+		}
+		prev := fields[i-1]
+		if field.id <= prev.id {
+			return fmt.Errorf("conversation field %d(%s) must be greater than previous field %d(%s)", field.id, field.name, prev.id, prev.name)
+		}
+		if field.version < prev.version {
+			return fmt.Errorf("conversation field %d(%s) version %d is less than previous field %d(%s) version %d", field.id, field.name, field.version, prev.id, prev.name, prev.version)
+		}
+		if field.merge == conversationMergeGroup && prev.merge != conversationMergeCarry && prev.merge != conversationMergeGroup {
+			return fmt.Errorf("conversation field %d(%s) merged with previous field %d(%s) which has no carry", field.id, field.name, prev.id, prev.name)
+		}
+		if field.key && !prev.key {
+			return fmt.Errorf("conversation key field %d(%s) must be before other fields", field.id, field.name)
+		}
+	}
+	return nil
+}
+
+// appendConversation 按指定的字段和版本号编码一条最近会话追加到dst，version为v1时没有数据长度
+// 所有字段直接追加到同一个slice里（数据长度先占位，编码完字段后回填），编码时除了dst扩容外没有内存分配
+func appendConversation(dst []byte, fields []conversationField, version uint8, cn *Conversation) []byte {
+	dst = append(dst, version)
+	if version == conversationVersionV1 {
+		for _, field := range fields {
+			dst = field.append(dst, cn)
+		}
+		return dst
+	}
+	sizeOffset := len(dst)
+	dst = append(dst, 0, 0, 0, 0)
+	for _, field := range fields {
+		dst = field.append(dst, cn)
+	}
+	binary.BigEndian.PutUint32(dst[sizeOffset:], uint32(len(dst)-sizeOffset-4))
+	return dst
+}
+
+// appendConversationString 字符串编码为 长度(uint16) + 内容，和wkproto.Encoder.WriteString相同
+func appendConversationString(dst []byte, str string) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(str)))
+	return append(dst, str...)
+}
+
+func conversationStringField(id int, name string, version uint8, key bool, value func(cn *Conversation) *string) conversationField {
+	return conversationField{
+		id: id, name: name, version: version, key: key,
+		append: func(dst []byte, cn *Conversation) []byte { return appendConversationString(dst, *value(cn)) },
+		decode: func(dec *wkproto.Decoder, cn *Conversation) (err error) {
+			*value(cn), err = dec.String()
+			return
+		},
+	}
+}
+
+func conversationInt64Field(id int, name string, version uint8, value func(cn *Conversation) *int64) conversationField {
+	return conversationField{
+		id: id, name: name, version: version,
+		append: func(dst []byte, cn *Conversation) []byte {
+			return binary.BigEndian.AppendUint64(dst, uint64(*value(cn)))
+		},
+		decode: func(dec *wkproto.Decoder, cn *Conversation) (err error) {
+			*value(cn), err = dec.Int64()
+			return
+		},
+	}
+}
+
+// encodeConversationExtra 扩展数据编码为json，没有扩展数据时为空字符串
+func encodeConversationExtra(extra map[string]string) string {
+	if len(extra) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(extra) // map[string]string不会出错，key按顺序输出
+	return string(data)
+}
+
+// appendConversationExtra 扩展数据按字符串编码，json直接追加到dst，不转换成字符串
+func appendConversationExtra(dst []byte, cn *Conversation) []byte {
+	if len(cn.Extra) == 0 {
+		return append(dst, 0, 0)
+	}
+	data, _ := json.Marshal(cn.Extra)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(data)))
+	return append(dst, data...)
+}
+
+func decodeConversationExtra(extra string) (map[string]string, error) {
+	if extra == "" {
+		return nil, nil
+	}
+	var m map[string]string
+	if err := json.Unmarshal([]byte(extra), &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,233 @@
+package wkstore
+
+import (
+	"fmt"
+	"testing"
+
+	wkproto "github.com/WuKongIM/WuKongIMGoProto"
+	"github.com/stretchr/testify/assert"
+)
+
+// conversationFieldSamples 每个字段有值时的样例，新增字段时需要在这里添加
+var conversationFieldSamples = map[string]func(cn *Conversation){
+	"uid":                func(cn *Conversation) { cn.UID = "u1" },
+	"channel_id":         func(cn *Conversation) { cn.ChannelID = "g1" },
+	"channel_type":       func(cn *Conversation) { cn.ChannelType = 2 },
+	"unread_count":       func(cn *Conversation) { cn.UnreadCount = 5 },
+	"timestamp":          func(cn *Conversation) { cn.Timestamp = 1700000000 },
+	"last_msg_seq":       func(cn *Conversation) { cn.LastMsgSeq = 99 },
+	"last_client_msg_no": func(cn *Conversation) { cn.LastClientMsgNo = "no99" },
+	"last_msg_id":        func(cn *Conversation) { cn.LastMsgID = 990 },
+	"version":            func(cn *Conversation) { cn.Version = 1700000000123 },
+	"channel_name":       func(cn *Conversation) { cn.ChannelName = "group1" },
+	"channel_avatar":     func(cn *Conversation) { cn.ChannelAvatar = "http://avatar/g1.png" },
+	"left":               func(cn *Conversation) { cn.Left = true },
+	"pinned_at":          func(cn *Conversation) { cn.PinnedAt = 1700000000456 },
+	"mute":               func(cn *Conversation) { cn.Mute = 1 },
+	"extra":              func(cn *Conversation) { cn.Extra = map[string]string{"draft": "hi", "mention": "u2"} },
+	"archived":           func(cn *Conversation) { cn.Archived = true },
+	"mention_count":      func(cn *Conversation) { cn.MentionCount = 3 },
+}
+
+// generateConversations 生成非key字段有值/没值的所有组合，key字段都有值（channelID带上组合编号，保证同一个用户下不重复）
+func generateConversations(t *testing.T, fields []conversationField) ConversationSet {
+	optional := make([]conversationField, 0, len(fields))
+	for _, field := range fields {
+		if _, ok := conversationFieldSamples[field.name]; !ok {
+			t.Fatalf("conversation field %s has no sample", field.name)
+		}
+		if !field.key {
+			optional = append(optional, field)
+		}
+	}
+	conversations := make(ConversationSet, 0, 1<<len(optional))
+	for mask := 0; mask < 1<<len(optional); mask++ {
+		cn := &Conversation{}
+		for _, field := range fields {
+			if field.key {
+				conversationFieldSamples[field.name](cn)
+			}
+		}
+		cn.ChannelID = fmt.Sprintf("%s-%d", cn.ChannelID, mask)
+		for i, field := range optional {
+			if mask&(1<<i) != 0 {
+				conversationFieldSamples[field.name](cn)
+			}
+		}
+		conversations = append(conversations, cn)
+	}
+	return conversations
+}
+
+// fieldsOfVersion 指定版本拥有的字段
+func fieldsOfVersion(version uint8) []conversationField {
+	fields := make([]conversationField, 0, len(conversationFields))
+	for _, field := range conversationFields {
+		if field.version <= version {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// keepFields 只保留fields里的字段，其他字段为零值
+func keepFields(cn *Conversation, fields []conversationField) *Conversation {
+	data := appendConversation(nil, fields, conversationVersionV1, cn)
+	result := &Conversation{}
+	dec := wkproto.NewDecoder(data[1:])
+	for _, field := range fields {
+		if err := field.decode(dec, result); err != nil {
+			panic(err)
+		}
+	}
+	return result
+}
+
+func TestValidateConversationFields(t *testing.T) {
+	assert.NoError(t, validateConversationFields(conversationFields, conversationVersion))
+
+	clone := func() []conversationField {
+		return append([]conversationField(nil), conversationFields...)
+	}
+	last := len(conversationFields) - 1
+
+	// 顺序错乱
+	fields := clone()
+	fields[last-1], fields[last] = fields[last], fields[last-1]
+	assert.Error(t, validateConversationFields(fields, conversationVersion))
+
+	// id重复
+	fields = clone()
+	fields[last].id = fields[last-1].id
+	assert.Error(t, validateConversationFields(fields, conversationVersion))
+
+	// 新字段的版本比前面的小
+	fields = clone()
+	fields = append(fields, conversationStringField(fields[last].id+1, "preview", conversationVersionV2, false, func(cn *Conversation) *string { return &cn.LastClientMsgNo }).withMerge(conversationMergeUpdate, nil))
+	assert.Error(t, validateConversationFields(fields, conversationVersion))
+
+	// 版本号超过当前版本
+	fields = clone()
+	fields = append(fields, conversationStringField(fields[last].id+1, "preview", conversationVersion+1, false, func(cn *Conversation) *string { return &cn.LastClientMsgNo }).withMerge(conversationMergeUpdate, nil))
+	assert.Error(t, validateConversationFields(fields, conversationVersion))
+	assert.NoError(t, validateConversationFields(fields, conversationVersion+1))
+
+	// key字段在其他字段后面
+	fields = clone()
+	fields = append(fields, conversationStringField(fields[last].id+1, "preview", conversationVersion, true, func(cn *Conversation) *string { return &cn.LastClientMsgNo }).withMerge(conversationMergeUpdate, nil))
+	assert.Error(t, validateConversationFields(fields, conversationVersion))
+
+	// 没有声明合并方式
+	fields = clone()
+	fields = append(fields, conversationStringField(fields[last].id+1, "preview", conversationVersion, false, func(cn *Conversation) *string { return &cn.LastClientMsgNo }))
+	assert.Error(t, validateConversationFields(fields, conversationVersion))
+
+	// 保留已存储的值但没有carry
+	fields = clone()
+	fields[last].carry = nil
+	assert.Error(t, validateConversationFields(fields, conversationVersion))
+}
+
+// 更新已存储的最近会话时按字段声明的合并方式合并：conversationMergeUpdate的字段使用更新的值，其他的保留已存储的值
+func TestMergeConversationFields(t *testing.T) {
+	stored := &Conversation{}
+	update := &Conversation{}
+	for _, field := range conversationFields {
+		conversationFieldSamples[field.name](stored)
+		if field.key {
+			conversationFieldSamples[field.name](update)
+		}
+	}
+	merged := mergeConversationFields(update, stored)
+	assert.NotSame(t, update, merged)
+	assert.Equal(t, &Conversation{UID: "u1", ChannelID: "g1", ChannelType: 2}, update) // 不修改调用方的最近会话
+	for _, field := range conversationFields {
+		expected := &Conversation{}
+		if field.key || field.merge != conversationMergeUpdate {
+			conversationFieldSamples[field.name](expected)
+		}
+		assert.Equal(t, keepFields(expected, []conversationField{field}), keepFields(merged, []conversationField{field}), field.name)
+	}
+
+	// 没有需要保留的字段时返回原来的
+	assert.Same(t, stored, mergeConversationFields(stored, stored))
+}
+
+// 所有字段有值/没值的组合编码后都能完整解码出来，同一个用户的多条最近会话连续存储不会互相影响
+func TestConversationFieldsCombinations(t *testing.T) {
+	conversations := generateConversations(t, conversationFields)
+
+	decoded, err := DecodeConversationSet(conversations.Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, conversations, decoded)
+
+	onlyChannels, err := decodeConversations(conversations.Encode(), true)
+	assert.NoError(t, err)
+	assert.Equal(t, len(conversations), len(onlyChannels))
+	for i, cn := range conversations {
+		assert.Equal(t, &Conversation{UID: cn.UID, ChannelID: cn.ChannelID, ChannelType: cn.ChannelType}, onlyChannels[i])
+	}
+
+	// 存储后读取
+	store := newTestFileStore(t)
+	err = store.AddOrUpdateConversations("u1", conversations)
+	assert.NoError(t, err)
+	stored, err := store.GetConversations("u1")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []*Conversation(conversations), stored)
+}
+
+// 旧版本写入的数据，当前版本解码后旧版本没有的字段为零值
+func TestConversationFieldsOldVersions(t *testing.T) {
+	conversations := generateConversations(t, conversationFields)
+	for version := uint8(conversationVersionV1); version <= conversationVersion; version++ {
+		fields := fieldsOfVersion(version)
+		var data []byte
+		expected := make(ConversationSet, 0, len(conversations))
+		for _, cn := range conversations {
+			data = appendConversation(data, fields, version, cn)
+			expected = append(expected, keepFields(cn, fields))
+		}
+		decoded, err := DecodeConversationSet(data)
+		assert.NoError(t, err, "version %d", version)
+		assert.Equal(t, expected, decoded, "version %d", version)
+	}
+}
+
+// 新版本追加的字段有值/没值的组合，当前版本解码时都能忽略掉
+func TestConversationFieldsNextVersion(t *testing.T) {
+	var hidden, locked uint8
+	var preview string
+	last := conversationFields[len(conversationFields)-1]
+	fields := append(append([]conversationField(nil), conversationFields...),
+		conversationField{
+			id: last.id + 1, name: "hidden", version: conversationVersion + 1, merge: conversationMergeUpdate,
+			append: func(dst []byte, cn *Conversation) []byte { return append(dst, hidden) },
+			decode: func(dec *wkproto.Decoder, cn *Conversation) (err error) { hidden, err = dec.Uint8(); return },
+		},
+		conversationField{
+			id: last.id + 2, name: "locked", version: conversationVersion + 1, merge: conversationMergeUpdate,
+			append: func(dst []byte, cn *Conversation) []byte { return append(dst, locked) },
+			decode: func(dec *wkproto.Decoder, cn *Conversation) (err error) { locked, err = dec.Uint8(); return },
+		},
+		conversationField{
+			id: last.id + 3, name: "preview", version: conversationVersion + 1, merge: conversationMergeUpdate,
+			append: func(dst []byte, cn *Conversation) []byte { return appendConversationString(dst, preview) },
+			decode: func(dec *wkproto.Decoder, cn *Conversation) (err error) { preview, err = dec.String(); return },
+		},
+	)
+	assert.NoError(t, validateConversationFields(fields, conversationVersion+1))
+
+	conversations := generateConversations(t, conversationFields)
+	var data []byte
+	for i, cn := range conversations {
+		hidden, locked, preview = uint8(i%2), uint8(i/2%2), ""
+		if i%3 == 0 {
+			preview = fmt.Sprintf("preview %d", i)
+		}
+		data = appendConversation(data, fields, conversationVersion+1, cn)
+	}
+	decoded, err := DecodeConversationSet(data)
+	assert.NoError(t, err)
+	assert.Equal(t, conversations, decoded)
+}
@@ -0,0 +1,79 @@
+package wkstore
+
+// MessageSeqLocator 查找频道内存在的消息，最近会话查找第一条未读消息时用来跳过已删除或过期的消息（不依赖消息存储的实现）
+type MessageSeqLocator interface {
+	// NextMessageSeq 频道内seq在[startMessageSeq,endMessageSeq]之间第一条存在的消息seq，没有返回false
+	NextMessageSeq(channelID string, channelType uint8, startMessageSeq, endMessageSeq uint32) (uint32, bool, error)
+}
+
+// SetMessageSeqLocator 设置查找第一条未读消息时使用的消息查找，需要在Open前设置
+func (f *FileStore) SetMessageSeqLocator(locator MessageSeqLocator) {
+	f.messageSeqLocator = locator
+}
+
+// FirstUnreadMsgSeq 按未读数算出的第一条未读消息的seq（LastMsgSeq-UnreadCount+1），没有未读返回false
+// 中间的消息可能已经删除或过期，实际跳转的位置见FileStore.GetConversationFirstUnread
+func (c *Conversation) FirstUnreadMsgSeq() (uint32, bool) {
+	if c.UnreadCount <= 0 || c.LastMsgSeq == 0 {
+		return 0, false
+	}
+	if uint32(c.UnreadCount) >= c.LastMsgSeq {
+		return 1, true
+	}
+	return c.LastMsgSeq - uint32(c.UnreadCount) + 1, true
+}
+
+// GetConversationFirstUnread 用户在频道里第一条未读并且还存在的消息seq（客户端用来跳转到第一条未读），没有未读或未读的消息都已经删除或过期返回false
+// 最近会话不存在返回ErrNotFound
+func (f *FileStore) GetConversationFirstUnread(uid string, channelID string, channelType uint8) (uint32, bool, error) {
+	conversation, err := f.getConversation(uid, channelID, channelType)
+	if err == nil && conversation == nil {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return 0, false, wrapError("GetConversationFirstUnread", err, uid, channelID, channelType)
+	}
+	seq, exists, err := f.conversationFirstUnread(conversation)
+	return seq, exists, wrapError("GetConversationFirstUnread", err, uid, channelID, channelType)
+}
+
+// GetConversationsFirstUnread 批量获取用户在多个频道里第一条未读并且还存在的消息seq，只读取一次用户的最近会话，没有未读或最近会话不存在的不在结果里
+func (f *FileStore) GetConversationsFirstUnread(uid string, keys []ConversationKey) (map[ConversationKey]uint32, error) {
+	result := make(map[ConversationKey]uint32, len(keys))
+	if len(keys) == 0 {
+		return result, nil
+	}
+	conversations, err := f.getConversations(uid)
+	if err != nil {
+		return nil, wrapError("GetConversationsFirstUnread", err, uid, "", 0)
+	}
+	wanted := make(map[ConversationKey]struct{}, len(keys))
+	for _, key := range keys {
+		wanted[ConversationKey{ChannelID: key.ChannelID, ChannelType: key.ChannelType}] = struct{}{}
+	}
+	for _, conversation := range conversations {
+		key := ConversationKey{ChannelID: conversation.ChannelID, ChannelType: conversation.ChannelType}
+		if _, ok := wanted[key]; !ok {
+			continue
+		}
+		seq, exists, err := f.conversationFirstUnread(conversation)
+		if err != nil {
+			return nil, wrapError("GetConversationsFirstUnread", err, uid, conversation.ChannelID, conversation.ChannelType)
+		}
+		if exists {
+			result[ConversationKey{UID: uid, ChannelID: conversation.ChannelID, ChannelType: conversation.ChannelType}] = seq
+		}
+	}
+	return result, nil
+}
+
+func (f *FileStore) conversationFirstUnread(conversation *Conversation) (uint32, bool, error) {
+	seq, ok := conversation.FirstUnreadMsgSeq()
+	if !ok {
+		return 0, false, nil
+	}
+	if f.messageSeqLocator == nil {
+		return seq, true, nil
+	}
+	return f.messageSeqLocator.NextMessageSeq(conversation.ChannelID, conversation.ChannelType, seq, conversation.LastMsgSeq)
+}
@@ -0,0 +1,110 @@
+package wkstore
+
+import (
+	"context"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// channelConversationFn 修改用户在频道的最近会话，conversations为用户所有的最近会话，idx为此频道的最近会话的下标
+// 返回用户新的最近会话（可以删除或合并）和是否有修改需要保存，返回错误时当前批次回滚
+type channelConversationFn func(uid string, conversations []*Conversation, idx int) ([]*Conversation, bool, error)
+
+// channelConversationChunkFn 在每批的写事务里最后调用（比如修改频道的订阅关系），和这批最近会话在同一个事务里提交，返回错误时整批回滚
+// keys为这批的所有最近会话，changed为这批修改了的最近会话
+type channelConversationChunkFn func(t *bolt.Tx, keys []ConversationKey, changed []ConversationKey) error
+
+// forEachChannelConversation 遍历频道的本地用户（订阅者）在此频道的最近会话，按用户分批，每批在一个写事务里修改并提交
+// 返回频道所有的最近会话和修改了的最近会话（调用方用来清除缓存），出错时当前批次（包括chunkDone的修改）回滚，已经提交的批次不会回滚
+// opts.DryRun时只读并统计会修改的最近会话，不调用chunkDone
+func (f *FileStore) forEachChannelConversation(channelID string, channelType uint8, op string, opts MaintenanceOptions, fn channelConversationFn, chunkDone channelConversationChunkFn) ([]ConversationKey, []ConversationKey, error) {
+	keys, err := f.getConversationKeysOfChannel(channelID, channelType)
+	if err != nil {
+		return nil, nil, err
+	}
+	m := newMaintenance(op, opts, len(keys))
+	chunk := m.batchSize(f.cfg)
+	changed := make([]ConversationKey, 0)
+	for start := 0; start < len(keys); start += chunk {
+		end := start + chunk
+		if end > len(keys) {
+			end = len(keys)
+		}
+		chunkKeys := keys[start:end]
+		chunkChanged, err := f.updateChannelConversationsChunk(chunkKeys, opts.DryRun, fn, chunkDone)
+		if err != nil {
+			return nil, nil, err
+		}
+		changed = append(changed, chunkChanged...)
+		if err = m.advance(context.Background(), len(chunkKeys), len(chunkChanged)); err != nil {
+			return nil, nil, err
+		}
+	}
+	m.done()
+	return keys, changed, nil
+}
+
+// updateChannelConversationsChunk 在一个事务里修改一批最近会话（用户可能在不同的槽位）并调用chunkDone，dryRun时只读不写
+func (f *FileStore) updateChannelConversationsChunk(keys []ConversationKey, dryRun bool, fn channelConversationFn, chunkDone channelConversationChunkFn) ([]ConversationKey, error) {
+	tx := f.update
+	if dryRun {
+		tx = f.view
+	}
+	var changed []ConversationKey
+	err := tx(func(t *bolt.Tx) error {
+		changed = make([]ConversationKey, 0, len(keys))
+		for _, item := range keys {
+			bucket, err := f.getSlotBucket(f.slotNum(item.UID), t)
+			if err != nil {
+				return err
+			}
+			key := []byte(f.getConversationKey(item.UID))
+			value := bucket.Get(key)
+			if len(value) == 0 {
+				continue
+			}
+			conversations, err := decodeConversations(value, false)
+			if err != nil {
+				return err
+			}
+			idx := -1
+			for i, conversation := range conversations {
+				if conversation.ChannelID == item.ChannelID && conversation.ChannelType == item.ChannelType {
+					idx = i
+					break
+				}
+			}
+			if idx < 0 {
+				continue
+			}
+			old := snapshotConversations(conversations)
+			conversations, modify, err := fn(item.UID, conversations, idx)
+			if err != nil {
+				return err
+			}
+			if !modify {
+				continue
+			}
+			f.keepConversationVersionsMonotonic(old, conversations)
+			changed = append(changed, item)
+			if dryRun {
+				continue
+			}
+			var newValue []byte
+			if len(conversations) > 0 {
+				newValue = f.encodeConversations(conversations)
+			}
+			if err = f.putUserConversationsInTx(bucket, item.UID, newValue); err != nil {
+				return err
+			}
+		}
+		if chunkDone != nil && !dryRun {
+			return chunkDone(t, keys, changed)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changed, nil
+}
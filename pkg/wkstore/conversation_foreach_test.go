@@ -0,0 +1,140 @@
+package wkstore
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func newForEachTestStore(t *testing.T, uids []string) *FileStore {
+	store := newTestFileStore(t)
+	store.cfg.ScanBatchSize = 2
+	store.cfg.ScanBatchBackoff = 0
+	assert.NoError(t, store.AddSubscribers("g1", 2, uids))
+	for _, uid := range uids {
+		assert.NoError(t, store.AddOrUpdateConversations(uid, []*Conversation{
+			{UID: uid, ChannelID: "g1", ChannelType: 2, UnreadCount: 1},
+			{UID: uid, ChannelID: "g2", ChannelType: 2, UnreadCount: 1},
+		}))
+	}
+	return store
+}
+
+func TestForEachChannelConversationChunkFailure(t *testing.T) {
+	uids := []string{"u1", "u2", "u3", "u4"}
+	store := newForEachTestStore(t, uids)
+
+	errFail := errors.New("fail")
+	chunks := 0
+	setUnread := func(uid string, conversations []*Conversation, idx int) ([]*Conversation, bool, error) {
+		if uid == "u4" {
+			return nil, false, errFail
+		}
+		conversations[idx].UnreadCount = 0
+		return conversations, true, nil
+	}
+	_, _, err := store.forEachChannelConversation("g1", 2, "test", MaintenanceOptions{}, setUnread, func(_ *bolt.Tx, keys, changed []ConversationKey) error {
+		chunks++
+		assert.Len(t, keys, 2)
+		assert.Len(t, changed, 2)
+		return nil
+	})
+	assert.ErrorIs(t, err, errFail)
+	assert.Equal(t, 1, chunks)
+
+	// 第一批已经提交，失败的批次整体回滚
+	unread := map[string]int{}
+	for _, uid := range uids {
+		conversation, err := store.GetConversation(uid, "g1", 2)
+		assert.NoError(t, err)
+		unread[uid] = conversation.UnreadCount
+	}
+	committed := 0
+	for _, uid := range uids {
+		if unread[uid] == 0 {
+			committed++
+		}
+	}
+	assert.Equal(t, 2, committed)
+	assert.Equal(t, 1, unread["u4"])
+
+	// 其他频道的最近会话不受影响
+	conversation, err := store.GetConversation("u1", "g2", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, conversation.UnreadCount)
+}
+
+func TestForEachChannelConversationDryRunAndDelete(t *testing.T) {
+	uids := []string{"u1", "u2", "u3"}
+	store := newForEachTestStore(t, uids)
+	removeAll := func(uid string, conversations []*Conversation, idx int) ([]*Conversation, bool, error) {
+		if uid == "u2" {
+			return conversations, false, nil
+		}
+		return conversations[:0], true, nil
+	}
+
+	keys, changed, err := store.forEachChannelConversation("g1", 2, "test", MaintenanceOptions{DryRun: true}, removeAll, func(_ *bolt.Tx, keys, changed []ConversationKey) error {
+		t.Fatal("chunkDone called in dry run")
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, keys, 3)
+	assert.Len(t, changed, 2)
+	conversations, err := store.GetConversations("u1")
+	assert.NoError(t, err)
+	assert.Len(t, conversations, 2)
+
+	_, changed, err = store.forEachChannelConversation("g1", 2, "test", MaintenanceOptions{}, removeAll, nil)
+	assert.NoError(t, err)
+	assert.Len(t, changed, 2)
+	for _, uid := range []string{"u1", "u3"} {
+		conversations, err = store.GetConversations(uid)
+		assert.NoError(t, err)
+		assert.Len(t, conversations, 0)
+	}
+	conversations, err = store.GetConversations("u2")
+	assert.NoError(t, err)
+	assert.Len(t, conversations, 2)
+}
+
+// chunkDone在这批的事务里执行，返回错误时这批的最近会话和chunkDone的修改一起回滚
+func TestForEachChannelConversationChunkDoneAtomic(t *testing.T) {
+	uids := []string{"u1", "u2", "u3", "u4"}
+	store := newForEachTestStore(t, uids)
+
+	errFail := errors.New("fail")
+	setUnread := func(uid string, conversations []*Conversation, idx int) ([]*Conversation, bool, error) {
+		conversations[idx].UnreadCount = 0
+		return conversations, true, nil
+	}
+	_, _, err := store.forEachChannelConversation("g1", 2, "test", MaintenanceOptions{}, setUnread, func(tx *bolt.Tx, keys, changed []ConversationKey) error {
+		batch := make([]string, 0, len(keys))
+		for _, key := range keys {
+			batch = append(batch, key.UID)
+		}
+		if err := store.removeSubscribersInTx(tx, "g1", 2, batch); err != nil {
+			return err
+		}
+		if keys[0].UID == "u3" {
+			return errFail
+		}
+		return nil
+	})
+	assert.ErrorIs(t, err, errFail)
+
+	subscribers, err := store.GetSubscribers("g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"u3", "u4"}, subscribers)
+	for _, uid := range uids {
+		conversation, err := store.GetConversation(uid, "g1", 2)
+		assert.NoError(t, err)
+		if uid == "u3" || uid == "u4" {
+			assert.Equal(t, 1, conversation.UnreadCount, uid)
+		} else {
+			assert.Equal(t, 0, conversation.UnreadCount, uid)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package wkstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// readPositionMaxLineSize 导入已读位置时一行最大的长度
+const readPositionMaxLineSize = 64 * 1024
+
+// ReadPosition 导入的用户在频道已读到的消息位置
+type ReadPosition struct {
+	UID          string `json:"uid"`
+	ChannelID    string `json:"channel_id"`
+	ChannelType  uint8  `json:"channel_type"`
+	ReadToMsgSeq uint32 `json:"read_to_msg_seq"`
+}
+
+// ReadPositionImportResult 导入已读位置的结果
+type ReadPositionImportResult struct {
+	Applied   int      `json:"applied"`   // 修改或创建了最近会话的记录数量（DryRun时为会修改的）
+	Unchanged int      `json:"unchanged"` // 已经读到更后面不需要修改的记录数量（比如重复导入）
+	Skipped   int      `json:"skipped"`   // 格式错误或超过最近会话数量上限跳过的记录数量
+	UIDs      []string `json:"-"`         // 有修改的用户
+}
+
+// ImportReadPositions 从其他系统迁移时批量导入用户在频道已读到的消息位置，每行一条记录，支持csv（uid,channel_id,channel_type,read_to_msg_seq）和ndjson（ReadPosition）
+// 空行、#开头的行和csv的表头忽略，格式错误的行跳过并计数；最近会话存在时按Conversation.ReadTo修正未读数（已经读到更后面的不修改），不存在时创建（最后一条消息为已读位置，没有未读）
+// 每ScanBatchSize条记录按slot分组后在一个写事务里提交并回调进度，记录可以重复导入，中断后从头重新导入即可
+func (f *FileStore) ImportReadPositions(r io.Reader, opts MaintenanceOptions) (*ReadPositionImportResult, error) {
+	defer f.trace("ImportReadPositions", "", time.Now(), zap.Bool("dryRun", opts.DryRun))
+	result, err := f.importReadPositions(r, opts)
+	return result, wrapError("ImportReadPositions", err, "", "", 0)
+}
+
+func (f *FileStore) importReadPositions(r io.Reader, opts MaintenanceOptions) (*ReadPositionImportResult, error) {
+	m := newMaintenance("ImportReadPositions", opts, -1)
+	batchSize := m.batchSize(f.cfg)
+	result := &ReadPositionImportResult{}
+	uids := make(map[string]struct{})
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), readPositionMaxLineSize)
+
+	batch := make([]ReadPosition, 0, batchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		applied, err := f.importReadPositionsBatch(batch, opts.DryRun, result)
+		if err != nil {
+			return err
+		}
+		for _, key := range applied {
+			uids[key.UID] = struct{}{}
+		}
+		scanned := len(batch)
+		batch = batch[:0]
+		return m.advance(context.Background(), scanned, len(applied))
+	}
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		position, header, err := parseReadPosition(line)
+		if header {
+			continue
+		}
+		if err != nil {
+			result.Skipped++
+			f.Debug("skip malformed read position", zap.Int("line", lineNo), zap.Error(err))
+			continue
+		}
+		batch = append(batch, position)
+		if len(batch) >= batchSize {
+			if err = flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	m.done()
+	result.UIDs = make([]string, 0, len(uids))
+	for uid := range uids {
+		result.UIDs = append(result.UIDs, uid)
+	}
+	sort.Strings(result.UIDs)
+	return result, nil
+}
+
+// parseReadPosition 解析一行已读位置，{开头的按json解析，否则按csv解析，header为true表示是csv的表头
+func parseReadPosition(line []byte) (ReadPosition, bool, error) {
+	var position ReadPosition
+	if line[0] == '{' {
+		if err := json.Unmarshal(line, &position); err != nil {
+			return position, false, err
+		}
+	} else {
+		fields := strings.Split(string(line), ",")
+		if len(fields) != 4 {
+			return position, false, fmt.Errorf("expected 4 fields, got %d", len(fields))
+		}
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		if strings.EqualFold(fields[0], "uid") {
+			return position, true, nil
+		}
+		channelType, err := strconv.ParseUint(fields[2], 10, 8)
+		if err != nil {
+			return position, false, err
+		}
+		readToMsgSeq, err := strconv.ParseUint(fields[3], 10, 32)
+		if err != nil {
+			return position, false, err
+		}
+		position = ReadPosition{UID: fields[0], ChannelID: fields[1], ChannelType: uint8(channelType), ReadToMsgSeq: uint32(readToMsgSeq)}
+	}
+	if position.UID == "" || !validConversationChannel(position.ChannelID, position.ChannelType) {
+		return position, false, ErrInvalidConversation
+	}
+	return position, false, nil
+}
+
+// importReadPositionsBatch 在一个事务里导入一批已读位置（按slot和用户分组，同一个最近会话取最大的位置），返回有修改的最近会话
+func (f *FileStore) importReadPositionsBatch(batch []ReadPosition, dryRun bool, result *ReadPositionImportResult) ([]ConversationKey, error) {
+	userPositions := make(map[string]map[ConversationKey]uint32)
+	for _, position := range batch {
+		positions := userPositions[position.UID]
+		if positions == nil {
+			positions = make(map[ConversationKey]uint32)
+			userPositions[position.UID] = positions
+		}
+		key := ConversationKey{UID: position.UID, ChannelID: position.ChannelID, ChannelType: position.ChannelType}
+		if readTo, ok := positions[key]; ok {
+			result.Unchanged++ // 同一批里重复的记录
+			if readTo >= position.ReadToMsgSeq {
+				continue
+			}
+		}
+		positions[key] = position.ReadToMsgSeq
+	}
+	uids := make([]string, 0, len(userPositions))
+	for uid := range userPositions {
+		uids = append(uids, uid)
+	}
+	sort.Slice(uids, func(i, j int) bool { // 同一个slot的用户放在一起写
+		si, sj := f.slotNum(uids[i]), f.slotNum(uids[j])
+		if si != sj {
+			return si < sj
+		}
+		return uids[i] < uids[j]
+	})
+
+	tx := f.update
+	if dryRun {
+		tx = f.view
+	}
+	var (
+		applied            []ConversationKey
+		unchanged, skipped int
+	)
+	err := tx(func(t *bolt.Tx) error {
+		applied, unchanged, skipped = applied[:0], 0, 0
+		for _, uid := range uids {
+			userApplied, userUnchanged, userSkipped, err := f.importUserReadPositionsInTx(t, uid, userPositions[uid], dryRun)
+			if err != nil {
+				return err
+			}
+			applied = append(applied, userApplied...)
+			unchanged += userUnchanged
+			skipped += userSkipped
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.Applied += len(applied)
+	result.Unchanged += unchanged
+	result.Skipped += skipped
+	if !dryRun {
+		f.conversationOps.addKeys(ConversationOpReadTo, applied)
+	}
+	return applied, nil
+}
+
+// importUserReadPositionsInTx 导入用户的已读位置，超过最近会话数量上限时不创建最近会话（记为跳过），返回有修改的最近会话、不需要修改和跳过的数量
+func (f *FileStore) importUserReadPositionsInTx(t *bolt.Tx, uid string, positions map[ConversationKey]uint32, dryRun bool) ([]ConversationKey, int, int, error) {
+	bucket, err := f.getSlotBucketWithKey(uid, t)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	key := []byte(f.getConversationKey(uid))
+	conversations := make([]*Conversation, 0)
+	if value := bucket.Get(key); len(value) > 0 {
+		if conversations, err = decodeConversations(value, false); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	old := snapshotConversations(conversations)
+	oldLen := len(conversations)
+	version := f.newConversationVersion()
+	var (
+		applied, created []ConversationKey
+		updates          []*Conversation
+		unchanged        int
+	)
+	exist := make(map[ConversationKey]bool, len(conversations))
+	for _, conversation := range conversations {
+		channelKey := ConversationKey{UID: uid, ChannelID: conversation.ChannelID, ChannelType: conversation.ChannelType}
+		exist[channelKey] = true
+		readTo, ok := positions[channelKey]
+		if !ok {
+			continue
+		}
+		if !conversation.ReadTo(readTo) {
+			unchanged++
+			continue
+		}
+		conversation.Version = version
+		updates = append(updates, conversation)
+		applied = append(applied, channelKey)
+	}
+	for channelKey, readTo := range positions {
+		if exist[channelKey] {
+			continue
+		}
+		conversation := &Conversation{
+			UID:         uid,
+			ChannelID:   channelKey.ChannelID,
+			ChannelType: channelKey.ChannelType,
+			Timestamp:   f.now().Unix(),
+			LastMsgSeq:  readTo,
+			Version:     version,
+		}
+		conversations = append(conversations, conversation)
+		updates = append(updates, conversation)
+		created = append(created, channelKey)
+	}
+	skipped := 0
+	if len(created) > 0 {
+		quota, err := f.applyConversationQuota(uid, conversations, oldLen, updates)
+		if err != nil {
+			if !errors.Is(err, ErrOverQuota) {
+				return nil, 0, 0, err
+			}
+			conversations = conversations[:oldLen] // 超过上限不创建，已有的最近会话照样修改
+			skipped = len(created)
+			created = nil
+		} else {
+			conversations = quota
+		}
+	}
+	applied = append(applied, created...)
+	if len(applied) == 0 || dryRun {
+		return applied, unchanged, skipped, nil
+	}
+	f.keepConversationVersionsMonotonic(old, conversations)
+	if err = f.putUserConversationsInTx(bucket, uid, f.encodeConversations(conversations)); err != nil {
+		return nil, 0, 0, err
+	}
+	return applied, unchanged, skipped, nil
+}
@@ -0,0 +1,94 @@
+package wkstore
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImportReadPositions(t *testing.T) {
+	store := newTestFileStore(t)
+	store.cfg.ScanBatchSize = 2
+
+	err := store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, LastMsgSeq: 10, UnreadCount: 5},
+		{UID: "u1", ChannelID: "g2", ChannelType: 2, LastMsgSeq: 10, UnreadCount: 2},
+	})
+	assert.NoError(t, err)
+	before, err := store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+
+	input := strings.Join([]string{
+		"uid,channel_id,channel_type,read_to_msg_seq",
+		"# 注释",
+		"u1,g1,2,8",
+		"u1,g2,2,7", // 已经读到更后面
+		"",
+		`{"uid":"u2","channel_id":"g1","channel_type":2,"read_to_msg_seq":6}`,
+		"u2,g1,2,4", // 同一个最近会话取最大的
+		"u1,g3,x,1",
+		"u1,g3,2",
+		`{"uid":"u3",`,
+		",g1,2,1",
+	}, "\n")
+
+	events := make([]ProgressEvent, 0)
+	result, err := store.ImportReadPositions(strings.NewReader(input), MaintenanceOptions{
+		Progress: func(event ProgressEvent) {
+			events = append(events, event)
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, result.Applied)
+	assert.Equal(t, 2, result.Unchanged)
+	assert.Equal(t, 4, result.Skipped)
+	assert.Equal(t, []string{"u1", "u2"}, result.UIDs)
+	assert.Len(t, events, 3)
+	assert.True(t, events[len(events)-1].Done)
+
+	conversation, err := store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, conversation.UnreadCount)
+	assert.Greater(t, conversation.Version, before.Version)
+	conversation, err = store.GetConversation("u1", "g2", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, conversation.UnreadCount)
+
+	// 不存在的创建
+	conversation, err = store.GetConversation("u2", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(6), conversation.LastMsgSeq)
+	assert.Equal(t, 0, conversation.UnreadCount)
+	assert.Equal(t, int64(2), store.ConversationOpStats()[0].ReadTo)
+
+	// 重复导入不修改
+	result, err = store.ImportReadPositions(strings.NewReader(input), MaintenanceOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, result.Applied)
+	assert.Empty(t, result.UIDs)
+	conversations, err := store.GetConversations("u2")
+	assert.NoError(t, err)
+	assert.Len(t, conversations, 1)
+
+	// DryRun不写入
+	result, err = store.ImportReadPositions(strings.NewReader("u3,g1,2,1\nu1,g1,2,10"), MaintenanceOptions{DryRun: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, result.Applied)
+	conversation, err = store.GetConversation("u3", "g1", 2)
+	assert.NoError(t, err)
+	assert.Nil(t, conversation)
+	conversation, err = store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, conversation.UnreadCount)
+
+	// 超过数量上限的不创建
+	store.cfg.MaxConversationsPerUser = 2
+	result, err = store.ImportReadPositions(strings.NewReader("u1,g3,2,1\nu1,g1,2,10"), MaintenanceOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.Applied)
+	assert.Equal(t, 1, result.Skipped)
+	conversation, err = store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, conversation.UnreadCount)
+}
@@ -0,0 +1,136 @@
+package wkstore
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ConversationIterOptions 遍历最近会话的条件
+type ConversationIterOptions struct {
+	Context       context.Context // 取消后停止遍历并返回ctx.Err()，为nil表示不能取消
+	ChannelType   uint8           // 只遍历此频道类型的最近会话，0（ReservedChannelType）表示不过滤
+	UpdatedAfter  int64           // 只遍历Timestamp（秒）不小于此值的最近会话，0表示不限制
+	UpdatedBefore int64           // 只遍历Timestamp（秒）小于此值的最近会话，0表示不限制
+	RateLimit     int             // IterateAllConversations每秒最多遍历的用户数量，0表示不限制
+}
+
+func (o ConversationIterOptions) context() context.Context {
+	if o.Context == nil {
+		return context.Background()
+	}
+	return o.Context
+}
+
+func (o ConversationIterOptions) match(conversation *Conversation) bool {
+	if o.ChannelType != ReservedChannelType && conversation.ChannelType != o.ChannelType {
+		return false
+	}
+	if o.UpdatedAfter > 0 && conversation.Timestamp < o.UpdatedAfter {
+		return false
+	}
+	if o.UpdatedBefore > 0 && conversation.Timestamp >= o.UpdatedBefore {
+		return false
+	}
+	return true
+}
+
+// SlotCount slot的数量，IterateAllConversations的slot为[0, SlotCount)
+func (f *FileStore) SlotCount() int {
+	return f.cfg.SlotNum
+}
+
+// IterateConversations 按存储的顺序遍历用户符合条件的最近会话，fn返回false时停止
+// 遍历的是一个读事务里的快照，fn在事务外调用，可以在fn里修改最近会话（不影响这次遍历）
+func (f *FileStore) IterateConversations(uid string, opts ConversationIterOptions, fn func(Conversation) bool) error {
+	defer f.trace("IterateConversations", uid, time.Now(), zap.Uint8("channelType", opts.ChannelType))
+	return wrapError("IterateConversations", f.iterateConversations(uid, opts, fn), uid, "", 0)
+}
+
+func (f *FileStore) iterateConversations(uid string, opts ConversationIterOptions, fn func(Conversation) bool) error {
+	if uid == "" {
+		return ErrInvalidConversation
+	}
+	ctx := opts.context()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	conversations, err := f.getConversations(uid)
+	if err != nil {
+		return err
+	}
+	for _, conversation := range conversations {
+		if !opts.match(conversation) {
+			continue
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if !fn(*conversation) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// IterateAllConversations 按用户的顺序遍历slot下所有用户符合条件的最近会话，fn返回false时停止
+// 每ScanBatchSize个用户在一个读事务里读取（每批是一个快照，批之间的修改可能看到也可能看不到），fn在事务外调用，可以在fn里修改最近会话
+func (f *FileStore) IterateAllConversations(slot uint32, opts ConversationIterOptions, fn func(Conversation) bool) error {
+	defer f.trace("IterateAllConversations", "", time.Now(), zap.Uint32("slot", slot), zap.Uint8("channelType", opts.ChannelType))
+	return wrapError("IterateAllConversations", f.iterateAllConversations(slot, opts, fn), "", "", 0)
+}
+
+func (f *FileStore) iterateAllConversations(slot uint32, opts ConversationIterOptions, fn func(Conversation) bool) error {
+	if int(slot) >= f.cfg.SlotNum {
+		return ErrInvalidSlot
+	}
+	ctx := opts.context()
+	m := newMaintenance("IterateAllConversations", MaintenanceOptions{RateLimit: opts.RateLimit}, -1)
+	batchSize := m.batchSize(f.cfg)
+	prefix := []byte(f.conversationPrefix)
+	var startKey []byte
+	for {
+		var (
+			batch   []*Conversation
+			users   int
+			stopped bool
+		)
+		err := f.scanFrom(ctx, prefix, slot, startKey, func(s uint32, key, value []byte) error {
+			if s != slot { // 只遍历这个slot
+				return errStopScan
+			}
+			if users >= batchSize { // 下一批从这个用户开始
+				stopped = true
+				startKey = append(make([]byte, 0, len(key)), key...)
+				return errStopScan
+			}
+			users++
+			conversations, err := decodeConversations(value, false)
+			if err != nil {
+				f.Warn("decode conversations fail", zap.Error(err), zap.ByteString("key", key))
+				return nil
+			}
+			for _, conversation := range conversations {
+				if opts.match(conversation) {
+					batch = append(batch, conversation)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, conversation := range batch {
+			if !fn(*conversation) {
+				return nil
+			}
+		}
+		if !stopped {
+			return nil
+		}
+		if err = m.advance(ctx, users, len(batch)); err != nil {
+			return err
+		}
+	}
+}
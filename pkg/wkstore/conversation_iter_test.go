@@ -0,0 +1,134 @@
+package wkstore
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIterateConversations(t *testing.T) {
+	store := newTestFileStore(t)
+
+	err := store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, Timestamp: 100},
+		{UID: "u1", ChannelID: "g2", ChannelType: 2, Timestamp: 200},
+		{UID: "u1", ChannelID: "g3", ChannelType: 2, Timestamp: 300},
+		{UID: "u1", ChannelID: "u2", ChannelType: 1, Timestamp: 200},
+	})
+	assert.NoError(t, err)
+
+	collect := func(opts ConversationIterOptions) []string {
+		channelIDs := make([]string, 0)
+		err := store.IterateConversations("u1", opts, func(conversation Conversation) bool {
+			channelIDs = append(channelIDs, conversation.ChannelID)
+			return true
+		})
+		assert.NoError(t, err)
+		return channelIDs
+	}
+	assert.ElementsMatch(t, []string{"g1", "g2", "g3", "u2"}, collect(ConversationIterOptions{}))
+	assert.ElementsMatch(t, []string{"u2"}, collect(ConversationIterOptions{ChannelType: 1}))
+	assert.ElementsMatch(t, []string{"g2", "g3", "u2"}, collect(ConversationIterOptions{UpdatedAfter: 200}))
+	assert.ElementsMatch(t, []string{"g1", "g2", "u2"}, collect(ConversationIterOptions{UpdatedBefore: 300}))
+	assert.ElementsMatch(t, []string{"g2"}, collect(ConversationIterOptions{ChannelType: 2, UpdatedAfter: 200, UpdatedBefore: 300}))
+	assert.Empty(t, collect(ConversationIterOptions{ChannelType: 3}))
+
+	// fn返回false时停止
+	count := 0
+	err = store.IterateConversations("u1", ConversationIterOptions{}, func(conversation Conversation) bool {
+		count++
+		return count < 2
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// fn里可以修改最近会话
+	err = store.IterateConversations("u1", ConversationIterOptions{ChannelType: 2}, func(conversation Conversation) bool {
+		assert.NoError(t, store.DeleteConversation("u1", conversation.ChannelID, conversation.ChannelType))
+		return true
+	})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"u2"}, collect(ConversationIterOptions{}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = store.IterateConversations("u1", ConversationIterOptions{Context: ctx}, func(conversation Conversation) bool {
+		return true
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestIterateAllConversations(t *testing.T) {
+	store := newTestFileStore(t)
+	store.cfg.ScanBatchSize = 2
+
+	// 5个用户在同一个slot（分3批读取），另外5个用户在其他slot
+	slot := store.slotNum("u0")
+	var inSlot, others []string
+	for i := 0; len(inSlot) < 5 || len(others) < 5; i++ {
+		uid := fmt.Sprintf("u%d", i)
+		if store.slotNum(uid) == slot {
+			if len(inSlot) == 5 {
+				continue
+			}
+			inSlot = append(inSlot, uid)
+		} else {
+			if len(others) == 5 {
+				continue
+			}
+			others = append(others, uid)
+		}
+		err := store.AddOrUpdateConversations(uid, []*Conversation{
+			{UID: uid, ChannelID: "g1", ChannelType: 2, Timestamp: int64(len(inSlot))},
+			{UID: uid, ChannelID: "p1", ChannelType: 1, Timestamp: int64(len(inSlot))},
+		})
+		assert.NoError(t, err)
+	}
+
+	collect := func(opts ConversationIterOptions) []*Conversation {
+		conversations := make([]*Conversation, 0)
+		err := store.IterateAllConversations(slot, opts, func(conversation Conversation) bool {
+			conversations = append(conversations, &conversation)
+			return true
+		})
+		assert.NoError(t, err)
+		return conversations
+	}
+	conversations := collect(ConversationIterOptions{})
+	assert.Len(t, conversations, 10) // 只有这个slot的用户
+	uids := make(map[string]struct{})
+	for _, conversation := range conversations {
+		uids[conversation.UID] = struct{}{}
+	}
+	assert.Len(t, uids, 5)
+	for _, uid := range inSlot {
+		assert.Contains(t, uids, uid)
+	}
+
+	// 过滤条件组合
+	conversations = collect(ConversationIterOptions{ChannelType: 2})
+	assert.Len(t, conversations, 5)
+	conversations = collect(ConversationIterOptions{ChannelType: 1, UpdatedAfter: 2, UpdatedBefore: 5})
+	assert.Len(t, conversations, 3)
+	for _, conversation := range conversations {
+		assert.Equal(t, uint8(1), conversation.ChannelType)
+		assert.True(t, conversation.Timestamp >= 2 && conversation.Timestamp < 5)
+	}
+	assert.Empty(t, collect(ConversationIterOptions{UpdatedAfter: 6}))
+
+	// fn返回false时停止（跨批）
+	count := 0
+	err := store.IterateAllConversations(slot, ConversationIterOptions{}, func(conversation Conversation) bool {
+		count++
+		return count < 7
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 7, count)
+
+	err = store.IterateAllConversations(uint32(store.SlotCount()), ConversationIterOptions{}, func(conversation Conversation) bool {
+		return true
+	})
+	assert.ErrorIs(t, err, ErrInvalidSlot)
+}
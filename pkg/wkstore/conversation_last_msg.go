@@ -0,0 +1,68 @@
+package wkstore
+
+import (
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// UpdateConversationLastMsg 投递消息后更新最近会话的最后一条消息（messageSeq、客户端消息编号和时间），只有messageSeq比存储的大时才修改
+// 未读数等其他字段不变，最后一条消息的ID不知道时清空（按LastMsgSeq获取消息），返回最近会话是否有修改，最近会话不存在返回ErrNotFound
+func (f *FileStore) UpdateConversationLastMsg(uid string, channelID string, channelType uint8, messageSeq uint32, clientMsgNo string, timestamp int64) (bool, error) {
+	defer f.trace("UpdateConversationLastMsg", uid, time.Now(), zap.String("channelID", channelID), zap.Uint8("channelType", channelType), zap.Uint32("messageSeq", messageSeq))
+	modify, err := f.updateConversationLastMsg(uid, channelID, channelType, messageSeq, clientMsgNo, timestamp)
+	return modify, wrapError("UpdateConversationLastMsg", err, uid, channelID, channelType)
+}
+
+func (f *FileStore) updateConversationLastMsg(uid string, channelID string, channelType uint8, messageSeq uint32, clientMsgNo string, timestamp int64) (bool, error) {
+	if uid == "" || !validConversationChannel(channelID, channelType) {
+		return false, ErrInvalidConversation
+	}
+	key := f.getConversationKey(uid)
+	f.lock.Lock(key)
+	defer f.lock.Unlock(key)
+
+	var (
+		found  bool
+		modify bool
+	)
+	err := f.update(func(t *bolt.Tx) error {
+		found, modify = false, false
+		return f.updateConversationInTx(t, uid, channelID, channelType, func(conversations []*Conversation, idx int) []*Conversation {
+			found = true
+			conversation := conversations[idx]
+			if messageSeq <= conversation.LastMsgSeq { // 乱序投递的旧消息不回退
+				return nil
+			}
+			conversation.LastMsgSeq = messageSeq
+			conversation.LastClientMsgNo = clientMsgNo
+			conversation.LastMsgID = 0
+			conversation.Timestamp = timestamp
+			conversation.Version = f.newConversationVersion()
+			modify = true
+			return conversations
+		})
+	})
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		return false, ErrNotFound
+	}
+	if modify {
+		f.conversationOps.add(ConversationOpUpdate, channelType, 1)
+	}
+	return modify, nil
+}
+
+// carryLastMsg 更新的最近会话没有带最后一条消息（LastMsgSeq为0）时保留原来的最后一条消息
+func carryLastMsg(merged *Conversation, stored *Conversation) bool {
+	if merged.LastMsgSeq != 0 || stored.LastMsgSeq == 0 {
+		return false
+	}
+	merged.LastMsgSeq = stored.LastMsgSeq
+	merged.LastClientMsgNo = stored.LastClientMsgNo
+	merged.LastMsgID = stored.LastMsgID
+	return true
+}
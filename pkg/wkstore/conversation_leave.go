@@ -0,0 +1,109 @@
+package wkstore
+
+import (
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// ConversationLeavePolicy 用户离开频道后最近会话的处理策略
+type ConversationLeavePolicy int
+
+const (
+	// ConversationLeaveDelete 删除最近会话
+	ConversationLeaveDelete ConversationLeavePolicy = iota
+	// ConversationLeaveFreeze 冻结最近会话（清空未读数并标记为已离开，之后的消息不再更新），重新加入后恢复
+	ConversationLeaveFreeze
+)
+
+// OnUserLeftChannel 用户离开频道，在一个事务里移除订阅关系并按ConversationLeavePolicy删除或冻结最近会话
+func (f *FileStore) OnUserLeftChannel(uid string, channelID string, channelType uint8) error {
+	defer f.trace("OnUserLeftChannel", uid, time.Now(), zap.String("channelID", channelID), zap.Uint8("channelType", channelType))
+	return wrapError("OnUserLeftChannel", f.onUserLeftChannel(uid, channelID, channelType), uid, channelID, channelType)
+}
+
+func (f *FileStore) onUserLeftChannel(uid string, channelID string, channelType uint8) error {
+	if uid == "" || !validConversationChannel(channelID, channelType) {
+		return ErrInvalidConversation
+	}
+	subscribersKey := f.getSubscribersKey(channelID, channelType)
+	f.lock.Lock(subscribersKey)
+	defer f.lock.Unlock(subscribersKey)
+	deleted := false
+	err := f.update(func(t *bolt.Tx) error {
+		deleted = false
+		channelBucket, err := f.getSlotBucket(f.slotNumForChannel(channelID, channelType), t)
+		if err != nil {
+			return err
+		}
+		if err = removeListInBucket(channelBucket, subscribersKey, []string{uid}); err != nil {
+			return err
+		}
+		return f.updateConversationInTx(t, uid, channelID, channelType, func(conversations []*Conversation, idx int) []*Conversation {
+			if f.cfg.ConversationLeavePolicy == ConversationLeaveFreeze {
+				conversation := conversations[idx]
+				if conversation.Left && conversation.UnreadCount == 0 {
+					return nil
+				}
+				conversation.Left = true
+				conversation.UnreadCount = 0
+				conversation.Version = f.newConversationVersion()
+				return conversations
+			}
+			deleted = true
+			return append(conversations[:idx], conversations[idx+1:]...)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if deleted {
+		f.conversationOps.add(ConversationOpDelete, channelType, 1)
+	}
+	return nil
+}
+
+// OnUserJoinedChannel 用户重新加入频道后恢复冻结的最近会话（保留原来的消息位置），没有冻结的最近会话不做处理
+func (f *FileStore) OnUserJoinedChannel(uid string, channelID string, channelType uint8) error {
+	err := f.update(func(t *bolt.Tx) error {
+		return f.updateConversationInTx(t, uid, channelID, channelType, func(conversations []*Conversation, idx int) []*Conversation {
+			conversation := conversations[idx]
+			if !conversation.Left {
+				return nil
+			}
+			conversation.Left = false
+			conversation.Version = f.newConversationVersion()
+			return conversations
+		})
+	})
+	return wrapError("OnUserJoinedChannel", err, uid, channelID, channelType)
+}
+
+// updateConversationInTx 修改用户指定频道的最近会话，fn返回修改后的最近会话，返回nil表示不需要修改，最近会话不存在时不调用fn
+func (f *FileStore) updateConversationInTx(t *bolt.Tx, uid string, channelID string, channelType uint8, fn func(conversations []*Conversation, idx int) []*Conversation) error {
+	bucket, err := f.getSlotBucketWithKey(uid, t)
+	if err != nil {
+		return err
+	}
+	key := []byte(f.getConversationKey(uid))
+	value := bucket.Get(key)
+	if len(value) == 0 {
+		return nil
+	}
+	conversations, err := decodeConversations(value, false)
+	if err != nil {
+		return err
+	}
+	for idx, conversation := range conversations {
+		if conversation.ChannelID == channelID && conversation.ChannelType == channelType {
+			old := snapshotConversations(conversations)
+			if conversations = fn(conversations, idx); conversations == nil {
+				return nil
+			}
+			f.keepConversationVersionsMonotonic(old, conversations)
+			return f.putUserConversationsInTx(bucket, uid, f.encodeConversations(conversations))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package wkstore
+
+import (
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// IncConversationMentionCount 增加（delta为负数时减少，最小为0）用户最近会话的提及数量，只修改提及数量和版本号，返回修改后的最近会话，最近会话不存在返回ErrNotFound
+// 提及数量和未读数分开计数，群里@用户的消息先按普通消息更新最近会话，再调用这个方法
+func (f *FileStore) IncConversationMentionCount(uid string, channelID string, channelType uint8, delta int) (*Conversation, error) {
+	defer f.trace("IncConversationMentionCount", uid, time.Now(), zap.String("channelID", channelID), zap.Uint8("channelType", channelType), zap.Int("delta", delta))
+	conversation, err := f.incConversationMentionCount(uid, channelID, channelType, delta)
+	return conversation, wrapError("IncConversationMentionCount", err, uid, channelID, channelType)
+}
+
+func (f *FileStore) incConversationMentionCount(uid string, channelID string, channelType uint8, delta int) (*Conversation, error) {
+	if uid == "" || !validConversationChannel(channelID, channelType) {
+		return nil, ErrInvalidConversation
+	}
+	key := f.getConversationKey(uid)
+	f.lock.Lock(key)
+	defer f.lock.Unlock(key)
+
+	var conversation *Conversation
+	err := f.update(func(t *bolt.Tx) error {
+		return f.updateConversationInTx(t, uid, channelID, channelType, func(conversations []*Conversation, idx int) []*Conversation {
+			conversation = conversations[idx]
+			mentionCount := int64(conversation.MentionCount) + int64(delta)
+			if mentionCount < 0 {
+				mentionCount = 0
+			}
+			if uint32(mentionCount) == conversation.MentionCount {
+				return nil
+			}
+			conversation.MentionCount = uint32(mentionCount)
+			conversation.Version = f.newConversationVersion()
+			return conversations
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if conversation == nil {
+		return nil, ErrNotFound
+	}
+	newConversation := *conversation
+	return &newConversation, nil
+}
+
+// carryMentionCount 提及数量只能通过IncConversationMentionCount修改（已读时清零），更新已有的最近会话时保留原来的提及数量（更新的最近会话一般不带提及数量）
+func carryMentionCount(merged *Conversation, stored *Conversation) bool {
+	if merged.MentionCount == stored.MentionCount {
+		return false
+	}
+	merged.MentionCount = stored.MentionCount
+	return true
+}
@@ -0,0 +1,55 @@
+package wkstore
+
+import "go.uber.org/zap"
+
+// dedupeConversations 合并同一次更新里重复的最近会话（同一个频道），保留第一次出现的位置
+// 合并后的最近会话是新分配的，不会修改调用方传入的数据
+func (f *FileStore) dedupeConversations(uid string, conversations []*Conversation) []*Conversation {
+	if len(conversations) < 2 {
+		return conversations
+	}
+	indexMap := make(map[ConversationKey]int, len(conversations))
+	var deduped []*Conversation
+	for idx, conversation := range conversations {
+		key := ConversationKey{ChannelID: conversation.ChannelID, ChannelType: conversation.ChannelType}
+		existIdx, ok := indexMap[key]
+		if !ok {
+			indexMap[key] = len(indexMap)
+			if deduped != nil {
+				deduped = append(deduped, conversation)
+			}
+			continue
+		}
+		if deduped == nil { // 第一次出现重复时才复制
+			deduped = make([]*Conversation, 0, len(conversations))
+			deduped = append(deduped, conversations[:idx]...)
+		}
+		deduped[existIdx] = mergeConversation(deduped[existIdx], conversation)
+		f.Info("merge duplicate conversation", zap.String("uid", uid), zap.String("channelID", conversation.ChannelID), zap.Uint8("channelType", conversation.ChannelType))
+	}
+	if deduped == nil {
+		return conversations
+	}
+	return deduped
+}
+
+// mergeConversation 合并同一个频道的两条最近会话，later为后出现的
+// 最后一条消息的信息和未读数以LastMsgSeq大的为准（相同则以后出现的为准），时间和版本取最大值
+func mergeConversation(earlier, later *Conversation) *Conversation {
+	base, other := later, earlier
+	if earlier.LastMsgSeq > later.LastMsgSeq {
+		base, other = earlier, later
+	}
+	merged := *base
+	if other.Timestamp > merged.Timestamp {
+		merged.Timestamp = other.Timestamp
+	}
+	if other.Version > merged.Version {
+		merged.Version = other.Version
+	}
+	if merged.ChannelName == "" && merged.ChannelAvatar == "" {
+		merged.ChannelName = other.ChannelName
+		merged.ChannelAvatar = other.ChannelAvatar
+	}
+	return &merged
+}
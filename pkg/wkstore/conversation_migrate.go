@@ -0,0 +1,82 @@
+package wkstore
+
+import (
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+
+	wkproto "github.com/WuKongIM/WuKongIMGoProto"
+)
+
+// MigrateConversationsChannel 频道迁移（比如群升级为超级群换了新的频道id）后，把本地用户的最近会话和订阅关系迁移到新频道，返回迁移后的最近会话
+// 按批处理，每批的最近会话和订阅关系（从旧频道的订阅者里移除，加入新频道）在同一个事务里提交，中断后重新调用会继续迁移剩下的用户
+// opts.DryRun为true时只返回会迁移的最近会话，不修改最近会话和订阅关系
+func (f *FileStore) MigrateConversationsChannel(oldChannelID string, oldChannelType uint8, newChannelID string, newChannelType uint8, opts MaintenanceOptions) ([]ConversationKey, error) {
+	keys, err := f.migrateConversationsChannel(oldChannelID, oldChannelType, newChannelID, newChannelType, opts)
+	return keys, wrapError("MigrateConversationsChannel", err, "", oldChannelID, oldChannelType)
+}
+
+func (f *FileStore) migrateConversationsChannel(oldChannelID string, oldChannelType uint8, newChannelID string, newChannelType uint8, opts MaintenanceOptions) ([]ConversationKey, error) {
+	if oldChannelID == "" || newChannelID == "" || (oldChannelID == newChannelID && oldChannelType == newChannelType) {
+		return nil, ErrInvalidChannel
+	}
+	if oldChannelType == wkproto.ChannelTypePerson || newChannelType == wkproto.ChannelTypePerson { // 个人频道没有订阅者，不支持迁移
+		return nil, ErrInvalidChannel
+	}
+	newSubscribers, err := f.GetSubscribers(newChannelID, newChannelType)
+	if err != nil {
+		return nil, err
+	}
+	subscriberSet := make(map[string]struct{}, len(newSubscribers))
+	for _, uid := range newSubscribers {
+		subscriberSet[uid] = struct{}{}
+	}
+
+	// 把旧频道的最近会话改为新频道，用户已经有新频道的最近会话则合并
+	migrate := func(uid string, conversations []*Conversation, oldIdx int) ([]*Conversation, bool, error) {
+		newIdx := -1
+		for idx, conversation := range conversations {
+			if conversation.ChannelID == newChannelID && conversation.ChannelType == newChannelType {
+				newIdx = idx
+				break
+			}
+		}
+		if newIdx < 0 {
+			conversations[oldIdx].ChannelID = newChannelID
+			conversations[oldIdx].ChannelType = newChannelType
+			return conversations, true, nil
+		}
+		merged := mergeConversation(conversations[newIdx], conversations[oldIdx])
+		merged.ChannelID = newChannelID
+		merged.ChannelType = newChannelType
+		conversations[newIdx] = merged
+		f.Info("merge migrated conversation", zap.String("uid", uid), zap.String("oldChannelID", oldChannelID), zap.String("newChannelID", newChannelID))
+		return append(conversations[:oldIdx], conversations[oldIdx+1:]...), true, nil
+	}
+	// 这批用户的订阅关系和最近会话在同一个事务里迁移到新频道
+	moveSubscribers := func(t *bolt.Tx, keys []ConversationKey, changed []ConversationKey) error {
+		batch := make([]string, 0, len(keys))
+		addUIDs := make([]string, 0, len(keys))
+		for _, key := range keys {
+			batch = append(batch, key.UID)
+			if _, ok := subscriberSet[key.UID]; !ok {
+				subscriberSet[key.UID] = struct{}{}
+				addUIDs = append(addUIDs, key.UID)
+			}
+		}
+		if len(addUIDs) > 0 {
+			if err := f.addSubscribersInTx(t, newChannelID, newChannelType, addUIDs); err != nil {
+				return err
+			}
+		}
+		return f.removeSubscribersInTx(t, oldChannelID, oldChannelType, batch)
+	}
+	_, changed, err := f.forEachChannelConversation(oldChannelID, oldChannelType, "MigrateConversationsChannel", opts, migrate, moveSubscribers)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]ConversationKey, 0, len(changed))
+	for _, key := range changed {
+		keys = append(keys, ConversationKey{UID: key.UID, ChannelID: newChannelID, ChannelType: newChannelType})
+	}
+	return keys, nil
+}
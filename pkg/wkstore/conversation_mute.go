@@ -0,0 +1,57 @@
+package wkstore
+
+import (
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// SetConversationMute 设置用户最近会话的免打扰（1开启，0关闭，其他值按开启处理），只修改免打扰和版本号，返回修改后的最近会话，最近会话不存在返回ErrNotFound
+func (f *FileStore) SetConversationMute(uid string, channelID string, channelType uint8, mute uint8) (*Conversation, error) {
+	defer f.trace("SetConversationMute", uid, time.Now(), zap.String("channelID", channelID), zap.Uint8("channelType", channelType), zap.Uint8("mute", mute))
+	conversation, err := f.setConversationMute(uid, channelID, channelType, mute)
+	return conversation, wrapError("SetConversationMute", err, uid, channelID, channelType)
+}
+
+func (f *FileStore) setConversationMute(uid string, channelID string, channelType uint8, mute uint8) (*Conversation, error) {
+	if uid == "" || !validConversationChannel(channelID, channelType) {
+		return nil, ErrInvalidConversation
+	}
+	if mute > 1 {
+		mute = 1
+	}
+	key := f.getConversationKey(uid)
+	f.lock.Lock(key)
+	defer f.lock.Unlock(key)
+
+	var conversation *Conversation
+	err := f.update(func(t *bolt.Tx) error {
+		return f.updateConversationInTx(t, uid, channelID, channelType, func(conversations []*Conversation, idx int) []*Conversation {
+			conversation = conversations[idx]
+			if conversation.Mute == mute {
+				return nil
+			}
+			conversation.Mute = mute
+			conversation.Version = f.newConversationVersion()
+			return conversations
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if conversation == nil {
+		return nil, ErrNotFound
+	}
+	newConversation := *conversation
+	return &newConversation, nil
+}
+
+// carryMute 免打扰只能通过SetConversationMute修改，更新已有的最近会话时保留原来的免打扰（缓存里的最近会话可能是设置前读取的）
+func carryMute(merged *Conversation, stored *Conversation) bool {
+	if merged.Mute == stored.Mute {
+		return false
+	}
+	merged.Mute = stored.Mute
+	return true
+}
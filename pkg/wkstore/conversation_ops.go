@@ -0,0 +1,99 @@
+package wkstore
+
+import (
+	"fmt"
+
+	"go.uber.org/atomic"
+)
+
+// ConversationOp 最近会话的操作类型，按频道类型分别计数（产品分析用，比如群聊和单聊的已读比例）
+type ConversationOp int
+
+const (
+	ConversationOpCreate ConversationOp = iota // 新增最近会话
+	ConversationOpUpdate                       // 更新已有的最近会话（最后一条消息、未读数等）
+	ConversationOpReadTo                       // 设置已读位置（包括CreateIfMissing新建的）
+	ConversationOpDelete                       // 删除最近会话（包括群解散和过期清理）
+	conversationOpCount
+)
+
+var conversationOpNames = [conversationOpCount]string{"create", "update", "read_to", "delete"}
+
+func (o ConversationOp) String() string {
+	if o < 0 || o >= conversationOpCount {
+		return fmt.Sprintf("op(%d)", int(o))
+	}
+	return conversationOpNames[o]
+}
+
+// conversationOpCounters 操作类型×频道类型的计数，频道类型是uint8所以用固定大小的数组，写路径上只有一次原子加
+type conversationOpCounters [conversationOpCount][256]atomic.Int64
+
+func (c *conversationOpCounters) add(op ConversationOp, channelType uint8, n int64) {
+	if n == 0 {
+		return
+	}
+	c[op][channelType].Add(n)
+}
+
+// addKeys 按最近会话的频道类型给op计数
+func (c *conversationOpCounters) addKeys(op ConversationOp, keys []ConversationKey) {
+	for _, key := range keys {
+		c.add(op, key.ChannelType, 1)
+	}
+}
+
+// addWrites 添加或更新最近会话后计数，created为本次新增的最近会话，其他的updates算更新
+func (c *conversationOpCounters) addWrites(updates []*Conversation, created []*Conversation) {
+	for _, conversation := range updates {
+		c.add(ConversationOpUpdate, conversation.ChannelType, 1)
+	}
+	for _, conversation := range created {
+		c.add(ConversationOpCreate, conversation.ChannelType, 1)
+		c.add(ConversationOpUpdate, conversation.ChannelType, -1)
+	}
+}
+
+// ConversationOpCounts 一个频道类型的最近会话操作次数
+type ConversationOpCounts struct {
+	ChannelType uint8 `json:"channel_type"`
+	Create      int64 `json:"create"`
+	Update      int64 `json:"update"`
+	ReadTo      int64 `json:"read_to"`
+	Delete      int64 `json:"delete"`
+}
+
+// Get 操作类型op的次数
+func (c ConversationOpCounts) Get(op ConversationOp) int64 {
+	switch op {
+	case ConversationOpCreate:
+		return c.Create
+	case ConversationOpUpdate:
+		return c.Update
+	case ConversationOpReadTo:
+		return c.ReadTo
+	case ConversationOpDelete:
+		return c.Delete
+	}
+	return 0
+}
+
+// ConversationOpStats 按频道类型统计的最近会话操作次数（进程启动后），只返回有操作的频道类型，按频道类型从小到大
+// 每个计数单独读取，不是一个一致的快照
+func (f *FileStore) ConversationOpStats() []ConversationOpCounts {
+	stats := make([]ConversationOpCounts, 0)
+	for channelType := 0; channelType < 256; channelType++ {
+		counts := ConversationOpCounts{
+			ChannelType: uint8(channelType),
+			Create:      f.conversationOps[ConversationOpCreate][channelType].Load(),
+			Update:      f.conversationOps[ConversationOpUpdate][channelType].Load(),
+			ReadTo:      f.conversationOps[ConversationOpReadTo][channelType].Load(),
+			Delete:      f.conversationOps[ConversationOpDelete][channelType].Load(),
+		}
+		if counts.Create == 0 && counts.Update == 0 && counts.ReadTo == 0 && counts.Delete == 0 {
+			continue
+		}
+		stats = append(stats, counts)
+	}
+	return stats
+}
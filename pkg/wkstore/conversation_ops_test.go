@@ -0,0 +1,91 @@
+package wkstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConversationOpStats(t *testing.T) {
+	store := newTestFileStore(t)
+	assert.Empty(t, store.ConversationOpStats())
+
+	counts := func(channelType uint8) ConversationOpCounts {
+		for _, stat := range store.ConversationOpStats() {
+			if stat.ChannelType == channelType {
+				return stat
+			}
+		}
+		return ConversationOpCounts{ChannelType: channelType}
+	}
+
+	// 新增
+	err := store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "u2", ChannelType: 1, LastMsgSeq: 1},
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, LastMsgSeq: 1},
+		{UID: "u1", ChannelID: "g2", ChannelType: 2, LastMsgSeq: 1},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, ConversationOpCounts{ChannelType: 1, Create: 1}, counts(1))
+	assert.Equal(t, ConversationOpCounts{ChannelType: 2, Create: 2}, counts(2))
+
+	// 更新已有的和新增的混合
+	err = store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, LastMsgSeq: 2, UnreadCount: 2},
+		{UID: "u1", ChannelID: "c1", ChannelType: 3, LastMsgSeq: 1, UnreadCount: 1},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, ConversationOpCounts{ChannelType: 2, Create: 2, Update: 1}, counts(2))
+	assert.Equal(t, ConversationOpCounts{ChannelType: 3, Create: 1}, counts(3))
+
+	// 按版本号写入
+	conversation, err := store.GetConversation("u1", "g2", 2)
+	assert.NoError(t, err)
+	_, err = store.AddOrUpdateConversationsCAS("u1", []ConversationCAS{
+		{Conversation: &Conversation{ChannelID: "g2", ChannelType: 2, LastMsgSeq: 2}, ExpectedVersion: conversation.Version},
+		{Conversation: &Conversation{ChannelID: "g3", ChannelType: 2, LastMsgSeq: 1}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, ConversationOpCounts{ChannelType: 2, Create: 3, Update: 2}, counts(2))
+	// 版本号冲突不计数
+	_, err = store.AddOrUpdateConversationsCAS("u1", []ConversationCAS{
+		{Conversation: &Conversation{ChannelID: "g2", ChannelType: 2, LastMsgSeq: 3}, ExpectedVersion: conversation.Version},
+	})
+	assert.ErrorIs(t, err, ErrVersionConflict)
+	assert.Equal(t, ConversationOpCounts{ChannelType: 2, Create: 3, Update: 2}, counts(2))
+
+	// 未读数
+	_, err = store.IncConversationUnreadCount("u1", "u2", 1, 1, false)
+	assert.NoError(t, err)
+	_, err = store.IncConversationUnreadCount("u1", "u3", 1, 1, true)
+	assert.NoError(t, err)
+	_, err = store.IncConversationUnreadCount("u1", "u4", 1, 1, false) // 不存在不创建，不计数
+	assert.NoError(t, err)
+	assert.Equal(t, ConversationOpCounts{ChannelType: 1, Create: 2, Update: 1}, counts(1))
+
+	// 已读，没有修改的（已经读到更后面）不计数
+	_, err = store.UpdateConversationsReadToMsgSeq("u1", []ConversationReadTo{
+		{ChannelID: "g1", ChannelType: 2, ReadToMsgSeq: 2},
+		{ChannelID: "g2", ChannelType: 2, ReadToMsgSeq: 0},
+		{ChannelID: "c1", ChannelType: 3, ReadToMsgSeq: 1},
+		{ChannelID: "c2", ChannelType: 3, ReadToMsgSeq: 1, CreateIfMissing: true},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), counts(2).ReadTo)
+	assert.Equal(t, int64(2), counts(3).ReadTo)
+
+	// 删除
+	assert.NoError(t, store.DeleteConversation("u1", "u2", 1))
+	assert.NoError(t, store.DeleteConversation("u1", "u9", 1)) // 不存在不计数
+	assert.Equal(t, int64(1), counts(1).Delete)
+
+	assert.NoError(t, store.AddSubscribers("g1", 2, []string{"u1"}))
+	count, err := store.DeleteConversationsByChannel("g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, ConversationOpCounts{ChannelType: 2, Create: 3, Update: 2, ReadTo: 1, Delete: 1}, counts(2))
+
+	assert.Equal(t, int64(2), counts(3).Get(ConversationOpReadTo))
+	assert.Equal(t, "read_to", ConversationOpReadTo.String())
+	assert.Equal(t, ConversationOpCounts{ChannelType: 4}, counts(4))
+}
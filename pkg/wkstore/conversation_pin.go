@@ -0,0 +1,57 @@
+package wkstore
+
+import (
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// SetConversationPinned 置顶或取消置顶用户的最近会话（置顶时间为当前时间，重复置顶不修改），返回修改后的最近会话，最近会话不存在返回ErrNotFound
+func (f *FileStore) SetConversationPinned(uid string, channelID string, channelType uint8, pinned bool) (*Conversation, error) {
+	defer f.trace("SetConversationPinned", uid, time.Now(), zap.String("channelID", channelID), zap.Uint8("channelType", channelType), zap.Bool("pinned", pinned))
+	conversation, err := f.setConversationPinned(uid, channelID, channelType, pinned)
+	return conversation, wrapError("SetConversationPinned", err, uid, channelID, channelType)
+}
+
+func (f *FileStore) setConversationPinned(uid string, channelID string, channelType uint8, pinned bool) (*Conversation, error) {
+	if uid == "" || !validConversationChannel(channelID, channelType) {
+		return nil, ErrInvalidConversation
+	}
+	key := f.getConversationKey(uid)
+	f.lock.Lock(key)
+	defer f.lock.Unlock(key)
+
+	var conversation *Conversation
+	err := f.update(func(t *bolt.Tx) error {
+		return f.updateConversationInTx(t, uid, channelID, channelType, func(conversations []*Conversation, idx int) []*Conversation {
+			conversation = conversations[idx]
+			if conversation.Pinned() == pinned {
+				return nil
+			}
+			conversation.PinnedAt = 0
+			if pinned {
+				conversation.PinnedAt = f.newConversationVersion()
+			}
+			conversation.Version = f.newConversationVersion()
+			return conversations
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if conversation == nil {
+		return nil, ErrNotFound
+	}
+	newConversation := *conversation
+	return &newConversation, nil
+}
+
+// carryPinnedAt 置顶状态只能通过SetConversationPinned修改，更新已有的最近会话时保留原来的置顶时间（缓存里的最近会话可能是置顶前读取的）
+func carryPinnedAt(merged *Conversation, stored *Conversation) bool {
+	if merged.PinnedAt == stored.PinnedAt {
+		return false
+	}
+	merged.PinnedAt = stored.PinnedAt
+	return true
+}
@@ -0,0 +1,93 @@
+package wkstore
+
+import (
+	"sort"
+
+	"go.uber.org/zap"
+)
+
+// ConversationQuotaPolicy 用户最近会话数量达到上限后的处理策略
+type ConversationQuotaPolicy int
+
+const (
+	// ConversationQuotaReject 拒绝新增最近会话，返回ErrOverQuota
+	ConversationQuotaReject ConversationQuotaPolicy = iota
+	// ConversationQuotaEvict 淘汰最久没有更新的最近会话后再新增
+	ConversationQuotaEvict
+)
+
+// ConversationEvictions 超过数量上限被淘汰的最近会话数量（进程启动后）
+func (f *FileStore) ConversationEvictions() int64 {
+	return f.conversationEvictions.Load()
+}
+
+// applyConversationQuota 检查用户的最近会话数量是否超过MaxConversationsPerUser，conversations[oldLen:]为本次新增的最近会话
+// 只更新已有的最近会话不受限制（比如调小了上限），豁免的频道类型不计数也不会被淘汰
+func (f *FileStore) applyConversationQuota(uid string, conversations []*Conversation, oldLen int, updates []*Conversation) ([]*Conversation, error) {
+	maxCount := f.cfg.MaxConversationsPerUser
+	if maxCount <= 0 {
+		return conversations, nil
+	}
+	added := 0
+	for _, conversation := range conversations[oldLen:] {
+		if !f.isConversationQuotaExempt(conversation.ChannelType) {
+			added++
+		}
+	}
+	if added == 0 {
+		return conversations, nil
+	}
+	count := 0
+	for _, conversation := range conversations {
+		if !f.isConversationQuotaExempt(conversation.ChannelType) {
+			count++
+		}
+	}
+	over := count - maxCount
+	if over <= 0 {
+		return conversations, nil
+	}
+	if f.cfg.ConversationQuotaPolicy != ConversationQuotaEvict {
+		return nil, ErrOverQuota
+	}
+
+	// 淘汰最久没有更新的（本次更新的不淘汰）
+	updated := make(map[ConversationKey]struct{}, len(updates))
+	for _, update := range updates {
+		updated[ConversationKey{ChannelID: update.ChannelID, ChannelType: update.ChannelType}] = struct{}{}
+	}
+	candidates := make([]*Conversation, 0, oldLen)
+	for _, conversation := range conversations[:oldLen] {
+		if f.isConversationQuotaExempt(conversation.ChannelType) {
+			continue
+		}
+		if _, ok := updated[ConversationKey{ChannelID: conversation.ChannelID, ChannelType: conversation.ChannelType}]; ok {
+			continue
+		}
+		candidates = append(candidates, conversation)
+	}
+	if len(candidates) < over { // 本次新增的太多，淘汰已有的也放不下
+		return nil, ErrOverQuota
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Version != candidates[j].Version {
+			return candidates[i].Version < candidates[j].Version
+		}
+		return candidates[i].Timestamp < candidates[j].Timestamp
+	})
+	for _, evict := range candidates[:over] {
+		conversations = removeConversation(conversations, evict.ChannelID, evict.ChannelType)
+		f.conversationEvictions.Inc()
+		f.Warn("conversation over quota, evict", zap.String("uid", uid), zap.String("channelID", evict.ChannelID), zap.Uint8("channelType", evict.ChannelType), zap.Int("maxCount", maxCount))
+	}
+	return conversations, nil
+}
+
+func (f *FileStore) isConversationQuotaExempt(channelType uint8) bool {
+	for _, exempt := range f.cfg.ConversationQuotaExemptChannelTypes {
+		if exempt == channelType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package wkstore
+
+import (
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// ConversationUnreadCorrection 重新计算后修正了未读数的最近会话
+type ConversationUnreadCorrection struct {
+	ChannelID   string `json:"channel_id"`
+	ChannelType uint8  `json:"channel_type"`
+	LastMsgSeq  uint32 `json:"last_msg_seq"` // 频道最新的messageSeq（resolver返回的）
+	OldUnread   int    `json:"old_unread"`
+	NewUnread   int    `json:"new_unread"`
+}
+
+// ConversationUnreadReport 重新计算用户未读数的结果
+type ConversationUnreadReport struct {
+	Scanned   int                             `json:"scanned"`   // 检查的最近会话数量
+	Corrected []*ConversationUnreadCorrection `json:"corrected"` // 修正了未读数的最近会话
+	Failed    []ConversationKey               `json:"failed"`    // resolver返回错误没有检查的最近会话
+}
+
+// ReadPosition 按未读数算出的已读位置（LastMsgSeq-UnreadCount），未读数超出范围时取边界
+func (c *Conversation) ReadPosition() uint32 {
+	if c.UnreadCount <= 0 {
+		return c.LastMsgSeq
+	}
+	if uint32(c.UnreadCount) >= c.LastMsgSeq {
+		return 0
+	}
+	return c.LastMsgSeq - uint32(c.UnreadCount)
+}
+
+// recalculateUnread 按已读位置和频道最新的messageSeq重新计算的未读数
+// 存储里没有单独的已读位置，已读位置由LastMsgSeq-UnreadCount得出；LastMsgSeq之后的消息最近会话还没有处理（可能还在队列里），不计入未读
+// 频道最新的messageSeq比LastMsgSeq小时（消息已经删除或过期），不存在的消息不计入未读
+func (c *Conversation) recalculateUnread(lastMsgSeq uint32) int {
+	readTo := c.ReadPosition()
+	if lastMsgSeq > c.LastMsgSeq {
+		lastMsgSeq = c.LastMsgSeq
+	}
+	if lastMsgSeq <= readTo {
+		return 0
+	}
+	return int(lastMsgSeq - readTo)
+}
+
+// RecalculateConversationUnread 按已读位置和频道最新的messageSeq（resolver返回）重新计算用户所有最近会话的未读数（不小于0），在一个事务里只写入有变化的
+// resolver在写事务外调用（可能需要查询消息存储），返回错误的最近会话不修改，记录在结果的Failed里；返回修正的最近会话，方便运维核对
+func (f *FileStore) RecalculateConversationUnread(uid string, resolver func(channelID string, channelType uint8) (uint32, error)) (*ConversationUnreadReport, error) {
+	defer f.trace("RecalculateConversationUnread", uid, time.Now())
+	report, err := f.recalculateConversationUnread(uid, resolver)
+	return report, wrapError("RecalculateConversationUnread", err, uid, "", 0)
+}
+
+func (f *FileStore) recalculateConversationUnread(uid string, resolver func(channelID string, channelType uint8) (uint32, error)) (*ConversationUnreadReport, error) {
+	if uid == "" {
+		return nil, ErrInvalidConversation
+	}
+	conversations, err := f.getConversations(uid)
+	if err != nil {
+		return nil, err
+	}
+	report := &ConversationUnreadReport{}
+	lastMsgSeqs := make(map[ConversationKey]uint32, len(conversations))
+	for _, conversation := range conversations {
+		channelKey := ConversationKey{ChannelID: conversation.ChannelID, ChannelType: conversation.ChannelType}
+		lastMsgSeq, err := resolver(conversation.ChannelID, conversation.ChannelType)
+		if err != nil {
+			f.Warn("resolve last msg seq fail", zap.String("uid", uid), zap.String("channelID", conversation.ChannelID), zap.Uint8("channelType", conversation.ChannelType), zap.Error(err))
+			report.Failed = append(report.Failed, ConversationKey{UID: uid, ChannelID: conversation.ChannelID, ChannelType: conversation.ChannelType})
+			continue
+		}
+		lastMsgSeqs[channelKey] = lastMsgSeq
+	}
+
+	key := f.getConversationKey(uid)
+	f.lock.Lock(key)
+	defer f.lock.Unlock(key)
+	var corrected []*ConversationUnreadCorrection
+	err = f.update(func(t *bolt.Tx) error {
+		corrected = nil
+		bucket, err := f.getSlotBucketWithKey(uid, t)
+		if err != nil {
+			return err
+		}
+		value := bucket.Get([]byte(key))
+		if len(value) == 0 {
+			return nil
+		}
+		conversations, err := decodeConversations(value, false)
+		if err != nil {
+			return err
+		}
+		old := snapshotConversations(conversations)
+		version := f.newConversationVersion()
+		for _, conversation := range conversations {
+			lastMsgSeq, ok := lastMsgSeqs[ConversationKey{ChannelID: conversation.ChannelID, ChannelType: conversation.ChannelType}]
+			if !ok { // resolver失败或者读取后新增的
+				continue
+			}
+			unread := conversation.recalculateUnread(lastMsgSeq)
+			if unread == conversation.UnreadCount {
+				continue
+			}
+			corrected = append(corrected, &ConversationUnreadCorrection{
+				ChannelID:   conversation.ChannelID,
+				ChannelType: conversation.ChannelType,
+				LastMsgSeq:  lastMsgSeq,
+				OldUnread:   conversation.UnreadCount,
+				NewUnread:   unread,
+			})
+			conversation.UnreadCount = unread
+			conversation.Version = version
+		}
+		if len(corrected) == 0 {
+			return nil
+		}
+		f.keepConversationVersionsMonotonic(old, conversations)
+		return f.putUserConversationsInTx(bucket, uid, f.encodeConversations(conversations))
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.Scanned = len(lastMsgSeqs)
+	report.Corrected = corrected
+	for _, correction := range corrected {
+		f.conversationOps.add(ConversationOpUpdate, correction.ChannelType, 1)
+	}
+	return report, nil
+}
@@ -0,0 +1,99 @@
+package wkstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// conversationRecalledMaxCount 每个频道最多保留的已撤回消息的messageSeq，超过后删除最小的
+// 更早的消息一般已经不在未读范围内，重复撤回也不会再修改未读数
+const conversationRecalledMaxCount = 1000
+
+// onMessageRecalled 同一个messageSeq只修正一次（撤回重试时不会重复减少未读数），已经撤回过时返回nil
+// 撤回记录和第一批最近会话在同一个事务里提交，订阅者分多批时后面的批次失败，重试会跳过已经提交的修改
+func (f *FileStore) onMessageRecalled(channelID string, channelType uint8, messageSeq uint32) ([]ConversationKey, error) {
+	recalledKey := f.getConversationRecalledKey(channelID, channelType)
+	f.lock.Lock(recalledKey)
+	defer f.lock.Unlock(recalledKey)
+
+	slotNum := f.slotNumForChannel(channelID, channelType)
+	var recalled bool
+	err := f.view(func(t *bolt.Tx) error {
+		bucket, err := f.getSlotBucket(slotNum, t)
+		if err != nil {
+			return err
+		}
+		seqs, err := f.getConversationRecalledInTx(bucket, recalledKey)
+		if err != nil {
+			return err
+		}
+		recalled = containsMessageSeq(seqs, messageSeq)
+		return nil
+	})
+	if err != nil || recalled {
+		return nil, err
+	}
+	marked := false
+	keys, _, err := f.forEachChannelConversation(channelID, channelType, "OnMessageRecalled", MaintenanceOptions{}, func(uid string, conversations []*Conversation, idx int) ([]*Conversation, bool, error) {
+		return conversations, conversations[idx].Recall(messageSeq), nil
+	}, func(t *bolt.Tx, keys []ConversationKey, changed []ConversationKey) error {
+		if marked {
+			return nil
+		}
+		marked = true
+		return f.putConversationRecalledInTx(t, slotNum, recalledKey, messageSeq)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (f *FileStore) getConversationRecalledKey(channelID string, channelType uint8) string {
+	return fmt.Sprintf("%s%s-%d", conversationRecalledPrefix, channelID, channelType)
+}
+
+// getConversationRecalledInTx 频道已撤回消息的messageSeq，从小到大
+func (f *FileStore) getConversationRecalledInTx(bucket *bolt.Bucket, recalledKey string) ([]uint32, error) {
+	value := bucket.Get([]byte(recalledKey))
+	if len(value) == 0 {
+		return nil, nil
+	}
+	var seqs []uint32
+	if err := json.Unmarshal(value, &seqs); err != nil {
+		return nil, err
+	}
+	return seqs, nil
+}
+
+func (f *FileStore) putConversationRecalledInTx(t *bolt.Tx, slotNum uint32, recalledKey string, messageSeq uint32) error {
+	bucket, err := f.getSlotBucket(slotNum, t)
+	if err != nil {
+		return err
+	}
+	seqs, err := f.getConversationRecalledInTx(bucket, recalledKey)
+	if err != nil {
+		return err
+	}
+	if containsMessageSeq(seqs, messageSeq) {
+		return nil
+	}
+	seqs = append(seqs, messageSeq)
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	if len(seqs) > conversationRecalledMaxCount {
+		seqs = seqs[len(seqs)-conversationRecalledMaxCount:]
+	}
+	value, err := json.Marshal(seqs)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(recalledKey), value)
+}
+
+func containsMessageSeq(seqs []uint32, messageSeq uint32) bool {
+	i := sort.Search(len(seqs), func(i int) bool { return seqs[i] >= messageSeq })
+	return i < len(seqs) && seqs[i] == messageSeq
+}
@@ -0,0 +1,255 @@
+package wkstore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	wkproto "github.com/WuKongIM/WuKongIMGoProto"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// ReservedChannelType 保留的频道类型，不是合法的频道类型
+// 写入最近会话时频道类型为0返回ErrInvalidConversation；查询条件（比如ConversationSearchReq）里频道类型为0表示不按频道类型过滤
+const ReservedChannelType uint8 = 0
+
+// reservedTypeCandidates 推断频道类型为0的最近会话的真实频道类型时，在频道信息表里查找的频道类型
+var reservedTypeCandidates = []uint8{
+	wkproto.ChannelTypePerson,
+	wkproto.ChannelTypeGroup,
+	wkproto.ChannelTypeCustomerService,
+	wkproto.ChannelTypeCommunity,
+	wkproto.ChannelTypeCommunityTopic,
+	wkproto.ChannelTypeInfo,
+	wkproto.ChannelTypeData,
+}
+
+// 频道类型为0的最近会话被隔离的原因
+const (
+	ReservedTypeNoChannel  = "no_channel" // 频道信息表里没有这个频道
+	ReservedTypeAmbiguous  = "ambiguous"  // 频道信息表里有多个频道类型的这个频道
+	ReservedTypeDuplicated = "duplicated" // 用户已经有推断出的频道类型的最近会话
+)
+
+// validConversationChannel 最近会话的频道是否合法（频道id不为空，频道类型不是保留的类型）
+func validConversationChannel(channelID string, channelType uint8) bool {
+	return channelID != "" && channelType != ReservedChannelType
+}
+
+// ReservedTypeConversation 一条频道类型为0的最近会话的处理结果
+type ReservedTypeConversation struct {
+	UID         string `json:"uid"`
+	ChannelID   string `json:"channel_id"`
+	ChannelType uint8  `json:"channel_type"`     // 推断出的频道类型，隔离的为0
+	Reason      string `json:"reason,omitempty"` // 隔离的原因
+}
+
+// ReservedTypeReport 修复频道类型为0的最近会话的结果
+type ReservedTypeReport struct {
+	DryRun      bool                        `json:"dry_run"`
+	Fixed       []*ReservedTypeConversation `json:"fixed"`       // 从频道信息表推断出频道类型并修正的最近会话
+	Quarantined []*ReservedTypeConversation `json:"quarantined"` // 推断不出频道类型，移到隔离区的最近会话
+}
+
+// RepairReservedTypeConversations 查找频道类型为0的最近会话（写入校验之前误写入的，正常查询查不到），按频道信息表推断频道类型
+// 只能推断出一个频道类型的修正为此类型（更新版本号），推断不出或者用户已经有此类型的最近会话的移到隔离区（ListQuarantinedConversations）
+// 扫描分批进行，可通过ctx取消，opts.DryRun为true时只返回会修正和隔离的最近会话
+func (f *FileStore) RepairReservedTypeConversations(ctx context.Context, opts MaintenanceOptions) (*ReservedTypeReport, error) {
+	defer f.trace("RepairReservedTypeConversations", "", time.Now(), zap.Bool("dryRun", opts.DryRun))
+	report, err := f.repairReservedTypeConversations(ctx, opts)
+	return report, wrapError("RepairReservedTypeConversations", err, "", "", 0)
+}
+
+func (f *FileStore) repairReservedTypeConversations(ctx context.Context, opts MaintenanceOptions) (*ReservedTypeReport, error) {
+	prefix := []byte(f.conversationPrefix)
+	uids := make([]string, 0)
+	channelIDs := make(map[string]struct{})
+	err := f.scan(ctx, prefix, func(key, value []byte) error {
+		conversations, err := decodeConversations(value, true)
+		if err != nil {
+			f.Warn("decode conversations fail", zap.Error(err), zap.ByteString("key", key))
+			return nil
+		}
+		found := false
+		for _, conversation := range conversations {
+			if conversation.ChannelType == ReservedChannelType {
+				channelIDs[conversation.ChannelID] = struct{}{}
+				found = true
+			}
+		}
+		if found {
+			uids = append(uids, string(key[len(prefix):]))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// 在写事务外查询频道信息表
+	inferred := make(map[string]*ReservedTypeConversation, len(channelIDs))
+	for channelID := range channelIDs {
+		if inferred[channelID], err = f.inferChannelType(channelID); err != nil {
+			return nil, err
+		}
+	}
+
+	report := &ReservedTypeReport{DryRun: opts.DryRun}
+	m := newMaintenance("RepairReservedTypeConversations", opts, len(uids))
+	batchSize := m.batchSize(f.cfg)
+	for start := 0; start < len(uids); start += batchSize {
+		if err = ctx.Err(); err != nil {
+			return report, err
+		}
+		end := start + batchSize
+		if end > len(uids) {
+			end = len(uids)
+		}
+		changed := 0
+		for _, uid := range uids[start:end] {
+			fixed, quarantined, err := f.repairUserReservedType(uid, inferred, opts.DryRun)
+			if err != nil {
+				return report, err
+			}
+			report.Fixed = append(report.Fixed, fixed...)
+			report.Quarantined = append(report.Quarantined, quarantined...)
+			changed += len(fixed) + len(quarantined)
+		}
+		if err = m.advance(ctx, end-start, changed); err != nil {
+			return report, err
+		}
+	}
+	m.done()
+	if len(report.Fixed) > 0 || len(report.Quarantined) > 0 {
+		f.Info("repair reserved type conversations", zap.Bool("dryRun", opts.DryRun), zap.Int("fixed", len(report.Fixed)), zap.Int("quarantined", len(report.Quarantined)))
+	}
+	return report, nil
+}
+
+// inferChannelType 在频道信息表里查找这个频道id的频道类型，只有一个频道类型时返回此类型，否则返回不能推断的原因
+func (f *FileStore) inferChannelType(channelID string) (*ReservedTypeConversation, error) {
+	result := &ReservedTypeConversation{ChannelID: channelID, Reason: ReservedTypeNoChannel}
+	for _, candidate := range reservedTypeCandidates {
+		exist, err := f.ExistChannel(channelID, candidate)
+		if err != nil {
+			return nil, err
+		}
+		if !exist {
+			continue
+		}
+		if result.ChannelType != ReservedChannelType { // 有多个频道类型，不能确定是哪一个
+			return &ReservedTypeConversation{ChannelID: channelID, Reason: ReservedTypeAmbiguous}, nil
+		}
+		result.ChannelType = candidate
+		result.Reason = ""
+	}
+	return result, nil
+}
+
+// repairUserReservedType 在一个写事务里修正或隔离用户频道类型为0的最近会话（扫描后可能有更新，重新判断）
+func (f *FileStore) repairUserReservedType(uid string, inferred map[string]*ReservedTypeConversation, dryRun bool) (fixed, quarantined []*ReservedTypeConversation, err error) {
+	key := f.getConversationKey(uid)
+	f.lock.Lock(key)
+	defer f.lock.Unlock(key)
+	tx := f.update
+	if dryRun {
+		tx = f.view
+	}
+	err = tx(func(t *bolt.Tx) error {
+		fixed, quarantined = nil, nil
+		bucket, err := f.getSlotBucketWithKey(uid, t)
+		if err != nil {
+			return err
+		}
+		value := bucket.Get([]byte(key))
+		if len(value) == 0 {
+			return nil
+		}
+		conversations, err := decodeConversations(value, false)
+		if err != nil {
+			return err
+		}
+		exist := make(map[ConversationKey]bool, len(conversations))
+		for _, conversation := range conversations {
+			exist[ConversationKey{ChannelID: conversation.ChannelID, ChannelType: conversation.ChannelType}] = true
+		}
+		kept := make([]*Conversation, 0, len(conversations))
+		var isolated []*Conversation
+		version := f.newConversationVersion()
+		for _, conversation := range conversations {
+			if conversation.ChannelType != ReservedChannelType {
+				kept = append(kept, conversation)
+				continue
+			}
+			result := &ReservedTypeConversation{UID: uid, ChannelID: conversation.ChannelID, Reason: ReservedTypeNoChannel}
+			if inference := inferred[conversation.ChannelID]; inference != nil { // 扫描后新写入的没有推断
+				result.Reason = inference.Reason
+				channelType := inference.ChannelType
+				if result.Reason == "" && exist[ConversationKey{ChannelID: conversation.ChannelID, ChannelType: channelType}] {
+					result.Reason = ReservedTypeDuplicated
+				}
+			}
+			if result.Reason != "" {
+				quarantined = append(quarantined, result)
+				isolated = append(isolated, conversation)
+				continue
+			}
+			channelType := inferred[conversation.ChannelID].ChannelType
+			result.ChannelType = channelType
+			fixed = append(fixed, result)
+			exist[ConversationKey{ChannelID: conversation.ChannelID, ChannelType: channelType}] = true
+			conversation.ChannelType = channelType
+			conversation.Version = version
+			kept = append(kept, conversation)
+		}
+		if dryRun || (len(fixed) == 0 && len(quarantined) == 0) {
+			return nil
+		}
+		if len(isolated) > 0 {
+			if err = f.quarantineConversationsInTx(bucket, uid, isolated); err != nil {
+				return err
+			}
+		}
+		var newValue []byte
+		if len(kept) > 0 {
+			newValue = f.encodeConversations(kept)
+		}
+		return f.putUserConversationsInTx(bucket, uid, newValue)
+	})
+	return fixed, quarantined, err
+}
+
+// quarantineConversationsInTx 把最近会话追加到用户的隔离区
+func (f *FileStore) quarantineConversationsInTx(bucket *bolt.Bucket, uid string, conversations []*Conversation) error {
+	key := f.getConversationQuarantineKey(uid)
+	var existing []*Conversation
+	if value := bucket.Get(key); len(value) > 0 {
+		var err error
+		if existing, err = decodeConversations(value, false); err != nil {
+			return err
+		}
+	}
+	return bucket.Put(key, f.encodeConversations(append(existing, conversations...)))
+}
+
+// ListQuarantinedConversations 用户被隔离的频道类型为0的最近会话（RepairReservedTypeConversations推断不出频道类型的）
+func (f *FileStore) ListQuarantinedConversations(uid string) ([]*Conversation, error) {
+	var conversations []*Conversation
+	err := f.view(func(t *bolt.Tx) error {
+		bucket, err := f.getSlotBucketWithKey(uid, t)
+		if err != nil {
+			return err
+		}
+		value := bucket.Get(f.getConversationQuarantineKey(uid))
+		if len(value) == 0 {
+			return nil
+		}
+		conversations, err = decodeConversations(value, false)
+		return err
+	})
+	return conversations, wrapError("ListQuarantinedConversations", err, uid, "", 0)
+}
+
+func (f *FileStore) getConversationQuarantineKey(uid string) []byte {
+	return []byte(fmt.Sprintf("%s%s", conversationQuarantinePrefix, uid))
+}
@@ -0,0 +1,125 @@
+package wkstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestConversationReservedTypeValidation(t *testing.T) {
+	store := newTestFileStore(t)
+
+	err := store.AddOrUpdateConversations("u1", []*Conversation{{UID: "u1", ChannelID: "g1", ChannelType: ReservedChannelType}})
+	assert.ErrorIs(t, err, ErrInvalidConversation)
+	_, err = store.AddOrUpdateConversationsBatchIfNotExist([]*Conversation{{UID: "u1", ChannelID: "g1"}})
+	assert.ErrorIs(t, err, ErrInvalidConversation)
+	_, err = store.IncConversationUnreadCount("u1", "g1", ReservedChannelType, 1, true)
+	assert.ErrorIs(t, err, ErrInvalidConversation)
+	_, err = store.SetConversationPinned("u1", "g1", ReservedChannelType, true)
+	assert.ErrorIs(t, err, ErrInvalidConversation)
+	_, err = store.UpdateConversationsReadToMsgSeq("u1", []ConversationReadTo{{ChannelID: "g1", ReadToMsgSeq: 1}})
+	assert.ErrorIs(t, err, ErrInvalidConversation)
+
+	conversations, err := store.GetConversations("u1")
+	assert.NoError(t, err)
+	assert.Empty(t, conversations)
+
+	// 查询条件里0表示不按频道类型过滤
+	err = store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2},
+		{UID: "u1", ChannelID: "u2", ChannelType: 1},
+	})
+	assert.NoError(t, err)
+	result, err := store.SearchConversations(context.Background(), ConversationSearchReq{UID: "u1", ChannelType: ReservedChannelType})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, result.Total)
+}
+
+func TestRepairReservedTypeConversations(t *testing.T) {
+	store := newTestFileStore(t)
+
+	assert.NoError(t, store.AddOrUpdateChannel(&ChannelInfo{ChannelID: "g1", ChannelType: 2}))
+	assert.NoError(t, store.AddOrUpdateChannel(&ChannelInfo{ChannelID: "c1", ChannelType: 2}))
+	assert.NoError(t, store.AddOrUpdateChannel(&ChannelInfo{ChannelID: "c1", ChannelType: 4}))
+	putRawConversations(t, store, "u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 0, Version: 1}, // 只有群频道，修正为群频道
+		{UID: "u1", ChannelID: "x1", ChannelType: 0, Version: 1}, // 频道信息表里没有
+		{UID: "u1", ChannelID: "c1", ChannelType: 0, Version: 1}, // 有多个频道类型
+		{UID: "u1", ChannelID: "u2", ChannelType: 1, Version: 1},
+	})
+	putRawConversations(t, store, "u2", []*Conversation{
+		{UID: "u2", ChannelID: "g1", ChannelType: 2, Version: 1},
+		{UID: "u2", ChannelID: "g1", ChannelType: 0, Version: 1}, // 已经有群频道的最近会话
+	})
+
+	// DryRun不修改
+	report, err := store.RepairReservedTypeConversations(context.Background(), MaintenanceOptions{DryRun: true})
+	assert.NoError(t, err)
+	assert.True(t, report.DryRun)
+	assert.Len(t, report.Fixed, 1)
+	assert.Len(t, report.Quarantined, 3)
+	exist, err := store.ExistConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.False(t, exist)
+
+	report, err = store.RepairReservedTypeConversations(context.Background(), MaintenanceOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []*ReservedTypeConversation{{UID: "u1", ChannelID: "g1", ChannelType: 2}}, report.Fixed)
+	reasons := make(map[string]string)
+	for _, quarantined := range report.Quarantined {
+		reasons[quarantined.UID+"/"+quarantined.ChannelID] = quarantined.Reason
+	}
+	assert.Equal(t, map[string]string{
+		"u1/x1": ReservedTypeNoChannel,
+		"u1/c1": ReservedTypeAmbiguous,
+		"u2/g1": ReservedTypeDuplicated,
+	}, reasons)
+
+	// 修正的可以正常查询，版本号已更新
+	conversation, err := store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.NotNil(t, conversation)
+	assert.Greater(t, conversation.Version, int64(1))
+	conversations, err := store.GetConversations("u1")
+	assert.NoError(t, err)
+	assert.Len(t, conversations, 2)
+
+	// 推断不出的移到了隔离区
+	quarantined, err := store.ListQuarantinedConversations("u1")
+	assert.NoError(t, err)
+	assert.Len(t, quarantined, 2)
+	quarantined, err = store.ListQuarantinedConversations("u2")
+	assert.NoError(t, err)
+	assert.Len(t, quarantined, 1)
+	conversations, err = store.GetConversations("u2")
+	assert.NoError(t, err)
+	assert.Len(t, conversations, 1)
+	assert.Equal(t, uint8(2), conversations[0].ChannelType)
+
+	// 再次执行没有需要修复的
+	report, err = store.RepairReservedTypeConversations(context.Background(), MaintenanceOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, report.Fixed)
+	assert.Empty(t, report.Quarantined)
+
+	// 删除用户时一起删除隔离区
+	_, err = store.DeleteUserData("u1", MaintenanceOptions{})
+	assert.NoError(t, err)
+	quarantined, err = store.ListQuarantinedConversations("u1")
+	assert.NoError(t, err)
+	assert.Empty(t, quarantined)
+}
+
+// putRawConversations 不经过校验直接写入用户的最近会话（模拟校验之前写入的数据）
+func putRawConversations(t *testing.T, store *FileStore, uid string, conversations []*Conversation) {
+	err := store.update(func(tx *bolt.Tx) error {
+		bucket, err := store.getSlotBucketWithKey(uid, tx)
+		if err != nil {
+			return err
+		}
+		return store.putUserConversationsInTx(bucket, uid, store.encodeConversations(conversations))
+	})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,219 @@
+package wkstore
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ConversationSearchReq 后台搜索最近会话的条件，零值的条件不过滤
+type ConversationSearchReq struct {
+	UID           string `json:"uid"`            // 只搜索此用户的最近会话
+	ChannelID     string `json:"channel_id"`     // 频道ID
+	ChannelType   uint8  `json:"channel_type"`   // 频道类型，0（ReservedChannelType）表示不按频道类型过滤
+	UpdatedAfter  int64  `json:"updated_after"`  // 最后一次会话时间（10位时间戳）不小于此值
+	UpdatedBefore int64  `json:"updated_before"` // 最后一次会话时间（10位时间戳）小于此值
+	UnreadOnly    bool   `json:"unread_only"`    // 只返回有未读的最近会话
+	Limit         int    `json:"limit"`          // 每页数量，<=0表示20
+	CurrentPage   int    `json:"current_page"`   // 页码，从1开始，Cursor不为空时忽略
+	// Cursor 上一页返回的游标，不为空时从游标的位置继续搜索（找到下一页就停止扫描，不计算Total），翻页期间有修改也不会重复或跳过没修改的最近会话
+	Cursor string `json:"cursor"`
+}
+
+// ConversationSearchResult 后台搜索最近会话的结果
+type ConversationSearchResult struct {
+	Conversations []*Conversation // 当前页的最近会话
+	Total         int             // 符合条件的最近会话总数，按游标搜索时为0
+	NextCursor    string          // 下一页的游标，没有更多了为空
+	HasMore       bool            // 是否还有下一页
+}
+
+func (req ConversationSearchReq) match(conversation *Conversation) bool {
+	if req.ChannelID != "" && conversation.ChannelID != req.ChannelID {
+		return false
+	}
+	if req.ChannelType != 0 && conversation.ChannelType != req.ChannelType {
+		return false
+	}
+	if req.UpdatedAfter > 0 && conversation.Timestamp < req.UpdatedAfter {
+		return false
+	}
+	if req.UpdatedBefore > 0 && conversation.Timestamp >= req.UpdatedBefore {
+		return false
+	}
+	if req.UnreadOnly && conversation.UnreadCount <= 0 {
+		return false
+	}
+	return true
+}
+
+// conversationSearchCursor 上一页最后一条最近会话的位置，搜索按slot，用户的key，频道类型，频道id的顺序
+type conversationSearchCursor struct {
+	Slot        uint32 `json:"s"`
+	UID         string `json:"u"`
+	ChannelType uint8  `json:"ct"`
+	ChannelID   string `json:"c"`
+}
+
+func newConversationSearchCursor(slot uint32, conversation *Conversation) conversationSearchCursor {
+	return conversationSearchCursor{
+		Slot:        slot,
+		UID:         conversation.UID,
+		ChannelType: conversation.ChannelType,
+		ChannelID:   conversation.ChannelID,
+	}
+}
+
+func (c conversationSearchCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeConversationSearchCursor(cursor string) (conversationSearchCursor, error) {
+	var c conversationSearchCursor
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if err = json.Unmarshal(data, &c); err != nil || c.UID == "" || c.ChannelID == "" {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// before 是否排在o前面
+func (c conversationSearchCursor) before(o conversationSearchCursor) bool {
+	if c.Slot != o.Slot {
+		return c.Slot < o.Slot
+	}
+	if c.UID != o.UID {
+		return c.UID < o.UID
+	}
+	if c.ChannelType != o.ChannelType {
+		return c.ChannelType < o.ChannelType
+	}
+	return c.ChannelID < o.ChannelID
+}
+
+// conversationSearchPage 按过滤后的结果分页，只保留当前页的最近会话
+type conversationSearchPage struct {
+	req       ConversationSearchReq
+	offset    int
+	after     *conversationSearchCursor // 按游标搜索时上一页的位置
+	last      conversationSearchCursor  // 当前页最后一条的位置
+	collected int                       // 按游标搜索时已经找到的数量
+	result    *ConversationSearchResult
+}
+
+func newConversationSearchPage(req ConversationSearchReq) (*conversationSearchPage, error) {
+	if req.Limit <= 0 {
+		req.Limit = 20
+	}
+	if req.CurrentPage <= 0 {
+		req.CurrentPage = 1
+	}
+	p := &conversationSearchPage{
+		req:    req,
+		result: &ConversationSearchResult{Conversations: make([]*Conversation, 0, req.Limit)},
+	}
+	if req.Cursor != "" {
+		after, err := decodeConversationSearchCursor(req.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		p.after = &after
+	} else {
+		p.offset = (req.CurrentPage - 1) * req.Limit
+	}
+	return p, nil
+}
+
+// add 添加一个用户的最近会话，按游标搜索时找到下一页的第一条后返回errStopScan
+func (p *conversationSearchPage) add(slot uint32, conversations []*Conversation) error {
+	sort.Slice(conversations, func(i, j int) bool {
+		return newConversationSearchCursor(slot, conversations[i]).before(newConversationSearchCursor(slot, conversations[j]))
+	})
+	for _, conversation := range conversations {
+		if !p.req.match(conversation) {
+			continue
+		}
+		position := newConversationSearchCursor(slot, conversation)
+		if p.after != nil {
+			if !p.after.before(position) {
+				continue
+			}
+			if p.collected >= p.req.Limit {
+				p.result.HasMore = true
+				return errStopScan
+			}
+			p.collected++
+		} else {
+			p.result.Total++
+			if p.result.Total <= p.offset {
+				continue
+			}
+			if len(p.result.Conversations) >= p.req.Limit {
+				p.result.HasMore = true
+				continue
+			}
+		}
+		p.result.Conversations = append(p.result.Conversations, conversation)
+		p.last = position
+	}
+	return nil
+}
+
+func (p *conversationSearchPage) done() *ConversationSearchResult {
+	if p.result.HasMore && len(p.result.Conversations) > 0 {
+		p.result.NextCursor = p.last.encode()
+	}
+	return p.result
+}
+
+// SearchConversations 按条件搜索最近会话（后台管理用），没有指定uid时扫描所有用户的最近会话，ctx取消后停止扫描
+// 先过滤再分页；按slot，用户和频道的固定顺序返回，CurrentPage按全局的顺序计算偏移，按游标翻页更稳定
+func (f *FileStore) SearchConversations(ctx context.Context, req ConversationSearchReq) (*ConversationSearchResult, error) {
+	defer f.trace("SearchConversations", req.UID, time.Now(), zap.String("channelID", req.ChannelID), zap.Uint8("channelType", req.ChannelType))
+	result, err := f.searchConversations(ctx, req)
+	return result, wrapError("SearchConversations", err, req.UID, req.ChannelID, req.ChannelType)
+}
+
+func (f *FileStore) searchConversations(ctx context.Context, req ConversationSearchReq) (*ConversationSearchResult, error) {
+	page, err := newConversationSearchPage(req)
+	if err != nil {
+		return nil, err
+	}
+	if req.UID != "" {
+		conversations, err := f.getConversations(req.UID)
+		if err != nil {
+			return nil, err
+		}
+		_ = page.add(f.slotNum(req.UID), conversations)
+		return page.done(), nil
+	}
+	prefix := []byte(f.conversationPrefix)
+	var (
+		startSlot uint32
+		startKey  []byte
+	)
+	if page.after != nil { // 从上一页最后一个用户继续，这个用户剩下的最近会话还没返回
+		startSlot = page.after.Slot
+		startKey = []byte(f.getConversationKey(page.after.UID))
+	}
+	err = f.scanFrom(ctx, prefix, startSlot, startKey, func(slot uint32, key, value []byte) error {
+		conversations, err := decodeConversations(value, false)
+		if err != nil {
+			f.Warn("decode conversations fail", zap.Error(err), zap.ByteString("key", key))
+			return nil
+		}
+		return page.add(slot, conversations)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page.done(), nil
+}
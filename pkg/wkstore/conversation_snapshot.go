@@ -0,0 +1,191 @@
+package wkstore
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// ConversationSnapshot 用户最近会话的快照
+type ConversationSnapshot struct {
+	ID        string    `json:"id"`         // 快照id
+	UID       string    `json:"uid"`        // 用户uid
+	CreatedAt time.Time `json:"created_at"` // 快照时间
+	Count     int       `json:"count"`      // 快照里的最近会话数量
+	Size      int       `json:"size"`       // 快照数据大小
+}
+
+// SnapshotUserConversations 把用户当前的最近会话原样复制一份快照，返回快照id，超过ConversationSnapshotMaxCount时删除最旧的快照
+func (f *FileStore) SnapshotUserConversations(uid string) (string, error) {
+	defer f.trace("SnapshotUserConversations", uid, time.Now())
+	snapshotID, err := f.snapshotUserConversations(uid)
+	return snapshotID, wrapError("SnapshotUserConversations", err, uid, "", 0)
+}
+
+func (f *FileStore) snapshotUserConversations(uid string) (string, error) {
+	if uid == "" {
+		return "", ErrInvalidConversation
+	}
+	var snapshotID string
+	err := f.update(func(t *bolt.Tx) error {
+		bucket, err := f.getSlotBucketWithKey(uid, t)
+		if err != nil {
+			return err
+		}
+		value := bucket.Get([]byte(f.getConversationKey(uid)))
+		nano := time.Now().UnixNano()
+		for {
+			snapshotID = formatConversationSnapshotID(nano)
+			if bucket.Get(f.getConversationSnapshotKey(uid, snapshotID)) == nil {
+				break
+			}
+			nano++
+		}
+		// 用户没有最近会话时保存空数据，恢复时删除最近会话
+		if err = bucket.Put(f.getConversationSnapshotKey(uid, snapshotID), append(make([]byte, 0, len(value)), value...)); err != nil {
+			return err
+		}
+		return f.evictConversationSnapshots(uid, bucket)
+	})
+	return snapshotID, err
+}
+
+// evictConversationSnapshots 删除超过数量上限的最旧快照
+func (f *FileStore) evictConversationSnapshots(uid string, bucket *bolt.Bucket) error {
+	maxCount := f.cfg.ConversationSnapshotMaxCount
+	if maxCount <= 0 {
+		return nil
+	}
+	ids := f.conversationSnapshotIDs(uid, bucket)
+	if len(ids) <= maxCount {
+		return nil
+	}
+	for _, id := range ids[:len(ids)-maxCount] {
+		if err := bucket.Delete(f.getConversationSnapshotKey(uid, id)); err != nil {
+			return err
+		}
+		f.Info("evict conversation snapshot", zap.String("uid", uid), zap.String("snapshotID", id))
+	}
+	return nil
+}
+
+// ListUserConversationSnapshots 用户的最近会话快照，按时间从新到旧
+func (f *FileStore) ListUserConversationSnapshots(uid string) ([]*ConversationSnapshot, error) {
+	snapshots, err := f.listUserConversationSnapshots(uid)
+	return snapshots, wrapError("ListUserConversationSnapshots", err, uid, "", 0)
+}
+
+func (f *FileStore) listUserConversationSnapshots(uid string) ([]*ConversationSnapshot, error) {
+	snapshots := make([]*ConversationSnapshot, 0)
+	err := f.view(func(t *bolt.Tx) error {
+		bucket, err := f.getSlotBucketWithKey(uid, t)
+		if err != nil {
+			return err
+		}
+		ids := f.conversationSnapshotIDs(uid, bucket)
+		for i := len(ids) - 1; i >= 0; i-- {
+			value := bucket.Get(f.getConversationSnapshotKey(uid, ids[i]))
+			snapshot := &ConversationSnapshot{
+				ID:   ids[i],
+				UID:  uid,
+				Size: len(value),
+			}
+			if nano, err := strconv.ParseInt(ids[i], 10, 64); err == nil {
+				snapshot.CreatedAt = time.Unix(0, nano)
+			}
+			if len(value) > 0 {
+				conversations, err := decodeConversations(value, true)
+				if err != nil {
+					return err
+				}
+				snapshot.Count = len(conversations)
+			}
+			snapshots = append(snapshots, snapshot)
+		}
+		return nil
+	})
+	return snapshots, err
+}
+
+// RestoreUserConversations 用快照覆盖用户当前的最近会话（在一个事务里完成），快照不存在返回ErrNotFound
+func (f *FileStore) RestoreUserConversations(uid string, snapshotID string) error {
+	defer f.trace("RestoreUserConversations", uid, time.Now(), zap.String("snapshotID", snapshotID))
+	return wrapError("RestoreUserConversations", f.restoreUserConversations(uid, snapshotID), uid, "", 0)
+}
+
+func (f *FileStore) restoreUserConversations(uid string, snapshotID string) error {
+	return f.update(func(t *bolt.Tx) error {
+		bucket, err := f.getSlotBucketWithKey(uid, t)
+		if err != nil {
+			return err
+		}
+		value := bucket.Get(f.getConversationSnapshotKey(uid, snapshotID))
+		if value == nil {
+			return ErrNotFound
+		}
+		if len(value) == 0 {
+			return f.putUserConversationsInTx(bucket, uid, nil)
+		}
+		return f.putUserConversationsInTx(bucket, uid, append(make([]byte, 0, len(value)), value...))
+	})
+}
+
+// DeleteUserConversationSnapshots 删除用户的所有最近会话快照（清除用户数据时调用）
+func (f *FileStore) DeleteUserConversationSnapshots(uid string) error {
+	err := f.update(func(t *bolt.Tx) error {
+		bucket, err := f.getSlotBucketWithKey(uid, t)
+		if err != nil {
+			return err
+		}
+		for _, id := range f.conversationSnapshotIDs(uid, bucket) {
+			if err = bucket.Delete(f.getConversationSnapshotKey(uid, id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return wrapError("DeleteUserConversationSnapshots", err, uid, "", 0)
+}
+
+// conversationSnapshotIDs 用户的快照id，按时间从旧到新
+func (f *FileStore) conversationSnapshotIDs(uid string, bucket *bolt.Bucket) []string {
+	prefix := []byte(fmt.Sprintf("%s%s:", conversationSnapshotPrefix, uid))
+	ids := make([]string, 0)
+	cursor := bucket.Cursor()
+	for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+		id := string(k[len(prefix):])
+		if strings.IndexByte(id, ':') >= 0 { // 其他uid（比如uid为 uid:xxx）的快照
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (f *FileStore) getConversationSnapshotKey(uid string, snapshotID string) []byte {
+	return []byte(fmt.Sprintf("%s%s:%s", conversationSnapshotPrefix, uid, snapshotID))
+}
+
+// formatConversationSnapshotID 快照id为快照时间的纳秒数，补齐位数保证按字符串排序就是按时间排序
+func formatConversationSnapshotID(nano int64) string {
+	return fmt.Sprintf("%019d", nano)
+}
+
+// describeConversationSnapshotKey 快照的key为 uid:快照id，uid里可能有:，所以按最后一个:分割
+func describeConversationSnapshotKey(rest string) (map[string]string, error) {
+	idx := strings.LastIndexByte(rest, ':')
+	if idx <= 0 {
+		return nil, fmt.Errorf("missing snapshot_id: %w", ErrInvalidKey)
+	}
+	return map[string]string{
+		"uid":         rest[:idx],
+		"snapshot_id": rest[idx+1:],
+	}, nil
+}
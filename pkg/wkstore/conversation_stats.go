@@ -0,0 +1,234 @@
+package wkstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// ConversationStatsReport 最近会话统计报告
+type ConversationStatsReport struct {
+	TotalUsers             int                          `json:"total_users"`             // 有最近会话的用户数量
+	SampledUsers           int                          `json:"sampled_users"`           // 抽样的用户数量
+	TotalBytes             int64                        `json:"total_bytes"`             // 所有用户最近会话数据的大小
+	P50                    int                          `json:"p50"`                     // 每个用户最近会话数量的p50
+	P95                    int                          `json:"p95"`                     // 每个用户最近会话数量的p95
+	Max                    int                          `json:"max"`                     // 每个用户最近会话数量的最大值
+	AvgConversations       float64                      `json:"avg_conversations"`       // 每个用户平均最近会话数量
+	AvgBytesPerUser        float64                      `json:"avg_bytes_per_user"`      // 每个用户平均最近会话数据大小
+	AvgBytesPerRow         float64                      `json:"avg_bytes_per_row"`       // 每条最近会话平均数据大小
+	EstimatedConversations int64                        `json:"estimated_conversations"` // 估算的最近会话总数
+	GrowthRate             float64                      `json:"growth_rate"`             // 估算的最近会话总数相对上次统计的增长率
+	GrowthInterval         time.Duration                `json:"growth_interval"`         // 距离上次统计的时间
+	Thresholds             []*ConversationThresholdStat `json:"thresholds"`              // 超过阈值的用户统计（只统计抽样的用户）
+	Evictions              int64                        `json:"evictions"`               // 超过数量上限被淘汰的最近会话数量（进程启动后）
+	Purged                 int64                        `json:"purged"`                  // 超过ConversationTTL被清理的最近会话数量（进程启动后）
+	VersionClamps          int64                        `json:"version_clamps"`          // 版本号不大于已存储的最大版本号（比如时钟回拨）被修正的最近会话数量（进程启动后）
+	StatsAt                time.Time                    `json:"stats_at"`                // 统计时间
+	Cost                   time.Duration                `json:"cost"`                    // 统计耗时
+}
+
+// ConversationThresholdStat 最近会话数量超过阈值的用户统计
+type ConversationThresholdStat struct {
+	Threshold int      `json:"threshold"` // 阈值
+	Count     int      `json:"count"`     // 超过阈值的用户数量
+	UIDs      []string `json:"uids"`      // 超过阈值的用户uid（最多ConversationStatsMaxUIDs个）
+}
+
+type conversationSample struct {
+	uid   string
+	count int
+	size  int
+}
+
+// ConversationStats 抽样统计最近会话的分布情况，sampleUsers<=0表示统计所有用户
+// 扫描使用分批的读事务，不会长时间占用数据库，可通过ctx取消
+func (f *FileStore) ConversationStats(ctx context.Context, sampleUsers int) (*ConversationStatsReport, error) {
+	report, err := f.conversationStats(ctx, sampleUsers)
+	return report, wrapError("ConversationStats", err, "", "", 0)
+}
+
+func (f *FileStore) conversationStats(ctx context.Context, sampleUsers int) (*ConversationStatsReport, error) {
+	start := time.Now()
+	var (
+		report  = &ConversationStatsReport{StatsAt: start}
+		samples = make([]conversationSample, 0)
+		prefix  = []byte(f.conversationPrefix)
+		random  = rand.New(rand.NewSource(start.UnixNano()))
+	)
+	// 蓄水池抽样
+	err := f.scan(ctx, prefix, func(key, value []byte) error {
+		report.TotalUsers++
+		report.TotalBytes += int64(len(value))
+		idx := len(samples)
+		if sampleUsers > 0 && len(samples) >= sampleUsers {
+			idx = random.Intn(report.TotalUsers)
+			if idx >= sampleUsers {
+				return nil
+			}
+		}
+		conversations, err := decodeConversations(value, true)
+		if err != nil {
+			f.Warn("decode conversations fail", zap.Error(err), zap.ByteString("key", key))
+			return nil
+		}
+		sample := conversationSample{
+			uid:   string(key[len(prefix):]),
+			count: len(conversations),
+			size:  len(value),
+		}
+		if idx < len(samples) {
+			samples[idx] = sample
+		} else {
+			samples = append(samples, sample)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.fillConversationStats(report, samples)
+	report.Cost = time.Since(start)
+	return report, nil
+}
+
+func (f *FileStore) fillConversationStats(report *ConversationStatsReport, samples []conversationSample) {
+	report.SampledUsers = len(samples)
+	report.Evictions = f.conversationEvictions.Load()
+	report.Purged = f.conversationsPurged.Load()
+	report.VersionClamps = f.conversationVersionClamps.Load()
+	thresholds := make([]*ConversationThresholdStat, 0, len(f.cfg.ConversationStatsThresholds))
+	for _, threshold := range f.cfg.ConversationStatsThresholds {
+		thresholds = append(thresholds, &ConversationThresholdStat{Threshold: threshold, UIDs: make([]string, 0)})
+	}
+	report.Thresholds = thresholds
+	if len(samples) > 0 {
+		sort.Slice(samples, func(i, j int) bool {
+			return samples[i].count < samples[j].count
+		})
+		var (
+			totalCount int
+			totalSize  int
+		)
+		for i := len(samples) - 1; i >= 0; i-- { // 从多到少，返回的uid优先是会话最多的
+			sample := samples[i]
+			totalCount += sample.count
+			totalSize += sample.size
+			for _, threshold := range thresholds {
+				if sample.count > threshold.Threshold {
+					threshold.Count++
+					if len(threshold.UIDs) < f.cfg.ConversationStatsMaxUIDs {
+						threshold.UIDs = append(threshold.UIDs, sample.uid)
+					}
+				}
+			}
+		}
+		report.P50 = samples[percentileIndex(len(samples), 0.5)].count
+		report.P95 = samples[percentileIndex(len(samples), 0.95)].count
+		report.Max = samples[len(samples)-1].count
+		report.AvgConversations = float64(totalCount) / float64(len(samples))
+		report.AvgBytesPerUser = float64(totalSize) / float64(len(samples))
+		if totalCount > 0 {
+			report.AvgBytesPerRow = float64(totalSize) / float64(totalCount)
+		}
+		report.EstimatedConversations = int64(report.AvgConversations * float64(report.TotalUsers))
+	}
+
+	f.conversationStatsLock.Lock()
+	last := f.lastConversationStats
+	f.lastConversationStats = report
+	f.conversationStatsLock.Unlock()
+	if last != nil {
+		report.GrowthInterval = report.StatsAt.Sub(last.StatsAt)
+		if last.EstimatedConversations > 0 {
+			report.GrowthRate = float64(report.EstimatedConversations-last.EstimatedConversations) / float64(last.EstimatedConversations)
+		}
+	}
+}
+
+// percentileIndex 最近秩法计算百分位的下标
+func percentileIndex(n int, p float64) int {
+	idx := int(float64(n)*p+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= n {
+		idx = n - 1
+	}
+	return idx
+}
+
+// scan 分批扫描所有slot下指定前缀的数据，每批使用一个读事务，批之间间隔ScanBatchBackoff，ctx取消后停止扫描
+// 注意：key和value只在fn内有效
+func (f *FileStore) scan(ctx context.Context, prefix []byte, fn func(key, value []byte) error) error {
+	return f.scanFrom(ctx, prefix, 0, nil, func(slot uint32, key, value []byte) error {
+		return fn(key, value)
+	})
+}
+
+// errStopScan fn返回后停止扫描，scanFrom返回nil
+var errStopScan = errors.New("stop scan")
+
+// scanFrom 从startSlot的startKey（包含，为nil表示从prefix开始）继续扫描，fn返回errStopScan时停止扫描
+func (f *FileStore) scanFrom(ctx context.Context, prefix []byte, startSlot uint32, startKey []byte, fn func(slot uint32, key, value []byte) error) error {
+	batchSize := f.cfg.ScanBatchSize
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+	for slot := startSlot; slot < uint32(f.cfg.SlotNum); slot++ {
+		seek := prefix
+		if slot == startSlot && startKey != nil {
+			seek = startKey
+		}
+		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			finished := true
+			err := f.view(func(t *bolt.Tx) error {
+				bucket, err := f.getSlotBucket(slot, t)
+				if err != nil {
+					return err
+				}
+				cursor := bucket.Cursor()
+				k, v := cursor.Seek(seek)
+				count := 0
+				for ; k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+					if count >= batchSize {
+						finished = false
+						seek = append(make([]byte, 0, len(k)), k...) // 下一批从这个key开始
+						return nil
+					}
+					if err := fn(slot, k, v); err != nil {
+						return err
+					}
+					count++
+				}
+				return nil
+			})
+			if errors.Is(err, errStopScan) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if finished {
+				break
+			}
+			if f.cfg.ScanBatchBackoff > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(f.cfg.ScanBatchBackoff):
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package wkstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// ConversationTombstone 删除最近会话的记录，客户端增量同步时据此删除本地的最近会话
+type ConversationTombstone struct {
+	ChannelID   string `json:"channel_id"`
+	ChannelType uint8  `json:"channel_type"`
+	Version     int64  `json:"version"` // 删除时的版本号，和Conversation.Version在同一个序列里
+}
+
+// conversationTombstones 用户删除最近会话的记录，按版本号从小到大，超过ConversationTombstoneMaxCount后删除最旧的
+type conversationTombstones struct {
+	Pruned int64                   `json:"pruned"` // 已删除的记录里最大的版本号，客户端的版本号比它小时需要全量同步
+	Items  []ConversationTombstone `json:"items"`
+}
+
+// maxVersion 删除记录里最大的版本号
+func (t *conversationTombstones) maxVersion() int64 {
+	if len(t.Items) == 0 {
+		return t.Pruned
+	}
+	return t.Items[len(t.Items)-1].Version
+}
+
+// ConversationChanges 增量同步的结果
+type ConversationChanges struct {
+	Conversations []*Conversation          // 版本号大于sinceVersion的最近会话，按版本号从小到大
+	Deleted       []*ConversationTombstone // 版本号大于sinceVersion的删除记录（之后又重新创建的不返回）
+	Version       uint64                   // 下次同步传入的版本号（这一页最后的版本号，没有变化时为sinceVersion）
+	More          bool                     // 还有更多的变化，需要用Version继续同步
+	Reset         bool                     // sinceVersion之后的删除记录已经清理，客户端需要清空本地的最近会话，这次的结果从头开始
+}
+
+// GetConversationsUpdatedSince 用户版本号大于sinceVersion的最近会话和删除记录，按版本号从小到大（相同的按频道排序），最多limit个（limit<=0表示不限制）
+// 同一个版本号的不会拆到两页（可能超过limit），客户端用返回的Version继续同步不会漏掉也不会重复
+// 版本号在用户内单调递增（见keepConversationVersionsMonotonic），最近会话和删除记录在一个读事务里读取
+func (f *FileStore) GetConversationsUpdatedSince(uid string, sinceVersion uint64, limit int) (*ConversationChanges, error) {
+	defer f.trace("GetConversationsUpdatedSince", uid, time.Now(), zap.Uint64("sinceVersion", sinceVersion), zap.Int("limit", limit))
+	changes, err := f.getConversationsUpdatedSince(uid, sinceVersion, limit)
+	return changes, wrapError("GetConversationsUpdatedSince", err, uid, "", 0)
+}
+
+func (f *FileStore) getConversationsUpdatedSince(uid string, sinceVersion uint64, limit int) (*ConversationChanges, error) {
+	var (
+		conversations []*Conversation
+		tombstones    *conversationTombstones
+	)
+	err := f.view(func(t *bolt.Tx) error {
+		bucket, err := f.getSlotBucketWithKey(uid, t)
+		if err != nil {
+			return err
+		}
+		if value := bucket.Get([]byte(f.getConversationKey(uid))); len(value) > 0 {
+			if conversations, err = decodeConversations(value, false); err != nil {
+				return err
+			}
+		}
+		tombstones, err = f.getConversationTombstonesInTx(bucket, uid)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	changes := &ConversationChanges{}
+	if sinceVersion > 0 && sinceVersion < uint64(tombstones.Pruned) {
+		changes.Reset = true
+		sinceVersion = 0
+	}
+
+	type change struct {
+		version      int64
+		channelID    string
+		channelType  uint8
+		conversation *Conversation
+		tombstone    *ConversationTombstone
+	}
+	current := make(map[ConversationKey]int64, len(conversations))
+	changed := make([]change, 0)
+	for _, conversation := range conversations {
+		current[ConversationKey{ChannelID: conversation.ChannelID, ChannelType: conversation.ChannelType}] = conversation.Version
+		if conversation.Version > 0 && uint64(conversation.Version) > sinceVersion {
+			changed = append(changed, change{version: conversation.Version, channelID: conversation.ChannelID, channelType: conversation.ChannelType, conversation: conversation})
+		}
+	}
+	if sinceVersion > 0 { // 全量同步不需要删除记录
+		for i := range tombstones.Items {
+			tombstone := &tombstones.Items[i]
+			if uint64(tombstone.Version) <= sinceVersion {
+				continue
+			}
+			if version, ok := current[ConversationKey{ChannelID: tombstone.ChannelID, ChannelType: tombstone.ChannelType}]; ok && version > tombstone.Version {
+				continue // 删除后又重新创建了
+			}
+			changed = append(changed, change{version: tombstone.Version, channelID: tombstone.ChannelID, channelType: tombstone.ChannelType, tombstone: tombstone})
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool {
+		if changed[i].version != changed[j].version {
+			return changed[i].version < changed[j].version
+		}
+		if changed[i].channelType != changed[j].channelType {
+			return changed[i].channelType < changed[j].channelType
+		}
+		return changed[i].channelID < changed[j].channelID
+	})
+	end := len(changed)
+	if limit > 0 && limit < end {
+		end = limit
+		for end < len(changed) && changed[end].version == changed[end-1].version {
+			end++
+		}
+		changes.More = end < len(changed)
+	}
+	changes.Version = sinceVersion
+	for _, c := range changed[:end] {
+		if c.conversation != nil {
+			changes.Conversations = append(changes.Conversations, c.conversation)
+		} else {
+			changes.Deleted = append(changes.Deleted, c.tombstone)
+		}
+		changes.Version = uint64(c.version)
+	}
+	return changes, nil
+}
+
+func (f *FileStore) getConversationTombstoneKey(uid string) []byte {
+	return []byte(fmt.Sprintf("%s%s", conversationTombstonePrefix, uid))
+}
+
+func (f *FileStore) getConversationTombstonesInTx(bucket *bolt.Bucket, uid string) (*conversationTombstones, error) {
+	tombstones := &conversationTombstones{}
+	value := bucket.Get(f.getConversationTombstoneKey(uid))
+	if len(value) == 0 {
+		return tombstones, nil
+	}
+	if err := json.Unmarshal(value, tombstones); err != nil {
+		return nil, err
+	}
+	return tombstones, nil
+}
+
+// putConversationTombstonesInTx 记录删除的最近会话，版本号大于用户已存储的所有版本号（包括删除记录的）
+// 同一个频道只保留最新的删除记录，超过ConversationTombstoneMaxCount时删除最旧的（记录在Pruned里）
+func (f *FileStore) putConversationTombstonesInTx(bucket *bolt.Bucket, uid string, old []*Conversation, removed []*Conversation) error {
+	if len(removed) == 0 {
+		return nil
+	}
+	tombstones, err := f.getConversationTombstonesInTx(bucket, uid)
+	if err != nil {
+		return err
+	}
+	maxVersion, _ := conversationVersionRange(old)
+	if v := tombstones.maxVersion(); v > maxVersion {
+		maxVersion = v
+	}
+	version := f.newConversationVersion()
+	if version <= maxVersion {
+		version = maxVersion + 1
+		f.conversationVersionClamps.Inc()
+	}
+	for _, conversation := range removed {
+		items := tombstones.Items[:0]
+		for _, item := range tombstones.Items {
+			if item.ChannelID != conversation.ChannelID || item.ChannelType != conversation.ChannelType {
+				items = append(items, item)
+			}
+		}
+		tombstones.Items = append(items, ConversationTombstone{ChannelID: conversation.ChannelID, ChannelType: conversation.ChannelType, Version: version})
+	}
+	if maxCount := f.cfg.ConversationTombstoneMaxCount; maxCount > 0 && len(tombstones.Items) > maxCount {
+		prune := len(tombstones.Items) - maxCount
+		tombstones.Pruned = tombstones.Items[prune-1].Version
+		tombstones.Items = append([]ConversationTombstone(nil), tombstones.Items[prune:]...)
+	}
+	value, err := json.Marshal(tombstones)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(f.getConversationTombstoneKey(uid), value)
+}
+
+// keepVersionsAboveTombstonesInTx 用户有删除记录时，修改或新增的最近会话版本号不大于删除记录的版本号的改为删除记录的版本号+1
+// 已删除的最近会话不在已存储的最近会话里，keepConversationVersionsMonotonic不知道删除记录的版本号，客户端同步到删除记录后会漏掉这些修改
+// 只有删除过最近会话的用户才需要解码比较，value为新的最近会话数据，返回修正后的数据
+func (f *FileStore) keepVersionsAboveTombstonesInTx(bucket *bolt.Bucket, uid string, old []byte, value []byte) ([]byte, error) {
+	if len(value) == 0 {
+		return value, nil
+	}
+	tombstoneValue := bucket.Get(f.getConversationTombstoneKey(uid))
+	if len(tombstoneValue) == 0 {
+		return value, nil
+	}
+	tombstones := &conversationTombstones{}
+	if err := json.Unmarshal(tombstoneValue, tombstones); err != nil {
+		return nil, err
+	}
+	floor := tombstones.maxVersion()
+	conversations, err := decodeConversations(value, false)
+	if err != nil {
+		return nil, err
+	}
+	var oldMap map[ConversationKey]*Conversation
+	changed := false
+	for _, conversation := range conversations {
+		if conversation.Version > floor {
+			continue
+		}
+		if oldMap == nil {
+			oldMap = make(map[ConversationKey]*Conversation)
+			if len(old) > 0 {
+				oldConversations, err := decodeConversations(old, false)
+				if err != nil {
+					return nil, err
+				}
+				for _, oldConversation := range oldConversations {
+					oldMap[ConversationKey{ChannelID: oldConversation.ChannelID, ChannelType: oldConversation.ChannelType}] = oldConversation
+				}
+			}
+		}
+		if oldConversation := oldMap[ConversationKey{ChannelID: conversation.ChannelID, ChannelType: conversation.ChannelType}]; oldConversation != nil && equalExceptVersion(oldConversation, conversation) {
+			continue
+		}
+		conversation.Version = floor + 1
+		f.conversationVersionClamps.Inc()
+		changed = true
+	}
+	if !changed {
+		return value, nil
+	}
+	return f.encodeConversations(conversations), nil
+}
@@ -0,0 +1,110 @@
+package wkstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetConversationsUpdatedSince(t *testing.T) {
+	store := newTestFileStore(t)
+	now := time.UnixMilli(5) // 比已存储的版本号旧
+	store.cfg.Clock = func() time.Time { return now }
+	assert.NoError(t, store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 1, Version: 10},
+		{UID: "u1", ChannelID: "g2", ChannelType: 2, UnreadCount: 1, Version: 20},
+		{UID: "u1", ChannelID: "g3", ChannelType: 2, UnreadCount: 1, Version: 20},
+		{UID: "u1", ChannelID: "g4", ChannelType: 2, UnreadCount: 1, Version: 30},
+	}))
+
+	// 同一个版本号的不拆到两页
+	changes, err := store.GetConversationsUpdatedSince("u1", 0, 2)
+	assert.NoError(t, err)
+	assert.Len(t, changes.Conversations, 3)
+	assert.Equal(t, []string{"g1", "g2", "g3"}, []string{changes.Conversations[0].ChannelID, changes.Conversations[1].ChannelID, changes.Conversations[2].ChannelID})
+	assert.Equal(t, uint64(20), changes.Version)
+	assert.True(t, changes.More)
+	changes, err = store.GetConversationsUpdatedSince("u1", changes.Version, 2)
+	assert.NoError(t, err)
+	assert.Len(t, changes.Conversations, 1)
+	assert.Equal(t, "g4", changes.Conversations[0].ChannelID)
+	assert.Equal(t, uint64(30), changes.Version)
+	assert.False(t, changes.More)
+
+	// 没有变化
+	changes, err = store.GetConversationsUpdatedSince("u1", 30, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, changes.Conversations)
+	assert.Empty(t, changes.Deleted)
+	assert.Equal(t, uint64(30), changes.Version)
+
+	// 删除的版本号大于已存储的所有版本号
+	assert.NoError(t, store.DeleteConversation("u1", "g4", 2))
+	changes, err = store.GetConversationsUpdatedSince("u1", 30, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, changes.Conversations)
+	assert.Equal(t, []*ConversationTombstone{{ChannelID: "g4", ChannelType: 2, Version: 31}}, changes.Deleted)
+	assert.Equal(t, uint64(31), changes.Version)
+
+	// 删除后修改的最近会话版本号大于删除记录的，同步到删除记录后不会漏掉
+	_, err = store.IncConversationUnreadCount("u1", "g1", 2, 1, false)
+	assert.NoError(t, err)
+	changes, err = store.GetConversationsUpdatedSince("u1", 31, 0)
+	assert.NoError(t, err)
+	assert.Len(t, changes.Conversations, 1)
+	assert.Equal(t, "g1", changes.Conversations[0].ChannelID)
+	assert.Equal(t, int64(32), changes.Conversations[0].Version)
+
+	// 重新创建的不返回删除记录
+	assert.NoError(t, store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g4", ChannelType: 2, UnreadCount: 1, Version: 1},
+	}))
+	changes, err = store.GetConversationsUpdatedSince("u1", 30, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, changes.Deleted)
+	assert.Len(t, changes.Conversations, 2)
+	assert.Equal(t, "g4", changes.Conversations[1].ChannelID)
+	assert.Equal(t, int64(33), changes.Conversations[1].Version)
+
+	// 全量同步不返回删除记录
+	changes, err = store.GetConversationsUpdatedSince("u1", 0, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, changes.Deleted)
+	assert.Len(t, changes.Conversations, 4)
+}
+
+func TestConversationTombstonePrune(t *testing.T) {
+	store := newTestFileStore(t)
+	store.cfg.ConversationTombstoneMaxCount = 1
+	assert.NoError(t, store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, Version: 10},
+		{UID: "u1", ChannelID: "g2", ChannelType: 2, Version: 20},
+	}))
+	assert.NoError(t, store.DeleteConversation("u1", "g1", 2))
+	changes, err := store.GetConversationsUpdatedSince("u1", 20, 0)
+	assert.NoError(t, err)
+	assert.Len(t, changes.Deleted, 1)
+	deleted := changes.Version
+
+	assert.NoError(t, store.DeleteConversation("u1", "g2", 2))
+	// 客户端的版本号比清理的删除记录旧，需要全量同步
+	changes, err = store.GetConversationsUpdatedSince("u1", 20, 0)
+	assert.NoError(t, err)
+	assert.True(t, changes.Reset)
+	assert.Empty(t, changes.Deleted)
+	assert.Empty(t, changes.Conversations)
+
+	changes, err = store.GetConversationsUpdatedSince("u1", deleted, 0)
+	assert.NoError(t, err)
+	assert.False(t, changes.Reset)
+	assert.Len(t, changes.Deleted, 1)
+	assert.Equal(t, "g2", changes.Deleted[0].ChannelID)
+
+	// 删除用户数据时同时删除删除记录
+	_, err = store.DeleteUserData("u1", MaintenanceOptions{})
+	assert.NoError(t, err)
+	changes, err = store.GetConversationsUpdatedSince("u1", deleted, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, changes.Deleted)
+}
@@ -0,0 +1,215 @@
+package wkstore
+
+import (
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// IncConversationUnreadCount 在一个事务里给最近会话的未读数加上delta（减少时最小为0）并更新版本号，返回修改后的最近会话
+// 最近会话不存在时，createIfMissing为true则新建（未读数为max(delta,0)），否则返回nil
+func (f *FileStore) IncConversationUnreadCount(uid string, channelID string, channelType uint8, delta int, createIfMissing bool) (*Conversation, error) {
+	defer f.trace("IncConversationUnreadCount", uid, time.Now(), zap.String("channelID", channelID), zap.Uint8("channelType", channelType), zap.Int("delta", delta))
+	conversation, err := f.incConversationUnreadCount(uid, channelID, channelType, delta, createIfMissing)
+	return conversation, wrapError("IncConversationUnreadCount", err, uid, channelID, channelType)
+}
+
+func (f *FileStore) incConversationUnreadCount(uid string, channelID string, channelType uint8, delta int, createIfMissing bool) (*Conversation, error) {
+	if uid == "" || !validConversationChannel(channelID, channelType) {
+		return nil, ErrInvalidConversation
+	}
+	key := f.getConversationKey(uid)
+	f.lock.Lock(key)
+	defer f.lock.Unlock(key)
+
+	var (
+		result  *Conversation
+		created bool
+	)
+	err := f.update(func(t *bolt.Tx) error {
+		bucket, err := f.getSlotBucketWithKey(uid, t)
+		if err != nil {
+			return err
+		}
+		conversations := make([]*Conversation, 0)
+		if value := bucket.Get([]byte(key)); len(value) > 0 {
+			if conversations, err = decodeConversations(value, false); err != nil {
+				return err
+			}
+		}
+		old := snapshotConversations(conversations)
+		var conversation *Conversation
+		for _, c := range conversations {
+			if c.ChannelID == channelID && c.ChannelType == channelType {
+				conversation = c
+				break
+			}
+		}
+		if conversation == nil {
+			if !createIfMissing {
+				return nil
+			}
+			conversation = &Conversation{
+				UID:         uid,
+				ChannelID:   channelID,
+				ChannelType: channelType,
+			}
+			created = true
+			oldLen := len(conversations)
+			conversations = append(conversations, conversation)
+			if conversations, err = f.applyConversationQuota(uid, conversations, oldLen, []*Conversation{conversation}); err != nil {
+				return err
+			}
+			if f.cfg.ConversationChannelInfo {
+				f.fillChannelInfo(conversations)
+				conversation = conversations[len(conversations)-1]
+			}
+		}
+		conversation.UnreadCount += delta
+		if conversation.UnreadCount < 0 {
+			conversation.UnreadCount = 0
+		}
+		conversation.Version = f.newConversationVersion()
+		f.keepConversationVersionsMonotonic(old, conversations)
+		if err = f.putUserConversationsInTx(bucket, uid, f.encodeConversations(conversations)); err != nil {
+			return err
+		}
+		newConversation := *conversation
+		result = &newConversation
+		return nil
+	})
+	if err != nil || result == nil {
+		return result, err
+	}
+	if created {
+		f.conversationOps.add(ConversationOpCreate, channelType, 1)
+	} else {
+		f.conversationOps.add(ConversationOpUpdate, channelType, 1)
+	}
+	return result, nil
+}
+
+// ConversationReadTo 用户已读到频道的消息位置
+type ConversationReadTo struct {
+	ChannelID    string
+	ChannelType  uint8
+	ReadToMsgSeq uint32 // 已读到的messageSeq（包含）
+	// CreateIfMissing 最近会话不存在时创建（最后一条消息为ReadToMsgSeq，没有未读），比如新用户在有最近会话之前读了频道，不然已读位置会丢失
+	CreateIfMissing bool
+	// ResetMentions 提及数量清零，调用方确认已读位置已经超过最后一条提及用户的消息时设置（存储里没有记录提及的消息位置）
+	ResetMentions bool
+}
+
+// UpdateConversationsReadToMsgSeq 在一个事务里批量设置用户在多个频道已读到的消息位置（比如全部标记为已读），见Conversation.ReadTo
+// 已经读到更后面的不做处理（ResetMentions时照样清零提及数量），不存在的最近会话只有CreateIfMissing时创建，返回有修改（包括创建）的最近会话
+func (f *FileStore) UpdateConversationsReadToMsgSeq(uid string, items []ConversationReadTo) ([]ConversationKey, error) {
+	defer f.trace("UpdateConversationsReadToMsgSeq", uid, time.Now(), zap.Int("count", len(items)))
+	keys, err := f.updateConversationsReadToMsgSeq(uid, items)
+	return keys, wrapError("UpdateConversationsReadToMsgSeq", err, uid, "", 0)
+}
+
+func (f *FileStore) updateConversationsReadToMsgSeq(uid string, items []ConversationReadTo) ([]ConversationKey, error) {
+	if uid == "" {
+		return nil, ErrInvalidConversation
+	}
+	for _, item := range items {
+		if !validConversationChannel(item.ChannelID, item.ChannelType) {
+			return nil, ErrInvalidConversation
+		}
+	}
+	if len(items) == 0 {
+		return nil, nil
+	}
+	readTos := make(map[ConversationKey]uint32, len(items))
+	resetMentions := make(map[ConversationKey]bool)
+	creates := make([]ConversationKey, 0)
+	for _, item := range items {
+		key := ConversationKey{ChannelID: item.ChannelID, ChannelType: item.ChannelType}
+		if _, ok := readTos[key]; !ok && item.CreateIfMissing {
+			creates = append(creates, key)
+		}
+		if item.ResetMentions {
+			resetMentions[key] = true
+		}
+		if item.ReadToMsgSeq > readTos[key] {
+			readTos[key] = item.ReadToMsgSeq
+		}
+	}
+	key := f.getConversationKey(uid)
+	f.lock.Lock(key)
+	defer f.lock.Unlock(key)
+
+	var changed []ConversationKey
+	err := f.update(func(t *bolt.Tx) error {
+		changed = nil
+		bucket, err := f.getSlotBucketWithKey(uid, t)
+		if err != nil {
+			return err
+		}
+		value := bucket.Get([]byte(key))
+		if len(value) == 0 && len(creates) == 0 {
+			return nil
+		}
+		conversations := make([]*Conversation, 0)
+		if len(value) > 0 {
+			if conversations, err = decodeConversations(value, false); err != nil {
+				return err
+			}
+		}
+		old := snapshotConversations(conversations)
+		oldLen := len(conversations)
+		version := f.newConversationVersion()
+		exist := make(map[ConversationKey]bool, len(conversations))
+		for _, conversation := range conversations {
+			channelKey := ConversationKey{ChannelID: conversation.ChannelID, ChannelType: conversation.ChannelType}
+			exist[channelKey] = true
+			readTo, ok := readTos[channelKey]
+			if !ok {
+				continue
+			}
+			modify := conversation.ReadTo(readTo) // 已经读到更后面的不修改
+			if resetMentions[channelKey] && conversation.MentionCount > 0 {
+				conversation.MentionCount = 0
+				modify = true
+			}
+			if !modify {
+				continue
+			}
+			conversation.Version = version
+			changed = append(changed, ConversationKey{UID: uid, ChannelID: conversation.ChannelID, ChannelType: conversation.ChannelType})
+		}
+		var created []*Conversation
+		for _, channelKey := range creates {
+			if exist[channelKey] {
+				continue
+			}
+			conversation := &Conversation{
+				UID:         uid,
+				ChannelID:   channelKey.ChannelID,
+				ChannelType: channelKey.ChannelType,
+				Timestamp:   f.now().Unix(),
+				LastMsgSeq:  readTos[channelKey],
+				Version:     version,
+			}
+			created = append(created, conversation)
+			conversations = append(conversations, conversation)
+			changed = append(changed, ConversationKey{UID: uid, ChannelID: channelKey.ChannelID, ChannelType: channelKey.ChannelType})
+		}
+		if len(changed) == 0 {
+			return nil
+		}
+		if len(created) > 0 {
+			if conversations, err = f.applyConversationQuota(uid, conversations, oldLen, created); err != nil {
+				return err
+			}
+		}
+		f.keepConversationVersionsMonotonic(old, conversations)
+		return f.putUserConversationsInTx(bucket, uid, f.encodeConversations(conversations))
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.conversationOps.addKeys(ConversationOpReadTo, changed)
+	return changed, nil
+}
@@ -0,0 +1,239 @@
+package wkstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"maps"
+	"reflect"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// now 当前时间，配置了Clock时使用Clock（测试时可以模拟时钟回拨）
+func (f *FileStore) now() time.Time {
+	if f.cfg.Clock != nil {
+		return f.cfg.Clock()
+	}
+	return time.Now()
+}
+
+// newConversationVersion 生成最近会话的版本号（毫秒时间戳）
+func (f *FileStore) newConversationVersion() int64 {
+	return f.now().UnixNano() / 1e6
+}
+
+// ConversationVersionClamps 因为版本号不大于用户已存储的最大版本号（比如时钟回拨）被修正的最近会话数量（进程启动后）
+func (f *FileStore) ConversationVersionClamps() int64 {
+	return f.conversationVersionClamps.Load()
+}
+
+// snapshotConversations 复制用户已存储的最近会话，用于写入前比较版本号
+func snapshotConversations(conversations []*Conversation) []Conversation {
+	snapshot := make([]Conversation, 0, len(conversations))
+	for _, conversation := range conversations {
+		snapshot = append(snapshot, *conversation)
+	}
+	return snapshot
+}
+
+// keepConversationVersionsMonotonic 保证用户的最近会话版本号单调递增，客户端增量同步（大于客户端最大版本号）不会漏掉
+// 有修改或新增的最近会话版本号不大于已存储的最大版本号时修正为最大版本号+1，没有修改的最近会话保留已存储的版本号
+func (f *FileStore) keepConversationVersionsMonotonic(old []Conversation, conversations []*Conversation) {
+	if len(old) == 0 {
+		return
+	}
+	var maxVersion int64
+	oldMap := make(map[ConversationKey]*Conversation, len(old))
+	for i := range old {
+		if old[i].Version > maxVersion {
+			maxVersion = old[i].Version
+		}
+		oldMap[ConversationKey{ChannelID: old[i].ChannelID, ChannelType: old[i].ChannelType}] = &old[i]
+	}
+	for _, conversation := range conversations {
+		oldConversation := oldMap[ConversationKey{ChannelID: conversation.ChannelID, ChannelType: conversation.ChannelType}]
+		if oldConversation != nil && equalExceptVersion(oldConversation, conversation) {
+			if conversation.Version < oldConversation.Version {
+				conversation.Version = oldConversation.Version
+			}
+			continue
+		}
+		if conversation.Version <= maxVersion {
+			conversation.Version = maxVersion + 1
+			f.conversationVersionClamps.Inc()
+		}
+	}
+}
+
+// equalExceptVersion 除了版本号外是否相同（Extra为nil和空map视为相同）
+func equalExceptVersion(a, b *Conversation) bool {
+	if !maps.Equal(a.Extra, b.Extra) {
+		return false
+	}
+	c, d := *a, *b
+	c.Extra, d.Extra = nil, nil
+	d.Version = c.Version
+	return reflect.DeepEqual(c, d)
+}
+
+// RepairConversationVersions 修复开启版本号单调保证之前时钟回拨导致客户端增量同步漏掉的最近会话，返回修复的用户数量
+// 用户的最大版本号比当前时间还新说明之后发生过时钟回拨，回拨后更新的最近会话版本号更小会被增量同步漏掉
+// 无法区分哪些最近会话在回拨后更新过，把这些用户所有的最近会话都改为最大版本号+1，客户端下次增量同步时重新同步
+// 扫描分批进行，可通过ctx取消，opts.DryRun为true时只返回需要修复的用户数量
+func (f *FileStore) RepairConversationVersions(ctx context.Context, opts MaintenanceOptions) (int, error) {
+	count, err := f.repairConversationVersions(ctx, opts)
+	return count, wrapError("RepairConversationVersions", err, "", "", 0)
+}
+
+func (f *FileStore) repairConversationVersions(ctx context.Context, opts MaintenanceOptions) (int, error) {
+	prefix := []byte(f.conversationPrefix)
+	nowVersion := f.newConversationVersion()
+	uids := make([]string, 0)
+	err := f.scan(ctx, prefix, func(key, value []byte) error {
+		conversations, err := decodeConversations(value, false)
+		if err != nil {
+			f.Warn("decode conversations fail", zap.Error(err), zap.ByteString("key", key))
+			return nil
+		}
+		if needRepairConversationVersions(conversations, nowVersion) {
+			uids = append(uids, string(key[len(prefix):]))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	m := newMaintenance("RepairConversationVersions", opts, len(uids))
+	if opts.DryRun {
+		m.event.Scanned, m.event.Changed = len(uids), len(uids)
+		m.done()
+		return len(uids), nil
+	}
+	batchSize := m.batchSize(f.cfg)
+	count := 0
+	for start := 0; start < len(uids); start += batchSize {
+		end := start + batchSize
+		if end > len(uids) {
+			end = len(uids)
+		}
+		n, err := f.repairConversationVersionsOfUsers(uids[start:end], nowVersion)
+		count += n
+		if err != nil {
+			return count, err
+		}
+		if err = m.advance(ctx, end-start, n); err != nil {
+			return count, err
+		}
+	}
+	m.done()
+	return count, nil
+}
+
+// needRepairConversationVersions 最大版本号比当前时间还新并且有版本号更小的最近会话
+func needRepairConversationVersions(conversations []*Conversation, nowVersion int64) bool {
+	maxVersion, minVersion := conversationVersionRange(conversations)
+	return maxVersion > nowVersion && minVersion < maxVersion
+}
+
+func conversationVersionRange(conversations []*Conversation) (maxVersion int64, minVersion int64) {
+	for idx, conversation := range conversations {
+		if idx == 0 || conversation.Version > maxVersion {
+			maxVersion = conversation.Version
+		}
+		if idx == 0 || conversation.Version < minVersion {
+			minVersion = conversation.Version
+		}
+	}
+	return
+}
+
+func (f *FileStore) repairConversationVersionsOfUsers(uids []string, nowVersion int64) (int, error) {
+	count := 0
+	err := f.update(func(t *bolt.Tx) error {
+		count = 0
+		for _, uid := range uids {
+			bucket, err := f.getSlotBucketWithKey(uid, t)
+			if err != nil {
+				return err
+			}
+			key := []byte(f.getConversationKey(uid))
+			value := bucket.Get(key)
+			if len(value) == 0 {
+				continue
+			}
+			conversations, err := decodeConversations(value, false)
+			if err != nil {
+				return err
+			}
+			if !needRepairConversationVersions(conversations, nowVersion) { // 扫描后已经修改过
+				continue
+			}
+			maxVersion, _ := conversationVersionRange(conversations)
+			for _, conversation := range conversations {
+				conversation.Version = maxVersion + 1
+			}
+			if err = f.putUserConversationsInTx(bucket, uid, f.encodeConversations(conversations)); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (f *FileStore) getConversationsVersionKey(uid string) []byte {
+	return []byte(conversationsVersionPrefix + uid)
+}
+
+// putUserConversationsInTx 写入用户的最近会话数据（value为空时删除），数据有变化时在同一个事务里把用户最近会话的版本号加1
+// 所有修改用户最近会话的写入都要通过这里，客户端才能通过版本号判断最近会话有没有变化
+// bolt的Put不会复制value，value在事务提交前必须保持不变，不能传入会被复用的buffer（encodeConversations每次返回新分配的数据）
+func (f *FileStore) putUserConversationsInTx(bucket *bolt.Bucket, uid string, value []byte) error {
+	key := []byte(f.getConversationKey(uid))
+	old := bucket.Get(key)
+	value, err := f.keepVersionsAboveTombstonesInTx(bucket, uid, old, value)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(old, value) {
+		return nil
+	}
+	if len(value) == 0 {
+		err = bucket.Delete(key)
+	} else {
+		err = bucket.Put(key, value)
+	}
+	if err != nil {
+		return err
+	}
+	versionKey := f.getConversationsVersionKey(uid)
+	var version uint64
+	if v := bucket.Get(versionKey); len(v) == 8 {
+		version = binary.BigEndian.Uint64(v)
+	}
+	return bucket.Put(versionKey, itob(version+1))
+}
+
+// GetConversationVersion 用户最近会话的版本号，用户的最近会话每次有变化加1，没有变化过为0
+// 和Conversation.Version不同，这个版本号只用来判断用户的最近会话整体有没有变化（客户端没有变化时不需要重新下载）
+func (f *FileStore) GetConversationVersion(uid string) (uint64, error) {
+	var version uint64
+	err := f.view(func(t *bolt.Tx) error {
+		bucket, err := f.getSlotBucketWithKey(uid, t)
+		if err != nil {
+			return err
+		}
+		if v := bucket.Get(f.getConversationsVersionKey(uid)); len(v) == 8 {
+			version = binary.BigEndian.Uint64(v)
+		}
+		return nil
+	})
+	return version, wrapError("GetConversationVersion", err, uid, "", 0)
+}
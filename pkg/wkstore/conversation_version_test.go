@@ -0,0 +1,164 @@
+package wkstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestConversationVersionBackwardsClock(t *testing.T) {
+	store := newTestFileStore(t)
+	store.cfg.ConversationLeavePolicy = ConversationLeaveFreeze
+	now := time.Unix(1700000000, 0)
+	store.cfg.Clock = func() time.Time { return now }
+
+	assert.NoError(t, store.AddSubscribers("g1", 2, []string{"u1"}))
+	assert.NoError(t, store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 1, Version: store.newConversationVersion()},
+	}))
+	synced := store.newConversationVersion() // 客户端已经同步到的版本号
+
+	// 时钟回拨后更新和新增的最近会话
+	now = now.Add(-time.Minute)
+	g1 := &Conversation{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 2, Version: store.newConversationVersion()}
+	g2 := &Conversation{UID: "u1", ChannelID: "g2", ChannelType: 2, UnreadCount: 1, Version: store.newConversationVersion()}
+	versions, err := store.AddOrUpdateConversationsWithVersions("u1", []*Conversation{g1, g2})
+	assert.NoError(t, err)
+	// 返回修正后的版本号（调用方更新缓存），传入的最近会话不修改
+	assert.Equal(t, map[ConversationKey]int64{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2}: synced + 1,
+		{UID: "u1", ChannelID: "g2", ChannelType: 2}: synced + 1,
+	}, versions)
+	assert.Equal(t, now.UnixNano()/1e6, g2.Version)
+	conversation, err := store.GetConversation("u1", "g2", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, synced+1, conversation.Version)
+	assert.Equal(t, int64(2), store.ConversationVersionClamps())
+
+	// 没有修改的最近会话重复保存不修改版本号（比如缓存里的旧版本号）
+	assert.NoError(t, store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 2, Version: 1},
+	}))
+	conversation, err = store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, synced+1, conversation.Version)
+	assert.Equal(t, int64(2), store.ConversationVersionClamps())
+
+	// 离开频道冻结最近会话使用回拨后的时钟
+	assert.NoError(t, store.OnUserLeftChannel("u1", "g1", 2))
+	conversation, err = store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.True(t, conversation.Left)
+	assert.Equal(t, synced+2, conversation.Version)
+	assert.Equal(t, int64(3), store.ConversationVersionClamps())
+
+	report, err := store.ConversationStats(context.Background(), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), report.VersionClamps)
+}
+
+func TestRepairConversationVersions(t *testing.T) {
+	store := newTestFileStore(t)
+	store.cfg.ScanBatchBackoff = 0
+	now := time.Unix(1700000000, 0)
+	store.cfg.Clock = func() time.Time { return now }
+	nowVersion := store.newConversationVersion()
+	future := nowVersion + time.Hour.Milliseconds()
+
+	// 开启版本号单调保证之前的数据：时钟回拨前的版本号比回拨后更新的还大
+	put := func(uid string, conversations []*Conversation) {
+		err := store.update(func(tx *bolt.Tx) error {
+			bucket, err := store.getSlotBucketWithKey(uid, tx)
+			if err != nil {
+				return err
+			}
+			return bucket.Put([]byte(store.getConversationKey(uid)), store.encodeConversations(conversations))
+		})
+		assert.NoError(t, err)
+	}
+	put("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, Version: future},
+		{UID: "u1", ChannelID: "g2", ChannelType: 2, Version: nowVersion},
+	})
+	put("u2", []*Conversation{ // 正常的数据
+		{UID: "u2", ChannelID: "g1", ChannelType: 2, Version: nowVersion - 1},
+		{UID: "u2", ChannelID: "g2", ChannelType: 2, Version: nowVersion},
+	})
+
+	count, err := store.RepairConversationVersions(context.Background(), MaintenanceOptions{DryRun: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	conversation, err := store.GetConversation("u1", "g2", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, nowVersion, conversation.Version)
+
+	count, err = store.RepairConversationVersions(context.Background(), MaintenanceOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	conversations, err := store.GetConversations("u1")
+	assert.NoError(t, err)
+	for _, conversation := range conversations {
+		assert.Equal(t, future+1, conversation.Version) // 客户端用future增量同步能拿到
+	}
+	conversation, err = store.GetConversation("u2", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, nowVersion-1, conversation.Version)
+
+	// 已修复的不再处理
+	count, err = store.RepairConversationVersions(context.Background(), MaintenanceOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+// 用户的最近会话每次有变化版本号加1，没有变化不加
+func TestGetConversationVersion(t *testing.T) {
+	store := newTestFileStore(t)
+	assertVersion := func(expect uint64) {
+		t.Helper()
+		version, err := store.GetConversationVersion("u1")
+		assert.NoError(t, err)
+		assert.Equal(t, expect, version)
+	}
+	assertVersion(0)
+
+	conversations := []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 3, LastMsgSeq: 10, Version: 1},
+		{UID: "u1", ChannelID: "g2", ChannelType: 2, UnreadCount: 2, LastMsgSeq: 10, Version: 1},
+	}
+	assert.NoError(t, store.AddOrUpdateConversations("u1", conversations))
+	assertVersion(1)
+	assert.NoError(t, store.AddOrUpdateConversations("u1", conversations)) // 没有变化
+	assertVersion(1)
+
+	_, err := store.IncConversationUnreadCount("u1", "g1", 2, 1, false)
+	assert.NoError(t, err)
+	assertVersion(2)
+
+	_, err = store.UpdateConversationsReadToMsgSeq("u1", []ConversationReadTo{
+		{ChannelID: "g1", ChannelType: 2, ReadToMsgSeq: 10},
+		{ChannelID: "g2", ChannelType: 2, ReadToMsgSeq: 10},
+	})
+	assert.NoError(t, err)
+	assertVersion(3)
+	_, err = store.UpdateConversationsReadToMsgSeq("u1", []ConversationReadTo{{ChannelID: "g1", ChannelType: 2, ReadToMsgSeq: 10}}) // 没有变化
+	assert.NoError(t, err)
+	assertVersion(3)
+
+	snapshotID, err := store.SnapshotUserConversations("u1")
+	assert.NoError(t, err)
+	assert.NoError(t, store.DeleteConversation("u1", "g2", 2))
+	assertVersion(4)
+	assert.NoError(t, store.RestoreUserConversations("u1", snapshotID))
+	assertVersion(5)
+
+	assert.NoError(t, store.AddSubscribers("g1", 2, []string{"u1"}))
+	assert.NoError(t, store.OnUserLeftChannel("u1", "g1", 2))
+	assertVersion(6)
+
+	// 其他用户的修改不影响
+	assert.NoError(t, store.AddOrUpdateConversations("u2", []*Conversation{{UID: "u2", ChannelID: "g1", ChannelType: 2, Version: 1}}))
+	assertVersion(6)
+}
@@ -0,0 +1,94 @@
+package wkstore
+
+import (
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// 运行时调试设置（慢日志阈值，调试uid），设置后在debugExpire时间后自动失效，避免调试日志一直开着
+var (
+	debugExpire = atomic.NewDuration(time.Minute * 10)
+
+	slowLogThreshold         = atomic.NewDuration(0)
+	slowLogThresholdExpireAt = atomic.NewInt64(0) // unix nano
+
+	debugUID         = atomic.NewString("")
+	debugUIDExpireAt = atomic.NewInt64(0) // unix nano
+)
+
+// DebugStatus 当前的调试设置
+type DebugStatus struct {
+	SlowLogThreshold         time.Duration `json:"slow_log_threshold"`
+	SlowLogThresholdExpireAt int64         `json:"slow_log_threshold_expire_at"` // 过期时间（unix nano）
+	DebugUID                 string        `json:"debug_uid"`
+	DebugUIDExpireAt         int64         `json:"debug_uid_expire_at"` // 过期时间（unix nano）
+	DebugExpire              time.Duration `json:"debug_expire"`
+}
+
+// SetDebugExpire 设置调试设置的有效时长
+func SetDebugExpire(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	debugExpire.Store(d)
+}
+
+// SetSlowLogThreshold 设置慢日志阈值，操作耗时超过阈值将打印警告日志，d<=0表示关闭
+func SetSlowLogThreshold(d time.Duration) {
+	if d <= 0 {
+		slowLogThreshold.Store(0)
+		slowLogThresholdExpireAt.Store(0)
+		return
+	}
+	slowLogThresholdExpireAt.Store(time.Now().Add(debugExpire.Load()).UnixNano())
+	slowLogThreshold.Store(d)
+}
+
+// SetDebugUID 只对涉及此uid的操作打印详细日志，uid为空表示关闭
+func SetDebugUID(uid string) {
+	if uid == "" {
+		debugUID.Store("")
+		debugUIDExpireAt.Store(0)
+		return
+	}
+	debugUIDExpireAt.Store(time.Now().Add(debugExpire.Load()).UnixNano())
+	debugUID.Store(uid)
+}
+
+// GetDebugStatus 获取当前的调试设置（已过期的设置不返回）
+func GetDebugStatus() DebugStatus {
+	status := DebugStatus{
+		DebugExpire: debugExpire.Load(),
+	}
+	if threshold := currentSlowLogThreshold(); threshold > 0 {
+		status.SlowLogThreshold = threshold
+		status.SlowLogThresholdExpireAt = slowLogThresholdExpireAt.Load()
+	}
+	if isDebugUID(debugUID.Load()) {
+		status.DebugUID = debugUID.Load()
+		status.DebugUIDExpireAt = debugUIDExpireAt.Load()
+	}
+	return status
+}
+
+func currentSlowLogThreshold() time.Duration {
+	threshold := slowLogThreshold.Load()
+	if threshold <= 0 {
+		return 0
+	}
+	if time.Now().UnixNano() > slowLogThresholdExpireAt.Load() {
+		return 0
+	}
+	return threshold
+}
+
+func isDebugUID(uid string) bool {
+	if uid == "" {
+		return false
+	}
+	if debugUID.Load() != uid {
+		return false
+	}
+	return time.Now().UnixNano() <= debugUIDExpireAt.Load()
+}
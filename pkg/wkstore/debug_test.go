@@ -0,0 +1,54 @@
+package wkstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebugSettingsExpire(t *testing.T) {
+	oldExpire := debugExpire.Load()
+	defer func() {
+		SetDebugExpire(oldExpire)
+		SetSlowLogThreshold(0)
+		SetDebugUID("")
+	}()
+
+	// 设置后生效
+	SetDebugExpire(time.Millisecond * 50)
+	SetSlowLogThreshold(time.Millisecond * 10)
+	SetDebugUID("u1")
+	status := GetDebugStatus()
+	assert.Equal(t, time.Millisecond*50, status.DebugExpire)
+	assert.Equal(t, time.Millisecond*10, status.SlowLogThreshold)
+	assert.Equal(t, "u1", status.DebugUID)
+	assert.Greater(t, status.SlowLogThresholdExpireAt, time.Now().UnixNano())
+	assert.Greater(t, status.DebugUIDExpireAt, time.Now().UnixNano())
+	assert.True(t, isDebugUID("u1"))
+	assert.False(t, isDebugUID("u2"))
+	assert.Equal(t, time.Millisecond*10, currentSlowLogThreshold())
+
+	// 有效时长<=0时不修改
+	SetDebugExpire(0)
+	assert.Equal(t, time.Millisecond*50, GetDebugStatus().DebugExpire)
+
+	// 过期后自动关闭
+	assert.Eventually(t, func() bool {
+		return !isDebugUID("u1") && currentSlowLogThreshold() == 0
+	}, time.Second, time.Millisecond*10)
+	status = GetDebugStatus()
+	assert.Empty(t, status.DebugUID)
+	assert.Zero(t, status.SlowLogThreshold)
+
+	// 重新设置后重新计时
+	SetDebugUID("u1")
+	assert.True(t, isDebugUID("u1"))
+
+	// 主动关闭
+	SetDebugUID("")
+	SetSlowLogThreshold(0)
+	assert.False(t, isDebugUID("u1"))
+	assert.Zero(t, currentSlowLogThreshold())
+	assert.Equal(t, DebugStatus{DebugExpire: time.Millisecond * 50}, GetDebugStatus())
+}
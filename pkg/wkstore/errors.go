@@ -0,0 +1,76 @@
+package wkstore
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// ErrNotFound 数据不存在
+	ErrNotFound = errors.New("not found")
+	// ErrDBClosed 数据库未打开或已关闭
+	ErrDBClosed = errors.New("db closed")
+	// ErrInvalidConversation 最近会话数据不合法
+	ErrInvalidConversation = errors.New("invalid conversation")
+	// ErrOverQuota 用户的最近会话数量超过上限
+	ErrOverQuota = errors.New("over quota")
+	// ErrUnknownKey 不认识的key（没有注册解析）
+	ErrUnknownKey = errors.New("unknown key")
+	// ErrInvalidKey key的格式不正确
+	ErrInvalidKey = errors.New("invalid key")
+	// ErrInvalidChannel 频道不合法
+	ErrInvalidChannel = errors.New("invalid channel")
+	// ErrConversationExtraTooLarge 最近会话的扩展数据编码后超过上限
+	ErrConversationExtraTooLarge = errors.New("conversation extra too large")
+	// ErrInvalidCursor 分页的游标格式不对
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrInvalidSlot slot超出范围（[0, SlotCount)）
+	ErrInvalidSlot = errors.New("invalid slot")
+	// ErrVersionConflict 按版本号写入时最近会话的版本号和期望的不一致（已经被修改），具体的最近会话见VersionConflictError
+	ErrVersionConflict = errors.New("version conflict")
+	// ErrStartupCheckFailed 打开数据库时检查发现损坏的最近会话超过阈值（开启StartupCheckFailOnCorruption时）
+	ErrStartupCheckFailed = errors.New("startup check failed")
+)
+
+// wrapError 给错误加上操作名和uid，频道等上下文（不要传入消息内容），可以通过errors.Is匹配原始错误
+func wrapError(op string, err error, uid string, channelID string, channelType uint8) error {
+	if err == nil {
+		return nil
+	}
+	var b strings.Builder
+	b.WriteString("wkstore: ")
+	b.WriteString(op)
+	if uid != "" {
+		b.WriteString(" uid=")
+		b.WriteString(uid)
+	}
+	if channelID != "" {
+		fmt.Fprintf(&b, " channel=%s/%d", channelID, channelType)
+	}
+	return fmt.Errorf("%s: %w", b.String(), err)
+}
+
+// dbError 把bolt的错误转换为wkstore的错误
+func dbError(err error) error {
+	if errors.Is(err, bolt.ErrDatabaseNotOpen) {
+		return fmt.Errorf("%w: %w", ErrDBClosed, err)
+	}
+	return err
+}
+
+func (f *FileStore) view(fn func(t *bolt.Tx) error) error {
+	if f.db == nil {
+		return ErrDBClosed
+	}
+	return dbError(f.db.View(fn))
+}
+
+func (f *FileStore) update(fn func(t *bolt.Tx) error) error {
+	if f.db == nil {
+		return ErrDBClosed
+	}
+	return dbError(f.db.Update(fn))
+}
@@ -1,17 +1,23 @@
 package wkstore
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/WuKongIM/WuKongIM/pkg/keylock"
 	"github.com/WuKongIM/WuKongIM/pkg/wkutil"
 	wkproto "github.com/WuKongIM/WuKongIMGoProto"
+	lru "github.com/hashicorp/golang-lru/v2"
 	bolt "go.etcd.io/bbolt"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 )
 
@@ -35,6 +41,29 @@ type FileStore struct {
 	nodeInFlightDataPrefix string
 	systemUIDsKey          string
 	ipBlacklistKey         string
+	conversationPrefix     string
+
+	conversationStatsLock sync.Mutex
+	lastConversationStats *ConversationStatsReport // 上次最近会话统计结果，用于计算增长率
+
+	channelInfoCache *lru.Cache[string, channelDisplayInfo] // 频道名称和头像缓存
+
+	conversationEvictions     atomic.Int64           // 超过数量上限被淘汰的最近会话数量
+	conversationVersionClamps atomic.Int64           // 版本号不大于已存储的最大版本号被修正的最近会话数量
+	conversationsPurged       atomic.Int64           // 超过ConversationTTL被清理的最近会话数量
+	conversationOps           conversationOpCounters // 按频道类型统计的最近会话操作次数
+
+	conversationCleanupLock   sync.Mutex                // 同时只能有一次清理过期最近会话
+	conversationCleanupCursor conversationCleanupCursor // 上次清理过期最近会话停下的位置
+
+	memoryPressure  atomic.Int32  // 最后一次检查的内存压力等级（MemoryPressureLevel）
+	memoryCheckStop chan struct{} // 停止检查内存使用量
+
+	messageSeqLocator MessageSeqLocator // 查找第一条未读消息时跳过已删除或过期的消息，默认为FileStoreForMsg
+
+	cleanups cleanupRegistry // 删除用户或频道时的清理钩子
+
+	startupCheckReport *StartupCheckReport // 打开数据库时检查最近会话数据的结果
 
 	*FileStoreForMsg
 }
@@ -45,19 +74,27 @@ func NewFileStore(cfg *StoreConfig) *FileStore {
 		cfg:                       cfg,
 		lock:                      keylock.NewKeyLock(),
 		rootBucketPrefix:          "wukongimRoot",
-		messageOfUserCursorPrefix: "messageOfUserCursor:",
-		userTokenPrefix:           "userToken:",
-		channelPrefix:             "channel:",
-		subscribersPrefix:         "subscribers:",
-		denylistPrefix:            "denylist:",
-		allowlistPrefix:           "allowlist:",
+		messageOfUserCursorPrefix: messageOfUserCursorKeyPrefix,
+		userTokenPrefix:           userTokenKeyPrefix,
+		channelPrefix:             channelKeyPrefix,
+		subscribersPrefix:         subscribersKeyPrefix,
+		denylistPrefix:            denylistKeyPrefix,
+		allowlistPrefix:           allowlistKeyPrefix,
 		notifyQueuePrefix:         "notifyQueue",
 		userSeqPrefix:             "userSeq:",
 		nodeInFlightDataPrefix:    "nodeInFlightData",
 		systemUIDsKey:             "systemUIDs",
 		ipBlacklistKey:            "ipBlacklist",
+		conversationPrefix:        conversationKeyPrefix,
 		FileStoreForMsg:           NewFileStoreForMsg(cfg),
 	}
+	cacheSize := cfg.ConversationChannelInfoCacheSize
+	if cacheSize <= 0 {
+		cacheSize = 10000
+	}
+	f.channelInfoCache, _ = lru.New[string, channelDisplayInfo](cacheSize)
+	f.messageSeqLocator = f.FileStoreForMsg
+	f.registerConversationCleanups()
 
 	return f
 }
@@ -87,6 +124,17 @@ func (f *FileStore) Open() error {
 		}
 		return nil
 	})
+	if err == nil && f.cfg.StartupCheck != "" && f.cfg.StartupCheck != StartupCheckOff {
+		if err = f.runStartupCheck(); err != nil { // 不提供可能有损坏的数据
+			f.lock.StopCleanLoop()
+			f.db.Close()
+			return err
+		}
+	}
+	if err == nil && f.cfg.MemoryBudget > 0 {
+		f.memoryCheckStop = make(chan struct{})
+		go f.memoryCheckLoop(f.memoryCheckStop)
+	}
 	return err
 
 }
@@ -113,6 +161,7 @@ func (f *FileStore) GetChannel(channelID string, channelType uint8) (*ChannelInf
 }
 
 func (f *FileStore) GetUserToken(uid string, deviceFlag uint8) (string, uint8, error) {
+	defer f.trace("GetUserToken", uid, time.Now())
 	slotNum := f.slotNum(uid)
 	value, err := f.get(slotNum, []byte(f.getUserTokenKey(uid, deviceFlag)))
 	if err != nil {
@@ -133,6 +182,7 @@ func (f *FileStore) GetUserToken(uid string, deviceFlag uint8) (string, uint8, e
 
 // UpdateUserToken UpdateUserToken
 func (f *FileStore) UpdateUserToken(uid string, deviceFlag uint8, deviceLevel uint8, token string) error {
+	defer f.trace("UpdateUserToken", uid, time.Now())
 	slotNum := f.slotNum(uid)
 	return f.set(slotNum, []byte(f.getUserTokenKey(uid, deviceFlag)), []byte(wkutil.ToJSON(map[string]string{
 		"device_level": fmt.Sprintf("%d", deviceLevel),
@@ -174,6 +224,24 @@ func (f *FileStore) RemoveSubscribers(channelID string, channelType uint8, uids
 	return f.removeList(slotNum, key, uids)
 }
 
+// addSubscribersInTx 在已有的写事务里添加订阅者（和其他修改一起提交）
+func (f *FileStore) addSubscribersInTx(t *bolt.Tx, channelID string, channelType uint8, uids []string) error {
+	bucket, err := f.getSlotBucket(f.slotNumForChannel(channelID, channelType), t)
+	if err != nil {
+		return err
+	}
+	return addListInBucket(bucket, f.getSubscribersKey(channelID, channelType), uids)
+}
+
+// removeSubscribersInTx 在已有的写事务里移除订阅者（和其他修改一起提交）
+func (f *FileStore) removeSubscribersInTx(t *bolt.Tx, channelID string, channelType uint8, uids []string) error {
+	bucket, err := f.getSlotBucket(f.slotNumForChannel(channelID, channelType), t)
+	if err != nil {
+		return err
+	}
+	return removeListInBucket(bucket, f.getSubscribersKey(channelID, channelType), uids)
+}
+
 func (f *FileStore) GetSubscribers(channelID string, channelType uint8) ([]string, error) {
 	key := f.getSubscribersKey(channelID, channelType)
 	slotNum := f.slotNumForChannel(channelID, channelType)
@@ -272,6 +340,7 @@ func (f *FileStore) GetMessageOfUserCursor(uid string) (uint32, error) {
 }
 
 func (f *FileStore) UpdateMessageOfUserCursorIfNeed(uid string, messageSeq uint32) error {
+	defer f.trace("UpdateMessageOfUserCursorIfNeed", uid, time.Now(), zap.Uint32("messageSeq", messageSeq))
 	slot := f.slotNum(uid)
 	lastSeq := f.getTopic(fmt.Sprintf("%s%s", UserQueuePrefix, uid), wkproto.ChannelTypePerson).getLastMsgSeq()
 	actOffset := messageSeq
@@ -435,31 +504,149 @@ func (f *FileStore) GetIPBlacklist() ([]string, error) {
 }
 
 func (f *FileStore) AddOrUpdateConversations(uid string, conversations []*Conversation) error {
-	newConversations, err := f.getNewConversations(uid, conversations)
+	defer f.trace("AddOrUpdateConversations", uid, time.Now(), zap.Int("count", len(conversations)))
+	return wrapError("AddOrUpdateConversations", f.addOrUpdateConversations(uid, conversations), uid, "", 0)
+}
+
+// AddOrUpdateConversationsWithVersions 和AddOrUpdateConversations一样，另外返回版本号被修正（见keepConversationVersionsMonotonic）的最近会话和修正后的版本号
+// 传入的最近会话不会被修改，调用方（比如缓存）需要用返回的版本号更新自己保存的版本号
+func (f *FileStore) AddOrUpdateConversationsWithVersions(uid string, conversations []*Conversation) (map[ConversationKey]int64, error) {
+	defer f.trace("AddOrUpdateConversationsWithVersions", uid, time.Now(), zap.Int("count", len(conversations)))
+	result, err := f.addOrUpdateUserConversations(uid, conversations, false)
 	if err != nil {
-		return err
+		return nil, wrapError("AddOrUpdateConversationsWithVersions", err, uid, "", 0)
 	}
-	key := fmt.Sprintf("conversation:%s", uid)
-	return f.db.Update(func(t *bolt.Tx) error {
+	return result.versions, nil
+}
+
+func (f *FileStore) addOrUpdateConversations(uid string, conversations []*Conversation) error {
+	_, err := f.addOrUpdateUserConversations(uid, conversations, false)
+	return err
+}
+
+// userConversationsWriteResult 写入用户最近会话的结果
+type userConversationsWriteResult struct {
+	skipped  []*Conversation           // onlyNotExist时已存在没有写入的最近会话
+	versions map[ConversationKey]int64 // 版本号被修正的最近会话和修正后的版本号
+}
+
+// addOrUpdateUserConversations 合并并保存用户的最近会话，onlyNotExist为true时在锁里跳过已存在的最近会话（批量预检查之后可能已经被其他写入创建）
+func (f *FileStore) addOrUpdateUserConversations(uid string, conversations []*Conversation, onlyNotExist bool) (*userConversationsWriteResult, error) {
+	if uid == "" {
+		return nil, ErrInvalidConversation
+	}
+	for _, conversation := range conversations {
+		if conversation == nil || !validConversationChannel(conversation.ChannelID, conversation.ChannelType) {
+			return nil, ErrInvalidConversation
+		}
+	}
+	input := conversations
+	conversations = f.dedupeConversations(uid, conversations)
+	key := f.getConversationKey(uid)
+	f.lock.Lock(key) // 和IncConversationUnreadCount互斥，读取和写入之间的未读数修改不会被覆盖
+	defer f.lock.Unlock(key)
+	oldConversations, err := f.getConversations(uid)
+	if err != nil {
+		return nil, err
+	}
+	result := &userConversationsWriteResult{}
+	if onlyNotExist {
+		conversations, result.skipped = splitExistConversations(oldConversations, conversations)
+		if len(conversations) == 0 {
+			return result, nil
+		}
+	}
+	oldLen := len(oldConversations)
+	newConversations := f.mergeNewConversations(oldConversations, conversations)
+	created := append([]*Conversation(nil), newConversations[oldLen:]...)
+	if newConversations, err = f.applyConversationQuota(uid, newConversations, oldLen, conversations); err != nil {
+		return nil, err
+	}
+	if f.cfg.ConversationChannelInfo {
+		f.fillChannelInfo(newConversations)
+	}
+	err = f.update(func(t *bolt.Tx) error {
 		bucket, err := f.getSlotBucketWithKey(uid, t)
 		if err != nil {
 			return err
 		}
-		return bucket.Put([]byte(key), []byte(wkutil.ToJSON(newConversations)))
+		return f.putUserConversationsInTx(bucket, uid, f.encodeConversations(newConversations))
 	})
+	if err != nil {
+		return nil, err
+	}
+	f.conversationOps.addWrites(conversations, created)
+	result.versions = correctedConversationVersions(uid, input, newConversations)
+	return result, nil
+}
+
+// correctedConversationVersions 写入的最近会话里版本号和传入时不同（被修正）的最近会话和修正后的版本号
+func correctedConversationVersions(uid string, input []*Conversation, written []*Conversation) map[ConversationKey]int64 {
+	writtenVersions := make(map[ConversationKey]int64, len(written))
+	for _, conversation := range written {
+		writtenVersions[ConversationKey{ChannelID: conversation.ChannelID, ChannelType: conversation.ChannelType}] = conversation.Version
+	}
+	var versions map[ConversationKey]int64
+	for _, conversation := range input {
+		version, ok := writtenVersions[ConversationKey{ChannelID: conversation.ChannelID, ChannelType: conversation.ChannelType}]
+		if !ok || version == conversation.Version {
+			continue
+		}
+		if versions == nil {
+			versions = make(map[ConversationKey]int64)
+		}
+		versions[ConversationKey{UID: uid, ChannelID: conversation.ChannelID, ChannelType: conversation.ChannelType}] = version
+	}
+	return versions
+}
+
+// splitExistConversations 把conversations分为不在oldConversations里的和已存在的
+func splitExistConversations(oldConversations []*Conversation, conversations []*Conversation) ([]*Conversation, []*Conversation) {
+	notExist := make([]*Conversation, 0, len(conversations))
+	var exist []*Conversation
+	for _, conversation := range conversations {
+		found := false
+		for _, oldConversation := range oldConversations {
+			if oldConversation.ChannelID == conversation.ChannelID && oldConversation.ChannelType == conversation.ChannelType {
+				found = true
+				break
+			}
+		}
+		if found {
+			exist = append(exist, conversation)
+		} else {
+			notExist = append(notExist, conversation)
+		}
+	}
+	return notExist, exist
+}
+
+func containsConversation(conversations []*Conversation, key ConversationKey) bool {
+	for _, conversation := range conversations {
+		if conversation.ChannelID == key.ChannelID && conversation.ChannelType == key.ChannelType {
+			return true
+		}
+	}
+	return false
 }
 
 func (f *FileStore) GetConversations(uid string) ([]*Conversation, error) {
-	key := fmt.Sprintf("conversation:%s", uid)
+	defer f.trace("GetConversations", uid, time.Now())
+	conversations, err := f.getConversations(uid)
+	return conversations, wrapError("GetConversations", err, uid, "", 0)
+}
+
+func (f *FileStore) getConversations(uid string) ([]*Conversation, error) {
+	key := f.getConversationKey(uid)
 	var conversations []*Conversation
-	err := f.db.View(func(t *bolt.Tx) error {
+	err := f.view(func(t *bolt.Tx) error {
 		bucket, err := f.getSlotBucketWithKey(uid, t)
 		if err != nil {
 			return err
 		}
 		value := bucket.Get([]byte(key))
 		if len(value) > 0 {
-			err = wkutil.ReadJSONByByte(value, &conversations)
+			conversations, err = decodeConversations(value, false)
 			return err
 		}
 		return nil
@@ -469,7 +656,12 @@ func (f *FileStore) GetConversations(uid string) ([]*Conversation, error) {
 }
 
 func (f *FileStore) GetConversation(uid string, channelID string, channelType uint8) (*Conversation, error) {
-	conversations, err := f.GetConversations(uid)
+	conversation, err := f.getConversation(uid, channelID, channelType)
+	return conversation, wrapError("GetConversation", err, uid, channelID, channelType)
+}
+
+func (f *FileStore) getConversation(uid string, channelID string, channelType uint8) (*Conversation, error) {
+	conversations, err := f.getConversations(uid)
 	if err != nil {
 		return nil, err
 	}
@@ -483,27 +675,241 @@ func (f *FileStore) GetConversation(uid string, channelID string, channelType ui
 	return nil, nil
 }
 func (f *FileStore) DeleteConversation(uid string, channelID string, channelType uint8) error {
-	conversations, err := f.GetConversations(uid)
+	defer f.trace("DeleteConversation", uid, time.Now(), zap.String("channelID", channelID), zap.Uint8("channelType", channelType))
+	return wrapError("DeleteConversation", f.deleteConversation(uid, channelID, channelType), uid, channelID, channelType)
+}
+
+func (f *FileStore) deleteConversation(uid string, channelID string, channelType uint8) error {
+	key := f.getConversationKey(uid)
+	f.lock.Lock(key)
+	defer f.lock.Unlock(key)
+	conversations, err := f.getConversations(uid)
 	if err != nil {
 		return err
 	}
-	newConversations := make([]*Conversation, 0, len(conversations))
-	if len(conversations) > 0 {
-		for _, conversation := range conversations {
-			if !(conversation.ChannelID == channelID && conversation.ChannelType == channelType) {
-				newConversations = append(newConversations, conversation)
-			}
+	newConversations := removeConversation(conversations, channelID, channelType)
+	removed := make([]*Conversation, 0, 1)
+	for _, conversation := range conversations {
+		if conversation.ChannelID == channelID && conversation.ChannelType == channelType {
+			removed = append(removed, conversation)
 		}
 	}
 
-	key := fmt.Sprintf("conversation:%s", uid)
-	return f.db.Update(func(t *bolt.Tx) error {
+	err = f.update(func(t *bolt.Tx) error {
 		bucket, err := f.getSlotBucketWithKey(uid, t)
 		if err != nil {
 			return err
 		}
-		return bucket.Put([]byte(key), []byte(wkutil.ToJSON(newConversations)))
+		// 先写删除记录，之后写入的最近会话版本号都大于删除记录的
+		if err = f.putConversationTombstonesInTx(bucket, uid, conversations, removed); err != nil {
+			return err
+		}
+		return f.putUserConversationsInTx(bucket, uid, f.encodeConversations(newConversations))
+	})
+	if err != nil {
+		return err
+	}
+	f.conversationOps.add(ConversationOpDelete, channelType, int64(len(conversations)-len(newConversations)))
+	return nil
+}
+
+// removeConversation 返回去掉指定频道后的最近会话
+func removeConversation(conversations []*Conversation, channelID string, channelType uint8) []*Conversation {
+	newConversations := make([]*Conversation, 0, len(conversations))
+	for _, conversation := range conversations {
+		if !(conversation.ChannelID == channelID && conversation.ChannelType == channelType) {
+			newConversations = append(newConversations, conversation)
+		}
+	}
+	return newConversations
+}
+
+func (f *FileStore) ExistConversation(uid string, channelID string, channelType uint8) (bool, error) {
+	conversation, err := f.getConversation(uid, channelID, channelType)
+	if err != nil {
+		return false, wrapError("ExistConversation", err, uid, channelID, channelType)
+	}
+	return conversation != nil, nil
+}
+
+// ExistConversations 先按槽位对uid分组，每个槽位使用一个游标按key顺序依次seek，避免每个用户单独开启一次查询
+func (f *FileStore) ExistConversations(items []ConversationKey) (map[int]bool, error) {
+	result, err := f.existConversations(items)
+	return result, wrapError("ExistConversations", err, "", "", 0)
+}
+
+func (f *FileStore) existConversations(items []ConversationKey) (map[int]bool, error) {
+	result := make(map[int]bool, len(items))
+	if len(items) == 0 {
+		return result, nil
+	}
+	slotUIDIndexs := make(map[uint32]map[string][]int)
+	for idx, item := range items {
+		result[idx] = false
+		slot := f.slotNum(item.UID)
+		uidIndexs := slotUIDIndexs[slot]
+		if uidIndexs == nil {
+			uidIndexs = make(map[string][]int)
+			slotUIDIndexs[slot] = uidIndexs
+		}
+		uidIndexs[item.UID] = append(uidIndexs[item.UID], idx)
+	}
+
+	err := f.view(func(t *bolt.Tx) error {
+		for slot, uidIndexs := range slotUIDIndexs {
+			bucket, err := f.getSlotBucket(slot, t)
+			if err != nil {
+				return err
+			}
+			uids := make([]string, 0, len(uidIndexs))
+			for uid := range uidIndexs {
+				uids = append(uids, uid)
+			}
+			sort.Strings(uids) // uid有序则key有序，游标只需向前移动
+
+			cursor := bucket.Cursor()
+			for _, uid := range uids {
+				key := []byte(f.getConversationKey(uid))
+				k, v := cursor.Seek(key)
+				if !bytes.Equal(k, key) || len(v) == 0 {
+					continue
+				}
+				conversations, err := decodeConversations(v, true) // 只需要解码频道信息
+				if err != nil {
+					return err
+				}
+				for _, idx := range uidIndexs[uid] {
+					item := items[idx]
+					for _, conversation := range conversations {
+						if conversation.ChannelID == item.ChannelID && conversation.ChannelType == item.ChannelType {
+							result[idx] = true
+							break
+						}
+					}
+				}
+			}
+		}
+		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ConversationBatchResult 批量写入多个用户的最近会话的结果
+// 每个用户的最近会话在一个写事务里写入，一个用户写入失败不影响其他用户，调用方只需要重试Failed
+type ConversationBatchResult struct {
+	Written []ConversationKey // 已经写入的最近会话
+	Skipped []ConversationKey // 已存在没有写入的最近会话
+	Failed  []ConversationKey // 写入失败的最近会话（同一个用户的一起失败）
+}
+
+// AddOrUpdateConversationsBatchIfNotExist 批量添加多个用户的最近会话，已存在的最近会话不做处理
+// 有用户写入失败时继续写入其他用户，返回所有失败用户的错误，result里是每条最近会话是否已经写入
+func (f *FileStore) AddOrUpdateConversationsBatchIfNotExist(conversations []*Conversation) (*ConversationBatchResult, error) {
+	result := &ConversationBatchResult{}
+	if len(conversations) == 0 {
+		return result, nil
+	}
+	items := make([]ConversationKey, 0, len(conversations))
+	for _, conversation := range conversations {
+		items = append(items, ConversationKey{
+			UID:         conversation.UID,
+			ChannelID:   conversation.ChannelID,
+			ChannelType: conversation.ChannelType,
+		})
+	}
+	existMap, err := f.existConversations(items)
+	if err != nil {
+		result.Failed = items
+		return result, wrapError("AddOrUpdateConversationsBatchIfNotExist", err, "", "", 0)
+	}
+	uids := make([]string, 0)
+	userConversationMap := make(map[string][]*Conversation)
+	userKeyMap := make(map[string][]ConversationKey)
+	for idx, conversation := range conversations {
+		if existMap[idx] {
+			result.Skipped = append(result.Skipped, items[idx])
+			continue
+		}
+		if _, ok := userConversationMap[conversation.UID]; !ok {
+			uids = append(uids, conversation.UID)
+		}
+		userConversationMap[conversation.UID] = append(userConversationMap[conversation.UID], conversation)
+		userKeyMap[conversation.UID] = append(userKeyMap[conversation.UID], items[idx])
+	}
+	// 预检查和写入之间其他写入可能已经创建了最近会话，写入时在用户的锁里再检查一次，已存在的不覆盖
+	var errs []error
+	for _, uid := range uids {
+		written, err := f.addOrUpdateUserConversations(uid, userConversationMap[uid], true)
+		if err != nil {
+			result.Failed = append(result.Failed, userKeyMap[uid]...)
+			errs = append(errs, wrapError("AddOrUpdateConversationsBatchIfNotExist", err, uid, "", 0))
+			continue
+		}
+		for _, key := range userKeyMap[uid] {
+			if containsConversation(written.skipped, key) {
+				result.Skipped = append(result.Skipped, key)
+			} else {
+				result.Written = append(result.Written, key)
+			}
+		}
+	}
+	return result, errors.Join(errs...)
+}
+
+// OnMessagesExpired 按槽位分批修正本地用户此频道的最近会话，返回涉及的最近会话
+func (f *FileStore) OnMessagesExpired(channelID string, channelType uint8, uptoSeq uint32) ([]ConversationKey, error) {
+	keys, err := f.onMessagesExpired(channelID, channelType, uptoSeq)
+	return keys, wrapError("OnMessagesExpired", err, "", channelID, channelType)
+}
+
+func (f *FileStore) onMessagesExpired(channelID string, channelType uint8, uptoSeq uint32) ([]ConversationKey, error) {
+	keys, _, err := f.forEachChannelConversation(channelID, channelType, "OnMessagesExpired", MaintenanceOptions{}, func(uid string, conversations []*Conversation, idx int) ([]*Conversation, bool, error) {
+		return conversations, conversations[idx].ClampExpired(uptoSeq), nil
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// OnMessageRecalled 按槽位分批修正本地用户此频道的最近会话（未读数和最后一条消息），返回涉及的最近会话，同一条消息已经撤回过时不修改并返回空
+func (f *FileStore) OnMessageRecalled(channelID string, channelType uint8, messageSeq uint32) ([]ConversationKey, error) {
+	keys, err := f.onMessageRecalled(channelID, channelType, messageSeq)
+	return keys, wrapError("OnMessageRecalled", err, "", channelID, channelType)
+}
+
+// OnMessageEdited 按槽位分批更新最后一条消息是messageSeq的本地用户最近会话的数据版本，返回涉及的最近会话
+func (f *FileStore) OnMessageEdited(channelID string, channelType uint8, messageSeq uint32) ([]ConversationKey, error) {
+	keys, _, err := f.forEachChannelConversation(channelID, channelType, "OnMessageEdited", MaintenanceOptions{}, func(uid string, conversations []*Conversation, idx int) ([]*Conversation, bool, error) {
+		return conversations, conversations[idx].Edit(messageSeq), nil
+	}, nil)
+	return keys, wrapError("OnMessageEdited", err, "", channelID, channelType)
+}
+
+// getConversationKeysOfChannel 获取频道的本地用户对应的最近会话
+// 个人频道的频道ID为fromUID@toUID，双方最近会话的频道ID为对方的uid，其他频道为频道的订阅者
+func (f *FileStore) getConversationKeysOfChannel(channelID string, channelType uint8) ([]ConversationKey, error) {
+	if channelType == wkproto.ChannelTypePerson {
+		uids := strings.Split(channelID, "@")
+		if len(uids) == 2 {
+			return []ConversationKey{
+				{UID: uids[0], ChannelID: uids[1], ChannelType: channelType},
+				{UID: uids[1], ChannelID: uids[0], ChannelType: channelType},
+			}, nil
+		}
+	}
+	subscribers, err := f.GetSubscribers(channelID, channelType)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]ConversationKey, 0, len(subscribers))
+	for _, subscriber := range subscribers {
+		keys = append(keys, ConversationKey{UID: subscriber, ChannelID: channelID, ChannelType: channelType})
+	}
+	return keys, nil
 }
 
 func (f *FileStore) AppendMessageOfNotifyQueue(messages []Message) error {
@@ -575,12 +981,34 @@ func (f *FileStore) GetMessagesOfNotifyQueue(count int) ([]Message, error) {
 
 func (f *FileStore) Close() error {
 	f.lock.StopCleanLoop()
+	if f.memoryCheckStop != nil {
+		close(f.memoryCheckStop)
+		f.memoryCheckStop = nil
+	}
 	f.FileStoreForMsg.Close()
 	f.db.Close()
 	return nil
 
 }
 
+// trace 打印慢操作日志，如果操作的uid是调试uid则打印详细日志
+func (f *FileStore) trace(op string, uid string, start time.Time, fields ...zap.Field) {
+	threshold := currentSlowLogThreshold()
+	debug := isDebugUID(uid)
+	if threshold == 0 && !debug {
+		return
+	}
+	cost := time.Since(start)
+	fields = append(fields, zap.String("op", op), zap.String("uid", uid), zap.Duration("cost", cost))
+	if threshold > 0 && cost >= threshold {
+		f.Warn("slow operation", fields...)
+		return
+	}
+	if debug {
+		f.Info("debug uid operation", fields...)
+	}
+}
+
 func (f *FileStore) get(slot uint32, key []byte) ([]byte, error) {
 	var value []byte
 	err := f.db.View(func(t *bolt.Tx) error {
@@ -594,20 +1022,18 @@ func (f *FileStore) get(slot uint32, key []byte) ([]byte, error) {
 	return value, err
 }
 
-func (f *FileStore) getNewConversations(uid string, updateConversations []*Conversation) ([]*Conversation, error) {
-	oldConversations, err := f.GetConversations(uid)
-	if err != nil {
-		return nil, err
-	}
-
+// mergeNewConversations 把更新的最近会话合并到已存储的最近会话，新增的追加在后面
+func (f *FileStore) mergeNewConversations(oldConversations []*Conversation, updateConversations []*Conversation) []*Conversation {
 	newConversations := make([]*Conversation, 0, len(oldConversations)+len(updateConversations))
 	newConversations = append(newConversations, oldConversations...)
-	for _, updateConversation := range updateConversations {
+	for _, update := range updateConversations {
+		copied := *update // 之后会修正版本号和填充频道信息，不修改调用方的（比如缓存里的）最近会话
+		updateConversation := &copied
 		var existConversation *Conversation
 		var existIndex = 0
 		for idx, oldConversation := range oldConversations {
 			if updateConversation.ChannelID == oldConversation.ChannelID && updateConversation.ChannelType == oldConversation.ChannelType {
-				existConversation = updateConversation
+				existConversation = mergeConversationFields(updateConversation, oldConversation)
 				existIndex = idx
 				break
 			}
@@ -618,7 +1044,8 @@ func (f *FileStore) getNewConversations(uid string, updateConversations []*Conve
 			newConversations[existIndex] = existConversation
 		}
 	}
-	return newConversations, nil
+	f.keepConversationVersionsMonotonic(snapshotConversations(oldConversations), newConversations)
+	return newConversations
 }
 
 func (f *FileStore) getRootBucket(t *bolt.Tx) *bolt.Bucket {
@@ -630,7 +1057,11 @@ func (f *FileStore) getSlotBucketWithKey(key string, t *bolt.Tx) (*bolt.Bucket,
 	return f.getSlotBucket(slot, t)
 }
 func (f *FileStore) getSlotBucket(slotNum uint32, t *bolt.Tx) (*bolt.Bucket, error) {
-	return t.Bucket([]byte(fmt.Sprintf("%d", slotNum))), nil
+	bucket := t.Bucket([]byte(fmt.Sprintf("%d", slotNum)))
+	if bucket == nil {
+		return nil, fmt.Errorf("slot bucket %d: %w", slotNum, ErrNotFound)
+	}
+	return bucket, nil
 }
 
 func (f *FileStore) getUserTokenKey(uid string, deviceFlag uint8) string {
@@ -651,6 +1082,10 @@ func (f *FileStore) getAllowlistKey(channelID string, channelType uint8) string
 	return fmt.Sprintf("%s%s-%d", f.allowlistPrefix, channelID, channelType)
 }
 
+func (f *FileStore) getConversationKey(uid string) string {
+	return fmt.Sprintf("%s%s", f.conversationPrefix, uid)
+}
+
 func (f *FileStore) getMessageOfUserCursorKey(uid string) string {
 	return fmt.Sprintf("%s%s", f.messageOfUserCursorPrefix, uid)
 }
@@ -681,29 +1116,33 @@ func (f *FileStore) removeList(slotNum uint32, key string, uids []string) error
 		if err != nil {
 			return err
 		}
-		value := bucket.Get([]byte(key))
-		list := make([]string, 0)
-		if len(value) > 0 {
-			values := strings.Split(string(value), ",")
-			if len(values) > 0 {
-				for _, v := range values {
-					var has = false
-					for _, uid := range uids {
-						if v == uid {
-							has = true
-							break
-						}
-					}
-					if !has {
-						list = append(list, v)
+		return removeListInBucket(bucket, key, uids)
+	})
+	return err
+
+}
+
+func removeListInBucket(bucket *bolt.Bucket, key string, uids []string) error {
+	value := bucket.Get([]byte(key))
+	list := make([]string, 0)
+	if len(value) > 0 {
+		values := strings.Split(string(value), ",")
+		if len(values) > 0 {
+			for _, v := range values {
+				var has = false
+				for _, uid := range uids {
+					if v == uid {
+						has = true
+						break
 					}
 				}
+				if !has {
+					list = append(list, v)
+				}
 			}
 		}
-		return bucket.Put([]byte(key), []byte(strings.Join(list, ",")))
-	})
-	return err
-
+	}
+	return bucket.Put([]byte(key), []byte(strings.Join(list, ",")))
 }
 
 func (f *FileStore) getList(slotNum uint32, key string) ([]string, error) {
@@ -735,20 +1174,24 @@ func (f *FileStore) addList(slotNum uint32, key string, valueList []string) erro
 		if err != nil {
 			return err
 		}
-		value := bucket.Get([]byte(key))
-		list := make([]string, 0)
-		if len(value) > 0 {
-			values := strings.Split(string(value), ",")
-			if len(values) > 0 {
-				list = append(list, values...)
-			}
-		}
-		list = append(list, valueList...)
-		return bucket.Put([]byte(key), []byte(strings.Join(list, ",")))
+		return addListInBucket(bucket, key, valueList)
 	})
 	return err
 }
 
+func addListInBucket(bucket *bolt.Bucket, key string, valueList []string) error {
+	value := bucket.Get([]byte(key))
+	list := make([]string, 0)
+	if len(value) > 0 {
+		values := strings.Split(string(value), ",")
+		if len(values) > 0 {
+			list = append(list, values...)
+		}
+	}
+	list = append(list, valueList...)
+	return bucket.Put([]byte(key), []byte(strings.Join(list, ",")))
+}
+
 func (f *FileStore) set(slot uint32, key []byte, value []byte) error {
 	err := f.db.Update(func(t *bolt.Tx) error {
 		bucket, err := f.getSlotBucket(slot, t)
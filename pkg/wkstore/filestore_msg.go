@@ -129,6 +129,21 @@ func (f *FileStoreForMsg) LoadNextRangeMsgs(channelID string, channelType uint8,
 	return messages, err
 }
 
+// NextMessageSeq 频道内seq在[startMessageSeq,endMessageSeq]之间第一条存在的消息seq，没有返回false
+func (f *FileStoreForMsg) NextMessageSeq(channelID string, channelType uint8, startMessageSeq, endMessageSeq uint32) (uint32, bool, error) {
+	if startMessageSeq > endMessageSeq {
+		return 0, false, nil
+	}
+	messages, err := f.LoadNextRangeMsgs(channelID, channelType, startMessageSeq, endMessageSeq+1, 1)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(messages) == 0 {
+		return 0, false, nil
+	}
+	return messages[0].GetSeq(), true, nil
+}
+
 func (f *FileStoreForMsg) DeleteChannelAndClearMessages(channelID string, channelType uint8) error {
 	f.Warn("暂未实现DeleteChannelAndClearMessages")
 
@@ -1,9 +1,14 @@
 package wkstore
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -41,3 +46,1559 @@ func TestFileWriteAndRead(t *testing.T) {
 	fmt.Println("zzz--->", string(testBytes[:n]))
 
 }
+
+func newTestFileStore(t testing.TB) *FileStore {
+	cfg := NewStoreConfig()
+	cfg.DataDir = t.TempDir()
+	store := NewFileStore(cfg)
+	err := store.Open()
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		store.Close()
+	})
+	return store
+}
+
+func TestExistConversations(t *testing.T) {
+	store := newTestFileStore(t)
+
+	err := store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2},
+		{UID: "u1", ChannelID: "u2", ChannelType: 1},
+	})
+	assert.NoError(t, err)
+	err = store.AddOrUpdateConversations("u2", []*Conversation{
+		{UID: "u2", ChannelID: "g1", ChannelType: 2},
+	})
+	assert.NoError(t, err)
+
+	existMap, err := store.ExistConversations([]ConversationKey{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2},
+		{UID: "u1", ChannelID: "g1", ChannelType: 1},
+		{UID: "u2", ChannelID: "g1", ChannelType: 2},
+		{UID: "u3", ChannelID: "g1", ChannelType: 2},
+		{UID: "u1", ChannelID: "u2", ChannelType: 1},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]bool{0: true, 1: false, 2: true, 3: false, 4: true}, existMap)
+
+	exist, err := store.ExistConversation("u2", "g1", 2)
+	assert.NoError(t, err)
+	assert.True(t, exist)
+}
+
+func TestAddOrUpdateConversationsBatchIfNotExist(t *testing.T) {
+	store := newTestFileStore(t)
+
+	err := store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 5},
+	})
+	assert.NoError(t, err)
+
+	result, err := store.AddOrUpdateConversationsBatchIfNotExist([]*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 1},
+		{UID: "u1", ChannelID: "g2", ChannelType: 2, UnreadCount: 1},
+		{UID: "u2", ChannelID: "g1", ChannelType: 2, UnreadCount: 1},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []ConversationKey{{UID: "u1", ChannelID: "g1", ChannelType: 2}}, result.Skipped)
+	assert.Equal(t, []ConversationKey{{UID: "u1", ChannelID: "g2", ChannelType: 2}, {UID: "u2", ChannelID: "g1", ChannelType: 2}}, result.Written)
+	assert.Empty(t, result.Failed)
+
+	conversation, err := store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, conversation.UnreadCount) // 已存在的不覆盖
+
+	conversations, err := store.GetConversations("u1")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(conversations))
+
+	exist, err := store.ExistConversation("u2", "g1", 2)
+	assert.NoError(t, err)
+	assert.True(t, exist)
+}
+
+func TestAddOrUpdateConversationsBatchIfNotExistConcurrent(t *testing.T) {
+	store := newTestFileStore(t)
+
+	// 并发写入同一个最近会话，只有一个写入，其他的在锁里检查到已存在后跳过
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		written int
+		skipped int
+	)
+	for i := 1; i <= 50; i++ {
+		wg.Add(1)
+		go func(unread int) {
+			defer wg.Done()
+			result, err := store.AddOrUpdateConversationsBatchIfNotExist([]*Conversation{
+				{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: unread},
+			})
+			assert.NoError(t, err)
+			mu.Lock()
+			written += len(result.Written)
+			skipped += len(result.Skipped)
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 1, written)
+	assert.Equal(t, 49, skipped)
+}
+
+func TestAddOrUpdateConversationsBatchIfNotExistPartialFailure(t *testing.T) {
+	store := newTestFileStore(t)
+
+	// u2写入失败不影响前后的用户，返回失败的最近会话和错误
+	result, err := store.AddOrUpdateConversationsBatchIfNotExist([]*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2},
+		{UID: "u2", ChannelID: "g1", ChannelType: 2},
+		{UID: "u2", ChannelID: "g2", ChannelType: ReservedChannelType},
+		{UID: "u3", ChannelID: "g1", ChannelType: 2},
+	})
+	assert.ErrorIs(t, err, ErrInvalidConversation)
+	assert.Equal(t, []ConversationKey{{UID: "u1", ChannelID: "g1", ChannelType: 2}, {UID: "u3", ChannelID: "g1", ChannelType: 2}}, result.Written)
+	assert.Equal(t, []ConversationKey{{UID: "u2", ChannelID: "g1", ChannelType: 2}, {UID: "u2", ChannelID: "g2", ChannelType: ReservedChannelType}}, result.Failed)
+
+	for uid, expected := range map[string]bool{"u1": true, "u2": false, "u3": true} {
+		exist, err := store.ExistConversation(uid, "g1", 2)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, exist, uid)
+	}
+}
+
+func prepareFanoutConversations(b *testing.B, store *FileStore, recipientCount int) []ConversationKey {
+	items := make([]ConversationKey, 0, recipientCount)
+	for i := 0; i < recipientCount; i++ {
+		uid := fmt.Sprintf("user%d", i)
+		items = append(items, ConversationKey{UID: uid, ChannelID: "group1", ChannelType: 2})
+		if i%2 == 0 {
+			err := store.AddOrUpdateConversations(uid, []*Conversation{
+				{UID: uid, ChannelID: "group1", ChannelType: 2},
+			})
+			assert.NoError(b, err)
+		}
+	}
+	return items
+}
+
+func BenchmarkExistConversationLoop(b *testing.B) {
+	store := newTestFileStore(b)
+	items := prepareFanoutConversations(b, store, 5000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, item := range items {
+			_, err := store.ExistConversation(item.UID, item.ChannelID, item.ChannelType)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkExistConversations(b *testing.B) {
+	store := newTestFileStore(b)
+	items := prepareFanoutConversations(b, store, 5000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := store.ExistConversations(items)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestConversationStats(t *testing.T) {
+	store := newTestFileStore(t)
+	store.cfg.ScanBatchSize = 2
+	store.cfg.ScanBatchBackoff = 0
+	store.cfg.ConversationStatsThresholds = []int{5}
+	store.cfg.ConversationStatsMaxUIDs = 1
+
+	for i := 1; i <= 10; i++ {
+		uid := fmt.Sprintf("u%d", i)
+		conversations := make([]*Conversation, 0, i)
+		for j := 0; j < i; j++ {
+			conversations = append(conversations, &Conversation{UID: uid, ChannelID: fmt.Sprintf("g%d", j), ChannelType: 2})
+		}
+		err := store.AddOrUpdateConversations(uid, conversations)
+		assert.NoError(t, err)
+	}
+
+	report, err := store.ConversationStats(context.Background(), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, report.TotalUsers)
+	assert.Equal(t, 10, report.SampledUsers)
+	assert.Equal(t, 5, report.P50)
+	assert.Equal(t, 10, report.P95)
+	assert.Equal(t, 10, report.Max)
+	assert.Equal(t, 5.5, report.AvgConversations)
+	assert.Equal(t, int64(55), report.EstimatedConversations)
+	assert.Equal(t, 5, report.Thresholds[0].Count)
+	assert.Equal(t, []string{"u10"}, report.Thresholds[0].UIDs)
+
+	report, err = store.ConversationStats(context.Background(), 3)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, report.TotalUsers)
+	assert.Equal(t, 3, report.SampledUsers)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = store.ConversationStats(ctx, 0)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestOnMessagesExpired(t *testing.T) {
+	store := newTestFileStore(t)
+	err := store.AddSubscribers("g1", 2, []string{"u1", "u2"})
+	assert.NoError(t, err)
+
+	err = store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 5, LastMsgSeq: 10, LastClientMsgNo: "no10", LastMsgID: 100},
+	})
+	assert.NoError(t, err)
+	err = store.AddOrUpdateConversations("u2", []*Conversation{
+		{UID: "u2", ChannelID: "g1", ChannelType: 2, UnreadCount: 2, LastMsgSeq: 10, LastClientMsgNo: "no10", LastMsgID: 100},
+	})
+	assert.NoError(t, err)
+
+	// 较早的消息过期，最后一条消息还在
+	keys, err := store.OnMessagesExpired("g1", 2, 7)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(keys))
+
+	conversation, err := store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, conversation.UnreadCount)
+	assert.Equal(t, "no10", conversation.LastClientMsgNo)
+	assert.Equal(t, int64(100), conversation.LastMsgID)
+
+	conversation, err = store.GetConversation("u2", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, conversation.UnreadCount) // 未读的消息都没过期
+
+	// 最后一条消息过期
+	_, err = store.OnMessagesExpired("g1", 2, 10)
+	assert.NoError(t, err)
+
+	conversation, err = store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, conversation.UnreadCount)
+	assert.Equal(t, "", conversation.LastClientMsgNo)
+	assert.Equal(t, int64(0), conversation.LastMsgID)
+	assert.Equal(t, uint32(10), conversation.LastMsgSeq)
+}
+
+func TestOnMessagesExpiredForPerson(t *testing.T) {
+	store := newTestFileStore(t)
+	err := store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "u2", ChannelType: 1, UnreadCount: 1, LastMsgSeq: 3, LastClientMsgNo: "no3", LastMsgID: 3},
+	})
+	assert.NoError(t, err)
+
+	_, err = store.OnMessagesExpired("u1@u2", 1, 3)
+	assert.NoError(t, err)
+
+	conversation, err := store.GetConversation("u1", "u2", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, conversation.UnreadCount)
+	assert.Equal(t, "", conversation.LastClientMsgNo)
+}
+
+func TestOnMessageRecalled(t *testing.T) {
+	store := newTestFileStore(t)
+	err := store.AddSubscribers("g1", 2, []string{"u1", "u2"})
+	assert.NoError(t, err)
+
+	err = store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 3, LastMsgSeq: 10, LastClientMsgNo: "no10", LastMsgID: 100},
+	})
+	assert.NoError(t, err)
+	err = store.AddOrUpdateConversations("u2", []*Conversation{
+		{UID: "u2", ChannelID: "g1", ChannelType: 2, UnreadCount: 0, LastMsgSeq: 10, LastClientMsgNo: "no10", LastMsgID: 100},
+	})
+	assert.NoError(t, err)
+
+	// 撤回u1未读的消息，不是最后一条消息
+	keys, err := store.OnMessageRecalled("g1", 2, 9)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(keys))
+
+	conversation, err := store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, conversation.UnreadCount)
+	assert.Equal(t, "no10", conversation.LastClientMsgNo)
+	conversation, err = store.GetConversation("u2", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, conversation.UnreadCount)
+
+	// 撤回u1已读的消息
+	_, err = store.OnMessageRecalled("g1", 2, 8)
+	assert.NoError(t, err)
+	conversation, err = store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, conversation.UnreadCount)
+
+	// 撤回最后一条消息
+	_, err = store.OnMessageRecalled("g1", 2, 10)
+	assert.NoError(t, err)
+	conversation, err = store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, conversation.UnreadCount)
+	assert.Equal(t, "", conversation.LastClientMsgNo)
+	assert.Equal(t, int64(0), conversation.LastMsgID)
+	assert.Equal(t, uint32(10), conversation.LastMsgSeq)
+	conversation, err = store.GetConversation("u2", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, conversation.UnreadCount)
+	assert.Equal(t, "", conversation.LastClientMsgNo)
+
+	// 重试撤回同一条消息不会再减少未读数
+	keys, err = store.OnMessageRecalled("g1", 2, 9)
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+	conversation, err = store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, conversation.UnreadCount)
+}
+
+func TestOnMessageEdited(t *testing.T) {
+	store := newTestFileStore(t)
+	err := store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "u2", ChannelType: 1, UnreadCount: 1, LastMsgSeq: 3, LastClientMsgNo: "no3", LastMsgID: 3, Version: 1},
+	})
+	assert.NoError(t, err)
+
+	// 不是最后一条消息不修改
+	_, err = store.OnMessageEdited("u1@u2", 1, 2)
+	assert.NoError(t, err)
+	conversation, err := store.GetConversation("u1", "u2", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), conversation.Version)
+
+	_, err = store.OnMessageEdited("u1@u2", 1, 3)
+	assert.NoError(t, err)
+	conversation, err = store.GetConversation("u1", "u2", 1)
+	assert.NoError(t, err)
+	assert.Greater(t, conversation.Version, int64(1))
+	assert.Equal(t, 1, conversation.UnreadCount)
+	assert.Equal(t, "no3", conversation.LastClientMsgNo)
+}
+
+func TestConversationErrorWrap(t *testing.T) {
+	store := newTestFileStore(t)
+
+	err := store.AddOrUpdateConversations("u1", []*Conversation{{UID: "u1", ChannelType: 2}})
+	assert.ErrorIs(t, err, ErrInvalidConversation)
+	assert.Contains(t, err.Error(), "AddOrUpdateConversations")
+	assert.Contains(t, err.Error(), "uid=u1")
+
+	err = store.db.Close()
+	assert.NoError(t, err)
+
+	_, err = store.GetConversation("u1", "g1", 2)
+	assert.ErrorIs(t, err, ErrDBClosed)
+	assert.Contains(t, err.Error(), "GetConversation uid=u1 channel=g1/2")
+
+	err = store.DeleteConversation("u2", "g2", 2)
+	assert.ErrorIs(t, err, ErrDBClosed)
+	assert.Contains(t, err.Error(), "DeleteConversation uid=u2 channel=g2/2")
+
+	_, err = store.ExistConversations([]ConversationKey{{UID: "u1", ChannelID: "g1", ChannelType: 2}})
+	assert.ErrorIs(t, err, ErrDBClosed)
+	assert.Contains(t, err.Error(), "ExistConversations")
+
+	_, err = NewFileStore(NewStoreConfig()).GetConversations("u3") // 未打开
+	assert.ErrorIs(t, err, ErrDBClosed)
+}
+
+func TestRefreshConversationChannelInfo(t *testing.T) {
+	store := newTestFileStore(t)
+	store.cfg.ConversationChannelInfo = true
+	err := store.AddSubscribers("g1", 2, []string{"u1", "u2"})
+	assert.NoError(t, err)
+
+	err = store.AddOrUpdateConversations("u1", []*Conversation{{UID: "u1", ChannelID: "g1", ChannelType: 2, Version: 1}})
+	assert.NoError(t, err)
+	err = store.AddOrUpdateConversations("u2", []*Conversation{{UID: "u2", ChannelID: "g1", ChannelType: 2, Version: 1}})
+	assert.NoError(t, err)
+
+	// 频道改名后所有订阅者的最近会话都更新
+	keys, err := store.RefreshConversationChannelInfo("g1", 2, "group1", "avatar1")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(keys))
+	for _, uid := range []string{"u1", "u2"} {
+		conversation, err := store.GetConversation(uid, "g1", 2)
+		assert.NoError(t, err)
+		assert.Equal(t, "group1", conversation.ChannelName)
+		assert.Equal(t, "avatar1", conversation.ChannelAvatar)
+		assert.Greater(t, conversation.Version, int64(1))
+	}
+
+	// 更新最近会话时没有带频道信息，保留原来的
+	err = store.AddOrUpdateConversations("u1", []*Conversation{{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 1}})
+	assert.NoError(t, err)
+	conversation, err := store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, conversation.UnreadCount)
+	assert.Equal(t, "group1", conversation.ChannelName)
+
+	// 没有开启时不处理
+	store.cfg.ConversationChannelInfo = false
+	keys, err = store.RefreshConversationChannelInfo("g1", 2, "group2", "avatar2")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(keys))
+	conversation, err = store.GetConversation("u2", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, "group1", conversation.ChannelName)
+}
+
+func TestConversationChannelInfoLazyRefresh(t *testing.T) {
+	store := newTestFileStore(t)
+	store.cfg.ConversationChannelInfo = true
+
+	// 个人频道没有订阅者，只更新缓存
+	keys, err := store.RefreshConversationChannelInfo("u2", 1, "user2", "avatar2")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(keys))
+
+	// 写入时使用缓存里的频道信息，调用方的数据不被修改
+	update := &Conversation{UID: "u1", ChannelID: "u2", ChannelType: 1, ChannelName: "old", Version: 1}
+	err = store.AddOrUpdateConversations("u1", []*Conversation{update})
+	assert.NoError(t, err)
+	assert.Equal(t, "old", update.ChannelName)
+
+	conversation, err := store.GetConversation("u1", "u2", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "user2", conversation.ChannelName)
+	assert.Equal(t, "avatar2", conversation.ChannelAvatar)
+
+	// 没有缓存的频道保持原样
+	err = store.AddOrUpdateConversations("u1", []*Conversation{{UID: "u1", ChannelID: "u3", ChannelType: 1, ChannelName: "user3"}})
+	assert.NoError(t, err)
+	conversation, err = store.GetConversation("u1", "u3", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "user3", conversation.ChannelName)
+}
+
+func TestConversationQuotaReject(t *testing.T) {
+	store := newTestFileStore(t)
+	store.cfg.MaxConversationsPerUser = 2
+	store.cfg.ConversationQuotaExemptChannelTypes = []uint8{9}
+
+	err := store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2},
+		{UID: "u1", ChannelID: "g2", ChannelType: 2},
+	})
+	assert.NoError(t, err) // 刚好达到上限
+
+	err = store.AddOrUpdateConversations("u1", []*Conversation{{UID: "u1", ChannelID: "g3", ChannelType: 2}})
+	assert.ErrorIs(t, err, ErrOverQuota)
+
+	// 达到上限后更新已有的最近会话和豁免的频道类型不受影响
+	err = store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 1},
+		{UID: "u1", ChannelID: "system", ChannelType: 9},
+	})
+	assert.NoError(t, err)
+
+	// 一次新增超过上限整体拒绝
+	err = store.AddOrUpdateConversations("u2", []*Conversation{
+		{UID: "u2", ChannelID: "g1", ChannelType: 2},
+		{UID: "u2", ChannelID: "g2", ChannelType: 2},
+		{UID: "u2", ChannelID: "g3", ChannelType: 2},
+	})
+	assert.ErrorIs(t, err, ErrOverQuota)
+
+	conversations, err := store.GetConversations("u1")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(conversations))
+	conversations, err = store.GetConversations("u2")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(conversations))
+}
+
+func TestConversationQuotaEvict(t *testing.T) {
+	store := newTestFileStore(t)
+	store.cfg.MaxConversationsPerUser = 2
+	store.cfg.ConversationQuotaPolicy = ConversationQuotaEvict
+	store.cfg.ConversationQuotaExemptChannelTypes = []uint8{9}
+
+	err := store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "system", ChannelType: 9, Version: 1},
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, Version: 3},
+		{UID: "u1", ChannelID: "g2", ChannelType: 2, Version: 2},
+	})
+	assert.NoError(t, err)
+
+	// 淘汰最久没有更新的g2，豁免的system不淘汰
+	err = store.AddOrUpdateConversations("u1", []*Conversation{{UID: "u1", ChannelID: "g3", ChannelType: 2, Version: 4}})
+	assert.NoError(t, err)
+	exist, err := store.ExistConversation("u1", "g2", 2)
+	assert.NoError(t, err)
+	assert.False(t, exist)
+	conversations, err := store.GetConversations("u1")
+	assert.NoError(t, err)
+	channelIDs := make([]string, 0, len(conversations))
+	for _, conversation := range conversations {
+		channelIDs = append(channelIDs, conversation.ChannelID)
+	}
+	assert.ElementsMatch(t, []string{"system", "g1", "g3"}, channelIDs)
+	assert.Equal(t, int64(1), store.ConversationEvictions())
+
+	// 本次更新的最近会话不会被淘汰，放不下时拒绝
+	err = store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, Version: 5},
+		{UID: "u1", ChannelID: "g3", ChannelType: 2, Version: 5},
+		{UID: "u1", ChannelID: "g4", ChannelType: 2, Version: 5},
+	})
+	assert.ErrorIs(t, err, ErrOverQuota)
+	assert.Equal(t, int64(1), store.ConversationEvictions())
+}
+
+func TestAddOrUpdateConversationsDedupe(t *testing.T) {
+	store := newTestFileStore(t)
+
+	first := &Conversation{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 2, Timestamp: 200, LastMsgSeq: 5, LastClientMsgNo: "c5", LastMsgID: 5, Version: 1}
+	second := &Conversation{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 1, Timestamp: 100, LastMsgSeq: 4, LastClientMsgNo: "c4", LastMsgID: 4, Version: 2}
+	err := store.AddOrUpdateConversations("u1", []*Conversation{
+		first,
+		{UID: "u1", ChannelID: "u2", ChannelType: 1, Version: 1},
+		second,
+		{UID: "u1", ChannelID: "g1", ChannelType: 1, Version: 1}, // 频道类型不同不是重复
+	})
+	assert.NoError(t, err)
+
+	conversations, err := store.GetConversations("u1")
+	assert.NoError(t, err)
+	assert.Len(t, conversations, 3)
+	assert.Equal(t, "g1", conversations[0].ChannelID)
+	assert.Equal(t, uint8(2), conversations[0].ChannelType)
+	assert.Equal(t, uint32(5), conversations[0].LastMsgSeq)
+	assert.Equal(t, "c5", conversations[0].LastClientMsgNo)
+	assert.Equal(t, int64(5), conversations[0].LastMsgID)
+	assert.Equal(t, 2, conversations[0].UnreadCount)
+	assert.Equal(t, int64(200), conversations[0].Timestamp)
+	assert.Equal(t, int64(2), conversations[0].Version)
+
+	// 调用方传入的数据不被修改
+	assert.Equal(t, int64(1), first.Version)
+	assert.Equal(t, uint32(4), second.LastMsgSeq)
+}
+
+func TestIncConversationUnreadCount(t *testing.T) {
+	store := newTestFileStore(t)
+
+	// 最近会话不存在且不新建
+	conversation, err := store.IncConversationUnreadCount("u1", "g1", 2, 1, false)
+	assert.NoError(t, err)
+	assert.Nil(t, conversation)
+	exist, err := store.ExistConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.False(t, exist)
+
+	assert.NoError(t, store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 1, LastMsgSeq: 10, Version: 1},
+		{UID: "u1", ChannelID: "g2", ChannelType: 2, UnreadCount: 3, Version: 1},
+	}))
+
+	// 并发增加未读数不会丢失
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := store.IncConversationUnreadCount("u1", "g1", 2, 1, false)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	conversation, err = store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 21, conversation.UnreadCount)
+	assert.Equal(t, uint32(10), conversation.LastMsgSeq)
+	assert.Greater(t, conversation.Version, int64(1))
+
+	// 减少时最小为0，其他最近会话不受影响
+	conversation, err = store.IncConversationUnreadCount("u1", "g1", 2, -100, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, conversation.UnreadCount)
+	conversation, err = store.GetConversation("u1", "g2", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, conversation.UnreadCount)
+	assert.Equal(t, int64(1), conversation.Version)
+
+	// 不存在时新建
+	conversation, err = store.IncConversationUnreadCount("u1", "g3", 2, 2, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "u1", conversation.UID)
+	assert.Equal(t, 2, conversation.UnreadCount)
+	conversations, err := store.GetConversations("u1")
+	assert.NoError(t, err)
+	assert.Len(t, conversations, 3)
+
+	_, err = store.IncConversationUnreadCount("", "g1", 2, 1, true)
+	assert.ErrorIs(t, err, ErrInvalidConversation)
+}
+
+func TestUpdateConversationsReadToMsgSeq(t *testing.T) {
+	store := newTestFileStore(t)
+	assert.NoError(t, store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 5, LastMsgSeq: 10, Version: 1},
+		{UID: "u1", ChannelID: "g2", ChannelType: 2, UnreadCount: 1, LastMsgSeq: 10, Version: 1},
+		{UID: "u1", ChannelID: "g3", ChannelType: 2, UnreadCount: 3, LastMsgSeq: 3, Version: 1},
+	}))
+
+	changed, err := store.UpdateConversationsReadToMsgSeq("u1", []ConversationReadTo{
+		{ChannelID: "g1", ChannelType: 2, ReadToMsgSeq: 8},
+		{ChannelID: "g2", ChannelType: 2, ReadToMsgSeq: 5}, // 已经读到9了
+		{ChannelID: "g3", ChannelType: 2, ReadToMsgSeq: 100},
+		{ChannelID: "g4", ChannelType: 2, ReadToMsgSeq: 1}, // 不存在
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []ConversationKey{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2},
+		{UID: "u1", ChannelID: "g3", ChannelType: 2},
+	}, changed)
+
+	conversations, err := store.GetConversations("u1")
+	assert.NoError(t, err)
+	assert.Len(t, conversations, 3)
+	assert.Equal(t, 2, conversations[0].UnreadCount)
+	assert.Greater(t, conversations[0].Version, int64(1))
+	assert.Equal(t, 1, conversations[1].UnreadCount)
+	assert.Equal(t, int64(1), conversations[1].Version)
+	assert.Equal(t, 0, conversations[2].UnreadCount)
+
+	// 重复设置没有修改
+	changed, err = store.UpdateConversationsReadToMsgSeq("u1", []ConversationReadTo{{ChannelID: "g1", ChannelType: 2, ReadToMsgSeq: 8}})
+	assert.NoError(t, err)
+	assert.Empty(t, changed)
+}
+
+func TestUpdateConversationsReadToMsgSeqCreateIfMissing(t *testing.T) {
+	store := newTestFileStore(t)
+
+	// 新用户还没有最近会话
+	changed, err := store.UpdateConversationsReadToMsgSeq("u1", []ConversationReadTo{
+		{ChannelID: "g1", ChannelType: 2, ReadToMsgSeq: 8, CreateIfMissing: true},
+		{ChannelID: "g2", ChannelType: 2, ReadToMsgSeq: 3}, // 没有CreateIfMissing不创建
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []ConversationKey{{UID: "u1", ChannelID: "g1", ChannelType: 2}}, changed)
+	conversation, err := store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.NotNil(t, conversation)
+	assert.Equal(t, uint32(8), conversation.LastMsgSeq)
+	assert.Equal(t, 0, conversation.UnreadCount)
+	assert.Greater(t, conversation.Version, int64(0))
+	assert.Greater(t, conversation.Timestamp, int64(0))
+	exist, err := store.ExistConversation("u1", "g2", 2)
+	assert.NoError(t, err)
+	assert.False(t, exist)
+	version, err := store.GetConversationVersion("u1")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), version)
+
+	// 已经存在的不重复创建，已经读到更后面的不修改
+	assert.NoError(t, store.AddOrUpdateConversations("u1", []*Conversation{{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 2, LastMsgSeq: 10, Version: conversation.Version + 1}}))
+	changed, err = store.UpdateConversationsReadToMsgSeq("u1", []ConversationReadTo{{ChannelID: "g1", ChannelType: 2, ReadToMsgSeq: 5, CreateIfMissing: true}})
+	assert.NoError(t, err)
+	assert.Empty(t, changed)
+	conversations, err := store.GetConversations("u1")
+	assert.NoError(t, err)
+	assert.Len(t, conversations, 1)
+	assert.Equal(t, 2, conversations[0].UnreadCount)
+}
+
+func TestMigrateConversationsChannel(t *testing.T) {
+	store := newTestFileStore(t)
+	store.cfg.ScanBatchSize = 2
+
+	err := store.AddSubscribers("g1", 2, []string{"u1", "u2", "u3"})
+	assert.NoError(t, err)
+	err = store.AddSubscribers("sg1", 3, []string{"u2"})
+	assert.NoError(t, err)
+	err = store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 1, LastMsgSeq: 10, Version: 1},
+		{UID: "u1", ChannelID: "u9", ChannelType: 1, Version: 1},
+	})
+	assert.NoError(t, err)
+	// u2已经有新频道的最近会话，合并后保留LastMsgSeq大的
+	err = store.AddOrUpdateConversations("u2", []*Conversation{
+		{UID: "u2", ChannelID: "g1", ChannelType: 2, UnreadCount: 3, LastMsgSeq: 20, Version: 1},
+		{UID: "u2", ChannelID: "sg1", ChannelType: 3, UnreadCount: 1, LastMsgSeq: 5, Version: 2},
+	})
+	assert.NoError(t, err)
+
+	keys, err := store.MigrateConversationsChannel("g1", 2, "sg1", 3, MaintenanceOptions{})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []ConversationKey{
+		{UID: "u1", ChannelID: "sg1", ChannelType: 3},
+		{UID: "u2", ChannelID: "sg1", ChannelType: 3},
+	}, keys)
+
+	conversation, err := store.GetConversation("u1", "sg1", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(10), conversation.LastMsgSeq)
+	assert.Equal(t, 1, conversation.UnreadCount)
+	exist, err := store.ExistConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.False(t, exist)
+
+	conversations, err := store.GetConversations("u2")
+	assert.NoError(t, err)
+	assert.Len(t, conversations, 1)
+	assert.Equal(t, "sg1", conversations[0].ChannelID)
+	assert.Equal(t, uint32(20), conversations[0].LastMsgSeq)
+	assert.Equal(t, 3, conversations[0].UnreadCount)
+	assert.Equal(t, int64(3), conversations[0].Version) // 合并后有修改，版本号大于已存储的最大版本号
+
+	subscribers, err := store.GetSubscribers("g1", 2)
+	assert.NoError(t, err)
+	assert.Empty(t, subscribers)
+	subscribers, err = store.GetSubscribers("sg1", 3)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"u1", "u2", "u3"}, subscribers)
+
+	// 重复调用不会有影响
+	keys, err = store.MigrateConversationsChannel("g1", 2, "sg1", 3, MaintenanceOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+
+	_, err = store.MigrateConversationsChannel("g1", 2, "g1", 2, MaintenanceOptions{})
+	assert.ErrorIs(t, err, ErrInvalidChannel)
+}
+
+func TestDeleteConversationsByChannel(t *testing.T) {
+	store := newTestFileStore(t)
+	store.cfg.ScanBatchSize = 2
+
+	// u3没有此频道的最近会话
+	err := store.AddSubscribers("g1", 2, []string{"u1", "u2", "u3"})
+	assert.NoError(t, err)
+	err = store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 1, LastMsgSeq: 10, Version: 1},
+		{UID: "u1", ChannelID: "u9", ChannelType: 1, Version: 1},
+	})
+	assert.NoError(t, err)
+	err = store.AddOrUpdateConversations("u2", []*Conversation{
+		{UID: "u2", ChannelID: "g1", ChannelType: 2, UnreadCount: 3, LastMsgSeq: 20, Version: 1},
+	})
+	assert.NoError(t, err)
+
+	count, err := store.DeleteConversationsByChannel("g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	conversations, err := store.GetConversations("u1")
+	assert.NoError(t, err)
+	assert.Len(t, conversations, 1)
+	assert.Equal(t, "u9", conversations[0].ChannelID)
+	conversations, err = store.GetConversations("u2")
+	assert.NoError(t, err)
+	assert.Empty(t, conversations)
+	subscribers, err := store.GetSubscribers("g1", 2)
+	assert.NoError(t, err)
+	assert.Empty(t, subscribers)
+
+	// 重复调用不会有影响
+	count, err = store.DeleteConversationsByChannel("g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	_, err = store.DeleteConversationsByChannel("", 2)
+	assert.ErrorIs(t, err, ErrInvalidChannel)
+}
+
+func TestRunConversationCleanup(t *testing.T) {
+	store := newTestFileStore(t)
+	store.cfg.ConversationTTL = map[uint8]time.Duration{1: time.Hour * 24}
+	store.cfg.ConversationCleanupBatch = 2
+	store.cfg.ConversationCleanupBudget = 0
+
+	now := time.Now()
+	old := now.Add(-time.Hour * 48).Unix()
+	for _, uid := range []string{"u1", "u2", "u3"} {
+		err := store.AddOrUpdateConversations(uid, []*Conversation{
+			{UID: uid, ChannelID: "cmd", ChannelType: 1, Timestamp: old, Version: 1},
+			{UID: uid, ChannelID: "g1", ChannelType: 2, Timestamp: old, Version: 1}, // 没有配置TTL的频道类型不删除
+			{UID: uid, ChannelID: "u9", ChannelType: 1, Timestamp: now.Unix(), Version: 1},
+		})
+		assert.NoError(t, err)
+	}
+	err := store.AddOrUpdateConversations("u4", []*Conversation{
+		{UID: "u4", ChannelID: "cmd", ChannelType: 1, Timestamp: old, Version: 1},
+	})
+	assert.NoError(t, err)
+
+	result, err := store.RunConversationCleanup(now)
+	assert.NoError(t, err)
+	assert.True(t, result.Done)
+	assert.Equal(t, 4, result.ScannedUsers)
+	assert.ElementsMatch(t, []ConversationKey{
+		{UID: "u1", ChannelID: "cmd", ChannelType: 1},
+		{UID: "u2", ChannelID: "cmd", ChannelType: 1},
+		{UID: "u3", ChannelID: "cmd", ChannelType: 1},
+		{UID: "u4", ChannelID: "cmd", ChannelType: 1},
+	}, result.Purged)
+	assert.Equal(t, int64(4), store.ConversationsPurged())
+
+	conversations, err := store.GetConversations("u1")
+	assert.NoError(t, err)
+	assert.Len(t, conversations, 2)
+	conversations, err = store.GetConversations("u4")
+	assert.NoError(t, err)
+	assert.Empty(t, conversations)
+
+	// 没有过期的最近会话
+	result, err = store.RunConversationCleanup(now)
+	assert.NoError(t, err)
+	assert.True(t, result.Done)
+	assert.Empty(t, result.Purged)
+}
+
+func TestRunConversationCleanupBudget(t *testing.T) {
+	store := newTestFileStore(t)
+	store.cfg.ConversationTTL = map[uint8]time.Duration{1: time.Hour}
+	store.cfg.ConversationCleanupBudget = time.Nanosecond // 每次只处理一个用户
+
+	now := time.Now()
+	const users = 5
+	for i := 0; i < users; i++ {
+		uid := fmt.Sprintf("u%d", i)
+		err := store.AddOrUpdateConversations(uid, []*Conversation{
+			{UID: uid, ChannelID: "cmd", ChannelType: 1, Timestamp: now.Add(-time.Hour * 2).Unix(), Version: 1},
+		})
+		assert.NoError(t, err)
+	}
+
+	purged := 0
+	for runs := 1; ; runs++ {
+		result, err := store.RunConversationCleanup(now)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, result.ScannedUsers)
+		purged += len(result.Purged)
+		if result.Done {
+			assert.Equal(t, users, runs)
+			break
+		}
+		assert.Less(t, runs, users)
+	}
+	assert.Equal(t, users, purged)
+}
+
+func TestUserConversationSnapshot(t *testing.T) {
+	store := newTestFileStore(t)
+	store.cfg.ConversationSnapshotMaxCount = 2
+
+	// 没有最近会话时的快照，恢复后没有最近会话
+	emptyID, err := store.SnapshotUserConversations("u1")
+	assert.NoError(t, err)
+
+	err = store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 1, LastMsgSeq: 10, Version: 1},
+		{UID: "u1", ChannelID: "u2", ChannelType: 1, LastMsgSeq: 3, Version: 1},
+	})
+	assert.NoError(t, err)
+	// uid为 u1:x 的快照不能出现在u1的快照里
+	_, err = store.SnapshotUserConversations("u1:x")
+	assert.NoError(t, err)
+	snapshotID, err := store.SnapshotUserConversations("u1")
+	assert.NoError(t, err)
+	assert.NotEqual(t, emptyID, snapshotID)
+
+	snapshots, err := store.ListUserConversationSnapshots("u1")
+	assert.NoError(t, err)
+	assert.Len(t, snapshots, 2)
+	assert.Equal(t, snapshotID, snapshots[0].ID)
+	assert.Equal(t, 2, snapshots[0].Count)
+	assert.Equal(t, emptyID, snapshots[1].ID)
+	assert.Equal(t, 0, snapshots[1].Count)
+	assert.False(t, snapshots[0].CreatedAt.Before(snapshots[1].CreatedAt))
+
+	// 修改后恢复
+	err = store.DeleteConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	err = store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "u2", ChannelType: 1, UnreadCount: 5, LastMsgSeq: 8, Version: 2},
+		{UID: "u1", ChannelID: "g3", ChannelType: 2, LastMsgSeq: 1, Version: 2},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, store.RestoreUserConversations("u1", snapshotID))
+	conversations, err := store.GetConversations("u1")
+	assert.NoError(t, err)
+	assert.Len(t, conversations, 2)
+	conversation, err := store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(10), conversation.LastMsgSeq)
+	conversation, err = store.GetConversation("u1", "u2", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(3), conversation.LastMsgSeq)
+	assert.Equal(t, 0, conversation.UnreadCount)
+
+	assert.NoError(t, store.RestoreUserConversations("u1", emptyID))
+	conversations, err = store.GetConversations("u1")
+	assert.NoError(t, err)
+	assert.Empty(t, conversations)
+
+	err = store.RestoreUserConversations("u1", "0000000000000000001")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// 超过数量上限删除最旧的
+	thirdID, err := store.SnapshotUserConversations("u1")
+	assert.NoError(t, err)
+	snapshots, err = store.ListUserConversationSnapshots("u1")
+	assert.NoError(t, err)
+	assert.Len(t, snapshots, 2)
+	assert.Equal(t, thirdID, snapshots[0].ID)
+	assert.Equal(t, snapshotID, snapshots[1].ID)
+
+	assert.NoError(t, store.DeleteUserConversationSnapshots("u1"))
+	snapshots, err = store.ListUserConversationSnapshots("u1")
+	assert.NoError(t, err)
+	assert.Empty(t, snapshots)
+	snapshots, err = store.ListUserConversationSnapshots("u1:x")
+	assert.NoError(t, err)
+	assert.Len(t, snapshots, 1)
+}
+
+func TestOnUserLeftChannel(t *testing.T) {
+	store := newTestFileStore(t)
+
+	err := store.AddSubscribers("g1", 2, []string{"u1", "u2"})
+	assert.NoError(t, err)
+	err = store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 3, LastMsgSeq: 10, Version: 1},
+		{UID: "u1", ChannelID: "g2", ChannelType: 2, UnreadCount: 1, LastMsgSeq: 2, Version: 1},
+	})
+	assert.NoError(t, err)
+
+	// 默认删除最近会话
+	assert.NoError(t, store.OnUserLeftChannel("u1", "g1", 2))
+	subscribers, err := store.GetSubscribers("g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"u2"}, subscribers)
+	conversations, err := store.GetConversations("u1")
+	assert.NoError(t, err)
+	assert.Len(t, conversations, 1)
+	assert.Equal(t, "g2", conversations[0].ChannelID)
+
+	// 冻结最近会话
+	store.cfg.ConversationLeavePolicy = ConversationLeaveFreeze
+	assert.NoError(t, store.OnUserLeftChannel("u1", "g2", 2))
+	conversation, err := store.GetConversation("u1", "g2", 2)
+	assert.NoError(t, err)
+	assert.True(t, conversation.Left)
+	assert.Equal(t, 0, conversation.UnreadCount)
+	assert.Equal(t, uint32(2), conversation.LastMsgSeq)
+	assert.Greater(t, conversation.Version, int64(1))
+
+	// 重新加入后恢复，保留原来的消息位置
+	assert.NoError(t, store.OnUserJoinedChannel("u1", "g2", 2))
+	conversation, err = store.GetConversation("u1", "g2", 2)
+	assert.NoError(t, err)
+	assert.False(t, conversation.Left)
+	assert.Equal(t, uint32(2), conversation.LastMsgSeq)
+
+	// 没有最近会话也要移除订阅关系
+	assert.NoError(t, store.OnUserLeftChannel("u2", "g1", 2))
+	subscribers, err = store.GetSubscribers("g1", 2)
+	assert.NoError(t, err)
+	assert.Empty(t, subscribers)
+	assert.NoError(t, store.OnUserJoinedChannel("u2", "g1", 2))
+
+	assert.ErrorIs(t, store.OnUserLeftChannel("", "g1", 2), ErrInvalidConversation)
+}
+
+func TestSetConversationPinned(t *testing.T) {
+	store := newTestFileStore(t)
+	assert.NoError(t, store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 1, Version: 1},
+		{UID: "u1", ChannelID: "g2", ChannelType: 2, UnreadCount: 2, Version: 1},
+	}))
+
+	conversation, err := store.SetConversationPinned("u1", "g1", 2, true)
+	assert.NoError(t, err)
+	assert.True(t, conversation.Pinned())
+	assert.Equal(t, 1, conversation.UnreadCount)
+	assert.Greater(t, conversation.Version, int64(1))
+	pinnedAt := conversation.PinnedAt
+
+	// 重复置顶不修改置顶时间
+	conversation, err = store.SetConversationPinned("u1", "g1", 2, true)
+	assert.NoError(t, err)
+	assert.Equal(t, pinnedAt, conversation.PinnedAt)
+
+	// 普通更新（缓存里置顶前读取的最近会话）不会覆盖置顶状态
+	assert.NoError(t, store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 3, Version: 2},
+	}))
+	conversation, err = store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, pinnedAt, conversation.PinnedAt)
+	assert.Equal(t, 3, conversation.UnreadCount)
+
+	// 取消置顶，其他最近会话不受影响
+	conversation, err = store.SetConversationPinned("u1", "g1", 2, false)
+	assert.NoError(t, err)
+	assert.False(t, conversation.Pinned())
+	conversation, err = store.GetConversation("u1", "g2", 2)
+	assert.NoError(t, err)
+	assert.False(t, conversation.Pinned())
+	assert.Equal(t, int64(1), conversation.Version)
+
+	_, err = store.SetConversationPinned("u1", "g3", 2, true)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = store.SetConversationPinned("", "g1", 2, true)
+	assert.ErrorIs(t, err, ErrInvalidConversation)
+}
+
+func TestSetConversationMute(t *testing.T) {
+	store := newTestFileStore(t)
+	assert.NoError(t, store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 1, Version: 1},
+		{UID: "u1", ChannelID: "g2", ChannelType: 2, UnreadCount: 2, Version: 1},
+	}))
+
+	conversation, err := store.SetConversationMute("u1", "g1", 2, 1)
+	assert.NoError(t, err)
+	assert.True(t, conversation.Muted())
+	assert.Equal(t, 1, conversation.UnreadCount)
+	assert.Greater(t, conversation.Version, int64(1))
+
+	// 普通更新（缓存里设置前读取的最近会话）不会覆盖免打扰
+	assert.NoError(t, store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 3, Version: 2},
+	}))
+	conversation, err = store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.True(t, conversation.Muted())
+	assert.Equal(t, 3, conversation.UnreadCount)
+
+	// 关闭免打扰，其他最近会话不受影响
+	conversation, err = store.SetConversationMute("u1", "g1", 2, 0)
+	assert.NoError(t, err)
+	assert.False(t, conversation.Muted())
+	conversation, err = store.GetConversation("u1", "g2", 2)
+	assert.NoError(t, err)
+	assert.False(t, conversation.Muted())
+	assert.Equal(t, int64(1), conversation.Version)
+
+	_, err = store.SetConversationMute("u1", "g3", 2, 1)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = store.SetConversationMute("", "g1", 2, 1)
+	assert.ErrorIs(t, err, ErrInvalidConversation)
+}
+
+func TestSetConversationExtra(t *testing.T) {
+	store := newTestFileStore(t)
+	assert.NoError(t, store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 1, Version: 1},
+		{UID: "u1", ChannelID: "g2", ChannelType: 2, UnreadCount: 2, Version: 1},
+	}))
+	extra, err := store.GetConversationExtra("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.Nil(t, extra)
+
+	setExtra := map[string]string{"draft": "hello", "mention": "u2"}
+	conversation, err := store.SetConversationExtra("u1", "g1", 2, setExtra)
+	assert.NoError(t, err)
+	assert.Equal(t, setExtra, conversation.Extra)
+	assert.Equal(t, 1, conversation.UnreadCount)
+	assert.Greater(t, conversation.Version, int64(1))
+	setExtra["draft"] = "changed" // 修改传入的map不影响存储
+	extra, err = store.GetConversationExtra("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"draft": "hello", "mention": "u2"}, extra)
+
+	// 普通更新（缓存里设置前读取的最近会话）不会覆盖扩展数据
+	assert.NoError(t, store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 3, Version: 2},
+	}))
+	conversation, err = store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", conversation.Extra["draft"])
+	assert.Equal(t, 3, conversation.UnreadCount)
+	conversations, err := store.GetConversations("u1")
+	assert.NoError(t, err)
+	assert.Len(t, conversations, 2)
+
+	// 相同的扩展数据不修改版本号
+	version := conversation.Version
+	conversation, err = store.SetConversationExtra("u1", "g1", 2, map[string]string{"mention": "u2", "draft": "hello"})
+	assert.NoError(t, err)
+	assert.Equal(t, version, conversation.Version)
+
+	// 清空扩展数据，其他最近会话不受影响
+	conversation, err = store.SetConversationExtra("u1", "g1", 2, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, conversation.Extra)
+	conversation, err = store.GetConversation("u1", "g2", 2)
+	assert.NoError(t, err)
+	assert.Nil(t, conversation.Extra)
+	assert.Equal(t, int64(1), conversation.Version)
+
+	_, err = store.SetConversationExtra("u1", "g3", 2, setExtra)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = store.GetConversationExtra("u1", "g3", 2)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = store.SetConversationExtra("", "g1", 2, setExtra)
+	assert.ErrorIs(t, err, ErrInvalidConversation)
+	_, err = store.SetConversationExtra("u1", "g1", 2, map[string]string{"big": strings.Repeat("x", math.MaxUint16)})
+	assert.ErrorIs(t, err, ErrConversationExtraTooLarge)
+}
+
+// testMessageSeqLocator 频道内存在的消息seq
+type testMessageSeqLocator struct {
+	seqs map[uint32]bool
+}
+
+func (l *testMessageSeqLocator) NextMessageSeq(channelID string, channelType uint8, startMessageSeq, endMessageSeq uint32) (uint32, bool, error) {
+	for seq := startMessageSeq; seq <= endMessageSeq; seq++ {
+		if l.seqs[seq] {
+			return seq, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+func TestGetConversationFirstUnread(t *testing.T) {
+	store := newTestFileStore(t)
+	locator := &testMessageSeqLocator{seqs: map[uint32]bool{}}
+	for seq := uint32(1); seq <= 10; seq++ {
+		locator.seqs[seq] = true
+	}
+	store.SetMessageSeqLocator(locator)
+	assert.NoError(t, store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 5, LastMsgSeq: 10, Version: 1},
+		{UID: "u1", ChannelID: "g2", ChannelType: 2, UnreadCount: 0, LastMsgSeq: 10, Version: 1},
+	}))
+
+	seq, exists, err := store.GetConversationFirstUnread("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, uint32(6), seq)
+
+	// 中间的消息被删除，跳到下一条还存在的消息
+	delete(locator.seqs, 6)
+	delete(locator.seqs, 7)
+	seq, exists, err = store.GetConversationFirstUnread("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, uint32(8), seq)
+
+	// 过期后未读数被修正
+	assert.NoError(t, store.AddSubscribers("g1", 2, []string{"u1"}))
+	delete(locator.seqs, 8)
+	_, err = store.OnMessagesExpired("g1", 2, 8)
+	assert.NoError(t, err)
+	seq, exists, err = store.GetConversationFirstUnread("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, uint32(9), seq)
+
+	// 未读的消息都被删除
+	delete(locator.seqs, 9)
+	delete(locator.seqs, 10)
+	_, exists, err = store.GetConversationFirstUnread("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	// 全部已读
+	_, exists, err = store.GetConversationFirstUnread("u1", "g2", 2)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	_, _, err = store.GetConversationFirstUnread("u1", "g3", 2)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// 批量获取只返回有未读的
+	locator.seqs[10] = true
+	assert.NoError(t, store.AddOrUpdateConversations("u1", []*Conversation{{UID: "u1", ChannelID: "g2", ChannelType: 2, UnreadCount: 1, LastMsgSeq: 10, Version: 2}}))
+	firstUnreads, err := store.GetConversationsFirstUnread("u1", []ConversationKey{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2},
+		{UID: "u1", ChannelID: "g2", ChannelType: 2},
+		{UID: "u1", ChannelID: "g3", ChannelType: 2},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[ConversationKey]uint32{{UID: "u1", ChannelID: "g1", ChannelType: 2}: 10, {UID: "u1", ChannelID: "g2", ChannelType: 2}: 10}, firstUnreads)
+}
+
+func TestConversationFirstUnreadMsgSeq(t *testing.T) {
+	seq, ok := (&Conversation{UnreadCount: 3, LastMsgSeq: 10}).FirstUnreadMsgSeq()
+	assert.True(t, ok)
+	assert.Equal(t, uint32(8), seq)
+	seq, ok = (&Conversation{UnreadCount: 20, LastMsgSeq: 10}).FirstUnreadMsgSeq() // 未读数比消息多
+	assert.True(t, ok)
+	assert.Equal(t, uint32(1), seq)
+	_, ok = (&Conversation{UnreadCount: 0, LastMsgSeq: 10}).FirstUnreadMsgSeq()
+	assert.False(t, ok)
+}
+
+func TestSearchConversations(t *testing.T) {
+	store := newTestFileStore(t)
+	for i := 1; i <= 5; i++ {
+		uid := fmt.Sprintf("u%d", i)
+		assert.NoError(t, store.AddOrUpdateConversations(uid, []*Conversation{
+			{UID: uid, ChannelID: "g1", ChannelType: 2, UnreadCount: i % 2, Timestamp: int64(100 + i), Version: 1},
+			{UID: uid, ChannelID: "g2", ChannelType: 2, UnreadCount: 1, Timestamp: int64(200 + i), Version: 1},
+			{UID: uid, ChannelID: "p1", ChannelType: 1, UnreadCount: 1, Timestamp: int64(300 + i), Version: 1},
+		}))
+	}
+	ctx := context.Background()
+
+	result, err := store.SearchConversations(ctx, ConversationSearchReq{Limit: 100})
+	assert.NoError(t, err)
+	assert.Equal(t, 15, result.Total)
+	assert.Len(t, result.Conversations, 15)
+
+	// 组合条件：g1里有未读并且时间在[102,105)之间的只有u3
+	result, err = store.SearchConversations(ctx, ConversationSearchReq{ChannelID: "g1", ChannelType: 2, UnreadOnly: true, UpdatedAfter: 102, UpdatedBefore: 105})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.Total)
+	assert.Equal(t, "u3", result.Conversations[0].UID)
+
+	// 先过滤再分页，每页数量不受不匹配的最近会话影响
+	uids := make(map[string]bool)
+	for page := 1; page <= 3; page++ {
+		result, err = store.SearchConversations(ctx, ConversationSearchReq{ChannelType: 2, UnreadOnly: true, Limit: 3, CurrentPage: page})
+		assert.NoError(t, err)
+		assert.Equal(t, 8, result.Total) // g2的5个加上g1里u1,u3,u5
+		if page < 3 {
+			assert.Len(t, result.Conversations, 3)
+		} else {
+			assert.Len(t, result.Conversations, 2)
+		}
+		for _, conversation := range result.Conversations {
+			assert.Equal(t, uint8(2), conversation.ChannelType)
+			assert.Greater(t, conversation.UnreadCount, 0)
+			uids[conversation.UID+conversation.ChannelID] = true
+		}
+	}
+	assert.Len(t, uids, 8)
+	result, err = store.SearchConversations(ctx, ConversationSearchReq{ChannelType: 2, UnreadOnly: true, Limit: 3, CurrentPage: 4})
+	assert.NoError(t, err)
+	assert.Equal(t, 8, result.Total)
+	assert.Len(t, result.Conversations, 0)
+
+	// 指定uid时条件同样生效
+	result, err = store.SearchConversations(ctx, ConversationSearchReq{UID: "u2", ChannelType: 2, UnreadOnly: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.Total)
+	assert.Equal(t, "g2", result.Conversations[0].ChannelID)
+	result, err = store.SearchConversations(ctx, ConversationSearchReq{UID: "u2", UpdatedAfter: 200, Limit: 1, CurrentPage: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, result.Total)
+	assert.Len(t, result.Conversations, 1)
+	assert.Equal(t, "g2", result.Conversations[0].ChannelID) // 按频道类型和频道id排序
+}
+
+func TestSearchConversationsCursor(t *testing.T) {
+	store := newTestFileStore(t)
+	store.cfg.ScanBatchSize = 2 // 跨多批扫描
+	const users = 30
+	for i := 0; i < users; i++ {
+		uid := fmt.Sprintf("user%d", i)
+		assert.NoError(t, store.AddOrUpdateConversations(uid, []*Conversation{
+			{UID: uid, ChannelID: "g2", ChannelType: 2, UnreadCount: 1, Timestamp: 1, Version: 1},
+			{UID: uid, ChannelID: "g1", ChannelType: 2, UnreadCount: 0, Timestamp: 1, Version: 1},
+			{UID: uid, ChannelID: "g3", ChannelType: 2, UnreadCount: 1, Timestamp: 1, Version: 1},
+		}))
+	}
+	ctx := context.Background()
+	key := func(c *Conversation) string { return c.UID + "/" + c.ChannelID }
+
+	// 按偏移分页是全局的，和按游标分页的结果一致
+	var offsetKeys []string
+	for page := 1; ; page++ {
+		result, err := store.SearchConversations(ctx, ConversationSearchReq{UnreadOnly: true, Limit: 7, CurrentPage: page})
+		assert.NoError(t, err)
+		assert.Equal(t, users*2, result.Total)
+		for _, c := range result.Conversations {
+			offsetKeys = append(offsetKeys, key(c))
+		}
+		if !result.HasMore {
+			assert.Empty(t, result.NextCursor)
+			break
+		}
+		assert.NotEmpty(t, result.NextCursor)
+	}
+	assert.Len(t, offsetKeys, users*2)
+
+	var (
+		cursorKeys []string
+		cursor     string
+		seen       = make(map[string]bool)
+	)
+	for pages := 0; ; pages++ {
+		result, err := store.SearchConversations(ctx, ConversationSearchReq{UnreadOnly: true, Limit: 7, Cursor: cursor})
+		assert.NoError(t, err)
+		for _, c := range result.Conversations {
+			assert.False(t, seen[key(c)])
+			seen[key(c)] = true
+			cursorKeys = append(cursorKeys, key(c))
+		}
+		if pages == 0 { // 翻页期间已经返回过的位置新增最近会话不影响后面的页
+			uid := result.Conversations[0].UID
+			assert.NoError(t, store.AddOrUpdateConversations(uid, []*Conversation{
+				{UID: uid, ChannelID: "g0", ChannelType: 2, UnreadCount: 1, Timestamp: 1, Version: 1},
+			}))
+		}
+		if !result.HasMore {
+			assert.Empty(t, result.NextCursor)
+			break
+		}
+		assert.Len(t, result.Conversations, 7)
+		cursor = result.NextCursor
+	}
+	assert.Equal(t, offsetKeys, cursorKeys)
+
+	// 正好一页时没有下一页
+	result, err := store.SearchConversations(ctx, ConversationSearchReq{UID: "user1", UnreadOnly: true, Limit: 2})
+	assert.NoError(t, err)
+	assert.Len(t, result.Conversations, 2)
+	assert.False(t, result.HasMore)
+	result, err = store.SearchConversations(ctx, ConversationSearchReq{UID: "user1", Limit: 2})
+	assert.NoError(t, err)
+	assert.True(t, result.HasMore)
+	result, err = store.SearchConversations(ctx, ConversationSearchReq{UID: "user1", Limit: 2, Cursor: result.NextCursor})
+	assert.NoError(t, err)
+	assert.Len(t, result.Conversations, 1)
+	assert.Equal(t, "g3", result.Conversations[0].ChannelID)
+	assert.False(t, result.HasMore)
+
+	_, err = store.SearchConversations(ctx, ConversationSearchReq{Cursor: "bad"})
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+}
+
+func TestSetConversationArchived(t *testing.T) {
+	store := newTestFileStore(t)
+	assert.NoError(t, store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 1, Timestamp: 10, Version: 1},
+		{UID: "u1", ChannelID: "g2", ChannelType: 2, UnreadCount: 2, Timestamp: 20, Version: 1},
+		{UID: "u1", ChannelID: "g3", ChannelType: 2, UnreadCount: 3, Timestamp: 30, Version: 1},
+	}))
+
+	conversation, err := store.SetConversationArchived("u1", "g1", 2, true)
+	assert.NoError(t, err)
+	assert.True(t, conversation.Archived)
+	assert.Equal(t, 1, conversation.UnreadCount)
+	assert.Greater(t, conversation.Version, int64(1))
+	_, err = store.SetConversationArchived("u1", "g3", 2, true)
+	assert.NoError(t, err)
+
+	// 普通更新（缓存里设置前读取的最近会话）不会覆盖归档状态，未读数照常更新
+	assert.NoError(t, store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 4, Timestamp: 40, Version: 2},
+	}))
+	conversation, err = store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.True(t, conversation.Archived)
+	assert.Equal(t, 4, conversation.UnreadCount)
+
+	archived, err := store.GetArchivedConversations("u1", 0)
+	assert.NoError(t, err)
+	assert.Len(t, archived, 2)
+	assert.Equal(t, "g1", archived[0].ChannelID)
+	assert.Equal(t, "g3", archived[1].ChannelID)
+	archived, err = store.GetArchivedConversations("u1", 1)
+	assert.NoError(t, err)
+	assert.Len(t, archived, 1)
+
+	// 取消归档，其他最近会话不受影响
+	conversation, err = store.SetConversationArchived("u1", "g1", 2, false)
+	assert.NoError(t, err)
+	assert.False(t, conversation.Archived)
+	assert.Equal(t, 4, conversation.UnreadCount)
+	conversation, err = store.GetConversation("u1", "g2", 2)
+	assert.NoError(t, err)
+	assert.False(t, conversation.Archived)
+	assert.Equal(t, int64(1), conversation.Version)
+
+	_, err = store.SetConversationArchived("u1", "g4", 2, true)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = store.SetConversationArchived("", "g1", 2, true)
+	assert.ErrorIs(t, err, ErrInvalidConversation)
+}
+
+func TestIncConversationMentionCount(t *testing.T) {
+	store := newTestFileStore(t)
+	assert.NoError(t, store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 3, Timestamp: 10, LastMsgSeq: 10, Version: 1},
+		{UID: "u1", ChannelID: "g2", ChannelType: 2, UnreadCount: 1, Timestamp: 20, LastMsgSeq: 5, Version: 1},
+	}))
+
+	conversation, err := store.IncConversationMentionCount("u1", "g1", 2, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), conversation.MentionCount)
+	assert.Equal(t, 3, conversation.UnreadCount)
+	assert.Greater(t, conversation.Version, int64(1))
+	conversation, err = store.IncConversationMentionCount("u1", "g1", 2, -5) // 最小为0
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0), conversation.MentionCount)
+	_, err = store.IncConversationMentionCount("u1", "g1", 2, 1)
+	assert.NoError(t, err)
+
+	// 普通更新不带提及数量时不会清零
+	assert.NoError(t, store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 4, Timestamp: 30, LastMsgSeq: 11, Version: 2},
+	}))
+	conversation, err = store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), conversation.MentionCount)
+	assert.Equal(t, 4, conversation.UnreadCount)
+
+	// 已读位置没有超过最后一条提及的消息时不清零
+	changed, err := store.UpdateConversationsReadToMsgSeq("u1", []ConversationReadTo{{ChannelID: "g1", ChannelType: 2, ReadToMsgSeq: 8}})
+	assert.NoError(t, err)
+	assert.Len(t, changed, 1)
+	conversation, err = store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, conversation.UnreadCount)
+	assert.Equal(t, uint32(1), conversation.MentionCount)
+
+	// 已经读到更后面的照样清零
+	changed, err = store.UpdateConversationsReadToMsgSeq("u1", []ConversationReadTo{{ChannelID: "g1", ChannelType: 2, ReadToMsgSeq: 8, ResetMentions: true}})
+	assert.NoError(t, err)
+	assert.Len(t, changed, 1)
+	conversation, err = store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, conversation.UnreadCount)
+	assert.Equal(t, uint32(0), conversation.MentionCount)
+	changed, err = store.UpdateConversationsReadToMsgSeq("u1", []ConversationReadTo{{ChannelID: "g1", ChannelType: 2, ReadToMsgSeq: 8, ResetMentions: true}})
+	assert.NoError(t, err)
+	assert.Empty(t, changed)
+
+	conversation, err = store.GetConversation("u1", "g2", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0), conversation.MentionCount)
+	assert.Equal(t, int64(1), conversation.Version)
+
+	_, err = store.IncConversationMentionCount("u1", "g3", 2, 1)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = store.IncConversationMentionCount("", "g1", 2, 1)
+	assert.ErrorIs(t, err, ErrInvalidConversation)
+}
+
+func TestUpdateConversationLastMsg(t *testing.T) {
+	store := newTestFileStore(t)
+	assert.NoError(t, store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 2, Timestamp: 10, LastMsgSeq: 5, LastClientMsgNo: "c5", LastMsgID: 105, Version: 1},
+	}))
+
+	modify, err := store.UpdateConversationLastMsg("u1", "g1", 2, 6, "c6", 20)
+	assert.NoError(t, err)
+	assert.True(t, modify)
+	conversation, err := store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(6), conversation.LastMsgSeq)
+	assert.Equal(t, "c6", conversation.LastClientMsgNo)
+	assert.Equal(t, int64(0), conversation.LastMsgID)
+	assert.Equal(t, int64(20), conversation.Timestamp)
+	assert.Equal(t, 2, conversation.UnreadCount)
+	assert.Greater(t, conversation.Version, int64(1))
+
+	// 旧的消息不回退
+	modify, err = store.UpdateConversationLastMsg("u1", "g1", 2, 6, "c6-2", 30)
+	assert.NoError(t, err)
+	assert.False(t, modify)
+	modify, err = store.UpdateConversationLastMsg("u1", "g1", 2, 4, "c4", 30)
+	assert.NoError(t, err)
+	assert.False(t, modify)
+	conversation, err = store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, "c6", conversation.LastClientMsgNo)
+
+	// 普通更新没有带最后一条消息时保留原来的
+	assert.NoError(t, store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 0, Timestamp: 20, Version: 2},
+	}))
+	conversation, err = store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(6), conversation.LastMsgSeq)
+	assert.Equal(t, "c6", conversation.LastClientMsgNo)
+	assert.Equal(t, 0, conversation.UnreadCount)
+
+	_, err = store.UpdateConversationLastMsg("u1", "g2", 2, 1, "c1", 1)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = store.UpdateConversationLastMsg("", "g1", 2, 1, "c1", 1)
+	assert.ErrorIs(t, err, ErrInvalidConversation)
+}
+
+func TestGetConversationUnreadDigest(t *testing.T) {
+	store := newTestFileStore(t)
+	assert.NoError(t, store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "u2", ChannelType: 1, UnreadCount: 1, Timestamp: 10, LastMsgSeq: 3, LastClientMsgNo: "c3", Version: 1},
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 5, MentionCount: 2, Timestamp: 30, LastMsgSeq: 8, Version: 1},
+		{UID: "u1", ChannelID: "g2", ChannelType: 2, UnreadCount: 0, Timestamp: 40, LastMsgSeq: 9, Version: 1},
+		{UID: "u1", ChannelID: "g3", ChannelType: 2, UnreadCount: 2, Timestamp: 20, LastMsgSeq: 4, Version: 1},
+		{UID: "u1", ChannelID: "g4", ChannelType: 2, UnreadCount: 2, Timestamp: 50, Left: true, Version: 1},
+	}))
+	_, err := store.SetConversationArchived("u1", "g3", 2, true)
+	assert.NoError(t, err)
+
+	digest, err := store.GetConversationUnreadDigest("u1", 0)
+	assert.NoError(t, err)
+	assert.Len(t, digest, 2)
+	assert.Equal(t, "g1", digest[0].ChannelID)
+	assert.Equal(t, 5, digest[0].UnreadCount)
+	assert.Equal(t, uint32(2), digest[0].MentionCount)
+	assert.Equal(t, "u2", digest[1].ChannelID)
+	assert.Equal(t, "c3", digest[1].LastClientMsgNo)
+
+	digest, err = store.GetConversationUnreadDigest("u1", 1)
+	assert.NoError(t, err)
+	assert.Len(t, digest, 1)
+	assert.Equal(t, "g1", digest[0].ChannelID)
+
+	digest, err = store.GetConversationUnreadDigest("u9", 10)
+	assert.NoError(t, err)
+	assert.Empty(t, digest)
+}
+
+func TestRecalculateConversationUnread(t *testing.T) {
+	store := newTestFileStore(t)
+	assert.NoError(t, store.AddOrUpdateConversations("u1", []*Conversation{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 2, LastMsgSeq: 10, Version: 1},
+		{UID: "u1", ChannelID: "g2", ChannelType: 2, UnreadCount: 15, LastMsgSeq: 10, Version: 1},
+		{UID: "u1", ChannelID: "g3", ChannelType: 2, UnreadCount: 0, LastMsgSeq: 10, Version: 1},
+		{UID: "u1", ChannelID: "g4", ChannelType: 2, UnreadCount: 5, LastMsgSeq: 10, Version: 1},
+		{UID: "u1", ChannelID: "g5", ChannelType: 2, UnreadCount: 5, LastMsgSeq: 10, Version: 1},
+	}))
+	lastMsgSeqs := map[string]uint32{"g1": 12, "g2": 10, "g3": 10, "g4": 7}
+	report, err := store.RecalculateConversationUnread("u1", func(channelID string, channelType uint8) (uint32, error) {
+		lastMsgSeq, ok := lastMsgSeqs[channelID]
+		if !ok {
+			return 0, ErrNotFound
+		}
+		return lastMsgSeq, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, report.Scanned)
+	assert.Equal(t, []ConversationKey{{UID: "u1", ChannelID: "g5", ChannelType: 2}}, report.Failed)
+	assert.Equal(t, []*ConversationUnreadCorrection{
+		{ChannelID: "g2", ChannelType: 2, LastMsgSeq: 10, OldUnread: 15, NewUnread: 10}, // 未读数超过了消息数量
+		{ChannelID: "g4", ChannelType: 2, LastMsgSeq: 7, OldUnread: 5, NewUnread: 2},    // 已读位置5之后只剩2条消息
+	}, report.Corrected)
+
+	// 最近会话还没处理的新消息不计入未读，失败的不修改
+	for channelID, unread := range map[string]int{"g1": 2, "g2": 10, "g3": 0, "g4": 2, "g5": 5} {
+		conversation, err := store.GetConversation("u1", channelID, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, unread, conversation.UnreadCount, channelID)
+	}
+
+	// 没有变化时不写入
+	version, err := store.GetConversationVersion("u1")
+	assert.NoError(t, err)
+	report, err = store.RecalculateConversationUnread("u1", func(channelID string, channelType uint8) (uint32, error) {
+		return 10, nil
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, report.Corrected)
+	newVersion, err := store.GetConversationVersion("u1")
+	assert.NoError(t, err)
+	assert.Equal(t, version, newVersion)
+}
@@ -0,0 +1,160 @@
+package wkstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// slot bucket里的key前缀
+const (
+	userTokenKeyPrefix           = "userToken:"
+	channelKeyPrefix             = "channel:"
+	subscribersKeyPrefix         = "subscribers:"
+	denylistKeyPrefix            = "denylist:"
+	allowlistKeyPrefix           = "allowlist:"
+	conversationKeyPrefix        = "conversation:"
+	conversationSnapshotPrefix   = "conversationSnapshot:"
+	conversationsVersionPrefix   = "conversationsVersion:"
+	conversationQuarantinePrefix = "conversationQuarantine:"
+	conversationTombstonePrefix  = "conversationTombstone:"
+	conversationRecalledPrefix   = "conversationRecalled:"
+	messageOfUserCursorKeyPrefix = "messageOfUserCursor:"
+)
+
+// KeyDescriber 解析去掉前缀后的key，返回可读的字段
+type KeyDescriber func(rest string) (map[string]string, error)
+
+type keyDescriberEntry struct {
+	prefix   string
+	table    string
+	describe KeyDescriber
+}
+
+var (
+	keyDescribersLock sync.RWMutex
+	keyDescribers     []keyDescriberEntry // 按前缀长度从长到短排序，优先匹配最长的前缀
+)
+
+func init() {
+	RegisterKeyDescriber(userTokenKeyPrefix, "user_token", describeKeyWithType("uid", "device_flag"))
+	RegisterKeyDescriber(channelKeyPrefix, "channel", describeChannelKey)
+	RegisterKeyDescriber(subscribersKeyPrefix, "subscribers", describeChannelKey)
+	RegisterKeyDescriber(denylistKeyPrefix, "denylist", describeChannelKey)
+	RegisterKeyDescriber(allowlistKeyPrefix, "allowlist", describeChannelKey)
+	RegisterKeyDescriber(conversationKeyPrefix, "conversation", describeUIDKey)
+	RegisterKeyDescriber(conversationSnapshotPrefix, "conversation_snapshot", describeConversationSnapshotKey)
+	RegisterKeyDescriber(conversationsVersionPrefix, "conversations_version", describeUIDKey)
+	RegisterKeyDescriber(conversationQuarantinePrefix, "conversation_quarantine", describeUIDKey)
+	RegisterKeyDescriber(conversationTombstonePrefix, "conversation_tombstone", describeUIDKey)
+	RegisterKeyDescriber(conversationRecalledPrefix, "conversation_recalled", describeChannelKey)
+	RegisterKeyDescriber(messageOfUserCursorKeyPrefix, "message_of_user_cursor", describeUIDKey)
+}
+
+// RegisterKeyDescriber 注册一种key的解析，相同前缀的会被覆盖
+func RegisterKeyDescriber(prefix string, table string, describe KeyDescriber) {
+	keyDescribersLock.Lock()
+	defer keyDescribersLock.Unlock()
+	for i, entry := range keyDescribers {
+		if entry.prefix == prefix {
+			keyDescribers[i] = keyDescriberEntry{prefix: prefix, table: table, describe: describe}
+			return
+		}
+	}
+	keyDescribers = append(keyDescribers, keyDescriberEntry{prefix: prefix, table: table, describe: describe})
+	sort.SliceStable(keyDescribers, func(i, j int) bool {
+		return len(keyDescribers[i].prefix) > len(keyDescribers[j].prefix)
+	})
+}
+
+// DescribeKey 解析存储的key，返回所属的表和可读的字段，不认识的key返回ErrUnknownKey
+func DescribeKey(k []byte) (table string, fields map[string]string, err error) {
+	keyDescribersLock.RLock()
+	defer keyDescribersLock.RUnlock()
+	for _, entry := range keyDescribers {
+		if !bytes.HasPrefix(k, []byte(entry.prefix)) {
+			continue
+		}
+		fields, err = entry.describe(string(k[len(entry.prefix):]))
+		if err != nil {
+			return entry.table, nil, fmt.Errorf("%s key %q: %w", entry.table, k, err)
+		}
+		return entry.table, fields, nil
+	}
+	return "", nil, fmt.Errorf("key %q: %w", k, ErrUnknownKey)
+}
+
+// DescribedKey DumpKeys输出的一条key
+type DescribedKey struct {
+	Key       string            `json:"key"`
+	Table     string            `json:"table,omitempty"`
+	Fields    map[string]string `json:"fields,omitempty"`
+	ValueSize int               `json:"value_size"`
+	Error     string            `json:"error,omitempty"` // 解析失败的原因
+}
+
+// DumpKeys 按顺序输出slot里指定前缀的key（每行一个json），limit<=0表示不限制，用于排查存储的数据
+func (f *FileStore) DumpKeys(slot uint32, prefix []byte, limit int, w io.Writer) error {
+	err := f.view(func(t *bolt.Tx) error {
+		bucket, err := f.getSlotBucket(slot, t)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(w)
+		cursor := bucket.Cursor()
+		count := 0
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			if limit > 0 && count >= limit {
+				break
+			}
+			described := &DescribedKey{Key: string(k), ValueSize: len(v)}
+			described.Table, described.Fields, err = DescribeKey(k)
+			if err != nil {
+				described.Error = err.Error()
+			}
+			if err = enc.Encode(described); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	return wrapError("DumpKeys", err, "", "", 0)
+}
+
+func describeUIDKey(rest string) (map[string]string, error) {
+	if rest == "" {
+		return nil, fmt.Errorf("empty uid: %w", ErrInvalidKey)
+	}
+	return map[string]string{"uid": rest}, nil
+}
+
+// describeChannelKey 频道的key为 频道ID-频道类型
+func describeChannelKey(rest string) (map[string]string, error) {
+	return describeKeyWithType("channel_id", "channel_type")(rest)
+}
+
+// describeKeyWithType 解析 id-类型 格式的key，id里可能有-，所以按最后一个-分割
+func describeKeyWithType(idName string, typeName string) KeyDescriber {
+	return func(rest string) (map[string]string, error) {
+		idx := strings.LastIndexByte(rest, '-')
+		if idx <= 0 {
+			return nil, fmt.Errorf("missing %s: %w", typeName, ErrInvalidKey)
+		}
+		typ, err := strconv.ParseUint(rest[idx+1:], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("%s %q: %w", typeName, rest[idx+1:], ErrInvalidKey)
+		}
+		return map[string]string{
+			idName:   rest[:idx],
+			typeName: strconv.FormatUint(typ, 10),
+		}, nil
+	}
+}
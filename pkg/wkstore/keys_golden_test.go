@@ -0,0 +1,180 @@
+package wkstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 修改key的格式会导致旧数据读不到，这里把当前生成的key（和所在的slot）保存为golden文件，确认key的格式没有变化
+// 有意修改格式时需要同时处理已存储的旧数据，然后用 go test -run TestKeyGoldens -update-key-goldens 重新生成
+var updateKeyGoldens = flag.Bool("update-key-goldens", false, "regenerate testdata/keys.golden")
+
+const keyGoldensFile = "testdata/keys.golden"
+
+type keyGolden struct {
+	name   string
+	key    []byte
+	slot   uint32
+	table  string
+	fields map[string]string
+}
+
+func keyGoldenCases() []keyGolden {
+	store := NewFileStore(NewStoreConfig())
+	longChannelID := strings.Repeat("g", 1000)
+	uids := map[string]string{
+		"ascii": "u1",
+		"utf8":  "用户-1:😀",
+		"sep":   "u-1@x:y",
+		"long":  strings.Repeat("u", 1000),
+	}
+	channels := map[string]string{
+		"ascii":  "g1",
+		"person": "u1@u2",
+		"utf8":   "群组-1",
+		"long":   longChannelID,
+	}
+	channelTypes := []uint8{0, 1, 2, math.MaxUint8}
+	deviceFlags := []uint8{0, 1, math.MaxUint8}
+	snapshotTimes := []int64{0, 1, 1700000000000000000, math.MaxInt64}
+
+	cases := make([]keyGolden, 0)
+	add := func(name string, key []byte, table string, fields map[string]string) {
+		cases = append(cases, keyGolden{name: name, key: key, slot: store.slotNum(string(key)), table: table, fields: fields})
+	}
+	for uidName, uid := range uids {
+		add("conversation/"+uidName, []byte(store.getConversationKey(uid)), "conversation", map[string]string{"uid": uid})
+		add("conversations_version/"+uidName, store.getConversationsVersionKey(uid), "conversations_version", map[string]string{"uid": uid})
+		add("conversation_tombstone/"+uidName, store.getConversationTombstoneKey(uid), "conversation_tombstone", map[string]string{"uid": uid})
+		add("message_of_user_cursor/"+uidName, []byte(store.getMessageOfUserCursorKey(uid)), "message_of_user_cursor", map[string]string{"uid": uid})
+		for _, deviceFlag := range deviceFlags {
+			add(fmt.Sprintf("user_token/%s/%d", uidName, deviceFlag), []byte(store.getUserTokenKey(uid, deviceFlag)), "user_token", map[string]string{"uid": uid, "device_flag": strconv.Itoa(int(deviceFlag))})
+		}
+		for _, nano := range snapshotTimes {
+			snapshotID := formatConversationSnapshotID(nano)
+			add(fmt.Sprintf("conversation_snapshot/%s/%d", uidName, nano), store.getConversationSnapshotKey(uid, snapshotID), "conversation_snapshot", map[string]string{"uid": uid, "snapshot_id": snapshotID})
+		}
+	}
+	channelKeys := map[string]func(string, uint8) string{
+		"channel":               store.getChannelKey,
+		"subscribers":           store.getSubscribersKey,
+		"denylist":              store.getDenylistKey,
+		"allowlist":             store.getAllowlistKey,
+		"conversation_recalled": store.getConversationRecalledKey,
+	}
+	for table, build := range channelKeys {
+		for channelName, channelID := range channels {
+			for _, channelType := range channelTypes {
+				add(fmt.Sprintf("%s/%s/%d", table, channelName, channelType), []byte(build(channelID, channelType)), table, map[string]string{"channel_id": channelID, "channel_type": strconv.Itoa(int(channelType))})
+			}
+		}
+	}
+	return cases
+}
+
+func TestKeyGoldens(t *testing.T) {
+	cases := keyGoldenCases()
+	actual := make(map[string]string, len(cases))
+	for _, c := range cases {
+		actual[c.name] = fmt.Sprintf("%s %d", hex.EncodeToString(c.key), c.slot)
+
+		// 生成的key能解析回原来的字段
+		table, fields, err := DescribeKey(c.key)
+		assert.NoError(t, err, c.name)
+		assert.Equal(t, c.table, table, c.name)
+		assert.Equal(t, c.fields, fields, c.name)
+	}
+
+	if *updateKeyGoldens {
+		writeKeyGoldens(t, actual)
+		return
+	}
+	expect := readKeyGoldens(t)
+	for name, line := range expect {
+		got, ok := actual[name]
+		if !assert.True(t, ok, "golden %s is no longer generated", name) {
+			continue
+		}
+		assert.Equal(t, line, got, "key encoding of %s changed", name)
+	}
+	for name := range actual {
+		_, ok := expect[name]
+		assert.True(t, ok, "%s is missing in %s, regenerate with -update-key-goldens", name, keyGoldensFile)
+	}
+}
+
+func readKeyGoldens(t *testing.T) map[string]string {
+	f, err := os.Open(keyGoldensFile)
+	if err != nil {
+		t.Fatalf("open %s: %v (generate with -update-key-goldens)", keyGoldensFile, err)
+	}
+	defer f.Close()
+	goldens := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, rest, ok := strings.Cut(line, " ")
+		if !ok {
+			t.Fatalf("invalid golden line %q", line)
+		}
+		goldens[name] = rest
+	}
+	if err = scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return goldens
+}
+
+func writeKeyGoldens(t *testing.T, goldens map[string]string) {
+	names := make([]string, 0, len(goldens))
+	for name := range goldens {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	buf.WriteString("# name hex(key) slot(SlotNum=256)，由TestKeyGoldens生成，不要手动修改\n")
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s %s\n", name, goldens[name])
+	}
+	if err := os.MkdirAll(filepath.Dir(keyGoldensFile), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyGoldensFile, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 任意的key都不能导致解析panic
+func FuzzDescribeKey(f *testing.F) {
+	for _, c := range keyGoldenCases() {
+		f.Add(c.key)
+	}
+	f.Add([]byte(""))
+	f.Add([]byte("channel:-"))
+	f.Add([]byte("conversationSnapshot::"))
+	f.Add([]byte("userToken:\xff\xfe-999"))
+	f.Fuzz(func(t *testing.T, key []byte) {
+		table, fields, err := DescribeKey(key)
+		if err != nil {
+			assert.Nil(t, fields)
+			return
+		}
+		assert.NotEmpty(t, table)
+	})
+}
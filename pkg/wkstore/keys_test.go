@@ -0,0 +1,105 @@
+package wkstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDescribeKey(t *testing.T) {
+	store := NewFileStore(NewStoreConfig())
+	tests := []struct {
+		key    string
+		table  string
+		fields map[string]string
+	}{
+		{store.getConversationKey("u1"), "conversation", map[string]string{"uid": "u1"}},
+		{store.getConversationKey("u-1@x"), "conversation", map[string]string{"uid": "u-1@x"}},
+		{store.getChannelKey("g-1", 2), "channel", map[string]string{"channel_id": "g-1", "channel_type": "2"}},
+		{store.getSubscribersKey("u1@u2", 1), "subscribers", map[string]string{"channel_id": "u1@u2", "channel_type": "1"}},
+		{store.getDenylistKey("g1", 2), "denylist", map[string]string{"channel_id": "g1", "channel_type": "2"}},
+		{store.getAllowlistKey("g1", 2), "allowlist", map[string]string{"channel_id": "g1", "channel_type": "2"}},
+		{store.getUserTokenKey("u1", 1), "user_token", map[string]string{"uid": "u1", "device_flag": "1"}},
+		{store.getMessageOfUserCursorKey("u1"), "message_of_user_cursor", map[string]string{"uid": "u1"}},
+		{string(store.getConversationSnapshotKey("u:1", "0000000000000000001")), "conversation_snapshot", map[string]string{"uid": "u:1", "snapshot_id": "0000000000000000001"}},
+	}
+	for _, tt := range tests {
+		table, fields, err := DescribeKey([]byte(tt.key))
+		assert.NoError(t, err, tt.key)
+		assert.Equal(t, tt.table, table, tt.key)
+		assert.Equal(t, tt.fields, fields, tt.key)
+	}
+
+	_, _, err := DescribeKey([]byte("unknown:1"))
+	assert.True(t, errors.Is(err, ErrUnknownKey))
+
+	for _, key := range []string{"conversation:", "channel:g1", "channel:g1-abc", "channel:-2", "channel:g1-256"} {
+		_, _, err = DescribeKey([]byte(key))
+		assert.True(t, errors.Is(err, ErrInvalidKey), key)
+	}
+}
+
+func TestRegisterKeyDescriber(t *testing.T) {
+	RegisterKeyDescriber("conversationTest:", "conversation_test", func(rest string) (map[string]string, error) {
+		return map[string]string{"rest": rest}, nil
+	})
+	defer func() {
+		keyDescribersLock.Lock()
+		defer keyDescribersLock.Unlock()
+		for i, entry := range keyDescribers {
+			if entry.prefix == "conversationTest:" {
+				keyDescribers = append(keyDescribers[:i], keyDescribers[i+1:]...)
+				break
+			}
+		}
+	}()
+	// 前缀更长的优先匹配
+	table, fields, err := DescribeKey([]byte("conversationTest:abc"))
+	assert.NoError(t, err)
+	assert.Equal(t, "conversation_test", table)
+	assert.Equal(t, map[string]string{"rest": "abc"}, fields)
+
+	table, _, err = DescribeKey([]byte("conversation:abc"))
+	assert.NoError(t, err)
+	assert.Equal(t, "conversation", table)
+}
+
+func TestDumpKeys(t *testing.T) {
+	store := newTestFileStore(t)
+	store.cfg.SlotNum = 1 // 测试中所有的key都在一个slot里
+	for i := 0; i < 3; i++ {
+		uid := fmt.Sprintf("u%d", i)
+		err := store.AddOrUpdateConversations(uid, []*Conversation{{UID: uid, ChannelID: "g1", ChannelType: 2}})
+		assert.NoError(t, err)
+	}
+	err := store.AddSubscribers("g1", 2, []string{"u0", "u1"})
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	err = store.DumpKeys(0, []byte(conversationKeyPrefix), 2, &buf)
+	assert.NoError(t, err)
+	keys := make([]*DescribedKey, 0)
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		key := &DescribedKey{}
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), key))
+		keys = append(keys, key)
+	}
+	assert.Equal(t, 2, len(keys))
+	assert.Equal(t, "conversation:u0", keys[0].Key)
+	assert.Equal(t, "conversation", keys[0].Table)
+	assert.Equal(t, map[string]string{"uid": "u0"}, keys[0].Fields)
+	assert.Greater(t, keys[0].ValueSize, 0)
+	assert.Equal(t, "conversation:u1", keys[1].Key)
+
+	buf.Reset()
+	err = store.DumpKeys(0, nil, 0, &buf)
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), `"table":"subscribers"`)
+	assert.Contains(t, buf.String(), `"key":"conversation:u2"`)
+}
@@ -0,0 +1,85 @@
+package wkstore
+
+import (
+	"context"
+	"time"
+)
+
+// MaintenanceOptions 维护操作（频道迁移，重新压缩等）的通用参数
+type MaintenanceOptions struct {
+	DryRun    bool                // 只完整扫描并返回会修改的数据，不写入
+	RateLimit int                 // 每秒最多处理的用户数量，0表示不限制
+	Progress  func(ProgressEvent) // 进度回调，每处理完一批调用一次，可以用来显示进度条
+}
+
+// ProgressEvent 维护操作的进度
+type ProgressEvent struct {
+	Op      string        // 维护操作的名称
+	DryRun  bool          // 是否是DryRun
+	Total   int           // 需要处理的用户数量
+	Scanned int           // 已处理的用户数量
+	Changed int           // 已修改（DryRun时为会修改）的数量
+	Elapsed time.Duration // 已耗时
+	Done    bool          // 是否已完成
+}
+
+// maintenance 维护操作的进度和限速
+type maintenance struct {
+	opts  MaintenanceOptions
+	event ProgressEvent
+	start time.Time
+}
+
+// newMaintenance total为需要处理的用户数量，<0表示遍历完之前不知道总数
+func newMaintenance(op string, opts MaintenanceOptions, total int) *maintenance {
+	return &maintenance{
+		opts:  opts,
+		event: ProgressEvent{Op: op, DryRun: opts.DryRun, Total: total},
+		start: time.Now(),
+	}
+}
+
+// batchSize 每批处理的用户数量，限速时不超过每秒的处理数量
+func (m *maintenance) batchSize(cfg *StoreConfig) int {
+	batchSize := cfg.ScanBatchSize
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+	if m.opts.RateLimit > 0 && batchSize > m.opts.RateLimit {
+		batchSize = m.opts.RateLimit
+	}
+	return batchSize
+}
+
+// advance 处理完一批后更新进度，限速时等待到这批允许的时间
+func (m *maintenance) advance(ctx context.Context, scanned int, changed int) error {
+	m.event.Scanned += scanned
+	m.event.Changed += changed
+	m.event.Elapsed = time.Since(m.start)
+	m.report()
+	if m.opts.RateLimit <= 0 || (m.event.Total >= 0 && m.event.Scanned >= m.event.Total) {
+		return nil
+	}
+	expect := time.Duration(m.event.Scanned) * time.Second / time.Duration(m.opts.RateLimit)
+	if wait := expect - m.event.Elapsed; wait > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	return nil
+}
+
+// done 完成后回调最后一次进度
+func (m *maintenance) done() {
+	m.event.Elapsed = time.Since(m.start)
+	m.event.Done = true
+	m.report()
+}
+
+func (m *maintenance) report() {
+	if m.opts.Progress != nil {
+		m.opts.Progress(m.event)
+	}
+}
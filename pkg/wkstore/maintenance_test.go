@@ -0,0 +1,101 @@
+package wkstore
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+// reopenReadOnly 以只读方式重新打开数据库，写入会返回bolt.ErrDatabaseReadOnly
+func reopenReadOnly(t *testing.T, store *FileStore) {
+	path := filepath.Join(store.cfg.DataDir, "wukongim.db")
+	assert.NoError(t, store.db.Close())
+	db, err := bolt.Open(path, 0755, &bolt.Options{ReadOnly: true})
+	assert.NoError(t, err)
+	store.db = db
+	assert.ErrorIs(t, store.AddSubscribers("readonly", 2, []string{"u1"}), bolt.ErrDatabaseReadOnly)
+}
+
+func TestMaintenanceDryRunWritesNothing(t *testing.T) {
+	store := newTestFileStore(t)
+	store.cfg.ScanBatchSize = 2
+	store.cfg.ScanBatchBackoff = 0
+	store.cfg.ConversationCompressThreshold = 256
+
+	uids := []string{"u1", "u2", "u3"}
+	assert.NoError(t, store.AddSubscribers("g1", 2, uids))
+	for _, uid := range uids {
+		conversations := newCompressTestConversations(uid, 50)
+		conversations[0].ChannelID, conversations[0].ChannelType = "g1", 2
+		assert.NoError(t, store.AddOrUpdateConversations(uid, conversations))
+	}
+	store.cfg.ConversationCompress = true
+	reopenReadOnly(t, store)
+
+	events := make([]ProgressEvent, 0)
+	opts := MaintenanceOptions{DryRun: true, Progress: func(event ProgressEvent) {
+		events = append(events, event)
+	}}
+	keys, err := store.MigrateConversationsChannel("g1", 2, "sg1", 3, opts)
+	assert.NoError(t, err)
+	assert.Len(t, keys, 3)
+	assert.Len(t, events, 3) // 两批和完成
+	last := events[len(events)-1]
+	assert.True(t, last.Done)
+	assert.True(t, last.DryRun)
+	assert.Equal(t, 3, last.Total)
+	assert.Equal(t, 3, last.Scanned)
+	assert.Equal(t, 3, last.Changed)
+
+	events = events[:0]
+	count, err := store.RecompressConversations(context.Background(), opts)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+	assert.True(t, events[len(events)-1].Done)
+	assert.Equal(t, 3, events[len(events)-1].Changed)
+
+	// 没有修改
+	subscribers, err := store.GetSubscribers("g1", 2)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, uids, subscribers)
+	exist, err := store.ExistConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.True(t, exist)
+	assert.NotEqual(t, conversationCodecSnappy, getStoredConversations(t, store, "u1")[0])
+}
+
+func TestMaintenanceProgressAndRateLimit(t *testing.T) {
+	store := newTestFileStore(t)
+	uids := make([]string, 0, 10)
+	for i := 0; i < 10; i++ {
+		uid := fmt.Sprintf("u%d", i)
+		uids = append(uids, uid)
+		assert.NoError(t, store.AddOrUpdateConversations(uid, []*Conversation{{UID: uid, ChannelID: "g1", ChannelType: 2, Version: 1}}))
+	}
+	assert.NoError(t, store.AddSubscribers("g1", 2, uids))
+
+	events := make([]ProgressEvent, 0)
+	keys, err := store.MigrateConversationsChannel("g1", 2, "sg1", 3, MaintenanceOptions{RateLimit: 100, Progress: func(event ProgressEvent) {
+		events = append(events, event)
+	}})
+	assert.NoError(t, err)
+	assert.Len(t, keys, 10)
+	assert.Len(t, events, 2)
+	assert.Equal(t, 10, events[0].Scanned)
+	assert.True(t, events[1].Done)
+
+	// 每秒100个，处理完5个后至少要到50毫秒
+	m := newMaintenance("test", MaintenanceOptions{RateLimit: 100}, 1000)
+	assert.Equal(t, 100, m.batchSize(store.cfg))
+	assert.NoError(t, m.advance(context.Background(), 5, 0))
+	assert.GreaterOrEqual(t, time.Since(m.start), time.Millisecond*50)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, m.advance(ctx, 5, 0), context.Canceled)
+}
@@ -0,0 +1,123 @@
+package wkstore
+
+import (
+	"time"
+	"unsafe"
+
+	"go.uber.org/zap"
+)
+
+// MemoryPressureLevel 内存压力等级（内存使用量相对StoreConfig.MemoryBudget）
+type MemoryPressureLevel int32
+
+const (
+	// MemoryPressureNone 低于MemoryWarningRatio
+	MemoryPressureNone MemoryPressureLevel = iota
+	// MemoryPressureWarning 达到MemoryWarningRatio，调用方应该开始拒绝新的工作
+	MemoryPressureWarning
+	// MemoryPressureCritical 达到MemoryCriticalRatio，不再写入非必要的数据（比如缓存）
+	MemoryPressureCritical
+)
+
+func (l MemoryPressureLevel) String() string {
+	switch l {
+	case MemoryPressureNone:
+		return "none"
+	case MemoryPressureWarning:
+		return "warning"
+	case MemoryPressureCritical:
+		return "critical"
+	}
+	return "unknown"
+}
+
+// MemoryUsage 存储层占用内存的估算（字节），不包括bolt的mmap（由系统的page cache管理）
+type MemoryUsage struct {
+	ChannelInfoCache      int64 `json:"channel_info_cache"`       // 频道名称和头像缓存
+	ChannelInfoCacheCount int   `json:"channel_info_cache_count"` // 频道名称和头像缓存的数量
+	SegmentCacheCount     int   `json:"segment_cache_count"`      // 打开的消息段数量
+	BoltFreelist          int64 `json:"bolt_freelist"`            // bolt空闲页列表
+	External              int64 `json:"external"`                 // 调用方为存储层缓存的数据（StoreConfig.ExternalMemoryUsage，比如最近会话缓存）
+	Total                 int64 `json:"total"`
+}
+
+// channelInfoCacheEntrySize 频道名称和头像缓存每一项除了字符串内容以外的估算大小（lru的节点和map的项）
+const channelInfoCacheEntrySize = int64(unsafe.Sizeof(channelDisplayInfo{})) + 96
+
+// MemoryUsage 当前内存使用量的估算，同时按MemoryBudget更新内存压力等级
+func (f *FileStore) MemoryUsage() MemoryUsage {
+	usage := f.memoryUsage()
+	f.updateMemoryPressure(usage)
+	return usage
+}
+
+func (f *FileStore) memoryUsage() MemoryUsage {
+	var usage MemoryUsage
+	for _, key := range f.channelInfoCache.Keys() {
+		info, ok := f.channelInfoCache.Peek(key)
+		if !ok {
+			continue
+		}
+		usage.ChannelInfoCache += channelInfoCacheEntrySize + int64(len(key)+len(info.name)+len(info.avatar))
+		usage.ChannelInfoCacheCount++
+	}
+	usage.SegmentCacheCount = segmentCache.Len()
+	if f.db != nil {
+		usage.BoltFreelist = int64(f.db.Stats().FreelistInuse)
+	}
+	if f.cfg.ExternalMemoryUsage != nil {
+		usage.External = f.cfg.ExternalMemoryUsage()
+	}
+	usage.Total = usage.ChannelInfoCache + usage.BoltFreelist + usage.External
+	return usage
+}
+
+// MemoryPressure 最后一次检查的内存压力等级，没有配置MemoryBudget时一直为MemoryPressureNone
+func (f *FileStore) MemoryPressure() MemoryPressureLevel {
+	return MemoryPressureLevel(f.memoryPressure.Load())
+}
+
+func (f *FileStore) memoryPressureLevel(total int64) MemoryPressureLevel {
+	budget := f.cfg.MemoryBudget
+	if budget <= 0 {
+		return MemoryPressureNone
+	}
+	if float64(total) >= float64(budget)*f.cfg.MemoryCriticalRatio {
+		return MemoryPressureCritical
+	}
+	if float64(total) >= float64(budget)*f.cfg.MemoryWarningRatio {
+		return MemoryPressureWarning
+	}
+	return MemoryPressureNone
+}
+
+// updateMemoryPressure 内存压力等级变化时调用OnMemoryPressure
+func (f *FileStore) updateMemoryPressure(usage MemoryUsage) {
+	level := f.memoryPressureLevel(usage.Total)
+	old := MemoryPressureLevel(f.memoryPressure.Swap(int32(level)))
+	if old == level {
+		return
+	}
+	f.Warn("memory pressure changed", zap.String("from", old.String()), zap.String("to", level.String()), zap.Int64("total", usage.Total), zap.Int64("budget", f.cfg.MemoryBudget))
+	if f.cfg.OnMemoryPressure != nil {
+		f.cfg.OnMemoryPressure(level, usage)
+	}
+}
+
+// memoryCheckLoop 定时检查内存使用量
+func (f *FileStore) memoryCheckLoop(stop chan struct{}) {
+	interval := f.cfg.MemoryCheckInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.MemoryUsage()
+		case <-stop:
+			return
+		}
+	}
+}
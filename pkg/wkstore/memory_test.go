@@ -0,0 +1,83 @@
+package wkstore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/atomic"
+)
+
+func TestMemoryPressureWatermarks(t *testing.T) {
+	store := newTestFileStore(t)
+	store.cfg.ConversationChannelInfo = true
+	var external atomic.Int64
+	store.cfg.ExternalMemoryUsage = external.Load
+	store.cfg.MemoryBudget = 100000
+	levels := make([]MemoryPressureLevel, 0)
+	store.cfg.OnMemoryPressure = func(level MemoryPressureLevel, usage MemoryUsage) {
+		levels = append(levels, level)
+	}
+
+	// 填充频道信息缓存
+	for i := 0; i < 100; i++ {
+		_, err := store.RefreshConversationChannelInfo(fmt.Sprintf("g%03d", i), 2, "name", "avatar")
+		assert.NoError(t, err)
+	}
+	usage := store.MemoryUsage()
+	assert.Equal(t, 100, usage.ChannelInfoCacheCount)
+	entrySize := channelInfoCacheEntrySize + int64(len(channelInfoCacheKey("g000", 2))+len("name")+len("avatar"))
+	assert.Equal(t, 100*entrySize, usage.ChannelInfoCache)
+	assert.Equal(t, usage.ChannelInfoCache+usage.BoltFreelist, usage.Total)
+	assert.Equal(t, MemoryPressureNone, store.MemoryPressure())
+	assert.Empty(t, levels)
+
+	// 达到警告水位
+	external.Store(80000 - usage.Total)
+	store.MemoryUsage()
+	assert.Equal(t, MemoryPressureWarning, store.MemoryPressure())
+	// 达到严重水位，不再缓存频道信息，已缓存的删除
+	external.Store(95000 - usage.Total)
+	store.MemoryUsage()
+	assert.Equal(t, MemoryPressureCritical, store.MemoryPressure())
+	_, err := store.RefreshConversationChannelInfo("g000", 2, "new name", "avatar")
+	assert.NoError(t, err)
+	_, err = store.RefreshConversationChannelInfo("g999", 2, "name", "avatar")
+	assert.NoError(t, err)
+	assert.Equal(t, 99, store.memoryUsage().ChannelInfoCacheCount)
+
+	// 恢复
+	external.Store(0)
+	store.MemoryUsage()
+	assert.Equal(t, MemoryPressureNone, store.MemoryPressure())
+	_, err = store.RefreshConversationChannelInfo("g999", 2, "name", "avatar")
+	assert.NoError(t, err)
+	assert.Equal(t, 100, store.MemoryUsage().ChannelInfoCacheCount)
+
+	// 等级没有变化不回调
+	store.MemoryUsage()
+	assert.Equal(t, []MemoryPressureLevel{MemoryPressureWarning, MemoryPressureCritical, MemoryPressureNone}, levels)
+}
+
+func TestMemoryCheckLoop(t *testing.T) {
+	cfg := NewStoreConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.MemoryBudget = 1000
+	cfg.MemoryCheckInterval = time.Millisecond * 10
+	cfg.ExternalMemoryUsage = func() int64 { return 2000 }
+	levels := make(chan MemoryPressureLevel, 1)
+	cfg.OnMemoryPressure = func(level MemoryPressureLevel, usage MemoryUsage) {
+		levels <- level
+	}
+	store := NewFileStore(cfg)
+	assert.NoError(t, store.Open())
+	defer store.Close()
+
+	select {
+	case level := <-levels:
+		assert.Equal(t, MemoryPressureCritical, level)
+	case <-time.After(time.Second * 5):
+		t.Fatal("memory pressure not checked")
+	}
+}
@@ -4,101 +4,243 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/WuKongIM/WuKongIM/pkg/wkutil"
 	wkproto "github.com/WuKongIM/WuKongIMGoProto"
 )
 
-const conversationVersion = 0x1
+const (
+	conversationVersionV1 = 0x1 // 版本号 + 数据
+	conversationVersionV2 = 0x2 // 版本号 + 数据长度 + 数据
+	conversationVersionV3 = 0x3 // v2的数据后追加频道名称和频道头像
+	conversationVersionV4 = 0x4 // v3的数据后追加是否已离开频道
+	conversationVersionV5 = 0x5 // v4的数据后追加置顶时间
+	conversationVersionV6 = 0x6 // v5的数据后追加免打扰
+	conversationVersionV7 = 0x7 // v6的数据后追加扩展数据
+	conversationVersionV8 = 0x8 // v7的数据后追加是否已归档
+	conversationVersion   = 0x9 // 当前版本：v8的数据后追加提及数量
+)
 
 // Conversation Conversation
 type Conversation struct {
 	UID             string // User UID (user who belongs to the most recent session)
 	ChannelID       string // Conversation channel
 	ChannelType     uint8
-	UnreadCount     int    // Number of unread messages
-	Timestamp       int64  // Last session timestamp (10 digits)
-	LastMsgSeq      uint32 // Sequence number of the last message
-	LastClientMsgNo string // Last message client number
-	LastMsgID       int64  // Last message ID
-	Version         int64  // Data version
+	UnreadCount     int               // Number of unread messages
+	Timestamp       int64             // Last session timestamp (10 digits)
+	LastMsgSeq      uint32            // Sequence number of the last message
+	LastClientMsgNo string            // Last message client number
+	LastMsgID       int64             // Last message ID
+	Version         int64             // Data version
+	ChannelName     string            // 频道名称（开启ConversationChannelInfo后冗余存储）
+	ChannelAvatar   string            // 频道头像（开启ConversationChannelInfo后冗余存储）
+	Left            bool              // 用户已离开频道（冻结的最近会话，不再更新），重新加入后清除
+	PinnedAt        int64             // 置顶的时间（毫秒），0表示没有置顶，只能通过SetConversationPinned修改
+	Mute            uint8             // 免打扰（1表示开启），只能通过SetConversationMute修改
+	Extra           map[string]string // 业务自定义的扩展数据，只能通过SetConversationExtra修改，不要修改返回的map（可能和缓存共用）
+	Archived        bool              // 已归档（默认不在最近会话列表里返回，未读数等照常更新），只能通过SetConversationArchived修改
+	MentionCount    uint32            // 提及（@）用户的未读消息数量，只能通过IncConversationMentionCount修改，已读时可以清零（见ConversationReadTo.ResetMentions）
+}
+
+// ClampExpired 频道内messageSeq<=uptoSeq的消息过期后修正最近会话
+// 未读数不能超过剩余的消息数量，最后一条消息过期则清空最后一条消息的信息，返回最近会话是否有修改
+func (c *Conversation) ClampExpired(uptoSeq uint32) bool {
+	var remaining int
+	if c.LastMsgSeq > uptoSeq {
+		remaining = int(c.LastMsgSeq - uptoSeq)
+	}
+	modify := false
+	if c.UnreadCount > remaining {
+		c.UnreadCount = remaining
+		modify = true
+	}
+	if c.LastMsgSeq <= uptoSeq && (c.LastClientMsgNo != "" || c.LastMsgID != 0) {
+		c.LastClientMsgNo = ""
+		c.LastMsgID = 0
+		modify = true
+	}
+	if modify {
+		c.Version = time.Now().UnixNano() / 1e6
+	}
+	return modify
+}
+
+// ReadTo 用户已读到readToMsgSeq（包含），未读数修正为剩余的消息数量，已读位置（LastMsgSeq-UnreadCount）已经不小于readToMsgSeq时不修改，返回最近会话是否有修改
+func (c *Conversation) ReadTo(readToMsgSeq uint32) bool {
+	unread := 0
+	if c.LastMsgSeq > readToMsgSeq {
+		unread = int(c.LastMsgSeq - readToMsgSeq)
+	}
+	if unread >= c.UnreadCount {
+		return false
+	}
+	c.UnreadCount = unread
+	c.Version = time.Now().UnixNano() / 1e6
+	return true
+}
+
+// Recall 频道内messageSeq的消息撤回后修正最近会话
+// 撤回的消息还没读（在已读位置LastMsgSeq-UnreadCount之后）时未读数减1，撤回的是最后一条消息时清空最后一条消息的信息（客户端按LastMsgSeq获取到已撤回的消息），返回最近会话是否有修改
+// 未读数只记录了数量，同一条消息重复调用会重复减少未读数
+func (c *Conversation) Recall(messageSeq uint32) bool {
+	if messageSeq == 0 || messageSeq > c.LastMsgSeq {
+		return false
+	}
+	modify := false
+	if c.UnreadCount > 0 && int(c.LastMsgSeq-messageSeq) < c.UnreadCount {
+		c.UnreadCount--
+		modify = true
+	}
+	if c.LastMsgSeq == messageSeq && (c.LastClientMsgNo != "" || c.LastMsgID != 0) {
+		c.LastClientMsgNo = ""
+		c.LastMsgID = 0
+		modify = true
+	}
+	if modify {
+		c.Version = time.Now().UnixNano() / 1e6
+	}
+	return modify
+}
+
+// Edit 频道内messageSeq的消息编辑后修正最近会话，编辑的是最后一条消息时更新数据版本（客户端增量同步时重新获取最后一条消息），返回最近会话是否有修改
+func (c *Conversation) Edit(messageSeq uint32) bool {
+	if messageSeq == 0 || c.LastMsgSeq != messageSeq {
+		return false
+	}
+	c.Version = time.Now().UnixNano() / 1e6
+	return true
+}
+
+// RefreshChannelInfo 更新冗余的频道名称和头像，返回最近会话是否有修改（有修改时更新数据版本，客户端增量同步时能拿到）
+func (c *Conversation) RefreshChannelInfo(name string, avatar string) bool {
+	if c.ChannelName == name && c.ChannelAvatar == avatar {
+		return false
+	}
+	c.ChannelName = name
+	c.ChannelAvatar = avatar
+	c.Version = time.Now().UnixNano() / 1e6
+	return true
+}
+
+// Pinned 最近会话是否已置顶
+func (c *Conversation) Pinned() bool {
+	return c.PinnedAt > 0
+}
+
+// Muted 最近会话是否开启了免打扰
+func (c *Conversation) Muted() bool {
+	return c.Mute == 1
 }
 
 func (c *Conversation) String() string {
 	return fmt.Sprintf("uid:%s channelID:%s channelType:%d unreadCount:%d timestamp: %d lastMsgSeq:%d lastClientMsgNo:%s lastMsgID:%d version:%d", c.UID, c.ChannelID, c.ChannelType, c.UnreadCount, c.Timestamp, c.LastMsgSeq, c.LastClientMsgNo, c.LastMsgID, c.Version)
 }
 
+// ConversationKey 最近会话的唯一标识
+type ConversationKey struct {
+	UID         string
+	ChannelID   string
+	ChannelType uint8
+}
+
 type ConversationSet []*Conversation
 
+// Encode 每条最近会话编码为 版本号(uint8) + 数据长度(uint32) + 数据，旧版本的节点可以通过长度跳过不认识的尾部字段
+// 所有最近会话编码到同一块按估算大小分配的内存里，返回的数据归调用方所有（写入bolt时要保持到事务提交，不能复用）
 func (c ConversationSet) Encode() []byte {
-	enc := wkproto.NewEncoder()
-	defer enc.End()
+	data := make([]byte, 0, c.encodeSizeHint())
 	for _, cn := range c {
-		enc.WriteUint8(conversationVersion)
-		enc.WriteString(cn.UID)
-		enc.WriteString(cn.ChannelID)
-		enc.WriteUint8(cn.ChannelType)
-		enc.WriteInt32(int32(cn.UnreadCount))
-		enc.WriteInt64(cn.Timestamp)
-		enc.WriteUint32(cn.LastMsgSeq)
-		enc.WriteString(cn.LastClientMsgNo)
-		enc.WriteInt64(cn.LastMsgID)
-		enc.WriteInt64(cn.Version)
+		data = appendConversation(data, conversationFields, conversationVersion, cn)
 	}
-	return enc.Bytes()
+	return data
 }
 
+// conversationFixedSize 当前版本一条最近会话除了字符串内容外的编码长度（向上取整）
+const conversationFixedSize = 64
+
+// encodeSizeHint 估算编码后的长度（扩展数据的json没有算在内，有扩展数据时会再扩容）
+func (c ConversationSet) encodeSizeHint() int {
+	size := 0
+	for _, cn := range c {
+		size += conversationFixedSize + len(cn.UID) + len(cn.ChannelID) + len(cn.LastClientMsgNo) + len(cn.ChannelName) + len(cn.ChannelAvatar)
+	}
+	return size
+}
+
+// NewConversationSet 解码最近会话，解码失败时返回已解码的部分
 func NewConversationSet(data []byte) ConversationSet {
+	conversationSet, _ := DecodeConversationSet(data)
+	return conversationSet
+}
+
+// DecodeConversationSet 解码最近会话，兼容旧版本（v1没有数据长度）的数据，新版本的数据里不认识的尾部字段会被忽略
+func DecodeConversationSet(data []byte) (ConversationSet, error) {
 	conversationSet := ConversationSet{}
 	decoder := wkproto.NewDecoder(data)
-
-	for {
-		conversation, err := decodeConversation(decoder)
-		if err == io.EOF {
-			break
+	for decoder.Len() > 0 {
+		conversation, err := decodeConversation(decoder, false)
+		if err != nil {
+			return conversationSet, err
 		}
 		conversationSet = append(conversationSet, conversation)
 	}
-	return conversationSet
+	return conversationSet, nil
 }
 
-func decodeConversation(decoder *wkproto.Decoder) (*Conversation, error) {
-	// proto version
-	_, err := decoder.Uint8()
+// decodeConversations 解码存储的最近会话，兼容旧的json格式的数据
+func decodeConversations(data []byte, onlyChannel bool) ([]*Conversation, error) {
+	data, err := decompressConversations(data)
 	if err != nil {
 		return nil, err
 	}
-	cn := &Conversation{}
-
-	if cn.UID, err = decoder.String(); err != nil {
-		return nil, err
-	}
-	if cn.ChannelID, err = decoder.String(); err != nil {
-		return nil, err
-	}
-	if cn.ChannelType, err = decoder.Uint8(); err != nil {
-		return nil, err
+	if len(data) > 0 && (data[0] == '[' || data[0] == 'n') { // 旧的json格式（版本号都小于'['）
+		var conversations []*Conversation
+		err := wkutil.ReadJSONByByte(data, &conversations)
+		return conversations, err
 	}
-	var unreadCount uint32
-	if unreadCount, err = decoder.Uint32(); err != nil {
-		return nil, err
+	conversations := make([]*Conversation, 0)
+	decoder := wkproto.NewDecoder(data)
+	for decoder.Len() > 0 {
+		conversation, err := decodeConversation(decoder, onlyChannel)
+		if err != nil {
+			return nil, err
+		}
+		conversations = append(conversations, conversation)
 	}
-	cn.UnreadCount = int(unreadCount)
+	return conversations, nil
+}
 
-	if cn.Timestamp, err = decoder.Int64(); err != nil {
+// decodeConversation 解码一条最近会话，onlyChannel为true时只解码uid和频道信息
+func decodeConversation(decoder *wkproto.Decoder, onlyChannel bool) (*Conversation, error) {
+	version, err := decoder.Uint8()
+	if err != nil {
 		return nil, err
 	}
-	if cn.LastMsgSeq, err = decoder.Uint32(); err != nil {
-		return nil, err
+	if version == conversationVersionV1 { // v1没有数据长度，只能按字段依次解码
+		return decodeConversationBody(decoder, version, false)
 	}
-	if cn.LastClientMsgNo, err = decoder.String(); err != nil {
+	size, err := decoder.Uint32()
+	if err != nil {
 		return nil, err
 	}
-	if cn.LastMsgID, err = decoder.Int64(); err != nil {
+	body, err := decoder.Bytes(int(size))
+	if err != nil {
 		return nil, err
 	}
-	if cn.Version, err = decoder.Int64(); err != nil {
-		return nil, err
+	// 新版本的字段都追加在后面，解码已知的字段，剩余的忽略
+	return decodeConversationBody(wkproto.NewDecoder(body), version, onlyChannel)
+}
+
+func decodeConversationBody(decoder *wkproto.Decoder, version uint8, onlyChannel bool) (*Conversation, error) {
+	cn := &Conversation{}
+	for _, field := range conversationFields {
+		if field.version > version || (onlyChannel && !field.key) {
+			break
+		}
+		if err := field.decode(decoder, cn); err != nil {
+			return nil, err
+		}
 	}
 	return cn, nil
 }
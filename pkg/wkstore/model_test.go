@@ -0,0 +1,214 @@
+package wkstore
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/WuKongIM/WuKongIM/pkg/wkutil"
+	wkproto "github.com/WuKongIM/WuKongIMGoProto"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func testConversations() ConversationSet {
+	return ConversationSet{
+		{UID: "u1", ChannelID: "g1", ChannelType: 2, UnreadCount: 3, Timestamp: 1700000000, LastMsgSeq: 10, LastClientMsgNo: "no10", LastMsgID: 100, Version: 1},
+		{UID: "u1", ChannelID: "u2", ChannelType: 1, UnreadCount: 0, Timestamp: 1700000001, LastMsgSeq: 2, LastClientMsgNo: "", LastMsgID: 22, Version: 2},
+	}
+}
+
+func encodeConversationFields(enc *wkproto.Encoder, cn *Conversation) {
+	enc.WriteString(cn.UID)
+	enc.WriteString(cn.ChannelID)
+	enc.WriteUint8(cn.ChannelType)
+	enc.WriteInt32(int32(cn.UnreadCount))
+	enc.WriteInt64(cn.Timestamp)
+	enc.WriteUint32(cn.LastMsgSeq)
+	enc.WriteString(cn.LastClientMsgNo)
+	enc.WriteInt64(cn.LastMsgID)
+	enc.WriteInt64(cn.Version)
+}
+
+func TestConversationSetEncodeDecode(t *testing.T) {
+	conversations := testConversations()
+	data := conversations.Encode()
+	assert.Equal(t, uint8(conversationVersion), data[0])
+
+	decoded, err := DecodeConversationSet(data)
+	assert.NoError(t, err)
+	assert.Equal(t, conversations, decoded)
+
+	conversations[0].ChannelName = "group1"
+	conversations[0].ChannelAvatar = "http://avatar/g1.png"
+	data = conversations.Encode()
+	decoded, err = DecodeConversationSet(data)
+	assert.NoError(t, err)
+	assert.Equal(t, conversations, decoded)
+
+	onlyChannels, err := decodeConversations(data, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(onlyChannels))
+	assert.Equal(t, "u2", onlyChannels[1].ChannelID)
+	assert.Equal(t, int64(0), onlyChannels[1].LastMsgID)
+
+	_, err = DecodeConversationSet(data[:len(data)-1])
+	assert.Error(t, err)
+}
+
+// v1的数据没有数据长度
+func TestConversationSetDecodeV1(t *testing.T) {
+	conversations := testConversations()
+	enc := wkproto.NewEncoder()
+	defer enc.End()
+	for _, cn := range conversations {
+		enc.WriteUint8(conversationVersionV1)
+		encodeConversationFields(enc, cn)
+	}
+	decoded, err := DecodeConversationSet(enc.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, conversations, decoded)
+}
+
+// v2的数据没有频道名称和头像
+func TestConversationSetDecodeV2(t *testing.T) {
+	conversations := testConversations()
+	enc := wkproto.NewEncoder()
+	defer enc.End()
+	for _, cn := range conversations {
+		body := wkproto.NewEncoder()
+		encodeConversationFields(body, cn)
+		enc.WriteUint8(conversationVersionV2)
+		enc.WriteUint32(uint32(body.Len()))
+		enc.WriteBytes(body.Bytes())
+		body.End()
+	}
+	decoded, err := DecodeConversationSet(enc.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, conversations, decoded)
+}
+
+// 新版本追加了字段（比如置顶，免打扰，预览），当前版本解码时忽略不认识的字段
+func TestConversationSetDecodeNextVersion(t *testing.T) {
+	conversations := testConversations()
+	enc := wkproto.NewEncoder()
+	defer enc.End()
+	for _, cn := range conversations {
+		body := wkproto.NewEncoder()
+		encodeConversationFields(body, cn)
+		body.WriteString(cn.ChannelName)
+		body.WriteString(cn.ChannelAvatar)
+		body.WriteUint8(0)                                  // left
+		body.WriteInt64(cn.PinnedAt)                        // pinned_at
+		body.WriteUint8(cn.Mute)                            // mute
+		body.WriteString(encodeConversationExtra(cn.Extra)) // extra
+		body.WriteUint8(0)                                  // archived
+		body.WriteUint32(cn.MentionCount)                   // mention_count
+		body.WriteUint8(1)                                  // hidden
+		body.WriteString("preview...")                      // preview
+
+		enc.WriteUint8(conversationVersion + 1)
+		enc.WriteUint32(uint32(body.Len()))
+		enc.WriteBytes(body.Bytes())
+		body.End()
+	}
+	decoded, err := DecodeConversationSet(enc.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, conversations, decoded)
+}
+
+// 编码到同一块内存里，不再给每个字段分配小的slice（之前10000条最近会话有两万多次内存分配）
+func TestConversationSetEncodeAllocs(t *testing.T) {
+	conversations := ConversationSet(newCompressTestConversations("u1", 10000))
+	allocs := testing.AllocsPerRun(10, func() {
+		conversations.Encode()
+	})
+	assert.LessOrEqual(t, allocs, float64(2))
+
+	// 有扩展数据时只有json编码的分配
+	for _, cn := range conversations[:100] {
+		cn.Extra = map[string]string{"draft": "hello"}
+	}
+	allocs = testing.AllocsPerRun(10, func() {
+		conversations.Encode()
+	})
+	assert.Less(t, allocs, float64(500))
+}
+
+// 同一个事务里写入多个用户的最近会话，每次编码的数据是独立的，事务提交前不会被后面的编码覆盖（bolt不复制value）
+func TestConversationSetEncodeNotAliased(t *testing.T) {
+	store := newTestFileStore(t)
+	conversations := newCompressTestConversations("", 20)
+	expected := make(map[string][]*Conversation)
+	err := store.update(func(tx *bolt.Tx) error {
+		for i := 0; i < 50; i++ {
+			uid := fmt.Sprintf("u%d", i)
+			for _, cn := range conversations {
+				cn.UID = uid
+				cn.UnreadCount = i
+			}
+			bucket, err := store.getSlotBucketWithKey(uid, tx)
+			if err != nil {
+				return err
+			}
+			if err = store.putUserConversationsInTx(bucket, uid, store.encodeConversations(conversations)); err != nil {
+				return err
+			}
+			snapshot := snapshotConversations(conversations)
+			for j := range snapshot {
+				expected[uid] = append(expected[uid], &snapshot[j])
+			}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	for uid, conversations := range expected {
+		stored, err := store.GetConversations(uid)
+		assert.NoError(t, err)
+		assert.Equal(t, conversations, stored)
+	}
+}
+
+func BenchmarkConversationSetEncode(b *testing.B) {
+	conversations := ConversationSet(newCompressTestConversations("u1", 10000))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conversations.Encode()
+	}
+}
+
+func TestConversationsDecodeLegacyJSON(t *testing.T) {
+	conversations := testConversations()
+	decoded, err := decodeConversations([]byte(wkutil.ToJSON(conversations)), false)
+	assert.NoError(t, err)
+	assert.Equal(t, []*Conversation(conversations), decoded)
+
+	decoded, err = decodeConversations([]byte("null"), false)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(decoded))
+
+	// 存储里旧的json数据可以正常读取，更新后写入新的格式
+	store := newTestFileStore(t)
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := store.getSlotBucketWithKey("u1", tx)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(store.getConversationKey("u1")), []byte(wkutil.ToJSON(conversations)))
+	})
+	assert.NoError(t, err)
+
+	conversation, err := store.GetConversation("u1", "g1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, conversation.UnreadCount)
+
+	err = store.AddOrUpdateConversations("u1", []*Conversation{{UID: "u1", ChannelID: "g2", ChannelType: 2}})
+	assert.NoError(t, err)
+	value, err := store.get(store.slotNum("u1"), []byte(store.getConversationKey("u1")))
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(conversationVersion), value[0])
+
+	result, err := store.GetConversations("u1")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(result))
+}
@@ -0,0 +1,176 @@
+package wkstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// StartupCheckMode 打开数据库时检查最近会话数据的方式
+type StartupCheckMode string
+
+const (
+	// StartupCheckOff 不检查
+	StartupCheckOff StartupCheckMode = "off"
+	// StartupCheckSample 从随机的slot开始检查，最多StartupCheckSampleKeys个用户，超过StartupCheckBudget提前结束
+	StartupCheckSample StartupCheckMode = "sample"
+	// StartupCheckFull 检查所有用户
+	StartupCheckFull StartupCheckMode = "full"
+)
+
+// startupCheckMaxUIDs 检查结果里最多返回的损坏用户uid数量
+const startupCheckMaxUIDs = 100
+
+// StartupCheckReport 打开数据库时检查最近会话数据的结果
+type StartupCheckReport struct {
+	Mode         StartupCheckMode `json:"mode"`
+	Users        int              `json:"users"`         // 检查的用户数量
+	Rows         int              `json:"rows"`          // 检查的最近会话数量
+	Undecodable  int              `json:"undecodable"`   // 最近会话数据解码失败的用户数量
+	Duplicates   int              `json:"duplicates"`    // 同一个用户里重复的最近会话数量
+	Invalid      int              `json:"invalid"`       // 频道ID为空或者uid和key不一致的最近会话数量
+	Orphans      int              `json:"orphans"`       // 不在uid对应的slot里的用户数量（按uid读取不到）
+	ReservedType int              `json:"reserved_type"` // 频道类型为0的最近会话数量（不算损坏，可以用RepairReservedTypeConversations修复）
+	CorruptUsers int              `json:"corrupt_users"` // 有以上损坏（不包括ReservedType）的用户数量
+	CorruptUIDs  []string         `json:"corrupt_uids"`  // 损坏的用户uid（最多100个）
+	Truncated    bool             `json:"truncated"`     // 抽样检查达到数量或时间上限提前结束
+	Cost         time.Duration    `json:"cost"`
+}
+
+// CorruptRatio 损坏的用户比例
+func (r *StartupCheckReport) CorruptRatio() float64 {
+	if r.Users == 0 {
+		return 0
+	}
+	return float64(r.CorruptUsers) / float64(r.Users)
+}
+
+// StartupCheckReport 打开数据库时检查最近会话数据的结果，没有检查返回nil
+func (f *FileStore) StartupCheckReport() *StartupCheckReport {
+	return f.startupCheckReport
+}
+
+// runStartupCheck 按StartupCheck检查最近会话数据并打印结果，开启StartupCheckFailOnCorruption时损坏的用户比例超过StartupCheckMaxCorruptRatio返回ErrStartupCheckFailed
+func (f *FileStore) runStartupCheck() error {
+	report, err := f.startupCheck()
+	if err != nil {
+		return wrapError("StartupCheck", err, "", "", 0)
+	}
+	f.startupCheckReport = report
+	fields := []zap.Field{
+		zap.String("mode", string(report.Mode)),
+		zap.Int("users", report.Users),
+		zap.Int("rows", report.Rows),
+		zap.Int("undecodable", report.Undecodable),
+		zap.Int("duplicates", report.Duplicates),
+		zap.Int("invalid", report.Invalid),
+		zap.Int("orphans", report.Orphans),
+		zap.Int("reservedType", report.ReservedType),
+		zap.Int("corruptUsers", report.CorruptUsers),
+		zap.Bool("truncated", report.Truncated),
+		zap.Duration("cost", report.Cost),
+	}
+	if report.CorruptUsers == 0 {
+		f.Info("startup check", fields...)
+		return nil
+	}
+	f.Warn("startup check found corrupt conversations", append(fields, zap.Strings("corruptUIDs", report.CorruptUIDs))...)
+	if f.cfg.StartupCheckFailOnCorruption && report.CorruptRatio() > f.cfg.StartupCheckMaxCorruptRatio {
+		return wrapError("StartupCheck", fmt.Errorf("%w: %d of %d users corrupt", ErrStartupCheckFailed, report.CorruptUsers, report.Users), "", "", 0)
+	}
+	return nil
+}
+
+func (f *FileStore) startupCheck() (*StartupCheckReport, error) {
+	start := time.Now()
+	report := &StartupCheckReport{Mode: f.cfg.StartupCheck, CorruptUIDs: make([]string, 0)}
+	ctx := context.Background()
+	limit := 0
+	var startSlot uint32
+	switch f.cfg.StartupCheck {
+	case StartupCheckFull:
+	case StartupCheckSample:
+		limit = f.cfg.StartupCheckSampleKeys
+		if f.cfg.StartupCheckBudget > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, f.cfg.StartupCheckBudget)
+			defer cancel()
+		}
+		startSlot = uint32(rand.Intn(f.cfg.SlotNum)) // 用户按uid分散在slot里，从随机的slot开始连续检查相当于随机抽样
+	default:
+		return nil, fmt.Errorf("unknown startup check mode %q", f.cfg.StartupCheck)
+	}
+	prefix := []byte(f.conversationPrefix)
+	check := func(slot uint32, key, value []byte) error {
+		if limit > 0 && report.Users >= limit {
+			report.Truncated = true
+			return errStopScan
+		}
+		f.checkUserConversations(report, slot, string(key[len(prefix):]), value)
+		return nil
+	}
+	err := f.scanFrom(ctx, prefix, startSlot, nil, check)
+	if err == nil && startSlot > 0 && !report.Truncated { // 回到前面的slot
+		err = f.scanFrom(ctx, prefix, 0, nil, func(slot uint32, key, value []byte) error {
+			if slot >= startSlot {
+				return errStopScan
+			}
+			return check(slot, key, value)
+		})
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		report.Truncated = true
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	report.Cost = time.Since(start)
+	return report, nil
+}
+
+// checkUserConversations 检查一个用户的最近会话数据
+func (f *FileStore) checkUserConversations(report *StartupCheckReport, slot uint32, uid string, value []byte) {
+	report.Users++
+	corrupt := false
+	if slot != f.slotNum(uid) {
+		report.Orphans++
+		corrupt = true
+	}
+	conversations, err := decodeConversations(value, false)
+	if err != nil {
+		report.Undecodable++
+		corrupt = true
+		f.Debug("startup check: decode conversations fail", zap.String("uid", uid), zap.Error(err))
+	}
+	report.Rows += len(conversations)
+	seen := make(map[ConversationKey]struct{}, len(conversations))
+	for _, conversation := range conversations {
+		if conversation.ChannelID == "" || (conversation.UID != "" && conversation.UID != uid) {
+			report.Invalid++
+			corrupt = true
+			continue
+		}
+		if conversation.ChannelType == ReservedChannelType {
+			report.ReservedType++
+		}
+		key := ConversationKey{ChannelID: conversation.ChannelID, ChannelType: conversation.ChannelType}
+		if _, ok := seen[key]; ok {
+			report.Duplicates++
+			corrupt = true
+			continue
+		}
+		seen[key] = struct{}{}
+	}
+	if !corrupt {
+		return
+	}
+	report.CorruptUsers++
+	if len(report.CorruptUIDs) < startupCheckMaxUIDs {
+		report.CorruptUIDs = append(report.CorruptUIDs, uid)
+	}
+}
@@ -0,0 +1,98 @@
+package wkstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+// newStartupCheckStore 写入正常的用户u1、u2和损坏的用户（broken为true时），关闭后返回配置，由调用方按需要的检查方式重新打开
+func newStartupCheckStore(t *testing.T, broken bool) *StoreConfig {
+	cfg := NewStoreConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.ScanBatchSize = 1
+	cfg.ScanBatchBackoff = 0
+	store := NewFileStore(cfg)
+	assert.NoError(t, store.Open())
+	for _, uid := range []string{"u1", "u2"} {
+		assert.NoError(t, store.AddOrUpdateConversations(uid, []*Conversation{
+			{UID: uid, ChannelID: "g1", ChannelType: 2, UnreadCount: 1, Version: 1},
+			{UID: uid, ChannelID: "g2", ChannelType: 2, Version: 1},
+		}))
+	}
+	if broken {
+		assert.NoError(t, store.update(func(t *bolt.Tx) error {
+			bucket, err := store.getSlotBucketWithKey("u3", t)
+			if err != nil {
+				return err
+			}
+			// 同一个频道重复的最近会话
+			return bucket.Put([]byte(store.getConversationKey("u3")), store.encodeConversations([]*Conversation{
+				{UID: "u3", ChannelID: "g1", ChannelType: 2, Version: 1},
+				{UID: "u3", ChannelID: "g1", ChannelType: 2, Version: 2},
+			}))
+		}))
+	}
+	assert.NoError(t, store.Close())
+	return cfg
+}
+
+func TestStartupCheckClean(t *testing.T) {
+	cfg := newStartupCheckStore(t, false)
+	cfg.StartupCheck = StartupCheckFull
+	cfg.StartupCheckFailOnCorruption = true
+	store := NewFileStore(cfg)
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	report := store.StartupCheckReport()
+	assert.Equal(t, 2, report.Users)
+	assert.Equal(t, 4, report.Rows)
+	assert.Equal(t, 0, report.CorruptUsers)
+	assert.False(t, report.Truncated)
+}
+
+func TestStartupCheckCorruptBelowThreshold(t *testing.T) {
+	cfg := newStartupCheckStore(t, true)
+	cfg.StartupCheck = StartupCheckFull
+	cfg.StartupCheckFailOnCorruption = true
+	cfg.StartupCheckMaxCorruptRatio = 0.5
+	store := NewFileStore(cfg)
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	report := store.StartupCheckReport()
+	assert.Equal(t, 3, report.Users)
+	assert.Equal(t, 1, report.Duplicates)
+	assert.Equal(t, 1, report.CorruptUsers)
+	assert.Equal(t, []string{"u3"}, report.CorruptUIDs)
+}
+
+func TestStartupCheckCorruptAboveThreshold(t *testing.T) {
+	cfg := newStartupCheckStore(t, true)
+	cfg.StartupCheck = StartupCheckFull
+	cfg.StartupCheckFailOnCorruption = true
+	cfg.StartupCheckMaxCorruptRatio = 0.1
+	store := NewFileStore(cfg)
+	assert.ErrorIs(t, store.Open(), ErrStartupCheckFailed)
+
+	// 关闭了拒绝打开时只记录
+	cfg.StartupCheckFailOnCorruption = false
+	store = NewFileStore(cfg)
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	assert.Equal(t, 1, store.StartupCheckReport().CorruptUsers)
+}
+
+func TestStartupCheckSampleLimit(t *testing.T) {
+	cfg := newStartupCheckStore(t, true)
+	cfg.StartupCheck = StartupCheckSample
+	cfg.StartupCheckSampleKeys = 1
+	cfg.StartupCheckBudget = time.Second
+	store := NewFileStore(cfg)
+	assert.NoError(t, store.Open())
+	defer store.Close()
+	report := store.StartupCheckReport()
+	assert.Equal(t, 1, report.Users)
+	assert.True(t, report.Truncated)
+}
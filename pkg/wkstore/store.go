@@ -1,5 +1,11 @@
 package wkstore
 
+import (
+	"context"
+	"io"
+	"time"
+)
+
 type Store interface {
 	Open() error
 	Close() error
@@ -73,9 +79,109 @@ type Store interface {
 
 	// #################### conversations ####################
 	AddOrUpdateConversations(uid string, conversations []*Conversation) error
+	// AddOrUpdateConversationsWithVersions 添加或更新最近会话，返回版本号被修正（保证单调递增）的最近会话和修正后的版本号，缓存了最近会话的调用方用来更新缓存
+	AddOrUpdateConversationsWithVersions(uid string, conversations []*Conversation) (map[ConversationKey]int64, error)
 	GetConversations(uid string) ([]*Conversation, error)
 	GetConversation(uid string, channelID string, channelType uint8) (*Conversation, error)
 	DeleteConversation(uid string, channelID string, channelType uint8) error // 删除最近会话
+	// IncConversationUnreadCount 原子地给最近会话的未读数加上delta（最小为0），最近会话不存在且createIfMissing为true时新建，返回修改后的最近会话
+	IncConversationUnreadCount(uid string, channelID string, channelType uint8, delta int, createIfMissing bool) (*Conversation, error)
+	// UpdateConversationsReadToMsgSeq 批量设置用户在多个频道已读到的消息位置并修正未读数，已经读到更后面的不修改，CreateIfMissing时创建不存在的最近会话，返回有修改的最近会话
+	UpdateConversationsReadToMsgSeq(uid string, items []ConversationReadTo) ([]ConversationKey, error)
+	// ImportReadPositions 从其他系统批量导入已读位置（csv或ndjson，每行一条），不存在的最近会话创建，格式错误的行跳过，可以重复导入
+	ImportReadPositions(r io.Reader, opts MaintenanceOptions) (*ReadPositionImportResult, error)
+	// ExportConversations 把用户的所有最近会话按json lines写入w，返回导出的数量
+	ExportConversations(uid string, w io.Writer) (int, error)
+	// ImportConversations 导入ExportConversations导出的最近会话，已存在的overwrite为true时覆盖否则跳过
+	ImportConversations(r io.Reader, overwrite bool) (*ConversationImportResult, error)
+	// SetConversationPinned 置顶或取消置顶最近会话，返回修改后的最近会话，最近会话不存在返回ErrNotFound
+	SetConversationPinned(uid string, channelID string, channelType uint8, pinned bool) (*Conversation, error)
+	// SetConversationMute 设置最近会话的免打扰（1开启，0关闭），返回修改后的最近会话，最近会话不存在返回ErrNotFound
+	SetConversationMute(uid string, channelID string, channelType uint8, mute uint8) (*Conversation, error)
+	// GetConversationExtra 获取最近会话的扩展数据，最近会话不存在返回ErrNotFound
+	GetConversationExtra(uid string, channelID string, channelType uint8) (map[string]string, error)
+	// SetConversationExtra 替换最近会话的扩展数据，返回修改后的最近会话，最近会话不存在返回ErrNotFound
+	SetConversationExtra(uid string, channelID string, channelType uint8, extra map[string]string) (*Conversation, error)
+	// SetConversationArchived 归档或取消归档最近会话（不影响未读数），返回修改后的最近会话，最近会话不存在返回ErrNotFound
+	SetConversationArchived(uid string, channelID string, channelType uint8, archived bool) (*Conversation, error)
+	// GetArchivedConversations 用户已归档的最近会话，按最后一条消息的时间从新到旧，limit<=0表示不限制
+	GetArchivedConversations(uid string, limit int) ([]*Conversation, error)
+	// IncConversationMentionCount 增加（delta为负数时减少，最小为0）最近会话的提及数量，返回修改后的最近会话，最近会话不存在返回ErrNotFound
+	IncConversationMentionCount(uid string, channelID string, channelType uint8, delta int) (*Conversation, error)
+	// UpdateConversationLastMsg 更新最近会话的最后一条消息，只有messageSeq比存储的大时才修改，返回是否有修改，最近会话不存在返回ErrNotFound
+	UpdateConversationLastMsg(uid string, channelID string, channelType uint8, messageSeq uint32, clientMsgNo string, timestamp int64) (bool, error)
+	// GetConversationUnreadDigest 用户有未读消息的最近会话摘要，按最后一次会话的时间从新到旧，最多topN个（topN<=0表示不限制）
+	GetConversationUnreadDigest(uid string, topN int) ([]*ConversationUnreadDigest, error)
+	// GetConversationsUpdatedSince 用户版本号大于sinceVersion的最近会话和删除记录（按版本号从小到大），客户端用返回的Version继续增量同步
+	GetConversationsUpdatedSince(uid string, sinceVersion uint64, limit int) (*ConversationChanges, error)
+	// RecalculateConversationUnread 按已读位置（LastMsgSeq-UnreadCount）和频道最新的messageSeq重新计算用户所有最近会话的未读数，只写入有变化的，返回修正的最近会话
+	RecalculateConversationUnread(uid string, resolver func(channelID string, channelType uint8) (uint32, error)) (*ConversationUnreadReport, error)
+	// GetConversationFirstUnread 用户在频道里第一条未读并且还存在的消息seq，没有未读返回false，最近会话不存在返回ErrNotFound
+	GetConversationFirstUnread(uid string, channelID string, channelType uint8) (uint32, bool, error)
+	// GetConversationsFirstUnread 批量获取用户在多个频道里第一条未读并且还存在的消息seq，没有未读的不在结果里
+	GetConversationsFirstUnread(uid string, keys []ConversationKey) (map[ConversationKey]uint32, error)
+	// GetConversationVersion 用户最近会话的版本号，最近会话每次有变化加1（和修改在同一个事务里），客户端用来判断最近会话有没有变化
+	GetConversationVersion(uid string) (uint64, error)
+	// ExistConversation 是否存在最近会话
+	ExistConversation(uid string, channelID string, channelType uint8) (bool, error)
+	// ExistConversations 批量判断最近会话是否存在，返回结果的key为items的下标
+	ExistConversations(items []ConversationKey) (map[int]bool, error)
+	// AddOrUpdateConversationsBatchIfNotExist 批量添加多个用户的最近会话，已存在的最近会话不做处理，有用户写入失败时继续写入其他用户，result里是写入成功和失败的最近会话
+	AddOrUpdateConversationsBatchIfNotExist(conversations []*Conversation) (*ConversationBatchResult, error)
+	// MemoryUsage 存储层占用内存的估算，同时按配置的内存预算更新内存压力等级
+	MemoryUsage() MemoryUsage
+	// MemoryPressure 最后一次检查的内存压力等级
+	MemoryPressure() MemoryPressureLevel
+	// ConversationStats 抽样统计最近会话的分布情况，sampleUsers<=0表示统计所有用户
+	ConversationStats(ctx context.Context, sampleUsers int) (*ConversationStatsReport, error)
+	// ConversationOpStats 按频道类型统计的最近会话操作次数（新增、更新、已读、删除），只返回有操作的频道类型
+	ConversationOpStats() []ConversationOpCounts
+	// SearchConversations 按条件搜索最近会话（后台管理用），先过滤再分页
+	SearchConversations(ctx context.Context, req ConversationSearchReq) (*ConversationSearchResult, error)
+	// OnMessagesExpired 频道内messageSeq<=uptoSeq的消息过期后，修正本地用户的最近会话（未读数和最后一条消息），返回涉及的最近会话
+	OnMessagesExpired(channelID string, channelType uint8, uptoSeq uint32) ([]ConversationKey, error)
+	// OnMessageRecalled 频道内messageSeq的消息撤回后，修正本地用户的最近会话（未读数和最后一条消息），返回涉及的最近会话（同一条消息重复撤回时返回空）
+	OnMessageRecalled(channelID string, channelType uint8, messageSeq uint32) ([]ConversationKey, error)
+	// OnMessageEdited 频道内messageSeq的消息编辑后，更新最后一条消息是它的本地用户最近会话的数据版本，返回涉及的最近会话
+	OnMessageEdited(channelID string, channelType uint8, messageSeq uint32) ([]ConversationKey, error)
+	// RefreshConversationChannelInfo 频道名称或头像修改后，刷新本地用户最近会话里冗余的频道信息，返回涉及的最近会话
+	RefreshConversationChannelInfo(channelID string, channelType uint8, name string, avatar string) ([]ConversationKey, error)
+	// MigrateConversationsChannel 频道迁移到新的频道id后，把本地用户的最近会话和订阅关系迁移到新频道（可重复调用继续迁移），返回迁移后的最近会话
+	// opts.DryRun为true时只返回会迁移的最近会话
+	MigrateConversationsChannel(oldChannelID string, oldChannelType uint8, newChannelID string, newChannelType uint8, opts MaintenanceOptions) ([]ConversationKey, error)
+	// RunConversationCleanup 删除超过ConversationTTL的最近会话，每次最多执行ConversationCleanupBudget，没扫描完的下次继续，返回删除的最近会话
+	RunConversationCleanup(now time.Time) (*ConversationCleanupResult, error)
+	// DeleteUserData 依次调用删除用户的清理钩子（RegisterUserCleanup），删除最近会话，订阅关系，快照等引用了此用户的数据
+	DeleteUserData(uid string, opts MaintenanceOptions) (*CleanupReport, error)
+	// DeleteChannelData 依次调用删除频道的清理钩子（RegisterChannelCleanup），删除本地用户的最近会话，订阅关系等引用了此频道的数据
+	DeleteChannelData(channelID string, channelType uint8, opts MaintenanceOptions) (*CleanupReport, error)
+	// AddOrUpdateConversationsCAS 添加或更新最近会话，每条最近会话当前的版本号和期望的一致才写入（都一致才写入），不一致返回*VersionConflictError
+	AddOrUpdateConversationsCAS(uid string, items []ConversationCAS) ([]*Conversation, error)
+	// RepairReservedTypeConversations 按频道信息表修正频道类型为0（ReservedChannelType）的最近会话，推断不出频道类型的移到隔离区
+	// opts.DryRun为true时只返回会修正和隔离的最近会话
+	RepairReservedTypeConversations(ctx context.Context, opts MaintenanceOptions) (*ReservedTypeReport, error)
+	// ListQuarantinedConversations 用户被隔离的频道类型为0的最近会话
+	ListQuarantinedConversations(uid string) ([]*Conversation, error)
+	// SlotCount slot的数量
+	SlotCount() int
+	// IterateConversations 遍历用户符合条件的最近会话（一个快照），fn返回false时停止，其他模块遍历最近会话应该用它，不要直接解析存储的数据
+	IterateConversations(uid string, opts ConversationIterOptions, fn func(Conversation) bool) error
+	// IterateAllConversations 分批遍历slot下所有用户符合条件的最近会话，可以限速，fn返回false时停止
+	IterateAllConversations(slot uint32, opts ConversationIterOptions, fn func(Conversation) bool) error
+	// DeleteConversationsByChannel 删除本地用户在此频道的最近会话和订阅关系（比如群解散），返回删除了最近会话的用户数量
+	DeleteConversationsByChannel(channelID string, channelType uint8) (int, error)
+	// OnUserLeftChannel 用户离开频道，移除订阅关系并按策略删除或冻结最近会话
+	OnUserLeftChannel(uid string, channelID string, channelType uint8) error
+	// OnUserJoinedChannel 用户重新加入频道，恢复冻结的最近会话
+	OnUserJoinedChannel(uid string, channelID string, channelType uint8) error
+	// SnapshotUserConversations 保存用户当前最近会话的快照，返回快照id
+	SnapshotUserConversations(uid string) (string, error)
+	// ListUserConversationSnapshots 用户的最近会话快照，按时间从新到旧
+	ListUserConversationSnapshots(uid string) ([]*ConversationSnapshot, error)
+	// RestoreUserConversations 用快照覆盖用户当前的最近会话
+	RestoreUserConversations(uid string, snapshotID string) error
+	// DeleteUserConversationSnapshots 删除用户的所有最近会话快照
+	DeleteUserConversationSnapshots(uid string) error
 
 	// #################### system uids ####################
 	AddSystemUIDs(uids []string) error    // 添加系统uid